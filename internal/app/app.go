@@ -1,19 +1,26 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/encryption"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/server"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/tlsconfig"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/livekit"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/utils"
 	"github.com/coreos/go-systemd/daemon"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
@@ -24,15 +31,22 @@ var (
 	app config.App
 
 	flags struct {
-		config  string
-		dump    string
-		help    bool
-		version bool
+		config   string
+		dump     string
+		recover  string
+		inspect  string
+		decrypt  string
+		replay   string
+		tracks   []string
+		selfTest bool
+		help     bool
+		version  bool
 	}
 
 	cfg *config.Config
 	ps  pubsub.PubSub
 	sv  *server.Server
+	gs  *server.GRPCServer
 )
 
 func init() {
@@ -43,6 +57,12 @@ func init() {
 
 	flag.StringVarP(&flags.config, "config", "c", flags.config, "load configuration file")
 	flag.StringVar(&flags.dump, "dump", "", "print config value (e.g. 'recorder.directory')")
+	flag.StringVar(&flags.recover, "recover", "", "finalize a WebM/MKV recording left unfinished by a crash")
+	flag.StringVar(&flags.inspect, "inspect", "", "summarize a recording from its sidecar, given either; exits 2 on anomalies")
+	flag.StringVar(&flags.decrypt, "decrypt", "", "decrypt a recording or sidecar encrypted with the configured key (recorder.encryption) to stdout")
+	flag.StringVar(&flags.replay, "replay", "", "replay an rtpdump capture through the LiveKit adapter into a recording next to it, printing the stats")
+	flag.StringArrayVar(&flags.tracks, "replay-track", nil, "track of the --replay capture, as <payload type>=<mime type> (e.g. 111=audio/opus)")
+	flag.BoolVar(&flags.selfTest, "self-test", false, "record a synthetic VP8+Opus stream to the recordings directory, checking the file and stats, then print them; exits 1 on failure")
 	flag.BoolVarP(&flags.help, "help", "h", flags.help, "print help")
 	flag.BoolVarP(&flags.version, "version", "v", flags.version, "print version")
 	flag.Parse()
@@ -65,6 +85,35 @@ func init() {
 		dumpConfig()
 	}
 
+	if flags.recover != "" {
+		recoverRecording()
+	}
+
+	if flags.inspect != "" {
+		inspectRecording()
+	}
+
+	if flags.decrypt != "" {
+		log.SetLevel(log.FatalLevel)
+		cfg = initConfig()
+		loadConfig()
+		decryptFile()
+	}
+
+	if flags.replay != "" {
+		log.SetLevel(log.WarnLevel)
+		cfg = initConfig()
+		loadConfig()
+		replayCapture()
+	}
+
+	if flags.selfTest {
+		log.SetLevel(log.WarnLevel)
+		cfg = initConfig()
+		loadConfig()
+		selfTest()
+	}
+
 	Init()
 	Run()
 }
@@ -74,7 +123,7 @@ func Init() {
 	log.Infof("Starting %s PID: %d", app.Name, os.Getpid())
 	loadConfig()
 	configureLog()
-	sigintHandler()
+	shutdownSignalHandler()
 	sighupHandler()
 }
 
@@ -86,6 +135,12 @@ func Run() {
 		appstats.ServePromMetrics(cfg.Prometheus)
 	}
 
+	health := server.NewHealthServer(cfg)
+
+	if cfg.Health.Enable {
+		health.Serve()
+	}
+
 	ps = pubsub.NewPubSub(cfg.PubSub)
 
 	if err := ps.Check(); err != nil {
@@ -96,6 +151,107 @@ func Run() {
 		log.Fatalf("failed to check recorder filesystem permissions: %v", err)
 	}
 
+	if cfg.Recorder.PathTemplate != "" {
+		if _, err := recorder.ParsePathTemplate(cfg.Recorder.PathTemplate); err != nil {
+			log.Fatalf("invalid recording path template: %v", err)
+		}
+	}
+
+	if err := recorder.ValidateClockRates(cfg.Recorder.ClockRates); err != nil {
+		log.Fatalf("invalid clock rate override: %v", err)
+	}
+
+	if err := utils.ValidateHeaderExtensions(cfg.WebRTC.HeaderExtensions); err != nil {
+		log.Fatalf("invalid WebRTC header extensions: %v", err)
+	}
+
+	if err := utils.ValidateHeaderExtensions(cfg.LiveKit.HeaderExtensions); err != nil {
+		log.Fatalf("invalid LiveKit header extensions: %v", err)
+	}
+
+	if err := recorder.ValidateFileCollision(cfg.Recorder.FileCollision); err != nil {
+		log.Fatalf("invalid recorder configuration: %v", err)
+	}
+
+	if err := recorder.ValidateOpusEncoder(cfg.Recorder.OpusEncoder); err != nil {
+		log.Fatalf("invalid recorder opus encoder configuration: %v", err)
+	}
+
+	if err := recorder.ValidateProxy(cfg.Recorder.Proxy); err != nil {
+		log.Fatalf("invalid recorder proxy configuration: %v", err)
+	}
+
+	if err := recorder.ValidateRawOutput(cfg.Recorder.RawOutput); err != nil {
+		log.Fatalf("invalid recorder raw output configuration: %v", err)
+	}
+
+	if err := recorder.ValidateSnapshots(cfg.Recorder.Snapshots); err != nil {
+		log.Fatalf("invalid recorder snapshots configuration: %v", err)
+	}
+
+	if err := recorder.ValidateReorderTolerance(cfg.Recorder.ReorderTolerance); err != nil {
+		log.Fatalf("invalid recorder reorder tolerance configuration: %v", err)
+	}
+
+	if err := recorder.ValidateAVSync(cfg.Recorder.AVSync); err != nil {
+		log.Fatalf("invalid recorder A/V sync configuration: %v", err)
+	}
+
+	if err := recorder.ValidateEncryption(cfg.Recorder); err != nil {
+		log.Fatalf("invalid recorder encryption configuration: %v", err)
+	}
+
+	if err := recorder.ValidateCues(cfg.Recorder.Cues); err != nil {
+		log.Fatalf("invalid recorder cues configuration: %v", err)
+	}
+
+	for key, rate := range cfg.Recorder.ClockRates {
+		log.Infof("RTP clock rate override for %s: %d Hz", key, rate)
+	}
+
+	if cfg.Recorder.AudioOnlyWAV {
+		if err := recorder.ValidateWAVConfig(cfg.Recorder.WAV); err != nil {
+			log.Fatalf("invalid WAV recording configuration: %v", err)
+		}
+	}
+
+	if err := server.ValidateCapacity(cfg.Capacity); err != nil {
+		log.Fatalf("invalid capacity configuration: %v", err)
+	}
+
+	if err := livekit.ValidateReceiveQueue(cfg.LiveKit.ReceiveQueue); err != nil {
+		log.Fatalf("invalid LiveKit receive queue configuration: %v", err)
+	}
+
+	if err := livekit.ValidateAdaptiveQuality(cfg.LiveKit.AdaptiveQuality); err != nil {
+		log.Fatalf("invalid LiveKit adaptive quality configuration: %v", err)
+	}
+
+	if err := livekit.ValidateDisabledTracks(cfg.LiveKit.DisabledTracks); err != nil {
+		log.Fatalf("invalid LiveKit disabled tracks configuration: %v", err)
+	}
+
+	if err := livekit.ConfigureTLS(cfg.LiveKit); err != nil {
+		log.Fatalf("invalid LiveKit TLS configuration: %v", err)
+	}
+
+	endpoints := []struct {
+		name   string
+		enable bool
+		tls    config.TLS
+	}{
+		{"http", cfg.HTTP.Enable, cfg.HTTP.TLS},
+		{"prometheus", cfg.Prometheus.Enable, cfg.Prometheus.TLS},
+		{"health", cfg.Health.Enable, cfg.Health.TLS},
+		{"grpc", cfg.GRPC.Enable, cfg.GRPC.TLS},
+	}
+
+	for _, endpoint := range endpoints {
+		if _, err := tlsconfig.Server(endpoint.tls); endpoint.enable && err != nil {
+			log.Fatalf("invalid %s TLS configuration: %v", endpoint.name, err)
+		}
+	}
+
 	if cfg.LiveKit.HealthCheck.Enable {
 		log.WithField("interval", cfg.LiveKit.HealthCheck.Interval).
 			WithField("host", cfg.LiveKit.Host).
@@ -138,26 +294,199 @@ func Run() {
 		hs.Serve()
 	}
 
+	if cfg.Recorder.Recovery.Enable {
+		go server.RecoverInterrupted(cfg.Recorder.Directory)
+	}
+
 	sv = server.NewServer(cfg, ps)
+	health.SetSessions(sv.Sessions())
+
+	if cfg.GRPC.Enable {
+		var err error
+
+		if gs, err = server.NewGRPCServer(cfg, sv); err != nil {
+			log.Fatalf("failed to start gRPC server: %s", err)
+		}
+
+		if err := gs.Serve(); err != nil {
+			log.Fatalf("failed to start gRPC server: %s", err)
+		}
+	}
 
 	if err := ps.Subscribe(cfg.PubSub.Channels.Subscribe, sv.HandlePubSubMsg, sv.OnStart); err != nil {
 		log.Fatalf("failed to subscribe to pubsub %s: %s", cfg.PubSub.Channels.Subscribe, err)
 	}
 }
 
-func shutdown(code int) {
-	if ps != nil {
-		if err := ps.Close(); err != nil {
-			log.Errorf("failed to close pubsub: %s", err)
+// recoverRecording finalizes the recording given with --recover, then exits
+func recoverRecording() {
+	result, err := recorder.RecoverWebM(flags.recover)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to recover %s: %s\n", flags.recover, err)
+		shutdown(1)
+	}
+
+	fmt.Printf("recovered %s: %s in %d clusters, %d blocks, %d bytes dropped\n",
+		flags.recover, result.Duration, result.Clusters, result.Blocks, result.DroppedBytes)
+	shutdown(0)
+}
+
+// inspectRecording prints the summary of the recording given with
+// --inspect, then exits
+func inspectRecording() {
+	inspection, err := server.InspectRecording(flags.inspect)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to inspect %s: %s\n", flags.inspect, err)
+		shutdown(1)
+	}
+
+	inspection.Print(os.Stdout)
+
+	if len(inspection.Anomalies) > 0 {
+		shutdown(2)
+	}
+
+	shutdown(0)
+}
+
+// decryptFile writes the plaintext of the file given with --decrypt to
+// stdout, then exits
+func decryptFile() {
+	key, err := encryption.Load(cfg.Recorder.Encryption)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to decrypt %s: %s\n", flags.decrypt, err)
+		shutdown(1)
+	}
+
+	f, err := os.Open(flags.decrypt)
+
+	if err == nil {
+		defer f.Close()
+		err = encryption.Decrypt(os.Stdout, f, key)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to decrypt %s: %s\n", flags.decrypt, err)
+		shutdown(1)
+	}
+
+	shutdown(0)
+}
+
+// replayCapture replays the capture given with --replay into a recording
+// named after it, prints the result, then exits
+func replayCapture() {
+	var tracks []livekit.ReplayTrack
+
+	for _, spec := range flags.tracks {
+		track, err := livekit.ParseReplayTrack(spec)
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to replay %s: %s\n", flags.replay, err)
+			shutdown(1)
 		}
+
+		tracks = append(tracks, track)
+	}
+
+	if len(tracks) == 0 {
+		fmt.Fprintf(os.Stderr, "failed to replay %s: no --replay-track given\n", flags.replay)
+		shutdown(1)
+	}
+
+	f, err := os.Open(flags.replay)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to replay %s: %s\n", flags.replay, err)
+		shutdown(1)
+	}
+
+	packets, err := livekit.ReadRTPDump(f)
+	_ = f.Close()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read %s: %s\n", flags.replay, err)
+		shutdown(1)
+	}
+
+	recCfg := cfg.Recorder
+	recCfg.Directory = filepath.Dir(flags.replay)
+	name := strings.TrimSuffix(filepath.Base(flags.replay), filepath.Ext(flags.replay)) + ".replay.webm"
+	ctx := context.WithValue(context.Background(), "session", "replay")
+	rec, err := recorder.NewRecorder(ctx, recCfg, name)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to replay %s: %s\n", flags.replay, err)
+		shutdown(1)
+	}
+
+	result, err := livekit.Replay(ctx, cfg.LiveKit, rec, tracks, packets)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to replay %s: %s\n", flags.replay, err)
+		shutdown(1)
+	}
+
+	fmt.Printf("replayed %d packets of %s into %s\n", len(packets), flags.replay, rec.GetFilePath())
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(result)
+	shutdown(0)
+}
+
+// selfTestDuration is how long the stream --self-test records lasts
+const selfTestDuration = 5 * time.Second
+
+// selfTest records a synthetic stream to the recordings directory, with
+// the configured recorder and adapter, prints what it checked, then exits.
+// The recording is removed if it passed, left for inspection otherwise.
+func selfTest() {
+	recCfg := recorder.VerifiableConfig(cfg.Recorder)
+	name := fmt.Sprintf("selftest-%s.webm", uuid.New().String())
+	ctx := context.WithValue(context.Background(), "session", "selftest")
+	rec, err := recorder.NewRecorder(ctx, recCfg, name)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "self-test failed: %s\n", err)
+		shutdown(1)
+	}
+
+	result, err := livekit.SelfTest(ctx, cfg.LiveKit, rec, selfTestDuration)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(result)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "self-test failed: %s (recording left at %s)\n", err, rec.GetFilePath())
+		shutdown(1)
 	}
 
+	_ = os.Remove(rec.GetFilePath())
+	fmt.Println("self-test passed")
+	shutdown(0)
+}
+
+func shutdown(code int) {
+	// Sessions publish their stop events, so pubsub is closed after them
 	if sv != nil {
 		if err := sv.Close(); err != nil {
 			log.Errorf("failed to close server: %s", err)
 		}
 	}
 
+	if gs != nil {
+		gs.Stop()
+	}
+
+	if ps != nil {
+		if err := ps.Close(); err != nil {
+			log.Errorf("failed to close pubsub: %s", err)
+		}
+	}
+
 	os.Exit(code)
 }
 
@@ -176,11 +505,20 @@ func sighupHandler() {
 	}()
 }
 
-func sigintHandler() {
-	sigint := make(chan os.Signal, 1)
-	signal.Notify(sigint, os.Interrupt)
+func shutdownSignalHandler() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-sigint
-		shutdown(0)
+		log.Infof("received %s, finalizing active recordings", <-sig)
+
+		if _, err := daemon.SdNotify(false, daemon.SdNotifyStopping); err != nil {
+			log.Warnf("failed to notify stopping to systemd: %v", err)
+		}
+
+		go shutdown(0)
+
+		// A second signal skips draining
+		log.Warnf("received %s again, exiting without draining", <-sig)
+		os.Exit(1)
 	}()
 }
@@ -6,15 +6,40 @@ import (
 	"path"
 	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/logging"
 	log "github.com/sirupsen/logrus"
 )
 
+var sessionHookOnce sync.Once
+
 func configureLog() {
 	log.SetOutput(os.Stdout)
 
-	if isTty() {
+	// Tags the lines of each recording with its track IDs
+	sessionHookOnce.Do(func() {
+		log.AddHook(logging.SessionHook{})
+	})
+
+	format := strings.ToLower(cfg.Log.Format)
+
+	switch format {
+	case logging.FormatJSON, logging.FormatConsole:
+	default:
+		if format != "" && format != logging.FormatAuto {
+			log.Warnf("Invalid log format '%s', defaulting to auto", cfg.Log.Format)
+		}
+
+		format = logging.FormatJSON
+
+		if isTty() {
+			format = logging.FormatConsole
+		}
+	}
+
+	if format == logging.FormatConsole {
 		log.SetFormatter(&log.TextFormatter{
 			CallerPrettyfier: func(f *runtime.Frame) (string, string) {
 				filename := path.Base(f.File)
@@ -20,8 +20,200 @@ type AdapterTrackStats struct {
 	FirstSeqNum       uint16 `json:"firstSeqNum"`
 	LastSeqNum        uint16 `json:"lastSeqNum"`
 	SeqNumWrapArounds int    `json:"seqNumWrapArounds"`
-	PLIRequests       int    `json:"pliRequests"`
-	RTPReadErrors     int    `json:"rtpReadErrors"`
+	// Packets that went through the sample buffer, and the fraction (0-1) of
+	// the sequence number span (see SeqNumSpan) they're missing
+	SeqNumPackets uint64  `json:"seqNumPackets"`
+	LossFraction  float64 `json:"lossFraction"`
+	PLIRequests   int     `json:"pliRequests"`
+	// Full Intra Requests sent once PLIs went unanswered (see config.FIR)
+	FIRRequests   int `json:"firRequests"`
+	RTPReadErrors int `json:"rtpReadErrors"`
+	// Reads failed in a row so far and the resubscriptions persistent
+	// failures led to (see config.ReadErrors)
+	ConsecutiveReadErrors int `json:"consecutiveReadErrors"`
+	Resubscriptions       int `json:"resubscriptions,omitempty"`
+	// Room reconnections the track survived and the packets lost across them
+	// (and across resubscriptions)
+	Reconnects          int    `json:"reconnects"`
+	ReconnectGapPackets uint64 `json:"reconnectGapPackets"`
+	// Receiver-side network quality (RFC 3550), refreshed as RTP/RTCP is read
+	PacketsReceived  uint64  `json:"packetsReceived,omitempty"`
+	PacketsLost      int64   `json:"packetsLost,omitempty"`
+	JitterMs         float64 `json:"jitterMs,omitempty"`
+	SenderReports    int     `json:"senderReports,omitempty"`
+	LastSenderReport int64   `json:"lastSenderReport,omitempty"` // Unix ms
+	// Packets carrying the transport-wide congestion control extension,
+	// those that arrived after a packet sent later, and the variation of
+	// their arrival spacing. Unlike JitterMs it doesn't depend on the
+	// sender's clock. Only when the extension is negotiated.
+	TWCCPackets          uint64  `json:"twccPackets,omitempty"`
+	TWCCReorderedPackets uint64  `json:"twccReorderedPackets,omitempty"`
+	TWCCJitterMs         float64 `json:"twccJitterMs,omitempty"`
+	// Bytes received (RTP header + payload, retransmits counted once) and
+	// the bitrates over the recording
+	BytesReceived  uint64 `json:"bytesReceived,omitempty"`
+	AvgBitrateBps  uint64 `json:"avgBitrateBps,omitempty"`
+	PeakBitrateBps uint64 `json:"peakBitrateBps,omitempty"`
+	// Frames of end-to-end encrypted tracks dropped as undecryptable
+	DecryptFailures uint64 `json:"decryptFailures,omitempty"`
+	// Packets flushed to the recorder before they were due because the
+	// sample buffer hit its limits (see config.Limits)
+	LatePackets uint64 `json:"latePackets,omitempty"`
+	// Samples dropped because the receive queue was full, and the most
+	// samples waiting in it at once (see config.ReceiveQueue)
+	ReceiveQueueOverflows uint64 `json:"receiveQueueOverflows,omitempty"`
+	ReceiveQueueMaxDepth  int    `json:"receiveQueueMaxDepth,omitempty"`
+	// Packets received more than once, dropped as duplicates
+	DuplicatePackets uint64 `json:"duplicatePackets,omitempty"`
+	// Packets recovered from RFC 4588 retransmissions (RTX)
+	RTXRecoveredPackets uint64 `json:"rtxRecoveredPackets,omitempty"`
+	// NACKs sent (see config.NACK) and the packets they asked for
+	NACKRequests  int    `json:"nackRequests,omitempty"`
+	NACKedPackets uint64 `json:"nackedPackets,omitempty"`
+	// The first and latest RTP/NTP correlations from Sender Reports, to
+	// align the track to absolute time (see config.LiveKit.RecordNTPMapping)
+	FirstNTPMapping *NTPMapping `json:"firstNtpMapping,omitempty"`
+	LastNTPMapping  *NTPMapping `json:"lastNtpMapping,omitempty"`
+	// Times the publisher muted the track, whether it is now, and when the
+	// latest mutes were (the last 100)
+	Mutes         int            `json:"mutes,omitempty"`
+	Muted         bool           `json:"muted,omitempty"`
+	MuteIntervals []MuteInterval `json:"muteIntervals,omitempty"`
+	// The current minimum interval between keyframe requests and its latest
+	// changes (the last 100), if it adapts to loss (see
+	// config.AdaptiveKeyframeInterval)
+	KeyframeIntervalMs      int64                    `json:"keyframeIntervalMs,omitempty"`
+	KeyframeIntervalChanges []KeyframeIntervalChange `json:"keyframeIntervalChanges,omitempty"`
+	// The simulcast layer subscribed to and its latest switches (the last
+	// 100), if it adapts to the bitrate budget (see config.AdaptiveQuality)
+	Quality         string          `json:"quality,omitempty"`
+	QualitySwitches []QualitySwitch `json:"qualitySwitches,omitempty"`
+	// Whether recording the track is disabled at runtime, and the latest
+	// periods it was (the last 100)
+	RecordingDisabled bool               `json:"recordingDisabled,omitempty"`
+	DisabledIntervals []DisabledInterval `json:"disabledIntervals,omitempty"`
+
+	// The SSRCs the track's packets came with (the last 16), and the times
+	// it switched SSRC; sequence numbers above are those recorded, spliced
+	// across SSRCs
+	SSRCs       []SSRCStats `json:"ssrcs,omitempty"`
+	SSRCChanges int         `json:"ssrcChanges,omitempty"`
+
+	// Whether FirstSeqNum has been set - internal, not marshaled
+	HasSeqNum bool `json:"-"`
+}
+
+// SSRCStats describes the packets of one of a track's SSRCs, as received.
+// FirstSeen and LastSeen are in Unix ms.
+type SSRCStats struct {
+	SSRC        uint32 `json:"ssrc"`
+	Packets     uint64 `json:"packets"`
+	FirstSeqNum uint16 `json:"firstSeqNum"`
+	LastSeqNum  uint16 `json:"lastSeqNum"`
+	FirstSeen   int64  `json:"firstSeen"`
+	LastSeen    int64  `json:"lastSeen"`
+	// Late packets dropped after the track switched to another SSRC
+	StalePackets uint64 `json:"stalePackets,omitempty"`
+}
+
+// MuteInterval is a period a track was muted at the source, in Unix ms.
+// End is 0 while it still is.
+type MuteInterval struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end,omitempty"`
+}
+
+// DisabledInterval is a period recording a track was disabled for, in Unix
+// ms. End is 0 while it still is.
+type DisabledInterval struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end,omitempty"`
+}
+
+// KeyframeIntervalChange is when the keyframe request interval of a track
+// changed to IntervalMs, with LossFraction the recent loss rate it adapted
+// to. Time is in Unix ms.
+type KeyframeIntervalChange struct {
+	Time         int64   `json:"time"`
+	IntervalMs   int64   `json:"intervalMs"`
+	LossFraction float64 `json:"lossFraction"`
+}
+
+// QualitySwitch is when a video track switched to the simulcast layer of
+// Quality (Width x Height), for Reason: "initial" when subscribed to,
+// "over_budget" or "under_budget" as measured at BitrateBps over the last
+// interval against BudgetBps, its share. Time is in Unix ms.
+type QualitySwitch struct {
+	Time       int64  `json:"time"`
+	Quality    string `json:"quality"`
+	Width      uint32 `json:"width,omitempty"`
+	Height     uint32 `json:"height,omitempty"`
+	Reason     string `json:"reason"`
+	BitrateBps uint64 `json:"bitrateBps,omitempty"`
+	BudgetBps  uint64 `json:"budgetBps"`
+}
+
+// SpeakerSwitch is when a recording following the dominant speaker switched
+// to the video track of TrackID, published by ParticipantID. Time is in Unix
+// ms, OffsetMs the video timestamp of the recording the switch happened at.
+type SpeakerSwitch struct {
+	Time          int64  `json:"time"`
+	OffsetMs      int64  `json:"offsetMs"`
+	TrackID       string `json:"trackId"`
+	ParticipantID string `json:"participantId"`
+}
+
+// NTPMapping correlates a track's RTP timestamps with the sender's wall
+// clock, as of an RTCP Sender Report: RTPTimestamp was sampled at NTPTime.
+// Other timestamps of the same SSRC map at ClockRate ticks per second.
+type NTPMapping struct {
+	SSRC         uint32 `json:"ssrc"`
+	RTPTimestamp uint32 `json:"rtpTimestamp"`
+	NTPTime      uint64 `json:"ntpTime"`    // 64 bit NTP format, as sent
+	UnixMicros   int64  `json:"unixMicros"` // NTPTime as Unix time
+	ClockRate    uint32 `json:"clockRate,omitempty"`
+	ReceivedAt   int64  `json:"receivedAt"` // Unix ms, local clock
+}
+
+// SeqNumSpan returns the number of packets between the first and last
+// sequence numbers seen, accounting for wraparounds
+func (s *AdapterTrackStats) SeqNumSpan() uint64 {
+	if !s.HasSeqNum {
+		return 0
+	}
+
+	return uint64(s.SeqNumWrapArounds)<<16 + uint64(s.LastSeqNum) - uint64(s.FirstSeqNum) + 1
+}
+
+// OnPacketBatch accounts for a batch of count packets spanning first to last
+// sequence numbers, handling wraparounds. Batches must come in order (e.g.
+// samples popped from a jitter buffer). TODO review gaps larger than 2^16/2
+func (s *AdapterTrackStats) OnPacketBatch(first, last uint16, count int) {
+	if !s.HasSeqNum {
+		s.FirstSeqNum = first
+		s.HasSeqNum = true
+	}
+
+	if last < first || first < s.LastSeqNum {
+		s.SeqNumWrapArounds++
+	}
+
+	s.LastSeqNum = last
+	s.SeqNumPackets += uint64(count)
+	s.LossFraction = s.SeqNumLossFraction()
+}
+
+// SeqNumLossFraction returns the fraction of the sequence number span that
+// didn't go through the sample buffer. Retransmitted duplicates can make up
+// for lost packets, so it's 0 rather than negative then.
+func (s *AdapterTrackStats) SeqNumLossFraction() float64 {
+	expected := s.SeqNumSpan()
+
+	if expected == 0 || s.SeqNumPackets >= expected {
+		return 0
+	}
+
+	return float64(expected-s.SeqNumPackets) / float64(expected)
 }
 
 type BufferStatsWrapper struct {
@@ -47,6 +239,11 @@ type CaptureStats struct {
 	ParticipantID       string                 `json:"participantId"`
 	Tracks              map[string]*TrackStats `json:"tracks"`
 	FileName            string                 `json:"fileName"`
+	// Set if the recording follows the dominant speaker
+	SpeakerSwitches []SpeakerSwitch `json:"speakerSwitches,omitempty"`
+	// Set if data messages were captured (see config.DataCapture)
+	DataFile     string `json:"dataFile,omitempty"`
+	DataMessages int    `json:"dataMessages,omitempty"`
 }
 
 func GetUptime() time.Duration {
@@ -68,3 +265,11 @@ func ObserveLiveKitConnectDuration(duration time.Duration) {
 func ObserveLiveKitSubscribeDuration(duration time.Duration) {
 	LiveKitSubscribeDuration.Observe(duration.Seconds())
 }
+
+func OnLiveKitToken(reused bool) {
+	if reused {
+		LiveKitTokens.WithLabelValues("reused").Inc()
+	} else {
+		LiveKitTokens.WithLabelValues("issued").Inc()
+	}
+}
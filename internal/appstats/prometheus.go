@@ -5,6 +5,7 @@ import (
 
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/tlsconfig"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
@@ -46,6 +47,24 @@ var (
 		Help:      "Current number of recorder sessions",
 	})
 
+	SessionCapacity = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "recorder",
+		Name:      "session_capacity",
+		Help:      "Maximum number of recorder sessions at once (0 = unlimited)",
+	})
+
+	QueuedSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "recorder",
+		Name:      "queued_sessions",
+		Help:      "Current number of recordings waiting for a session slot",
+	})
+
+	RejectedSessions = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "recorder",
+		Name:      "rejected_sessions_total",
+		Help:      "Total number of recordings rejected at capacity",
+	})
+
 	// TODO implement ActiveTracks tracking (session storage)
 	ActiveTracks = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Subsystem: "recorder",
@@ -68,6 +87,16 @@ var (
 			"mime",   // mime type
 		})
 
+	FIRRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "recorder",
+		Name:      "fir_requests_total",
+		Help:      "Total number of FIR (Full Intra Request) requests sent",
+	},
+		[]string{
+			"source", // track source (e.g. camera, screen)
+			"mime",   // mime type
+		})
+
 	PacketLossBuffer = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Subsystem: "recorder",
 		Name:      "packet_loss_buffer_percentage",
@@ -200,6 +229,18 @@ var (
 			"component",
 		})
 
+	UploadBreakerState = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "recorder",
+		Name:      "upload_breaker_state",
+		Help:      "State of the upload circuit breaker (0 = closed, 1 = open, 2 = half-open)",
+	})
+
+	UploadsDeferred = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "recorder",
+		Name:      "uploads_deferred_total",
+		Help:      "Total number of files left on disk with a pending upload marker",
+	})
+
 	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Subsystem: "recorder",
 		Name:      "request_duration_seconds",
@@ -226,12 +267,105 @@ var (
 		Buckets:   []float64{0.01, 0.02, 0.03, 0.05, 0.1, 0.3, 0.5, 1.0, 2.0, 5.0},
 	})
 
+	LiveKitTokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "recorder",
+		Name:      "livekit_tokens_total",
+		Help:      "Total number of LiveKit access tokens needed to join rooms, by whether a cached one was reused.",
+	},
+		[]string{
+			"result", // issued/reused
+		})
+
 	LiveKitSubscribeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Subsystem: "recorder",
 		Name:      "livekit_subscribe_duration_seconds",
 		Help:      "Duration of the LiveKit track subscribe procedure.",
 		Buckets:   []float64{0.01, 0.02, 0.03, 0.05, 0.1, 0.3, 0.5, 1.0, 2.0, 5.0},
 	})
+
+	// ----- Per-session (live) metrics -----
+	// Updated while recordings are running; series are deleted when the
+	// session's adapter is closed to keep cardinality bounded.
+
+	SessionTrackSeqNumWrapArounds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "recorder",
+		Name:      "session_track_seqnum_wraparounds",
+		Help:      "Number of RTP sequence number wraparounds seen on an active track",
+	},
+		[]string{
+			"session",  // recording session ID
+			"track_id", // adapter track ID
+		})
+
+	SessionTrackPLIRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "recorder",
+		Name:      "session_track_pli_requests",
+		Help:      "Number of PLI requests sent for an active track",
+	},
+		[]string{
+			"session",  // recording session ID
+			"track_id", // adapter track ID
+		})
+
+	SessionTrackRTPReadErrors = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "recorder",
+		Name:      "session_track_rtp_read_errors",
+		Help:      "Number of RTP read errors on an active track",
+	},
+		[]string{
+			"session",  // recording session ID
+			"track_id", // adapter track ID
+		})
+
+	SessionTrackReceiveQueueOverflows = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "recorder",
+		Name:      "session_track_receive_queue_overflows",
+		Help:      "Number of samples of an active track dropped because its receive queue was full",
+	},
+		[]string{
+			"session",  // recording session ID
+			"track_id", // adapter track ID
+		})
+
+	SessionTrackConsecutiveReadErrors = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "recorder",
+		Name:      "session_track_consecutive_read_errors",
+		Help:      "Number of RTP reads failed in a row on an active track",
+	},
+		[]string{
+			"session",  // recording session ID
+			"track_id", // adapter track ID
+		})
+
+	SessionTrackPackets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "recorder",
+		Name:      "session_track_packets",
+		Help:      "Number of RTP packets spanned by an active track (derived from first/last sequence numbers)",
+	},
+		[]string{
+			"session",  // recording session ID
+			"track_id", // adapter track ID
+		})
+
+	SessionTrackLossFraction = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "recorder",
+		Name:      "session_track_loss_fraction",
+		Help:      "Fraction (0-1) of the RTP packets spanned by an active track that never made it through its sample buffer",
+	},
+		[]string{
+			"session",  // recording session ID
+			"track_id", // adapter track ID
+		})
+
+	SessionTrackBytesWritten = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "recorder",
+		Name:      "session_track_bytes_written",
+		Help:      "Number of media bytes written to the output file for an active track",
+	},
+		[]string{
+			"session",  // recording session ID
+			"track_id", // adapter track ID
+		})
 )
 
 func RegisterMetrics() {
@@ -239,8 +373,12 @@ func RegisterMetrics() {
 	prometheus.MustRegister(InvalidRequests)
 	prometheus.MustRegister(Responses)
 	prometheus.MustRegister(Sessions)
+	prometheus.MustRegister(SessionCapacity)
+	prometheus.MustRegister(QueuedSessions)
+	prometheus.MustRegister(RejectedSessions)
 	prometheus.MustRegister(ActiveTracks)
 	prometheus.MustRegister(PLIRequests)
+	prometheus.MustRegister(FIRRequests)
 	prometheus.MustRegister(PacketLossBuffer)
 	prometheus.MustRegister(SampleDuration)
 	prometheus.MustRegister(FrameSize)
@@ -254,10 +392,21 @@ func RegisterMetrics() {
 	prometheus.MustRegister(TrackSubscriptionFailures)
 	prometheus.MustRegister(ParticipantReconnectingEvents)
 	prometheus.MustRegister(ComponentHealth)
+	prometheus.MustRegister(UploadBreakerState)
+	prometheus.MustRegister(UploadsDeferred)
 	prometheus.MustRegister(RequestDuration)
 	prometheus.MustRegister(SessionErrors)
 	prometheus.MustRegister(LiveKitConnectDuration)
 	prometheus.MustRegister(LiveKitSubscribeDuration)
+	prometheus.MustRegister(LiveKitTokens)
+	prometheus.MustRegister(SessionTrackSeqNumWrapArounds)
+	prometheus.MustRegister(SessionTrackPLIRequests)
+	prometheus.MustRegister(SessionTrackRTPReadErrors)
+	prometheus.MustRegister(SessionTrackConsecutiveReadErrors)
+	prometheus.MustRegister(SessionTrackReceiveQueueOverflows)
+	prometheus.MustRegister(SessionTrackPackets)
+	prometheus.MustRegister(SessionTrackLossFraction)
+	prometheus.MustRegister(SessionTrackBytesWritten)
 }
 
 func newMetricsHandler() *metricsHandler {
@@ -295,11 +444,18 @@ func ServePromMetrics(cfg config.Prometheus) {
 		return
 	}
 
+	tlsConfig, err := tlsconfig.Server(cfg.TLS)
+
+	if err != nil {
+		log.Errorf("failed to start metrics server: %s", err)
+		return
+	}
+
 	metricsHandlerInstance = newMetricsHandler()
 	http.Handle("/metrics", metricsHandlerInstance)
 
 	go func() {
-		if err := http.ListenAndServe(cfg.ListenAddress, nil); err != nil {
+		if err := tlsconfig.ListenAndServe(cfg.ListenAddress, nil, tlsConfig); err != nil {
 			log.Errorf("failed to start metrics server: %s", err)
 		}
 	}()
@@ -362,13 +518,59 @@ func OnServerResponse(msg interface{}) {
 		Responses.WithLabelValues(events.RecordingRtpStatusChangedKey).Inc()
 	case *events.RecordingStopped:
 		Responses.WithLabelValues(events.RecordingStoppedKey).Inc()
+	case *events.RecordingUploaded:
+		Responses.WithLabelValues(events.RecordingUploadedKey).Inc()
 	case *events.RecorderStatus:
 		Responses.WithLabelValues(events.RecorderStatusKey).Inc()
+	case *events.RecordingMediaEvent:
+		Responses.WithLabelValues(events.RecordingMediaEventKey).Inc()
+	case *events.ValidateRecordingResponse:
+		Responses.WithLabelValues(events.ValidateRecordingResponseKey).Inc()
+	case *events.RecorderCapabilities:
+		Responses.WithLabelValues(events.RecorderCapabilitiesKey).Inc()
 	default:
 		Responses.WithLabelValues("unknown").Inc()
 	}
 }
 
+func UpdateSessionTrackMetrics(session string, trackID string, stats *AdapterTrackStats) {
+	if stats == nil {
+		return
+	}
+
+	// Called for every packet batch: label values don't allocate a map
+	SessionTrackSeqNumWrapArounds.WithLabelValues(session, trackID).Set(float64(stats.SeqNumWrapArounds))
+	SessionTrackPLIRequests.WithLabelValues(session, trackID).Set(float64(stats.PLIRequests))
+	SessionTrackRTPReadErrors.WithLabelValues(session, trackID).Set(float64(stats.RTPReadErrors))
+	SessionTrackConsecutiveReadErrors.WithLabelValues(session, trackID).Set(float64(stats.ConsecutiveReadErrors))
+	SessionTrackReceiveQueueOverflows.WithLabelValues(session, trackID).Set(float64(stats.ReceiveQueueOverflows))
+	SessionTrackPackets.WithLabelValues(session, trackID).Set(float64(stats.SeqNumSpan()))
+	SessionTrackLossFraction.WithLabelValues(session, trackID).Set(stats.LossFraction)
+}
+
+func SetSessionTrackBytesWritten(session string, trackID string, bytes uint64) {
+	SessionTrackBytesWritten.With(prometheus.Labels{
+		"session":  session,
+		"track_id": trackID,
+	}).Set(float64(bytes))
+}
+
+func DeleteSessionTrackMetrics(session string, trackID string) {
+	labels := prometheus.Labels{
+		"session":  session,
+		"track_id": trackID,
+	}
+
+	SessionTrackSeqNumWrapArounds.Delete(labels)
+	SessionTrackPLIRequests.Delete(labels)
+	SessionTrackRTPReadErrors.Delete(labels)
+	SessionTrackConsecutiveReadErrors.Delete(labels)
+	SessionTrackReceiveQueueOverflows.Delete(labels)
+	SessionTrackPackets.Delete(labels)
+	SessionTrackLossFraction.Delete(labels)
+	SessionTrackBytesWritten.Delete(labels)
+}
+
 func SetComponentHealth(component string, healthy bool) {
 	status := 0.0
 
@@ -379,6 +581,26 @@ func SetComponentHealth(component string, healthy bool) {
 	ComponentHealth.WithLabelValues(component).Set(status)
 }
 
+func SetUploadBreakerState(state int) {
+	UploadBreakerState.Set(float64(state))
+}
+
+func OnUploadDeferred() {
+	UploadsDeferred.Inc()
+}
+
+func SetSessionCapacity(capacity int) {
+	SessionCapacity.Set(float64(capacity))
+}
+
+func SetQueuedSessions(queued int) {
+	QueuedSessions.Set(float64(queued))
+}
+
+func OnSessionRejected() {
+	RejectedSessions.Inc()
+}
+
 func UpdateCaptureMetrics(stats *CaptureStats) {
 	if stats == nil {
 		return
@@ -394,6 +616,11 @@ func UpdateCaptureMetrics(stats *CaptureStats) {
 				"source": trackStats.Source,
 				"mime":   trackStats.MimeType,
 			}).Add(float64(trackStats.Adapter.PLIRequests))
+
+			FIRRequests.With(prometheus.Labels{
+				"source": trackStats.Source,
+				"mime":   trackStats.MimeType,
+			}).Add(float64(trackStats.Adapter.FIRRequests))
 		}
 
 		if trackStats.Buffer != nil {
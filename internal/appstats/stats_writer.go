@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -25,8 +27,14 @@ func NewStatsFileWriter(basePath string, fileMode os.FileMode) *StatsFileWriter
 	}
 }
 
+// StatsFilePath is where the stats of a recording go, e.g.
+// recording-stats.json for recording.webm
+func StatsFilePath(recordingPath string) string {
+	return fmt.Sprintf("%s-stats.json", strings.TrimSuffix(recordingPath, filepath.Ext(recordingPath)))
+}
+
 func (w *StatsFileWriter) WriteStats(webmFilePath string, stats *StatsFileOutput) error {
-	statsFilePath := fmt.Sprintf("%s-stats.json", webmFilePath[:len(webmFilePath)-5])
+	statsFilePath := StatsFilePath(webmFilePath)
 
 	jsonData, err := json.MarshalIndent(stats, "", "  ")
 
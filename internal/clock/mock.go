@@ -0,0 +1,181 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Mock is a clock for tests that only moves when told to. Timers and
+// tickers fire as Add (or Set) moves past them, in order; AfterFunc
+// callbacks run synchronously within it, and ticks are dropped if the
+// previous one wasn't received yet, as with time.Ticker.
+type Mock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*mockTimer
+}
+
+func NewMock(now time.Time) *Mock {
+	return &Mock{now: now}
+}
+
+type mockTimer struct {
+	m      *Mock
+	when   time.Time
+	period time.Duration // Tickers only
+	c      chan time.Time
+	f      func()
+}
+
+func (m *Mock) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.now
+}
+
+func (m *Mock) Since(t time.Time) time.Duration {
+	return m.Now().Sub(t)
+}
+
+func (m *Mock) NewTimer(d time.Duration) Timer {
+	return m.schedule(&mockTimer{m: m, c: make(chan time.Time, 1)}, d)
+}
+
+func (m *Mock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	return mockTicker{m.schedule(&mockTimer{m: m, period: d, c: make(chan time.Time, 1)}, d)}
+}
+
+func (m *Mock) AfterFunc(d time.Duration, f func()) Timer {
+	return m.schedule(&mockTimer{m: m, f: f}, d)
+}
+
+// Set moves the clock to t, firing what was due by then
+func (m *Mock) Set(t time.Time) {
+	for {
+		m.mu.Lock()
+
+		if len(m.timers) == 0 || m.timers[0].when.After(t) {
+			if t.After(m.now) {
+				m.now = t
+			}
+
+			m.mu.Unlock()
+			return
+		}
+
+		timer := m.timers[0]
+		m.timers = m.timers[1:]
+		m.now = timer.when
+
+		if timer.period > 0 {
+			timer.when = timer.when.Add(timer.period)
+			m.insert(timer)
+		}
+
+		now := m.now
+		m.mu.Unlock()
+		timer.fire(now)
+	}
+}
+
+// Add moves the clock forward by d, firing what was due by then
+func (m *Mock) Add(d time.Duration) {
+	m.Set(m.Now().Add(d))
+}
+
+// Timers returns how many timers and tickers are pending, so tests can
+// wait for the code under test to arm them
+func (m *Mock) Timers() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.timers)
+}
+
+func (m *Mock) schedule(t *mockTimer, d time.Duration) *mockTimer {
+	m.mu.Lock()
+	t.when = m.now.Add(d)
+	m.insert(t)
+	m.mu.Unlock()
+
+	// Due already, as with time.NewTimer(0). Callbacks wait for the next
+	// Add or Set, callers may hold locks they take.
+	if d <= 0 && t.f == nil {
+		m.Set(m.Now())
+	}
+
+	return t
+}
+
+// Locked
+func (m *Mock) insert(t *mockTimer) {
+	i := sort.Search(len(m.timers), func(i int) bool { return m.timers[i].when.After(t.when) })
+	m.timers = append(m.timers, nil)
+	copy(m.timers[i+1:], m.timers[i:])
+	m.timers[i] = t
+}
+
+// Locked
+func (m *Mock) remove(t *mockTimer) bool {
+	for i, timer := range m.timers {
+		if timer == t {
+			m.timers = append(m.timers[:i], m.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *mockTimer) fire(now time.Time) {
+	if t.f != nil {
+		t.f()
+		return
+	}
+
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+func (t *mockTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *mockTimer) Stop() bool {
+	t.m.mu.Lock()
+	defer t.m.mu.Unlock()
+
+	return t.m.remove(t)
+}
+
+type mockTicker struct {
+	*mockTimer
+}
+
+func (t mockTicker) Stop() {
+	t.mockTimer.Stop()
+}
+
+// Reset makes the ticker tick every d from now on
+func (t mockTicker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("non-positive interval for Ticker.Reset")
+	}
+
+	m := t.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.remove(t.mockTimer)
+	t.period = d
+	t.when = m.now.Add(d)
+	m.insert(t.mockTimer)
+}
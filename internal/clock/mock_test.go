@@ -0,0 +1,70 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	m := NewMock(start)
+	var fired []time.Duration
+
+	m.AfterFunc(30*time.Millisecond, func() { fired = append(fired, m.Since(start)) })
+	m.AfterFunc(10*time.Millisecond, func() { fired = append(fired, m.Since(start)) })
+	stopped := m.AfterFunc(20*time.Millisecond, func() { t.Error("Stopped timer fired") })
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop())
+	assert.Equal(t, 2, m.Timers())
+
+	m.Add(15 * time.Millisecond)
+	assert.Equal(t, []time.Duration{10 * time.Millisecond}, fired)
+	assert.Equal(t, 15*time.Millisecond, m.Since(start))
+
+	m.Add(time.Second)
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 30 * time.Millisecond}, fired, "Fired in order, at their time")
+	assert.Zero(t, m.Timers())
+}
+
+func TestMock_Timer(t *testing.T) {
+	m := NewMock(time.Unix(1000, 0))
+	timer := m.NewTimer(time.Second)
+
+	m.Add(999 * time.Millisecond)
+	assert.Empty(t, timer.C())
+
+	m.Add(time.Millisecond)
+	assert.Equal(t, time.Unix(1001, 0), <-timer.C())
+	assert.False(t, timer.Stop(), "Already fired")
+
+	assert.Len(t, m.NewTimer(0).C(), 1, "Due right away")
+}
+
+func TestMock_Ticker(t *testing.T) {
+	m := NewMock(time.Unix(1000, 0))
+	ticker := m.NewTicker(10 * time.Millisecond)
+
+	m.Add(10 * time.Millisecond)
+	assert.Equal(t, time.Unix(1000, int64(10*time.Millisecond)), <-ticker.C())
+
+	// Ticks not received in time are dropped
+	m.Add(50 * time.Millisecond)
+	assert.Equal(t, time.Unix(1000, int64(20*time.Millisecond)), <-ticker.C())
+	assert.Empty(t, ticker.C())
+
+	ticker.Reset(100 * time.Millisecond)
+	m.Add(90 * time.Millisecond)
+	assert.Empty(t, ticker.C())
+	m.Add(10 * time.Millisecond)
+	assert.Len(t, ticker.C(), 1)
+	<-ticker.C()
+
+	ticker.Stop()
+	m.Add(time.Second)
+	assert.Empty(t, ticker.C())
+	assert.Zero(t, m.Timers())
+
+	assert.Panics(t, func() { m.NewTicker(0) })
+}
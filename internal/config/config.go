@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/livekit/protocol/livekit"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v4"
 	log "github.com/sirupsen/logrus"
 )
@@ -24,7 +25,15 @@ type Config struct {
 	WebRTC     WebRTC     `yaml:"webrtc,omitempty"`
 	HTTP       HTTP       `yaml:"http,omitempty"`
 	Prometheus Prometheus `yaml:"prometheus,omitempty"`
+	Health     Health     `yaml:"health,omitempty"`
+	GRPC       GRPC       `yaml:"grpc,omitempty"`
+	Shutdown   Shutdown   `yaml:"shutdown,omitempty"`
+	Capacity   Capacity   `yaml:"capacity,omitempty"`
 	LiveKit    LiveKit    `yaml:"livekit,omitempty"`
+	RTP        RTP        `yaml:"rtp,omitempty"`
+	Upload     Upload     `yaml:"upload,omitempty"`
+	Webhook    Webhook    `yaml:"webhook,omitempty"`
+	Overrides  Overrides  `yaml:"overrides,omitempty"`
 	Log        LogConfig  `yaml:"log"`
 }
 
@@ -45,12 +54,106 @@ func (cfg *Config) SetDefaults() {
 
 	cfg.Recorder.DirFileMode = "0700"
 	cfg.Recorder.FileMode = "0600"
+	cfg.Recorder.FileCollision = "error"
 	cfg.Recorder.WriteToDevNull = false
 	cfg.Recorder.WriteIVFCopy = false
 	cfg.Recorder.WriteStatsFile = false
+	cfg.Recorder.WriteSidecarFile = false
 	cfg.Recorder.VideoPacketQueueSize = 256
 	cfg.Recorder.AudioPacketQueueSize = 32
 	cfg.Recorder.UseCustomSampler = true
+	cfg.Recorder.AudioOnlyOgg = false
+	cfg.Recorder.AudioOnlyWAV = false
+	cfg.Recorder.WAV = WAV{
+		SampleRate: 16000,
+		Channels:   1,
+	}
+	cfg.Recorder.FMP4 = FMP4{
+		Enable:           false,
+		FragmentDuration: 2 * time.Second,
+	}
+	cfg.Recorder.MKV = MKV{
+		Enable:        false,
+		AttachSidecar: false,
+	}
+	cfg.Recorder.Segments = Segments{
+		Enable:   false,
+		Duration: 10 * time.Minute,
+	}
+	cfg.Recorder.DiskGuard = DiskGuard{
+		Enable:   false,
+		MinFree:  1 << 30,
+		Interval: 5 * time.Second,
+	}
+	cfg.Recorder.AudioMix = AudioMix{
+		Channels: 1,
+		Bitrate:  32000,
+		Latency:  200 * time.Millisecond,
+	}
+	cfg.Recorder.OpusEncoder = OpusEncoder{
+		Complexity:  10,
+		FEC:         false,
+		Application: "audio",
+	}
+	cfg.Recorder.StallTimeout = 0
+	cfg.Recorder.LossConcealment = LossConcealment{
+		Audio: false,
+		Video: false,
+	}
+	cfg.Recorder.SilenceFill = SilenceFill{
+		Enable:    false,
+		Threshold: 100 * time.Millisecond,
+	}
+	cfg.Recorder.Trim = Trim{
+		Leading:  false,
+		Trailing: false,
+	}
+	cfg.Recorder.ConstantFrameRate = 0
+	cfg.Recorder.ReorderTolerance = ReorderTolerance{
+		MaxGap: 0,
+		Window: 100 * time.Millisecond,
+	}
+	cfg.Recorder.AVSync = AVSync{
+		Enable:        false,
+		MaxCorrection: time.Second,
+	}
+	cfg.Recorder.Snapshots = Snapshots{
+		Enable:   false,
+		Interval: 10 * time.Second,
+		Quality:  75,
+	}
+	cfg.Recorder.Proxy = Proxy{
+		Enable:       false,
+		FFmpeg:       "ffmpeg",
+		Height:       360,
+		VideoBitrate: 500000,
+		AudioBitrate: 64000,
+	}
+	cfg.Recorder.RawOutput = RawOutput{
+		Enable:     false,
+		FrameRate:  30,
+		SampleRate: 48000,
+		Channels:   2,
+	}
+	cfg.Recorder.Quota = Quota{
+		MaxBytes:    0,
+		MaxDuration: 0,
+	}
+	cfg.Recorder.MutedVideo = "hold"
+	cfg.Recorder.DTX = "preserve"
+	cfg.Recorder.Preallocate = Preallocate{
+		Bitrate:  0,
+		Duration: time.Hour,
+	}
+	cfg.Recorder.Recovery = Recovery{
+		Enable: false,
+	}
+	cfg.Recorder.Encryption = Encryption{
+		Enable: false,
+	}
+	cfg.Recorder.Cues = Cues{
+		FlushInterval: 0,
+	}
 	cfg.PubSub.Channels = Channels{
 		Subscribe: "to-" + cfg.App.Name,
 		Publish:   "from-" + cfg.App.Name,
@@ -62,10 +165,44 @@ func (cfg *Config) SetDefaults() {
 		Network:  "tcp",
 		Password: "",
 	}
+	cfg.Upload = Upload{
+		Enable:      false,
+		Backend:     "s3",
+		DeleteLocal: false,
+		Timeout:     10 * time.Minute,
+		Backends:    make(map[string]interface{}),
+		Breaker: UploadBreaker{
+			Enable:       false,
+			FailureRate:  0.5,
+			Window:       10,
+			OpenDuration: time.Minute,
+		},
+	}
+	cfg.Upload.Backends["s3"] = &S3{
+		Region:         "us-east-1",
+		ForcePathStyle: false,
+	}
+	cfg.Webhook = Webhook{
+		Enable:  false,
+		Timeout: 5 * time.Second,
+		Retry: WebhookRetry{
+			MaxAttempts:     5,
+			InitialInterval: time.Second,
+			MaxInterval:     30 * time.Second,
+		},
+	}
+	cfg.Overrides = Overrides{
+		Enable:         false,
+		Formats:        []string{},
+		MaxDuration:    0,
+		MaxBytes:       0,
+		UploadPrefixes: []string{},
+	}
 	cfg.WebRTC.RTCMinPort = 24577
 	cfg.WebRTC.RTCMaxPort = 32768
 	cfg.WebRTC.JitterBuffer = 512
 	cfg.WebRTC.JitterBufferPktTimeout = 200
+	cfg.WebRTC.HeaderExtensions = []string{sdp.AudioLevelURI}
 	cfg.HTTP = HTTP{
 		Enable: false,
 		Port:   8080,
@@ -74,11 +211,35 @@ func (cfg *Config) SetDefaults() {
 		Enable:        false,
 		ListenAddress: "127.0.0.1:3200",
 	}
+	cfg.Log = LogConfig{
+		Level:  "INFO",
+		Format: "auto",
+	}
+	cfg.Health = Health{
+		Enable:       false,
+		Port:         8081,
+		CheckLiveKit: true,
+		Timeout:      2 * time.Second,
+		Debug:        false,
+	}
+	cfg.GRPC = GRPC{
+		Enable:        false,
+		ListenAddress: "127.0.0.1:3201",
+	}
+	cfg.Shutdown = Shutdown{
+		DrainTimeout: 30 * time.Second,
+	}
+	cfg.Capacity = Capacity{
+		MaxSessions:  0,
+		Overflow:     "reject",
+		QueueTimeout: 30 * time.Second,
+	}
 	cfg.LiveKit = LiveKit{
 		Host:                  "ws://localhost:7880",
 		APIKey:                "",
 		APISecret:             "",
 		PacketReadTimeout:     500 * time.Millisecond,
+		TrackPublishTimeout:   5 * time.Second,
 		PreferredVideoQuality: livekit.VideoQuality_HIGH,
 		HealthCheck: HealthCheck{
 			Enable:             false,
@@ -86,19 +247,361 @@ func (cfg *Config) SetDefaults() {
 			AbortBootOnFailure: false,
 		},
 		WriteRTPDump: false,
+		JitterBuffer: LiveKitJitterBuffer{
+			Video: TrackJitterBuffer{
+				Size:     512,
+				MaxDelay: 50 * time.Millisecond,
+			},
+			Audio: TrackJitterBuffer{
+				Size:     64,
+				MaxDelay: 50 * time.Millisecond,
+			},
+		},
+		Reconnect: Reconnect{
+			MaxAttempts:    5,
+			MaxElapsedTime: 30 * time.Second,
+		},
+		Timeouts: Timeouts{
+			Connect:    10 * time.Second,
+			Subscribe:  10 * time.Second,
+			FirstMedia: 15 * time.Second,
+		},
+		MaxDuration:             0,
+		StatsInterval:           1 * time.Second,
+		KeyframeRequestInterval: 1 * time.Second,
+		FIR: FIR{
+			AfterPLIs: 3,
+			Timeout:   3 * time.Second,
+		},
+		AdaptiveKeyframeInterval: AdaptiveKeyframeInterval{
+			Enabled:     false,
+			MinInterval: 250 * time.Millisecond,
+			MaxInterval: 3 * time.Second,
+			HighLoss:    0.05,
+		},
+		ScreenShare: ScreenShare{
+			KeyframeRequestInterval: 3 * time.Second,
+		},
+		NACK: NACK{
+			Window:     256,
+			Interval:   20 * time.Millisecond,
+			MaxRetries: 3,
+		},
+		Limits: Limits{
+			MaxTrackPendingPackets: 2048,
+			MaxSessionPendingBytes: 32 << 20,
+		},
+		ReadErrors: ReadErrors{
+			MaxConsecutive:     10,
+			Window:             5 * time.Second,
+			Backoff:            10 * time.Millisecond,
+			MaxBackoff:         500 * time.Millisecond,
+			MaxResubscriptions: 3,
+		},
+		ReceiveQueue: ReceiveQueue{
+			Size:     0,
+			Overflow: "drop_oldest",
+			MaxBlock: 50 * time.Millisecond,
+		},
+		FollowSpeaker: FollowSpeaker{
+			Enabled:     false,
+			MinInterval: 2 * time.Second,
+		},
+		AdaptiveQuality: AdaptiveQuality{
+			Enabled:     false,
+			MaxBitrate:  1500000,
+			Interval:    2 * time.Second,
+			MinInterval: 10 * time.Second,
+		},
+		// All the ones parsed: RFC 6464 audio levels, for voice activity
+		// stats, and transport-wide congestion control, for TWCC stats
+		HeaderExtensions: []string{sdp.AudioLevelURI, sdp.TransportCCURI},
+		DataCapture: DataCapture{
+			Enabled: false,
+		},
+		DisabledTracks: "stats",
+		VideoCodecs:    []string{},
+	}
+	cfg.RTP = RTP{
+		Latency:                 200 * time.Millisecond,
+		KeyframeRequestInterval: 1 * time.Second,
 	}
 }
 
 type Recorder struct {
-	Directory            string `yaml:"directory,omitempty"`
-	DirFileMode          string `yaml:"dirFileMode,omitempty"`
-	FileMode             string `yaml:"fileMode,omitempty"`
-	WriteToDevNull       bool   `yaml:"writeToDevNull,omitempty"`
-	WriteIVFCopy         bool   `yaml:"writeIVFCopy,omitempty"`
-	VideoPacketQueueSize uint16 `yaml:"videoPacketQueueSize,omitempty"`
-	AudioPacketQueueSize uint16 `yaml:"audioPacketQueueSize,omitempty"`
-	UseCustomSampler     bool   `yaml:"useCustomSampler,omitempty"`
-	WriteStatsFile       bool   `yaml:"writeStatsFile,omitempty"`
+	Directory            string          `yaml:"directory,omitempty"`
+	DirFileMode          string          `yaml:"dirFileMode,omitempty"`
+	FileMode             string          `yaml:"fileMode,omitempty"`
+	PathTemplate         string          `yaml:"pathTemplate,omitempty"`
+	FileCollision        string          `yaml:"fileCollision,omitempty"`
+	WriteToDevNull       bool            `yaml:"writeToDevNull,omitempty"`
+	WriteIVFCopy         bool            `yaml:"writeIVFCopy,omitempty"`
+	VideoPacketQueueSize uint16          `yaml:"videoPacketQueueSize,omitempty"`
+	AudioPacketQueueSize uint16          `yaml:"audioPacketQueueSize,omitempty"`
+	UseCustomSampler     bool            `yaml:"useCustomSampler,omitempty"`
+	WriteStatsFile       bool            `yaml:"writeStatsFile,omitempty"`
+	WriteSidecarFile     bool            `yaml:"writeSidecarFile,omitempty"`
+	AudioOnlyOgg         bool            `yaml:"audioOnlyOgg,omitempty"`
+	AudioOnlyWAV         bool            `yaml:"audioOnlyWav,omitempty"`
+	WAV                  WAV             `yaml:"wav,omitempty"`
+	FMP4                 FMP4            `yaml:"fmp4,omitempty"`
+	MKV                  MKV             `yaml:"mkv,omitempty"`
+	Segments             Segments        `yaml:"segments,omitempty"`
+	DiskGuard            DiskGuard       `yaml:"diskGuard,omitempty"`
+	LossConcealment      LossConcealment `yaml:"lossConcealment,omitempty"`
+	SilenceFill          SilenceFill     `yaml:"silenceFill,omitempty"`
+	Trim                 Trim            `yaml:"trim,omitempty"`
+	// AudioMix is the format of recordings mixing several audio tracks
+	AudioMix AudioMix `yaml:"audioMix,omitempty"`
+	// OpusEncoder tunes the Opus encoder of the audio mix and the proxy
+	OpusEncoder OpusEncoder `yaml:"opusEncoder,omitempty"`
+	// StallTimeout stops recordings, with reason no_media, once neither
+	// their media timestamps advanced nor packets arrived for that long.
+	// 0 disables it.
+	StallTimeout time.Duration `yaml:"stallTimeout,omitempty"`
+	// ConstantFrameRate writes video at that many frames per second,
+	// repeating or dropping frames as their RTP timestamps require. 0
+	// writes frames as they come (variable frame rate).
+	ConstantFrameRate int `yaml:"constantFrameRate,omitempty"`
+	// TimestampJumpThreshold re-bases the timeline of a track whose RTP
+	// timestamps jump, e.g. when the publisher restarts, by more than that
+	// from the time elapsed between consecutive packets. 0 disables it.
+	TimestampJumpThreshold time.Duration `yaml:"timestampJumpThreshold,omitempty"`
+	// ReorderTolerance waits for packets missing from small sequence gaps
+	// before counting them lost
+	ReorderTolerance ReorderTolerance `yaml:"reorderTolerance,omitempty"`
+	// AVSync corrects the skew audio and video start with, as measured on
+	// the publisher's clock
+	AVSync AVSync `yaml:"avSync,omitempty"`
+	// VP8TemporalLayers records VP8 video up to that many temporal layers
+	// (1 is the base layer alone), dropping the frames of the layers above
+	// for smaller recordings of temporally scalable streams. 0 records all.
+	VP8TemporalLayers int `yaml:"vp8TemporalLayers,omitempty"`
+	// ClockRates overrides the RTP clock rate media time is computed with,
+	// by codec MIME type (e.g. video/VP8) or payload type (e.g. "96").
+	// Unset ones use the codec's standard rate: 90000 for video, 48000 for
+	// Opus.
+	ClockRates map[string]uint32 `yaml:"clockRates,omitempty"`
+	// Snapshots takes periodic JPEG stills of the video, e.g. for previews
+	Snapshots Snapshots `yaml:"snapshots,omitempty"`
+	// Proxy transcodes a low bitrate copy of each recording alongside it
+	Proxy Proxy `yaml:"proxy,omitempty"`
+	// RawOutput writes the decoded media of each recording for other
+	// pipelines to consume
+	RawOutput RawOutput `yaml:"rawOutput,omitempty"`
+	// Quota caps what a single recording may take up
+	Quota Quota `yaml:"quota,omitempty"`
+	// MutedVideo is how periods the video was muted at the source are
+	// represented: "hold" leaves the last frame showing, "marker" also
+	// writes a marker spanning them to the metadata track of WebM/MKV files
+	MutedVideo string `yaml:"mutedVideo,omitempty"`
+	// DTX is how the silences Opus publishers send as DTX are written:
+	// "preserve" leaves them as gaps, "fill" fills them with comfort noise
+	DTX string `yaml:"dtx,omitempty"`
+	// Tags are embedded in every recording's container, along with the
+	// session's (see startRecording's tags)
+	Tags map[string]string `yaml:"tags,omitempty"`
+	// Preallocate reserves disk space for recording files up front
+	Preallocate Preallocate `yaml:"preallocate,omitempty"`
+	// Recovery finalizes recordings a crash left unfinished
+	Recovery Recovery `yaml:"recovery,omitempty"`
+	// Encryption encrypts recordings at rest
+	Encryption Encryption `yaml:"encryption,omitempty"`
+	// FlushDeadline bounds how long finalizing a recording may take when it
+	// stops; past it, what's left to write is dropped. 0 means no bound.
+	FlushDeadline time.Duration `yaml:"flushDeadline,omitempty"`
+	// Cues indexes WebM/MKV recordings as they're written
+	Cues Cues `yaml:"cues,omitempty"`
+}
+
+type WAV struct {
+	SampleRate int `yaml:"sampleRate,omitempty"`
+	Channels   int `yaml:"channels,omitempty"`
+}
+
+type FMP4 struct {
+	Enable           bool          `yaml:"enable,omitempty"`
+	FragmentDuration time.Duration `yaml:"fragmentDuration,omitempty"`
+}
+
+// MKV writes Matroska files, with chapters and attachments, whatever the
+// codecs. AttachSidecar embeds each recording's sidecar in it.
+type MKV struct {
+	Enable        bool `yaml:"enable,omitempty"`
+	AttachSidecar bool `yaml:"attachSidecar,omitempty"`
+}
+
+type Segments struct {
+	Enable   bool          `yaml:"enable,omitempty"`
+	Duration time.Duration `yaml:"duration,omitempty"`
+}
+
+// DiskGuard stops recordings, with reason out_of_disk, once the filesystem
+// they're written to has less than MinFree bytes available. It's checked
+// every Interval.
+type DiskGuard struct {
+	Enable   bool          `yaml:"enable,omitempty"`
+	MinFree  uint64        `yaml:"minFree,omitempty"`
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+// Quota stops recordings, with reason quota_exceeded, once their files
+// hold MaxBytes or MaxDuration of media was written to them, whichever comes
+// first. 0 disables either. It's independent of LiveKit's MaxDuration.
+type Quota struct {
+	MaxBytes    uint64        `yaml:"maxBytes,omitempty"`
+	MaxDuration time.Duration `yaml:"maxDuration,omitempty"`
+}
+
+// Preallocate reserves the space of Bitrate (bits/s) for Duration (or a
+// segment's, if shorter) when a recording file is created, so long
+// recordings don't fragment. What isn't used is released once the file is
+// closed. Linux only, on filesystems supporting fallocate; elsewhere files
+// grow as written. Bitrate 0 disables it.
+type Preallocate struct {
+	Bitrate  uint64        `yaml:"bitrate,omitempty"`
+	Duration time.Duration `yaml:"duration,omitempty"`
+}
+
+// Recovery writes a marker next to each WebM/MKV recording while it's in
+// progress. On startup, recordings whose marker a crashed recorder left
+// behind are finalized so they can be played and seeked.
+type Recovery struct {
+	Enable bool `yaml:"enable,omitempty"`
+}
+
+// Cues writes the index (cues) of WebM/MKV recordings so far, and their
+// duration, every FlushInterval of media at most, so files can be seeked
+// while they're written or once a crash left them unfinished. 0 leaves
+// them without, as streamed.
+type Cues struct {
+	FlushInterval time.Duration `yaml:"flushInterval,omitempty"`
+}
+
+// Encryption writes recording files (and segments) encrypted with AES-GCM,
+// streamed in chunks after a plaintext header naming the scheme, nonce and
+// KeyID. The 128, 192 or 256-bit key is hex or base64 encoded, in Key or in
+// KeyFile, e.g. where a KMS agent or secret store puts the data key; it's
+// read for each recording, so the file can be rotated (with a new KeyID).
+// Sidecar also encrypts the sidecar files, which stay plaintext otherwise.
+type Encryption struct {
+	Enable  bool   `yaml:"enable,omitempty"`
+	Key     string `yaml:"key,omitempty"`
+	KeyFile string `yaml:"keyFile,omitempty"`
+	KeyID   string `yaml:"keyId,omitempty"`
+	Sidecar bool   `yaml:"sidecar,omitempty"`
+}
+
+// AudioMix configures the Opus track audio tracks are mixed into, when a
+// recording asks for it. The mix is held for Latency (at least 120ms) so
+// tracks arriving late still make it in.
+type AudioMix struct {
+	Channels int           `yaml:"channels,omitempty"`
+	Bitrate  int           `yaml:"bitrate,omitempty"`
+	Latency  time.Duration `yaml:"latency,omitempty"`
+}
+
+// OpusEncoder tunes how audio is re-encoded to Opus, by the audio mix and
+// the proxy, at the bitrate each sets. Complexity ranges from 0 (fastest) to
+// 10 (best quality). FEC adds in-band forward error correction, which files
+// have no use for unless streamed on. Application is what the encoder is
+// tuned for: "audio" (any content, music included), "voip" (speech) or
+// "lowdelay".
+type OpusEncoder struct {
+	Complexity  int    `yaml:"complexity,omitempty"`
+	FEC         bool   `yaml:"fec,omitempty"`
+	Application string `yaml:"application,omitempty"`
+}
+
+// LossConcealment fills gaps left by lost RTP packets. Audio inserts Opus
+// packet loss concealment frames, video writes a marker to a metadata track
+// of WebM/MKV files. Off, gaps are left as they are.
+type LossConcealment struct {
+	Audio bool `yaml:"audio,omitempty"`
+	Video bool `yaml:"video,omitempty"`
+}
+
+// SilenceFill fills the gaps in the audio of Opus recordings (WebM, MKV,
+// Ogg) longer than Threshold with generated silence, on the RTP timeline, so
+// the audio track lasts as long as the media time it spans. Gaps are filled
+// after loss concealment and DTX filling, if enabled, had their share; those
+// of pauses are left alone. WAV files are always continuous.
+type SilenceFill struct {
+	Enable    bool          `yaml:"enable,omitempty"`
+	Threshold time.Duration `yaml:"threshold,omitempty"`
+}
+
+// Trim cuts recordings with video to keyframe boundaries. Leading starts
+// the file at the first keyframe instead of the first packet, dropping the
+// audio received before it. Trailing drops what was written after the last
+// keyframe. Off, the stream is recorded as received.
+type Trim struct {
+	Leading  bool `yaml:"leading,omitempty"`
+	Trailing bool `yaml:"trailing,omitempty"`
+}
+
+// ReorderTolerance waits up to Window for the packets missing from sequence
+// gaps of up to MaxGap packets before counting them lost, in the recorder
+// stats' lostPackets and rtpDiscontInfo: publishers reordering packets send
+// them late rather than never. Those arriving in time are counted in
+// reorderedPackets instead. Larger gaps are counted lost at once. It's
+// independent of the jitter buffers: packets are passed on as they come.
+// MaxGap 0 disables it, counting any gap lost at once.
+type ReorderTolerance struct {
+	MaxGap int           `yaml:"maxGap,omitempty"`
+	Window time.Duration `yaml:"window,omitempty"`
+}
+
+// AVSync places the audio and video of recordings so they start in sync on
+// the publisher's wall clock, as given by RTCP Sender Reports, rather than
+// as they arrived: the track placed ahead of the other is delayed by the
+// skew, by at most MaxCorrection. It takes a Sender Report of each track
+// within 10s of both starting; failing that, or off, tracks are placed as
+// they arrived.
+type AVSync struct {
+	Enable        bool          `yaml:"enable,omitempty"`
+	MaxCorrection time.Duration `yaml:"maxCorrection,omitempty"`
+}
+
+// Snapshots writes a JPEG still of recordings with video every Interval of
+// media time, decoded from the first keyframe due, to a "-snapshots"
+// directory next to the recording. Files are named after their media
+// timestamp (ms). A keyframe is requested when none arrives within a second
+// of being due. Quality ranges from 1 to 100. Decoding needs libvpx (the
+// "vpx" build tag) and covers VP8 and VP9.
+type Snapshots struct {
+	Enable   bool          `yaml:"enable,omitempty"`
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Quality  int           `yaml:"quality,omitempty"`
+}
+
+// Proxy re-encodes WebM/MKV recordings, as they're written, to a
+// "-proxy.webm" file next to them (VP8 and Opus) for editing workflows: at
+// most Height lines, at VideoBitrate and AudioBitrate (bits/s). Timestamps
+// and keyframes match the recording's. Each recording runs an FFmpeg
+// process, which must have libvpx and libopus.
+type Proxy struct {
+	Enable       bool   `yaml:"enable,omitempty"`
+	FFmpeg       string `yaml:"ffmpeg,omitempty"`
+	Height       int    `yaml:"height,omitempty"`
+	VideoBitrate int    `yaml:"videoBitrate,omitempty"`
+	AudioBitrate int    `yaml:"audioBitrate,omitempty"`
+}
+
+// RawOutput writes the media of file recordings, decoded as it's written,
+// to files or named pipes FFmpeg and GStreamer read as they are: video to
+// VideoPath as YUV4MPEG2 (I420 frames at FrameRate, after a header giving
+// their size and rate), audio to AudioPath as a 16-bit PCM WAV stream of
+// SampleRate and Channels. Either path may be left empty. {session} in them
+// is replaced by the recording session ID. Decoding video needs libvpx (the
+// "vpx" build tag, VP8 and VP9), audio libopus (the "opus" build tag).
+type RawOutput struct {
+	Enable     bool   `yaml:"enable,omitempty"`
+	VideoPath  string `yaml:"videoPath,omitempty"`
+	AudioPath  string `yaml:"audioPath,omitempty"`
+	FrameRate  int    `yaml:"frameRate,omitempty"`
+	SampleRate int    `yaml:"sampleRate,omitempty"`
+	Channels   int    `yaml:"channels,omitempty"`
 }
 
 type Redis struct {
@@ -113,6 +616,74 @@ type PubSub struct {
 	Adapters map[string]interface{}
 }
 
+type Upload struct {
+	Enable      bool          `yaml:"enable,omitempty"`
+	Backend     string        `yaml:"backend,omitempty"`
+	DeleteLocal bool          `yaml:"deleteLocal,omitempty"`
+	Timeout     time.Duration `yaml:"timeout,omitempty"`
+	Backends    map[string]interface{}
+	Breaker     UploadBreaker `yaml:"breaker,omitempty"`
+}
+
+// UploadBreaker stops uploading while the backend fails: once FailureRate
+// (0-1) of the last Window uploads failed, uploads are skipped for
+// OpenDuration and the files left on disk with a pending upload marker. A
+// single upload is then tried, which closes the breaker if it succeeds.
+type UploadBreaker struct {
+	Enable       bool          `yaml:"enable,omitempty"`
+	FailureRate  float64       `yaml:"failureRate,omitempty"`
+	Window       int           `yaml:"window,omitempty"`
+	OpenDuration time.Duration `yaml:"openDuration,omitempty"`
+}
+
+// Webhook configures HTTP POST notifications of recording lifecycle events.
+// startRecording can override it per recording.
+type Webhook struct {
+	Enable bool   `yaml:"enable,omitempty" mapstructure:"enable"`
+	URL    string `yaml:"url,omitempty" mapstructure:"url"`
+	// Secret signs the payloads with HMAC-SHA256. Empty sends them unsigned
+	Secret string `yaml:"secret,omitempty" mapstructure:"secret"`
+	// Timeout of each delivery attempt
+	Timeout time.Duration `yaml:"timeout,omitempty" mapstructure:"timeout"`
+	Retry   WebhookRetry  `yaml:"retry,omitempty" mapstructure:"retry"`
+}
+
+// WebhookRetry configures the exponential backoff between delivery attempts
+// of an event. MaxAttempts includes the first one.
+type WebhookRetry struct {
+	MaxAttempts     uint64        `yaml:"maxAttempts,omitempty" mapstructure:"max_attempts"`
+	InitialInterval time.Duration `yaml:"initialInterval,omitempty" mapstructure:"initial_interval"`
+	MaxInterval     time.Duration `yaml:"maxInterval,omitempty" mapstructure:"max_interval"`
+}
+
+// Overrides bounds what startRecording may override of the configured
+// defaults, per recording (see its overrides). They're rejected unless
+// enabled.
+type Overrides struct {
+	Enable bool `yaml:"enable,omitempty"`
+	// Formats recordings may be written in, "webm" and "mp4". Empty allows
+	// both.
+	Formats []string `yaml:"formats,omitempty"`
+	// MaxDuration is the longest media duration quota a recording may get.
+	// 0 allows any.
+	MaxDuration time.Duration `yaml:"maxDuration,omitempty"`
+	// MaxBytes is the largest size quota a recording may get. 0 allows any.
+	MaxBytes uint64 `yaml:"maxBytes,omitempty"`
+	// UploadPrefixes an upload prefix override must start with. Empty
+	// allows any.
+	UploadPrefixes []string `yaml:"uploadPrefixes,omitempty"`
+}
+
+type S3 struct {
+	Endpoint        string `yaml:"endpoint,omitempty"`
+	Region          string `yaml:"region,omitempty"`
+	Bucket          string `yaml:"bucket,omitempty"`
+	Prefix          string `yaml:"prefix,omitempty"`
+	AccessKeyID     string `yaml:"accessKeyId,omitempty"`
+	SecretAccessKey string `yaml:"secretAccessKey,omitempty"`
+	ForcePathStyle  bool   `yaml:"forcePathStyle,omitempty"`
+}
+
 type Channels struct {
 	Subscribe string `yaml:"subscribe,omitempty"`
 	Publish   string `yaml:"publish,omitempty"`
@@ -124,26 +695,267 @@ type WebRTC struct {
 	RTCMaxPort             uint16             `yaml:"rtcMaxPort,omitempty"`
 	JitterBuffer           uint16             `yaml:"jitterBuffer,omitempty"`
 	JitterBufferPktTimeout uint16             `yaml:"jitterBufferPktTimeout,omitempty"`
+	// URIs of the RTP header extensions to parse. The rest are skipped.
+	HeaderExtensions []string `yaml:"headerExtensions"`
 }
 
 type HTTP struct {
 	Enable bool `yaml:"enable,omitempty"`
 	Port   int  `yaml:"port,omitempty"`
+	TLS    TLS  `yaml:"tls,omitempty"`
 }
 
 type Prometheus struct {
 	Enable        bool   `yaml:"enable,omitempty"`
 	ListenAddress string `yaml:"listenAddress,omitempty"`
+	TLS           TLS    `yaml:"tls,omitempty"`
+}
+
+type GRPC struct {
+	Enable        bool   `yaml:"enable,omitempty"`
+	ListenAddress string `yaml:"listenAddress,omitempty"`
+	TLS           TLS    `yaml:"tls,omitempty"`
+}
+
+type Health struct {
+	Enable       bool          `yaml:"enable,omitempty"`
+	Port         int           `yaml:"port,omitempty"`
+	CheckLiveKit bool          `yaml:"checkLiveKit"`
+	Timeout      time.Duration `yaml:"timeout,omitempty"`
+	// Debug serves the active sessions under /debug/sessions, including
+	// force-stopping them
+	Debug bool `yaml:"debug,omitempty"`
+	TLS   TLS  `yaml:"tls,omitempty"`
+}
+
+// TLS serves an endpoint over TLS with the PEM certificate (chain) and key
+// of CertFile and KeyFile, reloaded when they change. With ClientCAFile,
+// clients must present a certificate signed by one of its PEM CAs (mutual
+// TLS).
+type TLS struct {
+	Enable       bool   `yaml:"enable,omitempty"`
+	CertFile     string `yaml:"certFile,omitempty"`
+	KeyFile      string `yaml:"keyFile,omitempty"`
+	ClientCAFile string `yaml:"clientCAFile,omitempty"`
+}
+
+// LiveKitTLS is how LiveKit's certificate is verified: against the system's
+// CAs and those of CAFile (PEM), or not at all with InsecureSkipVerify, for
+// development only
+type LiveKitTLS struct {
+	CAFile             string `yaml:"caFile,omitempty" mapstructure:"ca_file"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify,omitempty" mapstructure:"insecure_skip_verify"`
+}
+
+type Shutdown struct {
+	DrainTimeout time.Duration `yaml:"drainTimeout,omitempty"`
+}
+
+// Capacity caps the recordings a node runs at once to MaxSessions, 0 being
+// unlimited. Past it, Overflow "reject" fails new ones with reason
+// at_capacity, "queue" has them wait up to QueueTimeout for one to end.
+type Capacity struct {
+	MaxSessions  int           `yaml:"maxSessions,omitempty"`
+	Overflow     string        `yaml:"overflow,omitempty"`
+	QueueTimeout time.Duration `yaml:"queueTimeout,omitempty"`
 }
 
 type LiveKit struct {
-	Host                  string               `yaml:"host,omitempty" mapstructure:"host"`
-	APIKey                string               `yaml:"apiKey,omitempty" mapstructure:"api_key"`
-	APISecret             string               `yaml:"apiSecret,omitempty" mapstructure:"api_secret"`
-	PacketReadTimeout     time.Duration        `yaml:"packetReadTimeout,omitempty" mapstructure:"packet_read_timeout"`
-	PreferredVideoQuality livekit.VideoQuality `yaml:"preferredVideoQuality,omitempty" mapstructure:"preferred_video_quality"`
-	HealthCheck           HealthCheck          `yaml:"healthCheck,omitempty"`
-	WriteRTPDump          bool                 `yaml:"writeRTPDump"`
+	Host                    string               `yaml:"host,omitempty" mapstructure:"host"`
+	APIKey                  string               `yaml:"apiKey,omitempty" mapstructure:"api_key"`
+	APISecret               string               `yaml:"apiSecret,omitempty" mapstructure:"api_secret"`
+	Region                  Region               `yaml:"region,omitempty" mapstructure:"region"`
+	PacketReadTimeout       time.Duration        `yaml:"packetReadTimeout,omitempty" mapstructure:"packet_read_timeout"`
+	TrackPublishTimeout     time.Duration        `yaml:"trackPublishTimeout,omitempty" mapstructure:"track_publish_timeout"`
+	Timeouts                Timeouts             `yaml:"timeouts,omitempty" mapstructure:"timeouts"`
+	PreferredVideoQuality   livekit.VideoQuality `yaml:"preferredVideoQuality,omitempty" mapstructure:"preferred_video_quality"`
+	HealthCheck             HealthCheck          `yaml:"healthCheck,omitempty"`
+	WriteRTPDump            bool                 `yaml:"writeRTPDump"`
+	JitterBuffer            LiveKitJitterBuffer  `yaml:"jitterBuffer,omitempty" mapstructure:"jitter_buffer"`
+	Reconnect               Reconnect            `yaml:"reconnect,omitempty" mapstructure:"reconnect"`
+	MaxDuration             time.Duration        `yaml:"maxDuration,omitempty" mapstructure:"max_duration"`
+	KeyframeRequestInterval time.Duration        `yaml:"keyframeRequestInterval,omitempty" mapstructure:"keyframe_request_interval"`
+	FIR                     FIR                  `yaml:"fir,omitempty" mapstructure:"fir"`
+	// Replaces KeyframeRequestInterval for video tracks when enabled
+	AdaptiveKeyframeInterval AdaptiveKeyframeInterval `yaml:"adaptiveKeyframeInterval,omitempty" mapstructure:"adaptive_keyframe_interval"`
+	ScreenShare              ScreenShare              `yaml:"screenShare,omitempty" mapstructure:"screen_share"`
+	NACK                     NACK                     `yaml:"nack,omitempty" mapstructure:"nack"`
+	RecordNTPMapping         bool                     `yaml:"recordNtpMapping,omitempty" mapstructure:"record_ntp_mapping"`
+	E2EEKey                  string                   `yaml:"e2eeKey,omitempty" mapstructure:"e2ee_key"`
+	Limits                   Limits                   `yaml:"limits,omitempty" mapstructure:"limits"`
+	ReadErrors               ReadErrors               `yaml:"readErrors,omitempty" mapstructure:"read_errors"`
+	ReceiveQueue             ReceiveQueue             `yaml:"receiveQueue,omitempty" mapstructure:"receive_queue"`
+	FollowSpeaker            FollowSpeaker            `yaml:"followSpeaker,omitempty" mapstructure:"follow_speaker"`
+	AdaptiveQuality          AdaptiveQuality          `yaml:"adaptiveQuality,omitempty" mapstructure:"adaptive_quality"`
+	DataCapture              DataCapture              `yaml:"dataCapture,omitempty" mapstructure:"data_capture"`
+	// What's done with the tracks recording is disabled for at runtime:
+	// "stats" keeps reading them for their stats, "stop" has the SFU stop
+	// sending them
+	DisabledTracks string `yaml:"disabledTracks,omitempty" mapstructure:"disabled_tracks"`
+	// MIME types of the video codecs recorded. A requested video track in
+	// another one fails the recording. Empty records all supported codecs.
+	VideoCodecs []string `yaml:"videoCodecs,omitempty" mapstructure:"video_codecs"`
+	// URIs of the RTP header extensions to parse. The rest are skipped.
+	HeaderExtensions []string `yaml:"headerExtensions" mapstructure:"header_extensions"`
+	// How often stats snapshots are sent to live monitoring subscribers
+	// (see LiveKitWebRTC.SubscribeStats)
+	StatsInterval time.Duration `yaml:"statsInterval,omitempty" mapstructure:"stats_interval"`
+	// TLS of the connections to LiveKit (wss:// hosts)
+	TLS LiveKitTLS `yaml:"tls,omitempty" mapstructure:"tls"`
+}
+
+// Region pins recordings to a LiveKit region (or node) of a multi-region
+// deployment: rooms are joined at URLs[Name] instead of Host, without the
+// server's region discovery. If Name has no URL or the room can't be joined
+// there, Host (and its default routing) is used. An empty Name always uses
+// Host.
+type Region struct {
+	Name string            `yaml:"name,omitempty" mapstructure:"name"`
+	URLs map[string]string `yaml:"urls,omitempty" mapstructure:"urls"`
+}
+
+// FollowSpeaker records only the video of the room's dominant speaker, out
+// of the video tracks requested, switching tracks within the same file as
+// the speaker changes. Switches happen on keyframes of the new track, at
+// most once per MinInterval. All tracks must share the same codec.
+type FollowSpeaker struct {
+	Enabled     bool          `yaml:"enabled,omitempty" mapstructure:"enabled"`
+	MinInterval time.Duration `yaml:"minInterval,omitempty" mapstructure:"min_interval"`
+}
+
+// AdaptiveQuality keeps the video tracks recorded within MaxBitrate (bits/s),
+// shared evenly between them, by switching their simulcast layers. Each
+// starts on the highest layer, up to the one requested, whose advertised
+// bitrate fits its share. Over every Interval, a track measured above its
+// share steps down a layer, one whose next layer fits steps back up; a track
+// switches at most once per MinInterval.
+type AdaptiveQuality struct {
+	Enabled     bool          `yaml:"enabled,omitempty" mapstructure:"enabled"`
+	MaxBitrate  uint64        `yaml:"maxBitrate,omitempty" mapstructure:"max_bitrate"`
+	Interval    time.Duration `yaml:"interval,omitempty" mapstructure:"interval"`
+	MinInterval time.Duration `yaml:"minInterval,omitempty" mapstructure:"min_interval"`
+}
+
+// DataCapture writes the room's data messages (e.g. chat or annotations) to
+// a <name>-data.jsonl file next to the recording, each with the media
+// timestamp it was received at. Topics limits them to those topics; empty
+// captures all of them.
+type DataCapture struct {
+	Enabled bool     `yaml:"enabled,omitempty" mapstructure:"enabled"`
+	Topics  []string `yaml:"topics,omitempty" mapstructure:"topics"`
+}
+
+// RTP configures recordings of plain RTP received over UDP (adapter "rtp")
+type RTP struct {
+	// Latency is how long packets are held in the sample buffer waiting for
+	// late or reordered ones
+	Latency                 time.Duration `yaml:"latency,omitempty" mapstructure:"latency"`
+	KeyframeRequestInterval time.Duration `yaml:"keyframeRequestInterval,omitempty" mapstructure:"keyframe_request_interval"`
+}
+
+// Timeouts fail a recording that can't get going, each with its own reason
+// (see interfaces.CloseReason*): Connect bounds joining the room, Subscribe
+// how long each requested track may take to be subscribed to once
+// published, and FirstMedia how long it may then take to send its first
+// packet (muted tracks aside). 0 disables a timeout.
+type Timeouts struct {
+	Connect    time.Duration `yaml:"connect,omitempty" mapstructure:"connect"`
+	Subscribe  time.Duration `yaml:"subscribe,omitempty" mapstructure:"subscribe"`
+	FirstMedia time.Duration `yaml:"firstMedia,omitempty" mapstructure:"first_media"`
+}
+
+// FIR configures the escalation from PLIs to Full Intra Requests (RFC 5104)
+// for publishers that ignore PLIs. After AfterPLIs PLIs without a keyframe,
+// if none arrives within Timeout, keyframes are requested with FIRs until one
+// does. AfterPLIs 0 disables it.
+type FIR struct {
+	AfterPLIs int           `yaml:"afterPLIs,omitempty" mapstructure:"after_plis"`
+	Timeout   time.Duration `yaml:"timeout,omitempty" mapstructure:"timeout"`
+}
+
+// AdaptiveKeyframeInterval adapts the minimum interval between keyframe
+// requests of a video track to its recent loss rate: MaxInterval while the
+// stream is clean, down to MinInterval as the loss rate reaches HighLoss
+// (a fraction, 0-1).
+type AdaptiveKeyframeInterval struct {
+	Enabled     bool          `yaml:"enabled,omitempty" mapstructure:"enabled"`
+	MinInterval time.Duration `yaml:"minInterval,omitempty" mapstructure:"min_interval"`
+	MaxInterval time.Duration `yaml:"maxInterval,omitempty" mapstructure:"max_interval"`
+	HighLoss    float64       `yaml:"highLoss,omitempty" mapstructure:"high_loss"`
+}
+
+// ScreenShare configures the recording of screen share tracks, told apart
+// from cameras by their publication's source. Their content barely changes,
+// so keyframes are requested at most every KeyframeRequestInterval instead
+// (0 uses the one of cameras), and they aren't fit to a constant frame rate.
+type ScreenShare struct {
+	KeyframeRequestInterval time.Duration `yaml:"keyframeRequestInterval,omitempty" mapstructure:"keyframe_request_interval"`
+}
+
+// NACK configures requesting retransmissions of lost packets with generic
+// NACKs (RFC 4585), for tracks that negotiated them. Sequence numbers
+// missing within the last Window packets are NACKed every Interval, at most
+// MaxRetries times, for as long as the sample buffer waits for them.
+// Window 0 disables it.
+type NACK struct {
+	Window     uint16        `yaml:"window,omitempty" mapstructure:"window"`
+	Interval   time.Duration `yaml:"interval,omitempty" mapstructure:"interval"`
+	MaxRetries int           `yaml:"maxRetries,omitempty" mapstructure:"max_retries"`
+}
+
+// Limits bound what a session holds in its sample buffers, so a broken or
+// flooding publisher can't run the node out of memory. Past a limit, the
+// track's buffered packets are flushed to the recorder. 0 disables a limit.
+type Limits struct {
+	MaxTrackPendingPackets int   `yaml:"maxTrackPendingPackets,omitempty" mapstructure:"max_track_pending_packets"`
+	MaxSessionPendingBytes int64 `yaml:"maxSessionPendingBytes,omitempty" mapstructure:"max_session_pending_bytes"`
+}
+
+// ReadErrors configures how a track's reader copes with failing reads
+// (timeouts, see PacketReadTimeout, aside). Reads are retried after a
+// backoff, starting at Backoff and doubling up to MaxBackoff. Once more than
+// MaxConsecutive fail in a row within Window, the track is resubscribed to,
+// MaxResubscriptions times at most before its recording stops.
+type ReadErrors struct {
+	MaxConsecutive     int           `yaml:"maxConsecutive,omitempty" mapstructure:"max_consecutive"`
+	Window             time.Duration `yaml:"window,omitempty" mapstructure:"window"`
+	Backoff            time.Duration `yaml:"backoff,omitempty" mapstructure:"backoff"`
+	MaxBackoff         time.Duration `yaml:"maxBackoff,omitempty" mapstructure:"max_backoff"`
+	MaxResubscriptions int           `yaml:"maxResubscriptions,omitempty" mapstructure:"max_resubscriptions"`
+}
+
+// ReceiveQueue bounds the samples of a track waiting to be written, so
+// reading from the network doesn't wait on the recorder. Once Size samples
+// wait, Overflow "drop_oldest" drops the oldest one for the new one, while
+// "block" holds reading back for up to MaxBlock before doing so. Dropped
+// samples are counted in the track's receiveQueueOverflows stat. Size 0
+// writes samples as they're read.
+type ReceiveQueue struct {
+	Size     int           `yaml:"size,omitempty" mapstructure:"size"`
+	Overflow string        `yaml:"overflow,omitempty" mapstructure:"overflow"`
+	MaxBlock time.Duration `yaml:"maxBlock,omitempty" mapstructure:"max_block"`
+}
+
+// Reconnect configures how the recorder rejoins a LiveKit room after a
+// transient disconnect. MaxAttempts 0 disables reconnection.
+type Reconnect struct {
+	MaxAttempts    uint64        `yaml:"maxAttempts,omitempty" mapstructure:"max_attempts"`
+	MaxElapsedTime time.Duration `yaml:"maxElapsedTime,omitempty" mapstructure:"max_elapsed_time"`
+}
+
+// LiveKitJitterBuffer configures the packet reordering stage that sits between
+// the LiveKit track reader and the recorder, per track type
+type LiveKitJitterBuffer struct {
+	Video TrackJitterBuffer `yaml:"video,omitempty" mapstructure:"video"`
+	Audio TrackJitterBuffer `yaml:"audio,omitempty" mapstructure:"audio"`
+}
+
+type TrackJitterBuffer struct {
+	// Size is the buffer depth in packets. 0 disables reordering
+	Size uint16 `yaml:"size,omitempty" mapstructure:"size"`
+	// MaxDelay is how long a missing packet is waited for before it's
+	// reported as skipped
+	MaxDelay time.Duration `yaml:"maxDelay,omitempty" mapstructure:"max_delay"`
 }
 
 type HealthCheck struct {
@@ -154,4 +966,6 @@ type HealthCheck struct {
 
 type LogConfig struct {
 	Level string `yaml:"level"`
+	// auto (console on a TTY, JSON otherwise), json or console
+	Format string `yaml:"format,omitempty"`
 }
@@ -0,0 +1,396 @@
+// Package encryption encrypts recordings at rest, as a stream that's written
+// once, front to back, and never seeked over.
+//
+// An encrypted file starts with a plaintext header:
+//
+//	magic       "BBBENC"
+//	version     1 byte (1)
+//	scheme      1 byte (1: AES-GCM, chunked)
+//	chunk size  4 bytes, big endian
+//	nonce       7 bytes, random
+//	key ID      1 byte length, then the ID
+//
+// followed by the chunks: chunk size bytes of plaintext each, the last one
+// possibly shorter (or empty), sealed with AES-GCM. A chunk's nonce is the
+// header's, its index (4 bytes, big endian) and 1 for the last chunk, 0
+// otherwise; the header is the additional data of each chunk. Chunks can't
+// be reordered, dropped or truncated without failing to decrypt, and the
+// header can't be tampered with.
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+)
+
+// MagicSize is how many bytes IsEncrypted needs
+const MagicSize = len(magic)
+
+const (
+	magic         = "BBBENC"
+	version       = 1
+	schemeAESGCM  = 1
+	prefixSize    = 7
+	chunkSize     = 64 * 1024
+	fixedHeader   = len(magic) + 1 + 1 + 4 + prefixSize + 1
+	maxKeyIDBytes = math.MaxUint8
+)
+
+var (
+	// ErrNotEncrypted is returned when decrypting what isn't encrypted
+	ErrNotEncrypted = errors.New("not encrypted")
+	// ErrTruncated is returned when an encrypted file ends before its last
+	// chunk, e.g. after a crash
+	ErrTruncated = errors.New("encrypted file truncated")
+)
+
+// Key is a key recordings are encrypted with, and the ID written with them
+type Key struct {
+	ID   string
+	aead cipher.AEAD
+}
+
+// NewKey returns the key of secret, which is 16, 24 or 32 bytes long (AES-128,
+// AES-192 or AES-256)
+func NewKey(id string, secret []byte) (*Key, error) {
+	if len(id) > maxKeyIDBytes {
+		return nil, fmt.Errorf("key ID longer than %d bytes", maxKeyIDBytes)
+	}
+
+	block, err := aes.NewCipher(secret)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{ID: id, aead: aead}, nil
+}
+
+// Load returns the key configured, read from its file if it's set there
+func Load(cfg config.Encryption) (*Key, error) {
+	encoded := cfg.Key
+
+	if cfg.KeyFile != "" {
+		data, err := os.ReadFile(cfg.KeyFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key file: %w", err)
+		}
+
+		encoded = string(data)
+	}
+
+	encoded = strings.TrimSpace(encoded)
+
+	if encoded == "" {
+		return nil, errors.New("encryption enabled without a key")
+	}
+
+	secret, err := decodeSecret(encoded)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKey(cfg.KeyID, secret)
+}
+
+// decodeSecret decodes a hex or base64 encoded key
+func decodeSecret(encoded string) ([]byte, error) {
+	if secret, err := hex.DecodeString(encoded); err == nil {
+		return secret, nil
+	}
+
+	if secret, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+		return secret, nil
+	}
+
+	return nil, errors.New("encryption key is neither hex nor base64")
+}
+
+// IsEncrypted returns whether data starts like an encrypted file
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(magic))
+}
+
+// nonce returns the nonce of a chunk
+func nonce(prefix []byte, index uint32, last bool) []byte {
+	n := make([]byte, 0, prefixSize+5)
+	n = append(n, prefix...)
+	n = binary.BigEndian.AppendUint32(n, index)
+
+	if last {
+		return append(n, 1)
+	}
+
+	return append(n, 0)
+}
+
+// Writer encrypts what's written to it to the underlying writer. Nothing
+// reaches it until a chunk is full; Close writes the last one.
+type Writer struct {
+	w      io.WriteCloser
+	key    *Key
+	header []byte
+	prefix []byte
+	buf    []byte
+	index  uint32
+	err    error
+}
+
+// NewWriter returns a writer encrypting to w with key. The header is written
+// along with the first chunk.
+func NewWriter(w io.WriteCloser, key *Key) *Writer {
+	prefix := make([]byte, prefixSize)
+	// Never fails
+	_, _ = rand.Read(prefix)
+
+	header := make([]byte, 0, fixedHeader+len(key.ID))
+	header = append(header, magic...)
+	header = append(header, version, schemeAESGCM)
+	header = binary.BigEndian.AppendUint32(header, chunkSize)
+	header = append(header, prefix...)
+	header = append(header, byte(len(key.ID)))
+	header = append(header, key.ID...)
+
+	return &Writer{
+		w:      w,
+		key:    key,
+		header: header,
+		prefix: prefix,
+		buf:    make([]byte, 0, chunkSize),
+	}
+}
+
+func (e *Writer) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+
+	written := 0
+
+	for len(p) > 0 {
+		// A full chunk is only sealed once more follows: the last one is
+		// sealed on Close
+		if len(e.buf) == chunkSize {
+			if e.err = e.seal(false); e.err != nil {
+				return written, e.err
+			}
+		}
+
+		n := min(len(p), chunkSize-len(e.buf))
+		e.buf = append(e.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (e *Writer) seal(last bool) error {
+	if e.index == math.MaxUint32 {
+		return errors.New("encrypted file too large")
+	}
+
+	if e.index == 0 {
+		if _, err := e.w.Write(e.header); err != nil {
+			return err
+		}
+	}
+
+	if _, err := e.w.Write(e.key.aead.Seal(nil, nonce(e.prefix, e.index, last), e.buf, e.header)); err != nil {
+		return err
+	}
+
+	e.index++
+	e.buf = e.buf[:0]
+
+	return nil
+}
+
+// Close writes the last chunk and closes the underlying writer
+func (e *Writer) Close() error {
+	err := e.err
+
+	if err == nil {
+		err = e.seal(true)
+		e.err = errors.New("encrypted writer closed")
+	}
+
+	if closeErr := e.w.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Reader decrypts an encrypted stream
+type Reader struct {
+	r      *bufio.Reader
+	key    *Key
+	header []byte
+	prefix []byte
+	chunk  int
+	buf    []byte
+	index  uint32
+	done   bool
+}
+
+// NewReader reads the header of an encrypted stream, returning a reader of
+// its plaintext. Fails if it isn't encrypted, or not with key.
+func NewReader(r io.Reader, key *Key) (*Reader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, fixedHeader)
+
+	if _, err := io.ReadFull(br, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrNotEncrypted
+		}
+
+		return nil, err
+	}
+
+	if !IsEncrypted(header) {
+		return nil, ErrNotEncrypted
+	}
+
+	offset := len(magic)
+
+	if header[offset] != version || header[offset+1] != schemeAESGCM {
+		return nil, fmt.Errorf("unsupported encryption version %d, scheme %d", header[offset], header[offset+1])
+	}
+
+	chunk := int(binary.BigEndian.Uint32(header[offset+2:]))
+	prefix := header[offset+6 : offset+6+prefixSize]
+
+	if chunk <= 0 || chunk > 16*chunkSize {
+		return nil, fmt.Errorf("invalid encryption chunk size %d", chunk)
+	}
+
+	id := make([]byte, header[fixedHeader-1])
+
+	if _, err := io.ReadFull(br, id); err != nil {
+		return nil, ErrTruncated
+	}
+
+	if string(id) != key.ID {
+		return nil, fmt.Errorf("encrypted with key %q, not %q", id, key.ID)
+	}
+
+	return &Reader{
+		r:      br,
+		key:    key,
+		header: append(header, id...),
+		prefix: prefix,
+		chunk:  chunk,
+	}, nil
+}
+
+func (d *Reader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+
+	return n, nil
+}
+
+// open decrypts the next chunk
+func (d *Reader) open() error {
+	sealed := make([]byte, d.chunk+d.key.aead.Overhead())
+	n, err := io.ReadFull(d.r, sealed)
+
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		if errors.Is(err, io.EOF) {
+			return ErrTruncated
+		}
+
+		return err
+	}
+
+	// The last chunk is the one the stream ends with
+	_, peekErr := d.r.Peek(1)
+	last := errors.Is(peekErr, io.EOF)
+
+	plain, err := d.key.aead.Open(sealed[:0], nonce(d.prefix, d.index, last), sealed[:n], d.header)
+
+	if err != nil {
+		if last {
+			return ErrTruncated
+		}
+
+		return fmt.Errorf("failed to decrypt chunk %d: %w", d.index, err)
+	}
+
+	d.index++
+	d.buf = plain
+	d.done = last
+
+	return nil
+}
+
+// Decrypt writes the plaintext of the encrypted src to dst
+func Decrypt(dst io.Writer, src io.Reader, key *Key) error {
+	r, err := NewReader(src, key)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, r)
+
+	return err
+}
+
+// Encrypt returns data encrypted with key, e.g. for small files written at
+// once
+func Encrypt(data []byte, key *Key) ([]byte, error) {
+	var buf bytes.Buffer
+	w := NewWriter(nopCloser{&buf}, key)
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,138 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKey(t *testing.T, id string) *Key {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+	key, err := NewKey(id, secret)
+	require.NoError(t, err)
+
+	return key
+}
+
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := newTestKey(t, "k1")
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17} {
+		plain := make([]byte, size)
+		_, err := rand.Read(plain)
+		require.NoError(t, err)
+
+		var out closeRecorder
+		w := NewWriter(&out, key)
+
+		// Written in odd pieces, as muxers do
+		for rest := plain; len(rest) > 0; {
+			n := min(len(rest), 1000)
+			_, err := w.Write(rest[:n])
+			require.NoError(t, err)
+			rest = rest[n:]
+		}
+
+		require.NoError(t, w.Close())
+		assert.True(t, out.closed)
+		assert.True(t, IsEncrypted(out.Bytes()))
+
+		if size >= 64 {
+			assert.False(t, bytes.Contains(out.Bytes(), plain[:64]), "size %d: plaintext visible", size)
+		}
+
+		var decrypted bytes.Buffer
+		require.NoError(t, Decrypt(&decrypted, &out, key), "size %d", size)
+		assert.Equal(t, plain, decrypted.Bytes(), "size %d", size)
+	}
+}
+
+func TestDecrypt_Failures(t *testing.T) {
+	key := newTestKey(t, "k1")
+	plain := bytes.Repeat([]byte("recording"), chunkSize/4)
+	sealed, err := Encrypt(plain, key)
+	require.NoError(t, err)
+
+	decrypt := func(data []byte, key *Key) error {
+		var out bytes.Buffer
+		return Decrypt(&out, bytes.NewReader(data), key)
+	}
+
+	assert.NoError(t, decrypt(sealed, key))
+	assert.ErrorIs(t, decrypt(plain, key), ErrNotEncrypted)
+	assert.ErrorIs(t, decrypt(nil, key), ErrNotEncrypted)
+	assert.Error(t, decrypt(sealed, newTestKey(t, "k2")), "Another key ID")
+	assert.Error(t, decrypt(sealed, newTestKey(t, "k1")), "Another key")
+	assert.ErrorIs(t, decrypt(sealed[:len(sealed)-1], key), ErrTruncated)
+
+	// Cut at a chunk boundary: the chunk before isn't the last one
+	headerSize := fixedHeader + len(key.ID)
+	assert.ErrorIs(t, decrypt(sealed[:headerSize+chunkSize+key.aead.Overhead()], key), ErrTruncated)
+	assert.ErrorIs(t, decrypt(sealed[:headerSize], key), ErrTruncated)
+
+	tampered := bytes.Clone(sealed)
+	tampered[headerSize+10] ^= 1
+	assert.Error(t, decrypt(tampered, key))
+
+	tampered = bytes.Clone(sealed)
+	tampered[fixedHeader-2] ^= 1 // The nonce
+	assert.Error(t, decrypt(tampered, key))
+}
+
+func TestLoad(t *testing.T) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+
+	keyFile := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(secret)+"\n"), 0600))
+
+	tests := []struct {
+		name    string
+		cfg     config.Encryption
+		wantErr bool
+	}{
+		{"hex", config.Encryption{Key: hex.EncodeToString(secret), KeyID: "k1"}, false},
+		{"base64", config.Encryption{Key: base64.StdEncoding.EncodeToString(secret)}, false},
+		{"aes-128", config.Encryption{Key: hex.EncodeToString(secret[:16])}, false},
+		{"file", config.Encryption{Key: "ignored", KeyFile: keyFile}, false},
+		{"missing file", config.Encryption{KeyFile: keyFile + ".missing"}, true},
+		{"no key", config.Encryption{}, true},
+		{"not encoded", config.Encryption{Key: "not a key!"}, true},
+		{"wrong size", config.Encryption{Key: hex.EncodeToString(secret[:10])}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := Load(tt.cfg)
+
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.cfg.KeyID, key.ID)
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package logging
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Log formats
+const (
+	FormatAuto    = "auto" // Console on a TTY, JSON otherwise
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+// Fields attached to the lines logged about each session, by session ID
+var sessions sync.Map
+
+// SetSessionFields attaches fields (e.g. the recorded track IDs) to every
+// line logged with the given "session" field, until ClearSession is called.
+// Fields set on the line itself take precedence.
+func SetSessionFields(session string, fields log.Fields) {
+	sessions.Store(session, fields)
+}
+
+// ClearSession stops attaching fields to the lines logged about a session
+func ClearSession(session string) {
+	sessions.Delete(session)
+}
+
+// SessionHook is a logrus hook adding the fields set by SetSessionFields to
+// the lines of the sessions they were set for
+type SessionHook struct{}
+
+func (SessionHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (SessionHook) Fire(entry *log.Entry) error {
+	session, ok := entry.Data["session"]
+
+	if !ok || session == nil {
+		return nil
+	}
+
+	fields, ok := sessions.Load(fmt.Sprint(session))
+
+	if !ok {
+		return nil
+	}
+
+	// Each line gets its own copy of the entry's data, it's safe to add to
+	for k, v := range fields.(log.Fields) {
+		if _, ok := entry.Data[k]; !ok {
+			entry.Data[k] = v
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLogger() (*log.Logger, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	logger := log.New()
+	logger.SetOutput(buf)
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.AddHook(SessionHook{})
+
+	return logger, buf
+}
+
+func lastLine(t *testing.T, buf *bytes.Buffer) map[string]any {
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	line := map[string]any{}
+	require.NoError(t, json.Unmarshal(lines[len(lines)-1], &line))
+
+	return line
+}
+
+func TestSessionHook(t *testing.T) {
+	logger, buf := newTestLogger()
+
+	SetSessionFields("sess-1", log.Fields{"trackIds": []string{"TR_1", "TR_2"}, "trackID": "TR_1"})
+
+	logger.WithField("session", "sess-1").Info("Recording")
+	line := lastLine(t, buf)
+	assert.Equal(t, []any{"TR_1", "TR_2"}, line["trackIds"])
+
+	// The line's own fields win
+	logger.WithField("session", "sess-1").WithField("trackID", "TR_2").Info("Track")
+	assert.Equal(t, "TR_2", lastLine(t, buf)["trackID"])
+
+	// Other sessions and lines without one are left alone
+	logger.WithField("session", "sess-2").Info("Other")
+	assert.NotContains(t, lastLine(t, buf), "trackIds")
+	logger.Info("Global")
+	assert.NotContains(t, lastLine(t, buf), "trackIds")
+
+	ClearSession("sess-1")
+	logger.WithField("session", "sess-1").Info("Done")
+	assert.NotContains(t, lastLine(t, buf), "trackIds")
+}
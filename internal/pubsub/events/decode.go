@@ -25,6 +25,8 @@ func Decode(message []byte) *Event {
 		s = &StartRecording{}
 	case "stopRecording":
 		s = &StopRecording{}
+	case "cancelRecording":
+		s = &CancelRecording{}
 	case "startRecordingResponse":
 		s = &StartRecordingResponse{}
 	case "recordingRtpStatusChanged":
@@ -35,6 +37,18 @@ func Decode(message []byte) *Event {
 		s = &RecorderStatus{}
 	case "getRecordings":
 		s = &GetRecordings{}
+	case "updateEncryptionKey":
+		s = &UpdateEncryptionKey{}
+	case "addChapter":
+		s = &AddChapter{}
+	case "setTrackRecording":
+		s = &SetTrackRecording{}
+	case "validateRecording":
+		s = &ValidateRecording{}
+	case "getRecorderCapabilities":
+		s = &GetRecorderCapabilities{}
+	case "recorderCapabilities":
+		s = &RecorderCapabilities{}
 	default:
 		var v map[string]interface{}
 		s = &v
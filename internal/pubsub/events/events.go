@@ -2,6 +2,9 @@ package events
 
 import (
 	"fmt"
+	"net/url"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/AlekSi/pointer"
@@ -17,6 +20,7 @@ type AdapterType string
 const (
 	AdapterMediasoup AdapterType = "mediasoup"
 	AdapterLiveKit   AdapterType = "livekit"
+	AdapterRTP       AdapterType = "rtp"
 )
 
 const (
@@ -24,21 +28,47 @@ const (
 	StartRecordingResponseKey    = "startRecordingResponse"
 	RecordingRtpStatusChangedKey = "recordingRtpStatusChanged"
 	StopRecordingKey             = "stopRecording"
+	CancelRecordingKey           = "cancelRecording"
 	RecordingStoppedKey          = "recordingStopped"
+	RecordingUploadedKey         = "recordingUploaded"
 	RecorderStatusKey            = "recorderStatus"
 	GetRecorderStatusKey         = "getRecorderStatus"
 	GetRecordingsKey             = "getRecordings"
 	GetRecordingsResponseKey     = "getRecordingsResponse"
+	UpdateEncryptionKeyKey       = "updateEncryptionKey"
+	AddChapterKey                = "addChapter"
+	SetTrackRecordingKey         = "setTrackRecording"
+	ValidateRecordingKey         = "validateRecording"
+	RecordingMediaEventKey       = "recordingMediaEvent"
+	ValidateRecordingResponseKey = "validateRecordingResponse"
+	GetRecorderCapabilitiesKey   = "getRecorderCapabilities"
+	RecorderCapabilitiesKey      = "recorderCapabilities"
 )
 
 const (
-	StopReasonAppShutdown = "application_shutdown"
-	StopReasonNormal      = "stopped"
+	StopReasonAppShutdown   = "application_shutdown"
+	StopReasonNormal        = "stopped"
+	StopReasonMaxDuration   = "max_duration"
+	StopReasonOutOfDisk     = "out_of_disk"
+	StopReasonNoMedia       = "no_media"
+	StopReasonQuotaExceeded = "quota_exceeded"
+	StopReasonForced        = "forced"
+	StopReasonCanceled      = "canceled"
+	// The recording's file couldn't be set up to be written
+	StopReasonWriteFailed = "write_failed"
+	// A LiveKit track wasn't subscribed to, or sent nothing, in time
+	StopReasonSubscribeTimeout  = "subscribe_timeout"
+	StopReasonFirstMediaTimeout = "first_media_timeout"
 )
 
+// FailReasonAtCapacity is the reason a recording fails to start with when
+// the recorder runs as many as it may
+const FailReasonAtCapacity = "at_capacity"
+
 type AdapterOptions struct {
 	Mediasoup *MediasoupConfig `json:"mediasoup,omitempty"`
 	LiveKit   *LiveKitConfig   `json:"livekit,omitempty"`
+	RTP       *RTPConfig       `json:"rtp,omitempty"`
 }
 
 type MediasoupConfig struct {
@@ -46,8 +76,185 @@ type MediasoupConfig struct {
 }
 
 type LiveKitConfig struct {
-	Room     string   `json:"room,omitempty"`
-	TrackIDs []string `json:"trackIds,omitempty"`
+	Room       string            `json:"room,omitempty"`
+	TrackIDs   []string          `json:"trackIds,omitempty"`
+	VideoLayer *VideoLayerConfig `json:"videoLayer,omitempty"`
+	// Shared key for end-to-end encrypted tracks
+	E2EEKey string `json:"e2eeKey,omitempty"`
+	// Mixes the audio tracks into a single one instead of interleaving them
+	AudioMix *AudioMixConfig `json:"audioMix,omitempty"`
+	// Records only the dominant speaker's video, see config.FollowSpeaker
+	FollowSpeaker bool `json:"followSpeaker,omitempty"`
+	// Captures the room's data messages, see config.DataCapture
+	DataCapture *DataCaptureConfig `json:"dataCapture,omitempty"`
+	// Adapts the video layers to a bitrate budget, see config.AdaptiveQuality
+	AdaptiveQuality *AdaptiveQualityConfig `json:"adaptiveQuality,omitempty"`
+	// Records the room's tracks matching it, including those published
+	// later, instead of (or on top of) TrackIDs
+	AllTracks *TrackFilter `json:"allTracks,omitempty"`
+}
+
+// Track sources a TrackFilter can match, as named by LiveKit
+var TrackSources = []string{"camera", "microphone", "screen_share", "screen_share_audio"}
+
+// TrackFilter selects tracks in a room. Empty fields match any track.
+type TrackFilter struct {
+	// Publisher identities
+	Participants []string `json:"participants,omitempty"`
+	// Out of TrackSources
+	Sources []string `json:"sources,omitempty"`
+}
+
+func (f *TrackFilter) Validate() error {
+	if f == nil {
+		return nil
+	}
+
+	for _, source := range f.Sources {
+		if !slices.Contains(TrackSources, source) {
+			return fmt.Errorf("unknown track source %s", source)
+		}
+	}
+
+	return nil
+}
+
+// Matches returns whether the filter selects a track of source published
+// by participant
+func (f *TrackFilter) Matches(participant, source string) bool {
+	return (len(f.Participants) == 0 || slices.Contains(f.Participants, participant)) &&
+		(len(f.Sources) == 0 || slices.Contains(f.Sources, source))
+}
+
+type DataCaptureConfig struct {
+	// Overrides the topics captured if set
+	Topics []string `json:"topics,omitempty"`
+}
+
+type AdaptiveQualityConfig struct {
+	// Overrides the bitrate budget (bits/s) if set
+	MaxBitrate uint64 `json:"maxBitrate,omitempty"`
+}
+
+type AudioMixConfig struct {
+	// Linear gain by track ID, 1 if unset
+	Gains map[string]float64 `json:"gains,omitempty"`
+}
+
+// RTPConfig receives plain RTP over UDP, e.g. forwarded by an SFU or sent by
+// GStreamer/FFmpeg, without any signaling
+type RTPConfig struct {
+	// Local address to receive RTP on, e.g. "127.0.0.1:5004"
+	ListenAddress string `json:"listenAddress,omitempty"`
+	// Optional address to send keyframe requests (RTCP PLI) to
+	RTCPAddress string           `json:"rtcpAddress,omitempty"`
+	Tracks      []RTPTrackConfig `json:"tracks,omitempty"`
+}
+
+// RTPTrackConfig maps incoming packets to a track, by SSRC or, if unset, by
+// payload type (the first SSRC seen with it is then kept)
+type RTPTrackConfig struct {
+	ID          string `json:"id,omitempty"`
+	SSRC        uint32 `json:"ssrc,omitempty"`
+	PayloadType uint8  `json:"payloadType,omitempty"`
+	MimeType    string `json:"mimeType,omitempty"`
+	// Defaults to the codec's usual rate (90000 for video, 48000 for Opus)
+	ClockRate uint32 `json:"clockRate,omitempty"`
+	// Opus channel layout: the channel count and fmtp parameters as in the
+	// SDP (stereo=1, or num_streams/coupled_streams/channel_mapping for
+	// audio/multiopus). Mono if both are unset.
+	Channels uint16 `json:"channels,omitempty"`
+	Fmtp     string `json:"fmtp,omitempty"`
+}
+
+// WebhookOptions override the configured webhook of a recording. Unset
+// fields keep the configured values.
+type WebhookOptions struct {
+	URL    string `json:"url,omitempty"`
+	Secret string `json:"secret,omitempty"`
+	// Delivery attempts per event, including the first one
+	MaxAttempts uint64 `json:"maxAttempts,omitempty"`
+}
+
+func (o *WebhookOptions) Validate() error {
+	if o == nil || o.URL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(o.URL)
+
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook url %s", o.URL)
+	}
+
+	return nil
+}
+
+// Formats a recording may be written in (see RecordingOverrides)
+const (
+	FormatWebM = "webm"
+	FormatMKV  = "mkv"
+	FormatMP4  = "mp4"
+)
+
+// RecordingOverrides override configured defaults of a recording, within the
+// bounds the recorder allows. Unset fields keep the configured values.
+type RecordingOverrides struct {
+	// "webm" (Matroska for H.264), "mkv" (Matroska) or "mp4" (fragmented
+	// MP4)
+	Format string `json:"format,omitempty"`
+	// Quota of the recording, in media time and bytes written
+	MaxDurationMs int64  `json:"maxDurationMs,omitempty"`
+	MaxBytes      uint64 `json:"maxBytes,omitempty"`
+	// Uploads the recording under that prefix, within the configured one
+	UploadPrefix string `json:"uploadPrefix,omitempty"`
+	// MIME types of the video codecs recorded (LiveKit only)
+	VideoCodecs []string `json:"videoCodecs,omitempty"`
+}
+
+func (o *RecordingOverrides) Validate() error {
+	if o == nil {
+		return nil
+	}
+
+	switch o.Format {
+	case "", FormatWebM, FormatMKV, FormatMP4:
+	default:
+		return fmt.Errorf("invalid format override %s", o.Format)
+	}
+
+	if o.MaxDurationMs < 0 {
+		return fmt.Errorf("invalid max duration override %d", o.MaxDurationMs)
+	}
+
+	if strings.HasPrefix(o.UploadPrefix, "/") || slices.Contains(strings.Split(o.UploadPrefix, "/"), "..") {
+		return fmt.Errorf("invalid upload prefix override %s", o.UploadPrefix)
+	}
+
+	return nil
+}
+
+// Redacted returns a copy of the options without secrets, fit for echoing
+// back to requesters
+func (o *AdapterOptions) Redacted() *AdapterOptions {
+	if o == nil || o.LiveKit == nil || o.LiveKit.E2EEKey == "" {
+		return o
+	}
+
+	redacted := *o
+	lk := *o.LiveKit
+	lk.E2EEKey = ""
+	redacted.LiveKit = &lk
+
+	return &redacted
+}
+
+// VideoLayerConfig selects the simulcast layer to record, by quality
+// ("high", "medium" or "low") or by target resolution
+type VideoLayerConfig struct {
+	Quality string `json:"quality,omitempty"`
+	Width   uint32 `json:"width,omitempty"`
+	Height  uint32 `json:"height,omitempty"`
 }
 
 func (e *Event) IsValid() bool {
@@ -68,6 +275,34 @@ func (e *Event) StartRecordingResponse() *StartRecordingResponse {
 	return nil
 }
 
+func (e *Event) CancelRecording() *CancelRecording {
+	if ev, ok := e.Data.(*CancelRecording); ok {
+		return ev
+	}
+	return nil
+}
+
+func (e *Event) UpdateEncryptionKey() *UpdateEncryptionKey {
+	if ev, ok := e.Data.(*UpdateEncryptionKey); ok {
+		return ev
+	}
+	return nil
+}
+
+func (e *Event) AddChapter() *AddChapter {
+	if ev, ok := e.Data.(*AddChapter); ok {
+		return ev
+	}
+	return nil
+}
+
+func (e *Event) SetTrackRecording() *SetTrackRecording {
+	if ev, ok := e.Data.(*SetTrackRecording); ok {
+		return ev
+	}
+	return nil
+}
+
 func (e *Event) StopRecording() *StopRecording {
 	if ev, ok := e.Data.(*StopRecording); ok {
 		return ev
@@ -84,7 +319,7 @@ startRecording (SFU -> Recorder)
 		recordingSessionId: <String> // requester-defined - error out if collision.
 		sdp?: <String>, // offer
 		fileName: <String>, // file name INCLUDING format (.webm)
-		adapter: <String>, // "mediasoup" or "livekit"
+		adapter: <String>, // "mediasoup", "livekit" or "rtp"
 		adapterOptions: <Object>, // adapter-specific configuration
 	}
 
@@ -94,15 +329,30 @@ type StartRecording struct {
 	Id             string          `json:"id,omitempty"`
 	SessionId      string          `json:"recordingSessionId,omitempty"`
 	FileName       string          `json:"fileName,omitempty"`
-	Adapter        AdapterType     `json:"adapter,omitempty"` // "mediasoup" or "livekit"
+	Adapter        AdapterType     `json:"adapter,omitempty"` // "mediasoup", "livekit" or "rtp"
 	AdapterOptions *AdapterOptions `json:"adapterOptions,omitempty"`
 	Metadata       map[string]any  `json:"metadata,omitempty"`
+	// Tags embedded in the recording's container, e.g. TITLE, on top of
+	// the configured ones and its session and room IDs
+	Tags map[string]string `json:"tags,omitempty"`
+	// Overrides the configured webhook for this recording
+	Webhook *WebhookOptions `json:"webhook,omitempty"`
+	// Overrides configured defaults for this recording
+	Overrides *RecordingOverrides `json:"overrides,omitempty"`
 	// Legacy field for backward compatibility - check AdapterOptions#Mediasoup#SDP
 	// for the new format
 	SDP string `json:"sdp,omitempty"`
 }
 
 func (e *StartRecording) Validate() error {
+	if err := e.Webhook.Validate(); err != nil {
+		return err
+	}
+
+	if err := e.Overrides.Validate(); err != nil {
+		return err
+	}
+
 	switch e.Adapter {
 	case AdapterLiveKit:
 		if e.AdapterOptions == nil || e.AdapterOptions.LiveKit == nil {
@@ -113,9 +363,19 @@ func (e *StartRecording) Validate() error {
 			return fmt.Errorf("livekit adapter requires room name")
 		}
 
-		if len(e.AdapterOptions.LiveKit.TrackIDs) == 0 {
-			return fmt.Errorf("livekit adapter requires at least one track ID")
+		if err := e.AdapterOptions.LiveKit.AllTracks.Validate(); err != nil {
+			return err
+		}
+
+		if len(e.AdapterOptions.LiveKit.TrackIDs) == 0 && e.AdapterOptions.LiveKit.AllTracks == nil {
+			return fmt.Errorf("livekit adapter requires at least one track ID or allTracks")
 		}
+	case AdapterRTP:
+		if e.AdapterOptions == nil || e.AdapterOptions.RTP == nil {
+			return fmt.Errorf("rtp adapter requires rtp configuration")
+		}
+
+		return e.AdapterOptions.RTP.Validate()
 	case AdapterMediasoup:
 		// TODO remove legacy SDP field later on - prlanzarin
 		if e.AdapterOptions != nil && e.AdapterOptions.Mediasoup != nil && e.AdapterOptions.Mediasoup.SDP != "" {
@@ -141,6 +401,40 @@ func (e *StartRecording) Validate() error {
 	return nil
 }
 
+func (c *RTPConfig) Validate() error {
+	if c.ListenAddress == "" {
+		return fmt.Errorf("rtp adapter requires a listen address")
+	}
+
+	if len(c.Tracks) == 0 {
+		return fmt.Errorf("rtp adapter requires at least one track")
+	}
+
+	ids := make(map[string]bool, len(c.Tracks))
+
+	for _, track := range c.Tracks {
+		if track.ID == "" {
+			return fmt.Errorf("rtp track requires an ID")
+		}
+
+		if ids[track.ID] {
+			return fmt.Errorf("duplicate rtp track ID %s", track.ID)
+		}
+
+		ids[track.ID] = true
+
+		if track.MimeType == "" {
+			return fmt.Errorf("rtp track %s requires a mime type", track.ID)
+		}
+
+		if track.SSRC == 0 && track.PayloadType == 0 {
+			return fmt.Errorf("rtp track %s requires an SSRC or a payload type", track.ID)
+		}
+	}
+
+	return nil
+}
+
 func (e *StartRecording) GetSDP() string {
 	// TODO remove legacy SDP field later on - prlanzarin
 	if e.AdapterOptions != nil && e.AdapterOptions.Mediasoup != nil && e.AdapterOptions.Mediasoup.SDP != "" {
@@ -149,6 +443,29 @@ func (e *StartRecording) GetSDP() string {
 	return e.SDP
 }
 
+// TrackIDs returns the IDs of the tracks to be recorded, if the adapter
+// names them (LiveKit and RTP)
+func (e *StartRecording) TrackIDs() []string {
+	if e.AdapterOptions == nil {
+		return nil
+	}
+
+	switch {
+	case e.AdapterOptions.LiveKit != nil:
+		return e.AdapterOptions.LiveKit.TrackIDs
+	case e.AdapterOptions.RTP != nil:
+		ids := make([]string, 0, len(e.AdapterOptions.RTP.Tracks))
+
+		for _, track := range e.AdapterOptions.RTP.Tracks {
+			ids = append(ids, track.ID)
+		}
+
+		return ids
+	default:
+		return nil
+	}
+}
+
 func (e *StartRecording) Fail(err error) *StartRecordingResponse {
 	r := StartRecordingResponse{
 		Id:        StartRecordingResponseKey,
@@ -159,6 +476,13 @@ func (e *StartRecording) Fail(err error) *StartRecordingResponse {
 	return &r
 }
 
+// FailWithReason is Fail with the machine-readable reason it failed for
+func (e *StartRecording) FailWithReason(err error, reason string) *StartRecordingResponse {
+	r := e.Fail(err)
+	r.Reason = pointer.ToString(reason)
+	return r
+}
+
 func (e *StartRecording) Success(sdp, fileName string, metadata map[string]any) *StartRecordingResponse {
 	r := StartRecordingResponse{
 		Id:        StartRecordingResponseKey,
@@ -180,6 +504,7 @@ startRecordingResponse (Recorder -> SFU)
 	recordingSessionId: <String>, // file name,
 	status: 'ok' | 'failed',
 	error: undefined | <String>,
+	reason: undefined | <String>, // failures only, e.g. 'connect_timeout'
 	sdp: <String | undefined>, // answer
 	fileName: <String | undefined>, // full path to recording
 }
@@ -191,6 +516,7 @@ type StartRecordingResponse struct {
 	SessionId string         `json:"recordingSessionId,omitempty"`
 	Status    string         `json:"status,omitempty"`
 	Error     *string        `json:"error,omitempty"`
+	Reason    *string        `json:"reason,omitempty"`
 	SDP       *string        `json:"sdp,omitempty"`
 	FileName  *string        `json:"fileName,omitempty"`
 	Adapter   *string        `json:"adapter,omitempty"`
@@ -208,7 +534,7 @@ func (e *StartRecordingResponse) Validate() error {
 		return fmt.Errorf("invalid status: %s", e.Status)
 	}
 	if e.Status == "ok" {
-		if e.Error != nil {
+		if e.Error != nil || e.Reason != nil {
 			return fmt.Errorf("error field should not be present in success response")
 		}
 		if e.FileName == nil {
@@ -258,6 +584,68 @@ func NewRecordingRtpStatusChanged(id string, status bool, ts time.Duration) *Rec
 	}
 }
 
+const (
+	MediaEventFirstPacket   = "firstPacket"
+	MediaEventFirstKeyframe = "firstKeyframe"
+)
+
+/*
+recordingMediaEvent (Recorder -> SFU)
+```JSON5
+{
+	id: 'recordingMediaEvent',
+	recordingSessionId: <String>,
+	event: 'firstPacket' | 'firstKeyframe', // first RTP packet of a track, first keyframe written
+	trackId: <String>,
+	kind: 'audio' | 'video',
+	timestampUTC: <Number>, // event ts, UTC
+	timestampHR: <Number>, // event ts, monotonic system time
+	rtpTimestamp: <Number | undefined>, // firstPacket: RTP timestamp of the packet
+	mediaTimestamp: <Number | undefined>, // firstKeyframe: position in the recording
+}
+```
+*/
+
+type RecordingMediaEvent struct {
+	Id             string        `json:"id,omitempty"`
+	SessionId      string        `json:"recordingSessionId,omitempty"`
+	Event          string        `json:"event,omitempty"`
+	TrackId        string        `json:"trackId,omitempty"`
+	Kind           string        `json:"kind,omitempty"`
+	TimestampUTC   time.Time     `json:"timestampUTC"`
+	TimestampHR    time.Duration `json:"timestampHR"`
+	RTPTimestamp   *uint32       `json:"rtpTimestamp,omitempty"`
+	MediaTimestamp *int64        `json:"mediaTimestamp,omitempty"`
+}
+
+func NewRecordingFirstPacket(id, trackId, kind string, ts time.Duration, rtpTs uint32) *RecordingMediaEvent {
+	return &RecordingMediaEvent{
+		Id:           RecordingMediaEventKey,
+		SessionId:    id,
+		Event:        MediaEventFirstPacket,
+		TrackId:      trackId,
+		Kind:         kind,
+		TimestampUTC: time.Now().UTC(),
+		TimestampHR:  ts,
+		RTPTimestamp: &rtpTs,
+	}
+}
+
+func NewRecordingFirstKeyframe(id, trackId string, ts time.Duration, mediaTs time.Duration) *RecordingMediaEvent {
+	mediaTsMs := int64(mediaTs)
+
+	return &RecordingMediaEvent{
+		Id:             RecordingMediaEventKey,
+		SessionId:      id,
+		Event:          MediaEventFirstKeyframe,
+		TrackId:        trackId,
+		Kind:           "video",
+		TimestampUTC:   time.Now().UTC(),
+		TimestampHR:    ts,
+		MediaTimestamp: &mediaTsMs,
+	}
+}
+
 /*
 stopRecording (SFU -> Recorder)
 ```JSON5
@@ -273,6 +661,21 @@ type StopRecording struct {
 	SessionId string `json:"recordingSessionId,omitempty"`
 }
 
+/*
+cancelRecording (SFU -> Recorder)
+```JSON5
+{
+	id: 'cancelRecording', // stops the recording and deletes it, uploads included
+	recordingSessionId: <String>,
+}
+```
+*/
+
+type CancelRecording struct {
+	Id        string `json:"id,omitempty"`
+	SessionId string `json:"recordingSessionId,omitempty"`
+}
+
 func (e *StopRecording) Stopped(reason string, ts time.Duration) *RecordingStopped {
 	return &RecordingStopped{
 		Id:           RecordingStoppedKey,
@@ -283,6 +686,61 @@ func (e *StopRecording) Stopped(reason string, ts time.Duration) *RecordingStopp
 	}
 }
 
+/*
+updateEncryptionKey (SFU -> Recorder)
+```JSON5
+{
+	id: 'updateEncryptionKey',
+	recordingSessionId: <String>,
+	key: <String>, // shared key, as set in the clients' key provider
+	keyIndex: <Number>, // key ring index the clients encrypt with, 0 by default
+}
+```
+*/
+
+type UpdateEncryptionKey struct {
+	Id        string `json:"id,omitempty"`
+	SessionId string `json:"recordingSessionId,omitempty"`
+	Key       string `json:"key,omitempty"`
+	KeyIndex  uint8  `json:"keyIndex,omitempty"`
+}
+
+/*
+addChapter (SFU -> Recorder)
+```JSON5
+{
+	id: 'addChapter',
+	recordingSessionId: <String>,
+	title: <String>, // e.g. the breakout room's name
+}
+```
+*/
+
+type AddChapter struct {
+	Id        string `json:"id,omitempty"`
+	SessionId string `json:"recordingSessionId,omitempty"`
+	Title     string `json:"title,omitempty"`
+}
+
+/*
+setTrackRecording (SFU -> Recorder)
+```JSON5
+{
+	id: 'setTrackRecording',
+	recordingSessionId: <String>,
+	trackId: <String>, // one of the tracks recorded
+	enabled: <Boolean>, // false stops writing it, true resumes
+}
+```
+*/
+
+type SetTrackRecording struct {
+	Id        string `json:"id,omitempty"`
+	SessionId string `json:"recordingSessionId,omitempty"`
+	TrackId   string `json:"trackId,omitempty"`
+	Enabled   bool   `json:"enabled"`
+}
+
 /*
 recordingStopped (Recorder -> SFU)
 ```JSON5
@@ -291,17 +749,19 @@ recordingStopped (Recorder -> SFU)
 	recordingSessionId: <String>, // file name
 	reason: <String>,
   	timestampUTC: <Number>, // last written frame timestamp, UTC, wall clock
-	timestampHR:  <Number> // last written frame timestamp, monotonic system time
+	timestampHR:  <Number>, // last written frame timestamp, monotonic system time
+	trackErrors: <Object>, // optional, track ID -> why a requested track wasn't recorded
 }
 ```
 */
 
 type RecordingStopped struct {
-	Id           string        `json:"id,omitempty"`
-	SessionId    string        `json:"recordingSessionId,omitempty"`
-	Reason       string        `json:"reason,omitempty"`
-	TimestampUTC time.Time     `json:"timestampUTC,omitempty"`
-	TimestampHR  time.Duration `json:"timestampHR,omitempty"`
+	Id           string            `json:"id,omitempty"`
+	SessionId    string            `json:"recordingSessionId,omitempty"`
+	Reason       string            `json:"reason,omitempty"`
+	TimestampUTC time.Time         `json:"timestampUTC,omitempty"`
+	TimestampHR  time.Duration     `json:"timestampHR,omitempty"`
+	TrackErrors  map[string]string `json:"trackErrors,omitempty"`
 }
 
 func NewRecordingStopped(id, reason string, ts time.Duration) *RecordingStopped {
@@ -314,6 +774,35 @@ func NewRecordingStopped(id, reason string, ts time.Duration) *RecordingStopped
 	}
 }
 
+/*
+recordingUploaded (Recorder -> SFU)
+```JSON5
+{
+	id: 'recordingUploaded',
+	recordingSessionId: <String>, // file name
+	files: <String[]>, // files uploaded
+	uploadError: <String>, // optional, set if uploading the recording failed
+	canceled: <Boolean>, // optional, set if cancelRecording discarded it while uploading
+}
+```
+*/
+
+type RecordingUploaded struct {
+	Id          string   `json:"id,omitempty"`
+	SessionId   string   `json:"recordingSessionId,omitempty"`
+	Files       []string `json:"files"`
+	UploadError string   `json:"uploadError,omitempty"`
+	Canceled    bool     `json:"canceled,omitempty"`
+}
+
+func NewRecordingUploaded(id string, files []string) *RecordingUploaded {
+	return &RecordingUploaded{
+		Id:        RecordingUploadedKey,
+		SessionId: id,
+		Files:     files,
+	}
+}
+
 /*
 recorderStatus (Recorder -> *)
 ```JSON5
@@ -366,6 +855,93 @@ func (e *GetRecorderStatus) Status(appVersion string, instanceId string) *Record
 	return NewRecorderStatus(appVersion, instanceId)
 }
 
+/*
+getRecorderCapabilities (* -> Recorder)
+```JSON5
+{
+	id: 'getRecorderCapabilities',
+	requestId: <String>, // requester-defined - for request/response correlation
+}
+```
+*/
+
+type GetRecorderCapabilities struct {
+	Id        string `json:"id,omitempty"`
+	RequestId string `json:"requestId,omitempty"`
+}
+
+func (e *Event) GetRecorderCapabilities() *GetRecorderCapabilities {
+	if ev, ok := e.Data.(*GetRecorderCapabilities); ok {
+		return ev
+	}
+	return nil
+}
+
+// CapabilitiesVersion is the version of the recorderCapabilities format.
+// Capabilities are only ever added to a version; it's bumped if existing
+// ones change meaning or go away.
+const CapabilitiesVersion = 1
+
+/*
+recorderCapabilities (Recorder -> *)
+```JSON5
+{
+	id: 'recorderCapabilities',
+	requestId: <String>, // mirrors the requestId from the request, empty on startup
+	version: <Number>, // of this format, see CapabilitiesVersion
+	appVersion: <String>, // version of the recorder
+	instanceId: <String>, // unique instance id
+	adapters: {
+		<String>: { // "mediasoup", "livekit" or "rtp"
+			codecs: [<String>], // input MIME types, e.g. "video/vp8"
+			features: [<String>], // e.g. "e2ee", "simulcast_layer_selection"
+		},
+	},
+	containers: [<String>], // output containers, e.g. "webm", "mkv"
+	features: [<String>], // e.g. "transcoding", "snapshots"
+	timestamp: <Number>, // event generation timestamp
+}
+```
+*/
+
+type RecorderCapabilities struct {
+	Id         string                              `json:"id,omitempty"`
+	RequestId  string                              `json:"requestId,omitempty"`
+	Version    int                                 `json:"version"`
+	AppVersion string                              `json:"appVersion,omitempty"`
+	InstanceId string                              `json:"instanceId,omitempty"`
+	Adapters   map[AdapterType]AdapterCapabilities `json:"adapters"`
+	Containers []string                            `json:"containers"`
+	Features   []string                            `json:"features"`
+	Timestamp  int64                               `json:"timestamp,omitempty"`
+}
+
+type AdapterCapabilities struct {
+	Codecs   []string `json:"codecs"`
+	Features []string `json:"features"`
+}
+
+func NewRecorderCapabilities(requestId, appVersion, instanceId string) *RecorderCapabilities {
+	return &RecorderCapabilities{
+		Id:         RecorderCapabilitiesKey,
+		RequestId:  requestId,
+		Version:    CapabilitiesVersion,
+		AppVersion: appVersion,
+		InstanceId: instanceId,
+		Adapters:   make(map[AdapterType]AdapterCapabilities),
+		Containers: []string{},
+		Features:   []string{},
+		Timestamp:  time.Now().UTC().UnixMilli(),
+	}
+}
+
+// SupportsCodec returns whether recordings of adapter can take mimeType in
+func (c *RecorderCapabilities) SupportsCodec(adapter AdapterType, mimeType string) bool {
+	a, ok := c.Adapters[adapter]
+
+	return ok && slices.Contains(a.Codecs, strings.ToLower(mimeType))
+}
+
 /*
 getRecordings (* -> Recorder)
 ```JSON5
@@ -426,3 +1002,125 @@ func (e *Event) GetRecordings() *GetRecordings {
 	}
 	return nil
 }
+
+/*
+validateRecording (* -> Recorder)
+```JSON5
+
+	{
+		"id": "validateRecording",
+		"requestId": "<String>", // requester-defined - for request/response correlation
+		"adapter": "livekit", // only the livekit adapter can be validated
+		"adapterOptions": { ... }, // same as startRecording
+	}
+
+```
+*/
+type ValidateRecording struct {
+	Id             string          `json:"id,omitempty"`
+	RequestId      string          `json:"requestId,omitempty"`
+	Adapter        AdapterType     `json:"adapter,omitempty"`
+	AdapterOptions *AdapterOptions `json:"adapterOptions,omitempty"`
+}
+
+func (e *Event) ValidateRecording() *ValidateRecording {
+	if ev, ok := e.Data.(*ValidateRecording); ok {
+		return ev
+	}
+	return nil
+}
+
+func (e *ValidateRecording) Validate() error {
+	if e.Adapter != AdapterLiveKit {
+		return fmt.Errorf("validation is not supported for adapter: %s", e.Adapter)
+	}
+
+	start := StartRecording{Adapter: e.Adapter, AdapterOptions: e.AdapterOptions}
+
+	return start.Validate()
+}
+
+func (e *ValidateRecording) Fail(err error) *ValidateRecordingResponse {
+	return &ValidateRecordingResponse{
+		Id:        ValidateRecordingResponseKey,
+		RequestId: e.RequestId,
+		Status:    "failed",
+		Error:     pointer.ToString(err.Error()),
+	}
+}
+
+func (e *ValidateRecording) Result(report *ValidationReport) *ValidateRecordingResponse {
+	r := &ValidateRecordingResponse{
+		Id:        ValidateRecordingResponseKey,
+		RequestId: e.RequestId,
+		Status:    "ok",
+		Report:    report,
+	}
+
+	if !report.Valid {
+		r.Status = "failed"
+		r.Error = pointer.ToString("recording would fail, see report")
+	}
+
+	return r
+}
+
+/*
+validateRecordingResponse (Recorder -> *)
+```JSON5
+
+	{
+		"id": "validateRecordingResponse",
+		"requestId": "<String>", // Mirrors the requestId from the validateRecording request
+		"status": "ok" | "failed",
+		"error": undefined | "<String>",
+		"report": {
+			"room": "<String>",
+			"connected": <Boolean>,
+			"valid": <Boolean>, // whether a recording with these options would start
+			"tracks": [
+				{
+					"trackId": "<String>",
+					"found": <Boolean>,
+					"participant": "<String>",
+					"kind": "audio" | "video",
+					"source": "<String>",
+					"mimeType": "<String>", // negotiated if subscribed, else as published
+					"encrypted": <Boolean>,
+					"codecSupported": <Boolean>,
+					"subscribed": <Boolean>,
+					"error": "<String | undefined>", // why the track can't be recorded
+				}
+			]
+		}
+	}
+
+```
+*/
+type ValidateRecordingResponse struct {
+	Id        string            `json:"id,omitempty"`
+	RequestId string            `json:"requestId,omitempty"`
+	Status    string            `json:"status,omitempty"`
+	Error     *string           `json:"error,omitempty"`
+	Report    *ValidationReport `json:"report,omitempty"`
+}
+
+type ValidationReport struct {
+	Room      string             `json:"room"`
+	Connected bool               `json:"connected"`
+	Valid     bool               `json:"valid"`
+	Tracks    []*TrackValidation `json:"tracks"`
+}
+
+type TrackValidation struct {
+	TrackId        string `json:"trackId"`
+	Found          bool   `json:"found"`
+	Participant    string `json:"participant,omitempty"`
+	Kind           string `json:"kind,omitempty"`
+	Source         string `json:"source,omitempty"`
+	MimeType       string `json:"mimeType,omitempty"`
+	Encrypted      bool   `json:"encrypted,omitempty"`
+	CodecSupported bool   `json:"codecSupported"`
+	Subscribed     bool   `json:"subscribed"`
+	Error          string `json:"error,omitempty"`
+}
@@ -1,6 +1,8 @@
 package events
 
 import (
+	"errors"
+	"slices"
 	"testing"
 )
 
@@ -111,6 +113,38 @@ func TestStartRecording_Validate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "livekit with allTracks",
+			event: StartRecording{
+				Id:        StartRecordingKey,
+				SessionId: "test-session",
+				FileName:  "test.webm",
+				Adapter:   AdapterLiveKit,
+				AdapterOptions: &AdapterOptions{
+					LiveKit: &LiveKitConfig{
+						Room:      "test-room",
+						AllTracks: &TrackFilter{Sources: []string{"camera", "microphone"}},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "livekit with an unknown allTracks source",
+			event: StartRecording{
+				Id:        StartRecordingKey,
+				SessionId: "test-session",
+				FileName:  "test.webm",
+				Adapter:   AdapterLiveKit,
+				AdapterOptions: &AdapterOptions{
+					LiveKit: &LiveKitConfig{
+						Room:      "test-room",
+						AllTracks: &TrackFilter{Sources: []string{"webcam"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
 		{
 			name: "livekit without adapterOptions",
 			event: StartRecording{
@@ -121,6 +155,97 @@ func TestStartRecording_Validate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "valid rtp",
+			event: StartRecording{
+				Id:        StartRecordingKey,
+				SessionId: "test-session",
+				FileName:  "test.webm",
+				Adapter:   AdapterRTP,
+				AdapterOptions: &AdapterOptions{
+					RTP: &RTPConfig{
+						ListenAddress: "127.0.0.1:5004",
+						Tracks: []RTPTrackConfig{
+							{ID: "video", SSRC: 1234, MimeType: "video/vp8"},
+							{ID: "audio", PayloadType: 111, MimeType: "audio/opus"},
+						},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "rtp track without SSRC nor payload type",
+			event: StartRecording{
+				Id:        StartRecordingKey,
+				SessionId: "test-session",
+				FileName:  "test.webm",
+				Adapter:   AdapterRTP,
+				AdapterOptions: &AdapterOptions{
+					RTP: &RTPConfig{
+						ListenAddress: "127.0.0.1:5004",
+						Tracks:        []RTPTrackConfig{{ID: "video", MimeType: "video/vp8"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "rtp with duplicate track IDs",
+			event: StartRecording{
+				Id:        StartRecordingKey,
+				SessionId: "test-session",
+				FileName:  "test.webm",
+				Adapter:   AdapterRTP,
+				AdapterOptions: &AdapterOptions{
+					RTP: &RTPConfig{
+						ListenAddress: "127.0.0.1:5004",
+						Tracks: []RTPTrackConfig{
+							{ID: "video", SSRC: 1, MimeType: "video/vp8"},
+							{ID: "video", SSRC: 2, MimeType: "video/vp8"},
+						},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "rtp without listen address",
+			event: StartRecording{
+				Id:        StartRecordingKey,
+				SessionId: "test-session",
+				FileName:  "test.webm",
+				Adapter:   AdapterRTP,
+				AdapterOptions: &AdapterOptions{
+					RTP: &RTPConfig{
+						Tracks: []RTPTrackConfig{{ID: "video", SSRC: 1, MimeType: "video/vp8"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid webhook override",
+			event: StartRecording{
+				Id:        StartRecordingKey,
+				SessionId: "test-session",
+				FileName:  "test.webm",
+				SDP:       "v=0\r\n...",
+				Webhook:   &WebhookOptions{URL: "https://example.org/hooks", Secret: "secret"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid webhook url",
+			event: StartRecording{
+				Id:        StartRecordingKey,
+				SessionId: "test-session",
+				FileName:  "test.webm",
+				SDP:       "v=0\r\n...",
+				Webhook:   &WebhookOptions{URL: "ftp://example.org/hooks"},
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -191,6 +316,27 @@ func TestStartRecording_GetSDP(t *testing.T) {
 	}
 }
 
+func TestStartRecording_TrackIDs(t *testing.T) {
+	tests := []struct {
+		name  string
+		event StartRecording
+		want  []string
+	}{
+		{"mediasoup", StartRecording{AdapterOptions: &AdapterOptions{Mediasoup: &MediasoupConfig{SDP: "v=0"}}}, nil},
+		{"no options", StartRecording{}, nil},
+		{"livekit", StartRecording{AdapterOptions: &AdapterOptions{LiveKit: &LiveKitConfig{TrackIDs: []string{"TR_1", "TR_2"}}}}, []string{"TR_1", "TR_2"}},
+		{"rtp", StartRecording{AdapterOptions: &AdapterOptions{RTP: &RTPConfig{Tracks: []RTPTrackConfig{{ID: "video"}, {ID: "audio"}}}}}, []string{"video", "audio"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.event.TrackIDs(); !slices.Equal(got, tt.want) {
+				t.Errorf("StartRecording.TrackIDs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestStartRecordingResponse_Validate(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -218,6 +364,22 @@ func TestStartRecordingResponse_Validate(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name:    "failure with reason",
+			event:   *(&StartRecording{SessionId: "test-session"}).FailWithReason(errors.New("timed out"), "connect_timeout"),
+			wantErr: false,
+		},
+		{
+			name: "success with reason",
+			event: StartRecordingResponse{
+				Id:        "startRecordingResponse",
+				SessionId: "test-session",
+				Status:    "ok",
+				FileName:  &[]string{"test.webm"}[0],
+				Reason:    &[]string{"connect_timeout"}[0],
+			},
+			wantErr: true,
+		},
 		{
 			name: "missing required fields",
 			event: StartRecordingResponse{
@@ -265,3 +427,91 @@ func TestStartRecordingResponse_Validate(t *testing.T) {
 		})
 	}
 }
+
+func TestAdapterOptions_Redacted(t *testing.T) {
+	options := &AdapterOptions{
+		LiveKit: &LiveKitConfig{
+			Room:     "room",
+			TrackIDs: []string{"TR_1"},
+			E2EEKey:  "secret",
+		},
+	}
+
+	redacted := options.Redacted()
+
+	if redacted.LiveKit.E2EEKey != "" {
+		t.Errorf("Redacted() kept the encryption key")
+	}
+
+	if redacted.LiveKit.Room != "room" {
+		t.Errorf("Redacted() room = %q, want %q", redacted.LiveKit.Room, "room")
+	}
+
+	if options.LiveKit.E2EEKey != "secret" {
+		t.Errorf("Redacted() modified the original options")
+	}
+
+	if (*AdapterOptions)(nil).Redacted() != nil {
+		t.Errorf("Redacted() of nil options should be nil")
+	}
+}
+
+func TestValidateRecording(t *testing.T) {
+	e := &ValidateRecording{
+		Id:        ValidateRecordingKey,
+		RequestId: "req",
+		Adapter:   AdapterMediasoup,
+	}
+
+	if err := e.Validate(); err == nil {
+		t.Errorf("Validate() should reject adapters other than livekit")
+	}
+
+	e.Adapter = AdapterLiveKit
+	e.AdapterOptions = &AdapterOptions{LiveKit: &LiveKitConfig{Room: "room"}}
+
+	if err := e.Validate(); err == nil {
+		t.Errorf("Validate() should require track IDs")
+	}
+
+	e.AdapterOptions.LiveKit.TrackIDs = []string{"TR_1"}
+
+	if err := e.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+
+	response := e.Result(&ValidationReport{Valid: true})
+
+	if response.Status != "ok" || response.Error != nil || response.RequestId != "req" {
+		t.Errorf("Result() of a valid report = %+v", response)
+	}
+
+	response = e.Result(&ValidationReport{Valid: false})
+
+	if response.Status != "failed" || response.Error == nil {
+		t.Errorf("Result() of an invalid report = %+v", response)
+	}
+}
+
+func TestRecordingOverrides_Validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides *RecordingOverrides
+		wantErr   bool
+	}{
+		{name: "none", overrides: nil},
+		{name: "valid", overrides: &RecordingOverrides{Format: FormatMP4, MaxDurationMs: 60000, UploadPrefix: "a/b/"}},
+		{name: "unknown format", overrides: &RecordingOverrides{Format: "avi"}, wantErr: true},
+		{name: "negative max duration", overrides: &RecordingOverrides{MaxDurationMs: -1}, wantErr: true},
+		{name: "absolute upload prefix", overrides: &RecordingOverrides{UploadPrefix: "/a/"}, wantErr: true},
+		{name: "upload prefix out of the configured one", overrides: &RecordingOverrides{UploadPrefix: "a/../../b/"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.overrides.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
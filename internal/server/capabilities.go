@@ -0,0 +1,49 @@
+package server
+
+import (
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
+)
+
+// Adapter features an orchestrator may route on
+const (
+	FeatureE2EE                    = "e2ee"
+	FeatureSimulcastLayerSelection = "simulcast_layer_selection"
+	FeatureFollowSpeaker           = "follow_speaker"
+	FeatureDataCapture             = "data_capture"
+	FeatureAdaptiveQuality         = "adaptive_quality"
+)
+
+// capabilities reports what the node records, so recordings can be routed
+// to nodes able to make them: the input codecs and features of each
+// adapter, and the containers and features of the recorder
+func capabilities(cfg *config.Config, requestId string) *events.RecorderCapabilities {
+	c := events.NewRecorderCapabilities(requestId, cfg.App.Version, cfg.App.InstanceId)
+
+	// The codecs the mediasoup peer connection negotiates
+	c.Adapters[events.AdapterMediasoup] = events.AdapterCapabilities{
+		Codecs:   []string{recorder.CodecVP8, recorder.CodecOpus},
+		Features: []string{},
+	}
+	c.Adapters[events.AdapterLiveKit] = events.AdapterCapabilities{
+		Codecs: []string{recorder.CodecVP8, recorder.CodecH264, recorder.CodecVP9, recorder.CodecAV1, recorder.CodecOpus},
+		Features: []string{
+			FeatureAdaptiveQuality,
+			FeatureDataCapture,
+			FeatureE2EE,
+			FeatureFollowSpeaker,
+			FeatureSimulcastLayerSelection,
+		},
+	}
+	c.Adapters[events.AdapterRTP] = events.AdapterCapabilities{
+		Codecs:   recorder.SupportedCodecs(),
+		Features: []string{},
+	}
+
+	rc := recorder.GetCapabilities(cfg.Recorder)
+	c.Containers = rc.Containers
+	c.Features = rc.Features
+
+	return c
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	log "github.com/sirupsen/logrus"
+)
+
+// What's done with recordings started at capacity, as in config.Capacity
+const (
+	CapacityOverflowReject = "reject"
+	CapacityOverflowQueue  = "queue"
+)
+
+// ValidateCapacity checks the capacity configuration
+func ValidateCapacity(cfg config.Capacity) error {
+	if cfg.MaxSessions < 0 {
+		return fmt.Errorf("invalid max sessions %d", cfg.MaxSessions)
+	}
+
+	switch cfg.Overflow {
+	case "", CapacityOverflowReject:
+	case CapacityOverflowQueue:
+		if cfg.QueueTimeout <= 0 {
+			return fmt.Errorf("invalid queue timeout %s", cfg.QueueTimeout)
+		}
+	default:
+		return fmt.Errorf("invalid capacity overflow %q (must be %s or %s)", cfg.Overflow, CapacityOverflowReject, CapacityOverflowQueue)
+	}
+
+	return nil
+}
+
+// rejectAtCapacity fails a recording started with no session slot left
+func (s *Server) rejectAtCapacity(ctx context.Context, e *events.StartRecording, err error) {
+	log.WithField("session", ctx.Value("session")).Warn(err)
+	appstats.OnSessionRejected()
+	s.PublishPubSub(e.FailWithReason(err, events.FailReasonAtCapacity))
+}
+
+// queuedStartEndedError is what a queued recording start fails with once
+// stopped or canceled before it got a slot
+type queuedStartEndedError struct {
+	reason string
+}
+
+func (e *queuedStartEndedError) Error() string {
+	return fmt.Sprintf("recording %s while queued", e.reason)
+}
+
+// startQueuedRecording starts a recording once a session slot frees up,
+// rejecting it if none does within the queue timeout. Stopped or canceled
+// while queued, it fails with the reason it ended for; while starting, its
+// session is stopped or canceled once added.
+func (s *Server) startQueuedRecording(ctx context.Context, e *events.StartRecording, start time.Time) {
+	// Once started, the session observes it
+	started := false
+
+	defer func() {
+		if !started {
+			appstats.ObserveRequestDuration(e.Id, time.Since(start))
+		}
+	}()
+
+	queueCtx, end := context.WithCancelCause(ctx)
+	defer end(nil)
+
+	if err := s.sessions.queueStart(e.SessionId, end); err != nil {
+		log.WithField("session", ctx.Value("session")).Error(err)
+		s.PublishPubSub(e.Fail(err))
+
+		return
+	}
+
+	log.WithField("session", ctx.Value("session")).
+		WithField("timeout", s.cfg.Capacity.QueueTimeout).
+		Info("Recorder at capacity, queueing recording")
+
+	waitCtx, cancel := context.WithTimeout(queueCtx, s.cfg.Capacity.QueueTimeout)
+	err := s.sessions.reserve(waitCtx, true)
+	cancel()
+
+	var ended *queuedStartEndedError
+
+	if errors.As(context.Cause(queueCtx), &ended) {
+		if err == nil {
+			s.sessions.release()
+		}
+
+		s.sessions.dequeueStart(e.SessionId)
+		log.WithField("session", ctx.Value("session")).Info(ended)
+		s.PublishPubSub(e.FailWithReason(ended, ended.reason))
+
+		return
+	}
+
+	if err != nil {
+		s.sessions.dequeueStart(e.SessionId)
+		s.rejectAtCapacity(ctx, e, err)
+
+		return
+	}
+
+	started = s.startRecording(ctx, e, start)
+
+	if endSession := s.sessions.dequeueStart(e.SessionId); endSession != nil && started {
+		if sess, ok := s.sessions.Get(e.SessionId); ok {
+			endSession(sess)
+		}
+	}
+}
+
+// endQueuedRecording stops or cancels (with reason) the queued start of
+// session id, end being applied to its session if it got one meanwhile.
+// Returns false if no start of id is queued.
+func (s *Server) endQueuedRecording(id string, reason string, end func(sess *Session)) bool {
+	if !s.sessions.endQueuedStart(id, &queuedStartEndedError{reason: reason}, end) {
+		return false
+	}
+
+	log.WithField("session", id).
+		WithField("reason", reason).
+		Info("Queued recording ended before it started")
+
+	return true
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateCapacity(t *testing.T) {
+	assert.NoError(t, ValidateCapacity(config.Capacity{}))
+	assert.NoError(t, ValidateCapacity(config.Capacity{MaxSessions: 2, Overflow: CapacityOverflowQueue, QueueTimeout: time.Second}))
+	assert.Error(t, ValidateCapacity(config.Capacity{MaxSessions: -1}))
+	assert.Error(t, ValidateCapacity(config.Capacity{Overflow: "drop"}))
+	assert.Error(t, ValidateCapacity(config.Capacity{Overflow: CapacityOverflowQueue}))
+}
+
+func startRTPRecording(server *Server, sessionID string) {
+	server.HandlePubSubEvent(context.Background(), &events.Event{
+		Id: events.StartRecordingKey,
+		Data: &events.StartRecording{
+			Id:        events.StartRecordingKey,
+			SessionId: sessionID,
+			FileName:  sessionID + ".webm",
+			Adapter:   events.AdapterRTP,
+			AdapterOptions: &events.AdapterOptions{
+				RTP: &events.RTPConfig{
+					ListenAddress: "127.0.0.1:0",
+					Tracks:        []events.RTPTrackConfig{{ID: "audio", PayloadType: 111, MimeType: "audio/opus"}},
+				},
+			},
+		},
+	})
+}
+
+func startResponse(t *testing.T, ps *mockPubSub) events.StartRecordingResponse {
+	t.Helper()
+
+	select {
+	case responseBytes := <-ps.publishChan:
+		var response events.StartRecordingResponse
+		require.NoError(t, json.Unmarshal(responseBytes, &response))
+		require.Equal(t, events.StartRecordingResponseKey, response.Id)
+
+		return response
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive a response from the server")
+	}
+
+	return events.StartRecordingResponse{}
+}
+
+func newCapacityTestServer(t *testing.T, capacity config.Capacity) (*Server, *mockPubSub) {
+	cfg := &config.Config{
+		Recorder: config.Recorder{
+			Directory:   t.TempDir(),
+			DirFileMode: "0700",
+			FileMode:    "0600",
+		},
+		Capacity: capacity,
+	}
+	ps := &mockPubSub{publishChan: make(chan []byte, 10)}
+
+	return NewServer(cfg, ps), ps
+}
+
+func TestStartRecording_AtCapacityRejected(t *testing.T) {
+	server, ps := newCapacityTestServer(t, config.Capacity{MaxSessions: 1, Overflow: CapacityOverflowReject})
+
+	startRTPRecording(server, "first")
+	assert.Equal(t, "ok", startResponse(t, ps).Status)
+
+	startRTPRecording(server, "second")
+	response := startResponse(t, ps)
+	assert.Equal(t, "failed", response.Status)
+	require.NotNil(t, response.Reason)
+	assert.Equal(t, events.FailReasonAtCapacity, *response.Reason)
+	assert.Contains(t, *response.Error, ErrAtCapacity.Error())
+	assert.Equal(t, 1, server.sessions.Len())
+
+	assert.NoError(t, server.Close())
+}
+
+func TestStartRecording_AtCapacityQueued(t *testing.T) {
+	server, ps := newCapacityTestServer(t, config.Capacity{
+		MaxSessions:  1,
+		Overflow:     CapacityOverflowQueue,
+		QueueTimeout: 5 * time.Second,
+	})
+
+	startRTPRecording(server, "first")
+	assert.Equal(t, "ok", startResponse(t, ps).Status)
+
+	// Doesn't hold up the events freeing a slot
+	startRTPRecording(server, "second")
+	require.Eventually(t, func() bool { return server.sessions.Queued() == 1 }, time.Second, time.Millisecond)
+
+	first, ok := server.sessions.Get("first")
+	require.True(t, ok)
+	require.NoError(t, first.StopRecording(nil, events.StopReasonNormal, time.Time{}))
+
+	deadline := time.After(5 * time.Second)
+
+	for {
+		select {
+		case responseBytes := <-ps.publishChan:
+			var response events.StartRecordingResponse
+			require.NoError(t, json.Unmarshal(responseBytes, &response))
+
+			if response.Id != events.StartRecordingResponseKey {
+				continue
+			}
+
+			assert.Equal(t, "second", response.SessionId)
+			assert.Equal(t, "ok", response.Status)
+			assert.Zero(t, server.sessions.Queued())
+			assert.NoError(t, server.Close())
+
+			return
+		case <-deadline:
+			t.Fatal("Queued recording didn't start")
+		}
+	}
+}
+
+func TestStartRecording_QueuedEnded(t *testing.T) {
+	tests := []struct {
+		name   string
+		event  *events.Event
+		reason string
+	}{
+		{
+			name:   "stopped",
+			event:  &events.Event{Id: events.StopRecordingKey, Data: &events.StopRecording{Id: events.StopRecordingKey, SessionId: "second"}},
+			reason: events.StopReasonNormal,
+		},
+		{
+			name:   "canceled",
+			event:  &events.Event{Id: events.CancelRecordingKey, Data: &events.CancelRecording{Id: events.CancelRecordingKey, SessionId: "second"}},
+			reason: events.StopReasonCanceled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, ps := newCapacityTestServer(t, config.Capacity{
+				MaxSessions:  1,
+				Overflow:     CapacityOverflowQueue,
+				QueueTimeout: 5 * time.Second,
+			})
+
+			startRTPRecording(server, "first")
+			assert.Equal(t, "ok", startResponse(t, ps).Status)
+
+			startRTPRecording(server, "second")
+			require.Eventually(t, func() bool { return server.sessions.Queued() == 1 }, time.Second, time.Millisecond)
+
+			startRTPRecording(server, "second")
+			assert.Equal(t, "failed", startResponse(t, ps).Status, "Already queued")
+
+			server.HandlePubSubEvent(context.Background(), tt.event)
+
+			response := startResponse(t, ps)
+			assert.Equal(t, "second", response.SessionId)
+			assert.Equal(t, "failed", response.Status)
+			require.NotNil(t, response.Reason)
+			assert.Equal(t, tt.reason, *response.Reason)
+
+			assert.Zero(t, server.sessions.Queued())
+			assert.False(t, server.sessions.IsQueued("second"))
+			assert.Equal(t, 1, server.sessions.Len())
+
+			// A slot freeing up doesn't start it any longer
+			first, ok := server.sessions.Get("first")
+			require.True(t, ok)
+			require.NoError(t, first.StopRecording(nil, events.StopReasonNormal, time.Time{}))
+			require.Eventually(t, func() bool { return server.sessions.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+			_, ok = server.sessions.Get("second")
+			assert.False(t, ok)
+
+			assert.NoError(t, server.Close())
+		})
+	}
+}
+
+func TestHealthServer_ReadyzAtCapacity(t *testing.T) {
+	s := newTestHealthServer(t, "ws://127.0.0.1:1")
+	s.cfg.Health.CheckLiveKit = false
+	sessions := NewSessionRegistry()
+	sessions.SetLimit(1)
+	s.SetSessions(sessions)
+
+	code, res := getHealth(t, s, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", res.Checks["capacity"])
+
+	require.NoError(t, sessions.add(&Session{id: "a"}))
+	code, res = getHealth(t, s, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, res.Checks["capacity"], ErrAtCapacity.Error())
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// diskGuard periodically checks the free space of the filesystem a recording
+// is written to, calling onLow once it drops below the configured minimum
+type diskGuard struct {
+	cfg   config.DiskGuard
+	dir   string
+	onLow func(free uint64)
+	// Overridden in tests
+	freeSpace func(dir string) (uint64, error)
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func newDiskGuard(cfg config.DiskGuard, dir string, onLow func(free uint64)) *diskGuard {
+	return &diskGuard{
+		cfg:       cfg,
+		dir:       dir,
+		onLow:     onLow,
+		freeSpace: freeDiskSpace,
+		stop:      make(chan struct{}),
+	}
+}
+
+// start checks right away, so recordings started on an already full volume
+// are stopped before they write much, then every Interval
+func (g *diskGuard) start(sessionId string) {
+	interval := g.cfg.Interval
+
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	g.wg.Add(1)
+
+	go func() {
+		defer g.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		logger := log.WithField("session", sessionId).WithField("dir", g.dir)
+		failing := false
+
+		for {
+			free, err := g.freeSpace(g.dir)
+
+			switch {
+			case err != nil:
+				// Logged once per streak, it'd be every tick otherwise
+				if !failing {
+					logger.WithError(err).Warn("Failed to check free disk space")
+				}
+
+				failing = true
+			case free < g.cfg.MinFree:
+				logger.Errorf("Free disk space %d bytes is below the minimum of %d, stopping recording", free, g.cfg.MinFree)
+				g.onLow(free)
+
+				return
+			default:
+				failing = false
+			}
+
+			select {
+			case <-g.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// close stops the checks and waits for a running one to finish. Safe to call
+// on a nil guard and more than once.
+func (g *diskGuard) close() {
+	if g == nil {
+		return
+	}
+
+	g.stopOnce.Do(func() { close(g.stop) })
+	g.wg.Wait()
+}
+
+// freeDiskSpace returns the bytes available to unprivileged users on the
+// filesystem holding dir
+func freeDiskSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
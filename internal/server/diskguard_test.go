@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskGuard(t *testing.T) {
+	var free atomic.Uint64
+	free.Store(2000)
+	var checks atomic.Int32
+	low := make(chan uint64, 2)
+
+	guard := newDiskGuard(config.DiskGuard{MinFree: 1000, Interval: 5 * time.Millisecond}, "/recordings", func(free uint64) {
+		low <- free
+	})
+	guard.freeSpace = func(dir string) (uint64, error) {
+		assert.Equal(t, "/recordings", dir)
+		checks.Add(1)
+
+		if checks.Load() == 2 {
+			return 0, errors.New("statfs failed")
+		}
+
+		return free.Load(), nil
+	}
+	guard.start("test-session")
+
+	assert.Eventually(t, func() bool { return checks.Load() > 3 }, time.Second, time.Millisecond)
+	assert.Empty(t, low, "Errors or enough space don't stop the recording")
+
+	free.Store(999)
+
+	select {
+	case got := <-low:
+		assert.Equal(t, uint64(999), got)
+	case <-time.After(time.Second):
+		t.Fatal("Low disk space not reported")
+	}
+
+	guard.close()
+	// Reported once, then the checks stop
+	n := checks.Load()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, n, checks.Load())
+	assert.Empty(t, low)
+
+	guard.close()
+}
+
+func TestDiskGuard_Close(t *testing.T) {
+	guard := newDiskGuard(config.DiskGuard{MinFree: 1, Interval: time.Hour}, t.TempDir(), func(free uint64) {
+		t.Error("Unexpected low disk space")
+	})
+	guard.start("test-session")
+	guard.close()
+
+	var nilGuard *diskGuard
+	nilGuard.close()
+}
+
+func TestFreeDiskSpace(t *testing.T) {
+	free, err := freeDiskSpace(t.TempDir())
+	require.NoError(t, err)
+	assert.Positive(t, free)
+
+	_, err = freeDiskSpace("/does/not/exist")
+	assert.Error(t, err)
+}
+
+func TestSessionOutOfDisk(t *testing.T) {
+	cfg := &config.Config{
+		Recorder: config.Recorder{
+			Directory:   t.TempDir(),
+			DirFileMode: "0700",
+			FileMode:    "0600",
+			// No volume has that much free
+			DiskGuard: config.DiskGuard{Enable: true, MinFree: math.MaxUint64, Interval: time.Second},
+		},
+	}
+	ps := &mockPubSub{publishChan: make(chan []byte, 10)}
+	server := NewServer(cfg, ps)
+	sessionID := "test-out-of-disk"
+
+	server.HandlePubSubEvent(context.Background(), &events.Event{
+		Id: events.StartRecordingKey,
+		Data: &events.StartRecording{
+			Id:        events.StartRecordingKey,
+			SessionId: sessionID,
+			FileName:  "test.webm",
+			Adapter:   events.AdapterRTP,
+			AdapterOptions: &events.AdapterOptions{
+				RTP: &events.RTPConfig{
+					ListenAddress: "127.0.0.1:0",
+					Tracks:        []events.RTPTrackConfig{{ID: "audio", PayloadType: 111, MimeType: "audio/opus"}},
+				},
+			},
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case responseBytes := <-ps.publishChan:
+			var event events.Event
+			require.NoError(t, json.Unmarshal(responseBytes, &event))
+
+			if event.Id != events.RecordingStoppedKey {
+				continue
+			}
+
+			var stopped events.RecordingStopped
+			require.NoError(t, json.Unmarshal(responseBytes, &stopped))
+			assert.Equal(t, events.StopReasonOutOfDisk, stopped.Reason)
+			assert.NoError(t, server.Close())
+
+			return
+		case <-time.After(2 * time.Second):
+			t.Fatal("Recording not stopped")
+		}
+	}
+
+	t.Fatal("No recordingStopped event")
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/recorderpb"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/tlsconfig"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	defaultWatchStatsInterval = time.Second
+	minWatchStatsInterval     = 100 * time.Millisecond
+)
+
+// GRPCServer exposes the recorder's control API over gRPC. Requests are
+// handled as their pubsub counterparts and answered with the responses
+// those would publish.
+type GRPCServer struct {
+	recorderpb.UnimplementedRecorderServer
+
+	cfg    *config.Config
+	server *Server
+	grpc   *grpc.Server
+}
+
+func NewGRPCServer(cfg *config.Config, sv *Server) (*GRPCServer, error) {
+	tlsConfig, err := tlsconfig.Server(cfg.GRPC.TLS)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []grpc.ServerOption
+
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	s := &GRPCServer{cfg: cfg, server: sv, grpc: grpc.NewServer(opts...)}
+	recorderpb.RegisterRecorderServer(s.grpc, s)
+
+	return s, nil
+}
+
+func (s *GRPCServer) Serve() error {
+	if !s.cfg.GRPC.Enable {
+		return nil
+	}
+
+	lis, err := net.Listen("tcp", s.cfg.GRPC.ListenAddress)
+
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := s.grpc.Serve(lis); err != nil {
+			log.Errorf("gRPC server stopped: %s", err)
+		}
+	}()
+
+	log.Infof("gRPC API exported on %s", lis.Addr())
+
+	return nil
+}
+
+// Stop closes all connections, ending ongoing WatchStats streams
+func (s *GRPCServer) Stop() {
+	s.grpc.Stop()
+}
+
+func (s *GRPCServer) StartRecording(ctx context.Context, req *recorderpb.StartRecordingRequest) (*recorderpb.StartRecordingResponse, error) {
+	sessionID := req.GetSessionId()
+
+	if sessionID == "" {
+		sessionID = uuid.New().String()
+	}
+
+	fileName := req.GetOutput().GetFileName()
+
+	// The recorder settles the extension from the tracks being recorded
+	if fileName == "" {
+		fileName = sessionID + ".webm"
+	}
+
+	e := &events.StartRecording{
+		Id:        events.StartRecordingKey,
+		SessionId: sessionID,
+		FileName:  fileName,
+		Adapter:   events.AdapterLiveKit,
+		AdapterOptions: &events.AdapterOptions{
+			LiveKit: &events.LiveKitConfig{
+				Room:     req.GetRoom(),
+				TrackIDs: req.GetTrackIds(),
+				E2EEKey:  req.GetE2EeKey(),
+			},
+		},
+	}
+
+	if layer := req.GetVideoLayer(); layer != nil {
+		e.AdapterOptions.LiveKit.VideoLayer = &events.VideoLayerConfig{
+			Quality: layer.GetQuality(),
+			Width:   layer.GetWidth(),
+			Height:  layer.GetHeight(),
+		}
+	}
+
+	if output := req.GetOutput(); output.GetFormat() != "" || output.GetMaxDurationMs() != 0 ||
+		output.GetMaxBytes() != 0 || output.GetUploadPrefix() != "" || len(req.GetVideoCodecs()) > 0 {
+		e.Overrides = &events.RecordingOverrides{
+			Format:        output.GetFormat(),
+			MaxDurationMs: output.GetMaxDurationMs(),
+			MaxBytes:      output.GetMaxBytes(),
+			UploadPrefix:  output.GetUploadPrefix(),
+			VideoCodecs:   req.GetVideoCodecs(),
+		}
+	}
+
+	if err := e.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// Overrides out of bounds are invalid arguments, not failed starts
+	if _, err := s.server.sessionConfig(e); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if _, ok := s.server.sessions.Get(sessionID); ok {
+		return nil, status.Errorf(codes.AlreadyExists, "session %s already exists", sessionID)
+	}
+
+	if s.server.isShuttingDown() {
+		return nil, status.Error(codes.Unavailable, errShuttingDown.Error())
+	}
+
+	responses, stop := s.server.watchResponses(func(msg interface{}) bool {
+		r, ok := msg.(*events.StartRecordingResponse)
+		return ok && r.SessionId == sessionID
+	})
+	defer stop()
+
+	// Sessions outlive the request
+	s.server.HandlePubSubEvent(context.Background(), &events.Event{Id: e.Id, Data: e})
+
+	select {
+	case msg := <-responses:
+		r := msg.(*events.StartRecordingResponse)
+
+		if r.Status != "ok" {
+			reason := "failed to start recording"
+
+			if r.Error != nil {
+				reason = *r.Error
+			}
+
+			if r.Reason != nil && *r.Reason == events.FailReasonAtCapacity {
+				return nil, status.Error(codes.ResourceExhausted, reason)
+			}
+
+			return nil, status.Error(codes.Internal, reason)
+		}
+
+		res := &recorderpb.StartRecordingResponse{SessionId: sessionID}
+
+		if r.FileName != nil {
+			res.FileName = *r.FileName
+		}
+
+		return res, nil
+	case <-ctx.Done():
+		// The recording goes on: it can still be stopped by session ID
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+func (s *GRPCServer) StopRecording(ctx context.Context, req *recorderpb.StopRecordingRequest) (*recorderpb.StopRecordingResponse, error) {
+	sess, err := s.session(req.GetSessionId())
+
+	if err != nil {
+		return nil, err
+	}
+
+	responses, stop := s.server.watchResponses(func(msg interface{}) bool {
+		r, ok := msg.(*events.RecordingStopped)
+		return ok && r.SessionId == sess.id
+	})
+	defer stop()
+
+	e := &events.StopRecording{Id: events.StopRecordingKey, SessionId: sess.id}
+
+	if err := sess.StopRecording(e, events.StopReasonNormal, time.Now()); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	var r *events.RecordingStopped
+
+	select {
+	case msg := <-responses:
+		r = msg.(*events.RecordingStopped)
+	case <-sess.Done():
+		// Sessions that never started stop without publishing anything
+		select {
+		case msg := <-responses:
+			r = msg.(*events.RecordingStopped)
+		default:
+			return nil, status.Errorf(codes.FailedPrecondition, "session %s stopped before it started", sess.id)
+		}
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+
+	return &recorderpb.StopRecordingResponse{
+		SessionId: sess.id,
+		Reason:    r.Reason,
+		// Already in ms
+		DurationMs: int64(r.TimestampHR),
+	}, nil
+}
+
+func (s *GRPCServer) GetStatus(ctx context.Context, req *recorderpb.GetStatusRequest) (*recorderpb.GetStatusResponse, error) {
+	sess, err := s.session(req.GetSessionId())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sessionStatus(sess)
+}
+
+func (s *GRPCServer) WatchStats(req *recorderpb.WatchStatsRequest, stream grpc.ServerStreamingServer[recorderpb.GetStatusResponse]) error {
+	sess, err := s.session(req.GetSessionId())
+
+	if err != nil {
+		return err
+	}
+
+	interval := defaultWatchStatsInterval
+
+	if req.GetIntervalMs() > 0 {
+		interval = max(time.Duration(req.GetIntervalMs())*time.Millisecond, minWatchStatsInterval)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		res, err := sessionStatus(sess)
+
+		if err != nil {
+			return err
+		}
+
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-sess.Done():
+			return nil
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func (s *GRPCServer) session(id string) (*Session, error) {
+	if id == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing session id")
+	}
+
+	sess, ok := s.server.sessions.Get(id)
+
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "session %s not found", id)
+	}
+
+	return sess, nil
+}
+
+func sessionStatus(sess *Session) (*recorderpb.GetStatusResponse, error) {
+	stats := sess.GetStats()
+
+	if stats == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "session %s has no stats (not a livekit recording)", sess.id)
+	}
+
+	res := &recorderpb.GetStatusResponse{
+		SessionId: sess.id,
+		FileName:  stats.FileName,
+		Room:      stats.RoomID,
+		Timestamp: time.Now().UnixMilli(),
+	}
+
+	for trackID, track := range stats.Tracks {
+		ts, err := trackStatus(trackID, track)
+
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "track %s stats: %v", trackID, err)
+		}
+
+		res.Tracks = append(res.Tracks, ts)
+	}
+
+	sort.Slice(res.Tracks, func(i, j int) bool {
+		return res.Tracks[i].TrackId < res.Tracks[j].TrackId
+	})
+
+	return res, nil
+}
+
+func trackStatus(trackID string, track *appstats.TrackStats) (*recorderpb.TrackStatus, error) {
+	ts := &recorderpb.TrackStatus{
+		TrackId:  trackID,
+		Kind:     track.TrackKind,
+		MimeType: track.MimeType,
+		Source:   track.Source,
+	}
+
+	var err error
+
+	if track.Adapter != nil {
+		if ts.Adapter, err = toStruct(track.Adapter); err != nil {
+			return nil, err
+		}
+	}
+
+	if track.RecorderTrackStats != nil {
+		if ts.Recorder, err = toStruct(track.RecorderTrackStats); err != nil {
+			return nil, err
+		}
+	}
+
+	return ts, nil
+}
+
+// toStruct converts stats to their JSON form, as in the stats file
+func toStruct(v any) (*structpb.Struct, error) {
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]any
+
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+
+	return structpb.NewStruct(m)
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/recorderpb"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Mock LiveKitWebRTC with live stats
+type statsLiveKitWebRTC struct {
+	mockLiveKitWebRTC
+}
+
+func (lk *statsLiveKitWebRTC) GetStats() *appstats.CaptureStats {
+	return &appstats.CaptureStats{
+		RoomID:   "test-room",
+		FileName: "/tmp/rec.webm",
+		Tracks: map[string]*appstats.TrackStats{
+			"track1": {
+				TrackKind:          "video",
+				MimeType:           "video/vp8",
+				Adapter:            &appstats.AdapterTrackStats{PLIRequests: 2},
+				RecorderTrackStats: &types.RecorderTrackStats{},
+			},
+		},
+	}
+}
+
+func newTestGRPCClient(t *testing.T, server *Server) recorderpb.RecorderClient {
+	lis := bufconn.Listen(1 << 20)
+	gs, err := NewGRPCServer(server.cfg, server)
+	require.NoError(t, err)
+
+	go gs.grpc.Serve(lis)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return recorderpb.NewRecorderClient(conn)
+}
+
+func startTestSession(t *testing.T, server *Server, sessionID string) *statsLiveKitWebRTC {
+	lk := &statsLiveKitWebRTC{mockLiveKitWebRTC{closed: make(chan struct{})}}
+	sess := NewSession(sessionID, server, (*webrtc.WebRTC)(nil), lk, &mockRecorder{})
+	require.NoError(t, server.addSession(sess))
+	require.NoError(t, sess.StartRecording(&events.StartRecording{
+		Id:        events.StartRecordingKey,
+		SessionId: sessionID,
+		Adapter:   events.AdapterLiveKit,
+	}, time.Time{}))
+
+	return lk
+}
+
+func TestGRPCStartRecordingErrors(t *testing.T) {
+	ps := &mockPubSub{publishChan: make(chan []byte, 100)}
+	server := NewServer(&config.Config{}, ps)
+	client := newTestGRPCClient(t, server)
+	ctx := context.Background()
+
+	_, err := client.StartRecording(ctx, &recorderpb.StartRecordingRequest{TrackIds: []string{"track1"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "Room is required")
+
+	require.NoError(t, server.sessions.add(&Session{id: "existing"}))
+	_, err = client.StartRecording(ctx, &recorderpb.StartRecordingRequest{
+		SessionId: "existing",
+		Room:      "test-room",
+		TrackIds:  []string{"track1"},
+	})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	_, err = client.StartRecording(ctx, &recorderpb.StartRecordingRequest{
+		Room:     "test-room",
+		TrackIds: []string{"track1"},
+		Output:   &recorderpb.OutputConfig{Format: "mp4"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "Overrides are disabled")
+}
+
+func TestGRPCStopRecording(t *testing.T) {
+	ps := &mockPubSub{publishChan: make(chan []byte, 100)}
+	server := NewServer(&config.Config{}, ps)
+	client := newTestGRPCClient(t, server)
+	ctx := context.Background()
+
+	_, err := client.StopRecording(ctx, &recorderpb.StopRecordingRequest{SessionId: "unknown"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	lk := startTestSession(t, server, "test-grpc-stop")
+	res, err := client.StopRecording(ctx, &recorderpb.StopRecordingRequest{SessionId: "test-grpc-stop"})
+	require.NoError(t, err)
+	assert.Equal(t, "test-grpc-stop", res.SessionId)
+	assert.Equal(t, events.StopReasonNormal, res.Reason)
+
+	select {
+	case <-lk.closed:
+	default:
+		t.Fatal("Capture wasn't closed")
+	}
+
+	_, ok := server.sessions.Get("test-grpc-stop")
+	assert.False(t, ok)
+}
+
+func TestGRPCGetStatus(t *testing.T) {
+	ps := &mockPubSub{publishChan: make(chan []byte, 100)}
+	server := NewServer(&config.Config{}, ps)
+	client := newTestGRPCClient(t, server)
+	ctx := context.Background()
+
+	startTestSession(t, server, "test-grpc-status")
+	res, err := client.GetStatus(ctx, &recorderpb.GetStatusRequest{SessionId: "test-grpc-status"})
+	require.NoError(t, err)
+
+	assert.Equal(t, "test-room", res.Room)
+	require.Len(t, res.Tracks, 1)
+	track := res.Tracks[0]
+	assert.Equal(t, "track1", track.TrackId)
+	assert.Equal(t, "video/vp8", track.MimeType)
+	assert.Equal(t, float64(2), track.Adapter.GetFields()["pliRequests"].GetNumberValue())
+	assert.NotNil(t, track.Recorder)
+
+	_, err = client.GetStatus(ctx, &recorderpb.GetStatusRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	require.NoError(t, server.Close())
+}
+
+func TestGRPCWatchStats(t *testing.T) {
+	ps := &mockPubSub{publishChan: make(chan []byte, 100)}
+	server := NewServer(&config.Config{}, ps)
+	client := newTestGRPCClient(t, server)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	startTestSession(t, server, "test-grpc-watch")
+	stream, err := client.WatchStats(ctx, &recorderpb.WatchStatsRequest{SessionId: "test-grpc-watch", IntervalMs: 100})
+	require.NoError(t, err)
+
+	for range 2 {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, "test-grpc-watch", res.SessionId)
+	}
+
+	_, err = client.StopRecording(ctx, &recorderpb.StopRecordingRequest{SessionId: "test-grpc-watch"})
+	require.NoError(t, err)
+
+	// Drain what was sent before the session stopped
+	for {
+		if _, err = stream.Recv(); err != nil {
+			break
+		}
+	}
+
+	assert.Equal(t, io.EOF, err, "The stream ends along with the session")
+}
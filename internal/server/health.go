@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/tlsconfig"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/livekit"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
+	log "github.com/sirupsen/logrus"
+)
+
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// HealthServer serves liveness (/healthz) and readiness (/readyz) probes,
+// the node's capabilities (/capabilities), and with Health.Debug the active
+// sessions (/debug/sessions)
+type HealthServer struct {
+	cfg *config.Config
+	// Set once the server is up, after the probes are
+	sessions atomic.Pointer[SessionRegistry]
+}
+
+func NewHealthServer(cfg *config.Config) *HealthServer {
+	return &HealthServer{cfg: cfg}
+}
+
+func (s *HealthServer) Serve() {
+	if !s.cfg.Health.Enable {
+		return
+	}
+
+	tlsConfig, err := tlsconfig.Server(s.cfg.Health.TLS)
+
+	if err != nil {
+		log.Errorf("failed to start health server: %s", err)
+		return
+	}
+
+	addr := ":" + strconv.Itoa(s.cfg.Health.Port)
+
+	go func() {
+		if err := tlsconfig.ListenAndServe(addr, s.handler(), tlsConfig); err != nil {
+			log.Errorf("failed to start health server: %s", err)
+		}
+	}()
+
+	log.Infof("Health endpoints exported on %s", addr)
+}
+
+func (s *HealthServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.HandleFunc("GET /capabilities", s.capabilities)
+
+	if s.cfg.Health.Debug {
+		mux.HandleFunc("GET /debug/sessions", s.listSessions)
+		mux.HandleFunc("GET /debug/sessions/{id}", s.sessionStats)
+		mux.HandleFunc("DELETE /debug/sessions/{id}", s.stopSession)
+	}
+
+	return mux
+}
+
+// SetSessions sets the registry the debug endpoints query
+func (s *HealthServer) SetSessions(sessions *SessionRegistry) {
+	s.sessions.Store(sessions)
+}
+
+func (s *HealthServer) capabilities(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, capabilities(s.cfg, ""))
+}
+
+func (s *HealthServer) healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealthResponse(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// readyz checks the recording directory is writable, unless disabled that
+// LiveKit is reachable and, with a session limit, that it isn't reached
+func (s *HealthServer) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if s.cfg.Health.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.Health.Timeout)
+		defer cancel()
+	}
+
+	res := healthResponse{Status: "ok", Checks: map[string]string{}}
+	check := func(name string, err error) {
+		if err != nil {
+			log.WithField("check", name).Warnf("Readiness check failed: %v", err)
+			res.Status = "unavailable"
+			res.Checks[name] = err.Error()
+		} else {
+			res.Checks[name] = "ok"
+		}
+	}
+
+	check("recordingDirectory", recorder.CheckFsPermissions(s.cfg.Recorder))
+
+	if s.cfg.Health.CheckLiveKit {
+		check("livekit", livekit.CheckReachability(ctx, s.cfg.LiveKit.Host))
+	}
+
+	if sessions := s.sessions.Load(); sessions != nil && sessions.Limit() > 0 {
+		var err error
+
+		if sessions.AtCapacity() {
+			err = fmt.Errorf("%w: %d sessions active", ErrAtCapacity, sessions.Limit())
+		}
+
+		check("capacity", err)
+	}
+
+	status := http.StatusOK
+
+	if res.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeHealthResponse(w, status, res)
+}
+
+func writeHealthResponse(w http.ResponseWriter, status int, res healthResponse) {
+	writeJSON(w, status, res)
+}
+
+func (s *HealthServer) registry(w http.ResponseWriter) *SessionRegistry {
+	sessions := s.sessions.Load()
+
+	if sessions == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "not started"})
+	}
+
+	return sessions
+}
+
+func (s *HealthServer) listSessions(w http.ResponseWriter, r *http.Request) {
+	if sessions := s.registry(w); sessions != nil {
+		writeJSON(w, http.StatusOK, sessions.List())
+	}
+}
+
+func (s *HealthServer) sessionStats(w http.ResponseWriter, r *http.Request) {
+	sessions := s.registry(w)
+
+	if sessions == nil {
+		return
+	}
+
+	stats, err := sessions.Stats(r.PathValue("id"))
+
+	if err != nil {
+		writeJSON(w, sessionErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// stopSession force-stops a session, answering once the stop was requested
+// rather than once the recording is finalized
+func (s *HealthServer) stopSession(w http.ResponseWriter, r *http.Request) {
+	sessions := s.registry(w)
+
+	if sessions == nil {
+		return
+	}
+
+	sess, err := sessions.Stop(r.PathValue("id"), events.StopReasonForced)
+
+	if err != nil {
+		writeJSON(w, sessionErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+
+	log.WithField("session", sess.id).Warn("Session force-stopped through the debug endpoint")
+	writeJSON(w, http.StatusAccepted, map[string]string{"sessionId": sess.id, "reason": events.StopReasonForced})
+}
+
+func sessionErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrSessionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrNoSessionStats):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestHealthServer(t *testing.T, livekitHost string) *HealthServer {
+	cfg := (&config.Config{}).GetDefaults()
+	cfg.Recorder.Directory = t.TempDir()
+	cfg.LiveKit.Host = livekitHost
+	cfg.Health.Timeout = time.Second
+
+	return NewHealthServer(cfg)
+}
+
+func getHealth(t *testing.T, s *HealthServer, path string) (int, healthResponse) {
+	rec := httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+	var res healthResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+
+	return rec.Code, res
+}
+
+func TestHealthServer_Healthz(t *testing.T) {
+	// Liveness doesn't depend on anything else being up
+	s := newTestHealthServer(t, "ws://127.0.0.1:1")
+	s.cfg.Recorder.Directory = filepath.Join(t.TempDir(), "missing")
+
+	code, res := getHealth(t, s, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", res.Status)
+}
+
+func TestHealthServer_Readyz(t *testing.T) {
+	lk := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer lk.Close()
+
+	s := newTestHealthServer(t, strings.Replace(lk.URL, "http://", "ws://", 1))
+
+	code, res := getHealth(t, s, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]string{"recordingDirectory": "ok", "livekit": "ok"}, res.Checks)
+
+	lk.Close()
+	code, res = getHealth(t, s, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "ok", res.Checks["recordingDirectory"])
+	assert.Contains(t, res.Checks["livekit"], "not reachable")
+
+	// LiveKit checks can be disabled, e.g. for mediasoup-only deployments
+	s.cfg.Health.CheckLiveKit = false
+	s.cfg.Recorder.Directory = filepath.Join(t.TempDir(), "missing")
+	code, res = getHealth(t, s, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.NotContains(t, res.Checks, "livekit")
+	assert.NotEqual(t, "ok", res.Checks["recordingDirectory"])
+}
+
+func TestHealthServer_ReadyzLiveKitError(t *testing.T) {
+	lk := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer lk.Close()
+
+	s := newTestHealthServer(t, lk.URL)
+
+	code, res := getHealth(t, s, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, res.Checks["livekit"], "502")
+}
+
+func TestHealthServer_DebugSessions(t *testing.T) {
+	s := newTestHealthServer(t, "ws://127.0.0.1:1")
+	request := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.handler().ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+
+		return rec
+	}
+
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/debug/sessions").Code, "Disabled by default")
+
+	s.cfg.Health.Debug = true
+	assert.Equal(t, http.StatusServiceUnavailable, request(http.MethodGet, "/debug/sessions").Code, "Server not up yet")
+
+	server := NewServer(s.cfg, &mockPubSub{publishChan: make(chan []byte, 10)})
+	s.SetSessions(server.Sessions())
+	lk := &statsLiveKitWebRTC{mockLiveKitWebRTC{closed: make(chan struct{})}}
+	sess := NewSession("test-debug", server, (*webrtc.WebRTC)(nil), lk, &mockRecorder{})
+	require.NoError(t, server.addSession(sess))
+
+	rec := request(http.MethodGet, "/debug/sessions")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var list []events.RecordingInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	require.Len(t, list, 1)
+	assert.Equal(t, "test-debug", list[0].SessionId)
+
+	rec = request(http.MethodGet, "/debug/sessions/test-debug")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "test-room")
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/debug/sessions/missing").Code)
+
+	assert.Equal(t, http.StatusAccepted, request(http.MethodDelete, "/debug/sessions/test-debug").Code)
+
+	select {
+	case <-sess.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Session not stopped")
+	}
+
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/debug/sessions/test-debug").Code)
+	assert.NoError(t, server.Close())
+}
+
+func TestHealthServer_Capabilities(t *testing.T) {
+	s := newTestHealthServer(t, "ws://127.0.0.1:1")
+	s.cfg.Recorder.Proxy.Enable = true
+	s.cfg.Recorder.FMP4.Enable = true
+
+	rec := httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/capabilities", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var res events.RecorderCapabilities
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+
+	assert.Equal(t, events.RecorderCapabilitiesKey, res.Id)
+	assert.Equal(t, events.CapabilitiesVersion, res.Version)
+	assert.True(t, res.SupportsCodec(events.AdapterLiveKit, "video/AV1"))
+	assert.False(t, res.SupportsCodec(events.AdapterMediasoup, "video/av1"), "Only VP8 is negotiated")
+	assert.True(t, res.SupportsCodec(events.AdapterRTP, "audio/multiopus"))
+	assert.Contains(t, res.Adapters[events.AdapterLiveKit].Features, FeatureE2EE)
+	assert.Contains(t, res.Containers, "mp4")
+	assert.NotContains(t, res.Containers, "ogg")
+	assert.Contains(t, res.Features, "transcoding")
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/tlsconfig"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/web"
 	log "github.com/sirupsen/logrus"
 )
@@ -94,9 +95,15 @@ func (s *HTTPServer) serve(handler func(string) string) {
 	http.Handle("/", http.FileServer(http.FS(public)))
 	http.HandleFunc("/favicon.ico", func(rw http.ResponseWriter, r *http.Request) {})
 
+	tlsConfig, err := tlsconfig.Server(s.cfg.HTTP.TLS)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	addr := ":" + strconv.Itoa(s.port)
 	log.Printf("starting http server on %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	if err := tlsconfig.ListenAndServe(addr, nil, tlsConfig); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/interfaces"
+)
+
+// Thresholds past which an inspected recording is flagged
+const (
+	inspectMaxLossFraction = 0.05
+	inspectMinDuration     = 2 * time.Second
+)
+
+// Stop and close reasons of recordings that didn't end as asked to
+var (
+	inspectAbnormalStopReasons = []string{
+		events.StopReasonOutOfDisk,
+		events.StopReasonNoMedia,
+		events.StopReasonQuotaExceeded,
+	}
+	inspectAbnormalCloseReasons = []string{
+		interfaces.CloseReasonDisconnected,
+		interfaces.CloseReasonReconnectFailed,
+		interfaces.CloseReasonInitFailed,
+		interfaces.CloseReasonError,
+	}
+)
+
+// Inspection summarizes a finished recording from its sidecar
+type Inspection struct {
+	SidecarPath string
+	Sidecar     *Sidecar
+	// Size of the recording file, -1 if it's missing
+	FileSize  int64
+	Anomalies []string
+}
+
+// InspectRecording reads the sidecar of a recording, given either, and flags
+// what looks wrong with it. Media isn't parsed, so the recording only needs
+// to exist.
+func InspectRecording(path string) (*Inspection, error) {
+	inspection := &Inspection{SidecarPath: path, FileSize: -1}
+
+	if !strings.HasSuffix(path, "-sidecar.json") {
+		inspection.SidecarPath = sidecarPath(path)
+	}
+
+	data, err := os.ReadFile(inspection.SidecarPath)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sidecar: %w", err)
+	}
+
+	var sidecar Sidecar
+
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		return nil, fmt.Errorf("invalid sidecar %s: %w", inspection.SidecarPath, err)
+	}
+
+	inspection.Sidecar = &sidecar
+
+	if info, err := os.Stat(sidecar.FileName); err == nil {
+		inspection.FileSize = info.Size()
+	}
+
+	inspection.check()
+
+	return inspection, nil
+}
+
+func (i *Inspection) check() {
+	s := i.Sidecar
+
+	switch {
+	case i.FileSize < 0:
+		i.flag("recording file %s is missing", s.FileName)
+	case i.FileSize == 0:
+		i.flag("recording file %s is empty", s.FileName)
+	}
+
+	if s.StartTimeUTC == nil {
+		i.flag("media never flowed")
+	}
+
+	if duration := time.Duration(s.DurationMs) * time.Millisecond; duration < inspectMinDuration {
+		i.flag("duration %s is shorter than %s", duration, inspectMinDuration)
+	}
+
+	if slices.Contains(inspectAbnormalStopReasons, s.StopReason) {
+		i.flag("stopped with reason %s", s.StopReason)
+	}
+
+	if slices.Contains(inspectAbnormalCloseReasons, s.CloseReason) {
+		i.flag("capture closed with reason %s", s.CloseReason)
+	}
+
+	for _, trackID := range slices.Sorted(maps.Keys(s.TrackErrors)) {
+		i.flag("track %s failed: %s", trackID, s.TrackErrors[trackID])
+	}
+
+	for _, trackID := range slices.Sorted(maps.Keys(s.Tracks)) {
+		if loss := s.Tracks[trackID].LossFraction; loss > inspectMaxLossFraction {
+			i.flag("track %s lost %.1f%% of its packets", trackID, loss*100)
+		}
+	}
+
+	if s.Recorder != nil && s.Recorder.Video != nil && s.Recorder.Video.CorruptedFrames > 0 {
+		i.flag("%d corrupted video frames", s.Recorder.Video.CorruptedFrames)
+	}
+
+	if s.Recorder != nil && s.Recorder.FlushTimedOut {
+		i.flag("not finalized within the flush deadline")
+	}
+}
+
+func (i *Inspection) flag(format string, args ...any) {
+	i.Anomalies = append(i.Anomalies, fmt.Sprintf(format, args...))
+}
+
+// Print writes the inspection as text
+func (i *Inspection) Print(w io.Writer) {
+	s := i.Sidecar
+
+	fmt.Fprintf(w, "recording:  %s\n", s.FileName)
+
+	if i.FileSize >= 0 {
+		fmt.Fprintf(w, "size:       %d bytes\n", i.FileSize)
+	}
+
+	fmt.Fprintf(w, "session:    %s\n", s.SessionId)
+
+	if s.Adapter != "" {
+		fmt.Fprintf(w, "adapter:    %s\n", s.Adapter)
+	}
+
+	fmt.Fprintf(w, "duration:   %s\n", time.Duration(s.DurationMs)*time.Millisecond)
+
+	for _, kind := range slices.Sorted(maps.Keys(s.Codecs)) {
+		fmt.Fprintf(w, "codec:      %s %s\n", kind, s.Codecs[kind])
+	}
+
+	fmt.Fprintf(w, "stopped:    %s\n", s.StopReason)
+
+	if s.CloseReason != "" {
+		fmt.Fprintf(w, "closed:     %s\n", s.CloseReason)
+	}
+
+	for _, trackID := range slices.Sorted(maps.Keys(s.Tracks)) {
+		t := s.Tracks[trackID]
+		fmt.Fprintf(w, "track %s: loss %.2f%%, %d wraparounds, %d PLIs, %d FIRs\n",
+			trackID, t.LossFraction*100, t.SeqNumWrapArounds, t.PLIRequests, t.FIRRequests)
+	}
+
+	if len(i.Anomalies) == 0 {
+		fmt.Fprintln(w, "no anomalies")
+		return
+	}
+
+	for _, anomaly := range i.Anomalies {
+		fmt.Fprintf(w, "WARNING: %s\n", anomaly)
+	}
+}
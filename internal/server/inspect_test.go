@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/interfaces"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestSidecar(t *testing.T, recPath string, sidecar *Sidecar) string {
+	sidecar.FileName = recPath
+	path, err := (&sidecarWriter{fileMode: 0600}).write(recPath, sidecar)
+	require.NoError(t, err)
+
+	return path
+}
+
+func TestInspectRecording(t *testing.T) {
+	recPath := filepath.Join(t.TempDir(), "rec.webm")
+	require.NoError(t, os.WriteFile(recPath, []byte("media"), 0600))
+	start := time.Now().UTC()
+	sidecarPath := writeTestSidecar(t, recPath, &Sidecar{
+		SessionId:    "s1",
+		Adapter:      events.AdapterLiveKit,
+		StartTimeUTC: &start,
+		DurationMs:   60000,
+		StopReason:   events.StopReasonNormal,
+		CloseReason:  interfaces.CloseReasonNormal,
+		Codecs:       map[string]string{"video": "VP8"},
+		Tracks: map[string]*appstats.AdapterTrackStats{
+			"TR_1": {LossFraction: 0.01, SeqNumWrapArounds: 2, PLIRequests: 3},
+		},
+	})
+
+	// Either the recording or its sidecar can be given
+	for _, path := range []string{recPath, sidecarPath} {
+		inspection, err := InspectRecording(path)
+		require.NoError(t, err)
+		assert.Equal(t, sidecarPath, inspection.SidecarPath)
+		assert.Equal(t, int64(5), inspection.FileSize)
+		assert.Empty(t, inspection.Anomalies)
+
+		var out bytes.Buffer
+		inspection.Print(&out)
+		assert.Contains(t, out.String(), "duration:   1m0s")
+		assert.Contains(t, out.String(), "codec:      video VP8")
+		assert.Contains(t, out.String(), "track TR_1: loss 1.00%, 2 wraparounds, 3 PLIs, 0 FIRs")
+		assert.Contains(t, out.String(), "no anomalies")
+	}
+}
+
+func TestInspectRecording_Anomalies(t *testing.T) {
+	recPath := filepath.Join(t.TempDir(), "rec.webm")
+	writeTestSidecar(t, recPath, &Sidecar{
+		DurationMs:  500,
+		StopReason:  events.StopReasonNoMedia,
+		CloseReason: interfaces.CloseReasonReconnectFailed,
+		Tracks: map[string]*appstats.AdapterTrackStats{
+			"TR_1": {LossFraction: 0.2},
+		},
+		TrackErrors: map[string]string{"TR_2": "subscription timed out"},
+	})
+
+	inspection, err := InspectRecording(recPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), inspection.FileSize)
+	assert.Equal(t, []string{
+		"recording file " + recPath + " is missing",
+		"media never flowed",
+		"duration 500ms is shorter than 2s",
+		"stopped with reason no_media",
+		"capture closed with reason reconnect_failed",
+		"track TR_2 failed: subscription timed out",
+		"track TR_1 lost 20.0% of its packets",
+	}, inspection.Anomalies)
+
+	var out bytes.Buffer
+	inspection.Print(&out)
+	assert.Contains(t, out.String(), "WARNING: track TR_1 lost 20.0% of its packets")
+}
+
+func TestInspectRecording_NoSidecar(t *testing.T) {
+	_, err := InspectRecording(filepath.Join(t.TempDir(), "rec.webm"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/upload"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
+)
+
+var errOverridesDisabled = errors.New("recording overrides are disabled")
+
+// sessionConfig returns the configuration of a recording: the configured
+// one, with the overrides it was started with applied. Fails if they're
+// disabled or out of the configured bounds.
+func (s *Server) sessionConfig(e *events.StartRecording) (*config.Config, error) {
+	o := e.Overrides
+
+	if o == nil {
+		return s.cfg, nil
+	}
+
+	bounds := s.cfg.Overrides
+
+	if !bounds.Enable {
+		return nil, errOverridesDisabled
+	}
+
+	cfg := *s.cfg
+
+	if o.Format != "" {
+		if len(bounds.Formats) > 0 && !slices.Contains(bounds.Formats, o.Format) {
+			return nil, fmt.Errorf("format %s not allowed", o.Format)
+		}
+
+		cfg.Recorder.FMP4.Enable = o.Format == events.FormatMP4
+		cfg.Recorder.MKV.Enable = o.Format == events.FormatMKV
+	}
+
+	if o.MaxDurationMs > 0 {
+		duration := time.Duration(o.MaxDurationMs) * time.Millisecond
+
+		if bounds.MaxDuration > 0 && duration > bounds.MaxDuration {
+			return nil, fmt.Errorf("max duration %s exceeds the allowed %s", duration, bounds.MaxDuration)
+		}
+
+		cfg.Recorder.Quota.MaxDuration = duration
+	}
+
+	if o.MaxBytes > 0 {
+		if bounds.MaxBytes > 0 && o.MaxBytes > bounds.MaxBytes {
+			return nil, fmt.Errorf("max bytes %d exceeds the allowed %d", o.MaxBytes, bounds.MaxBytes)
+		}
+
+		cfg.Recorder.Quota.MaxBytes = o.MaxBytes
+	}
+
+	// Applied to the session's uploader (see sessionUploader)
+	if o.UploadPrefix != "" && len(bounds.UploadPrefixes) > 0 &&
+		!slices.ContainsFunc(bounds.UploadPrefixes, func(prefix string) bool {
+			return strings.HasPrefix(o.UploadPrefix, prefix)
+		}) {
+		return nil, fmt.Errorf("upload prefix %s not allowed", o.UploadPrefix)
+	}
+
+	if len(o.VideoCodecs) > 0 {
+		// Narrowing the configured codecs down only
+		allowed := func(codec string) bool {
+			if len(s.cfg.LiveKit.VideoCodecs) == 0 {
+				return recorder.IsSupportedVideoCodec(codec)
+			}
+
+			return slices.ContainsFunc(s.cfg.LiveKit.VideoCodecs, func(c string) bool {
+				return recorder.NormalizeMimeType(c) == recorder.NormalizeMimeType(codec)
+			})
+		}
+
+		for _, codec := range o.VideoCodecs {
+			if !allowed(codec) {
+				return nil, fmt.Errorf("video codec %s not allowed", codec)
+			}
+		}
+
+		cfg.LiveKit.VideoCodecs = o.VideoCodecs
+	}
+
+	return &cfg, nil
+}
+
+// sessionUploader returns the uploader of a recording, nil if uploads are
+// disabled
+func (s *Server) sessionUploader(e *events.StartRecording) *upload.Uploader {
+	if s.uploader == nil || e.Overrides == nil || e.Overrides.UploadPrefix == "" {
+		return s.uploader
+	}
+
+	return s.uploader.WithPrefix(e.Overrides.UploadPrefix)
+}
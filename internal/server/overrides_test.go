@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionConfig(t *testing.T) {
+	cfg := &config.Config{
+		Recorder: config.Recorder{Quota: config.Quota{MaxBytes: 1000}},
+		LiveKit:  config.LiveKit{VideoCodecs: []string{"video/VP8", "video/VP9"}},
+		Overrides: config.Overrides{
+			Enable:         true,
+			Formats:        []string{events.FormatWebM, events.FormatMP4},
+			MaxDuration:    time.Hour,
+			MaxBytes:       1 << 30,
+			UploadPrefixes: []string{"tenants/"},
+		},
+	}
+	server := NewServer(cfg, &mockPubSub{})
+
+	sessCfg, err := server.sessionConfig(&events.StartRecording{})
+	require.NoError(t, err)
+	assert.Same(t, cfg, sessCfg, "Recordings without overrides use the configuration as is")
+
+	sessCfg, err = server.sessionConfig(&events.StartRecording{Overrides: &events.RecordingOverrides{
+		Format:        events.FormatMP4,
+		MaxDurationMs: 60000,
+		UploadPrefix:  "tenants/a/",
+		VideoCodecs:   []string{"video/vp8"},
+	}})
+	require.NoError(t, err)
+	assert.True(t, sessCfg.Recorder.FMP4.Enable)
+	assert.False(t, sessCfg.Recorder.MKV.Enable)
+	assert.Equal(t, time.Minute, sessCfg.Recorder.Quota.MaxDuration)
+	assert.Equal(t, uint64(1000), sessCfg.Recorder.Quota.MaxBytes, "Unset overrides keep the configured values")
+	assert.Equal(t, []string{"video/vp8"}, sessCfg.LiveKit.VideoCodecs)
+	assert.False(t, cfg.Recorder.FMP4.Enable, "The configuration itself is left alone")
+
+	for name, o := range map[string]*events.RecordingOverrides{
+		"format":        {Format: "ogg"},
+		"not allowed":   {Format: events.FormatMKV},
+		"max duration":  {MaxDurationMs: (2 * time.Hour).Milliseconds()},
+		"max bytes":     {MaxBytes: 2 << 30},
+		"upload prefix": {UploadPrefix: "other/"},
+		"video codec":   {VideoCodecs: []string{"video/H264"}},
+	} {
+		_, err := server.sessionConfig(&events.StartRecording{Overrides: o})
+		assert.Error(t, err, name)
+	}
+
+	cfg.Overrides.Enable = false
+	_, err = server.sessionConfig(&events.StartRecording{Overrides: &events.RecordingOverrides{Format: events.FormatMP4}})
+	assert.ErrorIs(t, err, errOverridesDisabled)
+}
+
+func TestStartRecordingOverridesRejected(t *testing.T) {
+	ps := &mockPubSub{publishChan: make(chan []byte, 10)}
+	server := NewServer(&config.Config{Recorder: config.Recorder{Directory: t.TempDir()}}, ps)
+
+	server.HandlePubSubEvent(context.Background(), &events.Event{
+		Id: events.StartRecordingKey,
+		Data: &events.StartRecording{
+			Id:        events.StartRecordingKey,
+			SessionId: "test-overrides",
+			FileName:  "test.webm",
+			Adapter:   events.AdapterRTP,
+			AdapterOptions: &events.AdapterOptions{
+				RTP: &events.RTPConfig{
+					ListenAddress: "127.0.0.1:0",
+					Tracks:        []events.RTPTrackConfig{{ID: "audio", PayloadType: 111, MimeType: "audio/opus"}},
+				},
+			},
+			Overrides: &events.RecordingOverrides{MaxBytes: 1000},
+		},
+	})
+
+	select {
+	case responseBytes := <-ps.publishChan:
+		var response events.StartRecordingResponse
+		require.NoError(t, json.Unmarshal(responseBytes, &response))
+		assert.Equal(t, "failed", response.Status)
+		assert.Equal(t, errOverridesDisabled.Error(), *response.Error)
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive a response from the server")
+	}
+
+	_, ok := server.sessions.Get("test-overrides")
+	assert.False(t, ok)
+}
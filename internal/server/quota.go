@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// quotaCheckInterval is how often a recording's usage is checked against
+// its quota, so how far past it it may go
+const quotaCheckInterval = time.Second
+
+// quotaUsage is what a recording's quota is checked against
+type quotaUsage struct {
+	// Bytes its files hold
+	bytes uint64
+	// Media time written
+	duration time.Duration
+}
+
+// quotaGuard periodically probes a recording's usage, calling onExceeded
+// once it reaches either of the quota's limits
+type quotaGuard struct {
+	cfg        config.Quota
+	probe      func() quotaUsage
+	onExceeded func(usage quotaUsage)
+	clock      clock.Clock
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func newQuotaGuard(cfg config.Quota, probe func() quotaUsage, onExceeded func(usage quotaUsage)) *quotaGuard {
+	return &quotaGuard{
+		cfg:        cfg,
+		probe:      probe,
+		onExceeded: onExceeded,
+		clock:      clock.Real,
+		stop:       make(chan struct{}),
+	}
+}
+
+// exceeded returns which limit usage reached, or "" if none
+func (g *quotaGuard) exceeded(usage quotaUsage) string {
+	if g.cfg.MaxBytes > 0 && usage.bytes >= g.cfg.MaxBytes {
+		return fmt.Sprintf("%d bytes written, quota is %d", usage.bytes, g.cfg.MaxBytes)
+	}
+
+	if g.cfg.MaxDuration > 0 && usage.duration >= g.cfg.MaxDuration {
+		return fmt.Sprintf("%v of media written, quota is %v", usage.duration, g.cfg.MaxDuration)
+	}
+
+	return ""
+}
+
+func (g *quotaGuard) start(sessionId string) {
+	ticker := g.clock.NewTicker(quotaCheckInterval)
+	g.wg.Add(1)
+
+	go func() {
+		defer g.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-g.stop:
+				return
+			case <-ticker.C():
+				usage := g.probe()
+
+				if limit := g.exceeded(usage); limit != "" {
+					log.WithField("session", sessionId).
+						Errorf("Recording quota exceeded (%s), stopping recording", limit)
+					g.onExceeded(usage)
+
+					return
+				}
+			}
+		}
+	}()
+}
+
+// close stops the probes and waits for a running one to finish. Safe to
+// call on a nil guard and more than once.
+func (g *quotaGuard) close() {
+	if g == nil {
+		return
+	}
+
+	g.stopOnce.Do(func() { close(g.stop) })
+	g.wg.Wait()
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaGuard(t *testing.T) {
+	var bytes atomic.Uint64
+	var probes atomic.Int32
+	exceeded := make(chan quotaUsage, 2)
+	clk := clock.NewMock(time.Unix(1000, 0))
+
+	guard := newQuotaGuard(config.Quota{MaxBytes: 1000}, func() quotaUsage {
+		probes.Add(1)
+		return quotaUsage{bytes: bytes.Load(), duration: time.Hour}
+	}, func(usage quotaUsage) {
+		exceeded <- usage
+	})
+	guard.clock = clk
+	guard.start("test-session")
+
+	tick := func() {
+		n := probes.Load()
+		clk.Add(quotaCheckInterval)
+		require.Eventually(t, func() bool { return probes.Load() > n }, time.Second, time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		bytes.Add(300)
+		tick()
+	}
+
+	assert.Empty(t, exceeded, "Under the quota, and no duration limit")
+	bytes.Add(100)
+	tick()
+
+	select {
+	case usage := <-exceeded:
+		assert.Equal(t, uint64(1000), usage.bytes)
+	case <-time.After(time.Second):
+		t.Fatal("Quota not enforced")
+	}
+
+	guard.close()
+	// Reported once, then the probes stop
+	n := probes.Load()
+	clk.Add(time.Minute)
+	assert.Equal(t, n, probes.Load())
+	assert.Empty(t, exceeded)
+	assert.Zero(t, clk.Timers())
+
+	var nilGuard *quotaGuard
+	nilGuard.close()
+}
+
+func TestQuotaGuard_Exceeded(t *testing.T) {
+	guard := newQuotaGuard(config.Quota{MaxBytes: 1000, MaxDuration: time.Minute}, nil, nil)
+
+	assert.Empty(t, guard.exceeded(quotaUsage{bytes: 999, duration: 59 * time.Second}))
+	assert.Contains(t, guard.exceeded(quotaUsage{bytes: 1000}), "1000 bytes")
+	assert.Contains(t, guard.exceeded(quotaUsage{duration: time.Minute}), "1m0s of media")
+
+	// Either limit can be left off
+	guard.cfg.MaxBytes = 0
+	assert.Empty(t, guard.exceeded(quotaUsage{bytes: 1 << 40}))
+	guard.cfg = config.Quota{MaxBytes: 1000}
+	assert.Empty(t, guard.exceeded(quotaUsage{duration: 24 * time.Hour}))
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
+	log "github.com/sirupsen/logrus"
+)
+
+const recoveryMarkerSuffix = "-recovery.json"
+
+// recoveryMarker flags a recording in progress, so it's recovered if the
+// recorder dies before finalizing it
+type recoveryMarker struct {
+	SessionId    string    `json:"recordingSessionId"`
+	FileName     string    `json:"fileName"`
+	StartTimeUTC time.Time `json:"startTimeUTC"`
+	Hostname     string    `json:"hostname"`
+	PID          int       `json:"pid"`
+}
+
+// recoveryMarkerPath is where the marker of a recording goes, e.g.
+// recording-recovery.json for recording.webm
+func recoveryMarkerPath(recordingPath string) string {
+	return strings.TrimSuffix(recordingPath, filepath.Ext(recordingPath)) + recoveryMarkerSuffix
+}
+
+// writeRecoveryMarker flags the recording as in progress, if it can be
+// recovered
+func (s *Session) writeRecoveryMarker() {
+	path := s.recorder.GetFilePath()
+
+	if !s.cfg.Recorder.Recovery.Enable {
+		return
+	}
+
+	// Segments, recordings without a file and the like aren't
+	if ext := filepath.Ext(path); ext != ".webm" && ext != ".mkv" {
+		return
+	}
+
+	hostname, _ := os.Hostname()
+	data, err := json.Marshal(&recoveryMarker{
+		SessionId:    s.id,
+		FileName:     path,
+		StartTimeUTC: time.Now().UTC(),
+		Hostname:     hostname,
+		PID:          os.Getpid(),
+	})
+
+	if err != nil {
+		log.WithField("session", s.id).WithError(err).Error("Failed to encode recovery marker")
+		return
+	}
+
+	marker := recoveryMarkerPath(path)
+
+	if err := os.WriteFile(marker, data, s.fileMode); err != nil {
+		log.WithField("session", s.id).WithError(err).Error("Failed to write recovery marker")
+		return
+	}
+
+	s.recoveryMarker = marker
+}
+
+// removeRecoveryMarker drops the marker of a recording once finalized
+func (s *Session) removeRecoveryMarker() {
+	if s.recoveryMarker == "" {
+		return
+	}
+
+	if err := os.Remove(s.recoveryMarker); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.WithField("session", s.id).WithError(err).Warn("Failed to remove recovery marker")
+	}
+}
+
+// RecoverInterrupted finalizes the recordings under dir whose marker was
+// left behind by a recorder of this host that's no longer running
+func RecoverInterrupted(dir string) {
+	hostname, _ := os.Hostname()
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, recoveryMarkerSuffix) {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+
+		if err != nil {
+			log.WithField("marker", path).WithError(err).Warn("Failed to read recovery marker")
+			return nil
+		}
+
+		var marker recoveryMarker
+
+		if err := json.Unmarshal(data, &marker); err != nil {
+			log.WithField("marker", path).WithError(err).Warn("Invalid recovery marker")
+			return nil
+		}
+
+		// Recordings of another host may still be going on
+		if marker.Hostname != hostname || processAlive(marker.PID) {
+			return nil
+		}
+
+		recoverRecording(path, &marker)
+
+		return nil
+	})
+
+	if err != nil {
+		log.WithField("directory", dir).WithError(err).Warn("Failed to look for interrupted recordings")
+	}
+}
+
+// recoverRecording recovers the recording of a marker, then drops it
+func recoverRecording(markerPath string, marker *recoveryMarker) {
+	logger := log.WithField("session", marker.SessionId).WithField("marker", markerPath)
+	file, err := recordingOfMarker(markerPath, marker)
+
+	if err == nil {
+		logger = logger.WithField("file", file)
+		var result *recorder.RecoveryResult
+
+		if result, err = recorder.RecoverWebM(file); err == nil {
+			logger.WithField("duration", result.Duration).
+				WithField("clusters", result.Clusters).
+				WithField("droppedBytes", result.DroppedBytes).
+				Info("Recovered interrupted recording")
+		}
+	}
+
+	if err != nil {
+		logger.WithError(err).Error("Failed to recover interrupted recording")
+	}
+
+	if err := os.Remove(markerPath); err != nil {
+		logger.WithError(err).Warn("Failed to remove recovery marker")
+	}
+}
+
+// recordingOfMarker returns the recording a marker is for. Its container may
+// have changed since the marker was written, e.g. to MKV for H.264.
+func recordingOfMarker(markerPath string, marker *recoveryMarker) (string, error) {
+	base := strings.TrimSuffix(markerPath, recoveryMarkerSuffix)
+	candidates := []string{marker.FileName, base + ".webm", base + ".mkv", base + ".ogg", base + ".wav", base + ".mp4"}
+
+	for _, file := range candidates {
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
+	}
+
+	return "", fmt.Errorf("no recording found for %s", base)
+}
+
+// processAlive returns whether a process is running. The recorder's own
+// markers are of recordings it's making.
+func processAlive(pid int) bool {
+	if pid == os.Getpid() {
+		return true
+	}
+
+	err := syscall.Kill(pid, 0)
+
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoveryMarkerPath(t *testing.T) {
+	assert.Equal(t, "/rec/abc-recovery.json", recoveryMarkerPath("/rec/abc.webm"))
+}
+
+func TestSession_RecoveryMarker(t *testing.T) {
+	recPath := filepath.Join(t.TempDir(), "rec.webm")
+	cfg := &config.Config{}
+	cfg.Recorder.Recovery.Enable = true
+	cfg.Recorder.FileMode = "0640"
+	server := NewServer(cfg, &mockPubSub{publishChan: make(chan []byte, 10)})
+	lk := &statsLiveKitWebRTC{mockLiveKitWebRTC{closed: make(chan struct{})}}
+	sess := NewSession("test-recovery", server, (*webrtc.WebRTC)(nil), lk, &mockRecorder{path: recPath})
+	sess.startedSuccessfully = true
+
+	sess.writeRecoveryMarker()
+
+	path := recoveryMarkerPath(recPath)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var marker recoveryMarker
+	require.NoError(t, json.Unmarshal(data, &marker))
+	assert.Equal(t, "test-recovery", marker.SessionId)
+	assert.Equal(t, recPath, marker.FileName)
+	assert.Equal(t, os.Getpid(), marker.PID)
+
+	sess.handleStopRecording(stopRecordingCommand{reason: events.StopReasonNormal})
+	assert.NoFileExists(t, path, "Dropped once the recording is finalized")
+}
+
+func TestSession_RecoveryMarkerUnsupported(t *testing.T) {
+	recPath := filepath.Join(t.TempDir(), "rec.ogg")
+	cfg := &config.Config{}
+	cfg.Recorder.Recovery.Enable = true
+	server := NewServer(cfg, &mockPubSub{publishChan: make(chan []byte, 10)})
+	sess := NewSession("test-recovery", server, (*webrtc.WebRTC)(nil), nil, &mockRecorder{path: recPath})
+
+	sess.writeRecoveryMarker()
+
+	assert.NoFileExists(t, recoveryMarkerPath(recPath))
+}
+
+// deadPID returns the PID of a process that exited
+func deadPID(t *testing.T) int {
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+
+	return cmd.Process.Pid
+}
+
+func writeMarker(t *testing.T, path string, marker recoveryMarker) {
+	data, err := json.Marshal(&marker)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0600))
+}
+
+func TestRecoverInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	hostname, _ := os.Hostname()
+
+	// Not a recording that can be recovered, so left as is
+	dead := filepath.Join(dir, "dead.webm")
+	require.NoError(t, os.WriteFile(dead, []byte("media"), 0600))
+	writeMarker(t, recoveryMarkerPath(dead), recoveryMarker{FileName: dead, Hostname: hostname, PID: deadPID(t)})
+
+	live := filepath.Join(dir, "live.webm")
+	writeMarker(t, recoveryMarkerPath(live), recoveryMarker{FileName: live, Hostname: hostname, PID: os.Getpid()})
+
+	other := filepath.Join(dir, "other.webm")
+	writeMarker(t, recoveryMarkerPath(other), recoveryMarker{FileName: other, Hostname: hostname + "-other", PID: deadPID(t)})
+
+	RecoverInterrupted(dir)
+
+	assert.NoFileExists(t, recoveryMarkerPath(dead), "Recoveries are tried once")
+	assert.FileExists(t, dead)
+	assert.FileExists(t, recoveryMarkerPath(live), "Still recording")
+	assert.FileExists(t, recoveryMarkerPath(other), "Another host's")
+}
@@ -0,0 +1,384 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionExists   = errors.New("session already exists")
+	// Only LiveKit captures report live stats
+	ErrNoSessionStats = errors.New("session has no stats")
+	ErrAtCapacity     = errors.New("recorder at capacity")
+)
+
+// SessionRegistry tracks the active sessions by ID, from the moment they're
+// added until they stopped. Safe for concurrent use.
+type SessionRegistry struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+	// limit caps the sessions active or reserved at once, 0 is unlimited
+	limit    int
+	reserved int
+	queued   int
+	// freed is closed, then replaced, whenever a slot may have freed up
+	freed chan struct{}
+	// Recording starts waiting for a slot, by session ID, until their
+	// session is added or they failed
+	queuedStarts map[string]*queuedStart
+	// Sessions that stopped, by ID, while their recording uploads
+	uploads map[string]*Session
+}
+
+// queuedStart is a recording start waiting for a session slot
+type queuedStart struct {
+	// cancel stops the wait for a slot
+	cancel context.CancelCauseFunc
+	// end is what the recording was stopped or canceled with while queued,
+	// to be applied to its session once added
+	end func(sess *Session)
+}
+
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		sessions:     make(map[string]*Session),
+		freed:        make(chan struct{}),
+		queuedStarts: make(map[string]*queuedStart),
+		uploads:      make(map[string]*Session),
+	}
+}
+
+// SetLimit caps the sessions active at once, 0 being unlimited. Sessions
+// past a lowered limit go on.
+func (r *SessionRegistry) SetLimit(limit int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.limit = limit
+	r.notifyFreed()
+	appstats.SetSessionCapacity(limit)
+}
+
+// reserve takes a slot for a session about to be added, failing with
+// ErrAtCapacity if there's none, or with wait, once ctx is done without one
+// freeing up. It's given back with release, once the session is added or
+// failed to be.
+func (r *SessionRegistry) reserve(ctx context.Context, wait bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for r.atCapacity() {
+		if !wait {
+			return fmt.Errorf("%w: %d sessions active", ErrAtCapacity, r.limit)
+		}
+
+		freed := r.freed
+		r.setQueued(r.queued + 1)
+		r.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+		}
+
+		r.mu.Lock()
+		r.setQueued(r.queued - 1)
+
+		if ctx.Err() != nil && r.atCapacity() {
+			return fmt.Errorf("%w: no session ended in time", ErrAtCapacity)
+		}
+	}
+
+	r.reserved++
+
+	return nil
+}
+
+// release gives back a slot taken with reserve
+func (r *SessionRegistry) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.reserved--
+	r.notifyFreed()
+}
+
+// atCapacity returns whether there's no slot left for a session
+// Locked
+func (r *SessionRegistry) atCapacity() bool {
+	return r.limit > 0 && len(r.sessions)+r.reserved >= r.limit
+}
+
+// Locked
+func (r *SessionRegistry) setQueued(queued int) {
+	r.queued = queued
+	appstats.SetQueuedSessions(queued)
+}
+
+// notifyFreed wakes up the sessions waiting for a slot
+// Locked
+func (r *SessionRegistry) notifyFreed() {
+	close(r.freed)
+	r.freed = make(chan struct{})
+}
+
+// add registers a session, failing if its ID is taken, including by a
+// session still uploading
+func (r *SessionRegistry) add(sess *Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, active := r.sessions[sess.id]
+	_, uploading := r.uploads[sess.id]
+
+	if active || uploading {
+		return fmt.Errorf("%w: %s", ErrSessionExists, sess.id)
+	}
+
+	r.sessions[sess.id] = sess
+
+	return nil
+}
+
+// remove unregisters a session. A session that took over its ID since is
+// left alone.
+func (r *SessionRegistry) remove(sess *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.sessions[sess.id] == sess {
+		delete(r.sessions, sess.id)
+		r.notifyFreed()
+	}
+}
+
+// queueStart registers a recording start waiting for a slot, whose wait
+// cancel stops. It fails if a session with its ID is active, queued or
+// uploading.
+func (r *SessionRegistry) queueStart(id string, cancel context.CancelCauseFunc) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, active := r.sessions[id]
+	_, queued := r.queuedStarts[id]
+	_, uploading := r.uploads[id]
+
+	if active || queued || uploading {
+		return fmt.Errorf("%w: %s", ErrSessionExists, id)
+	}
+
+	r.queuedStarts[id] = &queuedStart{cancel: cancel}
+
+	return nil
+}
+
+// endQueuedStart stops the wait of the queued start of session id, failing
+// it with cause, and keeps end to be applied to its session should it have
+// been added meanwhile. Returns false if no start of id is queued.
+func (r *SessionRegistry) endQueuedStart(id string, cause error, end func(sess *Session)) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	q, ok := r.queuedStarts[id]
+
+	if !ok || q.end != nil {
+		return ok
+	}
+
+	q.end = end
+	q.cancel(cause)
+
+	return true
+}
+
+// dequeueStart unregisters the queued start of session id, returning what
+// it was ended with while queued, if anything
+func (r *SessionRegistry) dequeueStart(id string) func(sess *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	q, ok := r.queuedStarts[id]
+
+	if !ok {
+		return nil
+	}
+
+	delete(r.queuedStarts, id)
+
+	return q.end
+}
+
+// IsQueued returns whether the start of session id waits for a slot
+func (r *SessionRegistry) IsQueued(id string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.queuedStarts[id]
+
+	return ok
+}
+
+// addUpload registers a session whose recording uploads, until removeUpload
+func (r *SessionRegistry) addUpload(sess *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.uploads[sess.id] = sess
+}
+
+// removeUpload unregisters a session done uploading
+func (r *SessionRegistry) removeUpload(sess *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.uploads[sess.id] == sess {
+		delete(r.uploads, sess.id)
+	}
+}
+
+// Uploading returns the stopped session with the given ID whose recording
+// uploads
+func (r *SessionRegistry) Uploading(id string) (*Session, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sess, ok := r.uploads[id]
+
+	return sess, ok
+}
+
+// Uploads returns the stopped sessions whose recording uploads
+func (r *SessionRegistry) Uploads() []*Session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sessions := make([]*Session, 0, len(r.uploads))
+
+	for _, sess := range r.uploads {
+		sessions = append(sessions, sess)
+	}
+
+	return sessions
+}
+
+// Get returns the active session with the given ID
+func (r *SessionRegistry) Get(id string) (*Session, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sess, ok := r.sessions[id]
+
+	return sess, ok
+}
+
+// Len returns the number of active sessions
+func (r *SessionRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.sessions)
+}
+
+// Limit returns the cap on active sessions, 0 if unlimited
+func (r *SessionRegistry) Limit() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.limit
+}
+
+// Queued returns the number of sessions waiting for a slot
+func (r *SessionRegistry) Queued() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.queued
+}
+
+// AtCapacity returns whether a session started now would be rejected, or
+// queued
+func (r *SessionRegistry) AtCapacity() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.atCapacity()
+}
+
+// Sessions returns the active sessions, sorted by ID. Sessions starting or
+// stopping meanwhile may or may not be in it.
+func (r *SessionRegistry) Sessions() []*Session {
+	r.mu.RLock()
+	sessions := make([]*Session, 0, len(r.sessions))
+
+	for _, sess := range r.sessions {
+		sessions = append(sessions, sess)
+	}
+
+	r.mu.RUnlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].id < sessions[j].id
+	})
+
+	return sessions
+}
+
+// List describes the active sessions, sorted by ID. Sessions that haven't
+// started recording yet only have their ID set.
+func (r *SessionRegistry) List() []*events.RecordingInfo {
+	sessions := r.Sessions()
+	infos := make([]*events.RecordingInfo, 0, len(sessions))
+
+	for _, sess := range sessions {
+		info := sess.GetRecordingInfo()
+
+		if info == nil {
+			info = &events.RecordingInfo{SessionId: sess.id}
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
+// Stats returns the live capture stats of a session
+func (r *SessionRegistry) Stats(id string) (*appstats.CaptureStats, error) {
+	sess, ok := r.Get(id)
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+
+	stats := sess.GetStats()
+
+	if stats == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoSessionStats, id)
+	}
+
+	return stats, nil
+}
+
+// Stop stops a session with the given reason. It's removed from the
+// registry once its recording is finalized, which Session.Done signals.
+func (r *SessionRegistry) Stop(id string, reason string) (*Session, error) {
+	sess, ok := r.Get(id)
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+
+	if err := sess.StopRecording(nil, reason, time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return sess, nil
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionRegistry(t *testing.T) {
+	r := NewSessionRegistry()
+	a := &Session{id: "a"}
+	b := &Session{id: "b", startEvent: &events.StartRecording{Adapter: events.AdapterRTP}, recorder: &mockRecorder{}}
+
+	require.NoError(t, r.add(b))
+	require.NoError(t, r.add(a))
+	assert.ErrorIs(t, r.add(&Session{id: "a"}), ErrSessionExists)
+	assert.Equal(t, 2, r.Len())
+
+	sess, ok := r.Get("a")
+	assert.True(t, ok)
+	assert.Same(t, a, sess)
+
+	infos := r.List()
+	require.Len(t, infos, 2)
+	assert.Equal(t, "a", infos[0].SessionId, "Sorted by ID")
+	assert.Empty(t, infos[0].Adapter, "Not started yet")
+	assert.Equal(t, "b", infos[1].SessionId)
+	assert.Equal(t, events.AdapterRTP, infos[1].Adapter)
+
+	_, err := r.Stats("a")
+	assert.ErrorIs(t, err, ErrNoSessionStats)
+	_, err = r.Stats("missing")
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+	_, err = r.Stop("missing", events.StopReasonForced)
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+
+	// Only the registered session of an ID removes it
+	r.remove(&Session{id: "a"})
+	assert.Equal(t, 2, r.Len())
+
+	r.remove(a)
+	_, ok = r.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 1, r.Len())
+}
+
+func TestSessionRegistry_Concurrent(t *testing.T) {
+	r := NewSessionRegistry()
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				sess := &Session{id: fmt.Sprintf("%d-%d", i, j)}
+				assert.NoError(t, r.add(sess))
+				r.List()
+				r.remove(sess)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	assert.Zero(t, r.Len())
+}
+
+func TestSessionRegistry_Stop(t *testing.T) {
+	server := NewServer(&config.Config{}, &mockPubSub{publishChan: make(chan []byte, 10)})
+	lk := &statsLiveKitWebRTC{mockLiveKitWebRTC{closed: make(chan struct{})}}
+	sess := NewSession("test-force-stop", server, (*webrtc.WebRTC)(nil), lk, &mockRecorder{})
+	require.NoError(t, server.addSession(sess))
+
+	stats, err := server.Sessions().Stats("test-force-stop")
+	require.NoError(t, err)
+	assert.Equal(t, "test-room", stats.RoomID)
+
+	stopped, err := server.Sessions().Stop("test-force-stop", events.StopReasonForced)
+	require.NoError(t, err)
+	assert.Same(t, sess, stopped)
+
+	select {
+	case <-sess.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Session not stopped")
+	}
+
+	// Gone by the time it's done
+	_, ok := server.Sessions().Get("test-force-stop")
+	assert.False(t, ok)
+	assert.NoError(t, server.Close())
+}
+
+func TestSessionRegistry_Capacity(t *testing.T) {
+	r := NewSessionRegistry()
+	r.SetLimit(1)
+	a := &Session{id: "a"}
+
+	require.NoError(t, r.reserve(context.Background(), false))
+	require.NoError(t, r.add(a))
+	r.release()
+	assert.True(t, r.AtCapacity())
+	assert.ErrorIs(t, r.reserve(context.Background(), false), ErrAtCapacity)
+
+	// Times out with no session ending
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, r.reserve(ctx, true), ErrAtCapacity)
+	assert.Zero(t, r.Queued())
+
+	// Takes the slot of a session ending
+	reserved := make(chan error, 1)
+
+	go func() {
+		reserved <- r.reserve(context.Background(), true)
+	}()
+
+	assert.Eventually(t, func() bool { return r.Queued() == 1 }, time.Second, time.Millisecond)
+	r.remove(a)
+
+	select {
+	case err := <-reserved:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Queued session didn't get the slot freed")
+	}
+
+	assert.True(t, r.AtCapacity(), "Reserved")
+	r.release()
+	assert.False(t, r.AtCapacity())
+
+	// Unlimited
+	r.SetLimit(0)
+	require.NoError(t, r.add(a))
+	require.NoError(t, r.reserve(context.Background(), false))
+	r.release()
+}
+
+func TestSessionRegistry_QueuedStarts(t *testing.T) {
+	r := NewSessionRegistry()
+	require.NoError(t, r.add(&Session{id: "active"}))
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	assert.ErrorIs(t, r.queueStart("active", cancel), ErrSessionExists)
+	require.NoError(t, r.queueStart("queued", cancel))
+	assert.ErrorIs(t, r.queueStart("queued", cancel), ErrSessionExists)
+	assert.True(t, r.IsQueued("queued"))
+	assert.False(t, r.endQueuedStart("missing", context.Canceled, nil))
+
+	var ended *Session
+	cause := fmt.Errorf("stopped")
+	assert.True(t, r.endQueuedStart("queued", cause, func(sess *Session) { ended = sess }))
+	assert.Equal(t, cause, context.Cause(ctx), "The wait is stopped")
+	assert.True(t, r.endQueuedStart("queued", context.Canceled, nil), "Ended once")
+
+	end := r.dequeueStart("queued")
+	require.NotNil(t, end)
+	end(&Session{id: "queued"})
+	assert.Equal(t, "queued", ended.id)
+	assert.False(t, r.IsQueued("queued"))
+	assert.Nil(t, r.dequeueStart("queued"))
+}
@@ -3,7 +3,9 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"sync"
 	"time"
 
@@ -11,22 +13,294 @@ import (
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/upload"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/interfaces"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/livekit"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/rtpudp"
 	log "github.com/sirupsen/logrus"
 )
 
 type Server struct {
 	cfg      *config.Config
 	pubsub   pubsub.PubSub
-	sessions sync.Map
+	sessions *SessionRegistry
 	// shutdownWg is used to wait for graceful shutdowns
 	shutdownWg sync.WaitGroup
+	// lifecycleMu orders session creation against shutdown
+	lifecycleMu  sync.RWMutex
+	shuttingDown bool
+	uploader     *upload.Uploader
+	pathTemplate *recorder.PathTemplate
+	// Local consumers of published responses (e.g. the gRPC API)
+	watchersMu sync.Mutex
+	watchers   map[*responseWatcher]struct{}
 }
 
+type responseWatcher struct {
+	match func(msg interface{}) bool
+	ch    chan interface{}
+}
+
+var errShuttingDown = errors.New("recorder is shutting down")
+
 func NewServer(cfg *config.Config, ps pubsub.PubSub) *Server {
-	return &Server{cfg: cfg, pubsub: ps}
+	uploader, err := upload.NewUploader(cfg.Upload, cfg.Recorder.Directory)
+
+	if err != nil {
+		log.WithError(err).Error("Failed to set up recording uploads, uploads disabled")
+	}
+
+	s := &Server{cfg: cfg, pubsub: ps, uploader: uploader, sessions: NewSessionRegistry()}
+	s.sessions.SetLimit(cfg.Capacity.MaxSessions)
+
+	if cfg.Recorder.PathTemplate != "" {
+		if s.pathTemplate, err = recorder.ParsePathTemplate(cfg.Recorder.PathTemplate); err != nil {
+			log.WithError(err).Error("Invalid recording path template, using file names as is")
+		}
+	}
+
+	return s
+}
+
+// webhookConfig returns the webhook configuration of a recording, with its
+// overrides applied. A URL override enables webhooks for it.
+func (s *Server) webhookConfig(e *events.StartRecording) config.Webhook {
+	cfg := s.cfg.Webhook
+
+	if o := e.Webhook; o != nil {
+		if o.URL != "" {
+			cfg.Enable = true
+			cfg.URL = o.URL
+		}
+
+		if o.Secret != "" {
+			cfg.Secret = o.Secret
+		}
+
+		if o.MaxAttempts > 0 {
+			cfg.Retry.MaxAttempts = o.MaxAttempts
+		}
+	}
+
+	return cfg
+}
+
+// recordingPath returns the file a recording goes to, relative to the
+// recorder directory
+func (s *Server) recordingPath(e *events.StartRecording, start time.Time) string {
+	if s.pathTemplate == nil {
+		return e.FileName
+	}
+
+	vars := recorder.PathVars{
+		Session:  e.SessionId,
+		FileName: e.FileName,
+		Time:     start,
+	}
+
+	if e.AdapterOptions != nil {
+		if lk := e.AdapterOptions.LiveKit; lk != nil {
+			vars.Room = lk.Room
+			vars.Tracks = lk.TrackIDs
+		}
+
+		if rtp := e.AdapterOptions.RTP; rtp != nil {
+			for _, track := range rtp.Tracks {
+				vars.Tracks = append(vars.Tracks, track.ID)
+			}
+		}
+	}
+
+	return s.pathTemplate.Expand(vars)
+}
+
+// recordingTags are the tags embedded in a recording: its session and room
+// IDs, then the ones it was started with
+func recordingTags(e *events.StartRecording) map[string]string {
+	tags := map[string]string{recorder.TagSessionID: e.SessionId}
+
+	if e.AdapterOptions != nil && e.AdapterOptions.LiveKit != nil {
+		tags[recorder.TagRoomID] = e.AdapterOptions.LiveKit.Room
+	}
+
+	maps.Copy(tags, e.Tags)
+
+	return tags
+}
+
+// enableAudioMix makes rec mix the recording's audio tracks
+func enableAudioMix(rec recorder.Recorder, cfg config.AudioMix, gains map[string]float64) error {
+	mixer, ok := rec.(interface {
+		EnableAudioMix(cfg config.AudioMix, gains map[string]float64) error
+	})
+
+	if !ok {
+		return errors.New("recorder can't mix audio tracks")
+	}
+
+	if err := mixer.EnableAudioMix(cfg, gains); err != nil {
+		return fmt.Errorf("failed to enable audio mixing: %w", err)
+	}
+
+	return nil
+}
+
+// startRecording starts a recording a session slot was reserved for,
+// returning whether its session took over the request
+func (s *Server) startRecording(ctx context.Context, e *events.StartRecording, start time.Time) bool {
+	// Once added, the session holds the slot
+	defer s.sessions.release()
+
+	cfg, err := s.sessionConfig(e)
+
+	if err != nil {
+		log.WithField("session", ctx.Value("session")).Error(err)
+		s.PublishPubSub(e.Fail(err))
+		return false
+	}
+
+	var rec recorder.Recorder
+	fileName := s.recordingPath(e, start)
+	var wrtc *webrtc.WebRTC
+	var lk interfaces.LiveKitWebRTCInterface
+
+	switch e.Adapter {
+	case "livekit":
+		var layerPref *livekit.LayerPreference
+
+		if layer := e.AdapterOptions.LiveKit.VideoLayer; layer != nil {
+			layerPref, err = livekit.ParseLayerPreference(
+				layer.Quality,
+				layer.Width,
+				layer.Height,
+				s.cfg.LiveKit.PreferredVideoQuality,
+			)
+
+			if err != nil {
+				log.WithField("session", ctx.Value("session")).Error(err)
+				s.PublishPubSub(e.Fail(err))
+				return false
+			}
+		}
+
+		rec, err = recorder.NewRecorder(ctx, cfg.Recorder, fileName)
+
+		if err != nil {
+			log.WithField("session", ctx.Value("session")).Error(err)
+			s.PublishPubSub(e.Fail(err))
+			return false
+		}
+
+		if mix := e.AdapterOptions.LiveKit.AudioMix; mix != nil {
+			if err := enableAudioMix(rec, cfg.Recorder.AudioMix, mix.Gains); err != nil {
+				rec.Close()
+				log.WithField("session", ctx.Value("session")).Error(err)
+				s.PublishPubSub(e.Fail(err))
+				return false
+			}
+		}
+
+		lkCfg := cfg.LiveKit
+
+		// A per-recording key takes precedence over the configured one
+		if key := e.AdapterOptions.LiveKit.E2EEKey; key != "" {
+			lkCfg.E2EEKey = key
+		}
+
+		if e.AdapterOptions.LiveKit.FollowSpeaker {
+			lkCfg.FollowSpeaker.Enabled = true
+		}
+
+		if dc := e.AdapterOptions.LiveKit.DataCapture; dc != nil {
+			lkCfg.DataCapture.Enabled = true
+
+			if len(dc.Topics) > 0 {
+				lkCfg.DataCapture.Topics = dc.Topics
+			}
+		}
+
+		if aq := e.AdapterOptions.LiveKit.AdaptiveQuality; aq != nil {
+			lkCfg.AdaptiveQuality.Enabled = true
+
+			if aq.MaxBitrate > 0 {
+				lkCfg.AdaptiveQuality.MaxBitrate = aq.MaxBitrate
+			}
+		}
+
+		lkWebRTC := livekit.NewLiveKitWebRTC(
+			ctx,
+			lkCfg,
+			rec,
+			e.AdapterOptions.LiveKit.Room,
+			e.AdapterOptions.LiveKit.TrackIDs,
+			layerPref,
+		)
+
+		if filter := e.AdapterOptions.LiveKit.AllTracks; filter != nil {
+			lkWebRTC.DiscoverTracks(filter)
+		}
+
+		lk = lkWebRTC
+
+	case "rtp":
+		rec, err = recorder.NewRecorder(ctx, cfg.Recorder, fileName)
+
+		if err != nil {
+			log.WithField("session", ctx.Value("session")).Error(err)
+			s.PublishPubSub(e.Fail(err))
+			return false
+		}
+
+		lk = rtpudp.NewRTPCapture(ctx, s.cfg.RTP, rec, *e.AdapterOptions.RTP)
+
+	case "mediasoup", "":
+		rec, err = recorder.NewRecorder(ctx, cfg.Recorder, fileName)
+
+		if err != nil {
+			log.WithField("session", ctx.Value("session")).Error(err)
+			s.PublishPubSub(e.Fail(err))
+			return false
+		}
+
+		wrtc = webrtc.NewWebRTC(ctx, s.cfg.WebRTC, rec)
+
+	default:
+		err := fmt.Errorf("unknown adapter type: %s", e.Adapter)
+		log.WithField("session", ctx.Value("session")).Error(err)
+		s.PublishPubSub(e.Fail(err))
+
+		return false
+	}
+
+	if tagger, ok := rec.(interface{ AddTags(tags map[string]string) }); ok {
+		tagger.AddTags(recordingTags(e))
+	}
+
+	sess := NewSession(e.SessionId, s, wrtc, lk, rec)
+	sess.cfg = cfg
+	sess.uploader = s.sessionUploader(e)
+
+	if err := s.addSession(sess); err != nil {
+		log.WithField("session", e.SessionId).Warn(err)
+		s.PublishPubSub(e.Fail(err))
+		return false
+	}
+
+	if err := sess.StartRecording(e, start); err != nil {
+		log.WithField("session", e.SessionId).Errorf("failed to send start command: %v", err)
+		s.PublishPubSub(e.Fail(err))
+		appstats.OnSessionError(err.Error())
+
+		if stopErr := sess.StopRecording(nil, "start_failed", time.Time{}); stopErr != nil {
+			log.WithField("session", e.SessionId).Errorf("failed to stop session after start failure: %v", stopErr)
+			appstats.OnSessionError(stopErr.Error())
+		}
+
+		return false
+	}
+	return true
 }
 
 func (s *Server) HandlePubSubMsg(ctx context.Context, msg []byte) {
@@ -65,8 +339,9 @@ func (s *Server) HandlePubSubEvent(ctx context.Context, event *events.Event) {
 
 		ctx = context.WithValue(ctx, "session", e.SessionId)
 
-		_, ok := s.sessions.Load(e.SessionId)
-		if ok {
+		_, uploading := s.sessions.Uploading(e.SessionId)
+
+		if _, ok := s.sessions.Get(e.SessionId); ok || uploading || s.sessions.IsQueued(e.SessionId) {
 			err := fmt.Errorf("session %s already exists", e.SessionId)
 			log.Error(err)
 			s.PublishPubSub(e.Fail(err))
@@ -79,86 +354,152 @@ func (s *Server) HandlePubSubEvent(ctx context.Context, event *events.Event) {
 			return
 		}
 
-		var rec recorder.Recorder
-		var err error
-		var wrtc *webrtc.WebRTC
-		var lk *livekit.LiveKitWebRTC
+		if err := s.sessions.reserve(ctx, false); err != nil {
+			if s.cfg.Capacity.Overflow != CapacityOverflowQueue {
+				s.rejectAtCapacity(ctx, e, err)
+				return
+			}
 
-		switch e.Adapter {
-		case "livekit":
-			rec, err = recorder.NewRecorder(ctx, s.cfg.Recorder, e.FileName)
+			// Waiting here would hold up the events that may free a slot
+			processedHere = false
+			go s.startQueuedRecording(ctx, e, start)
 
-			if err != nil {
-				log.WithField("session", ctx.Value("session")).Error(err)
-				s.PublishPubSub(e.Fail(err))
-				return
+			return
+		}
+
+		processedHere = !s.startRecording(ctx, e, start)
+
+	case "stopRecording":
+		e := event.StopRecording()
+
+		if e == nil {
+			return
+		}
+
+		stop := func(sess *Session) error {
+			if err := sess.StopRecording(e, events.StopReasonNormal, start); err != nil {
+				log.WithField("session", e.SessionId).Errorf("failed to send stop command: %v", err)
+				appstats.OnSessionError(err.Error())
+				return err
 			}
 
-			lk = livekit.NewLiveKitWebRTC(
-				ctx,
-				s.cfg.LiveKit,
-				rec,
-				e.AdapterOptions.LiveKit.Room,
-				e.AdapterOptions.LiveKit.TrackIDs,
-			)
+			return nil
+		}
 
-		case "mediasoup", "":
-			rec, err = recorder.NewRecorder(ctx, s.cfg.Recorder, e.FileName)
+		if sess, ok := s.sessions.Get(e.SessionId); ok {
+			if stop(sess) == nil {
+				processedHere = false
+			}
+		} else {
+			s.endQueuedRecording(e.SessionId, events.StopReasonNormal, func(sess *Session) { _ = stop(sess) })
+		}
 
-			if err != nil {
-				log.WithField("session", ctx.Value("session")).Error(err)
-				s.PublishPubSub(e.Fail(err))
+	case "cancelRecording":
+		e := event.CancelRecording()
+
+		if e == nil {
+			return
+		}
+
+		cancel := func(sess *Session) error {
+			if err := sess.CancelRecording(e, start); err != nil {
+				log.WithField("session", e.SessionId).Errorf("failed to send cancel command: %v", err)
+				appstats.OnSessionError(err.Error())
+				return err
+			}
+
+			return nil
+		}
+
+		sess, ok := s.sessions.Get(e.SessionId)
+
+		if !ok {
+			// Stopped, but still uploading
+			if sess, ok := s.sessions.Uploading(e.SessionId); ok {
+				sess.cancelUpload()
 				return
 			}
 
-			wrtc = webrtc.NewWebRTC(ctx, s.cfg.WebRTC, rec)
+			if !s.endQueuedRecording(e.SessionId, events.StopReasonCanceled, func(sess *Session) { _ = cancel(sess) }) {
+				log.WithField("session", e.SessionId).Warn("Cancel for unknown session")
+			}
 
-		default:
-			err := fmt.Errorf("unknown adapter type: %s", e.Adapter)
-			log.WithField("session", ctx.Value("session")).Error(err)
-			s.PublishPubSub(e.Fail(err))
+			return
+		}
+
+		if cancel(sess) == nil {
+			processedHere = false
+		}
 
+	case "updateEncryptionKey":
+		e := event.UpdateEncryptionKey()
+
+		if e == nil {
 			return
 		}
 
-		sess := NewSession(e.SessionId, s, wrtc, lk, rec)
-		s.sessions.Store(e.SessionId, sess)
-		s.shutdownWg.Add(1)
-		go sess.Run(&s.shutdownWg)
+		sess, ok := s.sessions.Get(e.SessionId)
 
-		if err := sess.StartRecording(e, start); err != nil {
-			log.WithField("session", e.SessionId).Errorf("failed to send start command: %v", err)
-			s.PublishPubSub(e.Fail(err))
+		if !ok {
+			log.WithField("session", e.SessionId).Warn("Encryption key update for unknown session")
+			return
+		}
+
+		if err := sess.UpdateEncryptionKey(e); err != nil {
+			log.WithField("session", e.SessionId).Errorf("failed to update encryption key: %v", err)
 			appstats.OnSessionError(err.Error())
+		}
 
-			if stopErr := sess.StopRecording(nil, "start_failed", time.Time{}); stopErr != nil {
-				log.WithField("session", e.SessionId).Errorf("failed to stop session after start failure: %v", stopErr)
-				appstats.OnSessionError(stopErr.Error())
-			}
+	case "addChapter":
+		e := event.AddChapter()
 
+		if e == nil {
 			return
 		}
-		processedHere = false
 
-	case "stopRecording":
-		e := event.StopRecording()
+		sess, ok := s.sessions.Get(e.SessionId)
+
+		if !ok {
+			log.WithField("session", e.SessionId).Warn("Chapter for unknown session")
+			return
+		}
+
+		if err := sess.AddChapter(e); err != nil {
+			log.WithField("session", e.SessionId).Warnf("failed to add chapter: %v", err)
+		}
+
+	case "setTrackRecording":
+		e := event.SetTrackRecording()
 
 		if e == nil {
 			return
 		}
 
-		if sess, ok := s.sessions.Load(e.SessionId); ok {
-			if err := sess.(*Session).StopRecording(e, events.StopReasonNormal, start); err != nil {
-				log.WithField("session", e.SessionId).Errorf("failed to send stop command: %v", err)
-				appstats.OnSessionError(err.Error())
-				return
-			}
-			processedHere = false
+		sess, ok := s.sessions.Get(e.SessionId)
+
+		if !ok {
+			log.WithField("session", e.SessionId).Warn("Track recording change for unknown session")
+			return
+		}
+
+		if err := sess.SetTrackRecording(e); err != nil {
+			log.WithField("session", e.SessionId).
+				WithField("trackId", e.TrackId).
+				Warnf("failed to set track recording: %v", err)
 		}
 
 	case "getRecorderStatus":
 		s.PublishPubSub(events.NewRecorderStatus(s.cfg.App.Version, s.cfg.App.InstanceId))
 
+	case "getRecorderCapabilities":
+		e := event.GetRecorderCapabilities()
+
+		if e == nil {
+			return
+		}
+
+		s.PublishPubSub(capabilities(s.cfg, e.RequestId))
+
 	case "getRecordings":
 		e := event.GetRecordings()
 
@@ -168,9 +509,54 @@ func (s *Server) HandlePubSubEvent(ctx context.Context, event *events.Event) {
 
 		go s.handleGetRecordings(e)
 		processedHere = false
+
+	case "validateRecording":
+		e := event.ValidateRecording()
+
+		if e == nil {
+			return
+		}
+
+		if err := e.Validate(); err != nil {
+			s.PublishPubSub(e.Fail(err))
+			return
+		}
+
+		go s.handleValidateRecording(ctx, e)
+		processedHere = false
 	}
 }
 
+// handleValidateRecording does a dry run of a LiveKit recording, without
+// creating a session or touching the recording directory
+func (s *Server) handleValidateRecording(ctx context.Context, e *events.ValidateRecording) {
+	start := time.Now()
+
+	defer func() {
+		appstats.ObserveRequestDuration("validateRecording", time.Since(start))
+	}()
+
+	options := e.AdapterOptions.LiveKit
+	lkCfg := s.cfg.LiveKit
+
+	if options.E2EEKey != "" {
+		lkCfg.E2EEKey = options.E2EEKey
+	}
+
+	report, err := livekit.Validate(ctx, lkCfg, options.Room, options.TrackIDs, options.AllTracks)
+
+	if err != nil {
+		log.WithField("room", options.Room).Warnf("Recording validation failed: %v", err)
+		response := e.Fail(err)
+		response.Report = report
+		s.PublishPubSub(response)
+
+		return
+	}
+
+	s.PublishPubSub(e.Result(report))
+}
+
 func (s *Server) handleGetRecordings(e *events.GetRecordings) {
 	start := time.Now()
 	recordings := make([]*events.RecordingInfo, 0)
@@ -179,15 +565,12 @@ func (s *Server) handleGetRecordings(e *events.GetRecordings) {
 		appstats.ObserveRequestDuration("getRecordings", time.Since(start))
 	}()
 
-	s.sessions.Range(func(key, value interface{}) bool {
-		session := value.(*Session)
-
+	for _, session := range s.sessions.Sessions() {
 		if info := session.GetRecordingInfo(); info != nil {
 			recordings = append(recordings, info)
 		}
+	}
 
-		return true
-	})
 	response := &events.GetRecordingsResponse{
 		Id:         events.GetRecordingsResponseKey,
 		RequestId:  e.RequestId,
@@ -200,30 +583,132 @@ func (s *Server) PublishPubSub(msg interface{}) {
 	j, _ := json.Marshal(msg)
 	s.pubsub.Publish(s.cfg.PubSub.Channels.Publish, j)
 	appstats.OnServerResponse(msg)
+	s.notifyWatchers(msg)
+}
+
+// watchResponses returns a channel receiving the first published response
+// match accepts, and a function to stop watching
+func (s *Server) watchResponses(match func(msg interface{}) bool) (<-chan interface{}, func()) {
+	w := &responseWatcher{match: match, ch: make(chan interface{}, 1)}
+
+	s.watchersMu.Lock()
+	defer s.watchersMu.Unlock()
+
+	if s.watchers == nil {
+		s.watchers = make(map[*responseWatcher]struct{})
+	}
+
+	s.watchers[w] = struct{}{}
+
+	return w.ch, func() {
+		s.watchersMu.Lock()
+		defer s.watchersMu.Unlock()
+		delete(s.watchers, w)
+	}
+}
+
+func (s *Server) notifyWatchers(msg interface{}) {
+	s.watchersMu.Lock()
+	defer s.watchersMu.Unlock()
+
+	for w := range s.watchers {
+		if !w.match(msg) {
+			continue
+		}
+
+		select {
+		case w.ch <- msg:
+		default:
+		}
+	}
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.lifecycleMu.RLock()
+	defer s.lifecycleMu.RUnlock()
+
+	return s.shuttingDown
 }
 
 func (s *Server) OnStart() error {
 	log.Info("Application started. Version=", s.cfg.App.Version, " InstanceId=", s.cfg.App.InstanceId)
 	s.PublishPubSub(events.NewRecorderStatus(s.cfg.App.Version, s.cfg.App.InstanceId))
+	s.PublishPubSub(capabilities(s.cfg, ""))
+	return nil
+}
+
+// addSession registers and runs a session, unless the server is shutting down
+func (s *Server) addSession(sess *Session) error {
+	s.lifecycleMu.RLock()
+	defer s.lifecycleMu.RUnlock()
+
+	if s.shuttingDown {
+		return errShuttingDown
+	}
+
+	if err := s.sessions.add(sess); err != nil {
+		return err
+	}
+
+	s.shutdownWg.Add(1)
+	go sess.Run(&s.shutdownWg)
+
 	return nil
 }
 
-func (s *Server) CloseSession(id string) {
-	s.sessions.Delete(id)
+// Sessions returns the registry of the active sessions
+func (s *Server) Sessions() *SessionRegistry {
+	return s.sessions
 }
 
+// Close stops accepting sessions and stops the active ones, waiting up to
+// the configured drain timeout for them to finalize and upload. Uploads
+// still running past it are aborted.
 func (s *Server) Close() error {
-	// Close all sessions gracefully
-	s.sessions.Range(func(key, value interface{}) bool {
-		sess := value.(*Session)
+	s.lifecycleMu.Lock()
+	s.shuttingDown = true
+	s.lifecycleMu.Unlock()
 
+	// Close all sessions gracefully; each stops in its own goroutine
+	for _, sess := range s.sessions.Sessions() {
 		if err := sess.StopRecording(nil, events.StopReasonAppShutdown, time.Time{}); err != nil {
 			log.WithField("session", sess.id).Errorf("failed to send stop command during shutdown: %v", err)
 		}
+	}
 
-		return true
-	})
+	done := make(chan struct{})
 
-	s.shutdownWg.Wait()
-	return nil
+	go func() {
+		s.shutdownWg.Wait()
+		close(done)
+	}()
+
+	timeout := s.cfg.Shutdown.DrainTimeout
+
+	if timeout <= 0 {
+		<-done
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	pending := s.sessions.Sessions()
+
+	for _, sess := range pending {
+		log.WithField("session", sess.id).Warn("Session did not stop within the drain timeout, flushing its recording")
+		sess.flushRecording()
+	}
+
+	uploads := s.sessions.Uploads()
+
+	for _, sess := range uploads {
+		log.WithField("session", sess.id).Warn("Recording did not upload within the drain timeout, aborting its upload")
+		sess.abortUpload(errDrainTimeout)
+	}
+
+	return fmt.Errorf("%d session(s) did not stop, %d upload(s) did not finish within %v", len(pending), len(uploads), timeout)
 }
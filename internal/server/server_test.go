@@ -4,7 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -13,12 +21,14 @@ import (
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webhook"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/interfaces"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/utils"
 	"github.com/pion/rtp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // Mock PubSub
@@ -42,23 +52,33 @@ var _ pubsub.PubSub = (*mockPubSub)(nil)
 
 // Mock Recorder
 type mockRecorder struct {
-	path string
-}
-
-func (r *mockRecorder) GetFilePath() string             { return r.path }
-func (r *mockRecorder) PushVideo(p *rtp.Packet)         {}
-func (r *mockRecorder) PushAudio(p *rtp.Packet)         {}
-func (r *mockRecorder) Close() time.Duration            { return 0 }
-func (r *mockRecorder) SetHasAudio(hasAudio bool)       {}
-func (r *mockRecorder) GetHasAudio() bool               { return false }
-func (r *mockRecorder) SetHasVideo(hasVideo bool)       {}
-func (r *mockRecorder) GetHasVideo() bool               { return false }
-func (r *mockRecorder) WithContext(ctx context.Context) {}
-func (r *mockRecorder) GetStats() *types.RecorderStats  { return nil }
+	path   string
+	closed atomic.Bool
+}
+
+func (r *mockRecorder) GetFilePath() string                 { return r.path }
+func (r *mockRecorder) PushVideo(p *rtp.Packet)             {}
+func (r *mockRecorder) PushAudio(p *rtp.Packet)             {}
+func (r *mockRecorder) Close() time.Duration                { r.closed.Store(true); return 0 }
+func (r *mockRecorder) SetHasAudio(hasAudio bool)           {}
+func (r *mockRecorder) GetHasAudio() bool                   { return false }
+func (r *mockRecorder) SetHasVideo(hasVideo bool)           {}
+func (r *mockRecorder) GetHasVideo() bool                   { return false }
+func (r *mockRecorder) SetVideoCodec(mimeType string) error { return nil }
+func (r *mockRecorder) WithContext(ctx context.Context)     {}
+func (r *mockRecorder) GetStats() *types.RecorderStats      { return nil }
 func (r *mockRecorder) SetKeyframeRequester(requester recorder.KeyframeRequester) {
 }
+func (r *mockRecorder) SetVideoLayer(layer string, width, height uint32) {
+}
+func (r *mockRecorder) Pause() {
+}
+func (r *mockRecorder) Resume() {
+}
 func (r *mockRecorder) VideoTimestamp() time.Duration  { return 0 }
 func (r *mockRecorder) AudioTimestamp() time.Duration  { return 0 }
+func (r *mockRecorder) ReceivedPackets() uint64        { return 0 }
+func (r *mockRecorder) FileStats() types.FileStats     { return types.FileStats{} }
 func (r *mockRecorder) NotifySkippedPacket(seq uint16) {}
 
 var _ recorder.Recorder = (*mockRecorder)(nil)
@@ -73,6 +93,12 @@ func (lk *mockLiveKitWebRTC) SetConnectionStateCallback(callback func(state util
 }
 func (lk *mockLiveKitWebRTC) SetFlowCallback(callback func(isFlowing bool, timestamp time.Duration, closed bool)) {
 }
+func (lk *mockLiveKitWebRTC) SetStopCallback(callback func(reason string)) {
+}
+func (lk *mockLiveKitWebRTC) SetFirstPacketCallback(callback func(event interfaces.MediaEvent)) {
+}
+func (lk *mockLiveKitWebRTC) SetFirstKeyframeCallback(callback func(event interfaces.MediaEvent)) {
+}
 func (lk *mockLiveKitWebRTC) Init() error { return nil }
 func (lk *mockLiveKitWebRTC) Close() time.Duration {
 	lk.closeOnce.Do(func() {
@@ -80,14 +106,35 @@ func (lk *mockLiveKitWebRTC) Close() time.Duration {
 	})
 	return 0
 }
+
+func (lk *mockLiveKitWebRTC) CloseWithResult() *interfaces.CloseResult {
+	return &interfaces.CloseResult{
+		Reason:   interfaces.CloseReasonNormal,
+		Duration: lk.Close(),
+	}
+}
 func (lk *mockLiveKitWebRTC) GetStats() *appstats.CaptureStats { return nil }
 func (lk *mockLiveKitWebRTC) RequestKeyframe()                 {}
 func (lk *mockLiveKitWebRTC) RequestKeyframeForSSRC(ssrc uint32) {
 }
 func (lk *mockLiveKitWebRTC) HasTrack(trackID string) bool { return true }
+func (lk *mockLiveKitWebRTC) SetEncryptionKey(key string, index uint8) error {
+	return nil
+}
 
 var _ interfaces.LiveKitWebRTCInterface = (*mockLiveKitWebRTC)(nil)
 
+// Mock LiveKitWebRTC that hangs while closing until released
+type stuckLiveKitWebRTC struct {
+	mockLiveKitWebRTC
+	release chan struct{}
+}
+
+func (lk *stuckLiveKitWebRTC) CloseWithResult() *interfaces.CloseResult {
+	<-lk.release
+	return lk.mockLiveKitWebRTC.CloseWithResult()
+}
+
 func TestDoubleStopSession(t *testing.T) {
 	cfg := &config.Config{
 		LiveKit: config.LiveKit{
@@ -115,7 +162,7 @@ func TestDoubleStopSession(t *testing.T) {
 	rec := &mockRecorder{}
 	lk := &mockLiveKitWebRTC{closed: make(chan struct{})}
 	sess := NewSession(sessionID, server, (*webrtc.WebRTC)(nil), lk, rec)
-	server.sessions.Store(sessionID, sess)
+	assert.NoError(t, server.sessions.add(sess))
 	server.shutdownWg.Add(1)
 	go sess.Run(&server.shutdownWg)
 	err := sess.StartRecording(startEvent, time.Time{})
@@ -156,7 +203,7 @@ func TestDuplicateStartSession(t *testing.T) {
 	sessionID := "test-duplicate-start"
 
 	existingSess := &Session{id: sessionID, commands: make(chan interface{}, 1)}
-	server.sessions.Store(sessionID, existingSess)
+	assert.NoError(t, server.sessions.add(existingSess))
 
 	startEventJSON := []byte(fmt.Sprintf(`{
 		"id": "startRecording",
@@ -231,6 +278,127 @@ func TestStartRecordingFailureDoesNotPublishStopEvent(t *testing.T) {
 	}
 }
 
+func TestStartRecordingPathTemplate(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{
+		Recorder: config.Recorder{
+			Directory:    dir,
+			DirFileMode:  "0750",
+			FileMode:     "0640",
+			PathTemplate: "{session}/{date}/{fileName}",
+		},
+	}
+	ps := &mockPubSub{publishChan: make(chan []byte, 10)}
+	server := NewServer(cfg, ps)
+	sessionID := "test-path-template"
+	start := time.Now()
+
+	server.HandlePubSubEvent(context.Background(), &events.Event{
+		Id: events.StartRecordingKey,
+		Data: &events.StartRecording{
+			Id:        events.StartRecordingKey,
+			SessionId: sessionID,
+			FileName:  "test.webm",
+			Adapter:   events.AdapterRTP,
+			AdapterOptions: &events.AdapterOptions{
+				RTP: &events.RTPConfig{
+					ListenAddress: "127.0.0.1:0",
+					Tracks:        []events.RTPTrackConfig{{ID: "audio", PayloadType: 111, MimeType: "audio/opus"}},
+				},
+			},
+		},
+	})
+
+	select {
+	case responseBytes := <-ps.publishChan:
+		var response events.StartRecordingResponse
+		assert.NoError(t, json.Unmarshal(responseBytes, &response))
+		assert.Equal(t, "ok", response.Status)
+
+		recordingDir := filepath.Join(dir, sessionID, start.UTC().Format("2006-01-02"))
+		assert.Equal(t, filepath.Join(recordingDir, "test.webm"), *response.FileName)
+
+		info, err := os.Stat(recordingDir)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+	case <-time.After(1 * time.Second):
+		t.Fatal("Did not receive a response from the server")
+	}
+
+	assert.NoError(t, server.Close())
+}
+
+func TestSessionWebhook(t *testing.T) {
+	received := make(chan webhook.Event, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		if sig := r.Header.Get(webhook.SignatureHeader); sig != webhook.Sign("override", r.Header.Get(webhook.TimestampHeader), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var event webhook.Event
+		json.Unmarshal(body, &event)
+		received <- event
+	}))
+	defer receiver.Close()
+
+	cfg := &config.Config{
+		Recorder: config.Recorder{Directory: t.TempDir(), DirFileMode: "0700", FileMode: "0600"},
+		// Disabled, the recording enables it with its URL
+		Webhook: config.Webhook{Secret: "configured", Retry: config.WebhookRetry{MaxAttempts: 1}},
+	}
+	ps := &mockPubSub{publishChan: make(chan []byte, 10)}
+	server := NewServer(cfg, ps)
+	sessionID := "test-webhook"
+
+	server.HandlePubSubEvent(context.Background(), &events.Event{
+		Id: events.StartRecordingKey,
+		Data: &events.StartRecording{
+			Id:        events.StartRecordingKey,
+			SessionId: sessionID,
+			FileName:  "test.webm",
+			Adapter:   events.AdapterRTP,
+			AdapterOptions: &events.AdapterOptions{
+				RTP: &events.RTPConfig{
+					ListenAddress: "127.0.0.1:0",
+					Tracks:        []events.RTPTrackConfig{{ID: "audio", PayloadType: 111, MimeType: "audio/opus"}},
+				},
+			},
+			Metadata: map[string]any{"meeting": "m1"},
+			Webhook:  &events.WebhookOptions{URL: receiver.URL, Secret: "override"},
+		},
+	})
+
+	select {
+	case event := <-received:
+		assert.Equal(t, webhook.EventRecordingStarted, event.Event)
+		assert.Equal(t, sessionID, event.SessionId)
+		assert.Equal(t, filepath.Join(cfg.Recorder.Directory, "test.webm"), event.FileName)
+		assert.Equal(t, "m1", event.Metadata["meeting"])
+	case <-time.After(2 * time.Second):
+		t.Fatal("Did not receive the started webhook")
+	}
+
+	server.HandlePubSubEvent(context.Background(), &events.Event{
+		Id:   events.StopRecordingKey,
+		Data: &events.StopRecording{Id: events.StopRecordingKey, SessionId: sessionID},
+	})
+
+	select {
+	case event := <-received:
+		assert.Equal(t, webhook.EventRecordingStopped, event.Event)
+		assert.Equal(t, events.StopReasonNormal, event.Reason)
+		assert.NotNil(t, event.Duration)
+		assert.NotNil(t, event.Stats)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Did not receive the stopped webhook")
+	}
+
+	assert.NoError(t, server.Close())
+}
+
 func TestGetRecordings(t *testing.T) {
 	testCases := []struct {
 		name       string
@@ -262,7 +430,7 @@ func TestGetRecordings(t *testing.T) {
 					recordingStartTimeHR:  time.Second * 10,
 					mediaHasFlowed:        true,
 				}
-				server.sessions.Store(sessionID1, sess1)
+				assert.NoError(t, server.sessions.add(sess1))
 				sessions[sessionID1] = sess1
 
 				// Mediasoup session
@@ -285,7 +453,7 @@ func TestGetRecordings(t *testing.T) {
 					recordingStartTimeHR:  time.Second * 20,
 					mediaHasFlowed:        true,
 				}
-				server.sessions.Store(sessionID2, sess2)
+				assert.NoError(t, server.sessions.add(sess2))
 				sessions[sessionID2] = sess2
 
 				// Session without media flow
@@ -306,7 +474,7 @@ func TestGetRecordings(t *testing.T) {
 					metadata:       startEvent3.Metadata,
 					mediaHasFlowed: false,
 				}
-				server.sessions.Store(sessionID3, sess3)
+				assert.NoError(t, server.sessions.add(sess3))
 				sessions[sessionID3] = sess3
 
 				// Session with no metadata
@@ -327,7 +495,7 @@ func TestGetRecordings(t *testing.T) {
 					metadata:       startEvent4.Metadata,
 					mediaHasFlowed: false,
 				}
-				server.sessions.Store(sessionID4, sess4)
+				assert.NoError(t, server.sessions.add(sess4))
 				sessions[sessionID4] = sess4
 
 				return sessions
@@ -431,3 +599,299 @@ func TestGetRecordings(t *testing.T) {
 		})
 	}
 }
+
+func TestServerCloseWaitsForSessions(t *testing.T) {
+	cfg := &config.Config{Shutdown: config.Shutdown{DrainTimeout: time.Second}}
+	ps := &mockPubSub{publishChan: make(chan []byte, 10)}
+	server := NewServer(cfg, ps)
+	lk := &mockLiveKitWebRTC{closed: make(chan struct{})}
+	sess := NewSession("test-drain", server, nil, lk, &mockRecorder{})
+
+	assert.NoError(t, server.addSession(sess))
+	assert.NoError(t, server.Close())
+
+	select {
+	case <-lk.closed:
+	default:
+		t.Fatal("Session should be closed once Close returns")
+	}
+
+	_, ok := server.sessions.Get("test-drain")
+	assert.False(t, ok)
+	assert.ErrorIs(t, server.addSession(NewSession("test-late", server, nil, lk, &mockRecorder{})), errShuttingDown,
+		"No sessions should start once shutting down")
+}
+
+func TestServerCloseDrainTimeout(t *testing.T) {
+	cfg := &config.Config{Shutdown: config.Shutdown{DrainTimeout: 50 * time.Millisecond}}
+	ps := &mockPubSub{publishChan: make(chan []byte, 10)}
+	server := NewServer(cfg, ps)
+	rec := &mockRecorder{}
+	lk := &stuckLiveKitWebRTC{
+		mockLiveKitWebRTC: mockLiveKitWebRTC{closed: make(chan struct{})},
+		release:           make(chan struct{}),
+	}
+	sess := NewSession("test-drain-timeout", server, nil, lk, rec)
+
+	assert.NoError(t, server.addSession(sess))
+
+	start := time.Now()
+	err := server.Close()
+
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.True(t, rec.closed.Load(), "Sessions that didn't stop in time should have their recording flushed")
+
+	close(lk.release)
+	server.shutdownWg.Wait()
+}
+
+func TestRecordingTags(t *testing.T) {
+	assert.Equal(t, map[string]string{recorder.TagSessionID: "s1"},
+		recordingTags(&events.StartRecording{SessionId: "s1"}))
+
+	assert.Equal(t, map[string]string{
+		recorder.TagSessionID: "s1",
+		recorder.TagRoomID:    "room",
+		recorder.TagTitle:     "Class 1",
+	}, recordingTags(&events.StartRecording{
+		SessionId:      "s1",
+		AdapterOptions: &events.AdapterOptions{LiveKit: &events.LiveKitConfig{Room: "room"}},
+		Tags:           map[string]string{recorder.TagTitle: "Class 1"},
+	}))
+
+	assert.Equal(t, "custom", recordingTags(&events.StartRecording{
+		SessionId: "s1",
+		Tags:      map[string]string{recorder.TagSessionID: "custom"},
+	})[recorder.TagSessionID], "Requested tags win")
+}
+
+func TestSessionCancel(t *testing.T) {
+	dir := t.TempDir()
+	recPath := filepath.Join(dir, "rec.webm")
+	require.NoError(t, os.WriteFile(recPath, []byte("media"), 0600))
+
+	cfg := &config.Config{}
+	cfg.Recorder.WriteSidecarFile = true
+	cfg.Recorder.WriteStatsFile = true
+	cfg.Recorder.Directory = dir
+	cfg.Recorder.FileMode = "0600"
+	ps := &mockPubSub{publishChan: make(chan []byte, 10)}
+	server := NewServer(cfg, ps)
+	lk := &statsLiveKitWebRTC{mockLiveKitWebRTC{closed: make(chan struct{})}}
+	rec := &mockRecorder{path: recPath}
+	sess := NewSession("test-cancel", server, (*webrtc.WebRTC)(nil), lk, rec)
+	sess.startedSuccessfully = true
+
+	// A stop already queued is overridden
+	require.NoError(t, sess.CancelRecording(&events.CancelRecording{Id: events.CancelRecordingKey, SessionId: "test-cancel"}, time.Time{}))
+	sess.handleStopRecording(stopRecordingCommand{reason: events.StopReasonNormal})
+
+	assert.NoFileExists(t, recPath)
+	assert.NoFileExists(t, sidecarPath(recPath))
+	assert.NoFileExists(t, appstats.StatsFilePath(recPath))
+
+	var stopped events.RecordingStopped
+	require.NoError(t, json.Unmarshal(<-ps.publishChan, &stopped))
+	assert.Equal(t, events.StopReasonCanceled, stopped.Reason)
+}
+
+// fakeUploadBackend is an S3 endpoint whose PUTs wait for release, if set:
+// those of blocked, all of them if empty
+type fakeUploadBackend struct {
+	sync.Mutex
+	objects map[string]int
+	release chan struct{}
+	blocked string
+	puts    chan string
+}
+
+func (f *fakeUploadBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.puts <- r.URL.Path
+
+		if f.release != nil && (f.blocked == "" || r.URL.Path == f.blocked) {
+			select {
+			case <-f.release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		f.Lock()
+		f.objects[r.URL.Path] = len(data)
+		f.Unlock()
+	case http.MethodHead:
+		f.Lock()
+		size, ok := f.objects[r.URL.Path]
+		f.Unlock()
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+	case http.MethodDelete:
+		f.Lock()
+		delete(f.objects, r.URL.Path)
+		f.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newUploadTestSession(t *testing.T, backend *fakeUploadBackend) (*Server, *Session, *mockPubSub, string) {
+	server, ps := newUploadTestServer(t, backend, "")
+	recPath := filepath.Join(server.cfg.Recorder.Directory, "rec.webm")
+	sess := addUploadTestSession(t, server, "test-upload", recPath)
+
+	return server, sess, ps, recPath
+}
+
+// newUploadTestServer returns a server uploading to backend the recordings
+// laid out by pathTemplate, if any
+func newUploadTestServer(t *testing.T, backend *fakeUploadBackend, pathTemplate string) (*Server, *mockPubSub) {
+	srv := httptest.NewServer(backend)
+	t.Cleanup(srv.Close)
+
+	cfg := &config.Config{}
+	cfg.Recorder.Directory = t.TempDir()
+	cfg.Recorder.PathTemplate = pathTemplate
+	cfg.Recorder.WriteSidecarFile = true
+	cfg.Recorder.FileMode = "0600"
+	cfg.Upload = config.Upload{
+		Enable:  true,
+		Backend: "s3",
+		Timeout: 5 * time.Second,
+		Backends: map[string]interface{}{
+			"s3": map[string]interface{}{
+				"endpoint":        srv.URL,
+				"bucket":          "recordings",
+				"accessKeyId":     "key",
+				"secretAccessKey": "secret",
+				"forcePathStyle":  true,
+			},
+		},
+	}
+	ps := &mockPubSub{publishChan: make(chan []byte, 10)}
+
+	return NewServer(cfg, ps), ps
+}
+
+// addUploadTestSession adds a started session of server recording to
+// recPath, some media already written
+func addUploadTestSession(t *testing.T, server *Server, id, recPath string) *Session {
+	require.NoError(t, os.MkdirAll(filepath.Dir(recPath), 0700))
+	require.NoError(t, os.WriteFile(recPath, []byte("media"), 0600))
+
+	lk := &mockLiveKitWebRTC{closed: make(chan struct{})}
+	sess := NewSession(id, server, (*webrtc.WebRTC)(nil), lk, &mockRecorder{path: recPath})
+	sess.startedSuccessfully = true
+	require.NoError(t, server.sessions.add(sess))
+
+	return sess
+}
+
+func TestSessionUpload(t *testing.T) {
+	backend := &fakeUploadBackend{objects: map[string]int{}, puts: make(chan string, 10)}
+	_, sess, ps, recPath := newUploadTestSession(t, backend)
+
+	sess.handleStopRecording(stopRecordingCommand{reason: events.StopReasonNormal})
+
+	var stopped events.RecordingStopped
+	require.NoError(t, json.Unmarshal(<-ps.publishChan, &stopped))
+	assert.Equal(t, events.RecordingStoppedKey, stopped.Id)
+
+	var uploaded events.RecordingUploaded
+	require.NoError(t, json.Unmarshal(<-ps.publishChan, &uploaded))
+	assert.Equal(t, events.RecordingUploadedKey, uploaded.Id)
+	assert.Equal(t, []string{recPath, sidecarPath(recPath)}, uploaded.Files)
+	assert.Empty(t, uploaded.UploadError)
+	assert.False(t, uploaded.Canceled)
+	assert.Equal(t, 5, backend.objects["/recordings/rec.webm"])
+}
+
+func TestSessionUpload_PathTemplate(t *testing.T) {
+	backend := &fakeUploadBackend{objects: map[string]int{}, puts: make(chan string, 10)}
+	server, ps := newUploadTestServer(t, backend, "{session}/{fileName}")
+
+	for _, id := range []string{"session-1", "session-2"} {
+		path := server.recordingPath(&events.StartRecording{SessionId: id, FileName: "audio.webm"}, time.Now())
+		sess := addUploadTestSession(t, server, id, filepath.Join(server.cfg.Recorder.Directory, path))
+		sess.handleStopRecording(stopRecordingCommand{reason: events.StopReasonNormal})
+
+		// recordingStopped, then recordingUploaded
+		<-ps.publishChan
+		<-ps.publishChan
+	}
+
+	// Sharing a base name, in their own directories
+	assert.ElementsMatch(t, []string{
+		"/recordings/session-1/audio.webm",
+		"/recordings/session-1/audio-sidecar.json",
+		"/recordings/session-2/audio.webm",
+		"/recordings/session-2/audio-sidecar.json",
+	}, slices.Collect(maps.Keys(backend.objects)))
+}
+
+func TestSessionUpload_AfterStopped(t *testing.T) {
+	backend := &fakeUploadBackend{objects: map[string]int{}, puts: make(chan string, 10), release: make(chan struct{})}
+	server, sess, ps, recPath := newUploadTestSession(t, backend)
+
+	go sess.handleStopRecording(stopRecordingCommand{reason: events.StopReasonNormal})
+
+	// Published while the upload is under way
+	var stopped events.RecordingStopped
+	require.NoError(t, json.Unmarshal(<-ps.publishChan, &stopped))
+	assert.Equal(t, events.StopReasonNormal, stopped.Reason)
+	<-backend.puts
+	<-sess.Done()
+
+	_, active := server.sessions.Get(sess.id)
+	assert.False(t, active)
+	_, uploading := server.sessions.Uploading(sess.id)
+	assert.True(t, uploading, "Stopped sessions can be canceled while uploading")
+
+	server.HandlePubSubEvent(context.Background(), &events.Event{
+		Id:   events.CancelRecordingKey,
+		Data: &events.CancelRecording{Id: events.CancelRecordingKey, SessionId: sess.id},
+	})
+
+	var uploaded events.RecordingUploaded
+	require.NoError(t, json.Unmarshal(<-ps.publishChan, &uploaded))
+	assert.True(t, uploaded.Canceled)
+	assert.Empty(t, uploaded.Files)
+	assert.NoFileExists(t, recPath)
+
+	_, uploading = server.sessions.Uploading(sess.id)
+	assert.False(t, uploading)
+}
+
+func TestSessionUpload_CanceledPartway(t *testing.T) {
+	backend := &fakeUploadBackend{
+		objects: map[string]int{},
+		puts:    make(chan string, 10),
+		release: make(chan struct{}),
+		blocked: "/recordings/rec-sidecar.json",
+	}
+	_, sess, ps, recPath := newUploadTestSession(t, backend)
+
+	go sess.handleStopRecording(stopRecordingCommand{reason: events.StopReasonNormal})
+
+	<-ps.publishChan
+	<-backend.puts
+	<-backend.puts
+	sess.cancelUpload()
+
+	var uploaded events.RecordingUploaded
+	require.NoError(t, json.Unmarshal(<-ps.publishChan, &uploaded))
+	assert.True(t, uploaded.Canceled)
+
+	backend.Lock()
+	assert.Empty(t, backend.objects, "What was uploaded before is deleted")
+	backend.Unlock()
+	assert.NoFileExists(t, recPath)
+	assert.NoFileExists(t, sidecarPath(recPath))
+}
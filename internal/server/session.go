@@ -1,16 +1,26 @@
 package server
 
 import (
+	"context"
 	"errors"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/AlekSi/pointer"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/logging"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/upload"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webhook"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/interfaces"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
@@ -20,6 +30,12 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// What the upload of a stopped recording is aborted with
+var (
+	errRecordingCanceled = errors.New("recording canceled")
+	errDrainTimeout      = errors.New("shutdown drain timed out")
+)
+
 func isInterfaceNil(i interface{}) bool {
 	if i == nil {
 		return true
@@ -41,17 +57,28 @@ type stopRecordingCommand struct {
 }
 
 type Session struct {
-	id                  string
-	server              *Server
-	cfg                 *config.Config
-	webrtc              *webrtc.WebRTC
-	livekit             interfaces.LiveKitWebRTCInterface
-	recorder            recorder.Recorder
-	stopped             bool
-	stoppedOnce         sync.Once
-	commands            chan interface{}
+	id          string
+	server      *Server
+	cfg         *config.Config
+	webrtc      *webrtc.WebRTC
+	livekit     interfaces.LiveKitWebRTCInterface
+	recorder    recorder.Recorder
+	uploader    *upload.Uploader // Nil if uploads are disabled
+	stopped     bool
+	stoppedOnce sync.Once
+	// Set once the recording is canceled, which may be while it's stopping
+	canceled atomic.Bool
+	commands chan interface{}
+	// Closed once the session stopped
+	done                chan struct{}
 	statsWriter         *appstats.StatsFileWriter
+	sidecarWriter       *sidecarWriter
+	fileMode            os.FileMode
+	recoveryMarker      string
 	startedSuccessfully bool
+	diskGuard           *diskGuard
+	watchdog            *mediaWatchdog
+	quotaGuard          *quotaGuard
 
 	mu                    sync.Mutex
 	startEvent            *events.StartRecording
@@ -59,6 +86,9 @@ type Session struct {
 	recordingStartTimeHR  time.Duration
 	mediaHasFlowed        bool
 	metadata              map[string]any
+	webhook               *webhook.Notifier
+	// Aborts the upload of the stopped recording, once it started
+	uploadCancel context.CancelCauseFunc
 }
 
 func NewSession(
@@ -74,11 +104,13 @@ func NewSession(
 		webrtc:   wrtc,
 		livekit:  lk,
 		recorder: recorder,
+		uploader: s.uploader,
 		cfg:      s.cfg,
 		commands: make(chan interface{}, 10),
+		done:     make(chan struct{}),
 	}
 
-	if s.cfg.Recorder.WriteStatsFile {
+	if s.cfg.Recorder.WriteStatsFile || s.cfg.Recorder.WriteSidecarFile || s.cfg.Recorder.Recovery.Enable {
 		var fileMode os.FileMode
 
 		if parsedFileMode, err := strconv.ParseUint(s.cfg.Recorder.FileMode, 0, 32); err == nil {
@@ -89,7 +121,19 @@ func NewSession(
 			fileMode = 0600
 		}
 
-		sess.statsWriter = appstats.NewStatsFileWriter(s.cfg.Recorder.Directory, fileMode)
+		sess.fileMode = fileMode
+
+		if s.cfg.Recorder.WriteStatsFile {
+			sess.statsWriter = appstats.NewStatsFileWriter(s.cfg.Recorder.Directory, fileMode)
+		}
+
+		if s.cfg.Recorder.WriteSidecarFile {
+			sess.sidecarWriter = &sidecarWriter{fileMode: fileMode}
+
+			if enc := s.cfg.Recorder.Encryption; enc.Enable && enc.Sidecar {
+				sess.sidecarWriter.encryption = &enc
+			}
+		}
 	}
 
 	return sess
@@ -137,6 +181,67 @@ func (s *Session) StopRecording(e *events.StopRecording, reason string, startTim
 	}
 }
 
+// CancelRecording aborts the recording and deletes its files, running or
+// stopping: the recorder is canceled right away, then the
+// session stops as usual, with reason canceled, but without a sidecar or
+// upload. Whatever was already written or uploaded of it is removed.
+func (s *Session) CancelRecording(e *events.CancelRecording, startTime time.Time) error {
+	s.cancelRecorder()
+
+	return s.StopRecording(&events.StopRecording{Id: e.Id, SessionId: e.SessionId}, events.StopReasonCanceled, startTime)
+}
+
+// cancelUpload cancels the recording of a stopped session while it uploads
+func (s *Session) cancelUpload() {
+	s.cancelRecorder()
+	s.abortUpload(errRecordingCanceled)
+}
+
+// cancelRecorder marks the recording canceled and has its recorder delete
+// what it wrote
+func (s *Session) cancelRecorder() {
+	s.canceled.Store(true)
+
+	if canceler, ok := s.recorder.(interface{ Cancel() time.Duration }); ok {
+		canceler.Cancel()
+	}
+}
+
+// UpdateEncryptionKey sets a new key for the session's end-to-end encrypted
+// tracks
+func (s *Session) UpdateEncryptionKey(e *events.UpdateEncryptionKey) error {
+	if isInterfaceNil(s.livekit) {
+		return errors.New("encryption keys are only supported by the livekit adapter")
+	}
+
+	return s.livekit.SetEncryptionKey(e.Key, e.KeyIndex)
+}
+
+// AddChapter starts a chapter of the session's recording
+func (s *Session) AddChapter(e *events.AddChapter) error {
+	chapters, ok := s.recorder.(interface{ AddChapter(title string) error })
+
+	if !ok {
+		return errors.New("recorder doesn't support chapters")
+	}
+
+	return chapters.AddChapter(e.Title)
+}
+
+// SetTrackRecording enables or disables recording one of the session's
+// tracks, the others going on
+func (s *Session) SetTrackRecording(e *events.SetTrackRecording) error {
+	tracks, ok := s.livekit.(interface {
+		SetTrackRecording(trackID string, enabled bool) error
+	})
+
+	if !ok || isInterfaceNil(s.livekit) {
+		return errors.New("enabling and disabling tracks is only supported by the livekit adapter")
+	}
+
+	return tracks.SetTrackRecording(e.TrackId, e.Enabled)
+}
+
 func (s *Session) GetRecordingInfo() *events.RecordingInfo {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -149,7 +254,7 @@ func (s *Session) GetRecordingInfo() *events.RecordingInfo {
 		SessionId:      s.id,
 		FileName:       s.recorder.GetFilePath(),
 		Adapter:        s.startEvent.Adapter,
-		AdapterOptions: s.startEvent.AdapterOptions,
+		AdapterOptions: s.startEvent.AdapterOptions.Redacted(),
 		Metadata:       s.metadata,
 	}
 
@@ -163,6 +268,21 @@ func (s *Session) GetRecordingInfo() *events.RecordingInfo {
 	return info
 }
 
+// GetStats returns the live capture stats of LiveKit sessions, nil for
+// others
+func (s *Session) GetStats() *appstats.CaptureStats {
+	if isInterfaceNil(s.livekit) {
+		return nil
+	}
+
+	return s.livekit.GetStats()
+}
+
+// Done returns a channel closed once the session stopped
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
 func (s *Session) Run(wg *sync.WaitGroup) {
 	defer wg.Done()
 	appstats.Sessions.Inc()
@@ -196,8 +316,40 @@ func (s *Session) handleStartRecording(c startRecordingCommand) {
 	// Store the start event for GetRecordingInfo requests
 	s.startEvent = e
 	s.metadata = e.Metadata
+	s.webhook = webhook.NewNotifier(
+		context.WithValue(context.Background(), "session", s.id),
+		s.server.webhookConfig(e),
+	)
 	s.mu.Unlock()
 
+	if ids := e.TrackIDs(); len(ids) > 0 {
+		logging.SetSessionFields(s.id, log.Fields{"trackIds": ids})
+	}
+
+	if segmented, ok := s.recorder.(interface {
+		SetSegmentCallback(callback func(segment recorder.SegmentInfo))
+	}); ok {
+		segmented.SetSegmentCallback(func(segment recorder.SegmentInfo) {
+			s.notifyWebhook(webhook.Event{Event: webhook.EventRecordingSegment, Segment: &segment})
+		})
+	}
+
+	// Nothing more can be recorded once the recording can't be written
+	if failing, ok := s.recorder.(interface {
+		SetWriteFailureCallback(callback func(err error))
+	}); ok {
+		failing.SetWriteFailureCallback(func(err error) {
+			reason := events.StopReasonWriteFailed
+
+			if errors.Is(err, interfaces.ErrDiskFull) {
+				reason = events.StopReasonOutOfDisk
+			}
+
+			appstats.OnSessionError(reason)
+			s.StopRecording(nil, reason, time.Time{})
+		})
+	}
+
 	// webrtc is the mediasoup-based adapter
 	if s.webrtc != nil {
 		offer := pwebrtc.SessionDescription{}
@@ -228,6 +380,11 @@ func (s *Session) handleStartRecording(c startRecordingCommand) {
 
 		s.server.PublishPubSub(e.Success(signal.Encode(answer), s.recorder.GetFilePath(), s.metadata))
 		s.startedSuccessfully = true
+		s.writeRecoveryMarker()
+		s.notifyWebhook(webhook.Event{Event: webhook.EventRecordingStarted})
+		s.startDiskGuard()
+		s.startWatchdog()
+		s.startQuotaGuard()
 
 		return
 	}
@@ -238,6 +395,9 @@ func (s *Session) handleStartRecording(c startRecordingCommand) {
 				s.StopRecording(nil, state.String(), time.Time{})
 			}
 		})
+		s.livekit.SetStopCallback(func(reason string) {
+			s.StopRecording(nil, reason, time.Time{})
+		})
 		s.livekit.SetFlowCallback(func(isFlowing bool, timestamp time.Duration, closed bool) {
 			s.handleFirstMediaFlow(isFlowing, timestamp)
 
@@ -249,11 +409,22 @@ func (s *Session) handleStartRecording(c startRecordingCommand) {
 				s.StopRecording(nil, "closed", time.Time{})
 			}
 		})
+		s.livekit.SetFirstPacketCallback(func(event interfaces.MediaEvent) {
+			s.server.PublishPubSub(
+				events.NewRecordingFirstPacket(s.id, event.TrackID, event.Kind, event.Timestamp/time.Millisecond, event.RTPTimestamp),
+			)
+		})
+		s.livekit.SetFirstKeyframeCallback(func(event interfaces.MediaEvent) {
+			s.server.PublishPubSub(
+				events.NewRecordingFirstKeyframe(s.id, event.TrackID, event.Timestamp/time.Millisecond, event.MediaTimestamp/time.Millisecond),
+			)
+		})
 
 		if err := s.livekit.Init(); err != nil {
-			s.server.PublishPubSub(e.Fail(err))
-			appstats.OnSessionError("init_failed")
-			s.handleStopRecording(stopRecordingCommand{reason: "init_failed"})
+			reason := interfaces.ErrorReason(err, interfaces.CloseReasonInitFailed)
+			s.server.PublishPubSub(e.FailWithReason(err, reason))
+			appstats.OnSessionError(reason)
+			s.handleStopRecording(stopRecordingCommand{reason: reason})
 
 			return
 		}
@@ -261,6 +432,11 @@ func (s *Session) handleStartRecording(c startRecordingCommand) {
 		// For LiveKit, we don't need to return an SDP answer
 		s.server.PublishPubSub(e.Success("", s.recorder.GetFilePath(), s.metadata))
 		s.startedSuccessfully = true
+		s.writeRecoveryMarker()
+		s.notifyWebhook(webhook.Event{Event: webhook.EventRecordingStarted})
+		s.startDiskGuard()
+		s.startWatchdog()
+		s.startQuotaGuard()
 	}
 }
 
@@ -278,17 +454,29 @@ func (s *Session) handleStopRecording(c stopRecordingCommand) {
 		}()
 
 		s.stopped = true
+		s.diskGuard.close()
+		s.watchdog.close()
+		s.quotaGuard.close()
 		var duration time.Duration
+		var recorderStats *types.RecorderStats
+		var trackErrors map[string]string
+		var captureStats *appstats.CaptureStats
+		var closeReason string
 
 		if !isInterfaceNil(s.livekit) {
 			// Reset state callbacks to avoid any potential race conditions or duplicated events.
 			s.livekit.SetConnectionStateCallback(func(state utils.ConnectionState) {})
 			s.livekit.SetFlowCallback(func(isFlowing bool, timestamp time.Duration, closed bool) {})
+			s.livekit.SetStopCallback(func(reason string) {})
+			s.livekit.SetFirstPacketCallback(func(event interfaces.MediaEvent) {})
+			s.livekit.SetFirstKeyframeCallback(func(event interfaces.MediaEvent) {})
 			stats := s.livekit.GetStats()
+			captureStats = stats
 			appstats.UpdateCaptureMetrics(stats)
 
-			// Write detailed stats to file if enabled
-			if s.statsWriter != nil {
+			// Write detailed stats to file if enabled. Recordings streamed to
+			// a writer have no file to put them next to.
+			if s.statsWriter != nil && s.recorder.GetFilePath() != "" && !s.canceled.Load() {
 				fileStats := &appstats.StatsFileOutput{
 					CaptureStats:   stats,
 					StatsTimestamp: time.Now().Unix(),
@@ -299,7 +487,32 @@ func (s *Session) handleStopRecording(c stopRecordingCommand) {
 				}
 			}
 
-			duration = s.livekit.Close()
+			result := s.livekit.CloseWithResult()
+			duration = result.Duration
+			recorderStats = result.Stats
+			closeReason = result.Reason
+			logger := log.WithField("session", s.id).
+				WithField("reason", result.Reason).
+				WithField("duration", result.Duration)
+
+			if result.Err != nil {
+				logger.WithError(result.Err).Warn("LiveKit capture ended with an error")
+			} else {
+				logger.Info("LiveKit capture ended")
+			}
+
+			for trackID, err := range result.TrackErrors {
+				if trackErrors == nil {
+					trackErrors = make(map[string]string, len(result.TrackErrors))
+				}
+
+				trackErrors[trackID] = err.Error()
+				logger.WithField("trackID", trackID).WithError(err).Warn("Track not recorded")
+			}
+
+			for _, warning := range result.Warnings {
+				logger.Warn(warning)
+			}
 		}
 
 		if s.webrtc != nil {
@@ -307,13 +520,22 @@ func (s *Session) handleStopRecording(c stopRecordingCommand) {
 			s.webrtc.SetConnectionStateCallback(func(state utils.ConnectionState) {})
 			s.webrtc.SetFlowCallback(func(isFlowing bool, videoTimestamp time.Duration, closed bool) {})
 			duration = s.webrtc.Close()
+
+			if s.recorder != nil {
+				recorderStats = s.recorder.GetStats()
+			}
 		}
 
 		ts := duration / time.Millisecond
-		var response interface{}
+		var response *events.RecordingStopped
 
 		e := c.event
 		reason := c.reason
+		canceled := s.canceled.Load()
+
+		if canceled {
+			reason = events.StopReasonCanceled
+		}
 
 		if e != nil {
 			response = e.Stopped(reason, ts)
@@ -325,22 +547,385 @@ func (s *Session) handleStopRecording(c stopRecordingCommand) {
 			response = events.NewRecordingStopped(s.id, reason, ts)
 		}
 
+		response.TrackErrors = trackErrors
+		s.removeRecoveryMarker()
+		var sidecar, dataFile, proxyFile string
+
+		if captureStats != nil {
+			dataFile = captureStats.DataFile
+		}
+
+		if recorderStats != nil && recorderStats.Proxy != nil && recorderStats.Proxy.Error == "" {
+			proxyFile = recorderStats.Proxy.File
+		}
+
+		var uploads []string
+
+		if !canceled {
+			sidecar = s.writeSidecar(response, duration, recorderStats, captureStats, closeReason)
+			s.attachSidecar(sidecar)
+			uploads = s.uploadPaths(dataFile, proxyFile, sidecar)
+		}
+
+		// Cancel wins, even over a stop that was already under way
+		if s.canceled.Load() {
+			response.Reason = events.StopReasonCanceled
+			uploads = nil
+			s.discardRecording(nil, dataFile, proxyFile, sidecar)
+		}
+
 		if s.startedSuccessfully {
 			s.server.PublishPubSub(response)
+			s.notifyWebhook(webhook.Event{
+				Event:    webhook.EventRecordingStopped,
+				Reason:   response.Reason,
+				Duration: pointer.ToInt64(int64(ts)),
+				Stats:    recorderStats,
+			})
 		}
 
-		s.server.CloseSession(s.id)
+		var uploadCtx context.Context
+
+		// Still reached by cancelRecording while it uploads
+		if len(uploads) > 0 {
+			uploadCtx = s.startUpload()
+		}
+
+		s.server.sessions.remove(s)
 		close(s.commands)
+		close(s.done)
+
+		if uploadCtx != nil {
+			s.uploadRecording(uploadCtx, uploads, dataFile, proxyFile, sidecar)
+		}
+
+		logging.ClearSession(s.id)
+
+		// Pending deliveries hold off the shutdown, up to its drain timeout
+		s.mu.Lock()
+		notifier := s.webhook
+		s.mu.Unlock()
+		notifier.Close()
+	})
+}
+
+// startDiskGuard watches the free space of the filesystem the recording is
+// written to, stopping it before the volume fills
+func (s *Session) startDiskGuard() {
+	if !s.cfg.Recorder.DiskGuard.Enable || s.recorder == nil {
+		return
+	}
+
+	path := s.recorder.GetFilePath()
+
+	// Streamed to a writer, or discarded
+	if path == "" || path == os.DevNull {
+		return
+	}
+
+	s.diskGuard = newDiskGuard(s.cfg.Recorder.DiskGuard, filepath.Dir(path), func(free uint64) {
+		appstats.OnSessionError(events.StopReasonOutOfDisk)
+		s.StopRecording(nil, events.StopReasonOutOfDisk, time.Time{})
+	})
+	s.diskGuard.start(s.id)
+}
+
+// startWatchdog stops the recording once its media stops progressing, e.g.
+// when the publisher went away without the track ending
+func (s *Session) startWatchdog() {
+	if s.cfg.Recorder.StallTimeout <= 0 || s.recorder == nil {
+		return
+	}
+
+	s.watchdog = newMediaWatchdog(s.cfg.Recorder.StallTimeout, func() mediaProgress {
+		progress := mediaProgress{
+			audioTimestamp: s.recorder.AudioTimestamp(),
+			videoTimestamp: s.recorder.VideoTimestamp(),
+			packets:        s.recorder.ReceivedPackets(),
+		}
+
+		if m, ok := s.livekit.(interface{ Muted() bool }); ok && !isInterfaceNil(s.livekit) {
+			progress.muted = m.Muted()
+		}
+
+		return progress
+	}, func(idle time.Duration) {
+		appstats.OnSessionError(events.StopReasonNoMedia)
+		s.StopRecording(nil, events.StopReasonNoMedia, time.Time{})
+	})
+	s.watchdog.start(s.id)
+}
+
+// startQuotaGuard stops the recording once it takes up more than its
+// quota, in bytes written or media time
+func (s *Session) startQuotaGuard() {
+	quota := s.cfg.Recorder.Quota
+
+	if (quota.MaxBytes == 0 && quota.MaxDuration <= 0) || s.recorder == nil {
+		return
+	}
+
+	s.quotaGuard = newQuotaGuard(quota, func() quotaUsage {
+		return quotaUsage{
+			bytes:    s.recorder.FileStats().BytesWritten,
+			duration: max(s.recorder.VideoTimestamp(), s.recorder.AudioTimestamp()),
+		}
+	}, func(usage quotaUsage) {
+		appstats.OnSessionError(events.StopReasonQuotaExceeded)
+		s.StopRecording(nil, events.StopReasonQuotaExceeded, time.Time{})
+	})
+	s.quotaGuard.start(s.id)
+}
+
+// notifyWebhook queues a lifecycle event for the recording's webhook, if any
+func (s *Session) notifyWebhook(event webhook.Event) {
+	s.mu.Lock()
+	notifier := s.webhook
+	event.SessionId = s.id
+	event.Metadata = s.metadata
+	s.mu.Unlock()
+
+	if notifier == nil {
+		return
+	}
+
+	if s.recorder != nil {
+		event.FileName = s.recorder.GetFilePath()
+	}
+
+	notifier.Notify(event)
+}
+
+// flushRecording closes the recorder so its container is finalized even if
+// the session is stuck stopping. Closing it again is a no-op.
+func (s *Session) flushRecording() {
+	if s.recorder != nil {
+		s.recorder.Close()
+	}
+}
+
+// writeSidecar writes the sidecar file of a recording that just stopped, if
+// enabled. Returns its path, empty if none was written.
+func (s *Session) writeSidecar(
+	response *events.RecordingStopped,
+	duration time.Duration,
+	recorderStats *types.RecorderStats,
+	captureStats *appstats.CaptureStats,
+	closeReason string,
+) string {
+	if s.sidecarWriter == nil || !s.startedSuccessfully || s.recorder == nil {
+		return ""
+	}
+
+	// Recordings streamed to a writer have no file to put it next to
+	if path := s.recorder.GetFilePath(); path == "" || path == os.DevNull {
+		return ""
+	}
+
+	sidecar := s.newSidecar(response, duration, recorderStats, captureStats, closeReason)
+	path, err := s.sidecarWriter.write(s.recorder.GetFilePath(), sidecar)
+
+	if err != nil {
+		log.WithField("session", s.id).WithError(err).Error("Failed to write recording sidecar")
+		return ""
+	}
+
+	return path
+}
+
+// attachSidecar embeds the sidecar written at path in the MKV recording, if
+// enabled
+func (s *Session) attachSidecar(path string) {
+	if path == "" || !s.cfg.Recorder.MKV.AttachSidecar || filepath.Ext(s.recorder.GetFilePath()) != ".mkv" {
+		return
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err == nil {
+		err = recorder.AppendMatroskaAttachment(s.recorder.GetFilePath(), filepath.Base(path), "application/json", data)
+	}
+
+	if err != nil {
+		log.WithField("session", s.id).WithError(err).Error("Failed to attach the sidecar to the recording")
+	}
+}
+
+// discardRecording removes what's left of a canceled recording once its
+// recorder deleted what it wrote: the files written next to it and the
+// uploaded copies of those of its files that were uploaded
+func (s *Session) discardRecording(uploaded []string, companions ...string) {
+	if s.recorder == nil {
+		return
+	}
+
+	path := s.recorder.GetFilePath()
+
+	if path == "" || path == os.DevNull {
+		return
+	}
+
+	paths := s.recordingPaths(companions...)
+
+	if len(uploaded) > 0 {
+		ctx := context.WithValue(context.Background(), "session", s.id)
+
+		for _, path := range uploaded {
+			if err := s.uploader.Delete(ctx, path); err != nil {
+				log.WithField("session", s.id).WithError(err).Error("Failed to delete canceled recording upload")
+			}
+		}
+	}
+
+	if s.statsWriter != nil {
+		paths = append(paths, appstats.StatsFilePath(path))
+	}
+
+	if s.cfg.LiveKit.WriteRTPDump {
+		paths = append(paths, strings.TrimSuffix(path, filepath.Ext(path))+".rtp")
+	}
+
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.WithField("session", s.id).WithError(err).Warn("Failed to remove canceled recording file")
+		}
+	}
+
+	log.WithField("session", s.id).Info("Recording canceled, its files were removed")
+}
+
+// recordingPaths returns the recording's files: its segments then their
+// manifest if segmented, its file otherwise, then companions, those that
+// are set
+func (s *Session) recordingPaths(companions ...string) []string {
+	path := s.recorder.GetFilePath()
+	paths := []string{path}
+
+	if segmented, ok := s.recorder.(interface{ SegmentFiles() []string }); ok {
+		if files := segmented.SegmentFiles(); len(files) > 0 {
+			paths = append(files, path)
+		}
+	}
+
+	for _, companion := range companions {
+		if companion != "" {
+			paths = append(paths, companion)
+		}
+	}
+
+	return paths
+}
+
+// uploadPaths returns the files of the recording to upload (its segments,
+// then their manifest, if segmented) then the files written next to it
+// (e.g. its sidecar), those that are set. None if it isn't uploaded.
+func (s *Session) uploadPaths(companions ...string) []string {
+	if s.uploader == nil || !s.startedSuccessfully || s.recorder == nil {
+		return nil
+	}
+
+	path := s.recorder.GetFilePath()
+
+	if path == "" || path == os.DevNull {
+		return nil
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+
+	return s.recordingPaths(companions...)
+}
+
+// startUpload registers the stopped session as uploading its recording,
+// returning the context to upload it with
+func (s *Session) startUpload() context.Context {
+	ctx, cancel := context.WithCancelCause(context.WithValue(context.Background(), "session", s.id))
+
+	s.mu.Lock()
+	s.uploadCancel = cancel
+	s.mu.Unlock()
+
+	s.server.sessions.addUpload(s)
+
+	return ctx
+}
+
+// abortUpload stops uploading the recording, if it is, with cause
+func (s *Session) abortUpload(cause error) {
+	s.mu.Lock()
+	cancel := s.uploadCancel
+	s.mu.Unlock()
+
+	if cancel != nil {
+		cancel(cause)
+	}
+}
+
+// uploadRecording uploads paths, the files of the stopped recording, one
+// after the other, then publishes recordingUploaded. The files not uploaded
+// because one failed are left pending. Canceled meanwhile, the recording is
+// discarded, uploads included, as it would have been while running.
+func (s *Session) uploadRecording(ctx context.Context, paths []string, companions ...string) {
+	defer s.server.sessions.removeUpload(s)
+
+	response := events.NewRecordingUploaded(s.id, make([]string, 0, len(paths)))
+	// Uploaded or being uploaded, to delete if canceled
+	tried := 0
+
+	for i, path := range paths {
+		if s.canceled.Load() {
+			break
+		}
+
+		tried++
+
+		if err := s.uploader.Upload(ctx, path); err != nil {
+			if s.canceled.Load() {
+				break
+			}
+
+			log.WithField("session", s.id).WithError(err).Error("Failed to upload recording")
+			appstats.OnSessionError("upload_failed")
+			// Left for a later sweep, along with the files not tried
+			s.uploader.MarkPending(ctx, paths[i:], err)
+			response.UploadError = err.Error()
+
+			break
+		}
+
+		response.Files = append(response.Files, path)
+	}
+
+	if s.canceled.Load() {
+		response.Canceled = true
+		response.Files = []string{}
+		response.UploadError = ""
+		s.discardRecording(paths[:tried], companions...)
+	}
+
+	s.server.PublishPubSub(response)
+	s.notifyWebhook(webhook.Event{
+		Event:       webhook.EventRecordingUploaded,
+		Files:       response.Files,
+		UploadError: response.UploadError,
+		Canceled:    response.Canceled,
 	})
 }
 
 func (s *Session) handleFirstMediaFlow(isFlowing bool, timestamp time.Duration) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	first := isFlowing && !s.mediaHasFlowed
 
-	if isFlowing && !s.mediaHasFlowed {
+	if first {
 		s.mediaHasFlowed = true
 		s.recordingStartTimeUTC = time.Now().UTC()
 		s.recordingStartTimeHR = timestamp
 	}
+
+	s.mu.Unlock()
+
+	if first {
+		s.notifyWebhook(webhook.Event{Event: webhook.EventRecordingFirstMedia})
+	}
 }
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/encryption"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Sidecar is the machine-readable summary of a finalized recording, written
+// next to it so tools don't have to parse the media
+type Sidecar struct {
+	SessionId string             `json:"recordingSessionId"`
+	FileName  string             `json:"fileName"`
+	Adapter   events.AdapterType `json:"adapter,omitempty"`
+	// Start is when media first flowed, nil if it never did
+	StartTimeUTC *time.Time `json:"startTimeUTC,omitempty"`
+	StopTimeUTC  time.Time  `json:"stopTimeUTC"`
+	DurationMs   int64      `json:"durationMs"`
+	// StopReason is the reason reported in recordingStopped, CloseReason
+	// why the capture ended (LiveKit and RTP adapters only)
+	StopReason  string `json:"stopReason"`
+	CloseReason string `json:"closeReason,omitempty"`
+	// Codecs recorded, by kind ("audio", "video")
+	Codecs      map[string]string                      `json:"codecs,omitempty"`
+	Recorder    *types.RecorderStats                   `json:"recorder,omitempty"`
+	Tracks      map[string]*appstats.AdapterTrackStats `json:"tracks,omitempty"`
+	TrackErrors map[string]string                      `json:"trackErrors,omitempty"`
+	Metadata    map[string]any                         `json:"metadata,omitempty"`
+	// Video tracks switched to when following the dominant speaker
+	SpeakerSwitches []appstats.SpeakerSwitch `json:"speakerSwitches,omitempty"`
+	// Data messages captured (see config.DataCapture)
+	DataFile     string `json:"dataFile,omitempty"`
+	DataMessages int    `json:"dataMessages,omitempty"`
+}
+
+type sidecarWriter struct {
+	fileMode os.FileMode
+	// Encrypts the sidecars if set (see config.Encryption)
+	encryption *config.Encryption
+}
+
+// sidecarPath is where the sidecar of a recording goes, e.g.
+// recording-sidecar.json for recording.webm
+func sidecarPath(recordingPath string) string {
+	return fmt.Sprintf("%s-sidecar.json", strings.TrimSuffix(recordingPath, filepath.Ext(recordingPath)))
+}
+
+// write replaces the sidecar of a recording, so readers never see a partial
+// one. Returns its path.
+func (w *sidecarWriter) write(recordingPath string, sidecar *Sidecar) (string, error) {
+	data, err := json.MarshalIndent(sidecar, "", "  ")
+
+	if err != nil {
+		return "", fmt.Errorf("JSON marshalling failed: %w", err)
+	}
+
+	if w.encryption != nil {
+		key, err := encryption.Load(*w.encryption)
+
+		if err == nil {
+			data, err = encryption.Encrypt(data, key)
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("failed to encrypt sidecar file: %w", err)
+		}
+	}
+
+	path := sidecarPath(recordingPath)
+	tmp := path + ".tmp"
+
+	if err := os.WriteFile(tmp, data, w.fileMode); err != nil {
+		return "", fmt.Errorf("failed to write sidecar file: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to write sidecar file: %w", err)
+	}
+
+	log.WithField("path", path).Trace("Wrote recording sidecar file")
+
+	return path, nil
+}
+
+// newSidecar summarizes a recording that just stopped
+func (s *Session) newSidecar(
+	response *events.RecordingStopped,
+	duration time.Duration,
+	recorderStats *types.RecorderStats,
+	captureStats *appstats.CaptureStats,
+	closeReason string,
+) *Sidecar {
+	sidecar := &Sidecar{
+		SessionId:   s.id,
+		FileName:    s.recorder.GetFilePath(),
+		StopTimeUTC: response.TimestampUTC,
+		DurationMs:  duration.Milliseconds(),
+		StopReason:  response.Reason,
+		CloseReason: closeReason,
+		Recorder:    recorderStats,
+		TrackErrors: response.TrackErrors,
+	}
+
+	s.mu.Lock()
+	if s.startEvent != nil {
+		sidecar.Adapter = s.startEvent.Adapter
+	}
+
+	if s.mediaHasFlowed {
+		start := s.recordingStartTimeUTC
+		sidecar.StartTimeUTC = &start
+	}
+
+	sidecar.Metadata = s.metadata
+	s.mu.Unlock()
+
+	if recorderStats != nil {
+		sidecar.Codecs = make(map[string]string)
+
+		if recorderStats.Audio != nil && recorderStats.Audio.Codec != "" {
+			sidecar.Codecs["audio"] = recorderStats.Audio.Codec
+		}
+
+		if recorderStats.Video != nil && recorderStats.Video.Codec != "" {
+			sidecar.Codecs["video"] = recorderStats.Video.Codec
+		}
+	}
+
+	if captureStats != nil {
+		sidecar.Tracks = make(map[string]*appstats.AdapterTrackStats, len(captureStats.Tracks))
+
+		for trackID, track := range captureStats.Tracks {
+			if track.Adapter != nil {
+				sidecar.Tracks[trackID] = track.Adapter
+			}
+		}
+
+		sidecar.SpeakerSwitches = captureStats.SpeakerSwitches
+		sidecar.DataFile = captureStats.DataFile
+		sidecar.DataMessages = captureStats.DataMessages
+	}
+
+	return sidecar
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/encryption"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSidecarPath(t *testing.T) {
+	assert.Equal(t, "/rec/abc-sidecar.json", sidecarPath("/rec/abc.webm"))
+	assert.Equal(t, "/rec/abc-sidecar.json", sidecarPath("/rec/abc"))
+}
+
+func TestSessionStop_WritesSidecar(t *testing.T) {
+	recPath := filepath.Join(t.TempDir(), "rec.webm")
+	require.NoError(t, os.WriteFile(recPath, []byte("media"), 0600))
+
+	cfg := &config.Config{}
+	cfg.Recorder.WriteSidecarFile = true
+	cfg.Recorder.FileMode = "0640"
+	server := NewServer(cfg, &mockPubSub{publishChan: make(chan []byte, 10)})
+	lk := &statsLiveKitWebRTC{mockLiveKitWebRTC{closed: make(chan struct{})}}
+	sess := NewSession("test-sidecar", server, (*webrtc.WebRTC)(nil), lk, &mockRecorder{path: recPath})
+	sess.startedSuccessfully = true
+	sess.startEvent = &events.StartRecording{Adapter: events.AdapterLiveKit}
+	sess.metadata = map[string]any{"meetingId": "m1"}
+	sess.mediaHasFlowed = true
+	sess.recordingStartTimeUTC = time.Now().UTC().Add(-time.Minute)
+
+	sess.handleStopRecording(stopRecordingCommand{reason: events.StopReasonNormal})
+
+	path := filepath.Join(filepath.Dir(recPath), "rec-sidecar.json")
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err), "Temp file renamed")
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var sidecar Sidecar
+	require.NoError(t, json.Unmarshal(data, &sidecar))
+	assert.Equal(t, "test-sidecar", sidecar.SessionId)
+	assert.Equal(t, recPath, sidecar.FileName)
+	assert.Equal(t, events.AdapterLiveKit, sidecar.Adapter)
+	assert.Equal(t, events.StopReasonNormal, sidecar.StopReason)
+	assert.Equal(t, "stopped", sidecar.CloseReason)
+	require.NotNil(t, sidecar.StartTimeUTC)
+	assert.True(t, sidecar.StartTimeUTC.Before(sidecar.StopTimeUTC))
+	require.Contains(t, sidecar.Tracks, "track1")
+	assert.Equal(t, 2, sidecar.Tracks["track1"].PLIRequests)
+	assert.Equal(t, "m1", sidecar.Metadata["meetingId"])
+}
+
+func TestSessionStop_SidecarDisabled(t *testing.T) {
+	recPath := filepath.Join(t.TempDir(), "rec.webm")
+	server := NewServer(&config.Config{}, &mockPubSub{publishChan: make(chan []byte, 10)})
+	lk := &statsLiveKitWebRTC{mockLiveKitWebRTC{closed: make(chan struct{})}}
+	sess := NewSession("test-no-sidecar", server, (*webrtc.WebRTC)(nil), lk, &mockRecorder{path: recPath})
+	sess.startedSuccessfully = true
+
+	sess.handleStopRecording(stopRecordingCommand{reason: events.StopReasonNormal})
+
+	_, err := os.Stat(sidecarPath(recPath))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSidecarWriter_Encryption(t *testing.T) {
+	recPath := filepath.Join(t.TempDir(), "rec.webm")
+	enc := config.Encryption{Enable: true, Sidecar: true, Key: strings.Repeat("42", 32), KeyID: "k1"}
+	path, err := (&sidecarWriter{fileMode: 0600, encryption: &enc}).write(recPath, &Sidecar{SessionId: "s1"})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.True(t, encryption.IsEncrypted(data))
+
+	key, err := encryption.Load(enc)
+	require.NoError(t, err)
+
+	var plain bytes.Buffer
+	require.NoError(t, encryption.Decrypt(&plain, bytes.NewReader(data), key))
+
+	var sidecar Sidecar
+	require.NoError(t, json.Unmarshal(plain.Bytes(), &sidecar))
+	assert.Equal(t, "s1", sidecar.SessionId)
+
+	// Not written in plaintext when the key can't be loaded
+	enc.Key = ""
+	_, err = (&sidecarWriter{fileMode: 0600, encryption: &enc}).write(recPath, &Sidecar{SessionId: "s2"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	log "github.com/sirupsen/logrus"
+)
+
+// mediaProgress is what a stalled recording stops advancing
+type mediaProgress struct {
+	audioTimestamp time.Duration
+	videoTimestamp time.Duration
+	// Packets received: tells silent (or keyframe-less) periods, when the
+	// timestamps don't move, from media not arriving at all
+	packets uint64
+	// Every track is muted at the source, so nothing is expected to arrive
+	muted bool
+}
+
+// mediaWatchdog periodically probes a recording's media progress, calling
+// onStall once it hasn't changed for timeout
+type mediaWatchdog struct {
+	timeout time.Duration
+	probe   func() mediaProgress
+	onStall func(idle time.Duration)
+	clock   clock.Clock
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func newMediaWatchdog(timeout time.Duration, probe func() mediaProgress, onStall func(idle time.Duration)) *mediaWatchdog {
+	return &mediaWatchdog{
+		timeout: timeout,
+		probe:   probe,
+		onStall: onStall,
+		clock:   clock.Real,
+		stop:    make(chan struct{}),
+	}
+}
+
+// start probes every quarter of the timeout, so a stall is caught at most
+// that late
+func (g *mediaWatchdog) start(sessionId string) {
+	ticker := g.clock.NewTicker(g.timeout / 4)
+	last := g.probe()
+	lastChange := g.clock.Now()
+	g.wg.Add(1)
+
+	go func() {
+		defer g.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-g.stop:
+				return
+			case now := <-ticker.C():
+				if progress := g.probe(); progress != last || progress.muted {
+					last = progress
+					lastChange = now
+					continue
+				}
+
+				if idle := now.Sub(lastChange); idle >= g.timeout {
+					log.WithField("session", sessionId).
+						Errorf("No media progress for %v (audio %v, video %v, %d packets), stopping recording",
+							idle, last.audioTimestamp, last.videoTimestamp, last.packets)
+					g.onStall(idle)
+
+					return
+				}
+			}
+		}
+	}()
+}
+
+// close stops the probes and waits for a running one to finish. Safe to
+// call on a nil watchdog and more than once.
+func (g *mediaWatchdog) close() {
+	if g == nil {
+		return
+	}
+
+	g.stopOnce.Do(func() { close(g.stop) })
+	g.wg.Wait()
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMediaWatchdog(t *testing.T) {
+	var packets atomic.Uint64
+	var probes atomic.Int32
+	stalled := make(chan time.Duration, 2)
+	clk := clock.NewMock(time.Unix(1000, 0))
+
+	watchdog := newMediaWatchdog(40*time.Millisecond, func() mediaProgress {
+		probes.Add(1)
+		return mediaProgress{audioTimestamp: time.Second, packets: packets.Load()}
+	}, func(idle time.Duration) {
+		stalled <- idle
+	})
+	watchdog.clock = clk
+	watchdog.start("test-session")
+
+	// Moves to the next probe once the watchdog is done with this one
+	tick := func() {
+		n := probes.Load()
+		clk.Add(10 * time.Millisecond)
+		require.Eventually(t, func() bool { return probes.Load() > n }, time.Second, time.Millisecond)
+	}
+
+	// Silent audio: the timestamp is stuck, but packets keep arriving
+	for i := 0; i < 10; i++ {
+		packets.Add(1)
+		tick()
+	}
+
+	assert.Empty(t, stalled, "Packets arriving isn't a stall")
+
+	for i := 0; i < 3; i++ {
+		tick()
+	}
+
+	assert.Empty(t, stalled, "Not idle for the timeout yet")
+	tick()
+
+	select {
+	case idle := <-stalled:
+		assert.Equal(t, 40*time.Millisecond, idle)
+	case <-time.After(time.Second):
+		t.Fatal("Stall not reported")
+	}
+
+	watchdog.close()
+	// Reported once, then the probes stop
+	n := probes.Load()
+	clk.Add(time.Second)
+	assert.Equal(t, n, probes.Load())
+	assert.Empty(t, stalled)
+	assert.Zero(t, clk.Timers())
+
+	var nilWatchdog *mediaWatchdog
+	nilWatchdog.close()
+}
+
+func TestMediaWatchdog_Muted(t *testing.T) {
+	var muted atomic.Bool
+	var probes atomic.Int32
+	stalled := make(chan time.Duration, 1)
+	clk := clock.NewMock(time.Unix(1000, 0))
+	muted.Store(true)
+
+	watchdog := newMediaWatchdog(40*time.Millisecond, func() mediaProgress {
+		probes.Add(1)
+		return mediaProgress{audioTimestamp: time.Second, muted: muted.Load()}
+	}, func(idle time.Duration) {
+		stalled <- idle
+	})
+	watchdog.clock = clk
+	watchdog.start("test-session")
+	defer watchdog.close()
+
+	tick := func() {
+		n := probes.Load()
+		clk.Add(10 * time.Millisecond)
+		require.Eventually(t, func() bool { return probes.Load() > n }, time.Second, time.Millisecond)
+	}
+
+	for i := 0; i < 10; i++ {
+		tick()
+	}
+
+	assert.Empty(t, stalled, "Nothing arrives while muted")
+
+	// Stalls are timed from the unmute
+	muted.Store(false)
+
+	for i := 0; i < 4; i++ {
+		tick()
+	}
+
+	assert.Empty(t, stalled)
+	tick()
+
+	select {
+	case idle := <-stalled:
+		assert.Equal(t, 40*time.Millisecond, idle)
+	case <-time.After(time.Second):
+		t.Fatal("Stall not reported")
+	}
+}
+
+func TestSessionNoMedia(t *testing.T) {
+	cfg := &config.Config{
+		Recorder: config.Recorder{
+			Directory:    t.TempDir(),
+			DirFileMode:  "0700",
+			FileMode:     "0600",
+			StallTimeout: 100 * time.Millisecond,
+		},
+	}
+	ps := &mockPubSub{publishChan: make(chan []byte, 10)}
+	server := NewServer(cfg, ps)
+	sessionID := "test-no-media"
+
+	server.HandlePubSubEvent(context.Background(), &events.Event{
+		Id: events.StartRecordingKey,
+		Data: &events.StartRecording{
+			Id:        events.StartRecordingKey,
+			SessionId: sessionID,
+			FileName:  "test.webm",
+			Adapter:   events.AdapterRTP,
+			AdapterOptions: &events.AdapterOptions{
+				RTP: &events.RTPConfig{
+					ListenAddress: "127.0.0.1:0",
+					Tracks:        []events.RTPTrackConfig{{ID: "audio", PayloadType: 111, MimeType: "audio/opus"}},
+				},
+			},
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case responseBytes := <-ps.publishChan:
+			var event events.Event
+			require.NoError(t, json.Unmarshal(responseBytes, &event))
+
+			if event.Id != events.RecordingStoppedKey {
+				continue
+			}
+
+			var stopped events.RecordingStopped
+			require.NoError(t, json.Unmarshal(responseBytes, &stopped))
+			assert.Equal(t, events.StopReasonNoMedia, stopped.Reason)
+			assert.NoError(t, server.Close())
+
+			return
+		case <-time.After(2 * time.Second):
+			t.Fatal("Recording not stopped")
+		}
+	}
+
+	t.Fatal("No recordingStopped event")
+}
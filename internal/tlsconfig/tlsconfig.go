@@ -0,0 +1,181 @@
+// Package tlsconfig builds the TLS configurations of the recorder's
+// endpoints and of its connections to LiveKit
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// Server returns the TLS configuration of an endpoint, nil if it's served
+// in the clear
+func Server(cfg config.TLS) (*tls.Config, error) {
+	if !cfg.Enable {
+		return nil, nil
+	}
+
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("TLS enabled without a certificate and key")
+	}
+
+	cert, err := newCertificate(cfg.CertFile, cfg.KeyFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cert.get,
+	}
+
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCAs(x509.NewCertPool(), cfg.ClientCAFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// Client returns the TLS configuration of the connections to LiveKit, nil
+// for the default one
+func Client(cfg config.LiveKitTLS) (*tls.Config, error) {
+	if cfg.CAFile == "" && !cfg.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if tlsConfig.RootCAs, err = loadCAs(pool, cfg.CAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// ListenAndServe serves handler on addr, over TLS if tlsConfig is set
+func ListenAndServe(addr string, handler http.Handler, tlsConfig *tls.Config) error {
+	srv := &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig}
+
+	if tlsConfig == nil {
+		return srv.ListenAndServe()
+	}
+
+	// The certificate comes from tlsConfig
+	return srv.ListenAndServeTLS("", "")
+}
+
+func loadCAs(pool *x509.CertPool, file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates in CA file %s", file)
+	}
+
+	return pool, nil
+}
+
+// certificate is a key pair reloaded from its files when they change, e.g.
+// when renewed, so the endpoints don't need to be restarted. Failing to
+// reload keeps the previous pair.
+type certificate struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // Latest of the files' when loaded
+}
+
+func newCertificate(certFile, keyFile string) (*certificate, error) {
+	c := &certificate{certFile: certFile, keyFile: keyFile}
+	modTime, err := c.filesModTime()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.load(modTime); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *certificate) filesModTime() (time.Time, error) {
+	var latest time.Time
+
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// Locked, but for the first load
+func (c *certificate) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	c.cert = &cert
+	c.modTime = modTime
+
+	return nil
+}
+
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if modTime, err := c.filesModTime(); err == nil && !modTime.Equal(c.modTime) {
+		if err := c.load(modTime); err != nil {
+			log.Warnf("Keeping the previous TLS certificate: %v", err)
+			// Not retried until the files change again
+			c.modTime = modTime
+		} else {
+			log.Infof("TLS certificate reloaded: %s", c.certFile)
+		}
+	}
+
+	return c.cert, nil
+}
@@ -0,0 +1,201 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// issue creates a certificate for name signed by parent, self-signed if nil
+func issue(t *testing.T, name string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// files writes c and its key to dir, returning their paths
+func (c *testCert) files(t *testing.T, dir, name string) (string, string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, c.pem, 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	return certFile, keyFile
+}
+
+func (c *testCert) keyPair(t *testing.T) tls.Certificate {
+	dir := t.TempDir()
+	pair, err := tls.LoadX509KeyPair(c.files(t, dir, "client"))
+	require.NoError(t, err)
+
+	return pair
+}
+
+// serve serves with tlsConfig alone: httptest would add certificates of
+// its own
+func serve(t *testing.T, tlsConfig *tls.Config) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), TLSConfig: tlsConfig}
+	go srv.ServeTLS(lis, "", "")
+	t.Cleanup(func() { srv.Close() })
+
+	return "https://" + lis.Addr().String()
+}
+
+func get(url string, tlsConfig *tls.Config) error {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := client.Get(url)
+
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	return err
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	ca := issue(t, "ca", nil, true)
+	certFile, keyFile := issue(t, "server", ca, false).files(t, dir, "server")
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, ca.pem, 0600))
+
+	tlsConfig, err := Server(config.TLS{})
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig, "Disabled")
+
+	_, err = Server(config.TLS{Enable: true})
+	assert.Error(t, err)
+
+	_, err = Server(config.TLS{Enable: true, CertFile: certFile, KeyFile: filepath.Join(dir, "missing.key")})
+	assert.Error(t, err)
+
+	// TLS
+	tlsConfig, err = Server(config.TLS{Enable: true, CertFile: certFile, KeyFile: keyFile})
+	require.NoError(t, err)
+	url := serve(t, tlsConfig)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	assert.NoError(t, get(url, &tls.Config{RootCAs: roots}))
+	assert.Error(t, get(url, &tls.Config{}), "Not trusted by default")
+
+	// Mutual TLS
+	tlsConfig, err = Server(config.TLS{Enable: true, CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile})
+	require.NoError(t, err)
+	url = serve(t, tlsConfig)
+	assert.Error(t, get(url, &tls.Config{RootCAs: roots}), "A client certificate is required")
+
+	other := issue(t, "other", nil, true)
+	assert.Error(t, get(url, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{issue(t, "client", other, false).keyPair(t)}}),
+		"Signed by a CA that isn't trusted")
+	assert.NoError(t, get(url, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{issue(t, "client", ca, false).keyPair(t)}}))
+}
+
+func TestServer_Reload(t *testing.T) {
+	dir := t.TempDir()
+	first, second := issue(t, "first", nil, true), issue(t, "second", nil, true)
+	certFile, keyFile := first.files(t, dir, "server")
+
+	tlsConfig, err := Server(config.TLS{Enable: true, CertFile: certFile, KeyFile: keyFile})
+	require.NoError(t, err)
+
+	served := func() string {
+		cert, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+		require.NoError(t, err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+
+		return leaf.Subject.CommonName
+	}
+
+	assert.Equal(t, "first", served())
+
+	// Renewed
+	second.files(t, dir, "server")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	require.NoError(t, os.Chtimes(keyFile, later, later))
+	assert.Equal(t, "second", served())
+
+	// Broken, the previous one is kept
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0600))
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	assert.Equal(t, "second", served())
+}
+
+func TestClient(t *testing.T) {
+	dir := t.TempDir()
+	ca := issue(t, "ca", nil, true)
+	certFile, keyFile := issue(t, "server", ca, false).files(t, dir, "server")
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, ca.pem, 0600))
+
+	tlsConfig, err := Client(config.LiveKitTLS{})
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig, "Defaults")
+
+	_, err = Client(config.LiveKitTLS{CAFile: filepath.Join(dir, "missing.crt")})
+	assert.Error(t, err)
+
+	serverConfig, err := Server(config.TLS{Enable: true, CertFile: certFile, KeyFile: keyFile})
+	require.NoError(t, err)
+	url := serve(t, serverConfig)
+
+	tlsConfig, err = Client(config.LiveKitTLS{CAFile: caFile})
+	require.NoError(t, err)
+	assert.NoError(t, get(url, tlsConfig))
+
+	tlsConfig, err = Client(config.LiveKitTLS{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	assert.NoError(t, get(url, tlsConfig))
+}
@@ -19,7 +19,12 @@ type BaseTrackStats struct {
 	MaxSampleDurationMs time.Duration     `json:"maxSampleDurationMs"`
 	TotalSamples        int               `json:"totalSamples"`
 	WrittenSamples      int               `json:"writtenSamples"`
+	BytesWritten        uint64            `json:"bytesWritten"`
 	RTPDiscontInfo      DiscontinuityInfo `json:"rtpDiscontInfo"`
+	// Packets counted lost, and late ones the reorder tolerance waited for,
+	// which weren't (see config.ReorderTolerance)
+	LostPackets      uint64 `json:"lostPackets"`
+	ReorderedPackets uint64 `json:"reorderedPackets,omitempty"`
 
 	// sampleDurationAcc is an internal accumulator and should not be marshaled.
 	SampleDurationAcc time.Duration `json:"-"`
@@ -27,14 +32,188 @@ type BaseTrackStats struct {
 
 type RecorderTrackStats struct {
 	BaseTrackStats
+	Codec               string            `json:"codec,omitempty"`
+	Layer               string            `json:"layer,omitempty"`
+	LayerWidth          uint32            `json:"layerWidth,omitempty"`
+	LayerHeight         uint32            `json:"layerHeight,omitempty"`
+	Source              string            `json:"source,omitempty"` // "camera" or "screen_share", if known
 	CorruptedFrames     int               `json:"corruptedFrames,omitempty"`
 	AvgFrameSizeBytes   int               `json:"avgFrameSizeBytes,omitempty"`
 	MaxFrameSizeBytes   int               `json:"maxFrameSizeBytes,omitempty"`
 	KeyframeCount       int               `json:"keyframeCount,omitempty"`
 	VP8PicIDDiscontInfo DiscontinuityInfo `json:"vp8PicIdDiscontInfo,omitempty"`
+	// VP9: layer frames left out because they couldn't be decoded. VP8:
+	// frames of the temporal layers above MaxTemporalLayer.
+	DroppedLayerFrames int `json:"droppedLayerFrames,omitempty"`
+	// VP8 only: the highest temporal layer recorded, if filtering the
+	// layers above it
+	MaxTemporalLayer *int `json:"maxTemporalLayer,omitempty"`
+	// Audio: Opus PLC frames inserted for lost packets. Video: loss markers
+	// written. Only with loss concealment enabled.
+	ConcealedFrames int `json:"concealedFrames,omitempty"`
+	// Audio only: Opus DTX frames received, and frames filled in for the
+	// silences following them, if filling those
+	DTXFrames       int `json:"dtxFrames,omitempty"`
+	DTXFilledFrames int `json:"dtxFilledFrames,omitempty"`
+	// Audio only: silence generated to fill gaps, if filling those
+	SilenceFilledMs int64 `json:"silenceFilledMs,omitempty"`
+	// Audio only: speaking/silent periods on the recording's timeline
+	VoiceActivity []VoiceActivityInterval `json:"voiceActivity,omitempty"`
+	// RTP timestamp discontinuities the timeline was re-based across (the
+	// last 100), if enabled
+	TimestampJumps []TimestampJump `json:"timestampJumps,omitempty"`
+	// Blocks whose timestamp went backward, written at the last one instead
+	TimestampCorrections int `json:"timestampCorrections,omitempty"`
+}
+
+// TimestampJump is an RTP timestamp discontinuity: the packet SeqNum, with
+// RTPTimestamp as received, was JumpMs ahead of (or, negative, behind) the
+// time elapsed since the previous one. Time is in Unix ms.
+type TimestampJump struct {
+	Time         int64  `json:"time"`
+	SeqNum       uint16 `json:"seqNum"`
+	RTPTimestamp uint32 `json:"rtpTimestamp"`
+	JumpMs       int64  `json:"jumpMs"`
+}
+
+type VoiceActivityInterval struct {
+	StartMs  int64 `json:"startMs"`
+	EndMs    int64 `json:"endMs"`
+	Speaking bool  `json:"speaking"`
 }
 
 type RecorderStats struct {
 	Audio *RecorderTrackStats `json:"audio,omitempty"`
 	Video *RecorderTrackStats `json:"video,omitempty"`
+	// Tracks mixed into Audio, by track ID
+	AudioInputs map[string]*MixInputStats `json:"audioInputs,omitempty"`
+	// What the mix was encoded with, if mixed
+	AudioEncoding *OpusEncoding `json:"audioEncoding,omitempty"`
+	// What keyframe trimming cut, if enabled
+	Trim *TrimStats `json:"trim,omitempty"`
+	// How video was fit to a constant frame rate, if enabled
+	ConstantFrameRate *ConstantFrameRateStats `json:"constantFrameRate,omitempty"`
+	// How the skew between audio and video was corrected, if enabled
+	AVSync *AVSyncStats `json:"avSync,omitempty"`
+	// What the recording's files hold, once started
+	File *FileStats `json:"file,omitempty"`
+	// JPEG stills taken of the video, if enabled
+	Snapshots *SnapshotStats `json:"snapshots,omitempty"`
+	// The low bitrate proxy transcoded alongside, if enabled
+	Proxy *ProxyStats `json:"proxy,omitempty"`
+	// The decoded media written for other pipelines, if enabled
+	RawOutput *RawOutputStats `json:"rawOutput,omitempty"`
+	// Set if finalizing the recording took past the flush deadline, which
+	// left it unfinished
+	FlushTimedOut bool `json:"flushTimedOut,omitempty"`
+	// Set if the recording was canceled, its files deleted
+	Canceled bool `json:"canceled,omitempty"`
+}
+
+// AVSyncStats describes how audio and video were placed: Source is "rtcp"
+// once their skew was measured on the publisher's clock, "arrival" while
+// (or if) they're placed as they arrived. SkewMs is how far behind audio
+// the video was placed (negative if ahead), CorrectionMs what Track was
+// delayed by to compensate, less than the skew if Clamped to the maximum
+// correction.
+type AVSyncStats struct {
+	Source       string `json:"source"`
+	SkewMs       int64  `json:"skewMs"`
+	CorrectionMs int64  `json:"correctionMs"`
+	Track        string `json:"track,omitempty"`
+	Clamped      bool   `json:"clamped,omitempty"`
+}
+
+// ProxyStats describes the proxy of a recording: the bytes of the recording
+// fed to its transcoder, whether it fell behind so the proxy ends early, and
+// why transcoding failed, if it did
+type ProxyStats struct {
+	File    string `json:"file"`
+	Bytes   uint64 `json:"bytes"`
+	Overrun bool   `json:"overrun,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// What the audio was encoded with
+	Audio *OpusEncoding `json:"audio,omitempty"`
+}
+
+// OpusEncoding is what Opus was re-encoded with: Bitrate (bits/s),
+// Complexity (0-10), whether in-band FEC was on and the Application the
+// encoder was tuned for, as in config.OpusEncoder
+type OpusEncoding struct {
+	Bitrate     int    `json:"bitrate"`
+	Complexity  int    `json:"complexity"`
+	FEC         bool   `json:"fec"`
+	Application string `json:"application"`
+}
+
+// RawOutputStats describes the decoded streams of a recording written for
+// other pipelines, those enabled
+type RawOutputStats struct {
+	Video *RawStreamStats `json:"video,omitempty"`
+	Audio *RawStreamStats `json:"audio,omitempty"`
+}
+
+// RawStreamStats describes a decoded stream written to Path: whether its
+// reader opened it, the frames written (repeated ones included), those
+// dropped because the reader fell behind or to keep to the frame rate, those
+// that failed to decode, and why writing stopped, if it did
+type RawStreamStats struct {
+	Path    string `json:"path"`
+	Opened  bool   `json:"opened"`
+	Frames  int64  `json:"frames"`
+	Dropped int64  `json:"dropped"`
+	Failed  int64  `json:"failed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// SnapshotStats describes the stills taken of a recording's video into
+// Directory: the ones written, the ones that failed to decode or write, and
+// the keyframes skipped because the previous snapshot was still in progress
+type SnapshotStats struct {
+	Directory string `json:"directory"`
+	Written   int64  `json:"written"`
+	Failed    int64  `json:"failed"`
+	Skipped   int64  `json:"skipped"`
+}
+
+// FileStats describes the files of a recording in progress: the bytes they
+// hold, all segments included, and how fast they grew over the last few
+// seconds (bytes/s)
+type FileStats struct {
+	BytesWritten uint64 `json:"bytesWritten"`
+	WriteRate    uint64 `json:"writeRate"`
+}
+
+// TrimStats describes what was cut from a recording trimmed to keyframes.
+// Media received LeadingMs before the start of the file is left out, and
+// so is the last TrailingMs of what was written.
+type TrimStats struct {
+	LeadingMs          int64 `json:"leadingMs"`
+	TrailingMs         int64 `json:"trailingMs"`
+	DroppedVideoFrames int   `json:"droppedVideoFrames,omitempty"`
+	DroppedAudioFrames int   `json:"droppedAudioFrames,omitempty"`
+}
+
+// ConstantFrameRateStats describes how video was fit to FPS frames per
+// second: frames repeated into the slots nothing arrived for, and frames
+// dropped because their slot was taken or they depended on a dropped one
+type ConstantFrameRateStats struct {
+	FPS              int `json:"fps"`
+	DuplicatedFrames int `json:"duplicatedFrames"`
+	DroppedFrames    int `json:"droppedFrames"`
+}
+
+// MixInputStats describes an audio track mixed into a recording
+type MixInputStats struct {
+	Gain         float64 `json:"gain"`
+	Packets      uint64  `json:"packets"`
+	DecodeErrors uint64  `json:"decodeErrors,omitempty"`
+	// Packets (partly) left out because that part of the mix was already
+	// encoded
+	LatePackets uint64 `json:"latePackets,omitempty"`
+	// Times the track was realigned to the wall clock, e.g. when resuming
+	Realignments int `json:"realignments,omitempty"`
+	// When the track starts and ends in the recording
+	StartMs int64 `json:"startMs"`
+	EndMs   int64 `json:"endMs"`
 }
@@ -0,0 +1,167 @@
+package upload
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrBreakerOpen is returned instead of uploading while the backend fails
+var ErrBreakerOpen = errors.New("upload circuit breaker is open")
+
+// breakerState values are the ones exported to Prometheus
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker is a circuit breaker around the upload backend (see
+// config.UploadBreaker). Half-opening happens with the first upload after
+// OpenDuration, which is the only one let through until it's done.
+type breaker struct {
+	cfg   config.UploadBreaker
+	clock clock.Clock
+
+	mu       sync.Mutex
+	state    breakerState
+	openedAt time.Time
+	trying   bool
+
+	// The outcomes of the last uploads, failed ones true
+	outcomes []bool
+	next     int
+	count    int
+	failures int
+}
+
+func newBreaker(cfg config.UploadBreaker, c clock.Clock) *breaker {
+	if cfg.Window < 1 {
+		cfg.Window = 1
+	}
+
+	appstats.SetUploadBreakerState(int(breakerClosed))
+
+	return &breaker{
+		cfg:      cfg,
+		clock:    c,
+		outcomes: make([]bool, cfg.Window),
+	}
+}
+
+// allow returns ErrBreakerOpen if an upload must be skipped. Otherwise its
+// outcome must be passed to done.
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen && b.clock.Since(b.openedAt) >= b.cfg.OpenDuration {
+		b.setState(breakerHalfOpen)
+	}
+
+	switch b.state {
+	case breakerOpen:
+		return ErrBreakerOpen
+	case breakerHalfOpen:
+		if b.trying {
+			return ErrBreakerOpen
+		}
+
+		b.trying = true
+	}
+
+	return nil
+}
+
+func (b *breaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerHalfOpen:
+		b.trying = false
+
+		if err != nil {
+			b.open()
+		} else {
+			b.reset()
+			b.setState(breakerClosed)
+		}
+	case breakerClosed:
+		b.record(err != nil)
+
+		if b.count == b.cfg.Window && float64(b.failures) >= b.cfg.FailureRate*float64(b.cfg.Window) {
+			b.open()
+		}
+	}
+
+	// Uploads let through before the breaker opened don't count
+}
+
+// Locked
+func (b *breaker) record(failed bool) {
+	if b.count == len(b.outcomes) {
+		if b.outcomes[b.next] {
+			b.failures--
+		}
+	} else {
+		b.count++
+	}
+
+	b.outcomes[b.next] = failed
+	b.next = (b.next + 1) % len(b.outcomes)
+
+	if failed {
+		b.failures++
+	}
+}
+
+// Locked
+func (b *breaker) reset() {
+	clear(b.outcomes)
+	b.next = 0
+	b.count = 0
+	b.failures = 0
+}
+
+// Locked
+func (b *breaker) open() {
+	b.openedAt = b.clock.Now()
+	b.setState(breakerOpen)
+}
+
+// Locked
+func (b *breaker) setState(state breakerState) {
+	if state == b.state {
+		return
+	}
+
+	logger := log.WithField("from", b.state).WithField("to", state)
+
+	if state == breakerOpen {
+		logger.Warn("Upload circuit breaker opened, deferring uploads")
+	} else {
+		logger.Info("Upload circuit breaker state changed")
+	}
+
+	b.state = state
+	appstats.SetUploadBreakerState(int(state))
+}
@@ -0,0 +1,98 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreaker(t *testing.T) {
+	clk := clock.NewMock(time.Unix(1700000000, 0))
+	b := newBreaker(config.UploadBreaker{FailureRate: 0.75, Window: 4, OpenDuration: time.Minute}, clk)
+	failed := errors.New("failed")
+
+	for _, err := range []error{nil, failed, nil, failed, nil, failed} {
+		require.NoError(t, b.allow())
+		b.done(err)
+	}
+
+	assert.Equal(t, breakerClosed, b.state, "2 of the last 4 failing isn't enough")
+
+	require.NoError(t, b.allow())
+	b.done(failed)
+	assert.Equal(t, breakerOpen, b.state, "3 of the last 4 failed")
+	assert.ErrorIs(t, b.allow(), ErrBreakerOpen)
+
+	clk.Add(time.Minute)
+	require.NoError(t, b.allow(), "Half-open")
+	assert.Equal(t, breakerHalfOpen, b.state)
+	assert.ErrorIs(t, b.allow(), ErrBreakerOpen, "A single upload is tried")
+	b.done(failed)
+	assert.Equal(t, breakerOpen, b.state)
+	assert.ErrorIs(t, b.allow(), ErrBreakerOpen, "Open for another OpenDuration")
+
+	clk.Add(time.Minute)
+	require.NoError(t, b.allow())
+	b.done(nil)
+	assert.Equal(t, breakerClosed, b.state)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, b.allow())
+		b.done(failed)
+	}
+
+	assert.Equal(t, breakerClosed, b.state, "Outcomes from before opening are forgotten")
+}
+
+func TestUpload_Breaker(t *testing.T) {
+	var puts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		puts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	u := newTestUploader(t, srv.URL, true, false)
+	u.breaker = newBreaker(config.UploadBreaker{FailureRate: 1, Window: 2, OpenDuration: time.Minute}, clock.NewMock(time.Now()))
+	path := writeRecording(t, "data")
+
+	assert.Error(t, u.Upload(context.Background(), path))
+	assert.Error(t, u.Upload(context.Background(), path))
+	assert.ErrorIs(t, u.Upload(context.Background(), path), ErrBreakerOpen)
+	assert.Equal(t, int32(2), puts.Load(), "Not tried once open")
+
+	u.MarkPending(context.Background(), []string{path, path + ".missing"}, ErrBreakerOpen)
+
+	data, err := os.ReadFile(pendingUploadPath(path))
+	require.NoError(t, err)
+	var marker pendingUpload
+	require.NoError(t, json.Unmarshal(data, &marker))
+	assert.Equal(t, path, marker.FileName)
+	assert.Equal(t, "meeting/recording.webm", marker.Key)
+	assert.Equal(t, ErrBreakerOpen.Error(), marker.Error)
+
+	info, err := os.Stat(pendingUploadPath(path))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm(), "The recording's mode")
+	assert.NoFileExists(t, pendingUploadPath(path+".missing"))
+}
+
+func TestUpload_MarkPendingWithoutBreaker(t *testing.T) {
+	u := newTestUploader(t, "http://s3.test", true, false)
+	path := writeRecording(t, "data")
+
+	u.MarkPending(context.Background(), []string{path}, errors.New("failed"))
+
+	assert.NoFileExists(t, pendingUploadPath(path))
+}
@@ -0,0 +1,295 @@
+package upload
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+)
+
+const (
+	s3Service       = "s3"
+	s3SignAlgorithm = "AWS4-HMAC-SHA256"
+	s3AmzDateFormat = "20060102T150405Z"
+)
+
+var _ Backend = (*S3)(nil)
+
+// S3 uploads objects to an S3-compatible bucket with single PUT requests
+// signed with AWS Signature Version 4. Both virtual-hosted-style and
+// path-style (e.g. MinIO) addressing are supported.
+type S3 struct {
+	cfg        config.S3
+	endpoint   *url.URL
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+func NewS3(cfg config.S3) (*S3, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3 bucket is not set")
+	}
+
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %s", cfg.Endpoint)
+	}
+
+	return &S3{
+		cfg:        cfg,
+		endpoint:   endpoint,
+		httpClient: &http.Client{},
+		now:        time.Now,
+	}, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, file *os.File, size int64) error {
+	// Hash the payload first so the request is fully signed; unsigned
+	// payloads are not accepted over plain HTTP
+	hash := sha256.New()
+
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, size)); err != nil {
+		return err
+	}
+
+	// Body is wrapped so the transport doesn't close the caller's file
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key),
+		io.NopCloser(io.NewSectionReader(file, 0, size)))
+
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	s.sign(req, hex.EncodeToString(hash.Sum(nil)), s.now())
+
+	res, err := s.httpClient.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	return checkS3Response(res)
+}
+
+func (s *S3) Size(ctx context.Context, key string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.objectURL(key), nil)
+
+	if err != nil {
+		return 0, err
+	}
+
+	s.sign(req, emptyPayloadHash, s.now())
+	res, err := s.httpClient.Do(req)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer res.Body.Close()
+
+	if err := checkS3Response(res); err != nil {
+		return 0, err
+	}
+
+	return res.ContentLength, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key), nil)
+
+	if err != nil {
+		return err
+	}
+
+	s.sign(req, emptyPayloadHash, s.now())
+	res, err := s.httpClient.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	// Deleting a missing object succeeds (204) as well
+	return checkS3Response(res)
+}
+
+func (s *S3) Location(key string) string {
+	return fmt.Sprintf("s3://%s/%s", s.cfg.Bucket, key)
+}
+
+func (s *S3) objectURL(key string) string {
+	u := *s.endpoint
+	path := "/" + strings.TrimPrefix(key, "/")
+
+	if s.cfg.ForcePathStyle {
+		path = "/" + s.cfg.Bucket + path
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = awsURIEncode(u.Path, false)
+
+	return u.String()
+}
+
+var emptyPayloadHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+// sign adds SigV4 headers to req, signing every header already set on it
+// plus Host (https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html)
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(s3AmzDateFormat)
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+
+	if req.Host != "" {
+		headers["host"] = req.Host
+	}
+
+	for name, values := range req.Header {
+		trimmed := make([]string, len(values))
+
+		for i, v := range values {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+
+	names := make([]string, 0, len(headers))
+
+	for name := range headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, s.cfg.Region, s3Service, "aws4_request"}, "/")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3SignAlgorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := signingKey(s.cfg.SecretAccessKey, date, s.cfg.Region, s3Service)
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SignAlgorithm, s.cfg.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+
+	for k := range query {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+
+		for _, v := range values {
+			parts = append(parts, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// awsURIEncode percent-encodes everything but unreserved characters (RFC
+// 3986), which is what SigV4 expects. Slashes are kept unless encodeSlash.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func checkS3Response(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	return fmt.Errorf("s3 request failed: %s: %s", res.Status, strings.TrimSpace(string(body)))
+}
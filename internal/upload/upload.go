@@ -0,0 +1,272 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/mitchellh/mapstructure"
+	log "github.com/sirupsen/logrus"
+)
+
+// Backend stores finished recordings somewhere other than local disk
+type Backend interface {
+	// Put uploads size bytes read from file under key
+	Put(ctx context.Context, key string, file *os.File, size int64) error
+	// Size returns the size of the stored object
+	Size(ctx context.Context, key string) (int64, error)
+	// Delete removes the stored object, if any
+	Delete(ctx context.Context, key string) error
+	// Location returns a human readable location of key, for logging
+	Location(key string) string
+}
+
+type Uploader struct {
+	backend Backend
+	prefix  string
+	// The recorder directory: recordings are stored by their path within
+	dir         string
+	deleteLocal bool
+	cfg         config.Upload
+	// Set if enabled
+	breaker *breaker
+}
+
+// NewUploader returns nil if uploads are disabled. Recordings are stored by
+// their path within dir, the recorder directory, base name if outside it.
+func NewUploader(cfg config.Upload, dir string) (*Uploader, error) {
+	if !cfg.Enable {
+		return nil, nil
+	}
+
+	if dir != "" {
+		abs, err := filepath.Abs(dir)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid recorder directory %s: %w", dir, err)
+		}
+
+		dir = abs
+	}
+
+	var backend Backend
+	var prefix string
+
+	switch cfg.Backend {
+	case "s3":
+		c := config.S3{}
+
+		if err := mapstructure.Decode(cfg.Backends[cfg.Backend], &c); err != nil {
+			return nil, fmt.Errorf("failed to decode %s upload configuration: %w", cfg.Backend, err)
+		}
+
+		s3, err := NewS3(c)
+
+		if err != nil {
+			return nil, err
+		}
+
+		backend = s3
+		prefix = c.Prefix
+	default:
+		return nil, fmt.Errorf("unknown upload backend '%s'", cfg.Backend)
+	}
+
+	u := &Uploader{
+		backend:     backend,
+		prefix:      prefix,
+		dir:         dir,
+		deleteLocal: cfg.DeleteLocal,
+		cfg:         cfg,
+	}
+
+	if cfg.Breaker.Enable {
+		u.breaker = newBreaker(cfg.Breaker, clock.Real)
+	}
+
+	return u, nil
+}
+
+// WithPrefix returns an uploader storing recordings under prefix, within
+// the configured one. Its circuit breaker is u's.
+func (u *Uploader) WithPrefix(prefix string) *Uploader {
+	c := *u
+	c.prefix = u.prefix + prefix
+
+	return &c
+}
+
+// Upload ships a finalized recording to the backend and checks the stored
+// object size matches the local file. The local copy is removed afterwards
+// if configured to. While the circuit breaker is open, ErrBreakerOpen is
+// returned without trying.
+func (u *Uploader) Upload(ctx context.Context, path string) error {
+	if u.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, u.cfg.Timeout)
+		defer cancel()
+	}
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %w", err)
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return fmt.Errorf("failed to stat recording: %w", err)
+	}
+
+	key := u.key(path)
+
+	if u.breaker != nil {
+		if err := u.breaker.allow(); err != nil {
+			return err
+		}
+	}
+
+	log.WithField("session", ctx.Value("session")).
+		Infof("Uploading %s (%d bytes) to %s", path, info.Size(), u.backend.Location(key))
+
+	err = u.put(ctx, key, file, info.Size())
+
+	if u.breaker != nil {
+		u.breaker.done(err)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.WithField("session", ctx.Value("session")).
+		Infof("Uploaded %s to %s", path, u.backend.Location(key))
+
+	if u.deleteLocal {
+		// The file is still open, but that's fine for unlinking
+		if err := os.Remove(path); err != nil {
+			log.WithField("session", ctx.Value("session")).
+				Warnf("Failed to remove local recording %s after upload: %v", path, err)
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the uploaded copy of the recording at path, e.g. when it's
+// canceled after being uploaded. The circuit breaker doesn't apply.
+func (u *Uploader) Delete(ctx context.Context, path string) error {
+	if u.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, u.cfg.Timeout)
+		defer cancel()
+	}
+
+	key := u.key(path)
+
+	if err := u.backend.Delete(ctx, key); err != nil {
+		return fmt.Errorf("failed to delete uploaded recording: %w", err)
+	}
+
+	log.WithField("session", ctx.Value("session")).
+		Infof("Deleted %s from %s", path, u.backend.Location(key))
+
+	return nil
+}
+
+// key is where the recording at path is stored: its path within the
+// recorder directory, where path templates may lay recordings out in
+// subdirectories
+func (u *Uploader) key(path string) string {
+	name := filepath.Base(path)
+
+	if abs, err := filepath.Abs(path); err == nil && u.dir != "" {
+		if rel, err := filepath.Rel(u.dir, abs); err == nil && filepath.IsLocal(rel) {
+			name = filepath.ToSlash(rel)
+		}
+	}
+
+	return u.prefix + name
+}
+
+// put uploads file and checks the stored object size matches
+func (u *Uploader) put(ctx context.Context, key string, file *os.File, size int64) error {
+	if err := u.backend.Put(ctx, key, file, size); err != nil {
+		return fmt.Errorf("failed to upload recording: %w", err)
+	}
+
+	stored, err := u.backend.Size(ctx, key)
+
+	if err != nil {
+		return fmt.Errorf("failed to verify uploaded recording: %w", err)
+	}
+
+	if stored != size {
+		return fmt.Errorf("uploaded recording size mismatch: local=%d, remote=%d", size, stored)
+	}
+
+	return nil
+}
+
+// pendingUpload is the marker of a file left on disk for a later sweep to
+// upload
+type pendingUpload struct {
+	FileName string    `json:"fileName"`
+	Key      string    `json:"key"`
+	Location string    `json:"location"`
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+}
+
+// pendingUploadPath is where the marker of path goes, e.g.
+// recording.webm.pending-upload
+func pendingUploadPath(path string) string {
+	return path + ".pending-upload"
+}
+
+// MarkPending leaves a pending upload marker next to each of paths, that
+// weren't uploaded because of cause. Markers get the mode of their file.
+// Only with the circuit breaker enabled, which defers failed uploads.
+func (u *Uploader) MarkPending(ctx context.Context, paths []string, cause error) {
+	if u.breaker == nil {
+		return
+	}
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+
+		if err != nil {
+			continue
+		}
+
+		key := u.key(path)
+		data, err := json.Marshal(&pendingUpload{
+			FileName: path,
+			Key:      key,
+			Location: u.backend.Location(key),
+			Error:    cause.Error(),
+			Time:     time.Now().UTC(),
+		})
+
+		if err == nil {
+			err = os.WriteFile(pendingUploadPath(path), data, info.Mode().Perm())
+		}
+
+		if err != nil {
+			log.WithField("session", ctx.Value("session")).
+				Errorf("Failed to mark %s as pending upload: %v", path, err)
+			continue
+		}
+
+		appstats.OnUploadDeferred()
+	}
+}
@@ -0,0 +1,262 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
+	"github.com/cenkalti/backoff/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	EventRecordingStarted    = "recordingStarted"
+	EventRecordingFirstMedia = "recordingFirstMedia"
+	EventRecordingSegment    = "recordingSegment"
+	EventRecordingStopped    = "recordingStopped"
+	EventRecordingUploaded   = "recordingUploaded"
+)
+
+const (
+	EventHeader     = "X-Recorder-Event"
+	TimestampHeader = "X-Recorder-Timestamp"
+	SignatureHeader = "X-Recorder-Signature"
+)
+
+// Events waiting for delivery, per recording. Past that, new ones are
+// dropped.
+const queueSize = 32
+
+// Event is the JSON body of a webhook request
+type Event struct {
+	// Unique per event, the same across delivery attempts
+	Id        string         `json:"id"`
+	Event     string         `json:"event"`
+	SessionId string         `json:"recordingSessionId"`
+	Timestamp int64          `json:"timestamp"` // Unix ms
+	FileName  string         `json:"fileName,omitempty"`
+	Metadata  map[string]any `json:"metadata,omitempty"`
+	// recordingSegment: the segment that just started
+	Segment *recorder.SegmentInfo `json:"segment,omitempty"`
+	// recordingStopped
+	Reason   string               `json:"reason,omitempty"`
+	Duration *int64               `json:"duration,omitempty"` // ms
+	Stats    *types.RecorderStats `json:"stats,omitempty"`
+	// recordingUploaded
+	Files       []string `json:"files,omitempty"`
+	UploadError string   `json:"uploadError,omitempty"`
+	Canceled    bool     `json:"canceled,omitempty"`
+}
+
+// Notifier delivers the events of a recording in order, one at a time,
+// retrying failed deliveries with exponential backoff. Requests are signed
+// with Sign if a secret is set.
+type Notifier struct {
+	ctx    context.Context
+	cfg    config.Webhook
+	client *http.Client
+	now    func() time.Time
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan Event
+	done   chan struct{}
+}
+
+// NewNotifier returns nil if webhooks are disabled. A nil Notifier ignores
+// events.
+func NewNotifier(ctx context.Context, cfg config.Webhook) *Notifier {
+	if !cfg.Enable || cfg.URL == "" {
+		return nil
+	}
+
+	n := &Notifier{
+		ctx:    ctx,
+		cfg:    cfg,
+		client: &http.Client{},
+		now:    time.Now,
+		queue:  make(chan Event, queueSize),
+		done:   make(chan struct{}),
+	}
+
+	go n.run()
+
+	return n
+}
+
+// Notify queues an event for delivery. It never blocks.
+func (n *Notifier) Notify(event Event) {
+	if n == nil {
+		return
+	}
+
+	event.Id = newEventId()
+
+	if event.Timestamp == 0 {
+		event.Timestamp = n.now().UnixMilli()
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return
+	}
+
+	select {
+	case n.queue <- event:
+	default:
+		log.WithField("session", n.ctx.Value("session")).
+			Warnf("Webhook queue full, dropping %s event", event.Event)
+	}
+}
+
+// Close waits for the queued events to be delivered, or given up on.
+// Events notified afterwards are ignored.
+func (n *Notifier) Close() {
+	if n == nil {
+		return
+	}
+
+	n.mu.Lock()
+
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+
+	n.mu.Unlock()
+	<-n.done
+}
+
+func (n *Notifier) run() {
+	defer close(n.done)
+
+	for event := range n.queue {
+		n.deliver(event)
+	}
+}
+
+func (n *Notifier) deliver(event Event) {
+	logger := log.WithField("session", n.ctx.Value("session")).WithField("event", event.Event)
+	body, err := json.Marshal(event)
+
+	if err != nil {
+		logger.WithError(err).Error("Failed to encode webhook event")
+		return
+	}
+
+	eb := backoff.NewExponentialBackOff()
+
+	if n.cfg.Retry.InitialInterval > 0 {
+		eb.InitialInterval = n.cfg.Retry.InitialInterval
+	}
+
+	if n.cfg.Retry.MaxInterval > 0 {
+		eb.MaxInterval = n.cfg.Retry.MaxInterval
+	}
+
+	// Bounded by MaxAttempts instead
+	eb.MaxElapsedTime = 0
+	eb.Multiplier = 2
+	eb.RandomizationFactor = 0.1
+	eb.Reset()
+
+	attempts := max(n.cfg.Retry.MaxAttempts, 1)
+	attempt := 0
+
+	// WithMaxRetries counts retries, not attempts
+	err = backoff.RetryNotify(func() error {
+		attempt++
+		return n.post(event.Event, body)
+	}, backoff.WithMaxRetries(eb, attempts-1), func(err error, next time.Duration) {
+		logger.Warnf("Webhook delivery attempt %d/%d failed, retrying in %v: %v", attempt, attempts, next, err)
+	})
+
+	if err != nil {
+		logger.Errorf("Giving up delivering webhook after %d attempt(s): %v", attempt, err)
+		return
+	}
+
+	logger.Debugf("Webhook delivered after %d attempt(s)", attempt)
+}
+
+func (n *Notifier) post(event string, body []byte) error {
+	ctx := context.Background()
+
+	if n.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.cfg.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.cfg.URL, bytes.NewReader(body))
+
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+
+	// Signed on each attempt, so receivers can reject stale requests
+	timestamp := strconv.FormatInt(n.now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event)
+	req.Header.Set(TimestampHeader, timestamp)
+
+	if n.cfg.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(n.cfg.Secret, timestamp, body))
+	}
+
+	resp, err := n.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	// Drained so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout ||
+		resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode >= 500:
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	default:
+		// The receiver won't accept it on a retry either
+		return backoff.Permanent(fmt.Errorf("webhook returned %s", resp.Status))
+	}
+}
+
+// Sign returns the signature of a request: "sha256=" followed by the hex
+// encoded HMAC-SHA256, keyed with the secret, of the timestamp header, a dot
+// and the body
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newEventId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
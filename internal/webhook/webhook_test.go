@@ -0,0 +1,164 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AlekSi/pointer"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+type testReceiver struct {
+	m        sync.Mutex
+	requests []receivedRequest
+	// Status codes of the first requests, 200 after that
+	statuses []int
+}
+
+func (r *testReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.requests = append(r.requests, receivedRequest{header: req.Header.Clone(), body: body})
+
+	if len(r.statuses) > 0 {
+		w.WriteHeader(r.statuses[0])
+		r.statuses = r.statuses[1:]
+	}
+}
+
+func (r *testReceiver) received() []receivedRequest {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]receivedRequest(nil), r.requests...)
+}
+
+func setupNotifier(t *testing.T, receiver *testReceiver, secret string) *Notifier {
+	srv := httptest.NewServer(receiver)
+	t.Cleanup(srv.Close)
+
+	ctx := context.WithValue(context.Background(), "session", "test-session")
+
+	return NewNotifier(ctx, config.Webhook{
+		Enable:  true,
+		URL:     srv.URL,
+		Secret:  secret,
+		Timeout: time.Second,
+		Retry: config.WebhookRetry{
+			MaxAttempts:     3,
+			InitialInterval: time.Millisecond,
+			MaxInterval:     5 * time.Millisecond,
+		},
+	})
+}
+
+func TestNotifier_Deliver(t *testing.T) {
+	receiver := &testReceiver{}
+	n := setupNotifier(t, receiver, "secret")
+
+	n.Notify(Event{Event: EventRecordingStarted, SessionId: "test-session", FileName: "rec.webm"})
+	n.Notify(Event{
+		Event:     EventRecordingStopped,
+		SessionId: "test-session",
+		Reason:    "stopped",
+		Duration:  pointer.ToInt64(1500),
+		Stats:     &types.RecorderStats{Video: &types.RecorderTrackStats{}},
+	})
+	n.Close()
+
+	requests := receiver.received()
+	require.Len(t, requests, 2)
+
+	var started, stopped Event
+	require.NoError(t, json.Unmarshal(requests[0].body, &started))
+	require.NoError(t, json.Unmarshal(requests[1].body, &stopped))
+
+	assert.Equal(t, EventRecordingStarted, started.Event, "Events are delivered in order")
+	assert.Equal(t, "rec.webm", started.FileName)
+	assert.NotEmpty(t, started.Id)
+	assert.Positive(t, started.Timestamp)
+	assert.Nil(t, started.Duration)
+
+	assert.Equal(t, EventRecordingStopped, stopped.Event)
+	assert.Equal(t, int64(1500), *stopped.Duration)
+	assert.NotNil(t, stopped.Stats.Video)
+	assert.NotEqual(t, started.Id, stopped.Id)
+
+	for _, req := range requests {
+		assert.Equal(t, "application/json", req.header.Get("Content-Type"))
+		timestamp := req.header.Get(TimestampHeader)
+		assert.NotEmpty(t, timestamp)
+		assert.Equal(t, Sign("secret", timestamp, req.body), req.header.Get(SignatureHeader))
+	}
+
+	assert.Equal(t, EventRecordingStopped, requests[1].header.Get(EventHeader))
+
+	// Ignored once closed
+	n.Notify(Event{Event: EventRecordingStarted})
+	assert.Len(t, receiver.received(), 2)
+}
+
+func TestNotifier_Retry(t *testing.T) {
+	receiver := &testReceiver{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	n := setupNotifier(t, receiver, "")
+
+	n.Notify(Event{Event: EventRecordingStarted})
+	n.Close()
+
+	requests := receiver.received()
+	require.Len(t, requests, 3, "Delivered on the third attempt")
+	assert.Equal(t, string(requests[0].body), string(requests[2].body), "Retries send the same event")
+	assert.Empty(t, requests[0].header.Get(SignatureHeader), "Unsigned without a secret")
+}
+
+func TestNotifier_GiveUp(t *testing.T) {
+	receiver := &testReceiver{statuses: []int{500, 500, 500, 500}}
+	n := setupNotifier(t, receiver, "")
+
+	n.Notify(Event{Event: EventRecordingStarted})
+	n.Close()
+	assert.Len(t, receiver.received(), 3, "Up to MaxAttempts")
+
+	// Client errors aren't retried
+	receiver = &testReceiver{statuses: []int{http.StatusBadRequest}}
+	n = setupNotifier(t, receiver, "")
+
+	n.Notify(Event{Event: EventRecordingStarted})
+	n.Notify(Event{Event: EventRecordingStopped})
+	n.Close()
+	assert.Len(t, receiver.received(), 2, "Later events are still delivered")
+}
+
+func TestNewNotifier_Disabled(t *testing.T) {
+	assert.Nil(t, NewNotifier(context.Background(), config.Webhook{Enable: true}))
+	assert.Nil(t, NewNotifier(context.Background(), config.Webhook{URL: "http://127.0.0.1"}))
+
+	// Nil notifiers ignore events
+	var n *Notifier
+	n.Notify(Event{Event: EventRecordingStarted})
+	n.Close()
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '1700000000.{}' | openssl dgst -sha256 -hmac secret
+	assert.Equal(t,
+		"sha256=b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163",
+		Sign("secret", "1700000000", []byte("{}")),
+	)
+	assert.NotEqual(t, Sign("secret", "1700000000", []byte("{}")), Sign("secret", "1700000001", []byte("{}")))
+}
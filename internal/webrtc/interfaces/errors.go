@@ -0,0 +1,57 @@
+package interfaces
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Errors captures and recordings fail with, as reported in CloseResult (Err
+// and TrackErrors). They wrap what caused them: match them with errors.Is.
+var (
+	// ErrTrackNotFound is returned when a requested track isn't published
+	ErrTrackNotFound = errors.New("track not found")
+	// ErrCodecUnsupported is returned when a track's codec can't be recorded,
+	// or isn't allowed
+	ErrCodecUnsupported = errors.New("codec not supported")
+	// ErrSubscriptionFailed is returned when subscribing to a track fails
+	ErrSubscriptionFailed = errors.New("track subscription failed")
+	// ErrLiveKitDisconnected is returned when the capture is disconnected
+	// from the LiveKit room for good
+	ErrLiveKitDisconnected = errors.New("disconnected from LiveKit room")
+	// ErrDiskFull is returned when the recording can't be written for lack
+	// of space
+	ErrDiskFull = errors.New("disk full")
+	// ErrWriteFailed is returned when the recording can't be written for any
+	// other reason
+	ErrWriteFailed = errors.New("failed to write recording")
+)
+
+// TrackError is an error of a single track
+type TrackError struct {
+	TrackID string
+	Err     error
+}
+
+func (e *TrackError) Error() string {
+	return fmt.Sprintf("track %s: %v", e.TrackID, e.Err)
+}
+
+func (e *TrackError) Unwrap() error {
+	return e.Err
+}
+
+// NewTrackError returns err as an error of track trackID
+func NewTrackError(trackID string, err error) error {
+	return &TrackError{TrackID: trackID, Err: err}
+}
+
+// WriteError returns err, a failure to write the recording, as ErrDiskFull or
+// ErrWriteFailed
+func WriteError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		return fmt.Errorf("%w: %w", ErrDiskFull, err)
+	}
+
+	return fmt.Errorf("%w: %w", ErrWriteFailed, err)
+}
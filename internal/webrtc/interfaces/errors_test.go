@@ -0,0 +1,37 @@
+package interfaces
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrackError(t *testing.T) {
+	err := fmt.Errorf("closing: %w", NewTrackError("TR_1", fmt.Errorf("%w: video/h265", ErrCodecUnsupported)))
+	assert.EqualError(t, err, "closing: track TR_1: codec not supported: video/h265")
+	assert.ErrorIs(t, err, ErrCodecUnsupported)
+
+	var trackErr *TrackError
+	require.ErrorAs(t, err, &trackErr)
+	assert.Equal(t, "TR_1", trackErr.TrackID)
+}
+
+func TestWriteError(t *testing.T) {
+	full := &os.PathError{Op: "write", Path: "rec.webm", Err: syscall.ENOSPC}
+	err := WriteError(full)
+	assert.ErrorIs(t, err, ErrDiskFull)
+	assert.NotErrorIs(t, err, ErrWriteFailed)
+	assert.ErrorIs(t, err, syscall.ENOSPC, "The cause is kept")
+
+	var pathErr *os.PathError
+	assert.ErrorAs(t, err, &pathErr)
+
+	err = WriteError(errors.New("I/O error"))
+	assert.ErrorIs(t, err, ErrWriteFailed)
+	assert.NotErrorIs(t, err, ErrDiskFull)
+}
@@ -1,20 +1,100 @@
 package interfaces
 
 import (
+	"errors"
 	"time"
 
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/utils"
 )
 
+// Reasons a LiveKit capture ended, as reported in CloseResult
+const (
+	CloseReasonNormal          = "stopped"
+	CloseReasonMaxDuration     = "max_duration"
+	CloseReasonTrackEnded      = "track_ended"
+	CloseReasonDisconnected    = "disconnected"
+	CloseReasonReconnectFailed = "reconnect_failed"
+	CloseReasonInitFailed      = "init_failed"
+	CloseReasonError           = "error"
+	// See config.Timeouts
+	CloseReasonConnectTimeout    = "connect_timeout"
+	CloseReasonSubscribeTimeout  = "subscribe_timeout"
+	CloseReasonFirstMediaTimeout = "first_media_timeout"
+)
+
+// ReasonError is an error reported along with the machine-readable reason
+// it's for, one of the CloseReason values
+type ReasonError struct {
+	Reason string
+	Err    error
+}
+
+func (e *ReasonError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ReasonError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorReason returns the reason err was reported with, fallback if none
+func ErrorReason(err error, fallback string) string {
+	var reasonErr *ReasonError
+
+	if errors.As(err, &reasonErr) {
+		return reasonErr.Reason
+	}
+
+	return fallback
+}
+
+// CloseResult describes how a capture ended
+type CloseResult struct {
+	// Reason is the first terminal condition hit, CloseReasonNormal if the
+	// capture was just stopped
+	Reason   string
+	Duration time.Duration
+	// Stats are the recorder's final stats, nil if there's no recorder
+	Stats *types.RecorderStats
+	// Err is the terminal error, if any
+	Err error
+	// TrackErrors are why requested tracks weren't recorded (e.g. never
+	// published), by track ID
+	TrackErrors map[string]error
+	// Warnings are what went wrong without ending the capture in error,
+	// e.g. the recording left unfinished past the flush deadline
+	Warnings []string
+}
+
+// MediaEvent is a milestone in a track's media: its first packet, or its
+// first keyframe written to the recording
+type MediaEvent struct {
+	TrackID string
+	Kind    string
+	// Timestamp is when it happened, relative to the capture start like flow
+	// callback timestamps
+	Timestamp time.Duration
+	// RTPTimestamp of the packet (first packet only)
+	RTPTimestamp uint32
+	// MediaTimestamp is the position in the recording (first keyframe only)
+	MediaTimestamp time.Duration
+}
+
 // LiveKitWebRTCInterface is an interface wrapper for mocking
 type LiveKitWebRTCInterface interface {
 	SetConnectionStateCallback(callback func(state utils.ConnectionState))
 	SetFlowCallback(callback func(isFlowing bool, timestamp time.Duration, closed bool))
+	SetStopCallback(callback func(reason string))
+	SetFirstPacketCallback(callback func(event MediaEvent))
+	SetFirstKeyframeCallback(callback func(event MediaEvent))
 	Init() error
 	Close() time.Duration
+	CloseWithResult() *CloseResult
 	GetStats() *appstats.CaptureStats
 	RequestKeyframe()
 	RequestKeyframeForSSRC(ssrc uint32)
 	HasTrack(trackID string) bool
+	SetEncryptionKey(key string, index uint8) error
 }
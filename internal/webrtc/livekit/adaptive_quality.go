@@ -0,0 +1,265 @@
+package livekit
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/livekit/protocol/livekit"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+)
+
+// maxQualitySwitches bounds the switches kept in a track's stats
+const maxQualitySwitches = 100
+
+// A layer stepped down from for going over the budget is only switched back
+// to after this long, so tracks don't keep flapping between two layers
+const qualityRetryBackoff = time.Minute
+
+// Reasons of quality switches, as in appstats.QualitySwitch
+const (
+	qualitySwitchInitial     = "initial"
+	qualitySwitchOverBudget  = "over_budget"
+	qualitySwitchUnderBudget = "under_budget"
+)
+
+// ValidateAdaptiveQuality checks the adaptive quality configuration
+// (recordings may enable it even if it isn't by default)
+func ValidateAdaptiveQuality(cfg config.AdaptiveQuality) error {
+	if cfg.MaxBitrate == 0 {
+		return errors.New("adaptive quality without a max bitrate")
+	}
+
+	if cfg.Interval <= 0 {
+		return fmt.Errorf("invalid adaptive quality interval %s", cfg.Interval)
+	}
+
+	return nil
+}
+
+// adaptiveQuality is the simulcast layer of a video track adapting to its
+// share of the bitrate budget (see config.AdaptiveQuality). LiveKit's Go SDK
+// has no adaptive stream of its own: layers are switched with explicit
+// quality settings, as they'd be on request.
+type adaptiveQuality struct {
+	pub *lksdk.RemoteTrackPublication
+	// The layers published, as currently advertised
+	layers func() []*livekit.VideoLayer
+	// The highest layer switched to, as requested
+	ceiling    livekit.VideoQuality
+	quality    livekit.VideoQuality
+	switchedAt time.Time
+	// What the bitrate is measured from, as counted by bitrateStats
+	windowStart time.Time
+	windowBytes uint64
+	// The layer last stepped down from for going over the budget, and when
+	overshot   livekit.VideoQuality
+	overshotAt time.Time
+}
+
+// adaptiveLayers returns the layers published a track may switch to, from
+// the lowest to the highest
+func adaptiveLayers(layers []*livekit.VideoLayer, ceiling livekit.VideoQuality) []*livekit.VideoLayer {
+	candidates := make([]*livekit.VideoLayer, 0, len(layers))
+
+	for _, layer := range layers {
+		if layer != nil && layer.Quality != livekit.VideoQuality_OFF && layer.Quality <= ceiling {
+			candidates = append(candidates, layer)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Quality < candidates[j].Quality
+	})
+
+	return candidates
+}
+
+// fitVideoLayer returns the highest of the candidates whose advertised
+// bitrate fits budget, the lowest if none does
+func fitVideoLayer(candidates []*livekit.VideoLayer, budget uint64) *livekit.VideoLayer {
+	for i := len(candidates) - 1; i > 0; i-- {
+		if bitrate := uint64(candidates[i].Bitrate); bitrate > 0 && bitrate <= budget {
+			return candidates[i]
+		}
+	}
+
+	return candidates[0]
+}
+
+// next returns the layer to switch to, measured at bitrate against budget,
+// and why; nil to stay on the current one
+func (a *adaptiveQuality) next(candidates []*livekit.VideoLayer, bitrate, budget uint64, now time.Time) (*livekit.VideoLayer, string) {
+	current := -1
+
+	for i, layer := range candidates {
+		if layer.Quality == a.quality {
+			current = i
+		}
+	}
+
+	// The layer subscribed to isn't published any longer
+	if current < 0 {
+		return fitVideoLayer(candidates, budget), qualitySwitchOverBudget
+	}
+
+	if bitrate > budget {
+		if current == 0 {
+			return nil, ""
+		}
+
+		return candidates[current-1], qualitySwitchOverBudget
+	}
+
+	if current == len(candidates)-1 {
+		return nil, ""
+	}
+
+	up := candidates[current+1]
+
+	if advertised := uint64(up.Bitrate); advertised == 0 || advertised > budget {
+		return nil, ""
+	}
+
+	if up.Quality == a.overshot && now.Sub(a.overshotAt) < qualityRetryBackoff {
+		return nil, ""
+	}
+
+	return up, qualitySwitchUnderBudget
+}
+
+// qualityBudget returns the share of the bitrate budget of trackID: the
+// budget is shared by the adapting tracks being read, which ended ones
+// aren't, and trackID
+// Locked
+func (w *LiveKitWebRTC) qualityBudget(trackID string) uint64 {
+	tracks := 0
+
+	for id := range w.adaptive {
+		if id == trackID || w.readingTracks[id] != nil {
+			tracks++
+		}
+	}
+
+	return w.cfg.AdaptiveQuality.MaxBitrate / uint64(max(tracks, 1))
+}
+
+// setAdaptiveVideoLayer subscribes to the layer of a video track that fits
+// its share of the budget, up to the one requested, and adapts it from then
+// on. Returns false if the track advertises no layer to adapt.
+func (w *LiveKitWebRTC) setAdaptiveVideoLayer(pub *lksdk.RemoteTrackPublication) bool {
+	layers := pub.TrackInfo().GetLayers()
+	ceiling, _ := selectVideoLayer(layers, w.layerPref)
+
+	if ceiling == nil {
+		return false
+	}
+
+	candidates := adaptiveLayers(layers, ceiling.Quality)
+	now := w.clock.Now()
+
+	w.m.Lock()
+	a := &adaptiveQuality{
+		pub: pub,
+		layers: func() []*livekit.VideoLayer {
+			return pub.TrackInfo().GetLayers()
+		},
+		ceiling:    ceiling.Quality,
+		switchedAt: now,
+	}
+	w.adaptive[pub.SID()] = a
+	budget := w.qualityBudget(pub.SID())
+	layer := fitVideoLayer(candidates, budget)
+	w.recordQualitySwitch(pub.SID(), a, layer, qualitySwitchInitial, 0, budget, now)
+	w.m.Unlock()
+
+	_ = pub.SetVideoQuality(layer.Quality)
+	w.rec.SetVideoLayer(qualityName(layer.Quality), layer.Width, layer.Height)
+
+	return true
+}
+
+// adaptQuality measures the bitrate of an adapting video track, as counted by
+// bs, returning the layer to switch it to once an interval is over, if any
+// Locked
+func (w *LiveKitWebRTC) adaptQuality(trackID string, bs *bitrateStats, now time.Time) (*lksdk.RemoteTrackPublication, *livekit.VideoLayer) {
+	a, ok := w.adaptive[trackID]
+
+	if !ok {
+		return nil, nil
+	}
+
+	if a.windowStart.IsZero() {
+		a.windowStart, a.windowBytes = now, bs.bytes
+		return nil, nil
+	}
+
+	elapsed := now.Sub(a.windowStart)
+
+	if elapsed < w.cfg.AdaptiveQuality.Interval {
+		return nil, nil
+	}
+
+	bitrate := bitsPerSecond(bs.bytes-a.windowBytes, elapsed)
+	a.windowStart, a.windowBytes = now, bs.bytes
+
+	if now.Sub(a.switchedAt) < w.cfg.AdaptiveQuality.MinInterval {
+		return nil, nil
+	}
+
+	candidates := adaptiveLayers(a.layers(), a.ceiling)
+
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	budget := w.qualityBudget(trackID)
+	layer, reason := a.next(candidates, bitrate, budget, now)
+
+	if layer == nil {
+		return nil, nil
+	}
+
+	if reason == qualitySwitchOverBudget {
+		a.overshot, a.overshotAt = a.quality, now
+	}
+
+	w.recordQualitySwitch(trackID, a, layer, reason, bitrate, budget, now)
+
+	return a.pub, layer
+}
+
+// recordQualitySwitch switches a track to layer in its state and stats
+// Locked
+func (w *LiveKitWebRTC) recordQualitySwitch(trackID string, a *adaptiveQuality, layer *livekit.VideoLayer, reason string, bitrate, budget uint64, now time.Time) {
+	a.quality = layer.Quality
+	a.switchedAt = now
+
+	if stats, ok := w.trackStats[trackID]; ok {
+		stats.Quality = qualityName(layer.Quality)
+		stats.QualitySwitches = append(stats.QualitySwitches, appstats.QualitySwitch{
+			Time:       now.UnixMilli(),
+			Quality:    qualityName(layer.Quality),
+			Width:      layer.Width,
+			Height:     layer.Height,
+			Reason:     reason,
+			BitrateBps: bitrate,
+			BudgetBps:  budget,
+		})
+
+		if n := len(stats.QualitySwitches); n > maxQualitySwitches {
+			stats.QualitySwitches = stats.QualitySwitches[n-maxQualitySwitches:]
+		}
+	}
+
+	w.logger.WithField("trackID", trackID).
+		WithField("quality", qualityName(layer.Quality)).
+		WithField("resolution", fmt.Sprintf("%dx%d", layer.Width, layer.Height)).
+		WithField("reason", reason).
+		WithField("bitrate", bitrate).
+		WithField("budget", budget).
+		Info("Switched recorded video layer")
+}
@@ -0,0 +1,128 @@
+package livekit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/livekit/protocol/livekit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testQualityLayers = []*livekit.VideoLayer{
+	{Quality: livekit.VideoQuality_HIGH, Width: 1280, Height: 720, Bitrate: 1500000},
+	{Quality: livekit.VideoQuality_LOW, Width: 320, Height: 180, Bitrate: 150000},
+	{Quality: livekit.VideoQuality_MEDIUM, Width: 640, Height: 360, Bitrate: 500000},
+}
+
+func TestValidateAdaptiveQuality(t *testing.T) {
+	assert.NoError(t, ValidateAdaptiveQuality(config.AdaptiveQuality{MaxBitrate: 1000000, Interval: time.Second}))
+	assert.Error(t, ValidateAdaptiveQuality(config.AdaptiveQuality{Interval: time.Second}))
+	assert.Error(t, ValidateAdaptiveQuality(config.AdaptiveQuality{MaxBitrate: 1000000}))
+}
+
+func TestFitVideoLayer(t *testing.T) {
+	candidates := adaptiveLayers(testQualityLayers, livekit.VideoQuality_HIGH)
+	require.Len(t, candidates, 3)
+	assert.Equal(t, livekit.VideoQuality_LOW, candidates[0].Quality, "Lowest first")
+
+	assert.Equal(t, livekit.VideoQuality_HIGH, fitVideoLayer(candidates, 2000000).Quality)
+	assert.Equal(t, livekit.VideoQuality_MEDIUM, fitVideoLayer(candidates, 1000000).Quality)
+	assert.Equal(t, livekit.VideoQuality_LOW, fitVideoLayer(candidates, 100000).Quality, "Lowest if none fits")
+
+	// Up to the layer requested
+	candidates = adaptiveLayers(testQualityLayers, livekit.VideoQuality_MEDIUM)
+	assert.Equal(t, livekit.VideoQuality_MEDIUM, fitVideoLayer(candidates, 2000000).Quality)
+}
+
+func TestAdaptiveQuality_Next(t *testing.T) {
+	candidates := adaptiveLayers(testQualityLayers, livekit.VideoQuality_HIGH)
+	now := time.Now()
+	a := &adaptiveQuality{quality: livekit.VideoQuality_HIGH}
+
+	layer, reason := a.next(candidates, 1200000, 1000000, now)
+	require.NotNil(t, layer)
+	assert.Equal(t, livekit.VideoQuality_MEDIUM, layer.Quality)
+	assert.Equal(t, qualitySwitchOverBudget, reason)
+
+	a.quality = livekit.VideoQuality_LOW
+	layer, _ = a.next(candidates, 200000, 100000, now)
+	assert.Nil(t, layer, "Already on the lowest layer")
+
+	layer, reason = a.next(candidates, 140000, 1000000, now)
+	require.NotNil(t, layer)
+	assert.Equal(t, livekit.VideoQuality_MEDIUM, layer.Quality)
+	assert.Equal(t, qualitySwitchUnderBudget, reason)
+
+	a.quality = livekit.VideoQuality_MEDIUM
+	layer, _ = a.next(candidates, 450000, 1000000, now)
+	assert.Nil(t, layer, "The next layer doesn't fit")
+
+	// A layer stepped down from waits before being tried again
+	a.overshot, a.overshotAt = livekit.VideoQuality_HIGH, now
+	layer, _ = a.next(candidates, 450000, 2000000, now.Add(time.Second))
+	assert.Nil(t, layer)
+	layer, _ = a.next(candidates, 450000, 2000000, now.Add(qualityRetryBackoff))
+	require.NotNil(t, layer)
+	assert.Equal(t, livekit.VideoQuality_HIGH, layer.Quality)
+}
+
+func TestAdaptQuality(t *testing.T) {
+	lk, _ := setupMockLK()
+	lk.cfg.AdaptiveQuality = config.AdaptiveQuality{
+		Enabled:     true,
+		MaxBitrate:  1000000,
+		Interval:    time.Second,
+		MinInterval: 5 * time.Second,
+	}
+	lk.adaptive = make(map[string]*adaptiveQuality)
+	trackID := lk.trackIds[0]
+	start := time.Now()
+	a := &adaptiveQuality{
+		layers:  func() []*livekit.VideoLayer { return testQualityLayers },
+		ceiling: livekit.VideoQuality_HIGH,
+	}
+	lk.adaptive[trackID] = a
+	lk.recordQualitySwitch(trackID, a, testQualityLayers[2], qualitySwitchInitial, 0, lk.qualityBudget(trackID), start)
+	bs := newBitrateStats()
+	// Bytes at bits/s over d
+	send := func(bps uint64, d time.Duration) {
+		bs.bytes += uint64(float64(bps/8) * d.Seconds())
+	}
+
+	_, layer := lk.adaptQuality(trackID, bs, start)
+	assert.Nil(t, layer, "Starts measuring")
+
+	// Over budget, but switched too recently
+	send(1200000, time.Second)
+	_, layer = lk.adaptQuality(trackID, bs, start.Add(time.Second))
+	assert.Nil(t, layer)
+
+	send(1200000, 5*time.Second)
+	_, layer = lk.adaptQuality(trackID, bs, start.Add(6*time.Second))
+	require.NotNil(t, layer)
+	assert.Equal(t, livekit.VideoQuality_LOW, layer.Quality)
+
+	stats := lk.trackStats[trackID]
+	assert.Equal(t, "low", stats.Quality)
+	require.Len(t, stats.QualitySwitches, 2)
+	assert.Equal(t, qualitySwitchInitial, stats.QualitySwitches[0].Reason)
+	last := stats.QualitySwitches[1]
+	assert.Equal(t, qualitySwitchOverBudget, last.Reason)
+	assert.Equal(t, uint64(1200000), last.BitrateBps)
+	assert.Equal(t, uint64(1000000), last.BudgetBps)
+	assert.Equal(t, uint32(320), last.Width)
+
+	// Back up once the medium layer fits, after backing off
+	send(150000, 5*time.Second)
+	_, layer = lk.adaptQuality(trackID, bs, start.Add(11*time.Second))
+	assert.Nil(t, layer)
+
+	retry := start.Add(6*time.Second + qualityRetryBackoff)
+	send(150000, retry.Sub(start.Add(11*time.Second)))
+	_, layer = lk.adaptQuality(trackID, bs, retry)
+	require.NotNil(t, layer)
+	assert.Equal(t, livekit.VideoQuality_MEDIUM, layer.Quality)
+	assert.Equal(t, "medium", stats.Quality)
+}
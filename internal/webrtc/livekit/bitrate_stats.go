@@ -0,0 +1,100 @@
+package livekit
+
+import (
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/utils"
+	"github.com/pion/rtp"
+)
+
+const (
+	// Peak bitrate is the highest average over windows of this length
+	bitrateWindow = time.Second
+	// How far back (in packets) duplicates are recognized
+	bitrateSeqHistory = 1024
+)
+
+// bitrateStats accumulates the bytes (RTP header + payload) received on a
+// track. Packets are identified by their unwrapped sequence number, so
+// retransmits of already counted packets aren't counted again.
+type bitrateStats struct {
+	su      *utils.SequenceUnwrapper
+	ssrc    uint32
+	started bool
+	maxSeq  int64
+	// Unwrapped sequence numbers + 1 of recent packets, by seq % bitrateSeqHistory
+	seen [bitrateSeqHistory]int64
+
+	bytes       uint64
+	firstPacket time.Time
+	lastPacket  time.Time
+	windowStart time.Time
+	windowBytes uint64
+	peakBps     uint64
+}
+
+func newBitrateStats() *bitrateStats {
+	return &bitrateStats{
+		su: utils.NewSequenceUnwrapper(16),
+	}
+}
+
+func (s *bitrateStats) onRTP(packet *rtp.Packet, arrival time.Time) {
+	// A new SSRC (e.g. after a reconnect) restarts sequence numbers
+	if s.started && packet.SSRC != s.ssrc {
+		s.su = utils.NewSequenceUnwrapper(16)
+		s.started = false
+		clear(s.seen[:])
+	}
+
+	seq := s.su.Unwrap(uint64(packet.SequenceNumber))
+
+	if !s.started {
+		s.started = true
+		s.ssrc = packet.SSRC
+		s.maxSeq = seq
+	} else if seq <= s.maxSeq-bitrateSeqHistory || s.seen[seq%bitrateSeqHistory] == seq+1 {
+		return
+	} else if seq > s.maxSeq {
+		s.maxSeq = seq
+	}
+
+	s.seen[seq%bitrateSeqHistory] = seq + 1
+	size := uint64(packet.MarshalSize())
+	s.bytes += size
+
+	if s.firstPacket.IsZero() {
+		s.firstPacket = arrival
+		s.windowStart = arrival
+	}
+
+	s.lastPacket = arrival
+
+	if elapsed := arrival.Sub(s.windowStart); elapsed >= bitrateWindow {
+		s.peakBps = max(s.peakBps, bitsPerSecond(s.windowBytes, elapsed))
+		s.windowStart = arrival
+		s.windowBytes = 0
+	}
+
+	s.windowBytes += size
+}
+
+func (s *bitrateStats) avgBps() uint64 {
+	return bitsPerSecond(s.bytes, s.lastPacket.Sub(s.firstPacket))
+}
+
+func (s *bitrateStats) apply(stats *appstats.AdapterTrackStats) {
+	stats.BytesReceived = s.bytes
+	stats.AvgBitrateBps = s.avgBps()
+	// Recordings shorter than a window only have their average to go by
+	stats.PeakBitrateBps = max(s.peakBps, stats.AvgBitrateBps)
+}
+
+func bitsPerSecond(bytes uint64, elapsed time.Duration) uint64 {
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return uint64(float64(bytes*8) / elapsed.Seconds())
+}
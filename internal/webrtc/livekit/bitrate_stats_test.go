@@ -0,0 +1,68 @@
+package livekit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBitrateStats(t *testing.T) {
+	bs := newBitrateStats()
+	start := time.Unix(1700000000, 0)
+	// 12 byte header + 113 byte payload = 1000 bits
+	payload := make([]byte, 113)
+
+	// 100 packets/s for 2s, then 400 packets/s for 2s, across the sequence
+	// number wraparound
+	seq := uint16(65400)
+	at := start
+
+	for i := 0; i < 1000; i++ {
+		if i < 200 {
+			at = start.Add(time.Duration(i) * 10 * time.Millisecond)
+		} else {
+			at = start.Add(2*time.Second + time.Duration(i-200)*2500*time.Microsecond)
+		}
+
+		bs.onRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 1, SequenceNumber: seq}, Payload: payload}, at)
+		seq++
+	}
+
+	// Retransmits of packets already counted, before and after the wraparound
+	for _, dup := range []uint16{65500, 10, seq - 1} {
+		bs.onRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 1, SequenceNumber: dup}, Payload: payload}, at)
+	}
+
+	stats := &appstats.AdapterTrackStats{}
+	bs.apply(stats)
+
+	assert.Equal(t, uint64(1000*125), stats.BytesReceived)
+	assert.InDelta(t, 1000*1000/4.0, float64(stats.AvgBitrateBps), 1000)
+	assert.InDelta(t, 400*1000, float64(stats.PeakBitrateBps), 5000)
+
+	// A new SSRC restarts sequence numbers: its packets are new
+	bs.onRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 2, SequenceNumber: 10}, Payload: payload}, at)
+	bs.apply(stats)
+	assert.Equal(t, uint64(1001*125), stats.BytesReceived)
+}
+
+func TestBitrateStats_ShortRecording(t *testing.T) {
+	bs := newBitrateStats()
+	start := time.Unix(1700000000, 0)
+	stats := &appstats.AdapterTrackStats{}
+
+	bs.apply(stats)
+	assert.Zero(t, stats.AvgBitrateBps)
+
+	for i := 0; i < 11; i++ {
+		bs.onRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: uint16(i)}, Payload: make([]byte, 113)},
+			start.Add(time.Duration(i)*50*time.Millisecond))
+	}
+
+	bs.apply(stats)
+	assert.Equal(t, uint64(11*125*8*2), stats.AvgBitrateBps)
+	assert.Equal(t, stats.AvgBitrateBps, stats.PeakBitrateBps, "Peak falls back to the average")
+}
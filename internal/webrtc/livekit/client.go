@@ -0,0 +1,134 @@
+package livekit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/livekit/protocol/auth"
+	"github.com/livekit/protocol/livekit"
+)
+
+// Cached tokens are reissued once they're valid for less than this, so a
+// room joined with one doesn't outlive it
+const tokenRefreshMargin = time.Hour
+
+type clientKey struct {
+	host      string
+	apiKey    string
+	apiSecret string
+}
+
+type tokenKey struct {
+	room     string
+	identity string
+}
+
+type cachedToken struct {
+	jwt       string
+	expiresAt time.Time
+}
+
+// client is what the sessions recording rooms of the same LiveKit
+// deployment share. The SDK gives every room its own signalling connection
+// and peer connections, so there is nothing to pool there: what's shared is
+// issuing the access tokens, once per room and identity, reused (e.g. when
+// reconnecting) until they get close to expiring.
+type client struct {
+	cfg config.LiveKit
+	now func() time.Time
+
+	mu     sync.Mutex
+	tokens map[tokenKey]cachedToken
+}
+
+var (
+	clientsMu sync.Mutex
+	clients   = make(map[clientKey]*client)
+)
+
+// clientFor returns the client of the deployment cfg's credentials are for
+func clientFor(cfg config.LiveKit) *client {
+	key := clientKey{host: cfg.Host, apiKey: cfg.APIKey, apiSecret: cfg.APISecret}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	if c, ok := clients[key]; ok {
+		return c
+	}
+
+	c := &client{
+		cfg:    cfg,
+		now:    time.Now,
+		tokens: make(map[tokenKey]cachedToken),
+	}
+	clients[key] = c
+
+	return c
+}
+
+// recorderToken returns a token joining room as identity, hidden and
+// subscribe-only
+func (c *client) recorderToken(room, identity string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	key := tokenKey{room: room, identity: identity}
+
+	if token, ok := c.tokens[key]; ok && token.expiresAt.Sub(now) > tokenRefreshMargin {
+		appstats.OnLiveKitToken(true)
+		return token.jwt, nil
+	}
+
+	// Those of sessions that didn't release them
+	for key, token := range c.tokens {
+		if !token.expiresAt.After(now) {
+			delete(c.tokens, key)
+		}
+	}
+
+	jwt, err := buildRecorderToken(c.cfg, room, identity)
+
+	if err != nil {
+		return "", err
+	}
+
+	c.tokens[key] = cachedToken{jwt: jwt, expiresAt: now.Add(tokenTTL)}
+	appstats.OnLiveKitToken(false)
+
+	return jwt, nil
+}
+
+// release forgets the token of a session done with room
+func (c *client) release(room, identity string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.tokens, tokenKey{room: room, identity: identity})
+}
+
+func buildRecorderToken(cfg config.LiveKit, roomName string, identity string) (string, error) {
+	f := false
+	t := true
+	grant := &auth.VideoGrant{
+		RoomJoin:       true,
+		Room:           roomName,
+		CanSubscribe:   &t,
+		CanPublish:     &f,
+		CanPublishData: &f,
+		Hidden:         true,
+		Recorder:       true,
+	}
+
+	at := auth.NewAccessToken(cfg.APIKey, cfg.APISecret).
+		SetVideoGrant(grant).
+		SetIdentity(identity).
+		SetKind(livekit.ParticipantInfo_EGRESS).
+		SetValidFor(tokenTTL).
+		SetMetadata(baseSystemMetadata)
+
+	return at.ToJWT()
+}
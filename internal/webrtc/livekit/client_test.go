@@ -0,0 +1,72 @@
+package livekit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/livekit/protocol/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientFor(t *testing.T) {
+	cfg := config.LiveKit{Host: "ws://client-for:7880", APIKey: "key", APISecret: "secret"}
+	c := clientFor(cfg)
+
+	other := cfg
+	other.RecordNTPMapping = true
+	assert.Same(t, c, clientFor(other), "Shared by the same credentials")
+
+	other.APIKey = "other"
+	assert.NotSame(t, c, clientFor(other))
+
+	other = cfg
+	other.Host = "ws://other:7880"
+	assert.NotSame(t, c, clientFor(other))
+}
+
+func TestClient_RecorderToken(t *testing.T) {
+	cfg := config.LiveKit{Host: "ws://recorder-token:7880", APIKey: "key", APISecret: "secretsecretsecretsecretsecretsecret"}
+	c := clientFor(cfg)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	token, err := c.recorderToken("room", "identity")
+	require.NoError(t, err)
+
+	verifier, err := auth.ParseAPIToken(token)
+	require.NoError(t, err)
+	assert.Equal(t, "identity", verifier.Identity())
+	grants, err := verifier.Verify(cfg.APISecret)
+	require.NoError(t, err)
+	assert.Equal(t, "room", grants.Video.Room)
+	assert.True(t, grants.Video.Hidden)
+
+	// Reused, e.g. when reconnecting
+	now = now.Add(time.Second)
+	reused, err := c.recorderToken("room", "identity")
+	require.NoError(t, err)
+	assert.Equal(t, token, reused)
+
+	other, err := c.recorderToken("room", "other")
+	require.NoError(t, err)
+	assert.NotEqual(t, token, other)
+	assert.Len(t, c.tokens, 2)
+
+	// Reissued once close to expiring
+	now = now.Add(tokenTTL - tokenRefreshMargin)
+	_, err = c.recorderToken("room", "identity")
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(tokenTTL), c.tokens[tokenKey{room: "room", identity: "identity"}].expiresAt)
+
+	// Expired tokens of sessions that didn't release them are dropped
+	now = now.Add(tokenRefreshMargin)
+	_, err = c.recorderToken("another-room", "identity")
+	require.NoError(t, err)
+	assert.NotContains(t, c.tokens, tokenKey{room: "room", identity: "other"})
+
+	c.release("room", "identity")
+	c.release("another-room", "identity")
+	assert.Empty(t, c.tokens)
+}
@@ -0,0 +1,159 @@
+package livekit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+)
+
+// dataMessage is a line of the data capture file. Payloads that aren't
+// UTF-8 text are base64 encoded in PayloadBase64 instead.
+type dataMessage struct {
+	Time          int64  `json:"time"` // Unix ms
+	OffsetMs      int64  `json:"offsetMs"`
+	ParticipantID string `json:"participantId"`
+	Topic         string `json:"topic,omitempty"`
+	Payload       string `json:"payload,omitempty"`
+	PayloadBase64 []byte `json:"payloadBase64,omitempty"`
+}
+
+// dataCapture writes the room's data messages next to the recording (see
+// config.DataCapture). The file is created with the first message.
+type dataCapture struct {
+	topics []string
+
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	encoder  *json.Encoder
+	messages int
+	// Set once closed, or if the file can't be created
+	done bool
+}
+
+func newDataCapture(cfg config.DataCapture) *dataCapture {
+	return &dataCapture{topics: cfg.Topics}
+}
+
+// dataCapturePath is where the data messages of a recording go, e.g.
+// recording-data.jsonl for recording.webm
+func dataCapturePath(recordingPath string) string {
+	return strings.TrimSuffix(recordingPath, filepath.Ext(recordingPath)) + "-data.jsonl"
+}
+
+func (c *dataCapture) captures(topic string) bool {
+	return len(c.topics) == 0 || slices.Contains(c.topics, topic)
+}
+
+// write appends a message. Recordings streamed to a writer have no path to
+// put the file next to, so messages are dropped.
+func (c *dataCapture) write(recordingPath string, message *dataMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.done || recordingPath == "" || recordingPath == os.DevNull {
+		return nil
+	}
+
+	if c.file == nil {
+		// Same mode as the recording, if already created
+		mode := os.FileMode(0600)
+
+		if info, err := os.Stat(recordingPath); err == nil {
+			mode = info.Mode().Perm()
+		}
+
+		path := dataCapturePath(recordingPath)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, mode)
+
+		if err != nil {
+			c.done = true
+			return fmt.Errorf("failed to create data capture file: %w", err)
+		}
+
+		c.path = path
+		c.file = file
+		c.encoder = json.NewEncoder(file)
+	}
+
+	if err := c.encoder.Encode(message); err != nil {
+		return fmt.Errorf("failed to write data message: %w", err)
+	}
+
+	c.messages++
+
+	return nil
+}
+
+// stats returns the file written, if any, and how many messages it holds
+func (c *dataCapture) stats() (string, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.path, c.messages
+}
+
+func (c *dataCapture) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		return nil
+	}
+
+	err := c.file.Close()
+	c.file = nil
+	c.encoder = nil
+	c.done = true
+
+	return err
+}
+
+// onDataPacket captures the user data messages of the room, aligned to the
+// media timestamp of the recording they were received at
+func (w *LiveKitWebRTC) onDataPacket(data lksdk.DataPacket, params lksdk.DataReceiveParams) {
+	packet, ok := data.(*lksdk.UserDataPacket)
+
+	if w.data == nil || !ok || !w.data.captures(packet.Topic) {
+		return
+	}
+
+	offset := max(w.rec.VideoTimestamp(), w.rec.AudioTimestamp())
+	message := &dataMessage{
+		Time:          w.clock.Now().UnixMilli(),
+		OffsetMs:      offset.Milliseconds(),
+		ParticipantID: params.SenderIdentity,
+		Topic:         packet.Topic,
+	}
+
+	if utf8.Valid(packet.Payload) {
+		message.Payload = string(packet.Payload)
+	} else {
+		message.PayloadBase64 = packet.Payload
+	}
+
+	if err := w.data.write(w.rec.GetFilePath(), message); err != nil {
+		w.logger.WithError(err).
+			Error("Failed to capture data message")
+	}
+}
+
+// closeDataCapture is called once the room is left
+func (w *LiveKitWebRTC) closeDataCapture() {
+	if w.data == nil {
+		return
+	}
+
+	if err := w.data.close(); err != nil {
+		w.logger.WithError(err).
+			Warn("Failed to close data capture file")
+	}
+}
@@ -0,0 +1,77 @@
+package livekit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/livekit/protocol/livekit"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataCapturePath(t *testing.T) {
+	assert.Equal(t, "/rec/abc-data.jsonl", dataCapturePath("/rec/abc.webm"))
+}
+
+func TestOnDataPacket(t *testing.T) {
+	lk, rec := setupMockLK()
+	lk.WithClock(clock.NewMock(time.UnixMilli(10000)))
+	lk.data = newDataCapture(config.DataCapture{Enabled: true, Topics: []string{"chat", "annotations"}})
+	rec.filePath = filepath.Join(t.TempDir(), "rec.webm")
+	require.NoError(t, os.WriteFile(rec.filePath, nil, 0640))
+	rec.videoTs = 1500 * time.Millisecond
+	alice := lksdk.DataReceiveParams{SenderIdentity: "alice"}
+
+	lk.onDataPacket(&lksdk.UserDataPacket{Topic: "chat", Payload: []byte(`{"text":"hi"}`)}, alice)
+	lk.onDataPacket(&lksdk.UserDataPacket{Topic: "cursor", Payload: []byte("x")}, alice)
+	lk.onDataPacket(&livekit.SipDTMF{Code: 1}, alice)
+	rec.videoTs = 2 * time.Second
+	lk.onDataPacket(&lksdk.UserDataPacket{Topic: "annotations", Payload: []byte{0xff, 0x00}}, lksdk.DataReceiveParams{SenderIdentity: "bob"})
+
+	path, messages := lk.data.stats()
+	assert.Equal(t, dataCapturePath(rec.filePath), path)
+	assert.Equal(t, 2, messages, "Only user data of the topics captured")
+	assert.Equal(t, path, lk.GetStats().DataFile)
+
+	lk.closeDataCapture()
+	lk.onDataPacket(&lksdk.UserDataPacket{Topic: "chat", Payload: []byte("late")}, alice)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm(), "The recording's mode")
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var lines []dataMessage
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		var message dataMessage
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &message))
+		lines = append(lines, message)
+	}
+
+	assert.Equal(t, []dataMessage{
+		{Time: 10000, OffsetMs: 1500, ParticipantID: "alice", Topic: "chat", Payload: `{"text":"hi"}`},
+		{Time: 10000, OffsetMs: 2000, ParticipantID: "bob", Topic: "annotations", PayloadBase64: []byte{0xff, 0x00}},
+	}, lines, "Nothing written once closed")
+}
+
+func TestOnDataPacket_Disabled(t *testing.T) {
+	lk, rec := setupMockLK()
+	rec.filePath = filepath.Join(t.TempDir(), "rec.webm")
+
+	lk.onDataPacket(&lksdk.UserDataPacket{Payload: []byte("hi")}, lksdk.DataReceiveParams{})
+
+	assert.NoFileExists(t, dataCapturePath(rec.filePath))
+	assert.Empty(t, lk.GetStats().DataFile)
+}
@@ -0,0 +1,193 @@
+package livekit
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+)
+
+// anyTrack stands for the first track to discover while waiting for one
+const anyTrack = "*"
+
+// trackDiscovery adds the room's tracks matching filter to the requested
+// ones as they're published. They're all recorded to the same file, which
+// holds a single video: the first one discovered, or the dominant speaker's
+// when following it.
+type trackDiscovery struct {
+	filter *events.TrackFilter
+	// Set once Init subscribed: later tracks are subscribed to as published
+	started bool
+	// The video track recorded when not following the speaker, and its codec
+	video         string
+	videoMimeType string
+}
+
+// DiscoverTracks makes the capture record the room's tracks filter matches,
+// on top of the requested ones, including those published later. Must be
+// called before Init.
+func (w *LiveKitWebRTC) DiscoverTracks(filter *events.TrackFilter) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	w.discovery = &trackDiscovery{filter: filter}
+}
+
+// requestedTracks returns the tracks to record, those discovered included
+func (w *LiveKitWebRTC) requestedTracks() []string {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	return slices.Clone(w.trackIds)
+}
+
+// discoverTracks adopts the published tracks matching the discovery filter,
+// if any, and returns the tracks to record
+func (w *LiveKitWebRTC) discoverTracks() []string {
+	if w.discovery != nil {
+		for _, rp := range w.room.GetRemoteParticipants() {
+			for _, publication := range rp.TrackPublications() {
+				if pub, ok := publication.(*lksdk.RemoteTrackPublication); ok {
+					w.m.Lock()
+					w.adoptTrack(rp, pub)
+					w.m.Unlock()
+				}
+			}
+		}
+	}
+
+	return w.requestedTracks()
+}
+
+// awaitingDiscovery returns whether no track was discovered yet, nor any
+// requested one subscribed to
+func (w *LiveKitWebRTC) awaitingDiscovery() bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	return w.discovery != nil && len(w.remoteTrackPubs) == 0
+}
+
+// publishedTrack is what discovery looks at in a publication
+type publishedTrack struct {
+	id          string
+	participant string
+	source      string // As in events.TrackSources
+	kind        TrackKind
+	mimeType    string
+}
+
+func newPublishedTrack(rp *lksdk.RemoteParticipant, pub *lksdk.RemoteTrackPublication) publishedTrack {
+	return publishedTrack{
+		id:          pub.SID(),
+		participant: rp.Identity(),
+		source:      strings.ToLower(pub.Source().String()),
+		kind:        TrackKind(pub.Kind()),
+		mimeType:    recorder.NormalizeMimeType(pub.MimeType()),
+	}
+}
+
+// adoptTrack returns whether a publication is to be recorded, adding it to
+// the requested tracks if the discovery filter matches it
+// Locked
+func (w *LiveKitWebRTC) adoptTrack(rp *lksdk.RemoteParticipant, pub *lksdk.RemoteTrackPublication) bool {
+	return w.adopt(newPublishedTrack(rp, pub))
+}
+
+// Locked
+func (w *LiveKitWebRTC) adopt(track publishedTrack) bool {
+	trackID := track.id
+
+	if slices.Contains(w.trackIds, trackID) {
+		return true
+	}
+
+	if w.discovery == nil || !w.discovery.filter.Matches(track.participant, track.source) {
+		return false
+	}
+
+	switch track.kind {
+	case TrackKindVideo:
+		mimeType := track.mimeType
+
+		if !recorder.IsSupportedVideoCodec(mimeType) || !w.videoCodecAllowed(mimeType) {
+			w.logger.WithField("trackID", trackID).
+				Debugf("Not recording discovered track, video codec %s", mimeType)
+
+			return false
+		}
+
+		if w.speaker == nil {
+			if w.discovery.video != "" {
+				return false
+			}
+
+			if w.discovery.videoMimeType != "" && w.discovery.videoMimeType != mimeType {
+				w.logger.WithField("trackID", trackID).
+					Debugf("Not recording discovered track, video codec %s after %s", mimeType, w.discovery.videoMimeType)
+
+				return false
+			}
+
+			w.discovery.video = trackID
+			w.discovery.videoMimeType = mimeType
+		}
+	case TrackKindAudio:
+	default:
+		return false
+	}
+
+	w.trackIds = append(slices.Clip(w.trackIds), trackID)
+	w.trackStats[trackID] = &appstats.AdapterTrackStats{StartTime: w.clock.Now().Unix()}
+
+	w.logger.WithField("trackID", trackID).
+		Infof("Discovered track source=%s kind=%s participant=%s", track.source, track.kind, track.participant)
+
+	return true
+}
+
+// subscribeToDiscoveredTrack subscribes to a track discovered once
+// recording, unless reconnecting: resubscribing picks it up then
+func (w *LiveKitWebRTC) subscribeToDiscoveredTrack(rp *lksdk.RemoteParticipant, pub *lksdk.RemoteTrackPublication) {
+	w.m.Lock()
+	subscribe := w.discovery != nil && w.discovery.started && !w.reconnecting
+	w.m.Unlock()
+
+	if !subscribe {
+		return
+	}
+
+	if err := w.subscribeToTrack(rp, pub); err != nil {
+		w.m.Lock()
+		w.trackErrors[pub.SID()] = err
+		w.m.Unlock()
+
+		w.logger.WithField("trackID", pub.SID()).
+			Warnf("Failed to subscribe to discovered track: %v", err)
+	}
+}
+
+// startDiscovery hands the tracks published from now on over to
+// subscribeToDiscoveredTrack
+func (w *LiveKitWebRTC) startDiscovery() {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.discovery != nil {
+		w.discovery.started = true
+	}
+}
+
+// forgetDiscoveredVideo lets another video be discovered once the recorded
+// one is unpublished
+func (w *LiveKitWebRTC) forgetDiscoveredVideo(trackID string) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.discovery != nil && w.discovery.video == trackID {
+		w.discovery.video = ""
+	}
+}
@@ -0,0 +1,61 @@
+package livekit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdopt(t *testing.T) {
+	lk, _ := setupMockLK()
+
+	camera := publishedTrack{id: "TR_cam", participant: "alice", source: "camera", kind: TrackKindVideo, mimeType: "video/vp8"}
+	assert.False(t, lk.adopt(camera), "Not discovering")
+	assert.True(t, lk.adopt(publishedTrack{id: "test-track"}), "Requested")
+
+	lk.DiscoverTracks(&events.TrackFilter{Participants: []string{"alice", "bob"}})
+
+	assert.True(t, lk.adopt(camera))
+	assert.True(t, lk.adopt(camera), "Already adopted")
+	assert.True(t, lk.adopt(publishedTrack{id: "TR_mic", participant: "alice", source: "microphone", kind: TrackKindAudio, mimeType: "audio/opus"}))
+	assert.True(t, lk.adopt(publishedTrack{id: "TR_mic2", participant: "bob", source: "microphone", kind: TrackKindAudio, mimeType: "audio/opus"}))
+	assert.False(t, lk.adopt(publishedTrack{id: "TR_carol", participant: "carol", source: "microphone", kind: TrackKindAudio, mimeType: "audio/opus"}),
+		"Filtered out")
+	assert.False(t, lk.adopt(publishedTrack{id: "TR_cam2", participant: "bob", source: "camera", kind: TrackKindVideo, mimeType: "video/vp8"}),
+		"A single video")
+
+	assert.Equal(t, []string{"test-track", "TR_cam", "TR_mic", "TR_mic2"}, lk.requestedTracks())
+	assert.True(t, lk.HasTrack("TR_mic2"))
+	assert.Contains(t, lk.trackStats, "TR_mic2")
+
+	// Replaced by another video in the same codec once unpublished
+	lk.forgetDiscoveredVideo("TR_cam")
+	assert.False(t, lk.adopt(publishedTrack{id: "TR_cam2", participant: "bob", source: "camera", kind: TrackKindVideo, mimeType: "video/h264"}))
+	assert.False(t, lk.adopt(publishedTrack{id: "TR_cam3", participant: "bob", source: "camera", kind: TrackKindVideo, mimeType: "video/h265"}))
+	assert.True(t, lk.adopt(publishedTrack{id: "TR_cam4", participant: "bob", source: "camera", kind: TrackKindVideo, mimeType: "video/vp8"}))
+}
+
+func TestAdopt_FollowSpeaker(t *testing.T) {
+	lk, _ := setupMockLK()
+	lk.speaker = newSpeakerSwitcher(time.Second)
+	lk.DiscoverTracks(&events.TrackFilter{Sources: []string{"camera"}})
+
+	assert.True(t, lk.adopt(publishedTrack{id: "TR_cam", participant: "alice", source: "camera", kind: TrackKindVideo, mimeType: "video/vp8"}))
+	assert.True(t, lk.adopt(publishedTrack{id: "TR_cam2", participant: "bob", source: "camera", kind: TrackKindVideo, mimeType: "video/vp8"}),
+		"All videos when following the speaker")
+	assert.False(t, lk.adopt(publishedTrack{id: "TR_screen", participant: "bob", source: "screen_share", kind: TrackKindVideo, mimeType: "video/vp8"}))
+	assert.False(t, lk.adopt(publishedTrack{id: "TR_mic", participant: "bob", source: "microphone", kind: TrackKindAudio, mimeType: "audio/opus"}))
+}
+
+func TestAwaitingDiscovery(t *testing.T) {
+	lk, _ := setupMockLK()
+	assert.False(t, lk.awaitingDiscovery())
+
+	lk.DiscoverTracks(&events.TrackFilter{})
+	assert.True(t, lk.awaitingDiscovery())
+
+	lk.remoteTrackPubs["test-track"] = nil
+	assert.False(t, lk.awaitingDiscovery())
+}
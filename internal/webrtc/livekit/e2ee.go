@@ -0,0 +1,234 @@
+package livekit
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"sync"
+
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+// Bytes at the start of each frame the LiveKit client SDKs leave in the
+// clear (authenticated only) so packetizers can still read them
+const (
+	e2eeUnencryptedAudioBytes    = 1
+	e2eeUnencryptedVP8KeyBytes   = 10
+	e2eeUnencryptedVP8DeltaBytes = 3
+	e2eeFrameTrailerSize         = 2 // IV length + key index
+)
+
+var (
+	errE2EENoKey       = errors.New("track is end-to-end encrypted but no encryption key was provided")
+	errE2EEShortFrame  = errors.New("encrypted frame too short")
+	errE2EEUnsupported = errors.New("end-to-end encrypted recording not supported for this codec")
+)
+
+// frameDecryptor decrypts frames encrypted by the LiveKit client SDKs
+// (AES-GCM, shared key). Keys are held by index, as in the clients' key
+// ring, so the key can be rotated while frames under the old one are
+// still in flight.
+type frameDecryptor struct {
+	m          sync.RWMutex
+	keys       map[uint8]cipher.Block
+	sifTrailer []byte
+}
+
+func newFrameDecryptor() *frameDecryptor {
+	return &frameDecryptor{
+		keys: make(map[uint8]cipher.Block),
+	}
+}
+
+// setKey derives the frame key for index from a shared passphrase, the same
+// way the clients' external key provider does
+func (d *frameDecryptor) setKey(passphrase string, index uint8) error {
+	key, err := lksdk.DeriveKeyFromString(passphrase)
+
+	if err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return err
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.keys[index] = block
+
+	return nil
+}
+
+func (d *frameDecryptor) hasKey() bool {
+	d.m.RLock()
+	defer d.m.RUnlock()
+
+	return len(d.keys) > 0
+}
+
+// setSIFTrailer sets the trailer marking the room's unencrypted server
+// injected frames
+func (d *frameDecryptor) setSIFTrailer(trailer []byte) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.sifTrailer = trailer
+}
+
+func (d *frameDecryptor) isSIF(frame []byte) bool {
+	d.m.RLock()
+	defer d.m.RUnlock()
+
+	return len(d.sifTrailer) > 0 && bytes.HasSuffix(frame, d.sifTrailer)
+}
+
+// decryptFrame decrypts a frame laid out as
+// |header (unencrypted)|ciphertext|IV|IV length|key index|
+func (d *frameDecryptor) decryptFrame(frame []byte, unencrypted int) ([]byte, error) {
+	if len(frame) < unencrypted+e2eeFrameTrailerSize {
+		return nil, errE2EEShortFrame
+	}
+
+	ivLength := int(frame[len(frame)-2])
+	index := frame[len(frame)-1]
+	ivStart := len(frame) - e2eeFrameTrailerSize - ivLength
+
+	if ivLength == 0 || ivStart < unencrypted {
+		return nil, errE2EEShortFrame
+	}
+
+	d.m.RLock()
+	block := d.keys[index]
+	d.m.RUnlock()
+
+	if block == nil {
+		return nil, fmt.Errorf("no encryption key for index %d", index)
+	}
+
+	gcm, err := cipher.NewGCMWithNonceSize(block, ivLength)
+
+	if err != nil {
+		return nil, err
+	}
+
+	header := frame[:unencrypted]
+	plain, err := gcm.Open(nil, frame[ivStart:len(frame)-e2eeFrameTrailerSize], frame[unencrypted:ivStart], header)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt frame with key index %d: %w", index, err)
+	}
+
+	return append(header[:unencrypted:unencrypted], plain...), nil
+}
+
+// decrypt returns the packets of a sample with their frame decrypted.
+// Packets keep their headers so the recorder sees the same sequence; nil
+// means the sample should be dropped (a server injected frame).
+func (d *frameDecryptor) decrypt(mimeType MimeType, packets []*rtp.Packet) ([]*rtp.Packet, error) {
+	switch mimeType {
+	case MimeTypeOpus:
+		// Each audio packet carries a whole frame
+		decrypted := make([]*rtp.Packet, 0, len(packets))
+
+		for _, p := range packets {
+			if d.isSIF(p.Payload) {
+				continue
+			}
+
+			payload, err := d.decryptFrame(p.Payload, e2eeUnencryptedAudioBytes)
+
+			if err != nil {
+				return nil, err
+			}
+
+			decrypted = append(decrypted, withPayload(p, payload))
+		}
+
+		return decrypted, nil
+	case MimeTypeVP8:
+		return d.decryptVP8(packets)
+	default:
+		return nil, errE2EEUnsupported
+	}
+}
+
+// decryptVP8 reassembles a VP8 frame from its packets, decrypts it and
+// spreads it back over the same packets, behind their payload descriptors
+func (d *frameDecryptor) decryptVP8(packets []*rtp.Packet) ([]*rtp.Packet, error) {
+	descriptors := make([]int, len(packets))
+	sizes := make([]int, len(packets))
+	var frame []byte
+
+	for i, p := range packets {
+		var vp8 codecs.VP8Packet
+		data, err := vp8.Unmarshal(p.Payload)
+
+		if err != nil {
+			return nil, err
+		}
+
+		descriptors[i] = len(p.Payload) - len(data)
+		sizes[i] = len(data)
+		frame = append(frame, data...)
+	}
+
+	if len(frame) == 0 {
+		return nil, errE2EEShortFrame
+	}
+
+	if d.isSIF(frame) {
+		return nil, nil
+	}
+
+	unencrypted := e2eeUnencryptedVP8DeltaBytes
+
+	// P bit of the VP8 frame tag clear on keyframes
+	if frame[0]&0x01 == 0 {
+		unencrypted = e2eeUnencryptedVP8KeyBytes
+	}
+
+	plain, err := d.decryptFrame(frame, unencrypted)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(plain) < len(packets) {
+		return nil, errE2EEShortFrame
+	}
+
+	// The frame shrank by the IV, tag and trailer: take it off the last
+	// packets, leaving each at least a byte
+	excess := len(frame) - len(plain)
+
+	for i := len(sizes) - 1; i >= 0 && excess > 0; i-- {
+		take := min(excess, max(sizes[i]-1, 0))
+		sizes[i] -= take
+		excess -= take
+	}
+
+	decrypted := make([]*rtp.Packet, len(packets))
+	offset := 0
+
+	for i, p := range packets {
+		payload := make([]byte, 0, descriptors[i]+sizes[i])
+		payload = append(payload, p.Payload[:descriptors[i]]...)
+		payload = append(payload, plain[offset:offset+sizes[i]]...)
+		offset += sizes[i]
+		decrypted[i] = withPayload(p, payload)
+	}
+
+	return decrypted, nil
+}
+
+func withPayload(p *rtp.Packet, payload []byte) *rtp.Packet {
+	return &rtp.Packet{Header: p.Header.Clone(), Payload: payload}
+}
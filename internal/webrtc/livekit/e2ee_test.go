@@ -0,0 +1,181 @@
+package livekit
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"testing"
+
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encryptTestFrame encrypts a frame the way the LiveKit client SDKs do
+func encryptTestFrame(t *testing.T, passphrase string, index uint8, frame []byte, unencrypted int) []byte {
+	key, err := lksdk.DeriveKeyFromString(passphrase)
+	require.NoError(t, err)
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+
+	iv := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(iv)
+	require.NoError(t, err)
+
+	out := append([]byte{}, frame[:unencrypted]...)
+	out = gcm.Seal(out, iv, frame[unencrypted:], frame[:unencrypted])
+	out = append(out, iv...)
+
+	return append(out, byte(len(iv)), index)
+}
+
+func packetizeTestVP8(t *testing.T, frame []byte, mtu uint16) []*rtp.Packet {
+	payloader := &codecs.VP8Payloader{}
+	payloads := payloader.Payload(mtu, frame)
+	require.Greater(t, len(payloads), 1)
+
+	packets := make([]*rtp.Packet, len(payloads))
+
+	for i, payload := range payloads {
+		packets[i] = &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				SequenceNumber: uint16(100 + i),
+				Timestamp:      9000,
+				Marker:         i == len(payloads)-1,
+			},
+			Payload: payload,
+		}
+	}
+
+	return packets
+}
+
+func depacketizeTestVP8(t *testing.T, packets []*rtp.Packet) []byte {
+	var frame []byte
+
+	for _, p := range packets {
+		var vp8 codecs.VP8Packet
+		data, err := vp8.Unmarshal(p.Payload)
+		require.NoError(t, err)
+		frame = append(frame, data...)
+	}
+
+	return frame
+}
+
+func TestFrameDecryptor_Opus(t *testing.T) {
+	d := newFrameDecryptor()
+	require.NoError(t, d.setKey("passphrase", 0))
+
+	key, err := lksdk.DeriveKeyFromString("passphrase")
+	require.NoError(t, err)
+	sample := []byte{0x78, 1, 2, 3, 4, 5}
+	encrypted, err := lksdk.EncryptGCMAudioSample(sample, key, 0)
+	require.NoError(t, err)
+
+	packets := []*rtp.Packet{{Header: rtp.Header{Version: 2, SequenceNumber: 7}, Payload: encrypted}}
+	decrypted, err := d.decrypt(MimeTypeOpus, packets)
+	require.NoError(t, err)
+	require.Len(t, decrypted, 1)
+	assert.Equal(t, sample, decrypted[0].Payload)
+	assert.Equal(t, uint16(7), decrypted[0].SequenceNumber)
+	assert.Equal(t, encrypted, packets[0].Payload, "Incoming packets are left untouched")
+
+	// Server injected frames are dropped
+	d.setSIFTrailer([]byte{0xAA, 0xBB})
+	packets[0].Payload = []byte{0x78, 0, 0, 0xAA, 0xBB}
+	decrypted, err = d.decrypt(MimeTypeOpus, packets)
+	require.NoError(t, err)
+	assert.Empty(t, decrypted)
+}
+
+func TestFrameDecryptor_VP8(t *testing.T) {
+	d := newFrameDecryptor()
+	require.NoError(t, d.setKey("passphrase", 0))
+
+	for _, keyframe := range []bool{true, false} {
+		frame := make([]byte, 300)
+		_, err := rand.Read(frame)
+		require.NoError(t, err)
+		unencrypted := e2eeUnencryptedVP8DeltaBytes
+		frame[0] |= 0x01
+
+		if keyframe {
+			frame[0] &^= 0x01
+			unencrypted = e2eeUnencryptedVP8KeyBytes
+		}
+
+		// Small MTU so the last packet is shorter than the encryption overhead
+		encrypted := encryptTestFrame(t, "passphrase", 0, frame, unencrypted)
+		packets := packetizeTestVP8(t, encrypted, 110)
+
+		decrypted, err := d.decrypt(MimeTypeVP8, packets)
+		require.NoError(t, err)
+		require.Len(t, decrypted, len(packets), "Sequence numbers must be kept")
+		assert.Equal(t, frame, depacketizeTestVP8(t, decrypted))
+
+		for i, p := range decrypted {
+			assert.Equal(t, packets[i].SequenceNumber, p.SequenceNumber)
+			assert.Equal(t, packets[i].Marker, p.Marker)
+		}
+	}
+
+	// Frames whose unencrypted header doesn't authenticate are rejected
+	frame := make([]byte, 300)
+	encrypted := encryptTestFrame(t, "passphrase", 0, frame, e2eeUnencryptedVP8KeyBytes)
+	encrypted[1] ^= 0xFF
+	_, err := d.decrypt(MimeTypeVP8, packetizeTestVP8(t, encrypted, 110))
+	assert.Error(t, err)
+}
+
+func TestFrameDecryptor_KeyRotation(t *testing.T) {
+	d := newFrameDecryptor()
+	assert.False(t, d.hasKey())
+	assert.Error(t, d.setKey("", 0), "Empty keys are rejected")
+	assert.False(t, d.hasKey())
+
+	sample := []byte{0x78, 1, 2, 3}
+	decrypt := func(passphrase string, index uint8) ([]byte, error) {
+		encrypted := encryptTestFrame(t, passphrase, index, sample, e2eeUnencryptedAudioBytes)
+		packets, err := d.decrypt(MimeTypeOpus, []*rtp.Packet{{Payload: encrypted}})
+
+		if err != nil {
+			return nil, err
+		}
+
+		return packets[0].Payload, nil
+	}
+
+	require.NoError(t, d.setKey("first", 0))
+	assert.True(t, d.hasKey())
+	plain, err := decrypt("first", 0)
+	require.NoError(t, err)
+	assert.Equal(t, sample, plain)
+
+	_, err = decrypt("second", 1)
+	assert.Error(t, err, "Index 1 has no key yet")
+
+	require.NoError(t, d.setKey("second", 1))
+	plain, err = decrypt("second", 1)
+	require.NoError(t, err)
+	assert.Equal(t, sample, plain)
+
+	plain, err = decrypt("first", 0)
+	require.NoError(t, err, "Frames under the previous key still decrypt")
+	assert.Equal(t, sample, plain)
+
+	// Replacing the key at an index
+	require.NoError(t, d.setKey("third", 0))
+	_, err = decrypt("first", 0)
+	assert.Error(t, err)
+	_, err = decrypt("third", 0)
+	assert.NoError(t, err)
+
+	_, err = d.decrypt(MimeTypeH264, nil)
+	assert.ErrorIs(t, err, errE2EEUnsupported)
+}
@@ -0,0 +1,210 @@
+package livekit
+
+import (
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+// firEscalation tracks the keyframe requests for an SSRC that went
+// unanswered. Some publishers ignore PLIs, but not Full Intra Requests
+// (RFC 5104): after cfg.FIR.AfterPLIs PLIs, if no keyframe arrives within
+// cfg.FIR.Timeout, keyframes are requested with FIRs until one does.
+type firEscalation struct {
+	unansweredPLIs int
+	escalated      bool // Keyframes are requested with FIRs
+	armed          bool // The escalation timeout is running
+	// Bumped on keyframes, so timeouts armed before are ignored
+	generation uint64
+	firCount   int
+	firSeqNum  uint8
+}
+
+// onPLISent arms the escalation timeout once enough PLIs went unanswered
+// Locked
+func (w *LiveKitWebRTC) onPLISent(ssrc uint32, tracker *pliTracker) {
+	tracker.unansweredPLIs++
+
+	if w.cfg.FIR.AfterPLIs <= 0 || tracker.escalated || tracker.armed ||
+		tracker.unansweredPLIs < w.cfg.FIR.AfterPLIs {
+		return
+	}
+
+	tracker.armed = true
+	generation := tracker.generation
+
+	w.clock.AfterFunc(w.cfg.FIR.Timeout, func() {
+		w.escalateToFIR(ssrc, generation)
+	})
+}
+
+func (w *LiveKitWebRTC) escalateToFIR(ssrc uint32, generation uint64) {
+	w.m.Lock()
+	tracker, ok := w.pliStats[ssrc]
+
+	if !ok || tracker.generation != generation {
+		w.m.Unlock()
+		return
+	}
+
+	tracker.armed = false
+	tracker.escalated = true
+	unanswered := tracker.unansweredPLIs
+	w.pliStats[ssrc] = tracker
+	w.m.Unlock()
+
+	w.logger.Warnf("No keyframe for SSRC %d after %d PLIs, escalating to FIR", ssrc, unanswered)
+
+	w.queueKeyframeRequest(ssrc, "fir_escalation")
+}
+
+func (w *LiveKitWebRTC) firEscalated(ssrc uint32) bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	return w.pliStats[ssrc].escalated
+}
+
+// onKeyframeReceived resets the escalation: the publisher answers again
+func (w *LiveKitWebRTC) onKeyframeReceived(ssrc uint32) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	tracker, ok := w.pliStats[ssrc]
+
+	if !ok || (tracker.unansweredPLIs == 0 && !tracker.escalated && !tracker.armed) {
+		return
+	}
+
+	if tracker.escalated {
+		w.logger.Infof("Keyframe received for SSRC %d after %d FIRs, back to PLIs", ssrc, tracker.firCount)
+	}
+
+	tracker.unansweredPLIs = 0
+	tracker.escalated = false
+	tracker.armed = false
+	tracker.generation++
+	w.pliStats[ssrc] = tracker
+}
+
+// sendFIR writes a FIR for the SSRC on the transport of the track it
+// belongs to
+func (w *LiveKitWebRTC) sendFIR(ssrc uint32) {
+	w.m.Lock()
+	var writer interface {
+		WriteRTCP(pkts []rtcp.Packet) (int, error)
+	}
+
+	for _, pub := range w.remoteTrackPubs {
+		track := pub.TrackRemote()
+		receiver := pub.Receiver()
+
+		if track != nil && receiver != nil && uint32(track.SSRC()) == ssrc && receiver.Transport() != nil {
+			writer = receiver.Transport()
+			break
+		}
+	}
+
+	if writer == nil {
+		w.m.Unlock()
+		return
+	}
+
+	tracker := w.pliStats[ssrc]
+	tracker.firSeqNum++
+	seqNum := tracker.firSeqNum
+	w.pliStats[ssrc] = tracker
+	w.m.Unlock()
+
+	fir := &rtcp.FullIntraRequest{
+		SenderSSRC: ssrc,
+		MediaSSRC:  ssrc,
+		FIR:        []rtcp.FIREntry{{SSRC: ssrc, SequenceNumber: seqNum}},
+	}
+
+	if _, err := writer.WriteRTCP([]rtcp.Packet{fir}); err != nil {
+		w.logger.Warnf("Failed to send FIR for SSRC %d: %v", ssrc, err)
+		return
+	}
+
+	w.logger.Debugf("Requested keyframe for SSRC %d with FIR seq=%d", ssrc, seqNum)
+
+	w.m.Lock()
+	tracker = w.pliStats[ssrc]
+	tracker.firCount++
+	w.pliStats[ssrc] = tracker
+	w.m.Unlock()
+}
+
+// isKeyframeSample returns whether a sample (the packets of a frame) is a
+// keyframe. Only the payload headers are looked at, so it also works on
+// end-to-end encrypted frames.
+func isKeyframeSample(mimeType MimeType, packets []*rtp.Packet) bool {
+	if len(packets) == 0 {
+		return false
+	}
+
+	switch mimeType {
+	case MimeTypeVP8:
+		return recorder.IsVP8KeyFrame(packets[0])
+	case MimeTypeVP9:
+		vp9 := codecs.VP9Packet{}
+
+		if _, err := vp9.Unmarshal(packets[0].Payload); err != nil {
+			return false
+		}
+
+		// Start of a picture not predicted from previous ones, on the
+		// base spatial layer
+		return vp9.B && !vp9.P && vp9.SID == 0
+	case MimeTypeAV1:
+		// Keyframes start a new coded video sequence (N bit of the
+		// aggregation header)
+		payload := packets[0].Payload
+
+		return len(payload) > 0 && payload[0]&0x08 != 0
+	case MimeTypeH264:
+		for _, packet := range packets {
+			if h264HasIDR(packet.Payload) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+const (
+	h264NALUTypeIDR   = 5
+	h264NALUTypeSTAPA = 24
+	h264NALUTypeFUA   = 28
+)
+
+func h264HasIDR(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+
+	switch payload[0] & 0x1f {
+	case h264NALUTypeIDR:
+		return true
+	case h264NALUTypeSTAPA:
+		// Aggregated NALUs, each prefixed by its 16-bit size
+		for offset := 1; offset+2 < len(payload); {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+
+			if payload[offset]&0x1f == h264NALUTypeIDR {
+				return true
+			}
+
+			offset += size
+		}
+	case h264NALUTypeFUA:
+		// Start fragment of an IDR
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1f == h264NALUTypeIDR
+	}
+
+	return false
+}
@@ -0,0 +1,106 @@
+package livekit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFIREscalation(t *testing.T) {
+	lk, _ := setupMockLK()
+	defer lk.Close()
+	clk := clock.NewMock(time.Unix(1000, 0))
+	lk.WithClock(clk)
+	lk.cfg.FIR = config.FIR{AfterPLIs: 2, Timeout: 20 * time.Millisecond}
+	ssrc := uint32(1234)
+	lk.pliStats[ssrc] = pliTracker{}
+
+	pliSent := func() {
+		lk.m.Lock()
+		tracker := lk.pliStats[ssrc]
+		tracker.count++
+		lk.onPLISent(ssrc, &tracker)
+		lk.pliStats[ssrc] = tracker
+		lk.m.Unlock()
+	}
+
+	pliSent()
+	clk.Add(40 * time.Millisecond)
+	assert.False(t, lk.firEscalated(ssrc), "Not enough PLIs went unanswered")
+
+	pliSent()
+	clk.Add(19 * time.Millisecond)
+	assert.False(t, lk.firEscalated(ssrc), "Waits for the timeout")
+	clk.Add(time.Millisecond)
+	assert.True(t, lk.firEscalated(ssrc))
+
+	lk.onKeyframeReceived(ssrc)
+	assert.False(t, lk.firEscalated(ssrc), "A keyframe resets the escalation")
+
+	// Keyframes arriving within the timeout cancel it
+	pliSent()
+	pliSent()
+	lk.onKeyframeReceived(ssrc)
+	clk.Add(40 * time.Millisecond)
+	assert.False(t, lk.firEscalated(ssrc))
+	assert.Equal(t, 4, lk.pliStats[ssrc].count)
+}
+
+func TestFIREscalation_Disabled(t *testing.T) {
+	lk, _ := setupMockLK()
+	defer lk.Close()
+	lk.cfg.FIR = config.FIR{AfterPLIs: 0, Timeout: time.Millisecond}
+	ssrc := uint32(1234)
+
+	lk.m.Lock()
+	tracker := pliTracker{}
+	for range 5 {
+		lk.onPLISent(ssrc, &tracker)
+	}
+	lk.pliStats[ssrc] = tracker
+	lk.m.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, lk.firEscalated(ssrc))
+}
+
+func TestIsKeyframeSample(t *testing.T) {
+	packet := func(payload ...byte) []*rtp.Packet {
+		return []*rtp.Packet{{Payload: payload}}
+	}
+
+	tests := []struct {
+		name     string
+		mimeType MimeType
+		packets  []*rtp.Packet
+		want     bool
+	}{
+		{"vp8 keyframe", MimeTypeVP8, packet(0x10, 0x00, 0x9d, 0x01, 0x2a), true},
+		{"vp8 delta frame", MimeTypeVP8, packet(0x10, 0x01, 0x00), false},
+		// B set, P unset
+		{"vp9 keyframe", MimeTypeVP9, packet(0x08, 0x00), true},
+		// B and P set
+		{"vp9 delta frame", MimeTypeVP9, packet(0x48, 0x00), false},
+		{"h264 idr", MimeTypeH264, packet(0x65, 0x88), true},
+		{"h264 non-idr", MimeTypeH264, packet(0x41, 0x9a), false},
+		// SPS, then IDR
+		{"h264 stap-a", MimeTypeH264, packet(0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x02, 0x65, 0x88), true},
+		{"h264 fu-a idr start", MimeTypeH264, packet(0x7c, 0x85, 0x88), true},
+		{"h264 fu-a idr middle", MimeTypeH264, packet(0x7c, 0x05, 0x88), false},
+		// N set: new coded video sequence
+		{"av1 keyframe", MimeTypeAV1, packet(0x18, 0x0a), true},
+		{"av1 delta frame", MimeTypeAV1, packet(0x10, 0x32), false},
+		{"opus", MimeTypeOpus, packet(0x78), false},
+		{"empty", MimeTypeVP8, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isKeyframeSample(tt.mimeType, tt.packets))
+		})
+	}
+}
@@ -3,6 +3,8 @@ package livekit
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
@@ -76,3 +78,40 @@ func CheckConnectivity(cfg config.LiveKit) error {
 		return nil
 	}
 }
+
+// CheckReachability checks that the LiveKit server at host answers HTTP
+// requests, without joining a room. ws(s) hosts are queried over http(s).
+func CheckReachability(ctx context.Context, host string) error {
+	u, err := url.Parse(host)
+
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid livekit host %s", host)
+	}
+
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return fmt.Errorf("livekit is not reachable: %w", err)
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("livekit is not healthy: %s", res.Status)
+	}
+
+	return nil
+}
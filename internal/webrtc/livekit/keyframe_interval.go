@@ -0,0 +1,120 @@
+package livekit
+
+import (
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+)
+
+// maxKeyframeIntervalChanges bounds the interval changes kept in a track's
+// stats
+const maxKeyframeIntervalChanges = 100
+
+// The weight of a packet batch in the recent loss rate. Batches are samples,
+// so it smooths over the last few dozen frames.
+const keyframeLossSmoothing = 1.0 / 16
+
+// The effective interval is rounded to this, so small loss variations don't
+// show up as changes
+const keyframeIntervalStep = 50 * time.Millisecond
+
+// keyframeInterval adapts the minimum interval between keyframe requests of
+// a video track to its recent loss rate (see config.AdaptiveKeyframeInterval).
+// Lossy streams get keyframes asked for more often, clean ones less.
+type keyframeInterval struct {
+	cfg      config.AdaptiveKeyframeInterval
+	ssrc     uint32
+	loss     float64
+	interval time.Duration
+}
+
+func newKeyframeInterval(cfg config.AdaptiveKeyframeInterval, ssrc uint32) *keyframeInterval {
+	return &keyframeInterval{
+		cfg:      cfg,
+		ssrc:     ssrc,
+		interval: cfg.MaxInterval,
+	}
+}
+
+// onBatch accounts for a batch of received packets out of the expected ones,
+// returning whether the effective interval changed
+func (k *keyframeInterval) onBatch(expected uint64, received int) bool {
+	if expected == 0 {
+		return false
+	}
+
+	loss := 0.0
+
+	if uint64(received) < expected {
+		loss = float64(expected-uint64(received)) / float64(expected)
+	}
+
+	k.loss += (loss - k.loss) * keyframeLossSmoothing
+	interval := k.target()
+
+	if interval == k.interval {
+		return false
+	}
+
+	k.interval = interval
+
+	return true
+}
+
+// target interpolates between MaxInterval for a clean stream and MinInterval
+// once the loss rate reaches HighLoss
+func (k *keyframeInterval) target() time.Duration {
+	ratio := 1.0
+
+	if k.cfg.HighLoss > 0 {
+		ratio = min(k.loss/k.cfg.HighLoss, 1)
+	}
+
+	span := float64(k.cfg.MaxInterval - k.cfg.MinInterval)
+	interval := k.cfg.MaxInterval - time.Duration(span*ratio)
+
+	return max(interval.Round(keyframeIntervalStep), k.cfg.MinInterval)
+}
+
+// adaptKeyframeInterval updates the keyframe request interval of a track
+// with a batch of packets, expected of which were sent. Locked
+func (w *LiveKitWebRTC) adaptKeyframeInterval(trackID string, stats *appstats.AdapterTrackStats, expected uint64, received int) {
+	k, ok := w.keyframeIntervals[trackID]
+
+	if !ok || !k.onBatch(expected, received) {
+		return
+	}
+
+	stats.KeyframeIntervalMs = k.interval.Milliseconds()
+	stats.KeyframeIntervalChanges = append(stats.KeyframeIntervalChanges, appstats.KeyframeIntervalChange{
+		Time:         w.clock.Now().UnixMilli(),
+		IntervalMs:   k.interval.Milliseconds(),
+		LossFraction: k.loss,
+	})
+
+	if n := len(stats.KeyframeIntervalChanges); n > maxKeyframeIntervalChanges {
+		stats.KeyframeIntervalChanges = stats.KeyframeIntervalChanges[n-maxKeyframeIntervalChanges:]
+	}
+
+	w.logger.WithField("trackID", trackID).
+		WithField("interval", k.interval).
+		WithField("loss", k.loss).
+		Debug("Keyframe request interval adapted")
+}
+
+// keyframeRequestInterval returns the minimum interval between keyframe
+// requests for an SSRC. Locked
+func (w *LiveKitWebRTC) keyframeRequestInterval(ssrc uint32) time.Duration {
+	if interval, ok := w.screenShareInterval(ssrc); ok {
+		return interval
+	}
+
+	for _, k := range w.keyframeIntervals {
+		if k.ssrc == ssrc {
+			return k.interval
+		}
+	}
+
+	return w.cfg.KeyframeRequestInterval
+}
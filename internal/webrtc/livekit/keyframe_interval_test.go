@@ -0,0 +1,83 @@
+package livekit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+var testAdaptiveKeyframeInterval = config.AdaptiveKeyframeInterval{
+	Enabled:     true,
+	MinInterval: 250 * time.Millisecond,
+	MaxInterval: 3 * time.Second,
+	HighLoss:    0.05,
+}
+
+func TestKeyframeInterval_Target(t *testing.T) {
+	k := newKeyframeInterval(testAdaptiveKeyframeInterval, 1)
+	assert.Equal(t, 3*time.Second, k.target(), "Clean stream")
+
+	k.loss = 0.025
+	assert.Equal(t, 1650*time.Millisecond, k.target())
+
+	k.loss = 0.2
+	assert.Equal(t, 250*time.Millisecond, k.target(), "Bounded by MinInterval")
+}
+
+func TestAdaptKeyframeInterval(t *testing.T) {
+	lk, _ := setupMockLK()
+	lk.cfg.KeyframeRequestInterval = time.Second
+	trackID := lk.trackIds[0]
+	ssrc := uint32(1234)
+	lk.keyframeIntervals[trackID] = newKeyframeInterval(testAdaptiveKeyframeInterval, ssrc)
+
+	assert.Equal(t, 3*time.Second, lk.keyframeRequestInterval(ssrc))
+	assert.Equal(t, time.Second, lk.keyframeRequestInterval(4321), "Other SSRCs keep the fixed interval")
+
+	// Every other batch of 10 packets loses one before it
+	seq := uint16(0)
+
+	for i := 0; i < 200; i++ {
+		if i%2 == 1 {
+			seq++
+		}
+
+		lk.processPacketStats(trackID, makePackets(seq, seq+9))
+		seq += 10
+	}
+
+	lossy := lk.keyframeRequestInterval(ssrc)
+	assert.Less(t, lossy, time.Second)
+	assert.GreaterOrEqual(t, lossy, 250*time.Millisecond)
+
+	stats := lk.trackStats[trackID]
+	assert.Equal(t, lossy.Milliseconds(), stats.KeyframeIntervalMs)
+	assert.NotEmpty(t, stats.KeyframeIntervalChanges)
+	assert.LessOrEqual(t, len(stats.KeyframeIntervalChanges), maxKeyframeIntervalChanges)
+
+	// Once clean again it backs off
+	for i := 0; i < 200; i++ {
+		lk.processPacketStats(trackID, makePackets(seq, seq+9))
+		seq += 10
+	}
+
+	assert.Equal(t, 3*time.Second, lk.keyframeRequestInterval(ssrc))
+	last := stats.KeyframeIntervalChanges[len(stats.KeyframeIntervalChanges)-1]
+	assert.Equal(t, int64(3000), last.IntervalMs)
+}
+
+func TestAllowPLI_AdaptiveInterval(t *testing.T) {
+	lk, _ := setupMockLK()
+	lk.cfg.KeyframeRequestInterval = 5 * time.Second
+	ssrc := uint32(1234)
+	k := newKeyframeInterval(testAdaptiveKeyframeInterval, ssrc)
+	k.interval = 250 * time.Millisecond
+	lk.keyframeIntervals[lk.trackIds[0]] = k
+	now := time.Now()
+
+	assert.True(t, lk.allowPLI(ssrc, now))
+	assert.False(t, lk.allowPLI(ssrc, now.Add(100*time.Millisecond)))
+	assert.True(t, lk.allowPLI(ssrc, now.Add(400*time.Millisecond)), "Adapted interval elapsed")
+}
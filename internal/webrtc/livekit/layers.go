@@ -0,0 +1,132 @@
+package livekit
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/livekit/protocol/livekit"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+)
+
+// LayerPreference is the simulcast layer to subscribe to: either a quality
+// level or, if Width and Height are set, the largest layer fitting them.
+type LayerPreference struct {
+	Quality livekit.VideoQuality
+	Width   uint32
+	Height  uint32
+}
+
+// ParseLayerPreference builds a LayerPreference from its API representation.
+// An empty quality falls back to defaultQuality.
+func ParseLayerPreference(
+	quality string,
+	width uint32,
+	height uint32,
+	defaultQuality livekit.VideoQuality,
+) (*LayerPreference, error) {
+	pref := &LayerPreference{
+		Quality: defaultQuality,
+		Width:   width,
+		Height:  height,
+	}
+
+	switch strings.ToLower(quality) {
+	case "":
+	case "high":
+		pref.Quality = livekit.VideoQuality_HIGH
+	case "medium":
+		pref.Quality = livekit.VideoQuality_MEDIUM
+	case "low":
+		pref.Quality = livekit.VideoQuality_LOW
+	default:
+		return nil, fmt.Errorf("invalid video layer quality: %s", quality)
+	}
+
+	if (width == 0) != (height == 0) {
+		return nil, fmt.Errorf("invalid video layer resolution: %dx%d", width, height)
+	}
+
+	return pref, nil
+}
+
+func (p *LayerPreference) hasResolution() bool {
+	return p.Width > 0 && p.Height > 0
+}
+
+func (p *LayerPreference) String() string {
+	if p.hasResolution() {
+		return fmt.Sprintf("%dx%d", p.Width, p.Height)
+	}
+
+	return qualityName(p.Quality)
+}
+
+func qualityName(quality livekit.VideoQuality) string {
+	return strings.ToLower(quality.String())
+}
+
+// selectVideoLayer picks the published layer matching pref. If there is no
+// such layer, the highest available one is returned. Returns nil if the
+// track doesn't advertise any layer.
+func selectVideoLayer(layers []*livekit.VideoLayer, pref *LayerPreference) (*livekit.VideoLayer, bool) {
+	var highest, selected *livekit.VideoLayer
+
+	for _, layer := range layers {
+		if layer == nil || layer.Quality == livekit.VideoQuality_OFF {
+			continue
+		}
+
+		if highest == nil || layer.Quality > highest.Quality {
+			highest = layer
+		}
+
+		if pref.hasResolution() {
+			if layer.Width <= pref.Width && layer.Height <= pref.Height &&
+				(selected == nil || layer.Width*layer.Height > selected.Width*selected.Height) {
+				selected = layer
+			}
+		} else if layer.Quality == pref.Quality {
+			selected = layer
+		}
+	}
+
+	if selected == nil {
+		return highest, false
+	}
+
+	return selected, true
+}
+
+func (w *LiveKitWebRTC) setVideoLayer(pub *lksdk.RemoteTrackPublication) {
+	if w.adaptive != nil && w.setAdaptiveVideoLayer(pub) {
+		return
+	}
+
+	pref := w.layerPref
+	layer, matched := selectVideoLayer(pub.TrackInfo().GetLayers(), pref)
+
+	if layer == nil {
+		// No layer information: let the SFU pick based on the preference
+		w.logger.Debugf("Setting video layer to %s for track %s", pref, pub.SID())
+
+		if pref.hasResolution() {
+			pub.SetVideoDimensions(pref.Width, pref.Height)
+		} else {
+			// Ignore error - only throws when video quality = OFF which we do not care about
+			_ = pub.SetVideoQuality(pref.Quality)
+		}
+
+		return
+	}
+
+	if !matched {
+		w.logger.Warnf("Video layer %s unavailable for track %s, falling back to %s (%dx%d)",
+			pref, pub.SID(), qualityName(layer.Quality), layer.Width, layer.Height)
+	} else {
+		w.logger.Debugf("Setting video layer to %s (%dx%d) for track %s",
+			qualityName(layer.Quality), layer.Width, layer.Height, pub.SID())
+	}
+
+	_ = pub.SetVideoQuality(layer.Quality)
+	w.rec.SetVideoLayer(qualityName(layer.Quality), layer.Width, layer.Height)
+}
@@ -0,0 +1,65 @@
+package livekit
+
+import (
+	"testing"
+
+	"github.com/livekit/protocol/livekit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testLayers() []*livekit.VideoLayer {
+	return []*livekit.VideoLayer{
+		{Quality: livekit.VideoQuality_LOW, Width: 320, Height: 180},
+		{Quality: livekit.VideoQuality_HIGH, Width: 1280, Height: 720},
+		{Quality: livekit.VideoQuality_MEDIUM, Width: 640, Height: 360},
+	}
+}
+
+func TestParseLayerPreference(t *testing.T) {
+	pref, err := ParseLayerPreference("", 0, 0, livekit.VideoQuality_HIGH)
+	require.NoError(t, err)
+	assert.Equal(t, livekit.VideoQuality_HIGH, pref.Quality)
+
+	pref, err = ParseLayerPreference("Medium", 0, 0, livekit.VideoQuality_HIGH)
+	require.NoError(t, err)
+	assert.Equal(t, livekit.VideoQuality_MEDIUM, pref.Quality)
+	assert.Equal(t, "medium", pref.String())
+
+	pref, err = ParseLayerPreference("", 640, 360, livekit.VideoQuality_HIGH)
+	require.NoError(t, err)
+	assert.Equal(t, "640x360", pref.String())
+
+	_, err = ParseLayerPreference("ultra", 0, 0, livekit.VideoQuality_HIGH)
+	assert.Error(t, err)
+
+	_, err = ParseLayerPreference("", 640, 0, livekit.VideoQuality_HIGH)
+	assert.Error(t, err)
+}
+
+func TestSelectVideoLayer(t *testing.T) {
+	tests := []struct {
+		name    string
+		layers  []*livekit.VideoLayer
+		pref    LayerPreference
+		quality livekit.VideoQuality
+		matched bool
+	}{
+		{"by quality", testLayers(), LayerPreference{Quality: livekit.VideoQuality_MEDIUM}, livekit.VideoQuality_MEDIUM, true},
+		{"missing quality falls back to highest", testLayers()[:1], LayerPreference{Quality: livekit.VideoQuality_MEDIUM}, livekit.VideoQuality_LOW, false},
+		{"largest layer fitting resolution", testLayers(), LayerPreference{Width: 800, Height: 600}, livekit.VideoQuality_MEDIUM, true},
+		{"no layer fits resolution", testLayers(), LayerPreference{Width: 160, Height: 90}, livekit.VideoQuality_HIGH, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layer, matched := selectVideoLayer(tt.layers, &tt.pref)
+			require.NotNil(t, layer)
+			assert.Equal(t, tt.quality, layer.Quality)
+			assert.Equal(t, tt.matched, matched)
+		})
+	}
+
+	layer, _ := selectVideoLayer(nil, &LayerPreference{Quality: livekit.VideoQuality_HIGH})
+	assert.Nil(t, layer, "Tracks without layer information have nothing to select")
+}
@@ -5,24 +5,28 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"path/filepath"
 	"runtime/debug"
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/interfaces"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/utils"
-	"github.com/livekit/protocol/auth"
 	"github.com/livekit/protocol/livekit"
 	lksdk "github.com/livekit/server-sdk-go/v2"
 	"github.com/livekit/server-sdk-go/v2/pkg/jitter"
+	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v4"
@@ -31,6 +35,9 @@ import (
 
 const (
 	MimeTypeVP8  MimeType = "video/vp8"
+	MimeTypeH264 MimeType = "video/h264"
+	MimeTypeVP9  MimeType = "video/vp9"
+	MimeTypeAV1  MimeType = "video/av1"
 	MimeTypeOpus MimeType = "audio/opus"
 )
 
@@ -44,15 +51,26 @@ const (
 	flowingTicker      = time.Millisecond * 1000
 	tokenTTL           = 24 * time.Hour
 	baseSystemMetadata = "{\"bbb_system\": true}"
+	// How often per-track recorder stats are refreshed for live metrics
+	liveMetricsRecorderInterval = time.Second
+	// How often the room is checked for requested tracks not published yet,
+	// in case a track-published event is missed
+	trackPublishPollInterval = 250 * time.Millisecond
+	// How long the jitter buffer waits for packets missing from a sample
+	jitterLatency = 200 * time.Millisecond
 )
 
+var errTrackNotPublished = fmt.Errorf("%w, not published", interfaces.ErrTrackNotFound)
+
 type MimeType string
 
 type TrackKind string
 
 type pliTracker struct {
 	count     int
-	timestamp time.Time
+	timestamp time.Time // Last PLI (or FIR) sent, zero if none yet
+	pending   bool      // A throttled request will be retried
+	firEscalation
 }
 
 type trackFlowState struct {
@@ -64,22 +82,36 @@ type trackFlowState struct {
 type LiveKitWebRTC struct {
 	m                  sync.Mutex
 	ctx                context.Context
+	logger             *log.Entry // Tagged with the session of ctx
 	cfg                config.LiveKit
 	rec                recorder.Recorder
+	mixer              recorder.AudioMixer // Set if audio tracks are mixed
 	room               *lksdk.Room
 	remoteTrackPubs    map[string]*lksdk.RemoteTrackPublication
 	remoteParticipants map[string]*lksdk.RemoteParticipant
 	participantIDs     map[string]string // trackID -> participantID
 	roomId             string
 	identity           string
+	client             *client // Shared by the sessions of the same deployment
+	clock              clock.Clock
 	trackIds           []string
+	layerPref          *LayerPreference
 	pliStats           map[uint32]pliTracker
 	jitterBuffers      map[string]*jitter.Buffer
 	hasAudio           bool
 	hasVideo           bool
 	flowState          map[string]*trackFlowState
 	flowCallback       func(isFlowing bool, timestamp time.Duration, closed bool)
+	stopCallback       func(reason string)
+	firstPacketCb      func(event interfaces.MediaEvent)
+	firstKeyframeCb    func(event interfaces.MediaEvent)
+	firstPacketSeen    map[string]bool
+	firstKeyframeSeen  bool
 	trackStats         map[string]*appstats.AdapterTrackStats
+	receptionStats     map[string]*receptionStats
+	bitrateStats       map[string]*bitrateStats
+	decryptor          *frameDecryptor
+	pendingBytes       atomic.Int64 // Held in the sample buffers, all tracks
 	startTs            time.Time
 	connStateCallback  func(state utils.ConnectionState)
 	rtpWriters         map[string]*recorder.RTPWriter
@@ -90,6 +122,52 @@ type LiveKitWebRTC struct {
 	requestKeyframeWg     sync.WaitGroup
 
 	pendingSubscriptions map[string]time.Time
+	timeouts             trackTimeouts
+	trackPublished       chan struct{}
+	trackErrors          map[string]error // Requested tracks not recorded
+	readingTracks        map[string]*webrtc.TrackRemote
+
+	lastRecorderMetricsUpdate map[string]time.Time
+
+	reconnectCtx     context.Context
+	reconnectCancel  context.CancelFunc
+	reconnectWg      sync.WaitGroup
+	reconnecting     bool
+	reconnectRunning bool
+	resumingTracks   map[string]bool
+	// Resuming after a resubscription rather than a reconnect
+	resubscribedTracks map[string]bool
+	// Tracks muted by their publisher (see mute.go)
+	mutedTracks map[string]bool
+	// What's written of each track, whose recording can be disabled at
+	// runtime (see track_recording.go)
+	trackGates map[string]*trackGate
+	// Set when following the dominant speaker (see speaker.go)
+	speaker *speakerSwitcher
+	// Video tracks whose layer adapts to the bitrate budget, set when
+	// enabled (see adaptive_quality.go)
+	adaptive map[string]*adaptiveQuality
+	// Set when capturing data messages (see data.go)
+	data *dataCapture
+	// Set when recording the room's tracks matching a filter (see
+	// discovery.go)
+	discovery *trackDiscovery
+	// The RTP header extensions parsed, per the config
+	headerExtensions utils.HeaderExtensions
+	// Per video track, when the keyframe request interval adapts to loss
+	// (see keyframe_interval.go)
+	keyframeIntervals map[string]*keyframeInterval
+	// SSRCs of screen share tracks (see screenshare.go)
+	screenShares map[uint32]bool
+	// Stats snapshots for live monitoring (see statsstream.go)
+	statsStream statsStream
+
+	maxDurationReached bool
+
+	closeOnce   sync.Once
+	closeResult *interfaces.CloseResult
+	endReason   string
+	endErr      error
 }
 
 func NewLiveKitWebRTC(
@@ -98,30 +176,77 @@ func NewLiveKitWebRTC(
 	rec recorder.Recorder,
 	roomId string,
 	trackIds []string,
+	layerPref *LayerPreference,
 ) *LiveKitWebRTC {
 	requestKeyframeCtx, requestKeyframeCancel := context.WithCancel(ctx)
+	reconnectCtx, reconnectCancel := context.WithCancel(ctx)
 	sessionID := ctx.Value("session").(string)
 	identity := fmt.Sprintf("bbb-webrtc-recorder-%s", sessionID)
 
+	if layerPref == nil {
+		layerPref = &LayerPreference{Quality: cfg.PreferredVideoQuality}
+	}
+
 	w := &LiveKitWebRTC{
 		ctx:                   ctx,
+		logger:                log.WithField("session", sessionID),
 		cfg:                   cfg,
 		rec:                   rec,
 		roomId:                roomId,
 		identity:              identity,
+		client:                clientFor(cfg),
+		clock:                 clock.Real,
+		startTs:               time.Now(),
 		trackIds:              trackIds,
+		layerPref:             layerPref,
 		remoteTrackPubs:       make(map[string]*lksdk.RemoteTrackPublication),
 		pliStats:              make(map[uint32]pliTracker),
 		jitterBuffers:         make(map[string]*jitter.Buffer),
 		flowState:             make(map[string]*trackFlowState),
 		trackStats:            make(map[string]*appstats.AdapterTrackStats),
+		receptionStats:        make(map[string]*receptionStats),
+		bitrateStats:          make(map[string]*bitrateStats),
+		decryptor:             newFrameDecryptor(),
+		firstPacketSeen:       make(map[string]bool),
 		participantIDs:        make(map[string]string),
 		rtpWriters:            make(map[string]*recorder.RTPWriter),
-		startTs:               time.Now(),
 		keyframeRequestChan:   make(chan uint32, 100),
 		requestKeyframeCtx:    requestKeyframeCtx,
 		requestKeyframeCancel: requestKeyframeCancel,
 		pendingSubscriptions:  make(map[string]time.Time),
+		timeouts:              newTrackTimeouts(),
+		trackPublished:        make(chan struct{}, 1),
+		trackErrors:           make(map[string]error),
+		readingTracks:         make(map[string]*webrtc.TrackRemote),
+
+		lastRecorderMetricsUpdate: make(map[string]time.Time),
+
+		reconnectCtx:    reconnectCtx,
+		reconnectCancel: reconnectCancel,
+		resumingTracks:  make(map[string]bool),
+
+		resubscribedTracks: make(map[string]bool),
+		mutedTracks:        make(map[string]bool),
+		trackGates:         make(map[string]*trackGate),
+		headerExtensions:   utils.NewHeaderExtensions(cfg.HeaderExtensions),
+		keyframeIntervals:  make(map[string]*keyframeInterval),
+		screenShares:       make(map[uint32]bool),
+	}
+
+	if mixer, ok := rec.(recorder.AudioMixer); ok && mixer.MixesAudio() {
+		w.mixer = mixer
+	}
+
+	if cfg.FollowSpeaker.Enabled {
+		w.speaker = newSpeakerSwitcher(cfg.FollowSpeaker.MinInterval)
+	}
+
+	if cfg.DataCapture.Enabled {
+		w.data = newDataCapture(cfg.DataCapture)
+	}
+
+	if cfg.AdaptiveQuality.Enabled {
+		w.adaptive = make(map[string]*adaptiveQuality)
 	}
 
 	w.initTrackStats()
@@ -148,22 +273,67 @@ func (w *LiveKitWebRTC) SetFlowCallback(callback func(isFlowing bool, timestamp
 	w.flowCallback = callback
 }
 
+// WithClock makes the capture time itself with c rather than the system
+// clock, e.g. for tests to control it. Must be called before Init.
+func (w *LiveKitWebRTC) WithClock(c clock.Clock) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	w.clock = c
+	w.startTs = c.Now()
+}
+
+// SetStopCallback sets the callback used when the adapter decides to end the
+// recording on its own, e.g. when MaxDuration is exceeded
+func (w *LiveKitWebRTC) SetStopCallback(callback func(reason string)) {
+	// Lock the mutex before accessing the callback as it's accessed from multiple goroutines
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	w.stopCallback = callback
+}
+
+// SetFirstPacketCallback sets a callback for the first RTP packet received
+// on each track. Resubscriptions after a reconnect don't fire it again.
+func (w *LiveKitWebRTC) SetFirstPacketCallback(callback func(event interfaces.MediaEvent)) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.firstPacketCb = callback
+}
+
+// SetFirstKeyframeCallback sets a callback for the first keyframe written
+// to the recording, i.e. when video becomes decodable
+func (w *LiveKitWebRTC) SetFirstKeyframeCallback(callback func(event interfaces.MediaEvent)) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.firstKeyframeCb = callback
+}
+
 func (w *LiveKitWebRTC) Init() error {
 	if err := w.validateInitParams(); err != nil {
 		return err
 	}
 
+	if w.cfg.E2EEKey != "" {
+		if err := w.SetEncryptionKey(w.cfg.E2EEKey, 0); err != nil {
+			w.setEndReason(interfaces.CloseReasonInitFailed, err)
+			return fmt.Errorf("invalid encryption key: %w", err)
+		}
+	}
+
 	if err := w.connectToRoom(); err != nil {
+		w.setEndReason(interfaces.ErrorReason(err, interfaces.CloseReasonInitFailed), err)
+		w.Close()
 		return err
 	}
 
-	if _, err := w.subscribeToTracks(w.trackIds); err != nil {
+	if err := w.subscribeToInitialTracks(); err != nil {
+		w.setEndReason(interfaces.CloseReasonInitFailed, err)
 		w.Close()
 
-		log.WithField("session", w.ctx.Value("session")).
-			WithField("room", w.roomId).
+		w.logger.WithField("room", w.roomId).
 			WithField("identity", w.identity).
-			WithField("trackIds", w.trackIds).
+			WithField("trackIds", w.requestedTracks()).
 			Errorf("Failed to subscribe to tracks: %v", err)
 		appstats.OnTrackSubscriptionFailed(err.Error())
 
@@ -173,22 +343,74 @@ func (w *LiveKitWebRTC) Init() error {
 	return nil
 }
 
+// SetEncryptionKey sets the shared key used to decrypt end-to-end encrypted
+// tracks at the given key index. Setting a new index (or replacing the
+// current one) while recording rotates the key; frames carry the index of
+// the key they were encrypted with.
+func (w *LiveKitWebRTC) SetEncryptionKey(key string, index uint8) error {
+	if err := w.decryptor.setKey(key, index); err != nil {
+		return err
+	}
+
+	w.logger.Infof("Encryption key set for index %d", index)
+
+	return nil
+}
+
+// setEndReason records why the capture is ending. Only the first reason
+// sticks: later ones are usually fallout from the first.
+func (w *LiveKitWebRTC) setEndReason(reason string, err error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.endReason == "" {
+		w.endReason = reason
+		w.endErr = err
+	}
+}
+
 func (w *LiveKitWebRTC) Close() time.Duration {
+	return w.CloseWithResult().Duration
+}
+
+// CloseWithResult tears the capture down and reports why it ended. Only the
+// first call does any work; later calls return the same result.
+func (w *LiveKitWebRTC) CloseWithResult() *interfaces.CloseResult {
+	w.closeOnce.Do(func() {
+		w.closeResult = w.close()
+	})
+
+	return w.closeResult
+}
+
+func (w *LiveKitWebRTC) close() *interfaces.CloseResult {
+	w.stopTimeouts()
+	w.closeStatsStream()
+
+	// Stop reconnecting first so no new room gets connected behind our back
+	if w.reconnectCancel != nil {
+		w.reconnectCancel()
+	}
+
+	w.reconnectWg.Wait()
+
 	if w.room != nil {
 		w.room.Disconnect()
 	}
 
+	w.client.release(w.roomId, w.identity)
+
 	if w.requestKeyframeCancel != nil {
 		w.requestKeyframeCancel()
 	}
 
 	w.requestKeyframeWg.Wait()
+	w.closeDataCapture()
 
 	if w.rtpWriters != nil {
 		for trackID, writer := range w.rtpWriters {
 			if err := writer.Close(); err != nil {
-				log.WithField("session", w.ctx.Value("session")).
-					WithField("trackID", trackID).
+				w.logger.WithField("trackID", trackID).
 					Warnf("Failed to close rtp writer for track %s: %v", trackID, err)
 			}
 		}
@@ -196,11 +418,43 @@ func (w *LiveKitWebRTC) Close() time.Duration {
 
 	w.rtpWriters = nil
 
+	sessionID := w.ctx.Value("session").(string)
+
+	for _, trackID := range w.requestedTracks() {
+		appstats.DeleteSessionTrackMetrics(sessionID, trackID)
+	}
+
+	w.setEndReason(interfaces.CloseReasonNormal, nil)
+	w.m.Lock()
+	result := &interfaces.CloseResult{
+		Reason: w.endReason,
+		Err:    w.endErr,
+	}
+
+	if len(w.trackErrors) > 0 {
+		result.TrackErrors = maps.Clone(w.trackErrors)
+	}
+	w.m.Unlock()
+
 	if w.rec != nil {
-		return w.rec.Close()
+		result.Duration = w.rec.Close()
+		result.Stats = w.rec.GetStats()
+
+		if result.Stats != nil && result.Stats.FlushTimedOut {
+			result.Warnings = append(result.Warnings, "recording not finalized within the flush deadline")
+		}
+
+		// The capture may well have ended normally, the recording is broken
+		// all the same
+		if we, ok := w.rec.(interface{ WriteError() error }); ok && result.Err == nil {
+			if err := we.WriteError(); err != nil {
+				result.Reason = interfaces.CloseReasonError
+				result.Err = err
+			}
+		}
 	}
 
-	return 0
+	return result
 }
 
 func (w *LiveKitWebRTC) GetStats() *appstats.CaptureStats {
@@ -235,11 +489,12 @@ func (w *LiveKitWebRTC) GetStats() *appstats.CaptureStats {
 		pliStats[k] = v
 	}
 
-	trackStats := make(map[string]appstats.AdapterTrackStats, len(w.trackStats))
-	for k, vPtr := range w.trackStats {
-		if vPtr != nil {
-			trackStats[k] = *vPtr
-		}
+	trackStats := w.cloneTrackStats()
+
+	var speakerSwitches []appstats.SpeakerSwitch
+
+	if w.speaker != nil {
+		speakerSwitches = slices.Clone(w.speaker.timeline)
 	}
 
 	var recorderFilePath string
@@ -265,33 +520,37 @@ func (w *LiveKitWebRTC) GetStats() *appstats.CaptureStats {
 		ParticipantID:       currentParticipantID,
 		FileName:            recorderFilePath,
 		Tracks:              make(map[string]*appstats.TrackStats),
+		SpeakerSwitches:     speakerSwitches,
+	}
+
+	if w.data != nil {
+		finalAdapterStats.DataFile, finalAdapterStats.DataMessages = w.data.stats()
 	}
 
-	for trackID, remoteTrackPub := range w.remoteTrackPubs {
+	for trackID, remoteTrackPub := range remoteTrackPubs {
 		trackInfo := remoteTrackPub.TrackInfo()
 		mimeType := trackInfo.MimeType
 
 		var bufferStatsData *jitter.BufferStats
 
-		if jb, ok := w.jitterBuffers[trackID]; ok && jb != nil {
+		if jb, ok := jitterBuffers[trackID]; ok && jb != nil {
 			bufferStatsData = jb.Stats()
 		} else {
 			bufferStatsData = &jitter.BufferStats{}
 		}
 
-		currentTrackAdapterStats := appstats.AdapterTrackStats{}
-
-		if ts, ok := w.trackStats[trackID]; ok {
-			currentTrackAdapterStats = *ts
-		}
+		currentTrackAdapterStats := trackStats[trackID]
 
 		pliCount := 0
+		firCount := 0
 		if remoteTrackPub.Kind() == lksdk.TrackKindVideo {
-			for _, tracker := range w.pliStats {
+			for _, tracker := range pliStats {
 				pliCount += tracker.count
+				firCount += tracker.firCount
 			}
 		}
 		currentTrackAdapterStats.PLIRequests = pliCount
+		currentTrackAdapterStats.FIRRequests = firCount
 
 		source := remoteTrackPub.Source().String()
 		finalAdapterStats.Tracks[source] = &appstats.TrackStats{
@@ -319,6 +578,27 @@ func (w *LiveKitWebRTC) GetStats() *appstats.CaptureStats {
 	return finalAdapterStats
 }
 
+// cloneTrackStats returns copies of the tracks' adapter stats, by track ID
+//
+// Locked
+func (w *LiveKitWebRTC) cloneTrackStats() map[string]appstats.AdapterTrackStats {
+	trackStats := make(map[string]appstats.AdapterTrackStats, len(w.trackStats))
+
+	for k, vPtr := range w.trackStats {
+		if vPtr != nil {
+			stats := *vPtr
+			stats.MuteIntervals = slices.Clone(vPtr.MuteIntervals)
+			stats.DisabledIntervals = slices.Clone(vPtr.DisabledIntervals)
+			stats.KeyframeIntervalChanges = slices.Clone(vPtr.KeyframeIntervalChanges)
+			stats.QualitySwitches = slices.Clone(vPtr.QualitySwitches)
+			stats.SSRCs = slices.Clone(vPtr.SSRCs)
+			trackStats[k] = stats
+		}
+	}
+
+	return trackStats
+}
+
 func (w *LiveKitWebRTC) queueKeyframeRequest(ssrc uint32, reason string) {
 	if w.keyframeRequestChan == nil {
 		return
@@ -342,13 +622,17 @@ func (w *LiveKitWebRTC) RequestKeyframe() {
 	w.m.Lock()
 	ssrcsToRequest := make([]uint32, 0, len(w.pliStats))
 	for ssrc := range w.pliStats {
+		// Video not written has no use for keyframes
+		if w.speaker != nil && !w.speakerWritten(ssrc) {
+			continue
+		}
+
 		ssrcsToRequest = append(ssrcsToRequest, ssrc)
 	}
 	w.m.Unlock()
 
 	if len(ssrcsToRequest) > 0 {
-		log.WithField("session", w.ctx.Value("session")).
-			Tracef("RequestKeyframe: Queuing PLI for SSRCs %v", ssrcsToRequest)
+		w.logger.Tracef("RequestKeyframe: Queuing PLI for SSRCs %v", ssrcsToRequest)
 	}
 
 	for _, ssrc := range ssrcsToRequest {
@@ -361,8 +645,27 @@ func (w *LiveKitWebRTC) RequestKeyframeForSSRC(ssrc uint32) {
 		return
 	}
 
-	log.WithField("session", w.ctx.Value("session")).
-		Tracef("Requesting keyframe for SSRC %d", ssrc)
+	w.m.Lock()
+	muted := w.ssrcMuted(ssrc)
+	w.m.Unlock()
+
+	// Nothing is sent until it's unmuted, which asks for one
+	if muted {
+		w.logger.Tracef("Not requesting keyframe for muted SSRC %d", ssrc)
+
+		return
+	}
+
+	if !w.allowPLI(ssrc, w.clock.Now()) {
+		return
+	}
+
+	if w.firEscalated(ssrc) {
+		w.sendFIR(ssrc)
+		return
+	}
+
+	w.logger.Tracef("Requesting keyframe for SSRC %d", ssrc)
 	requestedKeyframes := 0
 
 	// w.remoteParticipants contain all owners of the tracks we are subscribed to
@@ -372,21 +675,53 @@ func (w *LiveKitWebRTC) RequestKeyframeForSSRC(ssrc uint32) {
 	}
 
 	if requestedKeyframes > 0 {
-		log.WithField("session", w.ctx.Value("session")).
-			Debugf("Requested %d keyframes for SSRC %d", requestedKeyframes, ssrc)
+		w.logger.Debugf("Requested %d keyframes for SSRC %d", requestedKeyframes, ssrc)
+	}
+
+	if requestedKeyframes == 0 {
+		return
 	}
 
 	w.m.Lock()
+	tracker := w.pliStats[ssrc]
+	tracker.count++
+	w.onPLISent(ssrc, &tracker)
+	w.pliStats[ssrc] = tracker
+	w.m.Unlock()
+}
+
+// allowPLI enforces cfg.KeyframeRequestInterval, or the adapted interval
+// (see keyframe_interval.go), between PLIs for an SSRC.
+// The first request after a quiet period goes out right away; requests
+// within the interval are coalesced into a single one sent when it elapses.
+func (w *LiveKitWebRTC) allowPLI(ssrc uint32, now time.Time) bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	tracker := w.pliStats[ssrc]
+	elapsed := now.Sub(tracker.timestamp)
+	interval := w.keyframeRequestInterval(ssrc)
+
+	if interval > 0 && !tracker.timestamp.IsZero() && elapsed < interval {
+		if !tracker.pending {
+			tracker.pending = true
+			w.pliStats[ssrc] = tracker
+
+			w.clock.AfterFunc(interval-elapsed, func() {
+				w.queueKeyframeRequest(ssrc, "throttled")
+			})
+		}
+
+		w.logger.Tracef("Throttling PLI for SSRC %d, last one sent %s ago", ssrc, elapsed)
 
-	if _, exists := w.pliStats[ssrc]; !exists {
-		w.pliStats[ssrc] = pliTracker{count: 0, timestamp: time.Now()}
+		return false
 	}
 
-	newCount := w.pliStats[ssrc].count + 1
-	now := time.Now()
-	w.pliStats[ssrc] = pliTracker{count: newCount, timestamp: now}
+	tracker.timestamp = now
+	tracker.pending = false
+	w.pliStats[ssrc] = tracker
 
-	w.m.Unlock()
+	return true
 }
 
 func (w *LiveKitWebRTC) HasTrack(trackID string) bool {
@@ -396,10 +731,29 @@ func (w *LiveKitWebRTC) HasTrack(trackID string) bool {
 	return slices.Contains(w.trackIds, trackID)
 }
 
+// newDepacketizer returns the depacketizer of a codec, nil if it isn't
+// supported
+func newDepacketizer(mimeType MimeType) rtp.Depacketizer {
+	switch mimeType {
+	case MimeTypeVP8:
+		return &codecs.VP8Packet{}
+	case MimeTypeH264:
+		return &codecs.H264Packet{}
+	case MimeTypeVP9:
+		return &codecs.VP9Packet{}
+	case MimeTypeAV1:
+		return &codecs.AV1Depacketizer{}
+	case MimeTypeOpus:
+		return &codecs.OpusPacket{}
+	default:
+		return nil
+	}
+}
+
 func (w *LiveKitWebRTC) initTrackStats() {
 	for _, trackID := range w.trackIds {
 		w.trackStats[trackID] = &appstats.AdapterTrackStats{
-			StartTime:         time.Now().Unix(),
+			StartTime:         w.clock.Now().Unix(),
 			FirstSeqNum:       0,
 			LastSeqNum:        0,
 			SeqNumWrapArounds: 0,
@@ -409,53 +763,201 @@ func (w *LiveKitWebRTC) initTrackStats() {
 	}
 }
 
+// subscribeToTracks subscribes to the given tracks from scratch, as
+// currently published in the room. Fails if none of them are.
 func (w *LiveKitWebRTC) subscribeToTracks(trackIds []string) (subscribedTrackPubs map[string]*lksdk.RemoteTrackPublication, err error) {
-	subscribedTrackPubs = make(map[string]*lksdk.RemoteTrackPublication)
-	remoteParticipants := make(map[string]*lksdk.RemoteParticipant)
-	pendingSubscriptions := make(map[string]time.Time)
+	w.m.Lock()
+	w.remoteParticipants = make(map[string]*lksdk.RemoteParticipant)
+	w.remoteTrackPubs = make(map[string]*lksdk.RemoteTrackPublication)
+	w.pendingSubscriptions = make(map[string]time.Time)
+	w.m.Unlock()
+
+	if _, err := w.subscribeToAvailableTracks(trackIds); err != nil {
+		return nil, err
+	}
+
+	w.m.Lock()
+	subscribedTrackPubs = maps.Clone(w.remoteTrackPubs)
+	w.m.Unlock()
+
+	if len(subscribedTrackPubs) == 0 {
+		return nil, fmt.Errorf("no tracks available")
+	}
+
+	return subscribedTrackPubs, nil
+}
+
+// subscribeToInitialTracks subscribes to the requested tracks, waiting up to
+// the track publish timeout for those not published yet. Tracks that don't
+// show up in time are left out with a per-track error; it only fails if
+// none of them do.
+func (w *LiveKitWebRTC) subscribeToInitialTracks() error {
+	missing, err := w.awaitTracks(w.cfg.TrackPublishTimeout, func() ([]string, error) {
+		missing, err := w.subscribeToAvailableTracks(w.discoverTracks())
+
+		if err == nil && len(missing) == 0 && w.awaitingDiscovery() {
+			return []string{anyTrack}, nil
+		}
+
+		return missing, err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	w.startDiscovery()
+	missing = slices.DeleteFunc(missing, func(trackID string) bool { return trackID == anyTrack })
+
+	w.m.Lock()
+	for _, trackID := range missing {
+		w.trackErrors[trackID] = fmt.Errorf("%w within %s", errTrackNotPublished, w.cfg.TrackPublishTimeout)
+	}
+	subscribed := len(w.remoteTrackPubs)
+	w.m.Unlock()
+
+	if len(missing) > 0 {
+		w.logger.WithField("room", w.roomId).
+			WithField("trackIds", missing).
+			Warnf("Tracks not published within %s, recording without them", w.cfg.TrackPublishTimeout)
+	}
+
+	if subscribed == 0 {
+		return fmt.Errorf("no tracks available: %w within %s", errTrackNotPublished, w.cfg.TrackPublishTimeout)
+	}
+
+	return nil
+}
+
+// awaitTracks calls subscribe, which returns the requested tracks not
+// published yet, until there are none left or timeout elapses. It's called
+// again on each track-published event, and periodically in case one is
+// missed. Returns the tracks still missing.
+func (w *LiveKitWebRTC) awaitTracks(timeout time.Duration, subscribe func() ([]string, error)) ([]string, error) {
+	missing, err := subscribe()
+
+	if err != nil || len(missing) == 0 || timeout <= 0 {
+		return missing, err
+	}
+
+	w.logger.WithField("trackIds", missing).
+		Infof("Waiting up to %s for tracks to be published", timeout)
+
+	timer := w.clock.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := w.clock.NewTicker(trackPublishPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-timer.C():
+			return missing, nil
+		case <-w.trackPublished:
+		case <-ticker.C():
+		}
+
+		if missing, err = subscribe(); err != nil || len(missing) == 0 {
+			return missing, err
+		}
+	}
+}
 
+// subscribeToAvailableTracks subscribes to the given tracks currently
+// published in the room, and returns those that aren't. Tracks already
+// subscribed to (or being subscribed to) are left alone.
+func (w *LiveKitWebRTC) subscribeToAvailableTracks(trackIds []string) (missing []string, err error) {
 	for _, remoteParticipant := range w.room.GetRemoteParticipants() {
 		for _, remoteTrackPublication := range remoteParticipant.TrackPublications() {
-			if slices.Contains(trackIds, remoteTrackPublication.SID()) {
-				kind := TrackKind(remoteTrackPublication.Kind())
-
-				if kind == TrackKindVideo {
-					w.hasVideo = true
-					w.rec.SetHasVideo(true)
-				} else if kind == TrackKindAudio {
-					w.hasAudio = true
-					w.rec.SetHasAudio(true)
-				}
+			if !slices.Contains(trackIds, remoteTrackPublication.SID()) {
+				continue
+			}
 
-				if remoteTrackPub, ok := remoteTrackPublication.(*lksdk.RemoteTrackPublication); ok {
-					trackSID := remoteTrackPub.SID()
-					subscribedTrackPubs[trackSID] = remoteTrackPub
-					w.participantIDs[trackSID] = remoteParticipant.Identity()
-					remoteParticipants[remoteParticipant.Identity()] = remoteParticipant
-					pendingSubscriptions[trackSID] = time.Now()
-
-					if err := w.subscribe(remoteTrackPub); err != nil {
-						log.WithField("session", w.ctx.Value("session")).
-							Errorf("Failed to subscribe to track %s: %v", trackSID, err)
-						return nil, err
-					}
-				}
+			remoteTrackPub, ok := remoteTrackPublication.(*lksdk.RemoteTrackPublication)
+
+			if !ok {
+				continue
+			}
+
+			if err := w.subscribeToTrack(remoteParticipant, remoteTrackPub); err != nil {
+				return nil, err
 			}
 		}
 	}
 
-	w.remoteParticipants = remoteParticipants
-	w.remoteTrackPubs = subscribedTrackPubs
+	w.m.Lock()
+	defer w.m.Unlock()
 
-	if len(pendingSubscriptions) == 0 {
-		return nil, fmt.Errorf("no tracks available")
+	for _, trackID := range trackIds {
+		if _, ok := w.remoteTrackPubs[trackID]; !ok {
+			missing = append(missing, trackID)
+		}
+	}
+
+	return missing, nil
+}
+
+// videoCodecAllowed returns whether video in mimeType is recorded, as
+// configured by VideoCodecs
+func (w *LiveKitWebRTC) videoCodecAllowed(mimeType string) bool {
+	if len(w.cfg.VideoCodecs) == 0 {
+		return true
 	}
 
+	return slices.ContainsFunc(w.cfg.VideoCodecs, func(codec string) bool {
+		return recorder.NormalizeMimeType(codec) == recorder.NormalizeMimeType(mimeType)
+	})
+}
+
+// subscribeToTrack subscribes to a requested track. It's a no-op for a
+// publication already subscribed to, so the track isn't set up twice.
+func (w *LiveKitWebRTC) subscribeToTrack(remoteParticipant *lksdk.RemoteParticipant, remoteTrackPub *lksdk.RemoteTrackPublication) error {
+	trackSID := remoteTrackPub.SID()
+
 	w.m.Lock()
-	w.pendingSubscriptions = pendingSubscriptions
+	known := w.remoteTrackPubs[trackSID] == remoteTrackPub
 	w.m.Unlock()
 
-	return subscribedTrackPubs, nil
+	if known {
+		return nil
+	}
+
+	kind := TrackKind(remoteTrackPub.Kind())
+
+	if kind == TrackKindVideo {
+		if !w.videoCodecAllowed(remoteTrackPub.MimeType()) {
+			return interfaces.NewTrackError(trackSID,
+				fmt.Errorf("%w: video codec %s not allowed", interfaces.ErrCodecUnsupported, remoteTrackPub.MimeType()))
+		}
+
+		w.hasVideo = true
+		w.rec.SetHasVideo(true)
+
+		// Select the container/depacketizer before the start event goes
+		// out so GetFilePath reports the actual file
+		if err := w.rec.SetVideoCodec(remoteTrackPub.MimeType()); err != nil {
+			return interfaces.NewTrackError(trackSID, err)
+		}
+	} else if kind == TrackKindAudio {
+		w.hasAudio = true
+		w.rec.SetHasAudio(true)
+	}
+
+	w.m.Lock()
+	w.remoteTrackPubs[trackSID] = remoteTrackPub
+	w.participantIDs[trackSID] = remoteParticipant.Identity()
+	w.remoteParticipants[remoteParticipant.Identity()] = remoteParticipant
+	w.pendingSubscriptions[trackSID] = w.clock.Now()
+	delete(w.trackErrors, trackSID)
+	w.m.Unlock()
+
+	if err := w.subscribe(remoteTrackPub); err != nil {
+		w.logger.Errorf("Failed to subscribe to track %s: %v", trackSID, err)
+		return interfaces.NewTrackError(trackSID, fmt.Errorf("%w: %w", interfaces.ErrSubscriptionFailed, err))
+	}
+
+	w.armSubscribeTimeout(trackSID)
+
+	return nil
 }
 
 func (w *LiveKitWebRTC) subscribe(track lksdk.TrackPublication) error {
@@ -464,14 +966,10 @@ func (w *LiveKitWebRTC) subscribe(track lksdk.TrackPublication) error {
 			return nil
 		}
 
-		log.WithField("session", w.ctx.Value("session")).
-			Debugf("Subscribing to track %s", pub.SID())
+		w.logger.Debugf("Subscribing to track %s", pub.SID())
 
 		if pub.Kind() == lksdk.TrackKindVideo {
-			log.WithField("session", w.ctx.Value("session")).
-				Debugf("Setting video quality to %s for track %s", w.cfg.PreferredVideoQuality, pub.SID())
-			// Ignore error - only throws when video quality = OFF which we do not care about
-			_ = pub.SetVideoQuality(w.cfg.PreferredVideoQuality)
+			w.setVideoLayer(pub)
 		}
 
 		return pub.SetSubscribed(true)
@@ -513,75 +1011,193 @@ func (w *LiveKitWebRTC) updateFlowState(trackID string, seqNum uint16, recvTs ti
 		}
 
 		w.flowCallback(state.isFlowing, latestRecvTs.Sub(w.startTs), false)
-		log.WithField("session", w.ctx.Value("session")).
-			Tracef("Flow state changed for track %s: flowing=%v latestRecvTs=%s",
-				trackID, state.isFlowing, latestRecvTs)
+		w.logger.Tracef("Flow state changed for track %s: flowing=%v latestRecvTs=%s",
+			trackID, state.isFlowing, latestRecvTs)
 	}
 
 	return state.isFlowing
 }
 
+// setAudioFormat passes the channel layout of an audio track to the recorder
+func (w *LiveKitWebRTC) setAudioFormat(track *webrtc.TrackRemote, pub *lksdk.RemoteTrackPublication) error {
+	afs, ok := w.rec.(interface {
+		SetAudioFormat(format recorder.OpusFormat) error
+	})
+
+	if !ok {
+		return nil
+	}
+
+	codec := track.Codec()
+	// The SDP channel count is always 2 for Opus
+	format, err := recorder.ParseOpusFormat(codec.MimeType, 0, codec.SDPFmtpLine)
+
+	if err != nil {
+		return err
+	}
+
+	// Publishers flag stereo tracks when publishing, which the SFU doesn't
+	// always carry over to the subscriber's SDP
+	if pub.TrackInfo().GetStereo() && format.Channels == 1 {
+		format.Channels = 2
+	}
+
+	return afs.SetAudioFormat(format)
+}
+
 func (w *LiveKitWebRTC) onTrackSubscribed(
 	track *webrtc.TrackRemote,
 	pub *lksdk.RemoteTrackPublication,
 	rp *lksdk.RemoteParticipant,
 ) {
-	w.observeSubscription(pub.SID())
 	trackID := pub.SID()
+
+	// Subscribing again to a track already being read is a no-op
+	if !w.startReading(trackID, track) {
+		w.logger.WithField("trackID", trackID).
+			Debug("Track already being recorded, ignoring duplicate subscription")
+
+		return
+	}
+
+	w.observeSubscription(trackID)
+	w.armFirstMediaTimeout(trackID, pub)
 	trackKind := TrackKind(pub.Kind())
 	isVideo := trackKind == TrackKindVideo
 	clockRate := track.Codec().ClockRate
 	mimeType := MimeType(strings.ToLower(track.Codec().MimeType))
 
-	log.WithField("session", w.ctx.Value("session")).
-		Infof("Subscribed to track %s source=%s kind=%s mime=%s clockRate=%d participant=%s ssrc=%d",
-			trackID, pub.Source(), trackKind, mimeType, clockRate, rp.Identity(), track.SSRC())
+	w.logger.Infof("Subscribed to track %s source=%s kind=%s mime=%s clockRate=%d participant=%s ssrc=%d",
+		trackID, pub.Source(), trackKind, mimeType, clockRate, rp.Identity(), track.SSRC())
 
-	var depacketizer rtp.Depacketizer
-	switch mimeType {
-	case MimeTypeVP8:
-		depacketizer = &codecs.VP8Packet{}
-	case MimeTypeOpus:
-		depacketizer = &codecs.OpusPacket{}
-	default:
-		log.WithField("session", w.ctx.Value("session")).
-			Errorf("Unsupported codec: %s", mimeType)
+	depacketizer := newDepacketizer(mimeType)
+
+	if depacketizer == nil {
+		w.logger.Errorf("Unsupported codec: %s", mimeType)
+		w.setEndReason(interfaces.CloseReasonError,
+			interfaces.NewTrackError(trackID, fmt.Errorf("%w: %s", interfaces.ErrCodecUnsupported, mimeType)))
 		w.connStateCallback(utils.ConnectionStateFailed)
 
 		return
 	}
 
-	if w.cfg.WriteRTPDump {
-		basePath := w.rec.GetFilePath()
-		ext := filepath.Ext(basePath)
-		rtpPath := fmt.Sprintf("%s.rtp", basePath[:len(basePath)-len(ext)])
-		rtpWriter, err := recorder.NewRTPWriter(rtpPath, net.IP{0, 0, 0, 0}, 0)
+	encrypted := pub.TrackInfo().GetEncryption() != livekit.Encryption_NONE
+
+	if encrypted {
+		var err error
+
+		switch {
+		case !w.decryptor.hasKey():
+			err = errE2EENoKey
+		case mimeType != MimeTypeVP8 && mimeType != MimeTypeOpus:
+			err = fmt.Errorf("%w: %s", errE2EEUnsupported, mimeType)
+		}
 
 		if err != nil {
-			log.WithField("session", w.ctx.Value("session")).
-				WithField("trackID", trackID).
-				Errorf("Failed to create RTP writer for track %s: %v", trackID, err)
-		} else {
-			log.WithField("session", w.ctx.Value("session")).
-				WithField("trackID", trackID).
-				Infof("RTP dump enabled for track %s to %s", trackID, rtpPath)
-			w.rtpWriters[trackID] = rtpWriter
+			w.logger.Errorf("Can't record track %s: %v", trackID, err)
+			w.setEndReason(interfaces.CloseReasonError, interfaces.NewTrackError(trackID, err))
+			w.connStateCallback(utils.ConnectionStateFailed)
+
+			return
+		}
+
+		if w.room != nil {
+			w.decryptor.setSIFTrailer(w.room.SifTrailer())
 		}
 	}
 
-	w.m.Lock()
-	w.remoteTrackPubs[trackID] = pub
-	w.participantIDs[trackID] = rp.Identity()
+	// The negotiated codec is authoritative over what was announced in the
+	// publication; this is a no-op if both match
+	if isVideo {
+		if err := w.rec.SetVideoCodec(string(mimeType)); err != nil {
+			w.logger.Errorf("Failed to set video codec for track %s: %v", trackID, err)
+			w.setEndReason(interfaces.CloseReasonError, interfaces.NewTrackError(trackID, err))
+			w.connStateCallback(utils.ConnectionStateFailed)
 
-	// Ensure remoteParticipants map is initialized - might be a thing if autoSubscribe is true
-	if w.remoteParticipants == nil {
+			return
+		}
+
+		w.setVideoSource(pub)
+	} else {
+		// A change after a resubscription ends the recording rather than
+		// writing frames that don't match the header
+		if err := w.setAudioFormat(track, pub); err != nil {
+			w.logger.Errorf("Failed to set audio format for track %s: %v", trackID, err)
+			w.setEndReason(interfaces.CloseReasonError, interfaces.NewTrackError(trackID, err))
+			w.connStateCallback(utils.ConnectionStateFailed)
+
+			return
+		}
+
+		if receiver := pub.Receiver(); receiver != nil {
+			if id := w.headerExtensions.AudioLevelID(receiver.GetParameters()); id != 0 {
+				if alr, ok := w.rec.(interface{ SetAudioLevelExtensionID(id uint8) }); ok {
+					alr.SetAudioLevelExtensionID(id)
+				}
+			}
+		}
+	}
+
+	w.m.Lock()
+	_, hasRTPWriter := w.rtpWriters[trackID]
+
+	// Tracks share the session's dump, told apart by SSRC or payload type
+	for _, rtpWriter := range w.rtpWriters {
+		if !hasRTPWriter {
+			w.rtpWriters[trackID] = rtpWriter
+			hasRTPWriter = true
+		}
+	}
+	w.m.Unlock()
+
+	// Resubscriptions after a reconnect keep appending to the same dump
+	// Recordings streamed to a writer have no path to dump next to
+	if w.cfg.WriteRTPDump && !hasRTPWriter && w.rec.GetFilePath() != "" {
+		basePath := w.rec.GetFilePath()
+		ext := filepath.Ext(basePath)
+		rtpPath := fmt.Sprintf("%s.rtp", basePath[:len(basePath)-len(ext)])
+		rtpWriter, err := recorder.NewRTPWriter(rtpPath, net.IP{0, 0, 0, 0}, 0)
+
+		if err != nil {
+			w.logger.WithField("trackID", trackID).
+				Errorf("Failed to create RTP writer for track %s: %v", trackID, err)
+		} else {
+			w.logger.WithField("trackID", trackID).
+				Infof("RTP dump enabled for track %s to %s", trackID, rtpPath)
+			w.m.Lock()
+			w.rtpWriters[trackID] = rtpWriter
+			w.m.Unlock()
+		}
+	}
+
+	w.m.Lock()
+	w.remoteTrackPubs[trackID] = pub
+	w.participantIDs[trackID] = rp.Identity()
+
+	// Ensure remoteParticipants map is initialized - might be a thing if autoSubscribe is true
+	if w.remoteParticipants == nil {
 		w.remoteParticipants = make(map[string]*lksdk.RemoteParticipant)
 	}
 
 	w.remoteParticipants[rp.Identity()] = rp
+
+	// Kept across resubscriptions so loss accounts for reconnect gaps
+	if _, exists := w.receptionStats[trackID]; !exists {
+		w.receptionStats[trackID] = newReceptionStats(clockRate)
+		w.receptionStats[trackID].recordNTP = w.cfg.RecordNTPMapping
+	}
+
+	if receiver := pub.Receiver(); receiver != nil {
+		w.receptionStats[trackID].setTWCCExtensionID(w.headerExtensions.TransportCCID(receiver.GetParameters()))
+	}
 	w.m.Unlock()
 
-	latency := time.Duration(200) * time.Millisecond
+	pub.OnRTCP(func(packet rtcp.Packet) {
+		w.processRTCPStats(trackID, packet)
+		w.forwardSenderReport(trackID, packet, isVideo)
+	})
+
+	latency := jitterLatency
 
 	var ssrcForHandler uint32
 
@@ -589,6 +1205,17 @@ func (w *LiveKitWebRTC) onTrackSubscribed(
 		ssrcForHandler = uint32(track.SSRC())
 	}
 
+	var rtpParams webrtc.RTPParameters
+
+	if receiver := pub.Receiver(); receiver != nil {
+		rtpParams = receiver.GetParameters()
+	}
+
+	rtx := newRTXDemuxer(rtpParams, track.Codec(), ssrcForHandler)
+	// pion updates the track's codec when the payload type changes
+	payloadType := uint8(track.Codec().PayloadType)
+	codecCheck := utils.NewCodecChecker(string(mimeType), payloadType, utils.CodecNames(rtpParams))
+
 	buffer := jitter.NewBuffer(
 		depacketizer,
 		clockRate,
@@ -603,10 +1230,38 @@ func (w *LiveKitWebRTC) onTrackSubscribed(
 
 	w.jitterBuffers[trackID] = buffer
 
+	reorderCfg := w.cfg.JitterBuffer.Audio
+
+	if isVideo {
+		reorderCfg = w.cfg.JitterBuffer.Video
+	}
+
+	reorder := newReorderBuffer(w.ctx, reorderCfg)
+
+	// Retransmissions are only useful while the buffers still wait for them
+	nackMaxAge := latency
+
+	if reorder != nil {
+		nackMaxAge = reorderCfg.MaxDelay
+	}
+
+	nacks := newNACKTracker(w.cfg.NACK, track.Codec(), nackMaxAge)
+
 	if isVideo {
 		w.m.Lock()
 		if _, exists := w.pliStats[ssrcForHandler]; !exists {
-			w.pliStats[ssrcForHandler] = pliTracker{count: 0, timestamp: time.Now()}
+			w.pliStats[ssrcForHandler] = pliTracker{}
+		}
+
+		screenShare := videoSource(pub) == recorder.VideoSourceScreenShare
+		w.screenShares[ssrcForHandler] = screenShare
+
+		if w.cfg.AdaptiveKeyframeInterval.Enabled && !screenShare {
+			w.keyframeIntervals[trackID] = newKeyframeInterval(w.cfg.AdaptiveKeyframeInterval, ssrcForHandler)
+
+			if stats, ok := w.trackStats[trackID]; ok {
+				stats.KeyframeIntervalMs = w.cfg.AdaptiveKeyframeInterval.MaxInterval.Milliseconds()
+			}
 		}
 		w.m.Unlock()
 
@@ -615,6 +1270,14 @@ func (w *LiveKitWebRTC) onTrackSubscribed(
 		}); ok {
 			kfr.SetKeyframeRequester(w)
 		}
+
+		if fkc, ok := w.rec.(interface {
+			SetFirstKeyframeCallback(func(timestamp time.Duration))
+		}); ok {
+			fkc.SetFirstKeyframeCallback(func(timestamp time.Duration) {
+				w.notifyFirstKeyframe(trackID, timestamp)
+			})
+		}
 	}
 
 	flowCheckDone := make(chan bool)
@@ -622,14 +1285,14 @@ func (w *LiveKitWebRTC) onTrackSubscribed(
 		flowCheckDone <- true
 	}()
 	go func() {
-		ticker := time.NewTicker(notFlowingTicker)
+		ticker := w.clock.NewTicker(notFlowingTicker)
 		var lastSeqNum uint16
 		for {
 			select {
 			case <-flowCheckDone:
 				ticker.Stop()
 				return
-			case <-ticker.C:
+			case <-ticker.C():
 				var currentSeqNum uint16
 				var currentRecvTs time.Time
 				var isFlowing bool
@@ -664,11 +1327,31 @@ func (w *LiveKitWebRTC) onTrackSubscribed(
 
 	appstats.OnTrackRecordingStarted(string(trackKind), string(mimeType), pub.Source().String())
 
+	// Published muted: nothing flows until it's unmuted
+	if pub.IsMuted() {
+		w.setTrackMuted(trackID, isVideo, true)
+	}
+
+	// Disabled before it was subscribed to (or resubscribed to)
+	w.m.Lock()
+	disabled := w.trackDisabled(trackID)
+	w.m.Unlock()
+
+	if disabled && w.disabledTracksMode() == DisabledTracksStop {
+		pub.SetEnabled(false)
+	}
+
 	go func() {
+		// Set when the track can't be recorded any longer, e.g. it switched
+		// to a codec it isn't recorded as
+		var trackErr error
+		// Set when reads keep failing and the track is to be resubscribed to
+		var resubscribe bool
+
 		defer func() {
+			w.stopReading(trackID, track)
 			appstats.OnTrackRecordingStopped(string(trackKind), string(mimeType), pub.Source().String())
-			log.WithField("session", w.ctx.Value("session")).
-				WithField("trackID", trackID).
+			w.logger.WithField("trackID", trackID).
 				WithField("source", pub.Source().String()).
 				WithField("kind", trackKind).
 				WithField("mime", mimeType).
@@ -677,83 +1360,493 @@ func (w *LiveKitWebRTC) onTrackSubscribed(
 
 			// If a panic occurs, notify the connection state callback as failed so clients can retry/handle it
 			if err := recover(); err != nil {
-				log.WithField("session", w.ctx.Value("session")).
-					WithField("error", err).
+				w.logger.WithField("error", err).
 					WithField("stack", string(debug.Stack())).
 					Error("Panic detected in LiveKit packet processing, emit failed state")
 
+				w.setEndReason(interfaces.CloseReasonError, fmt.Errorf("panic processing track %s: %v", trackID, err))
 				w.connStateCallback(utils.ConnectionStateFailed)
+			} else if trackErr != nil {
+				w.failTrack(trackID, trackErr)
+			} else if resubscribe && w.reconnectCtx.Err() == nil {
+				if err := w.resubscribe(trackID, pub); err != nil {
+					w.failTrack(trackID, fmt.Errorf("resubscribing: %w", err))
+				}
+			} else if w.suspendTrack(trackID) {
+				w.logger.WithField("trackID", trackID).
+					Info("Track will resume once the room is reconnected")
 			} else {
+				w.setEndReason(interfaces.CloseReasonTrackEnded, nil)
 				w.connStateCallback(utils.ConnectionStateClosed)
 			}
 		}()
 
+		w.m.Lock()
 		rtpWriter, rtpWriterExists := w.rtpWriters[trackID]
+		w.m.Unlock()
+		firstPacket := true
+		readErrors := newReadErrorTracker(w.cfg.ReadErrors)
+		duplicates := utils.NewDuplicateFilter()
+		splicer := newSSRCSplicer(clockRate)
+		pending := newPendingPackets(&w.pendingBytes)
+		defer pending.reset()
+		reader := newRTPReader()
+
+		writeSample := func(packets []*rtp.Packet) {
+			recvTs := w.clock.Now()
+			samplePackets := packets
+
+			if encrypted {
+				samplePackets = w.decryptSample(trackID, mimeType, packets, ssrcForHandler)
+			}
+
+			keyframe := isVideo && isKeyframeSample(mimeType, samplePackets)
+
+			if keyframe {
+				w.onKeyframeReceived(ssrcForHandler)
+			}
+
+			// Only the dominant speaker's video is written
+			if isVideo && w.speaker != nil {
+				samplePackets = w.speakerSample(trackID, samplePackets, keyframe, clockRate)
+			}
+
+			samplePackets, collectStats := w.gateSample(trackID, samplePackets, keyframe)
+
+			for _, p := range samplePackets {
+				switch trackKind {
+				case TrackKindVideo:
+					w.rec.PushVideo(p)
+				case TrackKindAudio:
+					if w.mixer != nil {
+						w.mixer.PushAudioTrack(trackID, p)
+					} else {
+						w.rec.PushAudio(p)
+					}
+				}
+			}
+
+			w.updateFlowState(trackID, packets[0].SequenceNumber, recvTs)
+
+			if collectStats {
+				w.processPacketStats(trackID, packets)
+			}
+		}
+
+		// Written as read, unless a receive queue hands them over to a
+		// goroutine of their own (see config.ReceiveQueue)
+		write := writeSample
+
+		if w.cfg.ReceiveQueue.Size > 0 {
+			queue := newReceiveQueue(w.cfg.ReceiveQueue, w.clock)
+			defer queue.close()
+
+			go func() {
+				defer func() {
+					if err := recover(); err != nil {
+						w.logger.WithField("error", err).
+							WithField("stack", string(debug.Stack())).
+							Error("Panic detected in LiveKit sample writing, emit failed state")
+
+						w.setEndReason(interfaces.CloseReasonError, fmt.Errorf("panic writing track %s: %v", trackID, err))
+						w.connStateCallback(utils.ConnectionStateFailed)
+					}
+				}()
+
+				queue.drain(writeSample)
+			}()
+
+			write = func(packets []*rtp.Packet) {
+				dropped, deeper := queue.push(packets)
+				w.onReceiveQueuePush(trackID, queue, dropped, deeper, ssrcForHandler, isVideo)
+			}
+		}
+
+		// Hands the packets out of the reorder buffer, in sequence, to the
+		// sample buffer, once the recorder was told about those skipped
+		deliver := func(ordered []*rtp.Packet, skipped []uint16) {
+			for _, seq := range skipped {
+				w.rec.NotifySkippedPacket(seq)
+			}
+
+			if len(skipped) > 0 {
+				w.logger.WithField("trackID", trackID).
+					Debugf("Notified recorder of %d skipped packets: seq=%d-%d", len(skipped), skipped[0], skipped[len(skipped)-1])
+			}
+
+			for _, p := range ordered {
+				buffer.Push(p)
+				pending.push(p)
+			}
+
+			// A push can complete more than one sample (e.g. when a lost
+			// packet is given up on)
+			for packets := buffer.Pop(false); len(packets) > 0; packets = buffer.Pop(false) {
+				pending.release(packets)
+				write(packets)
+			}
+
+			if pending.exceeds(w.cfg.Limits) {
+				w.flushPending(trackID, buffer, pending, write)
+			}
+		}
 
 		for {
+			// The track's deadline is on the system clock
 			readDeadline := time.Now().Add(w.cfg.PacketReadTimeout)
-			// Ignore error from SetReadDeadline - it comes from pion/packetio
-			// but it'll never throw - probably conforming to some interface
-			_ = track.SetReadDeadline(readDeadline)
-			packet, _, err := track.ReadRTP()
+			// Packets held back for a missing one are handed out once it's
+			// given up on, even if nothing comes meanwhile (e.g. the
+			// publisher muted or paused)
+			flushAt, flush := time.Time{}, false
+
+			if reorder != nil {
+				flushAt, flush = reorder.FlushAt()
+			}
+
+			flush = flush && flushAt.Before(readDeadline)
+
+			if flush {
+				// Ignore error from SetReadDeadline - it comes from pion/packetio
+				// but it'll never throw - probably conforming to some interface
+				_ = track.SetReadDeadline(flushAt)
+			} else {
+				_ = track.SetReadDeadline(readDeadline)
+			}
+
+			packet, attributes, err := reader.read(track)
+
+			if flush && isTimeout(err) {
+				deliver(reorder.Flush())
+				continue
+			}
+
+			if errors.Is(err, webrtc.ErrCodecNotFound) {
+				if trackErr = codecCheck.CheckUnnegotiated(); trackErr != nil {
+					return
+				}
+
+				continue
+			}
 
 			if err != nil {
-				if procErr := w.handleReadRTPError(err, trackID, pub); procErr != nil {
-					if procErr == io.EOF {
-						log.WithField("session", w.ctx.Value("session")).
-							Infof("%s track=%s stopped", pub.MimeType(), trackID)
-					} else {
-						log.WithField("session", w.ctx.Value("session")).
-							Errorf("Unexpected error handling RTP packet from track %s: %v", trackID, procErr)
-						// TODO this should be a panic-like situation
-					}
+				procErr := w.handleReadRTPError(err, trackID, pub)
+
+				if procErr == io.EOF {
+					w.logger.Infof("%s track=%s stopped", pub.MimeType(), trackID)
 
 					return
 				}
+
+				// Back off rather than spinning on a track gone bad
+				if procErr != nil {
+					wait, persistent := readErrors.failed(w.clock.Now())
+					w.setConsecutiveReadErrors(trackID, readErrors.consecutive)
+
+					if persistent {
+						if w.canResubscribe(trackID) {
+							resubscribe = true
+						} else {
+							trackErr = fmt.Errorf("%w, %d in a row: %v", errReadsFailing, readErrors.consecutive, procErr)
+						}
+
+						return
+					}
+
+					timer := w.clock.NewTimer(wait)
+
+					select {
+					case <-timer.C():
+					case <-w.reconnectCtx.Done():
+						timer.Stop()
+						return
+					}
+
+					continue
+				}
+			} else if readErrors.succeeded() {
+				w.setConsecutiveReadErrors(trackID, 0)
 			}
 
 			if packet == nil {
 				continue
 			}
 
+			packet, recovered := rtx.demux(packet, attributes)
+
+			if packet == nil {
+				continue
+			}
+
+			// Retransmits of packets already received included
+			if duplicates.Duplicate(packet.SSRC, packet.SequenceNumber) {
+				w.onDuplicatePacket(trackID, packet)
+				continue
+			}
+
+			if recovered {
+				w.onRTXPacket(trackID, packet)
+			}
+
+			w.processReceptionStats(trackID, packet)
+
+			if nacks != nil {
+				now := w.clock.Now()
+				nacks.push(packet.SequenceNumber, now)
+				w.sendNACKs(trackID, ssrcForHandler, nacks, now)
+			}
+
+			// Packets of another codec would be written as garbage
+			if ok, err := codecCheck.Check(packet.PayloadType); err != nil {
+				trackErr = err
+				return
+			} else if !ok {
+				if codecCheck.Mismatches() == 1 {
+					w.logger.WithField("trackID", trackID).
+						Warnf("Dropping packet seq=%d of payload type %d, expected %d",
+							packet.SequenceNumber, packet.PayloadType, payloadType)
+				}
+
+				continue
+			}
+
+			if firstPacket {
+				firstPacket = false
+				w.notifyFirstPacket(trackID, trackKind, packet)
+				w.resumeTrack(trackID, packet, isVideo, ssrcForHandler)
+			}
+
+			// Keep draining the track until it's closed, but nothing else
+			// gets written
+			if w.checkMaxDuration() {
+				continue
+			}
+
 			if rtpWriterExists {
 				if err := rtpWriter.WriteRTP(packet); err != nil {
-					log.WithField("session", w.ctx.Value("session")).
-						WithField("trackID", trackID).
+					w.logger.WithField("trackID", trackID).
 						Warnf("failed to write RTP packet for track %s: %v", trackID, err)
 				}
 			}
 
-			buffer.Push(packet)
-			packets := buffer.Pop(false)
+			previousSSRC, receivedSeq := splicer.ssrc, packet.SequenceNumber
+			switched, keep := splicer.splice(packet, w.clock.Now())
+			w.processSSRCStats(trackID, packet.SSRC, receivedSeq, !keep)
 
-			if len(packets) == 0 {
+			if !keep {
 				continue
 			}
 
-			recvTs := time.Now()
-
-			for _, p := range packets {
-				switch trackKind {
-				case TrackKindVideo:
-					w.rec.PushVideo(p)
-				case TrackKindAudio:
-					w.rec.PushAudio(p)
-				}
+			if switched {
+				w.onSSRCChange(trackID, packet, previousSSRC, isVideo)
 			}
 
-			w.updateFlowState(trackID, packets[0].SequenceNumber, recvTs)
-			w.processPacketStats(trackID, packets)
+			if reorder != nil {
+				deliver(reorder.Push(packet))
+			} else {
+				deliver([]*rtp.Packet{packet}, nil)
+			}
 		}
 	}()
 }
 
+func (w *LiveKitWebRTC) notifyFirstPacket(trackID string, kind TrackKind, packet *rtp.Packet) {
+	w.m.Lock()
+
+	if w.firstPacketSeen[trackID] {
+		w.m.Unlock()
+		return
+	}
+
+	w.firstPacketSeen[trackID] = true
+	w.disarmTimeout(w.timeouts.firstMedia, trackID)
+	callback := w.firstPacketCb
+	w.m.Unlock()
+
+	event := interfaces.MediaEvent{
+		TrackID:      trackID,
+		Kind:         string(kind),
+		Timestamp:    w.clock.Since(w.startTs),
+		RTPTimestamp: packet.Timestamp,
+	}
+
+	w.logger.WithField("trackID", trackID).
+		Infof("First %s packet received: ts=%v rtpTs=%d", kind, event.Timestamp, packet.Timestamp)
+
+	if callback != nil {
+		callback(event)
+	}
+}
+
+func (w *LiveKitWebRTC) notifyFirstKeyframe(trackID string, mediaTimestamp time.Duration) {
+	w.m.Lock()
+
+	if w.firstKeyframeSeen {
+		w.m.Unlock()
+		return
+	}
+
+	w.firstKeyframeSeen = true
+	callback := w.firstKeyframeCb
+	w.m.Unlock()
+
+	event := interfaces.MediaEvent{
+		TrackID:        trackID,
+		Kind:           string(TrackKindVideo),
+		Timestamp:      w.clock.Since(w.startTs),
+		MediaTimestamp: mediaTimestamp,
+	}
+
+	w.logger.WithField("trackID", trackID).
+		Infof("First keyframe written: ts=%v mediaTs=%v", event.Timestamp, mediaTimestamp)
+
+	if callback != nil {
+		callback(event)
+	}
+}
+
+// decryptSample returns the decrypted packets of an end-to-end encrypted
+// sample. Samples that fail to decrypt are dropped rather than written as
+// garbage; on video, a keyframe is requested to recover.
+func (w *LiveKitWebRTC) decryptSample(
+	trackID string,
+	mimeType MimeType,
+	packets []*rtp.Packet,
+	ssrc uint32,
+) []*rtp.Packet {
+	decrypted, err := w.decryptor.decrypt(mimeType, packets)
+
+	if err == nil {
+		return decrypted
+	}
+
+	w.m.Lock()
+	stats := w.trackStats[trackID]
+	stats.DecryptFailures++
+	failures := stats.DecryptFailures
+	w.m.Unlock()
+
+	logger := w.logger.WithField("trackID", trackID)
+
+	// Usually a wrong or missing key, which fails every frame: don't flood
+	if failures == 1 {
+		logger.Warnf("Failed to decrypt track %s, dropping frames: %v", trackID, err)
+	} else {
+		logger.Debugf("Failed to decrypt track %s: %v", trackID, err)
+	}
+
+	if mimeType != MimeTypeOpus {
+		w.queueKeyframeRequest(ssrc, "decrypt_failure")
+	}
+
+	return nil
+}
+
+// flushPending writes out everything a track's sample buffer holds, complete
+// samples or not, once it holds more than the configured limits allow. The
+// packets are counted as late.
+func (w *LiveKitWebRTC) flushPending(
+	trackID string,
+	buffer *jitter.Buffer,
+	pending *pendingPackets,
+	writeSample func(packets []*rtp.Packet),
+) {
+	count := pending.reset()
+	sessionBytes := w.pendingBytes.Load()
+
+	w.m.Lock()
+	stats := w.trackStats[trackID]
+	stats.LatePackets += uint64(count)
+	late := stats.LatePackets
+	w.m.Unlock()
+
+	logger := w.logger.WithField("trackID", trackID)
+
+	// A flooding publisher hits the limits over and over: don't flood too
+	if late == uint64(count) {
+		logger.Warnf("Sample buffer limits exceeded, flushing %d packets: sessionPendingBytes=%d", count, sessionBytes)
+	} else {
+		logger.Debugf("Sample buffer limits exceeded, flushing %d packets: sessionPendingBytes=%d", count, sessionBytes)
+	}
+
+	for _, packets := range buffer.PopSamples(true) {
+		if len(packets) > 0 {
+			writeSample(packets)
+		}
+	}
+}
+
+// checkMaxDuration returns whether the recording reached MaxDuration, asking
+// for it to be stopped the first time it does. Media time is used rather
+// than wall clock so paused or silent streams don't count towards it.
+func (w *LiveKitWebRTC) checkMaxDuration() bool {
+	if w.cfg.MaxDuration <= 0 {
+		return false
+	}
+
+	mediaTime := max(w.rec.VideoTimestamp(), w.rec.AudioTimestamp())
+
+	w.m.Lock()
+
+	if w.maxDurationReached {
+		w.m.Unlock()
+		return true
+	}
+
+	if mediaTime < w.cfg.MaxDuration {
+		w.m.Unlock()
+		return false
+	}
+
+	w.maxDurationReached = true
+	callback := w.stopCallback
+	w.m.Unlock()
+	w.setEndReason(interfaces.CloseReasonMaxDuration, nil)
+
+	w.logger.WithField("room", w.roomId).
+		WithField("mediaTime", mediaTime).
+		Warnf("Maximum recording duration of %s reached, stopping", w.cfg.MaxDuration)
+
+	if callback != nil {
+		callback(events.StopReasonMaxDuration)
+	} else {
+		w.connStateCallback(utils.ConnectionStateClosed)
+	}
+
+	return true
+}
+
+// startReading claims a subscribed track for its reader. Returns false if
+// it's already being read.
+func (w *LiveKitWebRTC) startReading(trackID string, track *webrtc.TrackRemote) bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.readingTracks[trackID] == track {
+		return false
+	}
+
+	w.readingTracks[trackID] = track
+
+	return true
+}
+
+// stopReading releases a track claimed by startReading, unless a newer
+// subscription already took over
+func (w *LiveKitWebRTC) stopReading(trackID string, track *webrtc.TrackRemote) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.readingTracks[trackID] == track {
+		delete(w.readingTracks, trackID)
+	}
+}
+
 func (w *LiveKitWebRTC) observeSubscription(trackID string) {
 	w.m.Lock()
 	defer w.m.Unlock()
 
 	if startTime, ok := w.pendingSubscriptions[trackID]; ok && !startTime.IsZero() {
-		duration := time.Since(startTime)
+		duration := w.clock.Since(startTime)
 		appstats.ObserveLiveKitSubscribeDuration(duration)
 		delete(w.pendingSubscriptions, trackID)
 	}
@@ -765,43 +1858,56 @@ func (w *LiveKitWebRTC) trackReadErrorStats(err error, trackID string, pub *lksd
 		w.m.Lock()
 		w.trackStats[trackID].RTPReadErrors++
 		w.m.Unlock()
+		w.updateLiveMetrics(trackID)
 	}
 }
 
-func (w *LiveKitWebRTC) handleReadRTPError(err error, trackID string, pub *lksdk.RemoteTrackPublication) error {
+// isTimeout returns whether err is a read deadline expiring
+func isTimeout(err error) bool {
 	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (w *LiveKitWebRTC) handleReadRTPError(err error, trackID string, pub *lksdk.RemoteTrackPublication) error {
 	flowState := w.flowState[trackID]
 
-	log.WithField("session", w.ctx.Value("session")).
-		Tracef("Error reading RTP packet from track %s: %+v", trackID, err)
+	w.logger.Tracef("Error reading RTP packet from track %s: %+v", trackID, err)
 	w.trackReadErrorStats(err, trackID, pub)
 
 	switch {
-	case errors.As(err, &netErr) && netErr.Timeout():
+	case isTimeout(err):
 		// If the flow state is nil, it means the track is not being tracked yet,
 		// so it's not flowing - skip
 		if flowState == nil || !flowState.isFlowing {
 			return nil
 		}
 
-		log.WithField("session", w.ctx.Value("session")).
-			Warnf("Network error reading RTP packet from track %s: %v", trackID, err)
+		w.m.Lock()
+		muted := w.trackSilent(trackID)
+		w.m.Unlock()
+
+		// Muted tracks stop sending, as do disabled ones, that's expected
+		if muted {
+			w.logger.Debugf("Muted track %s stopped flowing", trackID)
+		} else {
+			w.logger.Warnf("Network error reading RTP packet from track %s: %v", trackID, err)
+		}
+
 		// Update the flow state to indicate the track is not flowing. Nothing much
 		// else we can do here.
 		w.updateFlowState(trackID, flowState.lastSeqNum, flowState.lastRecvTs)
 
+	// The packet is dropped, the track is still fine
 	case err.Error() == "buffer too small":
-		log.WithField("session", w.ctx.Value("session")).
-			Warnf("Buffer too small reading RTP packet from track %s", trackID)
+		w.logger.Warnf("Buffer too small reading RTP packet from track %s", trackID)
 
 	case err.Error() == "EOF" || err == io.EOF:
-		log.WithField("session", w.ctx.Value("session")).
-			Infof("%s track stopped", pub.MimeType())
-		return err
+		w.logger.Infof("%s track stopped", pub.MimeType())
+		return io.EOF
 
 	default:
-		log.WithField("session", w.ctx.Value("session")).
-			Errorf("Unexpected error handling RTP packet from track %s: %v", trackID, err)
+		w.logger.Errorf("Unexpected error handling RTP packet from track %s: %v", trackID, err)
 
 		return err
 	}
@@ -809,26 +1915,195 @@ func (w *LiveKitWebRTC) handleReadRTPError(err error, trackID string, pub *lksdk
 	return nil
 }
 
+// failTrack stops recording a track that can't be recorded any longer,
+// failing the session
+func (w *LiveKitWebRTC) failTrack(trackID string, err error) {
+	w.logger.WithField("trackID", trackID).
+		Errorf("Stopping track recording: %v", err)
+
+	w.m.Lock()
+	w.trackErrors[trackID] = err
+	w.m.Unlock()
+	w.setEndReason(interfaces.CloseReasonError, interfaces.NewTrackError(trackID, err))
+	w.connStateCallback(utils.ConnectionStateFailed)
+}
+
 func (w *LiveKitWebRTC) processPacketStats(trackID string, packets []*rtp.Packet) {
 	w.m.Lock()
-	defer w.m.Unlock()
 
 	firstPacket := packets[0]
 	lastPacket := packets[len(packets)-1]
 	stats := w.trackStats[trackID]
 
-	// This method receives packets from unforced jitter buffer packet pops, which means they're
-	// properly ordered. Check is simpler this way. TODO review gaps larger than 2^16/2
-	if lastPacket.SequenceNumber < firstPacket.SequenceNumber ||
-		firstPacket.SequenceNumber < stats.LastSeqNum {
-		stats.SeqNumWrapArounds++
+	// This method receives packets from unforced jitter buffer packet pops,
+	// which means they're properly ordered
+	hadSeqNum, prevSeqNum, wrapArounds := stats.HasSeqNum, stats.LastSeqNum, stats.SeqNumWrapArounds
+	stats.OnPacketBatch(firstPacket.SequenceNumber, lastPacket.SequenceNumber, len(packets))
+
+	// Packets sent since the previous batch, including the ones lost before
+	// this one. Larger gaps than 2^15 are old packets, not losses.
+	expected := uint64(lastPacket.SequenceNumber-firstPacket.SequenceNumber) + 1
+
+	if hadSeqNum {
+		expected = uint64(lastPacket.SequenceNumber - prevSeqNum)
 	}
 
-	stats.LastSeqNum = lastPacket.SequenceNumber
+	if expected < 1<<15 {
+		w.adaptKeyframeInterval(trackID, stats, expected, len(packets))
+	}
+
+	if !hadSeqNum {
+		w.logger.WithField("trackID", trackID).
+			WithField("firstSeqNum", stats.FirstSeqNum).
+			Debug("Sequence number tracking started")
+	}
 
-	log.WithField("session", w.ctx.Value("session")).
-		Tracef("Processed packet batch for track %s: lastSeqNum: %d, firstSeqNum: %d, wraparound: %d, firstPacket: %d, lastPacket: %d",
+	if stats.SeqNumWrapArounds != wrapArounds {
+		w.logger.WithField("trackID", trackID).
+			WithField("prevSeqNum", prevSeqNum).
+			WithField("batchFirstSeqNum", firstPacket.SequenceNumber).
+			WithField("batchLastSeqNum", lastPacket.SequenceNumber).
+			WithField("wrapArounds", stats.SeqNumWrapArounds).
+			WithField("lossFraction", stats.LossFraction).
+			Debug("Sequence number wraparound detected")
+	}
+
+	bs, ok := w.bitrateStats[trackID]
+
+	if !ok {
+		bs = newBitrateStats()
+		w.bitrateStats[trackID] = bs
+	}
+
+	now := w.clock.Now()
+
+	for _, packet := range packets {
+		bs.onRTP(packet, now)
+	}
+
+	bs.apply(stats)
+	pub, layer := w.adaptQuality(trackID, bs, now)
+
+	if log.IsLevelEnabled(log.TraceLevel) {
+		w.logger.Tracef("Processed packet batch for track %s: lastSeqNum: %d, firstSeqNum: %d, wraparound: %d, firstPacket: %d, lastPacket: %d",
 			trackID, stats.LastSeqNum, stats.FirstSeqNum, stats.SeqNumWrapArounds, firstPacket.SequenceNumber, lastPacket.SequenceNumber)
+	}
+
+	w.m.Unlock()
+
+	if layer != nil {
+		_ = pub.SetVideoQuality(layer.Quality)
+		w.rec.SetVideoLayer(qualityName(layer.Quality), layer.Width, layer.Height)
+	}
+
+	w.updateLiveMetrics(trackID)
+}
+
+func (w *LiveKitWebRTC) onRTXPacket(trackID string, packet *rtp.Packet) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if stats, ok := w.trackStats[trackID]; ok {
+		stats.RTXRecoveredPackets++
+	}
+
+	w.logger.Tracef("Recovered packet seq=%d of track %s from RTX", packet.SequenceNumber, trackID)
+}
+
+func (w *LiveKitWebRTC) onDuplicatePacket(trackID string, packet *rtp.Packet) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if stats, ok := w.trackStats[trackID]; ok {
+		stats.DuplicatePackets++
+	}
+
+	w.logger.Tracef("Dropped duplicate packet seq=%d of track %s", packet.SequenceNumber, trackID)
+}
+
+func (w *LiveKitWebRTC) processReceptionStats(trackID string, packet *rtp.Packet) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	rs, ok := w.receptionStats[trackID]
+	stats, hasStats := w.trackStats[trackID]
+
+	if !ok || !hasStats {
+		return
+	}
+
+	rs.onRTP(packet, w.clock.Now())
+	rs.apply(stats)
+}
+
+func (w *LiveKitWebRTC) processRTCPStats(trackID string, packet rtcp.Packet) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	rs, ok := w.receptionStats[trackID]
+	stats, hasStats := w.trackStats[trackID]
+
+	if !ok || !hasStats {
+		return
+	}
+
+	rs.onRTCP(packet, w.clock.Now())
+	rs.apply(stats)
+}
+
+// updateLiveMetrics exports the track's current adapter stats to Prometheus.
+// Recorder stats (bytes written) are more expensive to fetch, so they're
+// only refreshed every liveMetricsRecorderInterval.
+// Must be called without w.m held: fetching recorder stats takes the
+// recorder lock, which may be held while the recorder requests keyframes.
+func (w *LiveKitWebRTC) updateLiveMetrics(trackID string) {
+	w.m.Lock()
+	stats, ok := w.trackStats[trackID]
+
+	if !ok || stats == nil {
+		w.m.Unlock()
+		return
+	}
+
+	snapshot := *stats
+	pub := w.remoteTrackPubs[trackID]
+	isVideo := pub != nil && pub.Kind() == lksdk.TrackKindVideo
+
+	if isVideo {
+		snapshot.PLIRequests = 0
+		snapshot.FIRRequests = 0
+		for _, tracker := range w.pliStats {
+			snapshot.PLIRequests += tracker.count
+			snapshot.FIRRequests += tracker.firCount
+		}
+	}
+
+	refreshRecorder := pub != nil && w.rec != nil &&
+		w.clock.Since(w.lastRecorderMetricsUpdate[trackID]) >= liveMetricsRecorderInterval
+
+	if refreshRecorder {
+		w.lastRecorderMetricsUpdate[trackID] = w.clock.Now()
+	}
+	w.m.Unlock()
+
+	sessionID := w.ctx.Value("session").(string)
+	appstats.UpdateSessionTrackMetrics(sessionID, trackID, &snapshot)
+
+	if !refreshRecorder {
+		return
+	}
+
+	recStats := w.rec.GetStats()
+
+	if recStats == nil {
+		return
+	}
+
+	if isVideo && recStats.Video != nil {
+		appstats.SetSessionTrackBytesWritten(sessionID, trackID, recStats.Video.BytesWritten)
+	} else if !isVideo && recStats.Audio != nil {
+		appstats.SetSessionTrackBytesWritten(sessionID, trackID, recStats.Audio.BytesWritten)
+	}
 }
 
 func (w *LiveKitWebRTC) onTrackUnsubscribed(
@@ -846,14 +2121,13 @@ func (w *LiveKitWebRTC) onTrackUnsubscribed(
 	w.m.Lock()
 
 	if stats, ok := w.trackStats[trackID]; ok {
-		stats.EndTime = time.Now().Unix()
+		stats.EndTime = w.clock.Now().Unix()
 	}
 
 	w.m.Unlock()
 
-	log.WithField("session", w.ctx.Value("session")).
-		Infof("Unsubscribed from track %s source=%s kind=%s participant=%s ssrc=%d",
-			trackID, pub.Source(), trackKind, rp.Identity(), track.SSRC())
+	w.logger.Infof("Unsubscribed from track %s source=%s kind=%s participant=%s ssrc=%d",
+		trackID, pub.Source(), trackKind, rp.Identity(), track.SSRC())
 }
 
 func (w *LiveKitWebRTC) onTrackSubscriptionFailed(
@@ -864,16 +2138,43 @@ func (w *LiveKitWebRTC) onTrackSubscriptionFailed(
 		return
 	}
 
+	w.setEndReason(interfaces.CloseReasonError, interfaces.NewTrackError(trackID, interfaces.ErrSubscriptionFailed))
 	w.connStateCallback(utils.ConnectionStateFailed)
 
-	log.WithField("session", w.ctx.Value("session")).
-		WithField("room", w.roomId).
+	w.logger.WithField("room", w.roomId).
 		WithField("identity", w.identity).
 		WithField("trackID", trackID).
 		Errorf("Track subscription failed")
 	appstats.OnTrackSubscriptionFailed("livekit_failure")
 }
 
+// onTrackPublished wakes up Init if it's waiting for requested tracks, and
+// subscribes to the tracks discovered once recording
+func (w *LiveKitWebRTC) onTrackPublished(
+	pub *lksdk.RemoteTrackPublication,
+	rp *lksdk.RemoteParticipant,
+) {
+	w.m.Lock()
+	requested := w.adoptTrack(rp, pub)
+	w.m.Unlock()
+
+	if !requested {
+		return
+	}
+
+	w.logger.WithField("room", w.roomId).
+		WithField("identity", w.identity).
+		WithField("trackID", pub.SID()).
+		Debug("Track published")
+
+	select {
+	case w.trackPublished <- struct{}{}:
+	default:
+	}
+
+	w.subscribeToDiscoveredTrack(rp, pub)
+}
+
 func (w *LiveKitWebRTC) onTrackUnpublished(
 	pub *lksdk.RemoteTrackPublication,
 	rp *lksdk.RemoteParticipant,
@@ -884,8 +2185,9 @@ func (w *LiveKitWebRTC) onTrackUnpublished(
 		return
 	}
 
-	log.WithField("session", w.ctx.Value("session")).
-		WithField("room", w.roomId).
+	w.forgetDiscoveredVideo(trackID)
+
+	w.logger.WithField("room", w.roomId).
 		WithField("identity", w.identity).
 		WithField("trackID", trackID).
 		Infof("Track unpublished")
@@ -898,12 +2200,15 @@ func (w *LiveKitWebRTC) onTrackUnmuted(
 	trackID := pub.SID()
 
 	// Only track mute/unmute events for tracks we're *subscribed* to
-	if _, exists := w.remoteTrackPubs[trackID]; !exists {
+	w.m.Lock()
+	_, exists := w.remoteTrackPubs[trackID]
+	w.m.Unlock()
+
+	if !exists {
 		return
 	}
 
-	log.WithField("session", w.ctx.Value("session")).
-		Infof("Track unmuted: %s", trackID)
+	w.setTrackMuted(trackID, pub.Kind() == lksdk.TrackKindVideo, false)
 }
 
 func (w *LiveKitWebRTC) onTrackMuted(
@@ -913,22 +2218,39 @@ func (w *LiveKitWebRTC) onTrackMuted(
 	trackID := pub.SID()
 
 	// Only track mute/unmute events for tracks we're *subscribed* to
-	if _, exists := w.remoteTrackPubs[trackID]; !exists {
+	w.m.Lock()
+	_, exists := w.remoteTrackPubs[trackID]
+	w.m.Unlock()
+
+	if !exists {
 		return
 	}
 
-	log.WithField("session", w.ctx.Value("session")).
-		Infof("Track muted: %s", trackID)
+	w.setTrackMuted(trackID, pub.Kind() == lksdk.TrackKindVideo, true)
 }
 
 func (w *LiveKitWebRTC) onDisconnected(reason lksdk.DisconnectionReason) {
-	log.WithField("session", w.ctx.Value("session")).
-		WithField("room", w.roomId).
+	w.logger.WithField("room", w.roomId).
 		WithField("identity", w.identity).
 		Infof("Disconnected from LiveKit room reason=%v", reason)
 
+	if utils.IsLiveKitDisconnectRecoverable(reason) && w.startReconnect(true) {
+		return
+	}
+
 	state := utils.NormalizeLiveKitDisconnectReason(reason)
 
+	if state == utils.ConnectionStateFailed {
+		w.setEndReason(interfaces.CloseReasonDisconnected, fmt.Errorf("%w: %v", interfaces.ErrLiveKitDisconnected, reason))
+	} else {
+		w.setEndReason(interfaces.CloseReasonDisconnected, nil)
+	}
+
+	w.notifyDisconnected(state)
+}
+
+func (w *LiveKitWebRTC) notifyDisconnected(state utils.ConnectionState) {
+
 	// Lock the mutex before accessing the callback as it's accessed from multiple goroutines
 	w.m.Lock()
 	callback := w.connStateCallback
@@ -945,24 +2267,33 @@ func (w *LiveKitWebRTC) onDisconnected(reason lksdk.DisconnectionReason) {
 	w.m.Unlock()
 
 	if state.IsTerminalState() && fcb != nil {
-		fcb(false, time.Since(w.startTs), true)
+		fcb(false, w.clock.Since(w.startTs), true)
 	}
 }
 
 func (w *LiveKitWebRTC) onReconnecting() {
-	log.WithField("session", w.ctx.Value("session")).
-		WithField("room", w.roomId).
+	w.logger.WithField("room", w.roomId).
 		WithField("identity", w.identity).
 		Warn("Reconnecting to LiveKit room")
 	appstats.OnParticipantReconnecting()
+
+	// Subscribed tracks may be torn down while the SDK restarts the
+	// connection; don't treat that as the end of the recording
+	if w.cfg.Reconnect.MaxAttempts > 0 {
+		w.m.Lock()
+		w.reconnecting = true
+		w.m.Unlock()
+	}
 }
 
 func (w *LiveKitWebRTC) onReconnected() {
-	log.WithField("session", w.ctx.Value("session")).
-		WithField("room", w.roomId).
+	w.logger.WithField("room", w.roomId).
 		WithField("identity", w.identity).
 		Info("Reconnected to LiveKit room")
 	appstats.OnParticipantReconnected()
+
+	// The room is back, but a full restart drops our subscriptions
+	w.startReconnect(false)
 }
 
 func (w *LiveKitWebRTC) validateInitParams() error {
@@ -988,83 +2319,117 @@ func (w *LiveKitWebRTC) processKeyframeRequests() {
 		select {
 		case ssrc, ok := <-w.keyframeRequestChan:
 			if !ok {
-				log.WithField("session", w.ctx.Value("session")).Debug("Keyframe request channel closed, processor shutting down.")
+				w.logger.Debug("Keyframe request channel closed, processor shutting down.")
 				return
 			}
-			log.WithField("session", w.ctx.Value("session")).Tracef("Processing PLI request for SSRC %d from channel", ssrc)
+			w.logger.Tracef("Processing PLI request for SSRC %d from channel", ssrc)
 			// Locks
 			w.RequestKeyframeForSSRC(ssrc)
 		case <-w.requestKeyframeCtx.Done():
-			log.WithField("session", w.ctx.Value("session")).Debug("Keyframe request processor shutting down due to context cancellation.")
+			w.logger.Debug("Keyframe request processor shutting down due to context cancellation.")
 			return
 		}
 	}
 }
 
 func (w *LiveKitWebRTC) connectToRoom() error {
-	token, err := w.buildRecorderToken(w.roomId, w.identity)
+	token, err := w.client.recorderToken(w.roomId, w.identity)
 
 	if err != nil {
 		return fmt.Errorf("failed to build recorder token: %w", err)
 	}
 
-	log.WithField("session", w.ctx.Value("session")).
-		WithField("room", w.roomId).
+	w.logger.WithField("room", w.roomId).
 		WithField("identity", w.identity).
 		Debugf("Connecting to LiveKit room")
 
+	if w.cfg.Region.Name != "" && w.cfg.Region.URLs[w.cfg.Region.Name] == "" {
+		w.logger.WithField("region", w.cfg.Region.Name).
+			Warn("No URL configured for LiveKit region, falling back to default routing")
+	}
+
+	var room *lksdk.Room
+	var region string
+	var deadline time.Time
+
+	if w.cfg.Timeouts.Connect > 0 {
+		deadline = w.clock.Now().Add(w.cfg.Timeouts.Connect)
+	}
+
+	for _, host := range roomHosts(w.cfg) {
+		room, err = w.dialRoomWithin(host, token, deadline)
+
+		if err == nil {
+			region = host.region
+			break
+		}
+
+		// No time left for the fallback
+		if errors.Is(err, errConnectTimeout) {
+			break
+		}
+
+		if host.region != "" {
+			w.logger.WithField("room", w.roomId).
+				WithField("region", host.region).
+				Warnf("Failed to connect to LiveKit region %s, falling back to default routing: %v", host.url, err)
+		}
+	}
+
+	if errors.Is(err, errConnectTimeout) {
+		return &interfaces.ReasonError{
+			Reason: interfaces.CloseReasonConnectTimeout,
+			Err:    fmt.Errorf("failed to connect to LiveKit room: %w", err),
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to connect to LiveKit room: %w", err)
+	}
+
+	w.room = room
+	w.logger.WithField("room", w.roomId).
+		WithField("identity", w.identity).
+		WithField("region", region).
+		Infof("Connected to LiveKit room")
+
+	return nil
+}
+
+// dialRoom joins the room at host. Region hosts are joined as is, without
+// the server redirecting to another region.
+func (w *LiveKitWebRTC) dialRoom(host roomHost, token string) (*lksdk.Room, error) {
+	opts := []lksdk.ConnectOption{lksdk.WithAutoSubscribe(false)}
+
+	if host.region != "" {
+		opts = append(opts, lksdk.WithDisableRegionDiscovery())
+	}
+
+	w.logger.WithField("host", host.url).
+		WithField("region", host.region).
+		Tracef("Dialing LiveKit room")
+
 	connectStart := time.Now()
-	room, err := lksdk.ConnectToRoomWithToken(w.cfg.Host, token,
+	room, err := lksdk.ConnectToRoomWithToken(host.url, token,
 		&lksdk.RoomCallback{
 			ParticipantCallback: lksdk.ParticipantCallback{
+				OnTrackPublished:          w.onTrackPublished,
 				OnTrackSubscribed:         w.onTrackSubscribed,
 				OnTrackUnsubscribed:       w.onTrackUnsubscribed,
 				OnTrackUnpublished:        w.onTrackUnpublished,
 				OnTrackUnmuted:            w.onTrackUnmuted,
 				OnTrackMuted:              w.onTrackMuted,
 				OnTrackSubscriptionFailed: w.onTrackSubscriptionFailed,
+				OnDataPacket:              w.onDataPacket,
 			},
+			OnActiveSpeakersChanged:  w.onActiveSpeakersChanged,
 			OnDisconnectedWithReason: w.onDisconnected,
 			OnReconnecting:           w.onReconnecting,
 			OnReconnected:            w.onReconnected,
 		},
-		lksdk.WithAutoSubscribe(false),
+		opts...,
 	)
 	appstats.ObserveLiveKitConnectDuration(time.Since(connectStart))
 
-	if err != nil {
-		w.Close()
-		return fmt.Errorf("failed to connect to LiveKit room: %w", err)
-	}
-
-	w.room = room
-	log.WithField("session", w.ctx.Value("session")).
-		WithField("room", w.roomId).
-		WithField("identity", w.identity).
-		Infof("Connected to LiveKit room")
-
-	return nil
-}
-
-func (w *LiveKitWebRTC) buildRecorderToken(roomName string, identity string) (string, error) {
-	f := false
-	t := true
-	grant := &auth.VideoGrant{
-		RoomJoin:       true,
-		Room:           roomName,
-		CanSubscribe:   &t,
-		CanPublish:     &f,
-		CanPublishData: &f,
-		Hidden:         true,
-		Recorder:       true,
-	}
-
-	at := auth.NewAccessToken(w.cfg.APIKey, w.cfg.APISecret).
-		SetVideoGrant(grant).
-		SetIdentity(identity).
-		SetKind(livekit.ParticipantInfo_EGRESS).
-		SetValidFor(tokenTTL).
-		SetMetadata(baseSystemMetadata)
-
-	return at.ToJWT()
+	return room, err
 }
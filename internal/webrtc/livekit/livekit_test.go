@@ -2,15 +2,27 @@ package livekit
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/interfaces"
 	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // mockRecorder implements the recorder.Recorder interface for testing
@@ -20,6 +32,12 @@ type mockRecorder struct {
 	hasAudio   bool
 	hasVideo   bool
 	filePath   string
+	skipped    []uint16
+	videoTs    time.Duration
+	videoMuted []bool
+	// RTP timestamps of the sender clocks given, by kind
+	senderClocks map[bool][]uint32
+	writeErr     error
 }
 
 func (m *mockRecorder) GetFilePath() string {
@@ -33,18 +51,37 @@ func (m *mockRecorder) GetStats() *types.RecorderStats {
 	}
 }
 
+func (m *mockRecorder) WriteError() error {
+	return m.writeErr
+}
+
 func (m *mockRecorder) PushVideo(packet *rtp.Packet)                                {}
 func (m *mockRecorder) PushAudio(packet *rtp.Packet)                                {}
-func (m *mockRecorder) NotifySkippedPacket(seq uint16)                              {}
+func (m *mockRecorder) NotifySkippedPacket(seq uint16)                              { m.skipped = append(m.skipped, seq) }
 func (m *mockRecorder) WithContext(ctx context.Context)                             {}
-func (m *mockRecorder) VideoTimestamp() time.Duration                               { return 0 }
+func (m *mockRecorder) VideoTimestamp() time.Duration                               { return m.videoTs }
 func (m *mockRecorder) AudioTimestamp() time.Duration                               { return 0 }
+func (m *mockRecorder) ReceivedPackets() uint64                                     { return 0 }
+func (m *mockRecorder) FileStats() types.FileStats                                  { return types.FileStats{} }
 func (m *mockRecorder) SetHasAudio(hasAudio bool)                                   { m.hasAudio = hasAudio }
 func (m *mockRecorder) SetHasVideo(hasVideo bool)                                   { m.hasVideo = hasVideo }
 func (m *mockRecorder) SetKeyframeRequester(requester interfaces.KeyframeRequester) {}
 func (m *mockRecorder) GetHasAudio() bool                                           { return m.hasAudio }
 func (m *mockRecorder) GetHasVideo() bool                                           { return m.hasVideo }
+func (m *mockRecorder) SetVideoCodec(mimeType string) error                         { return nil }
+func (m *mockRecorder) SetVideoLayer(layer string, width, height uint32)            {}
+func (m *mockRecorder) Pause()                                                      {}
+func (m *mockRecorder) Resume()                                                     {}
 func (m *mockRecorder) Close() time.Duration                                        { return 0 }
+func (m *mockRecorder) SetVideoMuted(muted bool)                                    { m.videoMuted = append(m.videoMuted, muted) }
+
+func (m *mockRecorder) SetSenderClock(video bool, rtpTimestamp uint32, wallClock time.Time) {
+	if m.senderClocks == nil {
+		m.senderClocks = make(map[bool][]uint32)
+	}
+
+	m.senderClocks[video] = append(m.senderClocks[video], rtpTimestamp)
+}
 
 func TestProcessPacketStats_SequenceNumberWraparound(t *testing.T) {
 	lk, _ := setupMockLK()
@@ -82,6 +119,37 @@ func TestProcessPacketStats_SequenceNumberWraparound(t *testing.T) {
 		"Should detect 3 sequence number wraparounds")
 }
 
+func TestProcessPacketStats_LogsWraparound(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	level := log.GetLevel()
+	log.SetLevel(log.DebugLevel)
+	defer log.SetLevel(level)
+
+	lk, _ := setupMockLK()
+	trackID := lk.trackIds[0]
+	packets := makeFullRangePackets(0)
+
+	lk.processPacketStats(trackID, packets[65000:])
+	lk.processPacketStats(trackID, packets[:10])
+
+	var wraparound *log.Entry
+
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Sequence number wraparound detected" {
+			wraparound = entry
+		}
+	}
+
+	require.NotNil(t, wraparound)
+	assert.Equal(t, log.DebugLevel, wraparound.Level)
+	assert.Equal(t, trackID, wraparound.Data["trackID"])
+	assert.Equal(t, packets[len(packets)-1].SequenceNumber, wraparound.Data["prevSeqNum"])
+	assert.Equal(t, uint16(0), wraparound.Data["batchFirstSeqNum"])
+	assert.Equal(t, 1, wraparound.Data["wrapArounds"])
+}
+
 // Test wraparound detection with pre-initialized track stats
 func TestProcessPacketStats_PreInitializedTrackStatsWraparound(t *testing.T) {
 	lk, _ := setupMockLK()
@@ -114,8 +182,6 @@ func TestDoubleClose(t *testing.T) {
 	firstDuration := lk.Close()
 	assert.Equal(t, time.Duration(0), firstDuration, "First close should return duration from recorder")
 
-	time.Sleep(50 * time.Millisecond)
-
 	// Second close should not panic
 	secondDuration := lk.Close()
 	assert.Equal(t, time.Duration(0), secondDuration, "Second close should still return same duration")
@@ -123,6 +189,140 @@ func TestDoubleClose(t *testing.T) {
 	assert.NotNil(t, lk.keyframeRequestChan, "Channel should not be nil even after close")
 }
 
+func TestCloseWithResult(t *testing.T) {
+	lk, _ := setupMockLK()
+
+	result := lk.CloseWithResult()
+	assert.Equal(t, interfaces.CloseReasonNormal, result.Reason)
+	assert.NoError(t, result.Err)
+	assert.NotNil(t, result.Stats, "Final recorder stats should be reported")
+	assert.Same(t, result, lk.CloseWithResult(), "Second close should return the cached result")
+
+	// Reasons set after closing don't change the result
+	lk.setEndReason(interfaces.CloseReasonError, errors.New("late error"))
+	assert.Equal(t, interfaces.CloseReasonNormal, lk.CloseWithResult().Reason)
+}
+
+func TestCloseWithResult_EndReason(t *testing.T) {
+	lk, rec := setupMockLK()
+	lk.SetStopCallback(func(reason string) {})
+	lk.cfg.MaxDuration = time.Minute
+	rec.videoTs = time.Minute
+
+	assert.True(t, lk.checkMaxDuration())
+	// Only the first reason sticks
+	lk.setEndReason(interfaces.CloseReasonTrackEnded, nil)
+
+	result := lk.CloseWithResult()
+	assert.Equal(t, interfaces.CloseReasonMaxDuration, result.Reason)
+	assert.NoError(t, result.Err)
+
+	lk, _ = setupMockLK()
+	err := errors.New("backoff exhausted")
+	lk.setEndReason(interfaces.CloseReasonReconnectFailed, err)
+
+	result = lk.CloseWithResult()
+	assert.Equal(t, interfaces.CloseReasonReconnectFailed, result.Reason)
+	assert.ErrorIs(t, result.Err, err)
+}
+
+func TestCloseWithResult_TrackErrors(t *testing.T) {
+	lk, _ := setupMockLK()
+	assert.Nil(t, lk.CloseWithResult().TrackErrors)
+
+	lk, _ = setupMockLK()
+	lk.trackErrors["missing-track"] = errTrackNotPublished
+
+	result := lk.CloseWithResult()
+	require.Len(t, result.TrackErrors, 1)
+	assert.ErrorIs(t, result.TrackErrors["missing-track"], errTrackNotPublished)
+	assert.ErrorIs(t, result.TrackErrors["missing-track"], interfaces.ErrTrackNotFound)
+}
+
+func TestCloseWithResult_WriteError(t *testing.T) {
+	lk, rec := setupMockLK()
+	rec.writeErr = interfaces.WriteError(&os.PathError{Op: "write", Path: "rec.webm", Err: syscall.ENOSPC})
+
+	result := lk.CloseWithResult()
+	assert.Equal(t, interfaces.CloseReasonError, result.Reason)
+	assert.ErrorIs(t, result.Err, interfaces.ErrDiskFull)
+
+	// The capture's own error comes first
+	lk, rec = setupMockLK()
+	rec.writeErr = interfaces.WriteError(errors.New("I/O error"))
+	lk.setEndReason(interfaces.CloseReasonDisconnected, fmt.Errorf("%w: %v", interfaces.ErrLiveKitDisconnected, "server shutdown"))
+
+	result = lk.CloseWithResult()
+	assert.Equal(t, interfaces.CloseReasonDisconnected, result.Reason)
+	assert.ErrorIs(t, result.Err, interfaces.ErrLiveKitDisconnected)
+}
+
+func TestAwaitTracks(t *testing.T) {
+	lk, _ := setupMockLK()
+	calls := 0
+	stillMissing := func() ([]string, error) {
+		calls++
+		return []string{"test-track"}, nil
+	}
+
+	// Not waiting at all
+	missing, err := lk.awaitTracks(0, stillMissing)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test-track"}, missing)
+	assert.Equal(t, 1, calls)
+
+	// Never published
+	calls = 0
+	missing, err = lk.awaitTracks(50*time.Millisecond, stillMissing)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test-track"}, missing)
+	assert.Equal(t, 1, calls, "Not checked again without an event")
+
+	// Published a bit later
+	calls = 0
+	published := func() ([]string, error) {
+		calls++
+
+		if calls == 1 {
+			lk.trackPublished <- struct{}{}
+			return []string{"test-track"}, nil
+		}
+
+		return nil, nil
+	}
+
+	start := time.Now()
+	missing, err = lk.awaitTracks(5*time.Second, published)
+	require.NoError(t, err)
+	assert.Empty(t, missing)
+	assert.Equal(t, 2, calls)
+	assert.Less(t, time.Since(start), trackPublishPollInterval, "Woken up by the event")
+
+	// Subscription errors end the wait
+	subErr := errors.New("unsupported codec")
+	_, err = lk.awaitTracks(5*time.Second, func() ([]string, error) {
+		return nil, subErr
+	})
+	assert.ErrorIs(t, err, subErr)
+}
+
+func TestStartReading_Idempotent(t *testing.T) {
+	lk, _ := setupMockLK()
+	first := &webrtc.TrackRemote{}
+	second := &webrtc.TrackRemote{}
+
+	assert.True(t, lk.startReading("test-track", first))
+	assert.False(t, lk.startReading("test-track", first), "Already being read")
+
+	// A resubscription after a reconnect brings a new track
+	assert.True(t, lk.startReading("test-track", second))
+	lk.stopReading("test-track", first)
+	assert.False(t, lk.startReading("test-track", second), "Still read by the new reader")
+
+	lk.stopReading("test-track", second)
+	assert.True(t, lk.startReading("test-track", second))
+}
+
 func setupMockLK() (*LiveKitWebRTC, *mockRecorder) {
 	ctx := context.Background()
 	ctx = context.WithValue(ctx, "session", "test-session")
@@ -138,7 +338,7 @@ func setupMockLK() (*LiveKitWebRTC, *mockRecorder) {
 	}
 	roomID := "test-room"
 	trackIDs := []string{"test-track"}
-	lk := NewLiveKitWebRTC(ctx, cfg, rec, roomID, trackIDs)
+	lk := NewLiveKitWebRTC(ctx, cfg, rec, roomID, trackIDs, nil)
 
 	return lk, rec
 }
@@ -157,3 +357,222 @@ func makeFullRangePackets(start uint16) []*rtp.Packet {
 
 	return packets
 }
+
+func TestProcessPacketStats_LossFraction(t *testing.T) {
+	lk, _ := setupMockLK()
+	trackID := lk.trackIds[0]
+
+	// Wrap around exactly to zero: 65530..65535, 0 is 7 packets
+	lk.processPacketStats(trackID, makePackets(65530, 65535))
+	lk.processPacketStats(trackID, makePackets(0, 0))
+	stats := lk.trackStats[trackID]
+	assert.Equal(t, uint64(7), stats.SeqNumSpan())
+	assert.Equal(t, uint64(7), stats.SeqNumPackets)
+	assert.Zero(t, stats.LossFraction, "Nothing is lost across the wraparound")
+
+	// 1..3 lost
+	lk.processPacketStats(trackID, makePackets(4, 10))
+	assert.Equal(t, uint64(17), stats.SeqNumSpan())
+	assert.InDelta(t, 3.0/17, stats.LossFraction, 1e-9)
+
+	// Duplicates don't make the loss negative
+	for range 5 {
+		lk.processPacketStats(trackID, makePackets(10, 10))
+	}
+
+	assert.Zero(t, stats.LossFraction)
+	assert.Zero(t, (&appstats.AdapterTrackStats{}).SeqNumLossFraction(), "No packets yet")
+
+	// makeFullRangePackets stops at 65534: wrapping to zero from there skips
+	// 65535, which is one packet lost
+	lk, _ = setupMockLK()
+	packets := makeFullRangePackets(0)
+	lk.processPacketStats(trackID, append(packets[65530:], packets[:1]...))
+	assert.InDelta(t, 1.0/7, lk.trackStats[trackID].LossFraction, 1e-9)
+}
+
+func TestProcessPacketStats_LiveMetrics(t *testing.T) {
+	lk, _ := setupMockLK()
+	trackID := lk.trackIds[0]
+	packets := makeFullRangePackets(0)
+
+	lk.processPacketStats(trackID, packets[100:200])
+	stats := lk.trackStats[trackID]
+	assert.Equal(t, uint16(100), stats.FirstSeqNum, "First seqnum should be set from the first batch")
+	assert.Equal(t, uint64(100), stats.SeqNumSpan())
+
+	labels := prometheus.Labels{"session": "test-session", "track_id": trackID}
+	assert.Equal(t, float64(100), testutil.ToFloat64(appstats.SessionTrackPackets.With(labels)))
+
+	// Wrap around: 65530..65534, 0..99
+	lk.processPacketStats(trackID, packets[65530:])
+	lk.processPacketStats(trackID, packets[:100])
+	assert.Equal(t, float64(1), testutil.ToFloat64(appstats.SessionTrackSeqNumWrapArounds.With(labels)))
+	assert.Equal(t, float64(65536), testutil.ToFloat64(appstats.SessionTrackPackets.With(labels)))
+
+	lk.Close()
+	assert.Equal(t, 0, testutil.CollectAndCount(appstats.SessionTrackPackets),
+		"Session series should be removed on close")
+}
+
+func TestResumeTrack_ReconnectGap(t *testing.T) {
+	lk, rec := setupMockLK()
+	trackID := lk.trackIds[0]
+
+	lk.processPacketStats(trackID, makePackets(65530, 65535))
+
+	// Not reconnecting: the track just ended
+	assert.False(t, lk.suspendTrack(trackID))
+
+	lk.reconnecting = true
+	assert.True(t, lk.suspendTrack(trackID))
+	lk.reconnecting = false
+
+	// Packets 0-9 were lost while the room was reconnecting
+	resumed := makePackets(10, 20)
+	lk.resumeTrack(trackID, resumed[0], false, 0)
+	lk.processPacketStats(trackID, resumed)
+
+	stats := lk.trackStats[trackID]
+	assert.Equal(t, 1, stats.Reconnects)
+	assert.Equal(t, uint64(10), stats.ReconnectGapPackets)
+	assert.Equal(t, []uint16{0}, rec.skipped)
+	assert.Equal(t, 1, stats.SeqNumWrapArounds, "Gap across the wraparound must still be counted")
+	assert.Equal(t, uint64(27), stats.SeqNumSpan())
+
+	// Only the first packet after a reconnect is considered
+	lk.resumeTrack(trackID, resumed[1], false, 0)
+	assert.Equal(t, 1, stats.Reconnects)
+}
+
+func TestFirstMediaCallbacks(t *testing.T) {
+	lk, _ := setupMockLK()
+	var packetEvents, keyframeEvents []interfaces.MediaEvent
+
+	lk.SetFirstPacketCallback(func(event interfaces.MediaEvent) {
+		packetEvents = append(packetEvents, event)
+	})
+	lk.SetFirstKeyframeCallback(func(event interfaces.MediaEvent) {
+		keyframeEvents = append(keyframeEvents, event)
+	})
+
+	packets := makePackets(10, 12)
+	lk.notifyFirstPacket("video-track", TrackKindVideo, packets[0])
+	lk.notifyFirstPacket("audio-track", TrackKindAudio, packets[0])
+	// A resubscription reads a "first" packet again
+	lk.notifyFirstPacket("video-track", TrackKindVideo, packets[1])
+
+	require.Len(t, packetEvents, 2)
+	assert.Equal(t, "video-track", packetEvents[0].TrackID)
+	assert.Equal(t, string(TrackKindVideo), packetEvents[0].Kind)
+	assert.Equal(t, packets[0].Timestamp, packetEvents[0].RTPTimestamp)
+	assert.Equal(t, "audio-track", packetEvents[1].TrackID)
+
+	lk.notifyFirstKeyframe("video-track", 40*time.Millisecond)
+	lk.notifyFirstKeyframe("video-track", 2*time.Second)
+
+	require.Len(t, keyframeEvents, 1)
+	assert.Equal(t, "video-track", keyframeEvents[0].TrackID)
+	assert.Equal(t, 40*time.Millisecond, keyframeEvents[0].MediaTimestamp)
+}
+
+func TestStartReconnect_Disabled(t *testing.T) {
+	lk, _ := setupMockLK()
+
+	assert.False(t, lk.startReconnect(true))
+	assert.False(t, lk.reconnecting)
+}
+
+func makePackets(first, last uint16) []*rtp.Packet {
+	var packets []*rtp.Packet
+
+	for seq := first; ; seq++ {
+		packets = append(packets, &rtp.Packet{Header: rtp.Header{SequenceNumber: seq}})
+
+		if seq == last {
+			return packets
+		}
+	}
+}
+
+func TestCheckMaxDuration(t *testing.T) {
+	lk, rec := setupMockLK()
+
+	var reasons []string
+	lk.SetStopCallback(func(reason string) {
+		reasons = append(reasons, reason)
+	})
+
+	// Disabled by default
+	rec.videoTs = 10 * time.Hour
+	assert.False(t, lk.checkMaxDuration())
+
+	lk.cfg.MaxDuration = time.Minute
+	rec.videoTs = 30 * time.Second
+	assert.False(t, lk.checkMaxDuration())
+	assert.Empty(t, reasons)
+
+	rec.videoTs = time.Minute
+	assert.True(t, lk.checkMaxDuration())
+	assert.True(t, lk.checkMaxDuration())
+	assert.Equal(t, []string{events.StopReasonMaxDuration}, reasons, "Stop must only be requested once")
+}
+
+func TestAllowPLI_Throttling(t *testing.T) {
+	lk, _ := setupMockLK()
+	lk.cfg.KeyframeRequestInterval = time.Second
+	ssrc := uint32(1234)
+	now := time.Now()
+
+	assert.True(t, lk.allowPLI(ssrc, now), "First PLI must go out immediately")
+	assert.False(t, lk.allowPLI(ssrc, now.Add(100*time.Millisecond)))
+	assert.False(t, lk.allowPLI(ssrc, now.Add(200*time.Millisecond)))
+	assert.True(t, lk.pliStats[ssrc].pending, "Burst must be coalesced into a retry")
+
+	select {
+	case queued := <-lk.keyframeRequestChan:
+		t.Fatalf("Retry for SSRC %d queued before the interval elapsed", queued)
+	default:
+	}
+
+	// After a quiet period the next request is not delayed
+	assert.True(t, lk.allowPLI(ssrc, now.Add(5*time.Second)))
+	assert.False(t, lk.pliStats[ssrc].pending)
+
+	lk.cfg.KeyframeRequestInterval = 0
+	assert.True(t, lk.allowPLI(ssrc, now.Add(5*time.Second)), "Throttling disabled")
+}
+
+func BenchmarkPacketIngestion(b *testing.B) {
+	lk, _ := setupMockLK()
+	trackID := lk.trackIds[0]
+	packets := makeFullRangePackets(0)
+	cfg := config.TrackJitterBuffer{Size: 256, MaxDelay: 500 * time.Millisecond}
+
+	var before, after runtime.MemStats
+
+	b.ReportAllocs()
+	runtime.ReadMemStats(&before)
+
+	for b.Loop() {
+		reorder := newReorderBuffer(lk.ctx, cfg)
+
+		for _, p := range packets {
+			ordered, _ := reorder.Push(p)
+			lk.processPacketStats(trackID, ordered)
+		}
+	}
+
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/float64(b.N*len(packets)), "allocs/packet")
+}
+
+func TestVideoCodecAllowed(t *testing.T) {
+	lk, _ := setupMockLK()
+	assert.True(t, lk.videoCodecAllowed("video/H264"), "All codecs are allowed by default")
+
+	lk.cfg.VideoCodecs = []string{"video/VP8", "video/vp9"}
+	assert.True(t, lk.videoCodecAllowed("video/vp8"))
+	assert.True(t, lk.videoCodecAllowed("video/VP9"))
+	assert.False(t, lk.videoCodecAllowed("video/H264"))
+}
@@ -0,0 +1,133 @@
+package livekit
+
+import (
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+)
+
+// maxMuteIntervals bounds the mute intervals kept in a track's stats
+const maxMuteIntervals = 100
+
+// setTrackMuted records a track being muted or unmuted by its publisher.
+// Muted tracks send nothing: keyframes aren't requested for them, and the
+// recording isn't deemed stalled while all its tracks are. Video asks for a
+// fresh keyframe once unmuted.
+func (w *LiveKitWebRTC) setTrackMuted(trackID string, isVideo bool, muted bool) {
+	w.m.Lock()
+
+	if w.mutedTracks[trackID] == muted {
+		w.m.Unlock()
+		return
+	}
+
+	if muted {
+		w.mutedTracks[trackID] = true
+	} else {
+		delete(w.mutedTracks, trackID)
+	}
+
+	now := w.clock.Now().UnixMilli()
+
+	if stats, ok := w.trackStats[trackID]; ok {
+		recordMute(stats, muted, now)
+	}
+
+	var ssrc uint32
+
+	if track := w.readingTracks[trackID]; track != nil {
+		ssrc = uint32(track.SSRC())
+	}
+
+	// PLIs sent while muted went unanswered for a reason: start over, and
+	// let the first request after the mute through right away
+	if tracker, ok := w.pliStats[ssrc]; ok {
+		tracker.unansweredPLIs = 0
+		tracker.escalated = false
+		tracker.armed = false
+		tracker.generation++
+
+		if !muted {
+			tracker.timestamp = time.Time{}
+		}
+
+		w.pliStats[ssrc] = tracker
+	}
+
+	w.m.Unlock()
+
+	w.logger.WithField("trackID", trackID).
+		WithField("muted", muted).
+		Info("Track mute state changed")
+
+	if !isVideo {
+		return
+	}
+
+	if vm, ok := w.rec.(interface{ SetVideoMuted(muted bool) }); ok {
+		vm.SetVideoMuted(muted)
+	}
+
+	if !muted && ssrc != 0 {
+		w.queueKeyframeRequest(ssrc, "unmuted")
+	}
+}
+
+// recordMute updates a track's mute stats, now in Unix ms
+func recordMute(stats *appstats.AdapterTrackStats, muted bool, now int64) {
+	stats.Muted = muted
+
+	if !muted {
+		if n := len(stats.MuteIntervals); n > 0 && stats.MuteIntervals[n-1].End == 0 {
+			stats.MuteIntervals[n-1].End = now
+		}
+
+		return
+	}
+
+	stats.Mutes++
+	stats.MuteIntervals = append(stats.MuteIntervals, appstats.MuteInterval{Start: now})
+
+	if n := len(stats.MuteIntervals); n > maxMuteIntervals {
+		stats.MuteIntervals = stats.MuteIntervals[n-maxMuteIntervals:]
+	}
+}
+
+// trackSilent returns whether nothing of trackID is expected to be written:
+// it's muted, or its recording is disabled (see track_recording.go)
+// Locked
+func (w *LiveKitWebRTC) trackSilent(trackID string) bool {
+	return w.mutedTracks[trackID] || w.trackDisabled(trackID)
+}
+
+// ssrcMuted returns whether the track an SSRC belongs to is muted, or
+// disabled
+// Locked
+func (w *LiveKitWebRTC) ssrcMuted(ssrc uint32) bool {
+	for trackID, track := range w.readingTracks {
+		if track != nil && uint32(track.SSRC()) == ssrc {
+			return w.trackSilent(trackID)
+		}
+	}
+
+	return false
+}
+
+// Muted returns whether every track recorded is muted at the source, or
+// disabled, so nothing is written
+func (w *LiveKitWebRTC) Muted() bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if len(w.remoteTrackPubs) == 0 {
+		return false
+	}
+
+	for trackID := range w.remoteTrackPubs {
+		if !w.trackSilent(trackID) {
+			return false
+		}
+	}
+
+	return true
+}
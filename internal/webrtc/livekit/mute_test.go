@@ -0,0 +1,65 @@
+package livekit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetTrackMuted(t *testing.T) {
+	lk, rec := setupMockLK()
+	clk := clock.NewMock(time.UnixMilli(10000))
+	lk.WithClock(clk)
+	trackID := lk.trackIds[0]
+	lk.remoteTrackPubs[trackID] = &lksdk.RemoteTrackPublication{}
+
+	assert.False(t, lk.Muted())
+	lk.setTrackMuted(trackID, true, true)
+	assert.True(t, lk.Muted())
+	clk.Add(2 * time.Second)
+	lk.setTrackMuted(trackID, true, true)
+	assert.True(t, lk.trackStats[trackID].Muted)
+
+	lk.setTrackMuted(trackID, true, false)
+	assert.False(t, lk.Muted())
+	clk.Add(time.Second)
+	lk.setTrackMuted(trackID, true, true)
+
+	stats := lk.trackStats[trackID]
+	assert.Equal(t, 2, stats.Mutes, "Repeated events are ignored")
+	assert.Equal(t, []appstats.MuteInterval{{Start: 10000, End: 12000}, {Start: 13000}}, stats.MuteIntervals)
+	assert.Equal(t, []bool{true, false, true}, rec.videoMuted)
+
+	// Audio mutes aren't the recorder's business
+	lk.setTrackMuted(trackID, false, false)
+	assert.Equal(t, []bool{true, false, true}, rec.videoMuted)
+	assert.Equal(t, int64(13000), lk.trackStats[trackID].MuteIntervals[1].End)
+}
+
+func TestMuted_AllTracks(t *testing.T) {
+	lk, _ := setupMockLK()
+	lk.remoteTrackPubs["audio"] = &lksdk.RemoteTrackPublication{}
+	lk.remoteTrackPubs["video"] = &lksdk.RemoteTrackPublication{}
+
+	lk.setTrackMuted("video", true, true)
+	assert.False(t, lk.Muted(), "Audio still flows")
+	lk.setTrackMuted("audio", false, true)
+	assert.True(t, lk.Muted())
+}
+
+func TestRecordMute_Bounded(t *testing.T) {
+	stats := &appstats.AdapterTrackStats{}
+
+	for i := range maxMuteIntervals + 10 {
+		recordMute(stats, true, int64(i))
+		recordMute(stats, false, int64(i))
+	}
+
+	assert.Equal(t, maxMuteIntervals+10, stats.Mutes)
+	assert.Len(t, stats.MuteIntervals, maxMuteIntervals)
+	assert.Equal(t, int64(10), stats.MuteIntervals[0].Start, "The latest are kept")
+}
@@ -0,0 +1,148 @@
+package livekit
+
+import (
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+type nackEntry struct {
+	missingSince time.Time
+	lastSent     time.Time // Zero if not NACKed yet
+	retries      int
+}
+
+// nackTracker follows the sequence numbers missing from a track so they can
+// be NACKed (RFC 4585 generic NACKs) while a retransmission can still make
+// it into the recording: missing ones are requested every cfg.Interval, up
+// to cfg.MaxRetries times, until they arrive, fall more than cfg.Window
+// packets behind or are older than maxAge (past which the sample buffer has
+// given up on them anyway).
+type nackTracker struct {
+	cfg     config.NACK
+	maxAge  time.Duration
+	started bool
+	highest uint16
+	missing map[uint16]*nackEntry
+}
+
+// newNACKTracker returns nil if NACKs are disabled (window 0) or weren't
+// negotiated for the codec
+func newNACKTracker(cfg config.NACK, codec webrtc.RTPCodecParameters, maxAge time.Duration) *nackTracker {
+	if cfg.Window == 0 || !supportsNACK(codec) {
+		return nil
+	}
+
+	return &nackTracker{
+		cfg:     cfg,
+		maxAge:  maxAge,
+		missing: make(map[uint16]*nackEntry),
+	}
+}
+
+func supportsNACK(codec webrtc.RTPCodecParameters) bool {
+	for _, fb := range codec.RTCPFeedback {
+		if fb.Type == webrtc.TypeRTCPFBNACK && fb.Parameter == "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// push records a received (or recovered) packet, and the ones it reveals
+// missing
+func (n *nackTracker) push(seq uint16, now time.Time) {
+	if !n.started {
+		n.started = true
+		n.highest = seq
+		return
+	}
+
+	delete(n.missing, seq)
+	diff := seq - n.highest
+
+	// Late or duplicate
+	if diff == 0 || diff >= 0x8000 {
+		return
+	}
+
+	// Past the window, nothing before is worth asking for
+	if diff > n.cfg.Window {
+		clear(n.missing)
+		n.highest = seq
+		return
+	}
+
+	for missing := n.highest + 1; missing != seq; missing++ {
+		n.missing[missing] = &nackEntry{missingSince: now}
+	}
+
+	n.highest = seq
+}
+
+// due returns the sequence numbers to NACK now, and drops those not worth
+// asking for anymore
+func (n *nackTracker) due(now time.Time) []uint16 {
+	var seqs []uint16
+
+	for seq, entry := range n.missing {
+		if n.highest-seq > n.cfg.Window || entry.retries >= n.cfg.MaxRetries ||
+			(n.maxAge > 0 && now.Sub(entry.missingSince) > n.maxAge) {
+			delete(n.missing, seq)
+			continue
+		}
+
+		if !entry.lastSent.IsZero() && now.Sub(entry.lastSent) < n.cfg.Interval {
+			continue
+		}
+
+		entry.lastSent = now
+		entry.retries++
+		seqs = append(seqs, seq)
+	}
+
+	return seqs
+}
+
+// sendNACKs requests the retransmission of the track's missing packets that
+// are due
+func (w *LiveKitWebRTC) sendNACKs(trackID string, ssrc uint32, tracker *nackTracker, now time.Time) {
+	seqs := tracker.due(now)
+
+	if len(seqs) == 0 {
+		return
+	}
+
+	w.m.Lock()
+	pub := w.remoteTrackPubs[trackID]
+	w.m.Unlock()
+
+	if pub == nil || pub.Receiver() == nil || pub.Receiver().Transport() == nil {
+		return
+	}
+
+	nack := &rtcp.TransportLayerNack{
+		SenderSSRC: ssrc,
+		MediaSSRC:  ssrc,
+		Nacks:      rtcp.NackPairsFromSequenceNumbers(seqs),
+	}
+
+	if _, err := pub.Receiver().Transport().WriteRTCP([]rtcp.Packet{nack}); err != nil {
+		w.logger.WithField("trackID", trackID).
+			Warnf("Failed to send NACK for SSRC %d: %v", ssrc, err)
+		return
+	}
+
+	w.m.Lock()
+	if stats, ok := w.trackStats[trackID]; ok {
+		stats.NACKRequests++
+		stats.NACKedPackets += uint64(len(seqs))
+	}
+	w.m.Unlock()
+
+	w.logger.WithField("trackID", trackID).
+		Tracef("Sent NACK for %d packets", len(seqs))
+}
@@ -0,0 +1,90 @@
+package livekit
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var nackCodec = webrtc.RTPCodecParameters{
+	RTPCodecCapability: webrtc.RTPCodecCapability{
+		MimeType:     webrtc.MimeTypeVP8,
+		ClockRate:    90000,
+		RTCPFeedback: []webrtc.RTCPFeedback{{Type: "nack"}, {Type: "nack", Parameter: "pli"}},
+	},
+}
+
+func sortedDue(n *nackTracker, now time.Time) []uint16 {
+	seqs := n.due(now)
+	slices.Sort(seqs)
+
+	return seqs
+}
+
+func TestNewNACKTracker(t *testing.T) {
+	cfg := config.NACK{Window: 256, Interval: 20 * time.Millisecond, MaxRetries: 3}
+	assert.NotNil(t, newNACKTracker(cfg, nackCodec, time.Second))
+	assert.Nil(t, newNACKTracker(config.NACK{}, nackCodec, time.Second), "Disabled")
+
+	opus := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000},
+	}
+	assert.Nil(t, newNACKTracker(cfg, opus, time.Second), "Not negotiated")
+}
+
+func TestNACKTracker_Retries(t *testing.T) {
+	cfg := config.NACK{Window: 256, Interval: 20 * time.Millisecond, MaxRetries: 2}
+	n := newNACKTracker(cfg, nackCodec, time.Second)
+	now := time.Now()
+
+	n.push(100, now)
+	n.push(101, now)
+	assert.Empty(t, n.due(now))
+
+	// 102-104 lost
+	n.push(105, now)
+	assert.Equal(t, []uint16{102, 103, 104}, sortedDue(n, now))
+	assert.Empty(t, n.due(now.Add(10*time.Millisecond)), "Waits for the interval")
+
+	// 103 recovered from a retransmission
+	n.push(103, now.Add(15*time.Millisecond))
+	assert.Equal(t, []uint16{102, 104}, sortedDue(n, now.Add(20*time.Millisecond)))
+
+	// Given up after MaxRetries
+	assert.Empty(t, n.due(now.Add(40*time.Millisecond)))
+	assert.Empty(t, n.missing)
+}
+
+func TestNACKTracker_WindowAndAge(t *testing.T) {
+	cfg := config.NACK{Window: 10, Interval: 20 * time.Millisecond, MaxRetries: 5}
+	n := newNACKTracker(cfg, nackCodec, 100*time.Millisecond)
+	now := time.Now()
+
+	// Across the wraparound
+	n.push(65534, now)
+	n.push(1, now)
+	assert.Equal(t, []uint16{0, 65535}, sortedDue(n, now))
+
+	// The missing ones fall out of the window
+	n.push(11, now)
+	assert.Equal(t, []uint16{2, 3, 4, 5, 6, 7, 8, 9, 10}, sortedDue(n, now.Add(20*time.Millisecond)))
+
+	// Too old for the sample buffer to still want them
+	assert.Empty(t, n.due(now.Add(200*time.Millisecond)))
+	assert.Empty(t, n.missing)
+
+	// A gap wider than the window isn't tracked at all
+	n.push(100, now)
+	assert.Empty(t, n.due(now))
+
+	// Late and duplicate packets don't move anything
+	n.push(90, now)
+	n.push(100, now)
+	require.Empty(t, n.missing)
+	assert.Equal(t, uint16(100), n.highest)
+}
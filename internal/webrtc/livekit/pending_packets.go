@@ -0,0 +1,90 @@
+package livekit
+
+import (
+	"sync/atomic"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/rtp"
+)
+
+type pendingPacket struct {
+	packet *rtp.Packet
+	size   int64
+}
+
+// pendingPackets keeps count of the packets a track has in its sample
+// buffer (pushed but neither popped nor dropped yet), so the buffer can be
+// bounded. The buffer doesn't say which packets it dropped, but it only
+// drops from its head: whatever is older than a popped sample is gone too.
+type pendingPackets struct {
+	entries []pendingPacket // Push order
+	bytes   int64
+	// Pending bytes of all the session's tracks
+	sessionBytes *atomic.Int64
+}
+
+func newPendingPackets(sessionBytes *atomic.Int64) *pendingPackets {
+	return &pendingPackets{sessionBytes: sessionBytes}
+}
+
+func (p *pendingPackets) push(packet *rtp.Packet) {
+	size := int64(packet.MarshalSize())
+	p.entries = append(p.entries, pendingPacket{packet: packet, size: size})
+	p.bytes += size
+	p.sessionBytes.Add(size)
+}
+
+// release forgets the packets of a popped sample, along with the ones
+// before it
+func (p *pendingPackets) release(popped []*rtp.Packet) {
+	if len(popped) == 0 {
+		return
+	}
+
+	last := popped[len(popped)-1].SequenceNumber
+	released := make(map[*rtp.Packet]struct{}, len(popped))
+
+	for _, packet := range popped {
+		released[packet] = struct{}{}
+	}
+
+	kept := p.entries[:0]
+	var freed int64
+
+	for _, e := range p.entries {
+		_, done := released[e.packet]
+
+		if done || int16(e.packet.SequenceNumber-last) <= 0 {
+			freed += e.size
+			continue
+		}
+
+		kept = append(kept, e)
+	}
+
+	clear(p.entries[len(kept):])
+	p.entries = kept
+	p.bytes -= freed
+	p.sessionBytes.Add(-freed)
+}
+
+// reset forgets all packets, returning how many there were
+func (p *pendingPackets) reset() int {
+	count := len(p.entries)
+	clear(p.entries)
+	p.entries = p.entries[:0]
+	p.sessionBytes.Add(-p.bytes)
+	p.bytes = 0
+
+	return count
+}
+
+// exceeds returns whether the track or its session hold more than limits
+// allow
+func (p *pendingPackets) exceeds(limits config.Limits) bool {
+	if limits.MaxTrackPendingPackets > 0 && len(p.entries) > limits.MaxTrackPendingPackets {
+		return true
+	}
+
+	return limits.MaxSessionPendingBytes > 0 && p.sessionBytes.Load() > limits.MaxSessionPendingBytes
+}
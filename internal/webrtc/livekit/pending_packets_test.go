@@ -0,0 +1,99 @@
+package livekit
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/livekit/server-sdk-go/v2/pkg/jitter"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPendingPackets(t *testing.T) {
+	var sessionBytes atomic.Int64
+	p := newPendingPackets(&sessionBytes)
+	other := newPendingPackets(&sessionBytes)
+
+	// 12 byte header + 8 byte payload
+	packets := makePackets(65533, 2)
+
+	for _, packet := range packets {
+		packet.Payload = make([]byte, 8)
+		p.push(packet)
+	}
+
+	other.push(&rtp.Packet{Payload: make([]byte, 8)})
+	assert.Equal(t, int64(7*20), sessionBytes.Load())
+
+	// 65533 was dropped by the buffer, [65534, 65535] popped
+	p.release(packets[1:3])
+	assert.Len(t, p.entries, 3)
+	assert.Equal(t, int64(3*20), p.bytes)
+
+	// Across the wraparound: 0 is gone along with 1
+	p.release(packets[4:5])
+	require.Len(t, p.entries, 1)
+	assert.Equal(t, uint16(2), p.entries[0].packet.SequenceNumber)
+	assert.Equal(t, int64(2*20), sessionBytes.Load())
+
+	assert.Equal(t, 1, p.reset())
+	assert.Zero(t, p.bytes)
+	assert.Equal(t, int64(20), sessionBytes.Load(), "Other tracks keep their share")
+}
+
+func TestPendingPackets_Exceeds(t *testing.T) {
+	var sessionBytes atomic.Int64
+	p := newPendingPackets(&sessionBytes)
+
+	for _, packet := range makePackets(0, 9) {
+		p.push(packet)
+	}
+
+	assert.False(t, p.exceeds(config.Limits{}), "Limits disabled")
+	assert.False(t, p.exceeds(config.Limits{MaxTrackPendingPackets: 10}))
+	assert.True(t, p.exceeds(config.Limits{MaxTrackPendingPackets: 9}))
+
+	sessionBytes.Add(1000)
+	assert.True(t, p.exceeds(config.Limits{MaxSessionPendingBytes: 1000}))
+	assert.False(t, p.exceeds(config.Limits{MaxSessionPendingBytes: 2000}))
+}
+
+func TestFlushPending(t *testing.T) {
+	lk, _ := setupMockLK()
+	buffer := jitter.NewBuffer(&codecs.OpusPacket{}, 48000, time.Second)
+	pending := newPendingPackets(&lk.pendingBytes)
+
+	var written [][]*rtp.Packet
+	writeSample := func(packets []*rtp.Packet) {
+		written = append(written, packets)
+	}
+
+	// 11 is lost: 12-14 wait for it
+	for _, packet := range append(makePackets(10, 10), makePackets(12, 14)...) {
+		packet.Payload = []byte{0xFC}
+		packet.Timestamp = uint32(packet.SequenceNumber) * 960
+		buffer.Push(packet)
+		pending.push(packet)
+	}
+
+	for packets := buffer.Pop(false); len(packets) > 0; packets = buffer.Pop(false) {
+		pending.release(packets)
+		writeSample(packets)
+	}
+
+	require.Len(t, written, 1)
+	assert.Len(t, pending.entries, 3)
+	require.True(t, pending.exceeds(config.Limits{MaxTrackPendingPackets: 2}))
+
+	lk.flushPending("test-track", buffer, pending, writeSample)
+
+	require.Len(t, written, 4, "Buffered samples are written as they are")
+	assert.Equal(t, uint16(14), written[3][0].SequenceNumber)
+	assert.Zero(t, lk.pendingBytes.Load())
+	assert.Equal(t, uint64(3), lk.trackStats["test-track"].LatePackets)
+	assert.Empty(t, buffer.Pop(true))
+}
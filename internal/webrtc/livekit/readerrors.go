@@ -0,0 +1,97 @@
+package livekit
+
+import (
+	"errors"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+)
+
+var errReadsFailing = errors.New("reads keep failing")
+
+// readErrorTracker applies config.ReadErrors to a track's reader
+type readErrorTracker struct {
+	cfg         config.ReadErrors
+	consecutive int
+	since       time.Time // First failure in a row
+	backoff     time.Duration
+}
+
+func newReadErrorTracker(cfg config.ReadErrors) *readErrorTracker {
+	return &readErrorTracker{cfg: cfg}
+}
+
+// failed accounts for a read that failed at now. Returns how long to wait
+// before reading again, and whether the failures persisted enough for the
+// track to be resubscribed to.
+func (t *readErrorTracker) failed(now time.Time) (time.Duration, bool) {
+	if t.consecutive == 0 || now.Sub(t.since) > t.cfg.Window {
+		t.consecutive = 0
+		t.since = now
+		t.backoff = t.cfg.Backoff
+	} else {
+		t.backoff = min(2*t.backoff, max(t.cfg.MaxBackoff, t.cfg.Backoff))
+	}
+
+	t.consecutive++
+
+	return t.backoff, t.consecutive > t.cfg.MaxConsecutive
+}
+
+// succeeded ends failures in a row, returning whether there were any
+func (t *readErrorTracker) succeeded() bool {
+	failing := t.consecutive > 0
+	t.consecutive = 0
+
+	return failing
+}
+
+func (w *LiveKitWebRTC) setConsecutiveReadErrors(trackID string, count int) {
+	w.m.Lock()
+
+	if stats, ok := w.trackStats[trackID]; ok {
+		stats.ConsecutiveReadErrors = count
+	}
+
+	w.m.Unlock()
+	w.updateLiveMetrics(trackID)
+}
+
+// canResubscribe returns whether a track whose reads keep failing has
+// resubscriptions left
+func (w *LiveKitWebRTC) canResubscribe(trackID string) bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	stats, ok := w.trackStats[trackID]
+
+	return ok && stats.Resubscriptions < w.cfg.ReadErrors.MaxResubscriptions
+}
+
+// resubscribe renews the subscription to a track whose reads keep failing,
+// once its reader stopped. The next reader resumes the recording like after
+// a reconnect.
+func (w *LiveKitWebRTC) resubscribe(trackID string, pub *lksdk.RemoteTrackPublication) error {
+	w.m.Lock()
+	w.resumingTracks[trackID] = true
+	w.resubscribedTracks[trackID] = true
+	stats := w.trackStats[trackID]
+	stats.Resubscriptions++
+	attempt := stats.Resubscriptions
+	w.m.Unlock()
+
+	w.logger.WithField("trackID", trackID).
+		Warnf("Reads of track %s keep failing, resubscribing %d/%d",
+			trackID, attempt, w.cfg.ReadErrors.MaxResubscriptions)
+
+	if err := pub.SetSubscribed(false); err != nil {
+		return err
+	}
+
+	if pub.Kind() == lksdk.TrackKindVideo {
+		w.setVideoLayer(pub)
+	}
+
+	return pub.SetSubscribed(true)
+}
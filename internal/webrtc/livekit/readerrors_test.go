@@ -0,0 +1,128 @@
+package livekit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/interfaces"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/utils"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadErrorTracker(t *testing.T) {
+	cfg := config.ReadErrors{
+		MaxConsecutive: 4,
+		Window:         time.Second,
+		Backoff:        10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+	}
+	tracker := newReadErrorTracker(cfg)
+	now := time.Now()
+	var waits []time.Duration
+
+	for range 4 {
+		wait, persistent := tracker.failed(now)
+		require.False(t, persistent)
+		waits = append(waits, wait)
+		now = now.Add(wait)
+	}
+
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond}, waits)
+
+	wait, persistent := tracker.failed(now)
+	assert.True(t, persistent, "More than MaxConsecutive in a row")
+	assert.Equal(t, 50*time.Millisecond, wait)
+
+	// A successful read starts over
+	assert.True(t, tracker.succeeded())
+	assert.False(t, tracker.succeeded())
+	wait, _ = tracker.failed(now)
+	assert.Equal(t, 10*time.Millisecond, wait)
+	assert.Equal(t, 1, tracker.consecutive)
+
+	// So do failures spread wider than the window
+	for range 3 {
+		tracker.failed(now)
+	}
+
+	wait, persistent = tracker.failed(now.Add(2 * time.Second))
+	assert.False(t, persistent)
+	assert.Equal(t, 10*time.Millisecond, wait)
+	assert.Equal(t, 1, tracker.consecutive)
+}
+
+func TestHandleReadRTPError_BufferTooSmall(t *testing.T) {
+	lk, _ := setupMockLK()
+	trackID := lk.trackIds[0]
+	pub := &lksdk.RemoteTrackPublication{}
+
+	// One packet too big for the buffer is dropped, not a failing track
+	// to back off from
+	assert.NoError(t, lk.handleReadRTPError(errors.New("buffer too small"), trackID, pub))
+	assert.Equal(t, 1, lk.trackStats[trackID].RTPReadErrors)
+
+	assert.Error(t, lk.handleReadRTPError(errors.New("read failed"), trackID, pub))
+}
+
+func TestCanResubscribe(t *testing.T) {
+	lk, _ := setupMockLK()
+	lk.cfg.ReadErrors.MaxResubscriptions = 2
+	trackID := lk.trackIds[0]
+
+	assert.True(t, lk.canResubscribe(trackID))
+	lk.trackStats[trackID].Resubscriptions = 2
+	assert.False(t, lk.canResubscribe(trackID))
+	assert.False(t, lk.canResubscribe("unknown-track"))
+}
+
+func TestSetConsecutiveReadErrors(t *testing.T) {
+	lk, _ := setupMockLK()
+	trackID := lk.trackIds[0]
+
+	lk.setConsecutiveReadErrors(trackID, 3)
+	assert.Equal(t, 3, lk.trackStats[trackID].ConsecutiveReadErrors)
+
+	lk.setConsecutiveReadErrors(trackID, 0)
+	assert.Zero(t, lk.trackStats[trackID].ConsecutiveReadErrors)
+}
+
+func TestResumeTrack_Resubscription(t *testing.T) {
+	lk, rec := setupMockLK()
+	trackID := lk.trackIds[0]
+
+	lk.processPacketStats(trackID, makePackets(100, 110))
+
+	// As flagged by resubscribe
+	lk.resumingTracks[trackID] = true
+	lk.resubscribedTracks[trackID] = true
+	lk.trackStats[trackID].Resubscriptions++
+
+	lk.resumeTrack(trackID, makePackets(115, 116)[0], false, 0)
+
+	stats := lk.trackStats[trackID]
+	assert.Zero(t, stats.Reconnects, "Not a reconnect")
+	assert.Equal(t, 1, stats.Resubscriptions)
+	assert.Equal(t, uint64(4), stats.ReconnectGapPackets)
+	assert.Equal(t, []uint16{111}, rec.skipped)
+	assert.Empty(t, lk.resubscribedTracks)
+}
+
+func TestFailTrack(t *testing.T) {
+	lk, _ := setupMockLK()
+	var states []utils.ConnectionState
+	lk.SetConnectionStateCallback(func(state utils.ConnectionState) {
+		states = append(states, state)
+	})
+
+	lk.failTrack("test-track", errReadsFailing)
+
+	assert.Equal(t, []utils.ConnectionState{utils.ConnectionStateFailed}, states)
+	result := lk.CloseWithResult()
+	assert.Equal(t, interfaces.CloseReasonError, result.Reason)
+	assert.ErrorIs(t, result.Err, errReadsFailing)
+	assert.ErrorIs(t, result.TrackErrors["test-track"], errReadsFailing)
+}
@@ -0,0 +1,157 @@
+package livekit
+
+import (
+	"fmt"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/rtp"
+)
+
+// What a full receive queue does with a new sample (see config.ReceiveQueue)
+const (
+	ReceiveQueueDropOldest = "drop_oldest"
+	ReceiveQueueBlock      = "block"
+)
+
+// ValidateReceiveQueue returns an error if the receive queue configuration
+// is invalid
+func ValidateReceiveQueue(cfg config.ReceiveQueue) error {
+	if cfg.Size < 0 {
+		return fmt.Errorf("invalid receive queue size %d", cfg.Size)
+	}
+
+	switch cfg.Overflow {
+	case "", ReceiveQueueDropOldest:
+		return nil
+	case ReceiveQueueBlock:
+		if cfg.MaxBlock <= 0 {
+			return fmt.Errorf("invalid receive queue max block %s", cfg.MaxBlock)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("invalid receive queue overflow %q", cfg.Overflow)
+	}
+}
+
+// receiveQueue hands the samples a track's reader completes over to the
+// goroutine writing them, so reads don't wait on the recorder. It's bounded:
+// when it's full, the oldest sample is dropped for the new one, right away
+// or once the writer hasn't made room within MaxBlock.
+type receiveQueue struct {
+	cfg      config.ReceiveQueue
+	clock    clock.Clock
+	samples  chan []*rtp.Packet
+	done     chan struct{}
+	maxDepth int // Reader side only
+}
+
+func newReceiveQueue(cfg config.ReceiveQueue, c clock.Clock) *receiveQueue {
+	return &receiveQueue{
+		cfg:     cfg,
+		clock:   c,
+		samples: make(chan []*rtp.Packet, cfg.Size),
+		done:    make(chan struct{}),
+	}
+}
+
+// push queues a sample, returning how many were dropped to make room for it
+// and whether the most samples waiting at once went up
+func (q *receiveQueue) push(packets []*rtp.Packet) (dropped int, deeper bool) {
+	select {
+	case q.samples <- packets:
+		return 0, q.noteDepth()
+	default:
+	}
+
+	if q.cfg.Overflow == ReceiveQueueBlock {
+		timer := q.clock.NewTimer(q.cfg.MaxBlock)
+
+		select {
+		case q.samples <- packets:
+			timer.Stop()
+			return 0, q.noteDepth()
+		case <-timer.C():
+		}
+	}
+
+	for {
+		select {
+		case q.samples <- packets:
+			return dropped, q.noteDepth()
+		default:
+		}
+
+		// The writer may have taken it meanwhile
+		select {
+		case <-q.samples:
+			dropped++
+		default:
+		}
+	}
+}
+
+func (q *receiveQueue) noteDepth() bool {
+	if depth := len(q.samples); depth > q.maxDepth {
+		q.maxDepth = depth
+		return true
+	}
+
+	return false
+}
+
+// drain writes the queued samples until the queue is closed
+func (q *receiveQueue) drain(write func(packets []*rtp.Packet)) {
+	defer close(q.done)
+
+	for packets := range q.samples {
+		write(packets)
+	}
+}
+
+// close waits for the samples already queued to be written
+func (q *receiveQueue) close() {
+	close(q.samples)
+	<-q.done
+}
+
+// onReceiveQueuePush accounts for a sample queued for writing, dropped of
+// which had to make room for it
+func (w *LiveKitWebRTC) onReceiveQueuePush(trackID string, queue *receiveQueue, dropped int, deeper bool, ssrc uint32, isVideo bool) {
+	if dropped == 0 && !deeper {
+		return
+	}
+
+	var overflows uint64
+
+	w.m.Lock()
+	stats, ok := w.trackStats[trackID]
+
+	if ok {
+		stats.ReceiveQueueMaxDepth = queue.maxDepth
+		stats.ReceiveQueueOverflows += uint64(dropped)
+		overflows = stats.ReceiveQueueOverflows
+	}
+	w.m.Unlock()
+
+	if !ok || dropped == 0 {
+		return
+	}
+
+	logger := w.logger.WithField("trackID", trackID)
+
+	// An overloaded node overflows over and over: don't flood its logs too
+	if overflows == uint64(dropped) {
+		logger.Warnf("Receive queue full, dropped %d samples", dropped)
+	} else {
+		logger.Debugf("Receive queue full, dropped %d samples", dropped)
+	}
+
+	// Frames after the dropped ones can't be decoded until the next keyframe
+	if isVideo {
+		w.queueKeyframeRequest(ssrc, "receive_queue_overflow")
+	}
+
+	w.updateLiveMetrics(trackID)
+}
@@ -0,0 +1,97 @@
+package livekit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReceiveQueue_DropOldest(t *testing.T) {
+	c := clock.NewMock(time.Unix(0, 0))
+	q := newReceiveQueue(config.ReceiveQueue{Size: 2, Overflow: ReceiveQueueDropOldest}, c)
+
+	dropped, deeper := q.push(makePackets(1, 1))
+	assert.Equal(t, 0, dropped)
+	assert.True(t, deeper)
+
+	q.push(makePackets(2, 2))
+	dropped, deeper = q.push(makePackets(3, 3))
+	assert.Equal(t, 1, dropped)
+	assert.False(t, deeper)
+	assert.Equal(t, 2, q.maxDepth)
+
+	var written []uint16
+
+	go q.drain(func(packets []*rtp.Packet) {
+		written = append(written, packets[0].SequenceNumber)
+	})
+	q.close()
+
+	assert.Equal(t, []uint16{2, 3}, written, "The oldest sample was dropped")
+}
+
+func TestReceiveQueue_Block(t *testing.T) {
+	c := clock.NewMock(time.Unix(0, 0))
+	q := newReceiveQueue(config.ReceiveQueue{Size: 1, Overflow: ReceiveQueueBlock, MaxBlock: 50 * time.Millisecond}, c)
+	q.push(makePackets(1, 1))
+
+	result := make(chan int, 1)
+
+	go func() {
+		dropped, _ := q.push(makePackets(2, 2))
+		result <- dropped
+	}()
+
+	require.Eventually(t, func() bool { return c.Timers() == 1 }, time.Second, time.Millisecond)
+
+	select {
+	case <-result:
+		t.Fatal("Pushed without waiting for room")
+	default:
+	}
+
+	// The writer makes room in time
+	<-q.samples
+	assert.Equal(t, 0, <-result)
+
+	go func() {
+		dropped, _ := q.push(makePackets(3, 3))
+		result <- dropped
+	}()
+
+	require.Eventually(t, func() bool { return c.Timers() == 1 }, time.Second, time.Millisecond)
+	c.Add(50 * time.Millisecond)
+	assert.Equal(t, 1, <-result, "Dropped once blocked for too long")
+
+	packets := <-q.samples
+	assert.Equal(t, uint16(3), packets[0].SequenceNumber)
+}
+
+func TestOnReceiveQueuePush(t *testing.T) {
+	lk, _ := setupMockLK()
+	trackID := "test-track"
+	lk.trackStats[trackID] = &appstats.AdapterTrackStats{}
+
+	q := newReceiveQueue(config.ReceiveQueue{Size: 1}, lk.clock)
+	q.push(makePackets(1, 1))
+	dropped, deeper := q.push(makePackets(2, 2))
+	lk.onReceiveQueuePush(trackID, q, dropped, deeper, 1234, true)
+
+	stats := lk.trackStats[trackID]
+	assert.Equal(t, uint64(1), stats.ReceiveQueueOverflows)
+	assert.Equal(t, 1, stats.ReceiveQueueMaxDepth)
+}
+
+func TestValidateReceiveQueue(t *testing.T) {
+	assert.NoError(t, ValidateReceiveQueue(config.ReceiveQueue{}))
+	assert.NoError(t, ValidateReceiveQueue(config.ReceiveQueue{Size: 64, Overflow: ReceiveQueueBlock, MaxBlock: time.Millisecond}))
+	assert.Error(t, ValidateReceiveQueue(config.ReceiveQueue{Size: -1}))
+	assert.Error(t, ValidateReceiveQueue(config.ReceiveQueue{Size: 64, Overflow: ReceiveQueueBlock}))
+	assert.Error(t, ValidateReceiveQueue(config.ReceiveQueue{Size: 64, Overflow: "drop_newest"}))
+}
@@ -0,0 +1,174 @@
+package livekit
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/interfaces"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/utils"
+	"github.com/cenkalti/backoff/v4"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/rtp"
+)
+
+const (
+	reconnectInitialInterval = 500 * time.Millisecond
+	reconnectMaxInterval     = 5 * time.Second
+)
+
+// startReconnect starts rejoining the room and resubscribing to w.trackIds in
+// the background, unless reconnection is disabled or we're closing. Returns
+// whether the disconnect is being handled (i.e. callers must not tear the
+// session down).
+func (w *LiveKitWebRTC) startReconnect(reconnectRoom bool) bool {
+	if w.cfg.Reconnect.MaxAttempts == 0 || w.reconnectCtx.Err() != nil {
+		return false
+	}
+
+	w.m.Lock()
+	w.reconnecting = true
+
+	if w.reconnectRunning {
+		w.m.Unlock()
+		return true
+	}
+
+	w.reconnectRunning = true
+	w.reconnectWg.Add(1)
+	w.m.Unlock()
+
+	go func() {
+		err := w.reconnect(reconnectRoom)
+
+		w.m.Lock()
+		w.reconnectRunning = false
+		w.reconnecting = err != nil
+		w.m.Unlock()
+		w.reconnectWg.Done()
+
+		if err == nil || w.reconnectCtx.Err() != nil {
+			return
+		}
+
+		w.logger.WithField("room", w.roomId).
+			WithField("identity", w.identity).
+			Errorf("Giving up reconnecting to LiveKit room: %v", err)
+		w.setEndReason(interfaces.CloseReasonReconnectFailed, fmt.Errorf("%w: %w", interfaces.ErrLiveKitDisconnected, err))
+		w.notifyDisconnected(utils.ConnectionStateFailed)
+	}()
+
+	return true
+}
+
+func (w *LiveKitWebRTC) reconnect(reconnectRoom bool) error {
+	eb := backoff.NewExponentialBackOff()
+	eb.InitialInterval = reconnectInitialInterval
+	eb.MaxInterval = reconnectMaxInterval
+	eb.MaxElapsedTime = w.cfg.Reconnect.MaxElapsedTime
+	eb.Multiplier = 2
+	eb.RandomizationFactor = 0.1
+	eb.Reset()
+
+	// WithMaxRetries counts retries, not attempts
+	b := backoff.WithContext(backoff.WithMaxRetries(eb, w.cfg.Reconnect.MaxAttempts-1), w.reconnectCtx)
+	attempt := 0
+
+	return backoff.RetryNotify(func() error {
+		attempt++
+
+		w.logger.WithField("room", w.roomId).
+			WithField("identity", w.identity).
+			Infof("Reconnecting to LiveKit room, attempt %d/%d", attempt, w.cfg.Reconnect.MaxAttempts)
+
+		if reconnectRoom || w.room == nil || w.room.ConnectionState() == lksdk.ConnectionStateDisconnected {
+			if err := w.connectToRoom(); err != nil {
+				return err
+			}
+
+			reconnectRoom = false
+		}
+
+		// Publisher tracks may take a while to show up again
+		if _, err := w.subscribeToTracks(w.discoverTracks()); err != nil {
+			return err
+		}
+
+		w.logger.WithField("room", w.roomId).
+			WithField("identity", w.identity).
+			WithField("trackIds", w.requestedTracks()).
+			Info("Resubscribed to tracks after reconnecting")
+
+		return nil
+	}, b, func(err error, next time.Duration) {
+		w.logger.WithField("room", w.roomId).
+			WithField("identity", w.identity).
+			Warnf("Reconnect attempt %d failed: %v - retrying in %s", attempt, err, next)
+	})
+}
+
+// suspendTrack flags a track whose reader stopped while reconnecting, so its
+// next reader knows it resumes an interrupted stream. Returns false if we're
+// not reconnecting (the track genuinely ended).
+func (w *LiveKitWebRTC) suspendTrack(trackID string) bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if !w.reconnecting {
+		return false
+	}
+
+	w.resumingTracks[trackID] = true
+
+	return true
+}
+
+// resumeTrack is called with the first packet read from a (re)subscribed
+// track. If the track was interrupted by a reconnect or a resubscription, the
+// sequence number gap is reported to the recorder as skipped packets and, for
+// video, a keyframe is requested so the recording can resume cleanly.
+func (w *LiveKitWebRTC) resumeTrack(trackID string, packet *rtp.Packet, isVideo bool, ssrc uint32) {
+	w.m.Lock()
+
+	if !w.resumingTracks[trackID] {
+		w.m.Unlock()
+		return
+	}
+
+	delete(w.resumingTracks, trackID)
+	cause := "reconnect"
+
+	if w.resubscribedTracks[trackID] {
+		delete(w.resubscribedTracks, trackID)
+		cause = "resubscription"
+	}
+
+	var gap uint16
+	stats, hasStats := w.trackStats[trackID]
+	hasGap := hasStats && stats.HasSeqNum
+	lastSeqNum := uint16(0)
+
+	if hasStats && cause == "reconnect" {
+		stats.Reconnects++
+	}
+
+	if hasGap {
+		lastSeqNum = stats.LastSeqNum
+		gap = packet.SequenceNumber - lastSeqNum - 1
+		stats.ReconnectGapPackets += uint64(gap)
+	}
+
+	w.m.Unlock()
+
+	w.logger.WithField("trackID", trackID).
+		Infof("Track resumed after %s: lastSeqNum=%d, seqNum=%d, gap=%d", cause, lastSeqNum, packet.SequenceNumber, gap)
+
+	if hasGap && gap > 0 {
+		w.rec.NotifySkippedPacket(lastSeqNum + 1)
+	}
+
+	if isVideo {
+		w.queueKeyframeRequest(ssrc, cause)
+	}
+
+	w.updateLiveMetrics(trackID)
+}
@@ -0,0 +1,25 @@
+package livekit
+
+import (
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+)
+
+// roomHost is a URL rooms can be joined at
+type roomHost struct {
+	url string
+	// region is the configured region the URL belongs to, empty for the
+	// default host
+	region string
+}
+
+// roomHosts returns where to join rooms, in order of preference: the
+// configured region's URL, if any, then the default host
+func roomHosts(cfg config.LiveKit) []roomHost {
+	hosts := make([]roomHost, 0, 2)
+
+	if url := cfg.Region.URLs[cfg.Region.Name]; cfg.Region.Name != "" && url != "" && url != cfg.Host {
+		hosts = append(hosts, roomHost{url: url, region: cfg.Region.Name})
+	}
+
+	return append(hosts, roomHost{url: cfg.Host})
+}
@@ -0,0 +1,28 @@
+package livekit
+
+import (
+	"testing"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoomHosts(t *testing.T) {
+	cfg := config.LiveKit{Host: "wss://lk.example.com"}
+	assert.Equal(t, []roomHost{{url: cfg.Host}}, roomHosts(cfg), "No region")
+
+	cfg.Region = config.Region{
+		Name: "eu-west",
+		URLs: map[string]string{"eu-west": "wss://eu.lk.example.com", "us-east": "wss://us.lk.example.com"},
+	}
+	assert.Equal(t, []roomHost{
+		{url: "wss://eu.lk.example.com", region: "eu-west"},
+		{url: cfg.Host},
+	}, roomHosts(cfg), "Region first, default routing as the fallback")
+
+	cfg.Region.Name = "ap-south"
+	assert.Equal(t, []roomHost{{url: cfg.Host}}, roomHosts(cfg), "Region without a URL")
+
+	cfg.Region = config.Region{Name: "eu-west", URLs: map[string]string{"eu-west": cfg.Host}}
+	assert.Equal(t, []roomHost{{url: cfg.Host}}, roomHosts(cfg), "Not dialed twice")
+}
@@ -0,0 +1,128 @@
+package livekit
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/utils"
+	"github.com/pion/rtp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Unwrapped sequence numbers are offset by one cycle: the jitter buffer
+// treats a start of 0 as "not started yet".
+const reorderSeqOffset = 1 << 16
+
+// reorderBuffer holds packets for a bounded window so that out-of-order
+// packets are put back in sequence before reaching the sample buffer. A
+// missing packet is only reported as skipped once the window expires,
+// whether more packets came meanwhile (Push) or not (Flush, once FlushAt).
+type reorderBuffer struct {
+	ctx      context.Context
+	jb       *utils.JitterBuffer
+	su       *utils.SequenceUnwrapper
+	maxDelay time.Duration
+
+	// Highest sequence number pushed, unwrapped
+	end int64
+	// When the missing packet at head, packets held behind it, is given up
+	// on, as the jitter buffer times it (on the system clock)
+	head    int64
+	flushAt time.Time
+}
+
+// newReorderBuffer returns nil if reordering is disabled (size 0)
+func newReorderBuffer(ctx context.Context, cfg config.TrackJitterBuffer) *reorderBuffer {
+	if cfg.Size == 0 {
+		return nil
+	}
+
+	timeout := cfg.MaxDelay.Milliseconds()
+
+	if timeout > math.MaxUint16 {
+		timeout = math.MaxUint16
+	}
+
+	return &reorderBuffer{
+		ctx:      ctx,
+		jb:       utils.NewJitterBuffer(cfg.Size, uint16(timeout), ctx),
+		su:       utils.NewSequenceUnwrapper(16),
+		maxDelay: time.Duration(timeout) * time.Millisecond,
+	}
+}
+
+// Push adds a packet and returns the packets that are ready, in sequence
+// order, along with the sequence numbers given up on to get to them
+func (b *reorderBuffer) Push(packet *rtp.Packet) ([]*rtp.Packet, []uint16) {
+	seq := b.su.Unwrap(uint64(packet.SequenceNumber)) + reorderSeqOffset
+
+	// Too late: whatever this packet belonged to was already released
+	if nextStart := b.jb.GetNextStart(); nextStart != 0 && seq < nextStart {
+		log.WithField("session", b.ctx.Value("session")).
+			Debugf("Dropping late packet: seq=%d, next=%d", packet.SequenceNumber, nextStart-reorderSeqOffset)
+
+		return nil, nil
+	}
+
+	if b.jb.Add(seq, packet) && seq > b.end {
+		b.end = seq
+	}
+
+	return b.next()
+}
+
+// Flush returns the packets held back for a missing one once it's given up
+// on, as a push would, for when no packet comes to push by FlushAt
+func (b *reorderBuffer) Flush() ([]*rtp.Packet, []uint16) {
+	return b.next()
+}
+
+// FlushAt returns when to flush the packets held back for a missing one,
+// false if none are
+func (b *reorderBuffer) FlushAt() (time.Time, bool) {
+	return b.flushAt, !b.flushAt.IsZero()
+}
+
+// next releases what's ready. The buffer is polled until it holds nothing
+// more back, so it starts timing the missing packet it's left waiting for.
+func (b *reorderBuffer) next() ([]*rtp.Packet, []uint16) {
+	var released []*rtp.Packet
+	var skippedSeqs []uint16
+
+	for {
+		start := b.jb.GetNextStart()
+		packets, skipped := b.jb.NextPackets()
+
+		if len(packets) == 0 && !skipped {
+			break
+		}
+
+		// What's released follows what was given up on
+		if skipped {
+			for seq := start; seq < b.jb.GetNextStart()-int64(len(packets)); seq++ {
+				skippedSeqs = append(skippedSeqs, uint16(seq-reorderSeqOffset))
+			}
+
+			b.jb.GetAndClearLastSkipped()
+		}
+
+		// Mostly all there is, not worth copying
+		if released == nil {
+			released = packets
+		} else {
+			released = append(released, packets...)
+		}
+	}
+
+	switch next := b.jb.GetNextStart(); {
+	case next > b.end:
+		b.flushAt = time.Time{}
+	case next != b.head || b.flushAt.IsZero():
+		b.head = next
+		b.flushAt = time.Now().Add(b.maxDelay)
+	}
+
+	return released, skippedSeqs
+}
@@ -0,0 +1,139 @@
+package livekit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func seqsOf(packets []*rtp.Packet) []uint16 {
+	seqs := make([]uint16, 0, len(packets))
+
+	for _, p := range packets {
+		seqs = append(seqs, p.SequenceNumber)
+	}
+
+	return seqs
+}
+
+func TestReorderBuffer_Disabled(t *testing.T) {
+	assert.Nil(t, newReorderBuffer(context.Background(), config.TrackJitterBuffer{}))
+}
+
+func TestReorderBuffer_ReordersAcrossWraparound(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "session", "test")
+	b := newReorderBuffer(ctx, config.TrackJitterBuffer{Size: 64, MaxDelay: time.Second})
+	require.NotNil(t, b)
+
+	var out []*rtp.Packet
+
+	for _, seq := range []uint16{65533, 65535, 65534, 1, 0, 2} {
+		packets, skipped := b.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}})
+		assert.Empty(t, skipped)
+		out = append(out, packets...)
+	}
+
+	assert.Equal(t, []uint16{65533, 65534, 65535, 0, 1, 2}, seqsOf(out))
+
+	// Wraparound accounting must still work on the reordered output
+	lk, _ := setupMockLK()
+	trackID := lk.trackIds[0]
+	lk.processPacketStats(trackID, out[:3])
+	lk.processPacketStats(trackID, out[3:])
+	assert.Equal(t, 1, lk.trackStats[trackID].SeqNumWrapArounds)
+	assert.Equal(t, uint16(2), lk.trackStats[trackID].LastSeqNum)
+
+	// Already released
+	packets, _ := b.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 65534}})
+	assert.Empty(t, packets)
+
+	_, held := b.FlushAt()
+	assert.False(t, held)
+}
+
+func TestReorderBuffer_SkipsAfterMaxDelay(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "session", "test")
+	b := newReorderBuffer(ctx, config.TrackJitterBuffer{Size: 64, MaxDelay: 20 * time.Millisecond})
+	require.NotNil(t, b)
+
+	packets, _ := b.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 10}})
+	assert.Equal(t, []uint16{10}, seqsOf(packets))
+
+	// 11 is missing: 12 and 13 are held back within the window
+	packets, skipped := b.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 12}})
+	assert.Empty(t, packets)
+	assert.Empty(t, skipped)
+
+	time.Sleep(30 * time.Millisecond)
+
+	packets, skipped = b.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 13}})
+	assert.Equal(t, []uint16{11}, skipped)
+	assert.Equal(t, []uint16{12, 13}, seqsOf(packets))
+}
+
+func TestReorderBuffer_SkipsRange(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "session", "test")
+	b := newReorderBuffer(ctx, config.TrackJitterBuffer{Size: 64, MaxDelay: 20 * time.Millisecond})
+	require.NotNil(t, b)
+
+	b.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 65533}})
+	// 65534 to 1 went missing, across the wraparound
+	b.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 2}})
+	b.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 0}})
+
+	var skipped []uint16
+	var out []*rtp.Packet
+
+	// Each missing packet in a row gets the window of its own
+	for i := 0; i < 10 && len(out) == 0; i++ {
+		time.Sleep(30 * time.Millisecond)
+
+		packets, s := b.Flush()
+		skipped = append(skipped, s...)
+		out = append(out, packets...)
+	}
+
+	assert.Equal(t, []uint16{65534, 65535}, skipped)
+	assert.Equal(t, []uint16{0}, seqsOf(out))
+
+	time.Sleep(30 * time.Millisecond)
+
+	packets, s := b.Flush()
+	assert.Equal(t, []uint16{1}, s)
+	assert.Equal(t, []uint16{2}, seqsOf(packets))
+}
+
+func TestReorderBuffer_FlushAt(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "session", "test")
+	b := newReorderBuffer(ctx, config.TrackJitterBuffer{Size: 64, MaxDelay: 20 * time.Millisecond})
+	require.NotNil(t, b)
+
+	b.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 10}})
+	_, held := b.FlushAt()
+	assert.False(t, held, "Nothing held back")
+
+	before := time.Now()
+	b.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 12}})
+	flushAt, held := b.FlushAt()
+	require.True(t, held)
+	assert.WithinDuration(t, before.Add(20*time.Millisecond), flushAt, 10*time.Millisecond)
+
+	// Packets pushed meanwhile don't push it back
+	b.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 13}})
+	again, _ := b.FlushAt()
+	assert.Equal(t, flushAt, again)
+
+	// Nothing more came: flushed once due
+	time.Sleep(time.Until(flushAt))
+	packets, skipped := b.Flush()
+	assert.Equal(t, []uint16{11}, skipped)
+	assert.Equal(t, []uint16{12, 13}, seqsOf(packets))
+
+	_, held = b.FlushAt()
+	assert.False(t, held)
+}
@@ -0,0 +1,322 @@
+package livekit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/utils"
+	"github.com/livekit/server-sdk-go/v2/pkg/jitter"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4/pkg/media/rtpdump"
+	log "github.com/sirupsen/logrus"
+)
+
+// Replays feed captured packets back through the adapter's packet path, as
+// the tracks' read loops would, to reproduce a recording deterministically:
+// duplicate filtering, reception stats, the reorder buffer (if enabled),
+// the jitter buffer, the recorder, then packet stats. Arrival times are the
+// capture's, on a mock clock, so a replay doesn't take the capture's
+// duration; the reorder buffer's timeouts are still on the system clock.
+// Left out: everything tied to a room (RTX, NACKs, RTCP, keyframe requests,
+// E2EE, mute and speaker events).
+
+// ReplayTrack is a track of a capture to replay
+type ReplayTrack struct {
+	ID       string
+	MimeType string
+	// Packets are routed to tracks by payload type, or SSRC if set
+	PayloadType uint8
+	SSRC        uint32
+	// Defaults to the codec's
+	ClockRate uint32
+}
+
+// ReplayPacket is a captured packet, at its arrival time from the start of
+// the capture
+type ReplayPacket struct {
+	Offset time.Duration
+	Packet *rtp.Packet
+}
+
+// ReplayResult is what a replay produced
+type ReplayResult struct {
+	// Adapter stats, by track ID
+	Tracks   map[string]appstats.AdapterTrackStats `json:"tracks"`
+	Recorder *types.RecorderStats                  `json:"recorder"`
+	Duration time.Duration                         `json:"duration"`
+	// Packets of none of the tracks, dropped
+	Unrouted int `json:"unrouted,omitempty"`
+}
+
+// ParseReplayTrack parses a track given as <payload type>=<mime type>, e.g.
+// 111=audio/opus. Its ID is made of its kind and payload type.
+func ParseReplayTrack(spec string) (ReplayTrack, error) {
+	pt, mimeType, ok := strings.Cut(spec, "=")
+
+	if !ok {
+		return ReplayTrack{}, fmt.Errorf("invalid track %q, expected <payload type>=<mime type>", spec)
+	}
+
+	payloadType, err := strconv.ParseUint(pt, 10, 7)
+
+	if err != nil {
+		return ReplayTrack{}, fmt.Errorf("invalid payload type %q", pt)
+	}
+
+	if newDepacketizer(MimeType(strings.ToLower(mimeType))) == nil {
+		return ReplayTrack{}, fmt.Errorf("unsupported codec %s", mimeType)
+	}
+
+	kind, _, _ := strings.Cut(strings.ToLower(mimeType), "/")
+
+	return ReplayTrack{
+		ID:          fmt.Sprintf("%s-%d", kind, payloadType),
+		MimeType:    mimeType,
+		PayloadType: uint8(payloadType),
+	}, nil
+}
+
+// ReadRTPDump reads the RTP packets of an rtpdump file, as written if
+// writeRTPDump is enabled (see recorder.RTPWriter). RTCP packets are
+// skipped.
+func ReadRTPDump(r io.Reader) ([]ReplayPacket, error) {
+	reader, _, err := rtpdump.NewReader(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var packets []ReplayPacket
+
+	for {
+		p, err := reader.Next()
+
+		if errors.Is(err, io.EOF) {
+			return packets, nil
+		}
+
+		if err != nil {
+			return packets, err
+		}
+
+		if p.IsRTCP {
+			continue
+		}
+
+		packet := &rtp.Packet{}
+
+		if err := packet.Unmarshal(p.Payload); err != nil {
+			return packets, fmt.Errorf("packet at %s: %w", p.Offset, err)
+		}
+
+		packets = append(packets, ReplayPacket{Offset: p.Offset, Packet: packet})
+	}
+}
+
+// replayTrack is the read loop state of a track being replayed
+type replayTrack struct {
+	ReplayTrack
+	kind       TrackKind
+	buffer     *jitter.Buffer
+	reorder    *reorderBuffer
+	duplicates *utils.DuplicateFilter
+	splicer    *ssrcSplicer
+}
+
+// Replay feeds packets, sorted by offset, to rec through an adapter set up
+// with cfg, then closes both. ctx's session value defaults to "replay".
+func Replay(ctx context.Context, cfg config.LiveKit, rec recorder.Recorder, tracks []ReplayTrack, packets []ReplayPacket) (*ReplayResult, error) {
+	if _, ok := ctx.Value("session").(string); !ok {
+		ctx = context.WithValue(ctx, "session", "replay")
+	}
+
+	trackIDs := make([]string, 0, len(tracks))
+
+	for _, t := range tracks {
+		trackIDs = append(trackIDs, t.ID)
+	}
+
+	w := NewLiveKitWebRTC(ctx, cfg, rec, "replay", trackIDs, nil)
+	mock := clock.NewMock(time.Unix(0, 0))
+	w.clock = mock
+	w.startTs = mock.Now()
+	w.initTrackStats()
+
+	replayTracks, err := w.replayTracks(tracks)
+
+	if err != nil {
+		w.CloseWithResult()
+		return nil, err
+	}
+
+	result := &ReplayResult{}
+
+	for _, p := range packets {
+		mock.Set(w.startTs.Add(p.Offset))
+		t := routeReplayPacket(replayTracks, p.Packet)
+
+		if t == nil {
+			result.Unrouted++
+			continue
+		}
+
+		w.replayPacket(t, p.Packet)
+	}
+
+	w.m.Lock()
+	result.Tracks = make(map[string]appstats.AdapterTrackStats, len(w.trackStats))
+
+	for id, stats := range w.trackStats {
+		result.Tracks[id] = *stats
+	}
+	w.m.Unlock()
+
+	closeResult := w.CloseWithResult()
+	result.Duration = closeResult.Duration
+	result.Recorder = closeResult.Stats
+
+	return result, closeResult.Err
+}
+
+func (w *LiveKitWebRTC) replayTracks(tracks []ReplayTrack) ([]*replayTrack, error) {
+	replayTracks := make([]*replayTrack, 0, len(tracks))
+
+	for _, t := range tracks {
+		mimeType := MimeType(strings.ToLower(t.MimeType))
+		depacketizer := newDepacketizer(mimeType)
+
+		if depacketizer == nil {
+			return nil, fmt.Errorf("track %s: unsupported codec %s", t.ID, t.MimeType)
+		}
+
+		kind := TrackKindAudio
+
+		if strings.HasPrefix(string(mimeType), "video/") {
+			kind = TrackKindVideo
+		}
+
+		if t.ClockRate == 0 {
+			t.ClockRate = 90000
+
+			if kind == TrackKindAudio {
+				t.ClockRate = 48000
+			}
+		}
+
+		reorderCfg := w.cfg.JitterBuffer.Audio
+
+		if kind == TrackKindVideo {
+			reorderCfg = w.cfg.JitterBuffer.Video
+
+			if err := w.rec.SetVideoCodec(string(mimeType)); err != nil {
+				return nil, fmt.Errorf("track %s: %w", t.ID, err)
+			}
+
+			w.rec.SetHasVideo(true)
+		} else {
+			w.rec.SetHasAudio(true)
+		}
+
+		buffer := jitter.NewBuffer(depacketizer, t.ClockRate, jitterLatency)
+
+		w.m.Lock()
+		w.jitterBuffers[t.ID] = buffer
+		w.receptionStats[t.ID] = newReceptionStats(t.ClockRate)
+		w.m.Unlock()
+
+		replayTracks = append(replayTracks, &replayTrack{
+			ReplayTrack: t,
+			kind:        kind,
+			buffer:      buffer,
+			reorder:     newReorderBuffer(w.ctx, reorderCfg),
+			duplicates:  utils.NewDuplicateFilter(),
+			splicer:     newSSRCSplicer(t.ClockRate),
+		})
+	}
+
+	return replayTracks, nil
+}
+
+func routeReplayPacket(tracks []*replayTrack, packet *rtp.Packet) *replayTrack {
+	for _, t := range tracks {
+		if t.SSRC != 0 && t.SSRC == packet.SSRC {
+			return t
+		}
+
+		if t.SSRC == 0 && t.PayloadType == packet.PayloadType {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// replayPacket handles a packet as the track's read loop does once read
+func (w *LiveKitWebRTC) replayPacket(t *replayTrack, packet *rtp.Packet) {
+	if t.duplicates.Duplicate(packet.SSRC, packet.SequenceNumber) {
+		w.onDuplicatePacket(t.ID, packet)
+		return
+	}
+
+	w.processReceptionStats(t.ID, packet)
+	w.notifyFirstPacket(t.ID, t.kind, packet)
+
+	if w.checkMaxDuration() {
+		return
+	}
+
+	previousSSRC, receivedSeq := t.splicer.ssrc, packet.SequenceNumber
+	switched, keep := t.splicer.splice(packet, w.clock.Now())
+	w.processSSRCStats(t.ID, packet.SSRC, receivedSeq, !keep)
+
+	if !keep {
+		return
+	}
+
+	if switched {
+		w.onSSRCChange(t.ID, packet, previousSSRC, t.kind == TrackKindVideo)
+	}
+
+	ordered := []*rtp.Packet{packet}
+
+	if t.reorder != nil {
+		var skipped []uint16
+		ordered, skipped = t.reorder.Push(packet)
+
+		for _, seq := range skipped {
+			w.rec.NotifySkippedPacket(seq)
+		}
+	}
+
+	for _, p := range ordered {
+		t.buffer.Push(p)
+	}
+
+	for packets := t.buffer.Pop(false); len(packets) > 0; packets = t.buffer.Pop(false) {
+		for _, p := range packets {
+			if t.kind == TrackKindVideo {
+				w.rec.PushVideo(p)
+			} else {
+				w.rec.PushAudio(p)
+			}
+		}
+
+		if log.IsLevelEnabled(log.TraceLevel) {
+			w.logger.WithField("trackID", t.ID).
+				Tracef("Replayed sample of %d packets", len(packets))
+		}
+
+		w.updateFlowState(t.ID, packets[0].SequenceNumber, w.clock.Now())
+		w.processPacketStats(t.ID, packets)
+	}
+}
@@ -0,0 +1,92 @@
+package livekit
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReplayTrack(t *testing.T) {
+	track, err := ParseReplayTrack("111=audio/opus")
+	require.NoError(t, err)
+	assert.Equal(t, ReplayTrack{ID: "audio-111", MimeType: "audio/opus", PayloadType: 111}, track)
+
+	for _, spec := range []string{"audio/opus", "128=audio/opus", "x=video/vp8", "96=video/theora"} {
+		_, err := ParseReplayTrack(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestReadRTPDump(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.rtp")
+	w, err := recorder.NewRTPWriter(path, net.IP{0, 0, 0, 0}, 0)
+	require.NoError(t, err)
+
+	for seq := uint16(10); seq < 13; seq++ {
+		require.NoError(t, w.WriteRTP(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, PayloadType: 111, SequenceNumber: seq, Timestamp: uint32(seq) * 960},
+			Payload: []byte{0xFC, 0xAA},
+		}))
+	}
+
+	require.NoError(t, w.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	packets, err := ReadRTPDump(f)
+	require.NoError(t, err)
+	require.Len(t, packets, 3)
+
+	for i, p := range packets {
+		assert.Equal(t, uint16(10+i), p.Packet.SequenceNumber)
+		assert.Equal(t, []byte{0xFC, 0xAA}, p.Packet.Payload)
+	}
+}
+
+func TestReplay_FullRange(t *testing.T) {
+	rec := &mockRecorder{
+		videoStats: &types.RecorderTrackStats{},
+		audioStats: &types.RecorderTrackStats{},
+	}
+	tracks := []ReplayTrack{{ID: "audio", MimeType: "audio/opus", PayloadType: 111}}
+
+	var packets []ReplayPacket
+
+	// Twice around the sequence numbers, with a retransmit and a stray packet
+	for _, p := range append(makeFullRangePackets(0), makeFullRangePackets(0)...) {
+		p.PayloadType = 111
+		p.Payload = []byte{0xFC, 0xAA}
+		packets = append(packets, ReplayPacket{Offset: time.Duration(len(packets)) * 20 * time.Millisecond, Packet: p})
+	}
+
+	for i := range packets[65535:] {
+		packets[65535+i].Packet.Timestamp += 65535 * 40
+	}
+
+	packets = append(packets[:100], append([]ReplayPacket{packets[99]}, packets[100:]...)...)
+	packets = append(packets, ReplayPacket{Offset: packets[len(packets)-1].Offset, Packet: &rtp.Packet{Header: rtp.Header{PayloadType: 96}}})
+
+	result, err := Replay(context.Background(), config.LiveKit{}, rec, tracks, packets)
+	require.NoError(t, err)
+
+	stats := result.Tracks["audio"]
+	assert.Equal(t, 1, stats.SeqNumWrapArounds)
+	assert.Equal(t, uint64(1), stats.DuplicatePackets)
+	// The full range leaves out 65535
+	assert.InDelta(t, 1.0/131072, stats.LossFraction, 1e-9)
+	assert.Equal(t, 1, result.Unrouted)
+	assert.True(t, rec.hasAudio)
+	assert.False(t, rec.hasVideo)
+}
@@ -0,0 +1,201 @@
+package livekit
+
+import (
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/utils"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// receptionStats keeps RFC 3550 receiver-side statistics for a track: loss
+// and interarrival jitter are derived from the received RTP stream (A.3 and
+// A.8). No RTT: the recorder sends no Sender Reports for the publisher to
+// report on.
+type receptionStats struct {
+	clockRate uint32
+	su        *utils.SequenceUnwrapper
+
+	ssrc     uint32
+	started  bool
+	baseSeq  int64
+	maxSeq   int64
+	received uint64
+
+	hasTransit  bool
+	lastTransit int64
+	jitter      float64 // In RTP timestamp units
+
+	senderReports int
+	lastSRTime    time.Time
+
+	// Only when the transport-wide congestion control extension is negotiated
+	twcc *twccStats
+
+	// Only kept with recordNTP
+	recordNTP       bool
+	firstNTPMapping *appstats.NTPMapping
+	lastNTPMapping  *appstats.NTPMapping
+}
+
+func newReceptionStats(clockRate uint32) *receptionStats {
+	return &receptionStats{
+		clockRate: clockRate,
+		su:        utils.NewSequenceUnwrapper(16),
+	}
+}
+
+func (s *receptionStats) onRTP(packet *rtp.Packet, arrival time.Time) {
+	seq := s.su.Unwrap(uint64(packet.SequenceNumber))
+
+	if !s.started {
+		s.started = true
+		s.baseSeq = seq
+		s.maxSeq = seq
+	} else if seq > s.maxSeq {
+		s.maxSeq = seq
+	}
+
+	s.received++
+
+	if s.twcc != nil {
+		s.twcc.onRTP(packet, arrival)
+	}
+
+	// A new SSRC (e.g. after a reconnect) has an unrelated timestamp base
+	if packet.SSRC != s.ssrc {
+		s.ssrc = packet.SSRC
+		s.hasTransit = false
+	}
+
+	if s.clockRate == 0 {
+		return
+	}
+
+	arrivalTs := arrival.UnixNano() * int64(s.clockRate) / int64(time.Second)
+	transit := arrivalTs - int64(packet.Timestamp)
+
+	if s.hasTransit {
+		d := transit - s.lastTransit
+
+		if d < 0 {
+			d = -d
+		}
+
+		s.jitter += (float64(d) - s.jitter) / 16
+	}
+
+	s.hasTransit = true
+	s.lastTransit = transit
+}
+
+func (s *receptionStats) onRTCP(packet rtcp.Packet, now time.Time) {
+	if p, ok := packet.(*rtcp.SenderReport); ok {
+		s.senderReports++
+		s.lastSRTime = now
+
+		if s.recordNTP {
+			s.onNTPMapping(p, now)
+		}
+	}
+}
+
+// forwardSenderReport gives the publisher's clock, as of a Sender Report, to
+// recorders correcting the skew between audio and video (see
+// config.AVSync). Only while the track keeps its first SSRC: the recorder
+// gets its timestamps as sent, those of later ones are spliced.
+func (w *LiveKitWebRTC) forwardSenderReport(trackID string, packet rtcp.Packet, isVideo bool) {
+	sr, ok := packet.(*rtcp.SenderReport)
+
+	if !ok {
+		return
+	}
+
+	sc, ok := w.rec.(interface {
+		SetSenderClock(video bool, rtpTimestamp uint32, wallClock time.Time)
+	})
+
+	if !ok {
+		return
+	}
+
+	w.m.Lock()
+	stats, hasStats := w.trackStats[trackID]
+	firstSSRC := hasStats && stats.SSRCChanges == 0 && len(stats.SSRCs) > 0 && stats.SSRCs[0].SSRC == sr.SSRC
+	w.m.Unlock()
+
+	if firstSSRC {
+		sc.SetSenderClock(isVideo, sr.RTPTime, fromNTPTime(sr.NTPTime))
+	}
+}
+
+// onNTPMapping keeps the first and latest correlations. A new first one is
+// kept when the SSRC changes (e.g. after a reconnect), as the old one doesn't
+// apply to the timestamps anymore.
+func (s *receptionStats) onNTPMapping(sr *rtcp.SenderReport, now time.Time) {
+	mapping := &appstats.NTPMapping{
+		SSRC:         sr.SSRC,
+		RTPTimestamp: sr.RTPTime,
+		NTPTime:      sr.NTPTime,
+		UnixMicros:   fromNTPTime(sr.NTPTime).UnixMicro(),
+		ClockRate:    s.clockRate,
+		ReceivedAt:   now.UnixMilli(),
+	}
+
+	if s.firstNTPMapping == nil || s.firstNTPMapping.SSRC != sr.SSRC {
+		s.firstNTPMapping = mapping
+	}
+
+	s.lastNTPMapping = mapping
+}
+
+func (s *receptionStats) packetsLost() int64 {
+	if !s.started {
+		return 0
+	}
+
+	return s.maxSeq - s.baseSeq + 1 - int64(s.received)
+}
+
+func (s *receptionStats) apply(stats *appstats.AdapterTrackStats) {
+	stats.PacketsReceived = s.received
+	stats.PacketsLost = s.packetsLost()
+	stats.SenderReports = s.senderReports
+
+	if s.clockRate > 0 {
+		stats.JitterMs = s.jitter * 1000 / float64(s.clockRate)
+	}
+
+	if !s.lastSRTime.IsZero() {
+		stats.LastSenderReport = s.lastSRTime.UnixMilli()
+	}
+
+	stats.FirstNTPMapping = s.firstNTPMapping
+	stats.LastNTPMapping = s.lastNTPMapping
+
+	if s.twcc != nil {
+		s.twcc.apply(stats)
+	}
+}
+
+// setTWCCExtensionID starts deriving stats from the transport-wide congestion
+// control extension, if negotiated. Kept across resubscriptions that
+// negotiate the same ID.
+func (s *receptionStats) setTWCCExtensionID(id uint8) {
+	if id == 0 {
+		s.twcc = nil
+	} else if s.twcc == nil || s.twcc.extID != id {
+		s.twcc = newTWCCStats(id)
+	}
+}
+
+// fromNTPTime converts a 64 bit NTP timestamp to wall clock time
+func fromNTPTime(ntp uint64) time.Time {
+	const ntpEpochOffset = 2208988800 // Seconds between 1900 and 1970
+
+	secs := int64(ntp>>32) - ntpEpochOffset
+	nanos := (ntp & 0xFFFFFFFF) * uint64(time.Second) >> 32
+
+	return time.Unix(secs, int64(nanos))
+}
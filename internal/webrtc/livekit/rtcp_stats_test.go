@@ -0,0 +1,136 @@
+package livekit
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceptionStats_LossAndJitter(t *testing.T) {
+	rs := newReceptionStats(48000)
+	start := time.Unix(1700000000, 0)
+
+	// 20ms Opus packets arriving exactly on time: no jitter. 65535 is
+	// reordered and 1 is lost, across the sequence number wraparound.
+	for _, seq := range []uint16{65533, 65534, 0, 65535, 2} {
+		ts := uint32(seq-65533) * 960
+		arrival := start.Add(time.Duration(uint16(seq-65533)) * 20 * time.Millisecond)
+		rs.onRTP(&rtp.Packet{Header: rtp.Header{SSRC: 1, SequenceNumber: seq, Timestamp: ts}}, arrival)
+	}
+
+	stats := &appstats.AdapterTrackStats{}
+	rs.apply(stats)
+
+	assert.Equal(t, uint64(5), stats.PacketsReceived)
+	assert.Equal(t, int64(1), stats.PacketsLost)
+	assert.InDelta(t, 0, stats.JitterMs, 0.01)
+
+	// A packet 16ms late bumps jitter by 1/16 of it
+	rs.onRTP(&rtp.Packet{Header: rtp.Header{SSRC: 1, SequenceNumber: 3, Timestamp: 6 * 960}},
+		start.Add(6*20*time.Millisecond+16*time.Millisecond))
+	rs.apply(stats)
+	assert.InDelta(t, 1, stats.JitterMs, 0.01)
+}
+
+func TestReceptionStats_RTCP(t *testing.T) {
+	rs := newReceptionStats(90000)
+	now := time.Now()
+	stats := &appstats.AdapterTrackStats{}
+
+	rs.onRTCP(&rtcp.SenderReport{NTPTime: toNTPTime(now)}, now)
+	rs.apply(stats)
+
+	assert.Equal(t, 1, stats.SenderReports)
+	assert.Equal(t, now.UnixMilli(), stats.LastSenderReport)
+
+	rs.onRTCP(&rtcp.ReceiverReport{}, now)
+	rs.apply(stats)
+	assert.Equal(t, 1, stats.SenderReports)
+}
+
+func TestAdapterTrackStats_JSONBackwardCompatible(t *testing.T) {
+	data, err := json.Marshal(&appstats.AdapterTrackStats{})
+	assert.NoError(t, err)
+
+	for _, key := range []string{"packetsReceived", "packetsLost", "jitterMs", "senderReports", "lastSenderReport"} {
+		assert.NotContains(t, string(data), key, "Unset reception stats must not be serialized")
+	}
+
+	var stats appstats.AdapterTrackStats
+	assert.NoError(t, json.Unmarshal([]byte(`{"startTime":1,"lastSeqNum":2,"pliRequests":3}`), &stats))
+	assert.Equal(t, uint16(2), stats.LastSeqNum)
+}
+
+func TestReceptionStats_NTPMapping(t *testing.T) {
+	rs := newReceptionStats(90000)
+	now := time.Now()
+	stats := &appstats.AdapterTrackStats{}
+
+	rs.onRTCP(&rtcp.SenderReport{SSRC: 1, NTPTime: toNTPTime(now), RTPTime: 1000}, now)
+	rs.apply(stats)
+	assert.Nil(t, stats.FirstNTPMapping, "Not recorded by default")
+
+	rs.recordNTP = true
+	sentAt := now.Add(-time.Second)
+
+	for i, ssrc := range []uint32{1, 1, 2} {
+		at := sentAt.Add(time.Duration(i) * time.Second)
+		rs.onRTCP(&rtcp.SenderReport{SSRC: ssrc, NTPTime: toNTPTime(at), RTPTime: uint32(i) * 90000}, now)
+		rs.apply(stats)
+
+		if i == 1 {
+			// Multiple SRs: the first one is kept along with the latest
+			assert.Equal(t, uint32(0), stats.FirstNTPMapping.RTPTimestamp)
+			assert.Equal(t, sentAt.UnixMicro(), stats.FirstNTPMapping.UnixMicros)
+			assert.Equal(t, uint32(90000), stats.LastNTPMapping.RTPTimestamp)
+			assert.Equal(t, uint32(90000), stats.LastNTPMapping.ClockRate)
+			assert.Equal(t, now.UnixMilli(), stats.LastNTPMapping.ReceivedAt)
+		}
+	}
+
+	// A new SSRC starts over
+	assert.Equal(t, stats.FirstNTPMapping, stats.LastNTPMapping)
+	assert.Equal(t, uint32(2), stats.FirstNTPMapping.SSRC)
+}
+
+func TestFromNTPTime(t *testing.T) {
+	now := time.Unix(1700000000, 123456789)
+	assert.WithinDuration(t, now, fromNTPTime(toNTPTime(now)), time.Microsecond)
+}
+
+func TestForwardSenderReport(t *testing.T) {
+	lk, rec := setupMockLK()
+	trackID := lk.trackIds[0]
+
+	// The track's SSRC isn't known before its first packet
+	lk.forwardSenderReport(trackID, &rtcp.SenderReport{SSRC: 1, RTPTime: 100}, true)
+	assert.Empty(t, rec.senderClocks[true])
+
+	lk.processSSRCStats(trackID, 1, 10, false)
+	lk.forwardSenderReport(trackID, &rtcp.SenderReport{SSRC: 1, RTPTime: 200}, true)
+	lk.forwardSenderReport(trackID, &rtcp.ReceiverReport{SSRC: 1}, true)
+	lk.forwardSenderReport(trackID, &rtcp.SenderReport{SSRC: 2, RTPTime: 300}, true)
+	assert.Equal(t, []uint32{200}, rec.senderClocks[true])
+
+	// Spliced timestamps don't match the reports anymore
+	lk.trackStats[trackID].SSRCChanges++
+	lk.forwardSenderReport(trackID, &rtcp.SenderReport{SSRC: 1, RTPTime: 400}, true)
+	assert.Equal(t, []uint32{200}, rec.senderClocks[true])
+	assert.Empty(t, rec.senderClocks[false])
+}
+
+// toNTPTime converts a wall clock time to the 64 bit NTP format
+func toNTPTime(t time.Time) uint64 {
+	const ntpEpochOffset = 2208988800 // Seconds between 1900 and 1970
+
+	nanos := uint64(t.UnixNano())
+	secs := nanos/uint64(time.Second) + ntpEpochOffset
+	frac := (nanos % uint64(time.Second)) << 32 / uint64(time.Second)
+
+	return secs<<32 | frac
+}
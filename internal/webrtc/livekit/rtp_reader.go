@@ -0,0 +1,85 @@
+package livekit
+
+import (
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+)
+
+// receiveMTU is the largest packet read, pion's default
+const receiveMTU = 1460
+
+// What packets read are carved out of: their bytes out of slabs of
+// readSlabSize, their structs and header extensions out of ones of
+// readSlabPackets
+const (
+	readSlabSize    = 64 * 1024
+	readSlabPackets = 64
+)
+
+// trackReader is what packets are read from, a webrtc.TrackRemote
+type trackReader interface {
+	Read(b []byte) (int, interceptor.Attributes, error)
+}
+
+// rtpReader reads the packets of a track without allocating for each of
+// them. Packets are read into slabs, each taking only its own size, and a
+// slab is replaced rather than reused once full: a packet read is never
+// overwritten, however long it's kept, but keeps its slab from being freed.
+type rtpReader struct {
+	slab       []byte
+	packets    []rtp.Packet
+	extensions []rtp.Extension
+}
+
+func newRTPReader() *rtpReader {
+	return &rtpReader{}
+}
+
+// read reads the next packet of track, as TrackRemote.ReadRTP does
+func (r *rtpReader) read(track trackReader) (*rtp.Packet, interceptor.Attributes, error) {
+	if cap(r.slab)-len(r.slab) < receiveMTU {
+		r.slab = make([]byte, 0, readSlabSize)
+	}
+
+	if len(r.packets) == cap(r.packets) {
+		r.packets = make([]rtp.Packet, 0, readSlabPackets)
+	}
+
+	if len(r.extensions) == cap(r.extensions) {
+		r.extensions = make([]rtp.Extension, 0, readSlabPackets)
+	}
+
+	start := len(r.slab)
+	n, attributes, err := track.Read(r.slab[start : start+receiveMTU])
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.packets = r.packets[:len(r.packets)+1]
+	packet := &r.packets[len(r.packets)-1]
+	extensions := r.extensions[:cap(r.extensions)]
+	packet.Extensions = r.extensions[len(r.extensions):len(r.extensions)]
+
+	// The payload and header extensions point into what's unmarshalled,
+	// capped so that nothing appended to them runs into the next packet
+	if err := packet.Unmarshal(r.slab[start : start+n : start+n]); err != nil {
+		*packet = rtp.Packet{}
+		r.packets = r.packets[:len(r.packets)-1]
+
+		return nil, nil, err
+	}
+
+	r.slab = r.slab[:start+n]
+
+	// Extensions that didn't fit in what was left of their slab were
+	// appended elsewhere
+	if e := packet.Extensions; len(e) == 0 {
+		packet.Extensions = nil
+	} else if &e[0] == &extensions[len(r.extensions)] {
+		packet.Extensions = e[:len(e):len(e)]
+		r.extensions = extensions[:len(r.extensions)+len(e)]
+	}
+
+	return packet, attributes, nil
+}
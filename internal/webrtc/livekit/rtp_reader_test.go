@@ -0,0 +1,93 @@
+package livekit
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTrackReader hands out the same marshalled packet, its sequence number
+// bumped on every read
+type fakeTrackReader struct {
+	packet     *rtp.Packet
+	attributes interceptor.Attributes
+	reads      int
+	err        error
+}
+
+func (f *fakeTrackReader) Read(b []byte) (int, interceptor.Attributes, error) {
+	if f.err != nil {
+		return 0, nil, f.err
+	}
+
+	f.packet.SequenceNumber = uint16(f.reads)
+	f.reads++
+
+	n, err := f.packet.MarshalTo(b)
+
+	return n, f.attributes, err
+}
+
+func newFakeTrackReader() *fakeTrackReader {
+	packet := &rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 111, Timestamp: 960, SSRC: 1234},
+		Payload: []byte{0xFC, 0xAA, 0xBB},
+	}
+	_ = packet.SetExtension(1, []byte{0x90})
+
+	return &fakeTrackReader{packet: packet, attributes: interceptor.Attributes{}}
+}
+
+func TestRTPReader(t *testing.T) {
+	track := newFakeTrackReader()
+	reader := newRTPReader()
+
+	first, attributes, err := reader.read(track)
+	require.NoError(t, err)
+	assert.NotNil(t, attributes)
+
+	second, _, err := reader.read(track)
+	require.NoError(t, err)
+
+	assert.Equal(t, uint16(0), first.SequenceNumber)
+	assert.Equal(t, uint16(1), second.SequenceNumber)
+	assert.Equal(t, []byte{0xFC, 0xAA, 0xBB}, first.Payload)
+	assert.Equal(t, []byte{0x90}, first.GetExtension(1))
+
+	// Packets read don't share their bytes
+	second.Payload[0] = 0
+	assert.Equal(t, byte(0xFC), first.Payload[0])
+	assert.Less(t, cap(first.Payload), receiveMTU)
+
+	// Nor are they overwritten once their slabs are full
+	for range readSlabSize / 16 {
+		_, _, err := reader.read(track)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, uint16(0), first.SequenceNumber)
+	assert.Equal(t, []byte{0xFC, 0xAA, 0xBB}, first.Payload)
+	assert.Equal(t, []byte{0x90}, first.GetExtension(1))
+
+	track.err = io.EOF
+	_, _, err = reader.read(track)
+	assert.True(t, errors.Is(err, io.EOF))
+}
+
+func BenchmarkRTPReader(b *testing.B) {
+	track := newFakeTrackReader()
+	reader := newRTPReader()
+
+	b.ReportAllocs()
+
+	for b.Loop() {
+		if _, _, err := reader.read(track); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package livekit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// rtxDemuxer turns RFC 4588 retransmissions back into the packets they
+// repair. Those on a negotiated RTX stream are already rewritten by pion,
+// only tagged with attributes; the ones showing up on the media stream with
+// the RTX payload type still carry the original sequence number (OSN) at
+// the start of their payload.
+type rtxDemuxer struct {
+	ssrc        uint32
+	payloadType uint8
+	// 0 if RTX wasn't negotiated for the codec
+	rtxPayloadType uint8
+}
+
+func newRTXDemuxer(params webrtc.RTPParameters, codec webrtc.RTPCodecParameters, ssrc uint32) *rtxDemuxer {
+	d := &rtxDemuxer{ssrc: ssrc, payloadType: uint8(codec.PayloadType)}
+	apt := fmt.Sprintf("apt=%d", codec.PayloadType)
+
+	for _, c := range params.Codecs {
+		if !strings.EqualFold(c.MimeType, webrtc.MimeTypeRTX) {
+			continue
+		}
+
+		for _, param := range strings.Split(c.SDPFmtpLine, ";") {
+			if strings.TrimSpace(param) == apt {
+				d.rtxPayloadType = uint8(c.PayloadType)
+			}
+		}
+	}
+
+	return d
+}
+
+// demux returns the packet as it was originally sent, and whether it was
+// recovered from a retransmission. It returns nil for RTX packets without
+// media, e.g. padding sent to probe bandwidth.
+func (d *rtxDemuxer) demux(packet *rtp.Packet, attributes interceptor.Attributes) (*rtp.Packet, bool) {
+	if attributes != nil && attributes.Get(webrtc.AttributeRtxSequenceNumber) != nil {
+		return packet, true
+	}
+
+	if d.rtxPayloadType == 0 || packet.PayloadType != d.rtxPayloadType {
+		return packet, false
+	}
+
+	if len(packet.Payload) < 2 {
+		return nil, false
+	}
+
+	packet.SequenceNumber = binary.BigEndian.Uint16(packet.Payload)
+	packet.PayloadType = d.payloadType
+	packet.SSRC = d.ssrc
+	packet.Payload = packet.Payload[2:]
+	packet.Padding = false
+	packet.Header.PaddingSize = 0
+	packet.PaddingSize = 0 // Deprecated, but still read by MarshalSize
+
+	return packet, true
+}
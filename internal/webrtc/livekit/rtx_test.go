@@ -0,0 +1,61 @@
+package livekit
+
+import (
+	"testing"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTXDemuxer(t *testing.T) {
+	vp8 := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		PayloadType:        96,
+	}
+	params := webrtc.RTPParameters{Codecs: []webrtc.RTPCodecParameters{
+		vp8,
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeRTX, SDPFmtpLine: "apt=98"}, PayloadType: 99},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeRTX, SDPFmtpLine: "apt=96"}, PayloadType: 97},
+	}}
+	d := newRTXDemuxer(params, vp8, 1234)
+	assert.Equal(t, uint8(97), d.rtxPayloadType)
+
+	media := &rtp.Packet{Header: rtp.Header{PayloadType: 96, SequenceNumber: 10, SSRC: 1234}, Payload: []byte{1, 2}}
+	packet, recovered := d.demux(media, nil)
+	assert.Same(t, media, packet)
+	assert.False(t, recovered)
+
+	// OSN 0x1234 ahead of the payload
+	retransmit := &rtp.Packet{
+		Header:  rtp.Header{PayloadType: 97, SequenceNumber: 500, SSRC: 5678, Timestamp: 3000, Marker: true},
+		Payload: []byte{0x12, 0x34, 0xAA, 0xBB},
+	}
+	packet, recovered = d.demux(retransmit, nil)
+	require.NotNil(t, packet)
+	assert.True(t, recovered)
+	assert.Equal(t, uint16(0x1234), packet.SequenceNumber)
+	assert.Equal(t, uint8(96), packet.PayloadType)
+	assert.Equal(t, uint32(1234), packet.SSRC)
+	assert.Equal(t, uint32(3000), packet.Timestamp)
+	assert.Equal(t, []byte{0xAA, 0xBB}, packet.Payload)
+
+	probe := &rtp.Packet{Header: rtp.Header{PayloadType: 97, Padding: true, PaddingSize: 200}}
+	packet, _ = d.demux(probe, nil)
+	assert.Nil(t, packet, "Padding-only probes are dropped")
+
+	// Already rewritten by pion
+	attributes := interceptor.Attributes{}
+	attributes.Set(webrtc.AttributeRtxSequenceNumber, uint16(500))
+	packet, recovered = d.demux(media, attributes)
+	assert.Same(t, media, packet)
+	assert.True(t, recovered)
+	assert.Equal(t, uint16(10), packet.SequenceNumber)
+
+	noRTX := newRTXDemuxer(webrtc.RTPParameters{}, vp8, 1234)
+	packet, recovered = noRTX.demux(&rtp.Packet{Header: rtp.Header{PayloadType: 97}, Payload: []byte{0, 1, 2}}, nil)
+	assert.NotNil(t, packet)
+	assert.False(t, recovered)
+}
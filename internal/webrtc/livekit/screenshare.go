@@ -0,0 +1,41 @@
+package livekit
+
+import (
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
+	"github.com/livekit/protocol/livekit"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+)
+
+// videoSource returns what the video of a publication shows, "" if unknown
+func videoSource(pub *lksdk.RemoteTrackPublication) string {
+	switch pub.Source() {
+	case livekit.TrackSource_SCREEN_SHARE:
+		return recorder.VideoSourceScreenShare
+	case livekit.TrackSource_CAMERA:
+		return recorder.VideoSourceCamera
+	default:
+		return ""
+	}
+}
+
+// setVideoSource tells the recorder what the video it's about to record
+// shows, so it can handle screen shares (see config.ScreenShare)
+func (w *LiveKitWebRTC) setVideoSource(pub *lksdk.RemoteTrackPublication) {
+	source := videoSource(pub)
+
+	if vs, ok := w.rec.(interface{ SetVideoSource(source string) }); ok && source != "" {
+		vs.SetVideoSource(source)
+	}
+}
+
+// screenShareInterval returns the minimum interval between keyframe
+// requests for an SSRC if it's of a screen share. Locked
+func (w *LiveKitWebRTC) screenShareInterval(ssrc uint32) (time.Duration, bool) {
+	if !w.screenShares[ssrc] || w.cfg.ScreenShare.KeyframeRequestInterval <= 0 {
+		return 0, false
+	}
+
+	return w.cfg.ScreenShare.KeyframeRequestInterval, true
+}
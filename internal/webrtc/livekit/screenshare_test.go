@@ -0,0 +1,29 @@
+package livekit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyframeRequestInterval_ScreenShare(t *testing.T) {
+	lk, _ := setupMockLK()
+	lk.cfg.KeyframeRequestInterval = time.Second
+	lk.cfg.ScreenShare.KeyframeRequestInterval = 3 * time.Second
+	camera, screen := uint32(1), uint32(2)
+	lk.screenShares[camera] = false
+	lk.screenShares[screen] = true
+
+	assert.Equal(t, time.Second, lk.keyframeRequestInterval(camera))
+	assert.Equal(t, 3*time.Second, lk.keyframeRequestInterval(screen))
+
+	now := time.Now()
+	assert.True(t, lk.allowPLI(screen, now))
+	assert.False(t, lk.allowPLI(screen, now.Add(2*time.Second)), "Within the screen share interval")
+	assert.True(t, lk.allowPLI(camera, now))
+	assert.True(t, lk.allowPLI(camera, now.Add(2*time.Second)))
+
+	lk.cfg.ScreenShare.KeyframeRequestInterval = 0
+	assert.Equal(t, time.Second, lk.keyframeRequestInterval(screen), "Falls back to the camera interval")
+}
@@ -0,0 +1,208 @@
+package livekit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
+	"github.com/pion/rtp"
+)
+
+// Tracks of the self-test stream
+const (
+	selfTestVideoTrack = "selftest-video"
+	selfTestAudioTrack = "selftest-audio"
+	selfTestVideoPT    = 96
+	selfTestAudioPT    = 111
+	selfTestFPS        = 15
+	// Opus frames are 20ms
+	selfTestAudioStep = 20 * time.Millisecond
+)
+
+// selfTestKeyframe is a 16x16 VP8 keyframe, a single gray macroblock
+var selfTestKeyframe = []byte{
+	0x30, 0x01, 0x00, 0x9d, 0x01, 0x2a, 0x10, 0x00, 0x10, 0x00, 0x0e,
+	0xc0, 0xfe, 0x25, 0xa4, 0x00, 0x03, 0x70, 0x00, 0x00, 0x00, 0x00,
+}
+
+// selfTestSilence is a 20ms Opus frame decoding to silence (CELT, full band,
+// mono)
+var selfTestSilence = []byte{0xF8, 0xFF, 0xFE}
+
+// SelfTestResult is what a self-test produced
+type SelfTestResult struct {
+	Replay *ReplayResult          `json:"replay"`
+	File   *recorder.Verification `json:"file,omitempty"`
+}
+
+// SelfTestStream returns a synthetic VP8+Opus stream lasting duration, and
+// its tracks: a keyframe every video frame, at 15 fps, and a silent frame
+// every 20ms of audio, as publishers would packetize them
+func SelfTestStream(duration time.Duration) ([]ReplayTrack, []ReplayPacket) {
+	tracks := []ReplayTrack{
+		{ID: selfTestVideoTrack, MimeType: string(MimeTypeVP8), PayloadType: selfTestVideoPT},
+		{ID: selfTestAudioTrack, MimeType: string(MimeTypeOpus), PayloadType: selfTestAudioPT},
+	}
+
+	var packets []ReplayPacket
+	var videoSeq, audioSeq uint16
+
+	for {
+		video := time.Duration(videoSeq) * time.Second / selfTestFPS
+		audio := time.Duration(audioSeq) * selfTestAudioStep
+
+		if video >= duration && audio >= duration {
+			break
+		}
+
+		if video <= audio && video < duration {
+			packets = append(packets, ReplayPacket{Offset: video, Packet: &rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					Marker:         true,
+					PayloadType:    selfTestVideoPT,
+					SequenceNumber: videoSeq,
+					Timestamp:      uint32(video * 90000 / time.Second),
+					SSRC:           1,
+				},
+				// VP8 payload descriptor: start of partition 0
+				Payload: append([]byte{0x10}, selfTestKeyframe...),
+			}})
+			videoSeq++
+
+			continue
+		}
+
+		packets = append(packets, ReplayPacket{Offset: audio, Packet: &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    selfTestAudioPT,
+				SequenceNumber: audioSeq,
+				Timestamp:      uint32(audio * 48000 / time.Second),
+				SSRC:           2,
+			},
+			Payload: selfTestSilence,
+		}})
+		audioSeq++
+	}
+
+	return tracks, packets
+}
+
+// SelfTest records a synthetic stream lasting duration (see
+// SelfTestStream) to rec, a WebM/MKV recorder whose file VerifyWebM can
+// check (see recorder.VerifiableConfig), through an adapter set up with
+// cfg as Replay does. It fails if the recording did, its stats don't
+// account for the stream or the file isn't valid. The result is returned
+// either way, as far as it got.
+func SelfTest(ctx context.Context, cfg config.LiveKit, rec recorder.Recorder, duration time.Duration) (*SelfTestResult, error) {
+	if _, ok := ctx.Value("session").(string); !ok {
+		ctx = context.WithValue(ctx, "session", "selftest")
+	}
+
+	tracks, packets := SelfTestStream(duration)
+	replay, err := Replay(ctx, cfg, rec, tracks, packets)
+	result := &SelfTestResult{Replay: replay}
+
+	if err != nil {
+		return result, fmt.Errorf("recording failed: %w", err)
+	}
+
+	if err := checkSelfTestStats(replay, packets, duration); err != nil {
+		return result, fmt.Errorf("unexpected stats: %w", err)
+	}
+
+	result.File, err = recorder.VerifyWebM(rec.GetFilePath())
+
+	if err != nil {
+		return result, fmt.Errorf("invalid recording %s: %w", rec.GetFilePath(), err)
+	}
+
+	if err := checkSelfTestFile(result.File, duration); err != nil {
+		return result, fmt.Errorf("unexpected recording %s: %w", rec.GetFilePath(), err)
+	}
+
+	return result, nil
+}
+
+// checkSelfTestStats checks that the stats of a self-test account for
+// packets, the stream it recorded. The jitter buffer may hold back the
+// last frames as the adapter closes, so a tenth of them may be missing.
+func checkSelfTestStats(result *ReplayResult, packets []ReplayPacket, duration time.Duration) error {
+	sent := make(map[uint8]int, 2)
+
+	for _, p := range packets {
+		sent[p.Packet.PayloadType]++
+	}
+
+	for id, pt := range map[string]uint8{selfTestVideoTrack: selfTestVideoPT, selfTestAudioTrack: selfTestAudioPT} {
+		stats, ok := result.Tracks[id]
+
+		if !ok {
+			return fmt.Errorf("no stats for track %s", id)
+		}
+
+		if stats.SeqNumPackets < uint64(sent[pt]*9/10) {
+			return fmt.Errorf("track %s: %d of %d packets went through", id, stats.SeqNumPackets, sent[pt])
+		}
+
+		if stats.LossFraction != 0 {
+			return fmt.Errorf("track %s: loss of %.3f, expected none", id, stats.LossFraction)
+		}
+	}
+
+	if result.Recorder == nil || result.Recorder.Video == nil || result.Recorder.Audio == nil {
+		return errors.New("no recorder stats for audio and video")
+	}
+
+	video, audio := result.Recorder.Video, result.Recorder.Audio
+
+	if video.WrittenSamples < sent[selfTestVideoPT]*9/10 {
+		return fmt.Errorf("%d of %d video frames written", video.WrittenSamples, sent[selfTestVideoPT])
+	}
+
+	if video.KeyframeCount == 0 {
+		return errors.New("no video keyframes counted")
+	}
+
+	if video.CorruptedFrames > 0 {
+		return fmt.Errorf("%d corrupted video frames", video.CorruptedFrames)
+	}
+
+	if audio.WrittenSamples < sent[selfTestAudioPT]*9/10 {
+		return fmt.Errorf("%d of %d audio frames written", audio.WrittenSamples, sent[selfTestAudioPT])
+	}
+
+	if result.Duration < duration/2 || result.Duration > duration*3/2 {
+		return fmt.Errorf("recorded %s of %s", result.Duration, duration)
+	}
+
+	return nil
+}
+
+// checkSelfTestFile checks that a self-test's file holds the stream it
+// recorded, lasting duration
+func checkSelfTestFile(v *recorder.Verification, duration time.Duration) error {
+	video, audio := v.Track("video"), v.Track("audio")
+
+	if video == nil || video.CodecID != "V_VP8" {
+		return errors.New("no VP8 video track")
+	}
+
+	if video.Width != 16 || video.Height != 16 {
+		return fmt.Errorf("video of %dx%d, expected 16x16", video.Width, video.Height)
+	}
+
+	if audio == nil || audio.CodecID != "A_OPUS" {
+		return errors.New("no Opus audio track")
+	}
+
+	if v.Duration < duration/2 || v.Duration > duration*3/2 {
+		return fmt.Errorf("duration of %s, expected %s", v.Duration, duration)
+	}
+
+	return nil
+}
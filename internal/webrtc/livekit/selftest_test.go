@@ -0,0 +1,41 @@
+package livekit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfTestStream(t *testing.T) {
+	tracks, packets := SelfTestStream(time.Second)
+	require.Len(t, tracks, 2)
+	// 15 video frames, 50 audio ones
+	require.Len(t, packets, 65)
+
+	for i := 1; i < len(packets); i++ {
+		assert.GreaterOrEqual(t, packets[i].Offset, packets[i-1].Offset, "Packets are sorted by offset")
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.SetDefaults()
+	recCfg := recorder.VerifiableConfig(cfg.Recorder)
+	recCfg.Directory = t.TempDir()
+	ctx := context.Background()
+
+	rec, err := recorder.NewRecorder(ctx, recCfg, "selftest.webm")
+	require.NoError(t, err)
+
+	result, err := SelfTest(ctx, cfg.LiveKit, rec, 3*time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, result.File)
+	assert.Equal(t, "V_VP8", result.File.Track("video").CodecID)
+	assert.Equal(t, "A_OPUS", result.File.Track("audio").CodecID)
+	assert.Positive(t, result.File.Track("video").Keyframes)
+}
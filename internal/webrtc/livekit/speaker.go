@@ -0,0 +1,175 @@
+package livekit
+
+import (
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/rtp"
+)
+
+// speakerSwitcher picks which video track is written when following the
+// dominant speaker (see config.FollowSpeaker), and rewrites its packets so
+// the recorder sees a single continuous stream across switches
+type speakerSwitcher struct {
+	minInterval time.Duration
+	// active is the track written, empty until one sends a keyframe. next
+	// is switched to on its next keyframe.
+	active     string
+	next       string
+	switchedAt time.Time
+	timeline   []appstats.SpeakerSwitch
+
+	// Last packet written, as rewritten
+	written  bool
+	lastSeq  uint16
+	lastTs   uint32
+	lastAt   time.Time
+	seqDelta uint16
+	tsDelta  uint32
+}
+
+func newSpeakerSwitcher(minInterval time.Duration) *speakerSwitcher {
+	return &speakerSwitcher{minInterval: minInterval}
+}
+
+// follow makes trackID the next track to switch to. Returns false if it's
+// already written, or if the last switch is too recent.
+func (s *speakerSwitcher) follow(trackID string, now time.Time) bool {
+	if trackID == s.active {
+		s.next = ""
+		return false
+	}
+
+	if s.active != "" && now.Sub(s.switchedAt) < s.minInterval {
+		return false
+	}
+
+	s.next = trackID
+
+	return true
+}
+
+// switchTo starts writing trackID from first, the start of a keyframe. Its
+// timestamps carry on from the last packet written, as if it had been sent
+// by the same source all along.
+func (s *speakerSwitcher) switchTo(trackID string, first *rtp.Packet, clockRate uint32, now time.Time) {
+	if s.written {
+		ticks := uint32(now.Sub(s.lastAt).Seconds() * float64(clockRate))
+		s.seqDelta = s.lastSeq + 1 - first.SequenceNumber
+		s.tsDelta = s.lastTs + max(ticks, 1) - first.Timestamp
+	}
+
+	s.active = trackID
+	s.next = ""
+	s.switchedAt = now
+}
+
+// rewrite returns packets as written: with sequence numbers and timestamps
+// continuing those of the tracks written before
+func (s *speakerSwitcher) rewrite(packets []*rtp.Packet, now time.Time) []*rtp.Packet {
+	rewritten := make([]*rtp.Packet, 0, len(packets))
+
+	for _, p := range packets {
+		out := *p
+		out.SequenceNumber += s.seqDelta
+		out.Timestamp += s.tsDelta
+		rewritten = append(rewritten, &out)
+		s.lastSeq = out.SequenceNumber
+		s.lastTs = out.Timestamp
+	}
+
+	s.written = true
+	s.lastAt = now
+
+	return rewritten
+}
+
+// speakerSample returns the packets of a video sample to write when
+// following the dominant speaker, none if trackID isn't the track written
+func (w *LiveKitWebRTC) speakerSample(trackID string, packets []*rtp.Packet, keyframe bool, clockRate uint32) []*rtp.Packet {
+	now := w.clock.Now()
+	offset := w.rec.VideoTimestamp()
+
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	s := w.speaker
+
+	if trackID != s.active {
+		// The first track to send a keyframe is written until a speaker is
+		// known
+		if !keyframe || (trackID != s.next && s.active != "") {
+			return nil
+		}
+
+		s.switchTo(trackID, packets[0], clockRate, now)
+		s.timeline = append(s.timeline, appstats.SpeakerSwitch{
+			Time:          now.UnixMilli(),
+			OffsetMs:      offset.Milliseconds(),
+			TrackID:       trackID,
+			ParticipantID: w.participantIDs[trackID],
+		})
+
+		w.logger.WithField("trackID", trackID).
+			WithField("participant", w.participantIDs[trackID]).
+			Info("Switched recorded video to the dominant speaker")
+	}
+
+	return s.rewrite(packets, now)
+}
+
+// onActiveSpeakersChanged switches the recording to the video of the
+// dominant speaker, asking it for a keyframe to switch on
+func (w *LiveKitWebRTC) onActiveSpeakersChanged(speakers []lksdk.Participant) {
+	if w.speaker == nil || len(speakers) == 0 {
+		return
+	}
+
+	identity := speakers[0].Identity()
+
+	w.m.Lock()
+	trackID, ssrc := w.speakerVideoTrack(identity)
+
+	if trackID == "" || !w.speaker.follow(trackID, w.clock.Now()) {
+		w.m.Unlock()
+		return
+	}
+
+	w.m.Unlock()
+
+	w.logger.WithField("trackID", trackID).
+		WithField("participant", identity).
+		Debug("Dominant speaker changed, switching on its next keyframe")
+
+	w.queueKeyframeRequest(ssrc, "speaker_switch")
+}
+
+// speakerVideoTrack returns the requested video track being read that
+// identity publishes, if any
+// Locked
+func (w *LiveKitWebRTC) speakerVideoTrack(identity string) (string, uint32) {
+	for _, trackID := range w.trackIds {
+		pub := w.remoteTrackPubs[trackID]
+		track := w.readingTracks[trackID]
+
+		if pub != nil && track != nil && pub.Kind() == lksdk.TrackKindVideo && w.participantIDs[trackID] == identity {
+			return trackID, uint32(track.SSRC())
+		}
+	}
+
+	return "", 0
+}
+
+// speakerWritten returns whether the video of an SSRC is, or is about to be,
+// written when following the dominant speaker
+// Locked
+func (w *LiveKitWebRTC) speakerWritten(ssrc uint32) bool {
+	for trackID, track := range w.readingTracks {
+		if track != nil && uint32(track.SSRC()) == ssrc {
+			return w.speaker.active == "" || trackID == w.speaker.active || trackID == w.speaker.next
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,72 @@
+package livekit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func speakerPacket(seq uint16, ts uint32) []*rtp.Packet {
+	return []*rtp.Packet{{Header: rtp.Header{SequenceNumber: seq, Timestamp: ts}}}
+}
+
+func TestSpeakerSample(t *testing.T) {
+	lk, rec := setupMockLK()
+	clk := clock.NewMock(time.UnixMilli(10000))
+	lk.WithClock(clk)
+	lk.speaker = newSpeakerSwitcher(time.Second)
+	lk.participantIDs["cam-a"] = "alice"
+	lk.participantIDs["cam-b"] = "bob"
+
+	assert.Nil(t, lk.speakerSample("cam-a", speakerPacket(100, 1000), false, 90000), "Waits for a keyframe")
+
+	out := lk.speakerSample("cam-a", speakerPacket(101, 4000), true, 90000)
+	require.Len(t, out, 1)
+	assert.Equal(t, uint16(101), out[0].SequenceNumber, "The first track is written as is")
+	assert.Equal(t, uint32(4000), out[0].Timestamp)
+
+	assert.Nil(t, lk.speakerSample("cam-b", speakerPacket(5000, 777000), true, 90000), "Not the speaker")
+
+	clk.Add(500 * time.Millisecond)
+	assert.False(t, lk.speaker.follow("cam-b", clk.Now()), "Too soon after the last switch")
+	clk.Add(500 * time.Millisecond)
+	require.True(t, lk.speaker.follow("cam-b", clk.Now()))
+
+	assert.Nil(t, lk.speakerSample("cam-b", speakerPacket(5001, 780000), false, 90000), "Switches on a keyframe")
+	out = lk.speakerSample("cam-a", speakerPacket(102, 7000), false, 90000)
+	require.Len(t, out, 1, "Until then the previous speaker is written")
+
+	clk.Add(100 * time.Millisecond)
+	rec.videoTs = 1100 * time.Millisecond
+	input := speakerPacket(5002, 783000)
+	out = lk.speakerSample("cam-b", input, true, 90000)
+	require.Len(t, out, 1)
+	assert.Equal(t, uint16(103), out[0].SequenceNumber, "Sequence numbers carry on")
+	assert.Equal(t, uint32(7000+9000), out[0].Timestamp, "Timestamps carry on at the time elapsed")
+	assert.Equal(t, uint16(5002), input[0].SequenceNumber, "Packets read aren't changed")
+
+	out = lk.speakerSample("cam-b", speakerPacket(5003, 786000), false, 90000)
+	assert.Equal(t, uint16(104), out[0].SequenceNumber)
+	assert.Equal(t, uint32(7000+9000+3000), out[0].Timestamp)
+	assert.Nil(t, lk.speakerSample("cam-a", speakerPacket(103, 10000), true, 90000))
+
+	assert.Equal(t, []appstats.SpeakerSwitch{
+		{Time: 10000, OffsetMs: 0, TrackID: "cam-a", ParticipantID: "alice"},
+		{Time: 11100, OffsetMs: 1100, TrackID: "cam-b", ParticipantID: "bob"},
+	}, lk.GetStats().SpeakerSwitches)
+}
+
+func TestSpeakerSwitcher_FollowActive(t *testing.T) {
+	s := newSpeakerSwitcher(0)
+	now := time.UnixMilli(0)
+	s.switchTo("cam-a", &rtp.Packet{}, 90000, now)
+
+	assert.True(t, s.follow("cam-b", now))
+	assert.False(t, s.follow("cam-a", now), "Back to the speaker written")
+	assert.Empty(t, s.next, "The pending switch is called off")
+}
@@ -0,0 +1,148 @@
+package livekit
+
+import (
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/pion/rtp"
+)
+
+// A subscription normally carries a single SSRC, but a publisher restarting
+// its encoder or the SFU switching streams can change it mid-track. A new
+// SSRC starts its own sequence numbers and timestamps: the track's packets
+// are spliced onto a single timeline instead, the new SSRC's first packet
+// following the last one of the previous SSRC, its timestamp advanced by
+// the time elapsed in between. A sequence number is left out at the seam
+// and the recorder told it was skipped, so it drops the frame in progress;
+// a keyframe of the new SSRC is requested.
+
+const (
+	// Packets of the previous SSRC arriving that long after the track
+	// switched from it are a switch back, not stragglers
+	ssrcSwitchGrace = jitterLatency
+	// maxTrackSSRCs bounds the SSRCs kept in a track's stats
+	maxTrackSSRCs = 16
+)
+
+// ssrcSplicer keeps a track's packets on a single timeline across SSRCs
+type ssrcSplicer struct {
+	clockRate uint32
+	started   bool
+	ssrc      uint32
+	// Added to the current SSRC's sequence numbers and timestamps
+	seqOffset uint16
+	tsOffset  uint32
+	// The last packet, as spliced
+	lastSeq     uint16
+	lastTs      uint32
+	lastArrival time.Time
+	// The SSRC switched from, and when
+	previous   uint32
+	switchedAt time.Time
+}
+
+func newSSRCSplicer(clockRate uint32) *ssrcSplicer {
+	return &ssrcSplicer{clockRate: clockRate}
+}
+
+// splice rewrites packet onto the track's timeline. Returns whether the
+// track switched to its SSRC, and whether it's kept: late packets of the
+// SSRC just switched from aren't.
+func (s *ssrcSplicer) splice(packet *rtp.Packet, now time.Time) (switched, keep bool) {
+	if !s.started {
+		s.started = true
+		s.ssrc = packet.SSRC
+		s.lastSeq, s.lastTs, s.lastArrival = packet.SequenceNumber, packet.Timestamp, now
+
+		return false, true
+	}
+
+	if packet.SSRC != s.ssrc {
+		if packet.SSRC == s.previous && now.Sub(s.switchedAt) < ssrcSwitchGrace {
+			return false, false
+		}
+
+		elapsed := max(now.Sub(s.lastArrival), 0)
+		s.previous, s.switchedAt = s.ssrc, now
+		s.ssrc = packet.SSRC
+		s.seqOffset = s.lastSeq + 2 - packet.SequenceNumber
+		s.tsOffset = s.lastTs + max(uint32(elapsed*time.Duration(s.clockRate)/time.Second), 1) - packet.Timestamp
+		switched = true
+	}
+
+	packet.SequenceNumber += s.seqOffset
+	packet.Timestamp += s.tsOffset
+
+	// Reordered packets don't move the timeline back
+	if seqDelta := packet.SequenceNumber - s.lastSeq; switched || (seqDelta != 0 && seqDelta < 1<<15) {
+		s.lastSeq, s.lastTs, s.lastArrival = packet.SequenceNumber, packet.Timestamp, now
+	}
+
+	return switched, true
+}
+
+// processSSRCStats accounts a packet of ssrc, numbered seq as received, to
+// the track's stats of that SSRC
+func (w *LiveKitWebRTC) processSSRCStats(trackID string, ssrc uint32, seq uint16, dropped bool) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	stats, ok := w.trackStats[trackID]
+
+	if !ok {
+		return
+	}
+
+	now := w.clock.Now().UnixMilli()
+	var ssrcStats *appstats.SSRCStats
+
+	for i := range stats.SSRCs {
+		if stats.SSRCs[i].SSRC == ssrc {
+			ssrcStats = &stats.SSRCs[i]
+			break
+		}
+	}
+
+	if ssrcStats == nil {
+		if len(stats.SSRCs) == maxTrackSSRCs {
+			stats.SSRCs = stats.SSRCs[1:]
+		}
+
+		stats.SSRCs = append(stats.SSRCs, appstats.SSRCStats{
+			SSRC:        ssrc,
+			FirstSeqNum: seq,
+			FirstSeen:   now,
+		})
+		ssrcStats = &stats.SSRCs[len(stats.SSRCs)-1]
+	}
+
+	if dropped {
+		ssrcStats.StalePackets++
+		return
+	}
+
+	ssrcStats.Packets++
+	ssrcStats.LastSeqNum = seq
+	ssrcStats.LastSeen = now
+}
+
+// onSSRCChange handles a track switching to the SSRC of packet, as spliced
+func (w *LiveKitWebRTC) onSSRCChange(trackID string, packet *rtp.Packet, previous uint32, isVideo bool) {
+	w.m.Lock()
+
+	if stats, ok := w.trackStats[trackID]; ok {
+		stats.SSRCChanges++
+	}
+
+	w.m.Unlock()
+
+	w.logger.WithField("trackID", trackID).
+		Infof("Track SSRC changed from %d to %d, spliced at seq=%d", previous, packet.SSRC, packet.SequenceNumber)
+
+	// The frame in progress won't be completed by the new SSRC
+	w.rec.NotifySkippedPacket(packet.SequenceNumber - 1)
+
+	if isVideo {
+		w.queueKeyframeRequest(packet.SSRC, "ssrc_change")
+	}
+}
@@ -0,0 +1,109 @@
+package livekit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSRCSplicer(t *testing.T) {
+	s := newSSRCSplicer(48000)
+	now := time.Unix(0, 0)
+	packet := func(ssrc uint32, seq uint16, ts uint32) *rtp.Packet {
+		return &rtp.Packet{Header: rtp.Header{SSRC: ssrc, SequenceNumber: seq, Timestamp: ts}}
+	}
+
+	for i := 0; i < 10; i++ {
+		p := packet(1, uint16(65530+i), uint32(i*960))
+		switched, keep := s.splice(p, now)
+		assert.False(t, switched)
+		assert.True(t, keep)
+		assert.Equal(t, uint16(65530+i), p.SequenceNumber, "The first SSRC is left as is")
+		now = now.Add(20 * time.Millisecond)
+	}
+
+	// 100ms later, the new SSRC follows with one sequence number left out
+	now = now.Add(80 * time.Millisecond)
+	p := packet(2, 1000, 500000)
+	switched, keep := s.splice(p, now)
+	assert.True(t, switched)
+	assert.True(t, keep)
+	assert.Equal(t, uint16(5), p.SequenceNumber)
+	assert.Equal(t, uint32(9*960+4800), p.Timestamp)
+
+	// Stragglers of the previous SSRC are dropped, untouched
+	p = packet(1, 4, 9*960)
+	switched, keep = s.splice(p, now.Add(10*time.Millisecond))
+	assert.False(t, switched)
+	assert.False(t, keep)
+
+	// Reordered packets of the new SSRC keep its offsets
+	next, late := packet(2, 1002, 500960), packet(2, 1001, 500960)
+	s.splice(next, now.Add(20*time.Millisecond))
+	s.splice(late, now.Add(20*time.Millisecond))
+	assert.Equal(t, uint16(7), next.SequenceNumber)
+	assert.Equal(t, uint16(6), late.SequenceNumber)
+
+	// Past the grace period, the previous SSRC is a switch back
+	now = now.Add(ssrcSwitchGrace + 20*time.Millisecond)
+	p = packet(1, 5, 10*960)
+	switched, keep = s.splice(p, now)
+	assert.True(t, switched)
+	assert.True(t, keep)
+	assert.Equal(t, uint16(9), p.SequenceNumber)
+}
+
+func TestReplay_SSRCChange(t *testing.T) {
+	rec := &mockRecorder{
+		videoStats: &types.RecorderTrackStats{},
+		audioStats: &types.RecorderTrackStats{},
+	}
+	tracks := []ReplayTrack{{ID: "audio", MimeType: "audio/opus", PayloadType: 111}}
+
+	var packets []ReplayPacket
+
+	add := func(ssrc uint32, seq uint16, ts uint32) {
+		packets = append(packets, ReplayPacket{
+			Offset: time.Duration(len(packets)) * 20 * time.Millisecond,
+			Packet: &rtp.Packet{
+				Header:  rtp.Header{PayloadType: 111, SSRC: ssrc, SequenceNumber: seq, Timestamp: ts},
+				Payload: []byte{0xFC, 0xAA},
+			},
+		})
+	}
+
+	// The publisher restarted its encoder: a straggler of the first SSRC
+	// follows the switch
+	for i := 0; i < 50; i++ {
+		add(1111, uint16(100+i), uint32(i*960))
+	}
+
+	add(2222, 7000, 3000000)
+	add(1111, 150, 50*960)
+
+	for i := 1; i < 50; i++ {
+		add(2222, uint16(7000+i), uint32(3000000+i*960))
+	}
+
+	result, err := Replay(context.Background(), config.LiveKit{}, rec, tracks, packets)
+	require.NoError(t, err)
+
+	stats := result.Tracks["audio"]
+	assert.Equal(t, 1, stats.SSRCChanges)
+	require.Len(t, stats.SSRCs, 2)
+	assert.Equal(t, uint32(1111), stats.SSRCs[0].SSRC)
+	assert.Equal(t, uint64(50), stats.SSRCs[0].Packets)
+	assert.Equal(t, uint64(1), stats.SSRCs[0].StalePackets)
+	assert.Equal(t, uint16(149), stats.SSRCs[0].LastSeqNum)
+	assert.Equal(t, uint32(2222), stats.SSRCs[1].SSRC)
+	assert.Equal(t, uint64(50), stats.SSRCs[1].Packets)
+	assert.Equal(t, uint16(7000), stats.SSRCs[1].FirstSeqNum, "SSRC stats are as received")
+	assert.Equal(t, uint16(7049), stats.SSRCs[1].LastSeqNum)
+	assert.Equal(t, []uint16{150}, rec.skipped, "The seam is signaled as skipped")
+}
@@ -0,0 +1,168 @@
+package livekit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+)
+
+// Live monitoring gets the stats as periodic snapshots rather than polling
+// GetStats: one snapshot is taken per interval, however many subscribers
+// there are, and handed to each of them. Subscribers that don't keep up miss
+// snapshots instead of holding the capture back.
+
+// StatsSnapshot is the stats of a capture at a point in time. Snapshots are
+// copies, shared by all subscribers: they must not be modified.
+type StatsSnapshot struct {
+	Time     time.Time
+	Recorder *types.RecorderStats
+	// Adapter stats, by track ID
+	Tracks map[string]appstats.AdapterTrackStats
+}
+
+// statsStream fans the snapshots out to the subscribers
+type statsStream struct {
+	m           sync.Mutex
+	subscribers map[chan *StatsSnapshot]struct{}
+	timer       clock.Timer // Next snapshot, set while there are subscribers
+	closed      bool
+}
+
+// SubscribeStats returns a channel getting a stats snapshot every
+// config.LiveKit.StatsInterval, and a function to unsubscribe. The channel
+// is closed on unsubscribing or when the capture is closed.
+func (w *LiveKitWebRTC) SubscribeStats() (<-chan *StatsSnapshot, func()) {
+	s := &w.statsStream
+	// The latest snapshot only: older ones are stale anyway
+	ch := make(chan *StatsSnapshot, 1)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	if s.subscribers == nil {
+		s.subscribers = make(map[chan *StatsSnapshot]struct{})
+	}
+
+	s.subscribers[ch] = struct{}{}
+
+	if s.timer == nil {
+		w.scheduleStatsSnapshot()
+	}
+
+	return ch, func() { w.unsubscribeStats(ch) }
+}
+
+func (w *LiveKitWebRTC) unsubscribeStats(ch chan *StatsSnapshot) {
+	s := &w.statsStream
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, ok := s.subscribers[ch]; !ok {
+		return
+	}
+
+	delete(s.subscribers, ch)
+	close(ch)
+
+	if len(s.subscribers) == 0 && s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
+
+// scheduleStatsSnapshot arms the next snapshot
+//
+// Locked (statsStream)
+func (w *LiveKitWebRTC) scheduleStatsSnapshot() {
+	w.m.Lock()
+	c := w.clock
+	w.m.Unlock()
+
+	interval := w.cfg.StatsInterval
+
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	w.statsStream.timer = c.AfterFunc(interval, w.publishStatsSnapshot)
+}
+
+func (w *LiveKitWebRTC) publishStatsSnapshot() {
+	s := &w.statsStream
+
+	s.m.Lock()
+	subscribed := len(s.subscribers) > 0 && !s.closed
+	s.m.Unlock()
+
+	if !subscribed {
+		return
+	}
+
+	// Taken unlocked, the recorder has locks of its own
+	snapshot := w.statsSnapshot()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	// Unsubscribed from, or closed, meanwhile
+	if len(s.subscribers) == 0 || s.closed {
+		return
+	}
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- snapshot:
+		default:
+		}
+	}
+
+	w.scheduleStatsSnapshot()
+}
+
+func (w *LiveKitWebRTC) statsSnapshot() *StatsSnapshot {
+	w.m.Lock()
+	snapshot := &StatsSnapshot{
+		Time:   w.clock.Now(),
+		Tracks: w.cloneTrackStats(),
+	}
+	rec := w.rec
+	w.m.Unlock()
+
+	if rec != nil {
+		snapshot.Recorder = rec.GetStats()
+	} else {
+		snapshot.Recorder = &types.RecorderStats{}
+	}
+
+	return snapshot
+}
+
+// closeStatsStream stops the snapshots and closes the subscribers' channels
+func (w *LiveKitWebRTC) closeStatsStream() {
+	s := &w.statsStream
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.closed = true
+
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+
+	for ch := range s.subscribers {
+		close(ch)
+	}
+
+	s.subscribers = nil
+}
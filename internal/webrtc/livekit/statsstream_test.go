@@ -0,0 +1,74 @@
+package livekit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribeStats(t *testing.T) {
+	lk, _ := setupMockLK()
+	clk := clock.NewMock(time.Unix(1000, 0))
+	lk.WithClock(clk)
+	lk.cfg.StatsInterval = 500 * time.Millisecond
+
+	first, unsubscribeFirst := lk.SubscribeStats()
+	second, _ := lk.SubscribeStats()
+	assert.Equal(t, 1, clk.Timers(), "One snapshot for all subscribers")
+
+	lk.trackStats["test-track"].SeqNumPackets = 10
+	clk.Add(500 * time.Millisecond)
+
+	a, b := <-first, <-second
+	require.NotNil(t, a)
+	assert.Same(t, a, b)
+	assert.Equal(t, clk.Now(), a.Time)
+	assert.Equal(t, uint64(10), a.Tracks["test-track"].SeqNumPackets)
+	require.NotNil(t, a.Recorder)
+
+	// Snapshots are copies
+	lk.trackStats["test-track"].SeqNumPackets = 20
+	assert.Equal(t, uint64(10), a.Tracks["test-track"].SeqNumPackets)
+
+	// Slow subscribers miss snapshots, and get the next ones
+	clk.Add(500 * time.Millisecond)
+	clk.Add(500 * time.Millisecond)
+	assert.Equal(t, uint64(20), (<-first).Tracks["test-track"].SeqNumPackets)
+	<-second
+
+	unsubscribeFirst()
+	_, ok := <-first
+	assert.False(t, ok, "Closed on unsubscribing")
+	unsubscribeFirst()
+
+	clk.Add(500 * time.Millisecond)
+	assert.NotNil(t, <-second)
+
+	lk.Close()
+	_, ok = <-second
+	assert.False(t, ok, "Closed on Close")
+	assert.Zero(t, clk.Timers())
+
+	late, _ := lk.SubscribeStats()
+	_, ok = <-late
+	assert.False(t, ok, "Closed once closed")
+}
+
+func TestSubscribeStats_LastUnsubscribe(t *testing.T) {
+	lk, _ := setupMockLK()
+	clk := clock.NewMock(time.Unix(1000, 0))
+	lk.WithClock(clk)
+	defer lk.Close()
+
+	_, unsubscribe := lk.SubscribeStats()
+	assert.Equal(t, 1, clk.Timers())
+	unsubscribe()
+	assert.Zero(t, clk.Timers(), "No snapshots without subscribers")
+
+	ch, _ := lk.SubscribeStats()
+	clk.Add(time.Second)
+	assert.NotNil(t, <-ch)
+}
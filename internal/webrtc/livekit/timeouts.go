@@ -0,0 +1,190 @@
+package livekit
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/interfaces"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/utils"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+)
+
+// The timeouts of config.Timeouts each end the capture with a reason of its
+// own, so the caller can tell a room it couldn't reach (worth retrying)
+// from a track that never came through. Joining the room is bounded from
+// Init; the track timeouts are timers armed as each track progresses,
+// disarmed as it does, and all stopped on Close.
+
+var (
+	errConnectTimeout    = errors.New("timed out connecting to room")
+	errSubscribeTimeout  = errors.New("track not subscribed")
+	errFirstMediaTimeout = errors.New("no media received from track")
+)
+
+// trackTimeouts are the pending timeouts of the requested tracks, by track
+// ID. Guarded by the adapter's lock.
+type trackTimeouts struct {
+	subscribe  map[string]clock.Timer
+	firstMedia map[string]clock.Timer
+	stopped    bool
+}
+
+func newTrackTimeouts() trackTimeouts {
+	return trackTimeouts{
+		subscribe:  make(map[string]clock.Timer),
+		firstMedia: make(map[string]clock.Timer),
+	}
+}
+
+// dialRoomWithin is dialRoom giving up at deadline, if set. A room joined
+// past it is left right away.
+func (w *LiveKitWebRTC) dialRoomWithin(host roomHost, token string, deadline time.Time) (*lksdk.Room, error) {
+	if deadline.IsZero() {
+		return w.dialRoom(host, token)
+	}
+
+	remaining := deadline.Sub(w.clock.Now())
+
+	if remaining <= 0 {
+		return nil, fmt.Errorf("%w within %s", errConnectTimeout, w.cfg.Timeouts.Connect)
+	}
+
+	type dialResult struct {
+		room *lksdk.Room
+		err  error
+	}
+
+	done := make(chan dialResult, 1)
+
+	go func() {
+		room, err := w.dialRoom(host, token)
+		done <- dialResult{room, err}
+	}()
+
+	timer := w.clock.NewTimer(remaining)
+	defer timer.Stop()
+
+	select {
+	case result := <-done:
+		return result.room, result.err
+	case <-timer.C():
+		go func() {
+			if result := <-done; result.room != nil {
+				result.room.Disconnect()
+			}
+		}()
+
+		return nil, fmt.Errorf("%w within %s", errConnectTimeout, w.cfg.Timeouts.Connect)
+	}
+}
+
+// armTimeout calls fire for trackID once d elapses, unless disarmed first
+//
+// Locked
+func (w *LiveKitWebRTC) armTimeout(timers map[string]clock.Timer, trackID string, d time.Duration, fire func()) {
+	if d <= 0 || w.timeouts.stopped {
+		return
+	}
+
+	if timer, ok := timers[trackID]; ok {
+		timer.Stop()
+	}
+
+	timers[trackID] = w.clock.AfterFunc(d, fire)
+}
+
+// Locked
+func (w *LiveKitWebRTC) disarmTimeout(timers map[string]clock.Timer, trackID string) {
+	if timer, ok := timers[trackID]; ok {
+		timer.Stop()
+		delete(timers, trackID)
+	}
+}
+
+// armSubscribeTimeout bounds how long a track just subscribed to may take to
+// come through. Resubscriptions after reconnecting are bounded by the
+// reconnect settings instead.
+func (w *LiveKitWebRTC) armSubscribeTimeout(trackID string) {
+	timeout := w.cfg.Timeouts.Subscribe
+
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.reconnecting {
+		return
+	}
+
+	w.armTimeout(w.timeouts.subscribe, trackID, timeout, func() {
+		w.m.Lock()
+		_, pending := w.pendingSubscriptions[trackID]
+		w.m.Unlock()
+
+		if pending {
+			w.onTimeout(trackID, interfaces.CloseReasonSubscribeTimeout, events.StopReasonSubscribeTimeout,
+				fmt.Errorf("%w within %s", errSubscribeTimeout, timeout))
+		}
+	})
+}
+
+// armFirstMediaTimeout bounds how long a track just subscribed to may take to
+// send its first packet. Tracks muted meanwhile aren't expected to.
+func (w *LiveKitWebRTC) armFirstMediaTimeout(trackID string, pub *lksdk.RemoteTrackPublication) {
+	timeout := w.cfg.Timeouts.FirstMedia
+
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	w.disarmTimeout(w.timeouts.subscribe, trackID)
+
+	if w.firstPacketSeen[trackID] {
+		return
+	}
+
+	w.armTimeout(w.timeouts.firstMedia, trackID, timeout, func() {
+		w.m.Lock()
+		waiting := !w.firstPacketSeen[trackID] && !w.trackSilent(trackID)
+		w.m.Unlock()
+
+		if waiting && !pub.IsMuted() {
+			w.onTimeout(trackID, interfaces.CloseReasonFirstMediaTimeout, events.StopReasonFirstMediaTimeout,
+				fmt.Errorf("%w within %s", errFirstMediaTimeout, timeout))
+		}
+	})
+}
+
+// stopTimeouts disarms all track timeouts, for good
+func (w *LiveKitWebRTC) stopTimeouts() {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	w.timeouts.stopped = true
+
+	for _, timers := range []map[string]clock.Timer{w.timeouts.subscribe, w.timeouts.firstMedia} {
+		for trackID := range timers {
+			w.disarmTimeout(timers, trackID)
+		}
+	}
+}
+
+// onTimeout ends the capture on a track timing out
+func (w *LiveKitWebRTC) onTimeout(trackID, reason, stopReason string, err error) {
+	w.m.Lock()
+	w.trackErrors[trackID] = err
+	callback := w.stopCallback
+	w.m.Unlock()
+	w.setEndReason(reason, interfaces.NewTrackError(trackID, err))
+
+	w.logger.WithField("room", w.roomId).
+		WithField("trackID", trackID).
+		WithField("reason", reason).
+		Errorf("Stopping recording: %v", err)
+
+	if callback != nil {
+		callback(stopReason)
+	} else {
+		w.connStateCallback(utils.ConnectionStateFailed)
+	}
+}
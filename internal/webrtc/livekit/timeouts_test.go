@@ -0,0 +1,120 @@
+package livekit
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/interfaces"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/utils"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInit_ConnectTimeout(t *testing.T) {
+	// Accepts connections, never answers them
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			defer conn.Close()
+		}
+	}()
+
+	lk, _ := setupMockLK()
+	lk.cfg.Host = "ws://" + listener.Addr().String()
+	lk.cfg.Timeouts.Connect = 100 * time.Millisecond
+	lk.SetConnectionStateCallback(func(state utils.ConnectionState) {})
+	lk.SetFlowCallback(func(isFlowing bool, timestamp time.Duration, closed bool) {})
+
+	start := time.Now()
+	err = lk.Init()
+	assert.Less(t, time.Since(start), 5*time.Second)
+	require.ErrorIs(t, err, errConnectTimeout)
+	assert.Equal(t, interfaces.CloseReasonConnectTimeout, interfaces.ErrorReason(err, interfaces.CloseReasonInitFailed))
+	assert.Equal(t, interfaces.CloseReasonConnectTimeout, lk.CloseWithResult().Reason)
+}
+
+func TestTrackTimeouts(t *testing.T) {
+	setup := func() (*LiveKitWebRTC, *clock.Mock, *[]string) {
+		lk, _ := setupMockLK()
+		clk := clock.NewMock(time.Unix(1000, 0))
+		lk.WithClock(clk)
+		lk.cfg.Timeouts.Subscribe = 10 * time.Second
+		lk.cfg.Timeouts.FirstMedia = 15 * time.Second
+
+		var reasons []string
+		lk.SetStopCallback(func(reason string) { reasons = append(reasons, reason) })
+
+		return lk, clk, &reasons
+	}
+
+	trackID := "test-track"
+	pub := &lksdk.RemoteTrackPublication{}
+
+	// Never subscribed to
+	lk, clk, reasons := setup()
+	lk.pendingSubscriptions[trackID] = clk.Now()
+	lk.armSubscribeTimeout(trackID)
+	clk.Add(9 * time.Second)
+	assert.Empty(t, *reasons)
+	clk.Add(time.Second)
+	assert.Equal(t, []string{events.StopReasonSubscribeTimeout}, *reasons)
+
+	result := lk.CloseWithResult()
+	assert.Equal(t, interfaces.CloseReasonSubscribeTimeout, result.Reason)
+	assert.ErrorIs(t, result.TrackErrors[trackID], errSubscribeTimeout)
+
+	// Subscribed to, but nothing arrives
+	lk, clk, reasons = setup()
+	lk.pendingSubscriptions[trackID] = clk.Now()
+	lk.armSubscribeTimeout(trackID)
+	clk.Add(5 * time.Second)
+	lk.observeSubscription(trackID)
+	lk.armFirstMediaTimeout(trackID, pub)
+	clk.Add(10 * time.Second)
+	assert.Empty(t, *reasons, "The subscribe timeout is disarmed once subscribed")
+	clk.Add(5 * time.Second)
+	assert.Equal(t, []string{events.StopReasonFirstMediaTimeout}, *reasons)
+	assert.Equal(t, interfaces.CloseReasonFirstMediaTimeout, lk.CloseWithResult().Reason)
+
+	// Media arrives in time
+	lk, clk, reasons = setup()
+	lk.armFirstMediaTimeout(trackID, pub)
+	clk.Add(time.Second)
+	lk.notifyFirstPacket(trackID, TrackKindAudio, &rtp.Packet{})
+	clk.Add(time.Minute)
+	assert.Empty(t, *reasons)
+	assert.Equal(t, interfaces.CloseReasonNormal, lk.CloseWithResult().Reason)
+
+	// Muted tracks aren't expected to send anything
+	lk, clk, reasons = setup()
+	lk.armFirstMediaTimeout(trackID, pub)
+	lk.mutedTracks[trackID] = true
+	clk.Add(time.Minute)
+	assert.Empty(t, *reasons)
+	lk.Close()
+
+	// Closing disarms them all
+	lk, clk, reasons = setup()
+	lk.pendingSubscriptions[trackID] = clk.Now()
+	lk.armSubscribeTimeout(trackID)
+	lk.Close()
+	assert.Zero(t, clk.Timers())
+	lk.armFirstMediaTimeout(trackID, pub)
+	assert.Zero(t, clk.Timers(), "Not armed once closed")
+	clk.Add(time.Minute)
+	assert.Empty(t, *reasons)
+}
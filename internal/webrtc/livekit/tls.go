@@ -0,0 +1,31 @@
+package livekit
+
+import (
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/tlsconfig"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// ConfigureTLS applies cfg.TLS to the connections to LiveKit. The SDK dials
+// rooms' signalling connections with the websocket package's default
+// dialer, with no way to pass one of its own: the default is replaced, for
+// the whole process, which only uses it for LiveKit. Must be called before
+// any room is joined.
+func ConfigureTLS(cfg config.LiveKit) error {
+	tlsConfig, err := tlsconfig.Client(cfg.TLS)
+
+	if err != nil || tlsConfig == nil {
+		return err
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	websocket.DefaultDialer = &dialer
+
+	if cfg.TLS.InsecureSkipVerify {
+		log.Warn("LiveKit certificates are not verified (livekit.tls.insecureSkipVerify)")
+	}
+
+	return nil
+}
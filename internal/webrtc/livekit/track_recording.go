@@ -0,0 +1,214 @@
+package livekit
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/interfaces"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/rtp"
+)
+
+// What's done with the tracks recording is disabled for (see
+// config.LiveKit.DisabledTracks)
+const (
+	// DisabledTracksStats keeps reading them: nothing is written, but their
+	// stats are still collected
+	DisabledTracksStats = "stats"
+	// DisabledTracksStop has the SFU stop sending them until re-enabled
+	DisabledTracksStop = "stop"
+)
+
+// maxDisabledIntervals bounds the disabled intervals kept in a track's stats
+const maxDisabledIntervals = 100
+
+// ValidateDisabledTracks checks the disabled tracks mode
+func ValidateDisabledTracks(mode string) error {
+	switch mode {
+	case "", DisabledTracksStats, DisabledTracksStop:
+		return nil
+	default:
+		return fmt.Errorf("invalid disabled tracks mode %q (must be %q or %q)", mode, DisabledTracksStats, DisabledTracksStop)
+	}
+}
+
+// trackGate is what's written of a track whose recording can be disabled:
+// nothing while it is, then, once re-enabled, video from its next keyframe.
+// Sequence numbers written carry on from those written before, so the
+// recorder doesn't take what was skipped for losses.
+type trackGate struct {
+	disabled         bool
+	awaitingKeyframe bool
+	// Packets were skipped since the last one written
+	skipped bool
+
+	// Last packet written, as rewritten
+	written  bool
+	lastSeq  uint16
+	seqDelta uint16
+}
+
+// rewrite returns packets as written, continuing the sequence numbers of
+// those written before
+func (g *trackGate) rewrite(packets []*rtp.Packet) []*rtp.Packet {
+	if g.skipped && g.written {
+		g.seqDelta = g.lastSeq + 1 - packets[0].SequenceNumber
+	}
+
+	g.skipped = false
+	g.written = true
+
+	if g.seqDelta == 0 {
+		g.lastSeq = packets[len(packets)-1].SequenceNumber
+		return packets
+	}
+
+	rewritten := make([]*rtp.Packet, 0, len(packets))
+
+	for _, p := range packets {
+		out := *p
+		out.SequenceNumber += g.seqDelta
+		rewritten = append(rewritten, &out)
+		g.lastSeq = out.SequenceNumber
+	}
+
+	return rewritten
+}
+
+// SetTrackRecording enables or disables recording trackID, one of the tracks
+// recorded, while the others go on. Nothing of a disabled track is written;
+// as configured (see config.LiveKit.DisabledTracks), it's still read for its
+// stats or stops being sent. Video asks for a fresh keyframe once re-enabled,
+// and is written again from there. The periods a track was disabled for are
+// in its stats.
+func (w *LiveKitWebRTC) SetTrackRecording(trackID string, enabled bool) error {
+	w.m.Lock()
+
+	if !slices.Contains(w.trackIds, trackID) {
+		w.m.Unlock()
+		return fmt.Errorf("%w: %s", interfaces.ErrTrackNotFound, trackID)
+	}
+
+	g, ok := w.trackGates[trackID]
+
+	if !ok {
+		g = &trackGate{}
+		w.trackGates[trackID] = g
+	}
+
+	if g.disabled == !enabled {
+		w.m.Unlock()
+		return nil
+	}
+
+	pub := w.remoteTrackPubs[trackID]
+	isVideo := pub != nil && pub.Kind() == lksdk.TrackKindVideo
+	g.disabled = !enabled
+	g.awaitingKeyframe = enabled && isVideo
+
+	if stats, ok := w.trackStats[trackID]; ok {
+		recordDisabled(stats, !enabled, w.clock.Now().UnixMilli())
+	}
+
+	var ssrc uint32
+
+	if track := w.readingTracks[trackID]; track != nil {
+		ssrc = uint32(track.SSRC())
+	}
+
+	// The keyframe to resume on is asked for right away
+	if tracker, ok := w.pliStats[ssrc]; ok && enabled {
+		tracker.timestamp = time.Time{}
+		w.pliStats[ssrc] = tracker
+	}
+
+	w.m.Unlock()
+
+	w.logger.WithField("trackID", trackID).
+		WithField("enabled", enabled).
+		WithField("mode", w.disabledTracksMode()).
+		Info("Track recording state changed")
+
+	if pub != nil && w.disabledTracksMode() == DisabledTracksStop {
+		pub.SetEnabled(enabled)
+	}
+
+	if enabled && isVideo && ssrc != 0 {
+		w.queueKeyframeRequest(ssrc, "recording_enabled")
+	}
+
+	return nil
+}
+
+// disabledTracksMode returns what's done with disabled tracks,
+// DisabledTracksStats unless configured otherwise
+func (w *LiveKitWebRTC) disabledTracksMode() string {
+	if w.cfg.DisabledTracks == "" {
+		return DisabledTracksStats
+	}
+
+	return w.cfg.DisabledTracks
+}
+
+// gateSample returns the packets of a sample of trackID to write, none if
+// its recording is disabled, and whether its stats are to be collected
+func (w *LiveKitWebRTC) gateSample(trackID string, packets []*rtp.Packet, keyframe bool) ([]*rtp.Packet, bool) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if len(packets) == 0 {
+		return packets, true
+	}
+
+	// Tracked from the first sample, to carry on from once re-enabled
+	g, ok := w.trackGates[trackID]
+
+	if !ok {
+		g = &trackGate{}
+		w.trackGates[trackID] = g
+	}
+
+	if g.disabled {
+		g.skipped = true
+		// In flight when the SFU was told to stop sending it
+		return nil, w.disabledTracksMode() == DisabledTracksStats
+	}
+
+	if g.awaitingKeyframe && !keyframe {
+		g.skipped = true
+		return nil, true
+	}
+
+	g.awaitingKeyframe = false
+
+	return g.rewrite(packets), true
+}
+
+// trackDisabled returns whether recording trackID is disabled
+// Locked
+func (w *LiveKitWebRTC) trackDisabled(trackID string) bool {
+	g, ok := w.trackGates[trackID]
+
+	return ok && g.disabled
+}
+
+// recordDisabled updates a track's disabled recording stats, now in Unix ms
+func recordDisabled(stats *appstats.AdapterTrackStats, disabled bool, now int64) {
+	stats.RecordingDisabled = disabled
+
+	if !disabled {
+		if n := len(stats.DisabledIntervals); n > 0 && stats.DisabledIntervals[n-1].End == 0 {
+			stats.DisabledIntervals[n-1].End = now
+		}
+
+		return
+	}
+
+	stats.DisabledIntervals = append(stats.DisabledIntervals, appstats.DisabledInterval{Start: now})
+
+	if n := len(stats.DisabledIntervals); n > maxDisabledIntervals {
+		stats.DisabledIntervals = stats.DisabledIntervals[n-maxDisabledIntervals:]
+	}
+}
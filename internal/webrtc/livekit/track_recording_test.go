@@ -0,0 +1,130 @@
+package livekit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/interfaces"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateDisabledTracks(t *testing.T) {
+	assert.NoError(t, ValidateDisabledTracks(""))
+	assert.NoError(t, ValidateDisabledTracks(DisabledTracksStats))
+	assert.NoError(t, ValidateDisabledTracks(DisabledTracksStop))
+	assert.Error(t, ValidateDisabledTracks("pause"))
+}
+
+func TestSetTrackRecording(t *testing.T) {
+	lk, _ := setupMockLK()
+	clk := clock.NewMock(time.UnixMilli(10000))
+	lk.WithClock(clk)
+	trackID := lk.trackIds[0]
+
+	assert.ErrorIs(t, lk.SetTrackRecording("unknown", false), interfaces.ErrTrackNotFound)
+
+	require.NoError(t, lk.SetTrackRecording(trackID, false))
+	clk.Add(2 * time.Second)
+	require.NoError(t, lk.SetTrackRecording(trackID, false))
+	assert.True(t, lk.trackStats[trackID].RecordingDisabled)
+
+	require.NoError(t, lk.SetTrackRecording(trackID, true))
+	clk.Add(time.Second)
+	require.NoError(t, lk.SetTrackRecording(trackID, false))
+
+	stats := lk.cloneTrackStats()[trackID]
+	assert.True(t, stats.RecordingDisabled)
+	assert.Equal(t, []appstats.DisabledInterval{{Start: 10000, End: 12000}, {Start: 13000}}, stats.DisabledIntervals,
+		"Repeated changes are ignored")
+}
+
+func TestGateSample_StatsMode(t *testing.T) {
+	lk, _ := setupMockLK()
+	trackID := lk.trackIds[0]
+
+	packets, collect := lk.gateSample(trackID, makePackets(1, 2), false)
+	assert.Len(t, packets, 2, "Tracks never disabled are written as is")
+	assert.True(t, collect)
+
+	require.NoError(t, lk.SetTrackRecording(trackID, false))
+	packets, collect = lk.gateSample(trackID, makePackets(3, 4), false)
+	assert.Empty(t, packets)
+	assert.True(t, collect, "Stats are still collected")
+
+	require.NoError(t, lk.SetTrackRecording(trackID, true))
+	packets, _ = lk.gateSample(trackID, makePackets(10, 11), false)
+	require.Len(t, packets, 2)
+	assert.Equal(t, uint16(3), packets[0].SequenceNumber, "Sequence numbers carry on from those written")
+	assert.Equal(t, uint16(4), packets[1].SequenceNumber)
+}
+
+func TestGateSample_StopMode(t *testing.T) {
+	lk, _ := setupMockLK()
+	lk.cfg.DisabledTracks = DisabledTracksStop
+	trackID := lk.trackIds[0]
+
+	require.NoError(t, lk.SetTrackRecording(trackID, false))
+	packets, collect := lk.gateSample(trackID, makePackets(1, 2), false)
+	assert.Empty(t, packets)
+	assert.False(t, collect, "Packets in flight aren't accounted for")
+}
+
+func TestGateSample_VideoResumesOnKeyframe(t *testing.T) {
+	lk, _ := setupMockLK()
+	trackID := lk.trackIds[0]
+	// As re-enabled video is, before anything was written
+	lk.trackGates[trackID] = &trackGate{awaitingKeyframe: true}
+
+	packets, collect := lk.gateSample(trackID, makePackets(7, 8), false)
+	assert.Empty(t, packets, "Delta frames are skipped until a keyframe")
+	assert.True(t, collect)
+
+	packets, _ = lk.gateSample(trackID, makePackets(9, 10), true)
+	require.Len(t, packets, 2)
+	assert.Equal(t, uint16(9), packets[0].SequenceNumber, "Nothing was written before")
+
+	packets, _ = lk.gateSample(trackID, makePackets(11, 11), false)
+	assert.Len(t, packets, 1)
+}
+
+func TestTrackGate_Rewrite(t *testing.T) {
+	g := &trackGate{}
+	out := g.rewrite([]*rtp.Packet{{Header: rtp.Header{SequenceNumber: 65534}}, {Header: rtp.Header{SequenceNumber: 65535}}})
+	assert.Equal(t, uint16(65535), out[1].SequenceNumber)
+
+	g.skipped = true
+	in := []*rtp.Packet{{Header: rtp.Header{SequenceNumber: 100}}}
+	out = g.rewrite(in)
+	assert.Equal(t, uint16(0), out[0].SequenceNumber, "Wraps around")
+	assert.Equal(t, uint16(100), in[0].SequenceNumber, "Packets read aren't modified")
+}
+
+func TestMuted_DisabledTracks(t *testing.T) {
+	lk, _ := setupMockLK()
+	lk.trackIds = append(lk.trackIds, "audio")
+	lk.remoteTrackPubs[lk.trackIds[0]] = &lksdk.RemoteTrackPublication{}
+	lk.remoteTrackPubs["audio"] = &lksdk.RemoteTrackPublication{}
+
+	require.NoError(t, lk.SetTrackRecording(lk.trackIds[0], false))
+	assert.False(t, lk.Muted(), "Audio is still written")
+	lk.setTrackMuted("audio", false, true)
+	assert.True(t, lk.Muted(), "Nothing is written")
+}
+
+func TestRecordDisabled_Bounded(t *testing.T) {
+	stats := &appstats.AdapterTrackStats{}
+
+	for i := range maxDisabledIntervals + 10 {
+		recordDisabled(stats, true, int64(i))
+		recordDisabled(stats, false, int64(i))
+	}
+
+	assert.Len(t, stats.DisabledIntervals, maxDisabledIntervals)
+	assert.Equal(t, int64(10), stats.DisabledIntervals[0].Start, "The latest are kept")
+	assert.False(t, stats.RecordingDisabled)
+}
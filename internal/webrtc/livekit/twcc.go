@@ -0,0 +1,93 @@
+package livekit
+
+import (
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/utils"
+	"github.com/pion/rtp"
+)
+
+// twccStats derives delay variation from the arrival of packets carrying the
+// transport-wide congestion control extension. Its sequence numbers are
+// assigned as packets are sent, so the spacing between arrivals can be told
+// apart without trusting the sender's RTP clock.
+type twccStats struct {
+	extID uint8
+	su    *utils.SequenceUnwrapper
+
+	packets   uint64
+	reordered uint64
+
+	// The latest packet in send order, and its arrival spacing
+	started     bool
+	lastSeq     int64
+	lastArrival time.Time
+	hasSpacing  bool
+	lastSpacing float64 // In ns per sequence number
+	jitter      float64 // In ns
+}
+
+func newTWCCStats(extID uint8) *twccStats {
+	return &twccStats{
+		extID: extID,
+		su:    utils.NewSequenceUnwrapper(16),
+	}
+}
+
+// onRTP accounts for the arrival of a packet. The sequence numbers are shared
+// by all tracks of the transport, so the spacing is per sequence number step
+// to leave out the packets of others sent in between.
+func (s *twccStats) onRTP(packet *rtp.Packet, arrival time.Time) {
+	payload := packet.GetExtension(s.extID)
+
+	if payload == nil {
+		return
+	}
+
+	var ext rtp.TransportCCExtension
+
+	if err := ext.Unmarshal(payload); err != nil {
+		return
+	}
+
+	seq := s.su.Unwrap(uint64(ext.TransportSequence))
+	s.packets++
+
+	if !s.started {
+		s.started = true
+		s.lastSeq = seq
+		s.lastArrival = arrival
+
+		return
+	}
+
+	// Sent before one that arrived already
+	if seq <= s.lastSeq {
+		s.reordered++
+		return
+	}
+
+	spacing := float64(arrival.Sub(s.lastArrival)) / float64(seq-s.lastSeq)
+
+	if s.hasSpacing {
+		d := spacing - s.lastSpacing
+
+		if d < 0 {
+			d = -d
+		}
+
+		s.jitter += (d - s.jitter) / 16
+	}
+
+	s.hasSpacing = true
+	s.lastSpacing = spacing
+	s.lastSeq = seq
+	s.lastArrival = arrival
+}
+
+func (s *twccStats) apply(stats *appstats.AdapterTrackStats) {
+	stats.TWCCPackets = s.packets
+	stats.TWCCReorderedPackets = s.reordered
+	stats.TWCCJitterMs = s.jitter / float64(time.Millisecond)
+}
@@ -0,0 +1,61 @@
+package livekit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func twccPacket(t *testing.T, seq uint16, transportSeq uint16) *rtp.Packet {
+	payload, err := (&rtp.TransportCCExtension{TransportSequence: transportSeq}).Marshal()
+	require.NoError(t, err)
+
+	packet := &rtp.Packet{Header: rtp.Header{SSRC: 1, SequenceNumber: seq}}
+	require.NoError(t, packet.SetExtension(3, payload))
+
+	return packet
+}
+
+func TestReceptionStats_TWCC(t *testing.T) {
+	rs := newReceptionStats(90000)
+	rs.setTWCCExtensionID(3)
+	start := time.Unix(1700000000, 0)
+	stats := &appstats.AdapterTrackStats{}
+
+	// A packet every 10ms, with another track's in between, across the
+	// transport sequence number wraparound: no jitter
+	for i, transportSeq := range []uint16{65532, 65534, 0, 2} {
+		rs.onRTP(twccPacket(t, uint16(i), transportSeq), start.Add(time.Duration(i)*10*time.Millisecond))
+	}
+
+	rs.apply(stats)
+	assert.Equal(t, uint64(4), stats.TWCCPackets)
+	assert.InDelta(t, 0, stats.TWCCJitterMs, 0.01)
+
+	// 16ms late: the spacing is 13ms a step instead of 5ms
+	rs.onRTP(twccPacket(t, 4, 4), start.Add(56*time.Millisecond))
+	rs.apply(stats)
+	assert.InDelta(t, 0.5, stats.TWCCJitterMs, 0.01)
+
+	// Sent before the previous one
+	rs.onRTP(twccPacket(t, 5, 3), start.Add(57*time.Millisecond))
+	rs.apply(stats)
+	assert.Equal(t, uint64(1), stats.TWCCReorderedPackets)
+	assert.Equal(t, uint64(6), stats.TWCCPackets)
+	assert.InDelta(t, 0.5, stats.TWCCJitterMs, 0.01)
+}
+
+func TestReceptionStats_TWCCNotNegotiated(t *testing.T) {
+	rs := newReceptionStats(90000)
+	rs.setTWCCExtensionID(0)
+	rs.onRTP(twccPacket(t, 0, 0), time.Now())
+
+	stats := &appstats.AdapterTrackStats{}
+	rs.apply(stats)
+	assert.Zero(t, stats.TWCCPackets)
+	assert.Equal(t, uint64(1), stats.PacketsReceived)
+}
@@ -0,0 +1,204 @@
+package livekit
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
+	"github.com/google/uuid"
+	"github.com/livekit/protocol/livekit"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/webrtc/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// Upper bound for connecting and subscribing during a validation
+const validateTimeout = 10 * time.Second
+
+type subscriptionResult struct {
+	mimeType string
+	err      error
+}
+
+// Validate checks that a recording of trackIds in room would start: it
+// connects with the recorder's credentials, looks the tracks up, checks they
+// can be decoded and recorded, and subscribes to them. The tracks filter
+// matches, if set, are checked too, which lists them. Nothing is written;
+// the room is left once done. The error is only set if the room couldn't be
+// joined - problems with the tracks are in the report.
+func Validate(ctx context.Context, cfg config.LiveKit, roomId string, trackIds []string, filter *events.TrackFilter) (*events.ValidationReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, validateTimeout)
+	defer cancel()
+
+	report := &events.ValidationReport{Room: roomId, Tracks: []*events.TrackValidation{}}
+	identity := fmt.Sprintf("bbb-webrtc-recorder-validate-%s", uuid.New().String())
+	client := clientFor(cfg)
+	token, err := client.recorderToken(roomId, identity)
+	defer client.release(roomId, identity)
+
+	if err != nil {
+		return report, fmt.Errorf("failed to build recorder token: %w", err)
+	}
+
+	var m sync.Mutex
+	pending := make(map[string]chan subscriptionResult)
+	deliver := func(trackID string, res subscriptionResult) {
+		m.Lock()
+		defer m.Unlock()
+
+		if ch, ok := pending[trackID]; ok {
+			ch <- res
+			delete(pending, trackID)
+		}
+	}
+
+	done := make(chan connResult, 1)
+
+	go func() {
+		room, err := lksdk.ConnectToRoomWithToken(cfg.Host, token,
+			&lksdk.RoomCallback{
+				ParticipantCallback: lksdk.ParticipantCallback{
+					OnTrackSubscribed: func(track *webrtc.TrackRemote, pub *lksdk.RemoteTrackPublication, rp *lksdk.RemoteParticipant) {
+						deliver(pub.SID(), subscriptionResult{mimeType: track.Codec().MimeType})
+					},
+					OnTrackSubscriptionFailed: func(sid string, rp *lksdk.RemoteParticipant) {
+						deliver(sid, subscriptionResult{err: fmt.Errorf("subscription failed")})
+					},
+				},
+			},
+			lksdk.WithAutoSubscribe(false),
+		)
+		done <- connResult{room, err}
+	}()
+
+	var room *lksdk.Room
+
+	select {
+	case <-ctx.Done():
+		go func() {
+			// Don't leave a late connection behind
+			if res := <-done; res.room != nil {
+				res.room.Disconnect()
+			}
+		}()
+
+		return report, fmt.Errorf("timed out connecting to LiveKit room")
+	case res := <-done:
+		if res.err != nil {
+			return report, fmt.Errorf("failed to connect to LiveKit room: %w", res.err)
+		}
+
+		room = res.room
+	}
+
+	defer room.Disconnect()
+	report.Connected = true
+
+	results := make(map[string]chan subscriptionResult)
+	found := make(map[string]*events.TrackValidation)
+
+	trackIds = slices.Clone(trackIds)
+
+	for _, rp := range room.GetRemoteParticipants() {
+		for _, publication := range rp.TrackPublications() {
+			pub, ok := publication.(*lksdk.RemoteTrackPublication)
+
+			if !ok || found[pub.SID()] != nil {
+				continue
+			}
+
+			if !slices.Contains(trackIds, pub.SID()) {
+				if filter == nil || !filter.Matches(rp.Identity(), strings.ToLower(pub.Source().String())) {
+					continue
+				}
+
+				trackIds = append(trackIds, pub.SID())
+			}
+
+			tv := &events.TrackValidation{
+				TrackId:     pub.SID(),
+				Found:       true,
+				Participant: rp.Identity(),
+				Kind:        string(pub.Kind()),
+				Source:      pub.Source().String(),
+				MimeType:    strings.ToLower(pub.MimeType()),
+				Encrypted:   pub.TrackInfo().GetEncryption() != livekit.Encryption_NONE,
+			}
+			found[pub.SID()] = tv
+			checkTrack(tv, cfg.E2EEKey != "")
+
+			if tv.Error != "" {
+				continue
+			}
+
+			ch := make(chan subscriptionResult, 1)
+			m.Lock()
+			pending[pub.SID()] = ch
+			m.Unlock()
+			results[pub.SID()] = ch
+
+			if err := pub.SetSubscribed(true); err != nil {
+				deliver(pub.SID(), subscriptionResult{err: err})
+			}
+		}
+	}
+
+	report.Valid = true
+
+	for _, trackID := range trackIds {
+		tv, ok := found[trackID]
+
+		if !ok {
+			tv = &events.TrackValidation{TrackId: trackID, Error: "track not found in room"}
+		} else if ch, subscribing := results[trackID]; subscribing {
+			select {
+			case res := <-ch:
+				if res.err != nil {
+					tv.Error = res.err.Error()
+				} else {
+					tv.Subscribed = true
+					// The negotiated codec is what would be recorded
+					tv.MimeType = strings.ToLower(res.mimeType)
+					checkTrack(tv, cfg.E2EEKey != "")
+				}
+			case <-ctx.Done():
+				tv.Error = "timed out waiting for subscription"
+			}
+		}
+
+		report.Valid = report.Valid && tv.Error == ""
+		report.Tracks = append(report.Tracks, tv)
+	}
+
+	log.WithField("room", roomId).
+		Infof("Validated LiveKit recording: valid=%t tracks=%d", report.Valid, len(report.Tracks))
+
+	return report, nil
+}
+
+// checkTrack reports whether the recorder can decode and write a track
+func checkTrack(tv *events.TrackValidation, hasKey bool) {
+	mimeType := MimeType(tv.MimeType)
+
+	switch TrackKind(tv.Kind) {
+	case TrackKindVideo:
+		tv.CodecSupported = recorder.IsSupportedVideoCodec(tv.MimeType)
+	case TrackKindAudio:
+		tv.CodecSupported = mimeType == MimeTypeOpus
+	}
+
+	switch {
+	case !tv.CodecSupported:
+		tv.Error = fmt.Sprintf("unsupported codec %s", tv.MimeType)
+	case tv.Encrypted && !hasKey:
+		tv.Error = errE2EENoKey.Error()
+	case tv.Encrypted && mimeType != MimeTypeVP8 && mimeType != MimeTypeOpus:
+		tv.Error = fmt.Sprintf("%v: %s", errE2EEUnsupported, tv.MimeType)
+	}
+}
@@ -0,0 +1,50 @@
+package livekit
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckTrack(t *testing.T) {
+	tests := []struct {
+		name      string
+		track     events.TrackValidation
+		hasKey    bool
+		supported bool
+		wantErr   bool
+	}{
+		{"vp8", events.TrackValidation{Kind: "video", MimeType: "video/vp8"}, false, true, false},
+		{"h264", events.TrackValidation{Kind: "video", MimeType: "video/h264"}, false, true, false},
+		{"opus", events.TrackValidation{Kind: "audio", MimeType: "audio/opus"}, false, true, false},
+		{"av1", events.TrackValidation{Kind: "video", MimeType: "video/av1"}, false, true, false},
+		{"h265", events.TrackValidation{Kind: "video", MimeType: "video/h265"}, false, false, true},
+		{"audio with a video codec", events.TrackValidation{Kind: "audio", MimeType: "video/vp8"}, false, false, true},
+		{"encrypted without key", events.TrackValidation{Kind: "audio", MimeType: "audio/opus", Encrypted: true}, false, true, true},
+		{"encrypted with key", events.TrackValidation{Kind: "video", MimeType: "video/vp8", Encrypted: true}, true, true, false},
+		{"encrypted h264", events.TrackValidation{Kind: "video", MimeType: "video/h264", Encrypted: true}, true, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tv := tt.track
+			checkTrack(&tv, tt.hasKey)
+			assert.Equal(t, tt.supported, tv.CodecSupported)
+			assert.Equal(t, tt.wantErr, tv.Error != "", tv.Error)
+		})
+	}
+}
+
+func TestValidate_ConnectionFailure(t *testing.T) {
+	cfg := config.LiveKit{Host: "ws://127.0.0.1:1", APIKey: "key", APISecret: "secret"}
+
+	report, err := Validate(context.Background(), cfg, "room", []string{"TR_1"}, nil)
+	require.Error(t, err)
+	require.NotNil(t, report)
+	assert.False(t, report.Connected)
+	assert.False(t, report.Valid)
+}
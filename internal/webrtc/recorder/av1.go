@@ -0,0 +1,462 @@
+package recorder
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/rtp/codecs/av1/obu"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	av1SampleRate = 90000
+	// Aggregation header (AV1 RTP spec 4.4) bits: continuation of the
+	// previous packet's last OBU, and first packet of a coded video sequence
+	av1AggregationZ = 0x80
+	av1AggregationN = 0x08
+	// frame_type of key frames (AV1 spec 6.8.2)
+	av1KeyFrame = 0
+)
+
+var errAV1ShortSequenceHeader = errors.New("av1: sequence header too short")
+
+// av1Depacketizer reassembles the OBUs of a temporal unit like
+// codecs.AV1Depacketizer, which handles aggregation headers and OBUs
+// fragmented across packets. That one takes any packet starting with a new
+// OBU (Z=0) for the start of a sample, and the sample builder would split
+// temporal units of several OBUs there; only the first of those packets with
+// a new timestamp, or starting a coded video sequence, is one.
+type av1Depacketizer struct {
+	codecs.AV1Depacketizer
+	timestamp       uint32
+	timestampValid  bool
+	newTemporalUnit bool
+}
+
+// push notes the timestamp of the packet about to be pushed to the sample
+// builder, which only tells the depacketizer about the payload
+func (d *av1Depacketizer) push(timestamp uint32) {
+	d.newTemporalUnit = !d.timestampValid || timestamp != d.timestamp
+	d.timestamp = timestamp
+	d.timestampValid = true
+}
+
+func (d *av1Depacketizer) IsPartitionHead(payload []byte) bool {
+	if len(payload) == 0 || payload[0]&av1AggregationZ != 0 {
+		return false
+	}
+
+	return d.newTemporalUnit || payload[0]&av1AggregationN != 0
+}
+
+// av1OBU is an OBU of a low overhead bitstream, as the depacketizer outputs
+type av1OBU struct {
+	typ     obu.Type
+	data    []byte // The whole OBU, header and size field included
+	payload []byte
+}
+
+// av1SequenceHeader is what the recorder needs from a sequence header OBU
+// (AV1 spec 5.5)
+type av1SequenceHeader struct {
+	obu                       []byte
+	profile                   uint8
+	level                     uint8
+	tier                      uint8
+	reducedStillPictureHeader bool
+	width, height             int
+	highBitDepth              bool
+	twelveBit                 bool
+	monochrome                bool
+	subsamplingX              bool
+	subsamplingY              bool
+	chromaSamplePosition      uint8
+}
+
+func (r *WebmRecorder) pushAV1(packet *rtp.Packet) {
+	if !r.hasVideo {
+		return
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if len(packet.Payload) == 0 || r.closed {
+		return
+	}
+
+	r.initVideoStats()
+
+	// Nothing decodes before a keyframe, which starts a coded video sequence
+	// and carries its sequence header: ask for one as soon as the stream
+	// starts, and drop what comes before
+	if !r.av1SequenceStarted {
+		if packet.Payload[0]&av1AggregationN == 0 {
+			r.RequestKeyframe()
+			return
+		}
+
+		r.av1SequenceStarted = true
+	}
+
+	if gap, ok := r.sequenceGap(r.videoSeqTracker, &r.stats.Video.BaseTrackStats, packet.SequenceNumber); ok {
+		r.trackRTPDiscontinuity(&r.stats.Video.BaseTrackStats, gap)
+		r.noteVideoLoss(gap)
+
+		r.logger.WithField("expected_seq", r.videoSeqTracker.expectedNextSeq).
+			WithField("got_seq", packet.SequenceNumber).
+			WithField("gap", gap).
+			Debug("Video sequence discontinuity detected")
+	}
+
+	// The sample builder retains the packet: it gets a copy of its own
+	packet = copyPacket(packet)
+	defer r.videoRecycler.recycle()
+
+	r.setExpectedNextSeq(packet.SequenceNumber, "video")
+	r.av1Depacketizer.push(packet.Timestamp)
+	r.videoBuilder.Push(packet)
+
+	for {
+		// Samples are temporal units of OBUs with size fields, temporal
+		// delimiters dropped, which is what Matroska and ISOBMFF expect
+		sample, ts := r.videoBuilder.PopWithTimestamp()
+
+		if sample == nil {
+			return
+		}
+
+		isKf := false
+		hasSeqHeader := false
+		frameSeen := false
+
+		for _, o := range splitAV1OBUs(sample.Data) {
+			switch o.typ {
+			case obu.OBUSequenceHeader:
+				r.updateAV1SequenceHeader(o)
+				hasSeqHeader = true
+			case obu.OBUFrameHeader, obu.OBUFrame:
+				// The first frame of the unit is the lowest spatial layer's
+				if !frameSeen {
+					frameSeen = true
+					isKf = hasSeqHeader && r.av1SeqHeader != nil && isAV1KeyFrame(o.payload, r.av1SeqHeader)
+				}
+			}
+		}
+
+		if r.resumeKeyframePending {
+			if !isKf {
+				r.RequestKeyframe()
+				continue
+			}
+
+			r.resumeKeyframePending = false
+		}
+
+		duration := sample.Duration
+		r.trackFrameStats(r.stats.Video, len(sample.Data), isKf, duration)
+
+		if r.needsWebmWriter() {
+			// The sequence header goes in the track's CodecPrivate, so
+			// nothing can be written until a keyframe shows up
+			if !isKf {
+				if r.videoWriter == nil {
+					if log.IsLevelEnabled(log.TraceLevel) {
+						r.logger.Tracef("Waiting for AV1 keyframe, dropping frame: ts=%d", ts)
+					}
+
+					r.RequestKeyframe()
+					continue
+				}
+			} else {
+				if log.IsLevelEnabled(log.TraceLevel) {
+					r.logger.Tracef("Frame dimensions: %dx%d", r.av1SeqHeader.width, r.av1SeqHeader.height)
+				}
+
+				r.initWriter(r.av1SeqHeader.width, r.av1SeqHeader.height)
+			}
+		}
+
+		if r.videoWriter != nil {
+			if gap, ok := r.consumePauseGap(&r.videoGapPending); ok {
+				duration = gap
+			}
+
+			r.startTimeline(&r.videoTimestamp, &r.videoTimelineStarted)
+			r.videoTimestamp += duration
+			r.anchorSkew(true, ts)
+
+			if log.IsLevelEnabled(log.TraceLevel) {
+				r.logger.Tracef("Writing AV1 temporal unit: ts=%d, size=%d, KF=%v", ts, len(sample.Data), isKf)
+			}
+
+			if _, err := r.videoWriter.Write(isKf, int64(r.videoTimestamp/time.Millisecond), sample.Data); err != nil {
+				r.logger.Errorf("Error writing video frame: %v", err)
+				r.hasKeyFrame = false
+				r.RequestKeyframe()
+			} else {
+				r.onVideoFrameWritten(len(sample.Data), isKf)
+
+				if log.IsLevelEnabled(log.TraceLevel) {
+					r.logger.Tracef("AV1 temporal unit written: ts=%d, size=%d, KF=%v", ts, len(sample.Data), isKf)
+				}
+			}
+		}
+	}
+}
+
+// Sequence headers are repeated with every keyframe, and kept in-band in the
+// written temporal units; the latest one is kept around for (re)initializing
+// the writer.
+func (r *WebmRecorder) updateAV1SequenceHeader(o av1OBU) {
+	if r.av1SeqHeader != nil && bytes.Equal(r.av1SeqHeader.obu, o.data) {
+		return
+	}
+
+	seq, err := parseAV1SequenceHeader(o.payload)
+
+	if err != nil {
+		r.logger.Warnf("Could not parse AV1 sequence header: %v", err)
+		return
+	}
+
+	if r.av1SeqHeader != nil {
+		r.logger.Infof("AV1 sequence header changed mid-stream (%dx%d)", seq.width, seq.height)
+	}
+
+	seq.obu = append([]byte(nil), o.data...)
+	r.av1SeqHeader = seq
+}
+
+// splitAV1OBUs splits a low overhead bitstream (OBUs with size fields) into
+// OBUs, stopping at the first malformed one
+func splitAV1OBUs(data []byte) []av1OBU {
+	var obus []av1OBU
+
+	for len(data) > 0 {
+		header, err := obu.ParseOBUHeader(data)
+
+		if err != nil || !header.HasSizeField || len(data) <= header.Size() {
+			break
+		}
+
+		size, n, err := obu.ReadLeb128(data[header.Size():])
+
+		if err != nil {
+			break
+		}
+
+		start := header.Size() + int(n)
+
+		if size > uint(len(data)-start) {
+			break
+		}
+
+		end := start + int(size)
+		obus = append(obus, av1OBU{typ: header.Type, data: data[:end], payload: data[start:end]})
+		data = data[end:]
+	}
+
+	return obus
+}
+
+// isAV1KeyFrame returns whether a frame header OBU (or frame OBU, which
+// starts with one) is that of a new key frame (AV1 spec 5.9.2)
+func isAV1KeyFrame(payload []byte, seq *av1SequenceHeader) bool {
+	if seq.reducedStillPictureHeader {
+		return true
+	}
+
+	br := &expGolombReader{data: payload}
+
+	if br.readBits(1) == 1 { // show_existing_frame
+		return false
+	}
+
+	return br.readBits(2) == av1KeyFrame && br.err == nil
+}
+
+// parseAV1SequenceHeader parses the payload of a sequence header OBU (AV1
+// spec 5.5) up to the color config
+func parseAV1SequenceHeader(payload []byte) (*av1SequenceHeader, error) {
+	br := &expGolombReader{data: payload}
+	seq := &av1SequenceHeader{}
+
+	seq.profile = uint8(br.readBits(3))
+	br.readBits(1) // still_picture
+	seq.reducedStillPictureHeader = br.readBits(1) == 1
+
+	if seq.reducedStillPictureHeader {
+		seq.level = uint8(br.readBits(5))
+	} else {
+		decoderModelInfoPresent := false
+		bufferDelayLength := 0
+
+		if br.readBits(1) == 1 { // timing_info_present_flag
+			br.readBits(32) // num_units_in_display_tick
+			br.readBits(32) // time_scale
+
+			if br.readBits(1) == 1 { // equal_picture_interval
+				br.readUE() // num_ticks_per_picture_minus_1, uvlc()
+			}
+
+			decoderModelInfoPresent = br.readBits(1) == 1
+
+			if decoderModelInfoPresent {
+				bufferDelayLength = int(br.readBits(5)) + 1
+				br.readBits(32) // num_units_in_decoding_tick
+				br.readBits(5)  // buffer_removal_time_length_minus_1
+				br.readBits(5)  // frame_presentation_time_length_minus_1
+			}
+		}
+
+		initialDisplayDelayPresent := br.readBits(1) == 1
+		operatingPoints := int(br.readBits(5)) + 1
+
+		for i := 0; i < operatingPoints && br.err == nil; i++ {
+			br.readBits(12) // operating_point_idc
+			level := uint8(br.readBits(5))
+			tier := uint8(0)
+
+			if level > 7 {
+				tier = uint8(br.readBits(1))
+			}
+
+			// The av1C describes the first operating point
+			if i == 0 {
+				seq.level = level
+				seq.tier = tier
+			}
+
+			if decoderModelInfoPresent && br.readBits(1) == 1 {
+				br.readBits(bufferDelayLength) // decoder_buffer_delay
+				br.readBits(bufferDelayLength) // encoder_buffer_delay
+				br.readBits(1)                 // low_delay_mode_flag
+			}
+
+			if initialDisplayDelayPresent && br.readBits(1) == 1 {
+				br.readBits(4) // initial_display_delay_minus_1
+			}
+		}
+	}
+
+	widthBits := int(br.readBits(4)) + 1
+	heightBits := int(br.readBits(4)) + 1
+	seq.width = int(br.readBits(widthBits)) + 1
+	seq.height = int(br.readBits(heightBits)) + 1
+
+	if !seq.reducedStillPictureHeader && br.readBits(1) == 1 { // frame_id_numbers_present_flag
+		br.readBits(4) // delta_frame_id_length_minus_2
+		br.readBits(3) // additional_frame_id_length_minus_1
+	}
+
+	br.readBits(3) // use_128x128_superblock, enable_filter_intra, enable_intra_edge_filter
+
+	if !seq.reducedStillPictureHeader {
+		// enable_interintra_compound, enable_masked_compound,
+		// enable_warped_motion, enable_dual_filter
+		br.readBits(4)
+		enableOrderHint := br.readBits(1) == 1
+
+		if enableOrderHint {
+			br.readBits(2) // enable_jnt_comp, enable_ref_frame_mvs
+		}
+
+		forceScreenContentTools := uint(2)
+
+		if br.readBits(1) == 0 { // seq_choose_screen_content_tools
+			forceScreenContentTools = br.readBits(1)
+		}
+
+		if forceScreenContentTools > 0 && br.readBits(1) == 0 { // seq_choose_integer_mv
+			br.readBits(1) // seq_force_integer_mv
+		}
+
+		if enableOrderHint {
+			br.readBits(3) // order_hint_bits_minus_1
+		}
+	}
+
+	br.readBits(3) // enable_superres, enable_cdef, enable_restoration
+
+	// color_config()
+	seq.highBitDepth = br.readBits(1) == 1
+
+	if seq.profile == 2 && seq.highBitDepth {
+		seq.twelveBit = br.readBits(1) == 1
+	}
+
+	if seq.profile != 1 {
+		seq.monochrome = br.readBits(1) == 1
+	}
+
+	colorPrimaries, transferCharacteristics, matrixCoefficients := uint(2), uint(2), uint(2)
+
+	if br.readBits(1) == 1 { // color_description_present_flag
+		colorPrimaries = br.readBits(8)
+		transferCharacteristics = br.readBits(8)
+		matrixCoefficients = br.readBits(8)
+	}
+
+	switch {
+	case seq.monochrome:
+		seq.subsamplingX, seq.subsamplingY = true, true
+	case colorPrimaries == 1 && transferCharacteristics == 13 && matrixCoefficients == 0:
+		// sRGB, 4:4:4
+	default:
+		br.readBits(1) // color_range
+
+		switch {
+		case seq.profile == 0:
+			seq.subsamplingX, seq.subsamplingY = true, true
+		case seq.profile == 2 && seq.twelveBit:
+			seq.subsamplingX = br.readBits(1) == 1
+
+			if seq.subsamplingX {
+				seq.subsamplingY = br.readBits(1) == 1
+			}
+		case seq.profile == 2:
+			seq.subsamplingX = true
+		}
+
+		if seq.subsamplingX && seq.subsamplingY {
+			seq.chromaSamplePosition = uint8(br.readBits(2))
+		}
+	}
+
+	if br.err != nil {
+		return nil, errAV1ShortSequenceHeader
+	}
+
+	return seq, nil
+}
+
+// buildAV1CodecConfig builds an AV1CodecConfigurationRecord (AV1 ISOBMFF
+// binding 2.3), to be used as the Matroska CodecPrivate and in the av1C box
+func buildAV1CodecConfig(seq *av1SequenceHeader) []byte {
+	if seq == nil {
+		return nil
+	}
+
+	flag := func(b bool, shift uint) byte {
+		if b {
+			return 1 << shift
+		}
+
+		return 0
+	}
+
+	buf := make([]byte, 0, 4+len(seq.obu))
+	buf = append(buf,
+		0x81, // marker, version 1
+		seq.profile<<5|seq.level&0x1F,
+		seq.tier<<7|flag(seq.highBitDepth, 6)|flag(seq.twelveBit, 5)|flag(seq.monochrome, 4)|
+			flag(seq.subsamplingX, 3)|flag(seq.subsamplingY, 2)|seq.chromaSamplePosition&0x03,
+		0x00, // No initial_presentation_delay
+	)
+
+	return append(buf, seq.obu...)
+}
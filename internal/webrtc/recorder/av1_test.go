@@ -0,0 +1,117 @@
+package recorder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Profile 0, level 4.0 (8), 640x480, 8-bit 4:2:0, without the OBU header
+const testAV1SequenceHeader = "00000042627fef994f3010"
+
+func TestParseAV1SequenceHeader(t *testing.T) {
+	seq, err := parseAV1SequenceHeader(mustHex(t, testAV1SequenceHeader))
+	require.NoError(t, err)
+	assert.Equal(t, 640, seq.width)
+	assert.Equal(t, 480, seq.height)
+	assert.Equal(t, uint8(0), seq.profile)
+	assert.Equal(t, uint8(8), seq.level)
+	assert.True(t, seq.subsamplingX)
+	assert.True(t, seq.subsamplingY)
+	assert.False(t, seq.highBitDepth)
+
+	_, err = parseAV1SequenceHeader([]byte{0x00, 0x00})
+	assert.Error(t, err, "Truncated sequence header should fail")
+}
+
+func TestBuildAV1CodecConfig(t *testing.T) {
+	seq, err := parseAV1SequenceHeader(mustHex(t, testAV1SequenceHeader))
+	require.NoError(t, err)
+	seq.obu = append([]byte{0x0A, 0x0B}, mustHex(t, testAV1SequenceHeader)...)
+
+	av1C := buildAV1CodecConfig(seq)
+	assert.Equal(t, []byte{0x81, 0x08, 0x0C, 0x00}, av1C[:4])
+	assert.Equal(t, seq.obu, av1C[4:])
+	assert.Nil(t, buildAV1CodecConfig(nil))
+}
+
+func TestSplitAV1OBUs(t *testing.T) {
+	data := []byte{0x0A, 0x02, 0xAA, 0xBB, 0x32, 0x01, 0x10}
+	obus := splitAV1OBUs(data)
+	require.Len(t, obus, 2)
+	assert.Equal(t, data[:4], obus[0].data)
+	assert.Equal(t, []byte{0xAA, 0xBB}, obus[0].payload)
+	assert.Equal(t, []byte{0x10}, obus[1].payload)
+
+	assert.Len(t, splitAV1OBUs([]byte{0x0A, 0x05, 0xAA}), 0, "Truncated OBU")
+}
+
+func TestWebmRecorder_AV1(t *testing.T) {
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, false)
+	r.SetHasVideo(true)
+	kfr := &countingKeyframeRequester{}
+	r.SetKeyframeRequester(kfr)
+	require.NoError(t, r.SetVideoCodec("video/AV1"))
+	assert.Equal(t, ".webm", filepath.Ext(r.GetFilePath()), "AV1 is part of WebM")
+
+	seqHeader := append([]byte{0x08}, mustHex(t, testAV1SequenceHeader)...)
+	// Frame OBU of a shown key frame, frame header and tile group OBUs of
+	// an inter frame
+	keyFrame := append([]byte{0x30, 0x10}, make([]byte, 80)...)
+	interFrame := append([]byte{0x30, 0x30}, make([]byte, 20)...)
+	interHeader := []byte{0x18, 0x30, 0x00}
+	tileGroup := append([]byte{0x20}, make([]byte, 20)...)
+
+	seq := uint16(100)
+	push := func(ts uint32, marker bool, payload ...byte) {
+		r.PushVideo(&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				SequenceNumber: seq,
+				Timestamp:      ts,
+				Marker:         marker,
+			},
+			Payload: payload,
+		})
+		seq++
+	}
+
+	// Joining mid-sequence: dropped, and a keyframe requested right away
+	push(1000, true, append([]byte{0x10}, interFrame...)...)
+	assert.Equal(t, 1, kfr.requests)
+
+	for i := uint32(0); i < 5; i++ {
+		ts := 4000 + i*6000
+
+		// N, W=2: the sequence header with its length, then the start of
+		// the key frame, continued (Y) in the next packet (Z)
+		first := []byte{0x68, byte(len(seqHeader))}
+		first = append(first, seqHeader...)
+		first = append(first, keyFrame[:40]...)
+		push(ts, false, first...)
+		push(ts, true, append([]byte{0x90}, keyFrame[40:]...)...)
+		// A new OBU (Z=0) in the same temporal unit
+		push(ts+3000, false, append([]byte{0x10}, interHeader...)...)
+		push(ts+3000, true, append([]byte{0x10}, tileGroup...)...)
+	}
+
+	r.Close()
+
+	stats := r.GetStats()
+	require.NotNil(t, stats.Video)
+	assert.Equal(t, CodecAV1, stats.Video.Codec)
+	assert.Equal(t, 5, stats.Video.KeyframeCount)
+	assert.Equal(t, 10, stats.Video.TotalSamples, "Temporal units aren't split")
+	require.NotNil(t, r.av1SeqHeader)
+	assert.Equal(t, 640, r.av1SeqHeader.width)
+
+	data, err := os.ReadFile(r.GetFilePath())
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "V_AV1")
+	// Reassembled key frame, with a size field
+	assert.Contains(t, string(data), string(append([]byte{0x32, byte(len(keyFrame) - 1)}, keyFrame[1:]...)))
+}
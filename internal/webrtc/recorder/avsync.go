@@ -0,0 +1,285 @@
+package recorder
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+)
+
+const (
+	// maxPendingAudio bounds how much audio is held while waiting for the
+	// first video keyframe to open an audio+video file
+	maxPendingAudio = 10 * time.Second
+	// maxSkewDelay bounds how long after both tracks started their skew may
+	// be corrected: later, a track would jump well into the recording
+	maxSkewDelay = 10 * time.Second
+)
+
+// What tracks are placed by (see types.AVSyncStats)
+const (
+	skewSourceArrival = "arrival"
+	skewSourceRTCP    = "rtcp"
+)
+
+type pendingAudioSample struct {
+	data         []byte
+	duration     time.Duration
+	rtpTimestamp uint32
+}
+
+// Both tracks of a WebM file share a timeline starting at mediaStart. RTP
+// timestamps of different tracks have unrelated bases, so a track's first
+// block is placed at the wall clock time it started at relative to
+// mediaStart; later blocks advance by their RTP durations. That keeps tracks
+// starting seconds apart aligned instead of both starting at zero.
+
+// Locked
+func (r *WebmRecorder) resetTimelines() {
+	r.mediaStart = r.now()
+
+	// Dropped by leading trim otherwise
+	if len(r.pendingAudio) > 0 && r.pendingAudioStart.Before(r.mediaStart) && (!r.trimLeading || !r.hasVideo) {
+		r.mediaStart = r.pendingAudioStart
+	}
+
+	r.videoTimelineStarted = false
+	r.audioTimelineStarted = false
+
+	if r.skew != nil {
+		r.skew.videoAnchor, r.skew.audioAnchor = nil, nil
+		r.skew.startedAt = time.Time{}
+	}
+}
+
+// startTimeline offsets a track's timestamp on its first block. Returns
+// whether it did.
+// Locked
+func (r *WebmRecorder) startTimeline(timestamp *time.Duration, started *bool) bool {
+	if *started {
+		return false
+	}
+
+	*started = true
+	*timestamp = max(r.now().Sub(r.mediaStart), 0) + r.skewOffset(timestamp)
+
+	return true
+}
+
+// needsWebmWriter returns whether an expected track has no writer yet. Once
+// both are open, tracks that start late are offset rather than the file
+// being restarted.
+// Locked
+func (r *WebmRecorder) needsWebmWriter() bool {
+	return (r.videoWriter == nil && r.hasVideo) || (r.audioWriter == nil && r.hasAudio)
+}
+
+// queuePendingAudio keeps audio that arrives before video opened the file,
+// dropping the oldest samples past maxPendingAudio.
+// Locked
+func (r *WebmRecorder) queuePendingAudio(data []byte, duration time.Duration, rtpTimestamp uint32) {
+	if len(r.pendingAudio) == 0 {
+		r.pendingAudioStart = r.now()
+	}
+
+	r.pendingAudio = append(r.pendingAudio, pendingAudioSample{data: data, duration: duration, rtpTimestamp: rtpTimestamp})
+	r.pendingAudioDuration += duration
+
+	for r.pendingAudioDuration > maxPendingAudio && len(r.pendingAudio) > 1 {
+		dropped := r.pendingAudio[0]
+		r.pendingAudio = r.pendingAudio[1:]
+		r.pendingAudioDuration -= dropped.duration
+		r.pendingAudioStart = r.pendingAudioStart.Add(dropped.duration)
+	}
+}
+
+// Locked
+func (r *WebmRecorder) flushPendingAudio() {
+	if r.audioWriter == nil || len(r.pendingAudio) == 0 {
+		return
+	}
+
+	r.logger.Debugf("Writing %v of audio received before video", r.pendingAudioDuration)
+
+	r.audioTimestamp = max(r.pendingAudioStart.Sub(r.mediaStart), 0) + r.skewOffset(&r.audioTimestamp)
+	r.audioTimelineStarted = true
+
+	for _, sample := range r.pendingAudio {
+		r.writeWebmAudio(sample.data, sample.duration, sample.rtpTimestamp)
+	}
+
+	r.pendingAudio = nil
+	r.pendingAudioDuration = 0
+}
+
+// Placing tracks as they arrive leaves them as skewed as their paths to the
+// recorder: a track delayed more by the publisher, the network or the SFU
+// plays late. Sender Reports map each track's RTP timestamps to the
+// publisher's wall clock, which both share: comparing where a block of each
+// track was placed with when it was sent gives the skew, once. The track
+// placed ahead is then delayed by it, from then on and in every later file,
+// which leaves a gap the size of the correction in it.
+
+// senderClock maps RTP timestamps of a track to the publisher's wall clock
+type senderClock struct {
+	rtpTimestamp uint32
+	wallClock    time.Time
+}
+
+// at returns when the media of rtpTimestamp was sampled
+func (c *senderClock) at(rtpTimestamp, rate uint32) time.Time {
+	return c.wallClock.Add(time.Duration(int32(rtpTimestamp-c.rtpTimestamp)) * time.Second / time.Duration(rate))
+}
+
+// skewAnchor is where the latest block of a track, of RTP timestamp
+// rtpTimestamp, was placed in the file
+type skewAnchor struct {
+	rtpTimestamp uint32
+	timestamp    time.Duration
+}
+
+type skewCorrection struct {
+	maxCorrection time.Duration
+
+	videoClock, audioClock   *senderClock
+	videoAnchor, audioAnchor *skewAnchor
+	// When both tracks were first placed in the file
+	startedAt time.Time
+
+	// Whether the skew was measured or given up on, and the timeline it
+	// delayed, if any (videoTimestamp or audioTimestamp)
+	settled    bool
+	target     *time.Duration
+	correction time.Duration
+	stats      types.AVSyncStats
+}
+
+// ValidateAVSync checks the skew correction configuration
+func ValidateAVSync(cfg config.AVSync) error {
+	if cfg.Enable && cfg.MaxCorrection <= 0 {
+		return fmt.Errorf("invalid A/V sync max correction %s", cfg.MaxCorrection)
+	}
+
+	return nil
+}
+
+// EnableAVSync corrects the skew between audio and video on startup, as
+// validated by ValidateAVSync. The publisher's clock is given by
+// SetSenderClock. Must be called before any media is pushed.
+func (r *WebmRecorder) EnableAVSync(cfg config.AVSync) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if !cfg.Enable {
+		r.skew = nil
+		return
+	}
+
+	r.skew = &skewCorrection{
+		maxCorrection: cfg.MaxCorrection,
+		stats:         types.AVSyncStats{Source: skewSourceArrival},
+	}
+}
+
+// SetSenderClock maps the RTP timestamps of the video or audio track, as
+// pushed, to the publisher's wall clock: rtpTimestamp was sampled at
+// wallClock, as a Sender Report tells
+func (r *WebmRecorder) SetSenderClock(video bool, rtpTimestamp uint32, wallClock time.Time) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.skew == nil || r.skew.settled {
+		return
+	}
+
+	// Pushed packets are re-based (see discontinuity.go)
+	if video {
+		r.skew.videoClock = &senderClock{rtpTimestamp: rtpTimestamp + r.videoRebaser.offset, wallClock: wallClock}
+	} else {
+		r.skew.audioClock = &senderClock{rtpTimestamp: rtpTimestamp + r.audioRebaser.offset, wallClock: wallClock}
+	}
+
+	r.measureSkew()
+}
+
+// anchorSkew notes where a block of the video or audio track, of RTP
+// timestamp rtpTimestamp, was just placed
+// Locked
+func (r *WebmRecorder) anchorSkew(video bool, rtpTimestamp uint32) {
+	if r.skew == nil || r.skew.settled {
+		return
+	}
+
+	if video {
+		r.skew.videoAnchor = &skewAnchor{rtpTimestamp: rtpTimestamp, timestamp: r.videoTimestamp}
+	} else {
+		r.skew.audioAnchor = &skewAnchor{rtpTimestamp: rtpTimestamp, timestamp: r.audioTimestamp}
+	}
+
+	if r.skew.startedAt.IsZero() && r.skew.videoAnchor != nil && r.skew.audioAnchor != nil {
+		r.skew.startedAt = r.now()
+	}
+
+	r.measureSkew()
+}
+
+// skewOffset returns what the timeline of timestamp starts delayed by in
+// every file, once the skew was corrected
+// Locked
+func (r *WebmRecorder) skewOffset(timestamp *time.Duration) time.Duration {
+	if r.skew == nil || r.skew.target != timestamp {
+		return 0
+	}
+
+	return r.skew.correction
+}
+
+// Locked
+func (r *WebmRecorder) measureSkew() {
+	s := r.skew
+
+	if s.videoAnchor == nil || s.audioAnchor == nil {
+		return
+	}
+
+	if r.now().Sub(s.startedAt) > maxSkewDelay {
+		s.settled = true
+
+		r.logger.Infof("No Sender Reports within %s, audio and video stay placed as they arrived", maxSkewDelay)
+
+		return
+	}
+
+	if s.videoClock == nil || s.audioClock == nil || r.videoRate == 0 || r.audioRate == 0 {
+		return
+	}
+
+	sent := s.videoClock.at(s.videoAnchor.rtpTimestamp, r.videoRate).
+		Sub(s.audioClock.at(s.audioAnchor.rtpTimestamp, r.audioRate))
+	skew := (s.videoAnchor.timestamp - s.audioAnchor.timestamp) - sent
+	s.correction = min(skew.Abs(), s.maxCorrection)
+	s.settled = true
+	s.stats = types.AVSyncStats{
+		Source:       skewSourceRTCP,
+		SkewMs:       skew.Milliseconds(),
+		CorrectionMs: s.correction.Milliseconds(),
+		Clamped:      skew.Abs() > s.maxCorrection,
+	}
+
+	if s.correction == 0 {
+		return
+	}
+
+	if skew > 0 {
+		s.target, s.stats.Track = &r.audioTimestamp, "audio"
+	} else {
+		s.target, s.stats.Track = &r.videoTimestamp, "video"
+	}
+
+	*s.target += s.correction
+
+	r.logger.WithField("skew", skew).
+		WithField("clamped", s.stats.Clamped).
+		Infof("Delaying %s by %s to sync audio and video", s.stats.Track, s.correction)
+}
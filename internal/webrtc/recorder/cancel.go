@@ -0,0 +1,62 @@
+package recorder
+
+import (
+	"os"
+	"time"
+)
+
+// Cancel aborts the recording and deletes what it wrote: its file (or
+// segments and their manifest), IVF copy, proxy, raw output files (named
+// pipes are left alone) and snapshots. What's left to write is dropped
+// rather than finalized. It may be called concurrently with Close, or after
+// it: the files are deleted either way. Recordings written to a sink can't
+// be deleted, only cut short. Returns the media duration recorded.
+func (r *WebmRecorder) Cancel() time.Duration {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.stats.Canceled {
+		return r.videoTimestamp
+	}
+
+	r.stats.Canceled = true
+
+	// Nothing to finalize
+	r.flushGuard.tripped.Store(true)
+	ts := r.close()
+	var files []string
+
+	if r.sink == nil && r.file != "" && r.file != os.DevNull {
+		if r.segmenter != nil {
+			r.segmenter.discard()
+		} else if r.started {
+			files = append(files, r.file)
+		}
+
+		if r.writeIVFCopy {
+			files = append(files, replaceExt(r.file, ".ivf"))
+		}
+
+		if r.proxy != nil {
+			files = append(files, r.proxy.path)
+		}
+
+		files = append(files, r.rawOutputFiles()...)
+	}
+
+	for _, file := range files {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			r.logger.Warnf("Error removing canceled recording file: %v", err)
+		}
+	}
+
+	if dir := r.snapshotDir(); dir != "" {
+		if err := os.RemoveAll(dir); err != nil {
+			r.logger.Warnf("Error removing canceled recording snapshots: %v", err)
+		}
+	}
+
+	r.logger.Infof("Recording canceled, files removed: %s", r.file)
+
+	return ts
+}
@@ -0,0 +1,54 @@
+package recorder
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebmRecorder_Cancel(t *testing.T) {
+	tests := []struct {
+		name   string
+		cancel func(r *WebmRecorder)
+	}{
+		{"while recording", func(r *WebmRecorder) { r.Cancel() }},
+		{"after close", func(r *WebmRecorder) { r.Close(); r.Cancel() }},
+		{"racing close", func(r *WebmRecorder) {
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() { defer wg.Done(); r.Close() }()
+			go func() { defer wg.Done(); r.Cancel() }()
+			wg.Wait()
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, false)
+			r.SetHasAudio(true)
+
+			for i := 0; i < 10; i++ {
+				r.PushAudio(&rtp.Packet{
+					Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * 960)},
+					Payload: []byte{0xFC, 0xAA, 0xBB},
+				})
+			}
+
+			assert.FileExists(t, r.GetFilePath())
+
+			tt.cancel(r)
+
+			assert.NoFileExists(t, r.GetFilePath())
+			assert.True(t, r.GetStats().Canceled)
+			assert.False(t, r.GetStats().FlushTimedOut)
+
+			// Nothing written past it
+			r.PushAudio(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: 10, Timestamp: 9600}, Payload: []byte{0xFC}})
+			r.Close()
+			assert.NoFileExists(t, r.GetFilePath())
+		})
+	}
+}
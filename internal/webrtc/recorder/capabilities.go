@@ -0,0 +1,83 @@
+package recorder
+
+import (
+	"slices"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+)
+
+// Containers recordings are written in
+const (
+	ContainerWebM = "webm"
+	ContainerMKV  = "mkv"
+	ContainerMP4  = "mp4"
+	ContainerOgg  = "ogg"
+	ContainerWAV  = "wav"
+)
+
+// Recorder features a node may lack, depending on how it was built and
+// configured
+const (
+	FeatureAudioMix    = "audio_mix"
+	FeatureSnapshots   = "snapshots"
+	FeatureTranscoding = "transcoding"
+	FeatureSegments    = "segments"
+	FeatureRawOutput   = "raw_output"
+)
+
+// Capabilities is what the recordings of a node can be written as
+type Capabilities struct {
+	Containers []string
+	Features   []string
+}
+
+// SupportedCodecs returns the MIME types the recorder writes
+func SupportedCodecs() []string {
+	return []string{CodecVP8, CodecH264, CodecVP9, CodecAV1, CodecOpus, CodecMultiOpus}
+}
+
+// GetCapabilities returns the containers and features of recordings made
+// with cfg. WebM is written unless the codecs need Matroska (H.264), the
+// other containers only if enabled.
+func GetCapabilities(cfg config.Recorder) Capabilities {
+	c := Capabilities{
+		Containers: []string{ContainerWebM, ContainerMKV},
+		Features:   []string{},
+	}
+
+	if cfg.FMP4.Enable {
+		c.Containers = append(c.Containers, ContainerMP4)
+	}
+
+	if cfg.AudioOnlyOgg {
+		c.Containers = append(c.Containers, ContainerOgg)
+	}
+
+	if cfg.AudioOnlyWAV && opusCodingAvailable {
+		c.Containers = append(c.Containers, ContainerWAV)
+	}
+
+	if opusCodingAvailable {
+		c.Features = append(c.Features, FeatureAudioMix)
+	}
+
+	if cfg.Snapshots.Enable && videoDecodingAvailable {
+		c.Features = append(c.Features, FeatureSnapshots)
+	}
+
+	if cfg.Proxy.Enable {
+		c.Features = append(c.Features, FeatureTranscoding)
+	}
+
+	if cfg.Segments.Enable {
+		c.Features = append(c.Features, FeatureSegments)
+	}
+
+	if cfg.RawOutput.Enable && ValidateRawOutput(cfg.RawOutput) == nil {
+		c.Features = append(c.Features, FeatureRawOutput)
+	}
+
+	slices.Sort(c.Features)
+
+	return c
+}
@@ -0,0 +1,146 @@
+package recorder
+
+import (
+	"time"
+
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxFrameRepeat bounds the gaps filled with repeated frames. Longer ones
+// (e.g. a muted camera) are left as they are, the frames after them still
+// landing on the cadence.
+const maxFrameRepeat = 5 * time.Second
+
+// EnableConstantFrameRate writes video at fps frames per second: every
+// frame lands on a slot of that cadence, by its RTP timestamp. The previous
+// frame is repeated into the slots nothing arrived for, frames arriving for
+// a slot already written are dropped. 0 writes frames as they come. Must be
+// called before any media is pushed.
+func (r *WebmRecorder) EnableConstantFrameRate(fps int) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.constantFrameRate = max(fps, 0)
+}
+
+// frameDuration returns the duration of a frame at the constant frame rate
+// (ns), 0 if the rate isn't constant
+// Locked
+func (r *WebmRecorder) frameDuration() uint64 {
+	if r.constantFrameRate == 0 || !r.hasVideo {
+		return 0
+	}
+
+	return uint64(time.Second) / uint64(r.constantFrameRate)
+}
+
+// cfrWriters fits the video track of a file to the constant frame rate
+// Locked
+func (r *WebmRecorder) cfrWriters(writers []webm.BlockWriteCloser) []webm.BlockWriteCloser {
+	if r.constantFrameRate == 0 || !r.hasVideo || len(writers) == 0 {
+		return writers
+	}
+
+	if r.stats.ConstantFrameRate == nil {
+		r.stats.ConstantFrameRate = &types.ConstantFrameRateStats{FPS: r.constantFrameRate}
+	}
+
+	// Video comes first
+	writers[0] = &cfrWriter{r: r, w: writers[0], fps: int64(r.constantFrameRate)}
+
+	return writers
+}
+
+// cfrWriter writes a video track at a constant frame rate: frames are
+// written at multiples of 1/fps from the first one, in the slot closest to
+// their timestamp. A frame
+// may land a slot late when the previous one took its slot; later than
+// that, it's dropped. Frames following a dropped one are dropped too until
+// the next keyframe, since they may depend on it, and one is requested.
+type cfrWriter struct {
+	r   *WebmRecorder
+	w   webm.BlockWriteCloser
+	fps int64
+
+	started   bool
+	origin    int64 // Timestamp of slot 0 (ms)
+	next      int64 // Slot the next frame is due at
+	resyncing bool  // Dropping until the next keyframe
+
+	// The last frame written, repeated into the slots skipped over.
+	// Samples may share buffers that are reused once written.
+	last         []byte
+	lastKeyframe bool
+}
+
+// slot returns the slot closest to timestamp
+func (w *cfrWriter) slot(timestamp int64) int64 {
+	return ((timestamp-w.origin)*w.fps*2 + 1000) / 2000
+}
+
+// slotTimestamp returns when slot is due (ms)
+func (w *cfrWriter) slotTimestamp(slot int64) int64 {
+	return w.origin + (slot*2000/w.fps+1)/2
+}
+
+func (w *cfrWriter) Write(keyframe bool, timestamp int64, b []byte) (int, error) {
+	stats := w.r.stats.ConstantFrameRate
+
+	if !w.started {
+		w.started = true
+		w.origin = timestamp
+	}
+
+	if w.resyncing && !keyframe {
+		stats.DroppedFrames++
+		return len(b), nil
+	}
+
+	slot := w.slot(timestamp)
+
+	// The keyframe ending a resync is kept even if later than that, not to
+	// wait for yet another one
+	if slot < w.next-1 && !w.resyncing {
+		stats.DroppedFrames++
+		w.resyncing = true
+
+		if log.IsLevelEnabled(log.TraceLevel) {
+			w.r.logger.Tracef("Dropping frame at %dms, slot %d already written, waiting for a keyframe", timestamp, slot)
+		}
+
+		w.r.RequestKeyframe()
+
+		return len(b), nil
+	}
+
+	w.resyncing = false
+
+	if w.last != nil && time.Duration(slot-w.next)*time.Second/time.Duration(w.fps) <= maxFrameRepeat {
+		for ; w.next < slot; w.next++ {
+			if _, err := w.w.Write(w.lastKeyframe, w.slotTimestamp(w.next), w.last); err != nil {
+				return 0, err
+			}
+
+			stats.DuplicatedFrames++
+		}
+	}
+
+	slot = max(slot, w.next)
+	n, err := w.w.Write(keyframe, w.slotTimestamp(slot), b)
+
+	if err != nil {
+		return n, err
+	}
+
+	w.next = slot + 1
+	w.last = append(w.last[:0], b...)
+	w.lastKeyframe = keyframe
+
+	return n, nil
+}
+
+func (w *cfrWriter) Close() error {
+	return w.w.Close()
+}
@@ -0,0 +1,108 @@
+package recorder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCFRWriter(t *testing.T) {
+	r := NewWebmRecorder("", 0, 256, 64, false, false, false)
+	r.SetHasVideo(true)
+	r.EnableConstantFrameRate(10)
+	requester := &countingKeyframeRequester{}
+	r.SetKeyframeRequester(requester)
+
+	video := &blockRecorder{}
+	writers := r.cfrWriters([]webm.BlockWriteCloser{video})
+	require.Len(t, writers, 1)
+
+	write := func(keyframe bool, timestamp int64) {
+		n, err := writers[0].Write(keyframe, timestamp, []byte{0xAA})
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+	}
+
+	write(true, 1000)
+	write(false, 1090)
+	write(false, 1210)
+	assert.Equal(t, []writtenBlock{{true, 1000}, {false, 1100}, {false, 1200}}, video.blocks, "On the cadence")
+
+	// Gaps are filled with the previous frame
+	write(false, 1500)
+	assert.Equal(t, []writtenBlock{{false, 1300}, {false, 1400}, {false, 1500}}, video.blocks[3:])
+
+	// A slot late at most
+	write(false, 1530)
+	assert.Equal(t, writtenBlock{false, 1600}, video.blocks[6])
+
+	// Then dropped, with what follows until the next keyframe
+	write(false, 1540)
+	write(false, 1700)
+	assert.Len(t, video.blocks, 7)
+	assert.Equal(t, 1, requester.requests)
+
+	write(true, 1800)
+	assert.Equal(t, []writtenBlock{{false, 1700}, {true, 1800}}, video.blocks[7:])
+
+	// Keyframes are repeated as keyframes, long gaps aren't filled
+	write(false, 1900+maxFrameRepeat.Milliseconds())
+	assert.Equal(t, []writtenBlock{{true, 1900}}, video.blocks[9:10])
+	written := len(video.blocks)
+	write(false, 20000)
+	assert.Equal(t, []writtenBlock{{false, 20000}}, video.blocks[written:])
+
+	require.NoError(t, writers[0].Close())
+	assert.True(t, video.closed)
+
+	stats := r.GetStats().ConstantFrameRate
+	require.NotNil(t, stats)
+	assert.Equal(t, 10, stats.FPS)
+	assert.Equal(t, 2, stats.DroppedFrames)
+	assert.Equal(t, 3+maxFrameRepeat.Milliseconds()/100, int64(stats.DuplicatedFrames))
+}
+
+func TestWebmRecorder_ConstantFrameRate(t *testing.T) {
+	s := newAVSyncSource(t)
+	s.r.EnableConstantFrameRate(15)
+
+	s.run(2*time.Second, true, true)
+	s.r.Close()
+
+	stats := s.r.GetStats()
+	require.NotNil(t, stats.ConstantFrameRate)
+	assert.InDelta(t, 30, stats.ConstantFrameRate.DroppedFrames, 2, "Half of the 30fps frames")
+	assert.Zero(t, stats.ConstantFrameRate.DuplicatedFrames)
+	assert.Equal(t, uint64(time.Second/15), s.r.frameDuration())
+
+	// Only what's written is retimed
+	assert.InDelta(t, 2*time.Second, s.r.VideoTimestamp(), float64(50*time.Millisecond))
+	assert.InDelta(t, s.r.AudioTimestamp(), s.r.VideoTimestamp(), float64(50*time.Millisecond))
+}
+
+func TestWebmRecorder_VariableFrameRate(t *testing.T) {
+	s := newAVSyncSource(t)
+
+	s.run(time.Second, true, true)
+	s.r.Close()
+
+	assert.Nil(t, s.r.GetStats().ConstantFrameRate)
+	assert.Zero(t, s.r.frameDuration())
+}
+
+func TestWebmRecorder_ScreenShareFrameRate(t *testing.T) {
+	s := newAVSyncSource(t)
+	s.r.EnableConstantFrameRate(15)
+	s.r.SetVideoSource(VideoSourceScreenShare)
+
+	s.run(time.Second, true, true)
+	s.r.Close()
+
+	stats := s.r.GetStats()
+	assert.Nil(t, stats.ConstantFrameRate, "Screen shares are written as they come")
+	require.NotNil(t, stats.Video)
+	assert.Equal(t, VideoSourceScreenShare, stats.Video.Source)
+}
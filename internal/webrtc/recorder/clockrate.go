@@ -0,0 +1,155 @@
+package recorder
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/jech/samplebuilder"
+	"github.com/pion/rtp/codecs"
+)
+
+// Bounds of a sane RTP clock rate, from 8 kHz narrowband audio to well past
+// 90 kHz video
+const (
+	minClockRate = 1000
+	maxClockRate = 1000000
+)
+
+// ValidateClockRates checks the clock rate overrides of the recorder
+// configuration. Keys are codec MIME types (e.g. video/VP8) or RTP payload
+// types (e.g. 96).
+func ValidateClockRates(rates map[string]uint32) error {
+	for key, rate := range rates {
+		if rate < minClockRate || rate > maxClockRate {
+			return fmt.Errorf("clock rate %d for %s out of range [%d, %d]", rate, key, minClockRate, maxClockRate)
+		}
+
+		if pt, err := strconv.ParseUint(key, 10, 8); err == nil {
+			// The RTP header's payload type is 7 bits
+			if pt > 127 {
+				return fmt.Errorf("invalid payload type %s", key)
+			}
+
+			continue
+		}
+
+		switch codec := NormalizeMimeType(key); {
+		case codec == CodecOpus || codec == CodecMultiOpus:
+		case IsSupportedVideoCodec(codec):
+		default:
+			return fmt.Errorf("unsupported codec %s for clock rate override", key)
+		}
+	}
+
+	return nil
+}
+
+// SetClockRates sets the RTP clock rate overrides, as validated by
+// ValidateClockRates. A payload type's rate takes precedence over its
+// codec's. Must be called before any media is pushed.
+func (r *WebmRecorder) SetClockRates(rates map[string]uint32) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.clockRates = make(map[string]uint32, len(rates))
+
+	for key, rate := range rates {
+		if _, err := strconv.ParseUint(key, 10, 8); err != nil {
+			key = NormalizeMimeType(key)
+		}
+
+		r.clockRates[key] = rate
+	}
+
+	r.applyClockRates()
+}
+
+// clockRate returns the rate RTP timestamps of a track are converted with:
+// its payload type's override, else its codec's, else the codec's standard
+// rate. payloadType is -1 until the track's first packet.
+func (r *WebmRecorder) clockRate(codec string, payloadType int, standard uint32) (uint32, bool) {
+	if payloadType >= 0 {
+		if rate, ok := r.clockRates[strconv.Itoa(payloadType)]; ok {
+			return rate, true
+		}
+	}
+
+	if rate, ok := r.clockRates[codec]; ok {
+		return rate, true
+	}
+
+	return standard, false
+}
+
+func (r *WebmRecorder) audioCodec() string {
+	if r.audioFormat.mappingFamily() != 0 {
+		return CodecMultiOpus
+	}
+
+	return CodecOpus
+}
+
+// applyClockRates picks the clock rates of the tracks, rebuilding the sample
+// builders whose rate changed. Only called before a track's first sample
+// was built. Locked
+func (r *WebmRecorder) applyClockRates() {
+	if rate, override := r.clockRate(r.videoCodec, r.videoPayloadType, videoClockRate(r.videoCodec)); rate != r.videoRate {
+		r.videoRate = rate
+		r.videoBuilder = r.newVideoBuilder()
+
+		if override {
+			r.logger.Infof("Using clock rate override %d Hz for video %s (payload type %d)", rate, r.videoCodec, r.videoPayloadType)
+		}
+	}
+
+	if rate, override := r.clockRate(r.audioCodec(), r.audioPayloadType, opusSampleRate); rate != r.audioRate {
+		r.audioRate = rate
+		r.audioBuilder = r.newAudioBuilder()
+
+		if override {
+			r.logger.Infof("Using clock rate override %d Hz for audio %s (payload type %d)", rate, r.audioCodec(), r.audioPayloadType)
+		}
+	}
+}
+
+// notePayloadType records the payload type of a track's first packet, in
+// case an override applies to it
+func (r *WebmRecorder) notePayloadType(payloadType *int, pt uint8) {
+	// Set once, before media flows
+	if len(r.clockRates) == 0 {
+		return
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if *payloadType >= 0 {
+		return
+	}
+
+	*payloadType = int(pt)
+	r.applyClockRates()
+}
+
+// newVideoBuilder returns a sample builder for the current video codec and
+// clock rate, handing the packets it releases to the video recycler. Locked
+func (r *WebmRecorder) newVideoBuilder() *samplebuilder.SampleBuilder {
+	depacketizer := newVideoDepacketizer(r.videoCodec)
+
+	switch r.videoCodec {
+	case CodecVP9:
+		r.vp9Depacketizer = depacketizer.(*vp9Depacketizer)
+	case CodecAV1:
+		r.av1Depacketizer = depacketizer.(*av1Depacketizer)
+	}
+
+	return samplebuilder.New(r.videoPacketQueueSize, depacketizer, r.videoRate,
+		samplebuilder.WithPacketReleaseHandler(r.videoRecycler.release))
+}
+
+// newAudioBuilder returns a sample builder for Opus at the current clock
+// rate, handing the packets it releases to the audio recycler. Locked
+func (r *WebmRecorder) newAudioBuilder() *samplebuilder.SampleBuilder {
+	return samplebuilder.New(r.audioPacketQueueSize, &codecs.OpusPacket{}, r.audioRate,
+		samplebuilder.WithPacketReleaseHandler(r.audioRecycler.release))
+}
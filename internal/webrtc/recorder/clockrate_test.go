@@ -0,0 +1,105 @@
+package recorder
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateClockRates(t *testing.T) {
+	tests := []struct {
+		name    string
+		rates   map[string]uint32
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"codecs", map[string]uint32{"video/VP8": 90000, "audio/opus": 16000, "video/h264": 90000}, false},
+		{"payload type", map[string]uint32{"96": 90000}, false},
+		{"zero", map[string]uint32{"video/vp8": 0}, true},
+		{"too high", map[string]uint32{"video/vp8": 90000000}, true},
+		{"payload type out of range", map[string]uint32{"200": 90000}, true},
+		{"unknown codec", map[string]uint32{"video/h265": 90000}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateClockRates(tt.rates)
+
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func pushAudioEvery(r Recorder, payloadType uint8, step uint32, count int) {
+	for i := 0; i < count; i++ {
+		r.PushAudio(&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    payloadType,
+				SequenceNumber: uint16(i),
+				Timestamp:      uint32(i) * step,
+			},
+			// CELT 20ms, stereo
+			Payload: []byte{0xFC, 0xAA, 0xBB},
+		})
+	}
+}
+
+func TestWebmRecorder_ClockRates(t *testing.T) {
+	tests := []struct {
+		name  string
+		rates map[string]uint32
+	}{
+		{"codec", map[string]uint32{"audio/OPUS": 16000}},
+		{"payload type", map[string]uint32{"111": 16000, "audio/opus": 8000}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, true)
+			r.SetHasAudio(true)
+			r.SetClockRates(tt.rates)
+
+			// 20ms frames of a 16 kHz clock
+			pushAudioEvery(r, 111, 320, 10)
+			r.Close()
+
+			written := r.GetStats().Audio.WrittenSamples
+			require.Positive(t, written)
+			assert.Equal(t, int64(written-1)*20, r.AudioTimestamp().Milliseconds())
+		})
+	}
+
+	// Overrides for other payload types don't apply
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, true)
+	r.SetHasAudio(true)
+	r.SetClockRates(map[string]uint32{"96": 16000})
+
+	pushAudioEvery(r, 111, 960, 10)
+	r.Close()
+
+	written := r.GetStats().Audio.WrittenSamples
+	require.Positive(t, written)
+	assert.Equal(t, int64(written-1)*20, r.AudioTimestamp().Milliseconds())
+	assert.Equal(t, uint32(opusSampleRate), r.audioRate)
+}
+
+func TestWebmRecorder_ClockRatesVideoCodec(t *testing.T) {
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, false)
+	r.SetClockRates(map[string]uint32{"video/vp9": 45000})
+	assert.Equal(t, uint32(vp8SampleRate), r.videoRate)
+
+	require.NoError(t, r.SetVideoCodec("video/VP9"))
+	assert.Equal(t, uint32(45000), r.videoRate)
+	assert.NotNil(t, r.vp9Depacketizer)
+
+	require.NoError(t, r.SetVideoCodec("video/H264"))
+	assert.Equal(t, uint32(h264SampleRate), r.videoRate)
+}
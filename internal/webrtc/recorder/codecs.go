@@ -0,0 +1,99 @@
+package recorder
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+// Normalized (lowercase) MIME types understood by the recorder
+const (
+	CodecVP8  = "video/vp8"
+	CodecH264 = "video/h264"
+	CodecVP9  = "video/vp9"
+	CodecAV1  = "video/av1"
+	CodecOpus = "audio/opus"
+	// Chrome's multichannel Opus (more than 2 channels)
+	CodecMultiOpus = "audio/multiopus"
+)
+
+const (
+	h264SampleRate = 90000
+)
+
+// NormalizeMimeType lowercases a MIME type so it can be compared with the
+// Codec* constants regardless of how the adapter reported it.
+func NormalizeMimeType(mimeType string) string {
+	return strings.ToLower(mimeType)
+}
+
+// IsSupportedVideoCodec returns whether the recorder is able to write the
+// given video MIME type
+func IsSupportedVideoCodec(mimeType string) bool {
+	switch NormalizeMimeType(mimeType) {
+	case CodecVP8, CodecH264, CodecVP9, CodecAV1:
+		return true
+	default:
+		return false
+	}
+}
+
+// Matroska CodecIDs for each supported video codec
+func videoCodecID(mimeType string) string {
+	switch mimeType {
+	case CodecH264:
+		return "V_MPEG4/ISO/AVC"
+	case CodecVP9:
+		return "V_VP9"
+	case CodecAV1:
+		return "V_AV1"
+	default:
+		return "V_VP8"
+	}
+}
+
+// Formats that are not part of the WebM subset must be written to a full
+// Matroska container.
+func requiresMatroska(mimeType string) bool {
+	return mimeType == CodecH264
+}
+
+func newVideoDepacketizer(mimeType string) rtp.Depacketizer {
+	switch mimeType {
+	case CodecH264:
+		// AVC (length-prefixed) NALUs are what Matroska expects
+		return &codecs.H264Packet{IsAVC: true}
+	case CodecVP9:
+		return &vp9Depacketizer{}
+	case CodecAV1:
+		return &av1Depacketizer{}
+	default:
+		return &codecs.VP8Packet{}
+	}
+}
+
+func videoClockRate(mimeType string) uint32 {
+	switch mimeType {
+	case CodecH264:
+		return h264SampleRate
+	case CodecVP9:
+		return vp9SampleRate
+	case CodecAV1:
+		return av1SampleRate
+	default:
+		return vp8SampleRate
+	}
+}
+
+// replaceExt swaps the extension of file with ext. Writes to /dev/null are
+// left untouched.
+func replaceExt(file string, ext string) string {
+	if file == os.DevNull {
+		return file
+	}
+
+	return strings.TrimSuffix(file, filepath.Ext(file)) + ext
+}
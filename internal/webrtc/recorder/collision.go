@@ -0,0 +1,124 @@
+package recorder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How a recording whose file is taken is handled (see
+// config.Recorder.FileCollision)
+const (
+	FileCollisionError     = "error"
+	FileCollisionSuffix    = "suffix"
+	FileCollisionTimestamp = "timestamp"
+)
+
+// Gives up on suffixes past this
+const maxFileCollisionSuffix = 1000
+
+// Files of recordings in progress, taken even if nothing was written to them
+// yet. Their recorder releases them once closed.
+var claimedFiles = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+// ValidateFileCollision returns an error if mode isn't one of FileCollision
+func ValidateFileCollision(mode string) error {
+	switch mode {
+	case "", FileCollisionError, FileCollisionSuffix, FileCollisionTimestamp:
+		return nil
+	default:
+		return fmt.Errorf("invalid file collision mode %q", mode)
+	}
+}
+
+// claimFile takes the file of a recording, or another one if it's taken and
+// mode allows for it, e.g. rec-1.webm or rec-20060102T150405Z.webm for
+// rec.webm. Returns the file taken.
+func claimFile(file, mode string, now time.Time) (string, error) {
+	claimedFiles.Lock()
+	defer claimedFiles.Unlock()
+
+	if !fileTaken(file) {
+		claimedFiles.paths[file] = true
+		return file, nil
+	}
+
+	ext := filepath.Ext(file)
+	base := strings.TrimSuffix(file, ext)
+
+	switch mode {
+	case FileCollisionSuffix:
+	case FileCollisionTimestamp:
+		base = fmt.Sprintf("%s-%s", base, now.UTC().Format("20060102T150405Z"))
+
+		if candidate := base + ext; !fileTaken(candidate) {
+			claimedFiles.paths[candidate] = true
+			return candidate, nil
+		}
+	default:
+		return "", fmt.Errorf("file already exists %s", file)
+	}
+
+	// Numbered from 1, after the timestamp if any
+	for i := 1; i <= maxFileCollisionSuffix; i++ {
+		if candidate := fmt.Sprintf("%s-%d%s", base, i, ext); !fileTaken(candidate) {
+			claimedFiles.paths[candidate] = true
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("file already exists %s, no free name found", file)
+}
+
+// switchFile moves the recording to file, its own with another extension.
+// If it was claimed, the requested file with that extension is, resolving
+// collisions the same way, and the claim of its current file released.
+// Locked
+func (r *WebmRecorder) switchFile(file string) error {
+	if r.claimedFile == "" {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			return fmt.Errorf("file already exists %s", file)
+		}
+
+		r.file = file
+
+		return nil
+	}
+
+	claimed, err := claimFile(replaceExt(r.requestedFile, filepath.Ext(file)), r.fileCollision, r.claimTime)
+
+	if err != nil {
+		return err
+	}
+
+	releaseFile(r.claimedFile)
+	r.claimedFile = claimed
+	r.file = claimed
+
+	return nil
+}
+
+// Locked
+func fileTaken(file string) bool {
+	if claimedFiles.paths[file] {
+		return true
+	}
+
+	_, err := os.Stat(file)
+
+	return !os.IsNotExist(err)
+}
+
+// releaseFile frees a file claimed by claimFile
+func releaseFile(file string) {
+	claimedFiles.Lock()
+	defer claimedFiles.Unlock()
+
+	delete(claimedFiles.paths, file)
+}
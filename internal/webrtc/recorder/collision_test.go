@@ -0,0 +1,150 @@
+package recorder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "rec.webm")
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	claimed, err := claimFile(file, FileCollisionError, now)
+	require.NoError(t, err)
+	assert.Equal(t, file, claimed)
+
+	// Taken by a recording in progress, nothing written yet
+	_, err = claimFile(file, FileCollisionError, now)
+	assert.ErrorContains(t, err, "file already exists")
+
+	claimed, err = claimFile(file, FileCollisionSuffix, now)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "rec-1.webm"), claimed)
+
+	// Taken by an existing file
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "rec-2.webm"), nil, 0600))
+	claimed, err = claimFile(file, FileCollisionSuffix, now)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "rec-3.webm"), claimed)
+
+	claimed, err = claimFile(file, FileCollisionTimestamp, now)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "rec-20260102T150405Z.webm"), claimed)
+
+	claimed, err = claimFile(file, FileCollisionTimestamp, now)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "rec-20260102T150405Z-1.webm"), claimed)
+
+	releaseFile(file)
+	claimed, err = claimFile(file, FileCollisionError, now)
+	require.NoError(t, err)
+	assert.Equal(t, file, claimed, "Released")
+}
+
+func TestNewRecorder_FileCollision(t *testing.T) {
+	cfg := config.Recorder{
+		Directory:            t.TempDir(),
+		DirFileMode:          "0700",
+		FileMode:             "0600",
+		FileCollision:        FileCollisionSuffix,
+		VideoPacketQueueSize: 256,
+		AudioPacketQueueSize: 64,
+	}
+
+	first, err := NewRecorder(context.Background(), cfg, "rec.webm")
+	require.NoError(t, err)
+	second, err := NewRecorder(context.Background(), cfg, "rec.webm")
+	require.NoError(t, err)
+
+	assert.Equal(t, filepath.Join(cfg.Directory, "rec.webm"), first.GetFilePath())
+	assert.Equal(t, filepath.Join(cfg.Directory, "rec-1.webm"), second.GetFilePath())
+
+	first.Close()
+	second.Close()
+
+	cfg.FileCollision = FileCollisionError
+	third, err := NewRecorder(context.Background(), cfg, "rec.webm")
+	require.NoError(t, err, "Closed without media, the file is free again")
+	third.Close()
+}
+
+func TestNewRecorder_FileCollisionContainer(t *testing.T) {
+	newConfig := func(mode string) config.Recorder {
+		return config.Recorder{
+			Directory:            t.TempDir(),
+			DirFileMode:          "0700",
+			FileMode:             "0600",
+			FileCollision:        mode,
+			VideoPacketQueueSize: 256,
+			AudioPacketQueueSize: 64,
+			AudioOnlyOgg:         true,
+		}
+	}
+
+	t.Run("mkv", func(t *testing.T) {
+		cfg := newConfig(FileCollisionSuffix)
+		require.NoError(t, os.WriteFile(filepath.Join(cfg.Directory, "rec.mkv"), nil, 0600))
+
+		r, err := NewRecorder(context.Background(), cfg, "rec.webm")
+		require.NoError(t, err)
+		defer r.Close()
+
+		require.NoError(t, r.SetVideoCodec(webrtc.MimeTypeH264))
+		assert.Equal(t, filepath.Join(cfg.Directory, "rec-1.mkv"), r.GetFilePath())
+
+		// The claim of the webm one was released
+		claimed, err := claimFile(filepath.Join(cfg.Directory, "rec.webm"), FileCollisionError, time.Now())
+		require.NoError(t, err)
+		releaseFile(claimed)
+	})
+
+	t.Run("mkv, error", func(t *testing.T) {
+		cfg := newConfig(FileCollisionError)
+		require.NoError(t, os.WriteFile(filepath.Join(cfg.Directory, "rec.mkv"), nil, 0600))
+
+		r, err := NewRecorder(context.Background(), cfg, "rec.webm")
+		require.NoError(t, err)
+		defer r.Close()
+
+		assert.ErrorContains(t, r.SetVideoCodec(webrtc.MimeTypeH264), "file already exists")
+		assert.Equal(t, filepath.Join(cfg.Directory, "rec.webm"), r.GetFilePath())
+	})
+
+	t.Run("ogg", func(t *testing.T) {
+		cfg := newConfig(FileCollisionSuffix)
+
+		// Taken by another audio only recording, nothing written yet
+		other, err := NewRecorder(context.Background(), cfg, "rec.webm")
+		require.NoError(t, err)
+		defer other.Close()
+
+		other.SetHasAudio(true)
+		require.Equal(t, filepath.Join(cfg.Directory, "rec.ogg"), other.GetFilePath())
+
+		r, err := NewRecorder(context.Background(), cfg, "rec.webm")
+		require.NoError(t, err)
+		defer r.Close()
+
+		r.SetHasAudio(true)
+		assert.Equal(t, filepath.Join(cfg.Directory, "rec-1.ogg"), r.GetFilePath())
+
+		// Back to webm, now free
+		r.SetHasVideo(true)
+		assert.Equal(t, filepath.Join(cfg.Directory, "rec.webm"), r.GetFilePath())
+	})
+}
+
+func TestValidateFileCollision(t *testing.T) {
+	assert.NoError(t, ValidateFileCollision(""))
+	assert.NoError(t, ValidateFileCollision(FileCollisionTimestamp))
+	assert.Error(t, ValidateFileCollision("overwrite"))
+}
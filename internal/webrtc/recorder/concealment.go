@@ -0,0 +1,187 @@
+package recorder
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+)
+
+const (
+	// maxConcealedAudio bounds the PLC inserted for a single gap; longer
+	// ones are mostly filled with silence by decoders anyway, and past that
+	// the remainder is left as a gap
+	maxConcealedAudio = 200 * time.Millisecond
+	// maxPendingAudioLosses bounds the losses noted but not reached yet, in
+	// case the samples following them never get built
+	maxPendingAudioLosses = 1024
+	// lossMarkerMaxDelay bounds how long the block sorter holds blocks while
+	// waiting for the sparse marker track
+	lossMarkerMaxDelay = 1000 // ms
+	// Matroska metadata track, as used by WebVTT metadata in WebM
+	lossMarkerTrackType = 0x21
+	lossMarkerCodecID   = "D_WEBVTT/METADATA"
+)
+
+// lossMarker is the payload of a loss marker block, placed at the first
+// video frame written after the loss
+type lossMarker struct {
+	LostPackets int   `json:"lostPackets"`
+	FromMs      int64 `json:"fromMs"`
+	ToMs        int64 `json:"toMs"`
+}
+
+// EnableLossConcealment fills the gaps left by lost packets. Must be called
+// before any media is pushed.
+func (r *WebmRecorder) EnableLossConcealment(cfg config.LossConcealment) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.concealAudioLoss = cfg.Audio
+	r.concealVideoLoss = cfg.Video
+
+	if r.concealAudioLoss && r.audioLosses == nil {
+		r.audioLosses = make(map[uint32]struct{})
+	}
+}
+
+// noteAudioLoss records that packets were lost before the one with
+// rtpTimestamp, to be concealed once its sample is written
+// Locked
+func (r *WebmRecorder) noteAudioLoss(rtpTimestamp uint32) {
+	if !r.concealAudioLoss {
+		return
+	}
+
+	if len(r.audioLosses) >= maxPendingAudioLosses {
+		clear(r.audioLosses)
+	}
+
+	r.audioLosses[rtpTimestamp] = struct{}{}
+}
+
+// concealAudio returns the samples to write for one built from the audio
+// track: itself, preceded by Opus PLC frames covering the packets lost
+// before it. The sample's duration spans the gap since the previous one, so
+// it's shared with the PLC frames. Samples late packets completed, DTX and
+// pause gaps are left as they are. The result is only valid until the next
+// call.
+// Locked
+func (r *WebmRecorder) concealAudio(data []byte, duration time.Duration, rtpTimestamp uint32) []pendingAudioSample {
+	samples := append(r.concealScratch[:0], pendingAudioSample{data: data, duration: duration, rtpTimestamp: rtpTimestamp})
+	r.concealScratch = samples
+
+	if _, ok := r.audioLosses[rtpTimestamp]; !ok {
+		return samples
+	}
+
+	delete(r.audioLosses, rtpTimestamp)
+
+	if r.audioGapPending {
+		return samples
+	}
+
+	// Opus TOCs count 48 kHz samples whatever the RTP clock rate
+	frameSamples := opusPacketSamples(data)
+
+	if frameSamples == 0 {
+		return samples
+	}
+
+	frame := time.Duration(frameSamples) * time.Second / opusSampleRate
+	lost := min(int(duration/frame)-1, int(maxConcealedAudio/frame))
+
+	if lost <= 0 {
+		return samples
+	}
+
+	// A code 0 packet without a frame: decoders run their PLC for its
+	// duration. Same configuration and channels as the packet that follows.
+	plc := []byte{data[0] &^ 0x03}
+	step := uint32(uint64(frameSamples) * uint64(r.audioRate) / opusSampleRate)
+	concealed := make([]pendingAudioSample, 0, lost+1)
+
+	for i := lost; i > 0; i-- {
+		concealed = append(concealed, pendingAudioSample{
+			data:         plc,
+			duration:     frame,
+			rtpTimestamp: rtpTimestamp - uint32(i)*step,
+		})
+	}
+
+	r.stats.Audio.ConcealedFrames += lost
+	r.logger.WithField("frames", lost).
+		WithField("rtp_timestamp", rtpTimestamp).
+		Debug("Concealing lost audio packets")
+
+	return append(concealed, pendingAudioSample{
+		data:         data,
+		duration:     duration - time.Duration(lost)*frame,
+		rtpTimestamp: rtpTimestamp,
+	})
+}
+
+// writesLossMarkers returns whether a WebM/MKV file gets a marker track,
+// for losses or mutes. Segments and fMP4 have a fixed set of tracks.
+// Locked
+func (r *WebmRecorder) writesLossMarkers() bool {
+	return (r.concealVideoLoss || r.muteMarkers) && r.hasVideo && !r.isSegmented() && r.containerExt() != ".mp4"
+}
+
+// lossMarkerTrack returns the metadata track loss (and mute) markers are
+// written to
+func lossMarkerTrack(trackNumber uint64) webm.TrackEntry {
+	return webm.TrackEntry{
+		Name:        "Loss markers",
+		TrackNumber: trackNumber,
+		TrackUID:    67890,
+		CodecID:     lossMarkerCodecID,
+		TrackType:   lossMarkerTrackType,
+	}
+}
+
+// noteVideoLoss records that video packets were lost, to be marked at the
+// next frame written. Gaps of a pause aren't losses.
+// Locked
+func (r *WebmRecorder) noteVideoLoss(gap uint16) {
+	if r.lossMarkerWriter == nil || !r.concealVideoLoss || r.videoGapPending {
+		return
+	}
+
+	r.videoLostPackets += int(gap)
+}
+
+// markVideoLoss writes a marker spanning the frames lost since the previous
+// one written, if packets were lost. Players show the previous frame until
+// the next one's timestamp either way; the marker tells where that's
+// standing in for lost frames.
+// Locked
+func (r *WebmRecorder) markVideoLoss() {
+	from := r.lastVideoFrameTimestamp
+	r.lastVideoFrameTimestamp = r.videoTimestamp
+
+	if r.lossMarkerWriter == nil || r.videoLostPackets == 0 {
+		return
+	}
+
+	marker := lossMarker{
+		LostPackets: r.videoLostPackets,
+		FromMs:      from.Milliseconds(),
+		ToMs:        r.videoTimestamp.Milliseconds(),
+	}
+	r.videoLostPackets = 0
+
+	payload, err := json.Marshal(marker)
+
+	if err != nil {
+		return
+	}
+
+	if _, err := r.lossMarkerWriter.Write(true, marker.ToMs, payload); err != nil {
+		r.logger.Warnf("Error writing loss marker: %v", err)
+		return
+	}
+
+	r.stats.Video.ConcealedFrames++
+}
@@ -0,0 +1,142 @@
+package recorder
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pushOpusWithLoss pushes count 20ms packets, leaving out the lost ones
+func pushOpusWithLoss(r Recorder, count int, lost ...int) {
+	for i := 0; i < count; i++ {
+		if slices.Contains(lost, i) {
+			continue
+		}
+
+		r.PushAudio(&rtp.Packet{
+			Header: rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * 960)},
+			// CELT 20ms, stereo
+			Payload: []byte{0xFC, 0xAA, 0xBB},
+		})
+	}
+}
+
+func TestWebmRecorder_AudioLossConcealment(t *testing.T) {
+	tests := []struct {
+		name    string
+		ogg     bool
+		conceal bool
+	}{
+		{"webm", false, true},
+		{"ogg", true, true},
+		{"disabled", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, tt.ogg)
+			r.SetHasAudio(true)
+			r.EnableLossConcealment(config.LossConcealment{Audio: tt.conceal})
+
+			pushOpusWithLoss(r, 200, 50, 51, 52)
+			r.Close()
+
+			stats := r.GetStats().Audio
+
+			if !tt.conceal {
+				assert.Zero(t, stats.ConcealedFrames)
+				assert.Equal(t, 197, stats.TotalSamples)
+				return
+			}
+
+			assert.Equal(t, 3, stats.ConcealedFrames)
+			assert.Equal(t, 200, stats.TotalSamples, "PLC frames fill the gap")
+			// Same timeline either way
+			assert.Equal(t, int64(199*20), r.AudioTimestamp().Milliseconds())
+		})
+	}
+}
+
+func TestWebmRecorder_AudioLossConcealmentFrames(t *testing.T) {
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, false)
+	r.SetHasAudio(true)
+	r.EnableLossConcealment(config.LossConcealment{Audio: true})
+	r.initAudioStats()
+
+	// Not following a loss
+	data := []byte{0xFC, 0xAA, 0xBB}
+	samples := r.concealAudio(data, 60*time.Millisecond, 2880)
+	assert.Len(t, samples, 1, "DTX gaps aren't concealed")
+
+	r.noteAudioLoss(2880)
+	samples = r.concealAudio(data, 60*time.Millisecond, 2880)
+	require.Len(t, samples, 3)
+
+	for i, sample := range samples[:2] {
+		assert.Equal(t, []byte{0xFC}, sample.data, "Code 0 and no frame")
+		assert.Equal(t, 20*time.Millisecond, sample.duration)
+		assert.Equal(t, uint32(960*(i+1)), sample.rtpTimestamp)
+	}
+
+	assert.Equal(t, data, samples[2].data)
+	assert.Equal(t, 20*time.Millisecond, samples[2].duration)
+
+	// Long gaps are only partly concealed
+	r.noteAudioLoss(48000)
+	samples = r.concealAudio(data, time.Second, 48000)
+	require.Len(t, samples, 11)
+	assert.Equal(t, 800*time.Millisecond, samples[10].duration)
+
+	// Nor are pauses
+	r.noteAudioLoss(96000)
+	r.audioGapPending = true
+	assert.Len(t, r.concealAudio(data, time.Second, 96000), 1)
+}
+
+func TestWebmRecorder_VideoLossMarkers(t *testing.T) {
+	for _, conceal := range []bool{true, false} {
+		s := newAVSyncSource(t)
+		s.r.EnableLossConcealment(config.LossConcealment{Video: conceal})
+
+		s.run(time.Second, true, true)
+
+		// Two frames lost
+		s.videoSeq += 2
+		s.videoTs += 6000
+
+		// Long enough for the sample builder to give up on them
+		s.run(10*time.Second, true, true)
+		s.r.Close()
+
+		data, err := os.ReadFile(s.r.GetFilePath())
+		require.NoError(t, err)
+
+		if !conceal {
+			assert.NotContains(t, string(data), lossMarkerCodecID)
+			assert.Zero(t, s.r.GetStats().Video.ConcealedFrames)
+			continue
+		}
+
+		assert.Contains(t, string(data), lossMarkerCodecID)
+		assert.Contains(t, string(data), `"lostPackets":2`)
+		assert.Equal(t, 1, s.r.GetStats().Video.ConcealedFrames)
+		assert.InDelta(t, s.r.VideoTimestamp(), s.r.AudioTimestamp(), float64(100*time.Millisecond))
+	}
+}
+
+func TestWebmRecorder_VideoLossMarkersSegmented(t *testing.T) {
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, false)
+	r.SetHasVideo(true)
+	r.EnableLossConcealment(config.LossConcealment{Video: true})
+	assert.True(t, r.writesLossMarkers())
+
+	require.NoError(t, r.EnableSegments(config.Segments{Enable: true, Duration: time.Minute}))
+	assert.False(t, r.writesLossMarkers(), "Segments have a fixed set of tracks")
+}
@@ -0,0 +1,519 @@
+package recorder
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/at-wat/ebml-go"
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// WebM/MKV recordings are streamed by the muxer: they get no cues, nor a
+// duration, unless recovered. With a cue flush interval, the file is
+// indexed as it's written instead. The stream is parsed on its way to the
+// file, room is reserved for a seek head at the start of the segment and
+// for the duration in its info, and, each time a cluster ends with cue
+// points left to write, every flush interval of media at most, the new ones
+// are added to the cues. Cues are written after a cluster with room to grow
+// as much again, a void element their points are written over, and are only
+// written again, after a later cluster and with twice the room, once it's
+// full: what's written grows with the recording, not with each flush. New
+// points are written over the void but for its header, then a new header
+// is written over it, so a file the recorder dies with always has complete
+// cues. The seek head and the duration are written over their room, the
+// seek head only once the cues it points to are complete, and the cues it
+// no longer points to are made void. Cue points are as RecoverWebM makes
+// them: one per cluster, at its first keyframe of the video track (the
+// first track of audio-only recordings).
+
+// maxClusterDuration is the longest a cluster lasts, in ms: block
+// timecodes are relative to their cluster's, on 16 bits
+const maxClusterDuration = 0x7FFF
+
+// ValidateCues checks the cues configuration
+func ValidateCues(cfg config.Cues) error {
+	if cfg.FlushInterval < 0 || cfg.FlushInterval > maxClusterDuration*time.Millisecond {
+		return fmt.Errorf("invalid cues flush interval %s (must be 0 to %s)", cfg.FlushInterval, maxClusterDuration*time.Millisecond)
+	}
+
+	return nil
+}
+
+// EnableCues indexes the WebM/MKV files the recording is written to every
+// cfg.FlushInterval of media, if set. Must be called before any media is
+// pushed.
+func (r *WebmRecorder) EnableCues(cfg config.Cues) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.cueFlushInterval = cfg.FlushInterval
+}
+
+// indexFile returns w, a file of the recording, indexed as it's written if
+// enabled. Files that can't be written back over (e.g. encrypted) aren't.
+// Locked
+func (r *WebmRecorder) indexFile(w io.WriteCloser) io.WriteCloser {
+	if r.cueFlushInterval <= 0 {
+		return w
+	}
+
+	if ext := r.containerExt(); ext != ".webm" && ext != ".mkv" {
+		return w
+	}
+
+	ws, ok := w.(io.WriteSeeker)
+
+	if !ok {
+		return w
+	}
+
+	return &cueWriter{
+		ctx:      r.ctx,
+		w:        w,
+		seeker:   ws,
+		interval: uint64(r.cueFlushInterval.Milliseconds()),
+	}
+}
+
+// Sizes of what's written over the room reserved for it
+var (
+	cuesSeekHeadSize = len(cuesSeekHead(0))
+	durationSize     = len(durationElement(0))
+)
+
+// cuesSeekHead is a seek head pointing to cues at position
+func cuesSeekHead(position int64) []byte {
+	return ebmlElement(idSeekHead, ebmlElement(idSeek,
+		ebmlElement(idSeekID, binary.BigEndian.AppendUint32(nil, idCues)),
+		ebmlElement(idSeekPosition, binary.BigEndian.AppendUint64(nil, uint64(position))),
+	))
+}
+
+// durationElement is the duration of a segment, in ms
+func durationElement(duration int64) []byte {
+	return ebmlElement(idDuration, binary.BigEndian.AppendUint64(nil, math.Float64bits(float64(duration))))
+}
+
+// voidHeaderSize is the size of the header of void elements written: 1 byte
+// ID, 8 bytes size
+const voidHeaderSize = 9
+
+// minCuesRoom is the least room cues are written with, in bytes
+const minCuesRoom = 4096
+
+// voidElement is room for size bytes, as a void element
+func voidElement(size int) []byte {
+	return append(voidHeader(size), make([]byte, size-voidHeaderSize)...)
+}
+
+// voidHeader is the header of a void element of size bytes
+func voidHeader(size int) []byte {
+	return append([]byte{idVoid}, ebmlSize(uint64(size-voidHeaderSize))...)
+}
+
+// marshalCuePoints returns points as written in cues
+func marshalCuePoints(points []webm.CuePoint) ([]byte, error) {
+	var b bytes.Buffer
+
+	err := ebml.Marshal(&struct {
+		CuePoint []webm.CuePoint `ebml:"CuePoint"`
+	}{points}, &b)
+
+	return b.Bytes(), err
+}
+
+// filePatch is data written over a file at an offset
+type filePatch struct {
+	at   int64
+	data []byte
+}
+
+// Block headers are read up to their flags: track number (up to 8
+// bytes), timecode and flags
+const maxBlockHeaderSize = 11
+
+// cueWriter indexes the WebM/MKV stream written to w, a seekable file
+type cueWriter struct {
+	ctx      context.Context
+	w        io.WriteCloser
+	seeker   io.Seeker
+	interval uint64 // ms
+
+	// Written to w so far, where the segment's data starts and where the
+	// room for the seek head and the duration is
+	out, segmentStart, seekHeadAt, durationAt int64
+	// Nesting of the element being read: in the segment, then in a cluster
+	level int
+	// The header of the element being read, and of those indexed, the data
+	// still to keep, then what's left to pass through. The segment info is
+	// held back until complete, to make room for the duration.
+	header     []byte
+	id         uint32
+	data       []byte
+	keep, skip int64
+	rest       int64
+	hold       bool
+	held       []byte
+	// The stream couldn't be parsed: it's passed through as is
+	broken bool
+
+	cueTrack        uint64
+	cueOnKeyframes  bool
+	clusterPosition int64
+	clusterTimecode int64
+	clusterCued     bool
+	lastTimecode    int64
+	cues            webm.Cues
+	// Cue points written so far, and where the cues they're in start, where
+	// the void after their points is and where they end
+	flushed                     int
+	cuesAt, cuesVoidAt, cuesEnd int64
+}
+
+func (c *cueWriter) write(b []byte) error {
+	n, err := c.w.Write(b)
+	c.out += int64(n)
+
+	return err
+}
+
+func (c *cueWriter) Write(b []byte) (int, error) {
+	n := len(b)
+
+	for len(b) > 0 {
+		if c.broken {
+			return n, c.write(b)
+		}
+
+		var err error
+
+		switch {
+		case c.keep > 0:
+			k := int(min(c.keep, int64(len(b))))
+			c.data = append(c.data, b[:k]...)
+			c.keep -= int64(k)
+
+			if !c.hold {
+				err = c.write(b[:k])
+			}
+
+			b = b[k:]
+
+			if err == nil && c.keep == 0 {
+				err = c.endElement()
+			}
+		case c.skip > 0:
+			k := int(min(c.skip, int64(len(b))))
+			err = c.write(b[:k])
+			c.skip -= int64(k)
+			b = b[k:]
+		default:
+			c.header = append(c.header, b[0])
+			b = b[1:]
+			err = c.readHeader()
+		}
+
+		if err != nil {
+			return n - len(b), err
+		}
+	}
+
+	return n, nil
+}
+
+// vintLength is the length of an EBML variable-size integer starting with
+// first, 0 if invalid
+func vintLength(first byte) int {
+	for n := 1; n <= 8; n++ {
+		if first&(0x80>>(n-1)) != 0 {
+			return n
+		}
+	}
+
+	return 0
+}
+
+// readHeader starts the element whose header is read, once complete
+func (c *cueWriter) readHeader() error {
+	idLength := vintLength(c.header[0])
+
+	if idLength == 0 || idLength > 4 {
+		return c.giveUp("invalid element ID")
+	}
+
+	if len(c.header) <= idLength {
+		return nil
+	}
+
+	sizeLength := vintLength(c.header[idLength])
+
+	if sizeLength == 0 {
+		return c.giveUp("invalid element size")
+	}
+
+	if len(c.header) < idLength+sizeLength {
+		return nil
+	}
+
+	id := uint32(beUint(c.header[:idLength]))
+	size := vintValue(c.header[idLength:])
+
+	return c.startElement(id, size)
+}
+
+// giveUp stops indexing, passing the stream through from then on
+func (c *cueWriter) giveUp(reason string) error {
+	log.WithField("session", c.ctx.Value("session")).
+		WithField("offset", c.out).
+		Warnf("Not indexing recording any longer: %s", reason)
+
+	c.broken = true
+	header := c.header
+	c.header = nil
+
+	return c.write(header)
+}
+
+func (c *cueWriter) startElement(id uint32, size int64) error {
+	header := c.header
+	c.header = c.header[:0]
+
+	if c.level == 0 {
+		if id != idSegment {
+			if size < 0 {
+				c.header = header
+				return c.giveUp("unknown size outside the segment")
+			}
+
+			c.skip = size
+
+			return c.write(header)
+		}
+
+		if err := c.write(header); err != nil {
+			return err
+		}
+
+		c.level = 1
+		c.segmentStart = c.out
+		c.seekHeadAt = c.out
+
+		return c.write(voidElement(cuesSeekHeadSize))
+	}
+
+	// Clusters of unknown size end at the next top-level element
+	if c.level == 2 {
+		switch id {
+		case idCues, idTags, idInfo, idTracks, idSeekHead, idChapters, idAttachments:
+			c.level = 1
+		}
+	}
+
+	if id == idCluster {
+		if err := c.flush(false); err != nil {
+			return err
+		}
+
+		c.level = 2
+		c.clusterPosition = c.out - c.segmentStart
+		c.clusterTimecode = 0
+		c.clusterCued = false
+
+		return c.write(header)
+	}
+
+	if size < 0 {
+		c.header = header
+		return c.giveUp("unknown size")
+	}
+
+	c.id = id
+	c.data = c.data[:0]
+
+	switch {
+	case c.level == 1 && id == idInfo:
+		// Written once complete
+		c.hold = true
+		c.held = append(c.held[:0], header...)
+		c.keep = size
+	case c.level == 1 && id == idTracks, c.level == 2 && id == idTimecode:
+		c.keep = size
+	case c.level == 2 && id == idSimpleBlock:
+		c.keep = min(size, maxBlockHeaderSize)
+		c.rest = size - c.keep
+	default:
+		c.skip = size
+	}
+
+	if !c.hold {
+		if err := c.write(header); err != nil {
+			return err
+		}
+	}
+
+	if c.keep == 0 && c.skip == 0 {
+		return c.endElement()
+	}
+
+	return nil
+}
+
+// endElement reads the data kept of an element
+func (c *cueWriter) endElement() error {
+	c.skip, c.rest = c.rest, 0
+
+	switch c.id {
+	case idInfo:
+		c.hold = false
+		info := ebmlElement(idInfo, c.data, voidElement(durationSize))
+		c.durationAt = c.out + int64(len(info)-durationSize)
+
+		return c.write(info)
+	case idTracks:
+		var err error
+
+		if c.cueTrack, c.cueOnKeyframes, err = cueTrack(c.data); err != nil {
+			return c.giveUp(fmt.Sprintf("reading tracks: %v", err))
+		}
+	case idTimecode:
+		c.clusterTimecode = int64(beUint(c.data))
+	case idSimpleBlock:
+		track, relative, keyframe, ok := parseBlock(idSimpleBlock, c.data)
+
+		if !ok {
+			return nil
+		}
+
+		timecode := c.clusterTimecode + int64(relative)
+		c.lastTimecode = max(c.lastTimecode, timecode)
+
+		if track == c.cueTrack && (keyframe || !c.cueOnKeyframes) && !c.clusterCued {
+			c.clusterCued = true
+			c.cues.CuePoint = append(c.cues.CuePoint, webm.CuePoint{
+				CueTime: uint64(max(timecode, 0)),
+				CueTrackPositions: []webm.CueTrackPosition{
+					{CueTrack: track, CueClusterPosition: uint64(c.clusterPosition)},
+				},
+			})
+		}
+	}
+
+	return nil
+}
+
+// flush adds the cue points left to write to the cues, if there are any
+// for an interval (any, if final), and updates the duration. Only happens
+// between clusters.
+func (c *cueWriter) flush(final bool) error {
+	pending := c.cues.CuePoint[c.flushed:]
+	due := len(pending) > 0 && (final || c.flushed == 0 ||
+		pending[len(pending)-1].CueTime-c.cues.CuePoint[c.flushed-1].CueTime >= c.interval)
+
+	if !due && !final {
+		return nil
+	}
+
+	var patches []filePatch
+
+	if due {
+		points, err := marshalCuePoints(pending)
+
+		if err != nil {
+			return err
+		}
+
+		if c.cuesAt > 0 && c.cuesVoidAt+int64(len(points)+voidHeaderSize) <= c.cuesEnd {
+			// The cues only hold the new points once the void's header
+			// is written over, last
+			update := append(points, voidHeader(int(c.cuesEnd-c.cuesVoidAt)-len(points))...)
+			patches = append(patches,
+				filePatch{c.cuesVoidAt + voidHeaderSize, update[voidHeaderSize:]},
+				filePatch{c.cuesVoidAt, update[:voidHeaderSize]},
+			)
+			c.cuesVoidAt += int64(len(points))
+		} else if patches, err = c.writeCues(); err != nil {
+			return err
+		}
+
+		c.flushed = len(c.cues.CuePoint)
+	}
+
+	end := c.out
+	patches = append([]filePatch{{c.durationAt, durationElement(c.lastTimecode)}}, patches...)
+
+	for _, patch := range patches {
+		if patch.at == 0 {
+			continue
+		}
+
+		if _, err := c.seeker.Seek(patch.at, io.SeekStart); err != nil {
+			return err
+		}
+
+		if _, err := c.w.Write(patch.data); err != nil {
+			return err
+		}
+	}
+
+	_, err := c.seeker.Seek(end, io.SeekStart)
+
+	return err
+}
+
+// writeCues writes all the cue points, with room for as many more, and
+// returns what's to be written over the file once they are: the seek head
+// pointing to them, then a void over the cues written before
+func (c *cueWriter) writeCues() ([]filePatch, error) {
+	points, err := marshalCuePoints(c.cues.CuePoint)
+
+	if err != nil {
+		return nil, err
+	}
+
+	room := max(len(points), minCuesRoom)
+	cues := ebmlElement(idCues, points, voidElement(room))
+	position := c.out - c.segmentStart
+
+	if err := c.write(cues); err != nil {
+		return nil, err
+	}
+
+	patches := []filePatch{{c.seekHeadAt, cuesSeekHead(position)}}
+
+	if c.cuesAt > 0 {
+		patches = append(patches, filePatch{c.cuesAt, voidHeader(int(c.cuesEnd - c.cuesAt))})
+	}
+
+	c.cuesAt = c.out - int64(len(cues))
+	c.cuesVoidAt = c.out - int64(room)
+	c.cuesEnd = c.out
+
+	return patches, nil
+}
+
+func (c *cueWriter) Close() error {
+	var err error
+
+	switch {
+	case c.hold:
+		// The segment info never completed
+		if err = c.write(c.held); err == nil {
+			err = c.write(c.data)
+		}
+	case !c.broken && c.segmentStart > 0:
+		err = c.flush(true)
+	}
+
+	if closeErr := c.w.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,261 @@
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/at-wat/ebml-go"
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memFile is an in-memory file, checked after every write
+type memFile struct {
+	data    []byte
+	pos     int64
+	onWrite func(data []byte)
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	if end := f.pos + int64(len(b)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+
+	copy(f.data[f.pos:], b)
+	f.pos += int64(len(b))
+
+	if f.onWrite != nil {
+		f.onWrite(f.data)
+	}
+
+	return len(b), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	}
+
+	f.pos = offset
+
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+// recordCuesTestVideo records 20s of VP8 at 30 fps, a keyframe a second,
+// with Opus audio
+func recordCuesTestVideo(t *testing.T, interval time.Duration) string {
+	path := filepath.Join(t.TempDir(), "rec.webm")
+	r := NewWebmRecorder(path, 0600, 256, 64, false, false, false)
+	r.EnableCues(config.Cues{FlushInterval: interval})
+	r.SetHasVideo(true)
+	r.SetHasAudio(true)
+
+	for i := 0; i < 600; i++ {
+		r.PushVideo(vp8LayerPacket(uint16(i), uint32(i*3000), uint16(i), 0, i%30 == 0))
+
+		for j := 0; j < 5 && i%3 == 0; j++ {
+			seq := i/3*5 + j
+			r.PushAudio(&rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: uint16(seq), Timestamp: uint32(seq * 960)},
+				Payload: opusSilence(false),
+			})
+		}
+	}
+
+	r.Close()
+
+	return path
+}
+
+// indexedCues returns the cues the seek head of an indexed recording
+// points to, nil if none, failing if they're incomplete
+func indexedCues(t *testing.T, data []byte) (*webm.Cues, int) {
+	segmentStart := bytes.Index(data, []byte{0x18, 0x53, 0x80, 0x67}) + 12
+	require.Greater(t, segmentStart, 12)
+
+	if len(data) < segmentStart+cuesSeekHeadSize || data[segmentStart] == idVoid {
+		return nil, segmentStart
+	}
+
+	seekHead := data[segmentStart : segmentStart+cuesSeekHeadSize]
+	position := int(binary.BigEndian.Uint64(seekHead[len(seekHead)-8:]))
+	cuesAt := segmentStart + position
+
+	e := &ebmlReader{r: bufio.NewReader(bytes.NewReader(data[cuesAt:]))}
+	header, err := e.readHeader()
+	require.NoError(t, err)
+	require.Equal(t, uint32(idCues), header.id)
+	require.LessOrEqual(t, cuesAt+len(header.raw)+int(header.size), len(data), "Cues are complete")
+
+	var element struct {
+		Cues webm.Cues `ebml:"Cues"`
+	}
+	require.NoError(t, ebml.Unmarshal(bytes.NewReader(data[cuesAt:cuesAt+len(header.raw)+int(header.size)]), &element))
+
+	return &element.Cues, segmentStart
+}
+
+func TestValidateCues(t *testing.T) {
+	assert.NoError(t, ValidateCues(config.Cues{}))
+	assert.NoError(t, ValidateCues(config.Cues{FlushInterval: 10 * time.Second}))
+	assert.Error(t, ValidateCues(config.Cues{FlushInterval: -time.Second}))
+	assert.Error(t, ValidateCues(config.Cues{FlushInterval: time.Minute}))
+}
+
+func TestWebmRecorder_Cues(t *testing.T) {
+	path := recordCuesTestVideo(t, 2*time.Second)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	cues, segmentStart := indexedCues(t, data)
+	require.NotNil(t, cues)
+	// A cluster every 2s, starting on a keyframe
+	assert.InDelta(t, 10, len(cues.CuePoint), 1)
+
+	var last uint64
+
+	for i, point := range cues.CuePoint {
+		require.Len(t, point.CueTrackPositions, 1)
+		position := point.CueTrackPositions[0]
+		assert.Equal(t, uint64(1), position.CueTrack, "Cues point to the video")
+
+		at := segmentStart + int(position.CueClusterPosition)
+		assert.Equal(t, []byte{0x1F, 0x43, 0xB6, 0x75}, data[at:at+4], "Cue %d points to a cluster", i)
+
+		if i > 0 {
+			assert.GreaterOrEqual(t, point.CueTime-last, uint64(2000))
+		}
+
+		last = point.CueTime
+	}
+
+	var file struct {
+		Segment struct {
+			Info    webm.Info      `ebml:"Info"`
+			Cluster []webm.Cluster `ebml:"Cluster"`
+		} `ebml:"Segment"`
+	}
+	require.NoError(t, ebml.Unmarshal(bytes.NewReader(data), &file))
+	assert.InDelta(t, 19967, file.Segment.Info.Duration, 50)
+	assert.Len(t, file.Segment.Cluster, len(cues.CuePoint)+1, "And the muxer's last, empty")
+
+	v, err := VerifyWebM(path)
+	require.NoError(t, err)
+	assert.InDelta(t, 19967, v.Duration.Milliseconds(), 50)
+}
+
+func TestWebmRecorder_CuesGrow(t *testing.T) {
+	// A keyframe a second for 10 minutes: more cue points than the cues
+	// are first written with room for
+	path := filepath.Join(t.TempDir(), "rec.webm")
+	r := NewWebmRecorder(path, 0600, 256, 64, false, false, false)
+	r.EnableCues(config.Cues{FlushInterval: time.Second})
+	r.SetHasVideo(true)
+
+	for i := 0; i < 600; i++ {
+		r.PushVideo(vp8LayerPacket(uint16(i), uint32(i*90000), uint16(i), 0, true))
+	}
+
+	r.Close()
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	cues, segmentStart := indexedCues(t, data)
+	require.NotNil(t, cues)
+	points, err := marshalCuePoints(cues.CuePoint)
+	require.NoError(t, err)
+	require.Greater(t, len(points), minCuesRoom, "The cues were written again")
+
+	assert.Equal(t, 2, bytes.Count(data, []byte{0x1C, 0x53, 0xBB, 0x6B}), "The seek head and the cues: those written before are void")
+	assert.Less(t, len(data), 10*len(points), "What's written grows with the cues, not with each flush")
+
+	for i, point := range cues.CuePoint {
+		at := segmentStart + int(point.CueTrackPositions[0].CueClusterPosition)
+		require.Equal(t, []byte{0x1F, 0x43, 0xB6, 0x75}, data[at:at+4], "Cue %d points to a cluster", i)
+	}
+
+	v, err := VerifyWebM(path)
+	require.NoError(t, err)
+	assert.InDelta(t, 599000, v.Duration.Milliseconds(), 50)
+}
+
+func TestWebmRecorder_CuesDisabled(t *testing.T) {
+	data, err := os.ReadFile(recordCuesTestVideo(t, 0))
+	require.NoError(t, err)
+
+	assert.False(t, bytes.Contains(data, []byte{0x1C, 0x53, 0xBB, 0x6B}), "No cues")
+	assert.False(t, bytes.Contains(data, []byte{0x11, 0x4D, 0x9B, 0x74}), "No seek head")
+}
+
+func TestCueWriter_Crash(t *testing.T) {
+	// A streamed recording, indexed as if written in small chunks
+	stream, err := os.ReadFile(recordCuesTestVideo(t, 0))
+	require.NoError(t, err)
+
+	flushes := 0
+	var lastPoints int
+	f := &memFile{}
+	f.onWrite = func(data []byte) {
+		if !bytes.Contains(data, []byte{0x18, 0x53, 0x80, 0x67}) {
+			return
+		}
+
+		// Dying after any write leaves the seek head pointing to complete
+		// cues, if any
+		if cues, _ := indexedCues(t, data); cues != nil && len(cues.CuePoint) != lastPoints {
+			lastPoints = len(cues.CuePoint)
+			flushes++
+		}
+	}
+
+	c := &cueWriter{ctx: context.Background(), w: f, seeker: f, interval: 4000}
+
+	for chunk := stream; len(chunk) > 0; {
+		n := min(len(chunk), 97)
+		_, err := c.Write(chunk[:n])
+		require.NoError(t, err)
+		chunk = chunk[n:]
+	}
+
+	require.NoError(t, c.Close())
+	assert.False(t, c.broken)
+	// Clusters of 32s at most: the muxer wasn't cutting them for cues
+	assert.Equal(t, 1, flushes)
+
+	// Left unfinished, before the first seek head and past it
+	for _, size := range []int{len(f.data) / 3, len(f.data) - 100} {
+		path := filepath.Join(t.TempDir(), "crashed.webm")
+		require.NoError(t, os.WriteFile(path, f.data[:size], 0600))
+		result, err := RecoverWebM(path)
+		require.NoError(t, err)
+		assert.Positive(t, result.Blocks)
+	}
+
+	var file struct {
+		Segment struct {
+			Info webm.Info `ebml:"Info"`
+		} `ebml:"Segment"`
+	}
+	require.NoError(t, ebml.Unmarshal(bytes.NewReader(f.data), &file))
+	assert.False(t, math.IsNaN(file.Segment.Info.Duration))
+	assert.InDelta(t, 19967, file.Segment.Info.Duration, 50)
+}
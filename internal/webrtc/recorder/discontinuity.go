@@ -0,0 +1,114 @@
+package recorder
+
+import (
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	"github.com/pion/rtp"
+)
+
+// maxTimestampJumps bounds the timestamp jumps kept in a track's stats
+const maxTimestampJumps = 100
+
+// timestampRebaser keeps the RTP timestamps of a track monotonic across
+// publisher resets: a packet following the previous one in sequence whose
+// timestamp moved away from the time elapsed since by more than the
+// threshold is a jump. Its timestamp, and those of the packets after it, are
+// shifted so it lands that time after the previous one.
+type timestampRebaser struct {
+	started     bool
+	lastSeq     uint16
+	lastTs      uint32 // As received
+	lastArrival time.Time
+	offset      uint32
+	jumps       []types.TimestampJump
+}
+
+// rebase returns the timestamp p is written with, and the jump it follows
+// if any
+func (t *timestampRebaser) rebase(p *rtp.Packet, now time.Time, rate uint32, threshold time.Duration) (uint32, time.Duration) {
+	if !t.started {
+		t.started = true
+		t.lastSeq, t.lastTs, t.lastArrival = p.SequenceNumber, p.Timestamp, now
+
+		return p.Timestamp, 0
+	}
+
+	// Retransmitted or reordered packets follow the current base
+	if seqDelta := p.SequenceNumber - t.lastSeq; seqDelta == 0 || seqDelta >= 1<<15 {
+		return p.Timestamp + t.offset, 0
+	}
+
+	elapsed := now.Sub(t.lastArrival)
+	advanced := time.Duration(int32(p.Timestamp-t.lastTs)) * time.Second / time.Duration(rate)
+	jump := advanced - elapsed
+
+	if jump > threshold || jump < -threshold {
+		expected := t.lastTs + t.offset + uint32(elapsed*time.Duration(rate)/time.Second)
+		t.offset = expected - p.Timestamp
+	} else {
+		jump = 0
+	}
+
+	t.lastSeq, t.lastTs, t.lastArrival = p.SequenceNumber, p.Timestamp, now
+
+	return p.Timestamp + t.offset, jump
+}
+
+// EnableTimestampRebasing makes RTP timestamps jumping by more than
+// threshold from the time elapsed between packets be re-based, so the
+// recording's timeline stays monotonic. 0 disables it. Must be called before
+// any media is pushed.
+func (r *WebmRecorder) EnableTimestampRebasing(threshold time.Duration) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.timestampJumpThreshold = max(threshold, 0)
+}
+
+// rebaseTimestamp returns p with its timestamp re-based if a track's
+// timestamps jumped, a copy of it if it changed
+func (r *WebmRecorder) rebaseTimestamp(p *rtp.Packet, rebaser *timestampRebaser, kind string) *rtp.Packet {
+	// Set once, before media flows
+	if r.timestampJumpThreshold == 0 {
+		return p
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	rate := r.audioRate
+
+	if kind == "video" {
+		rate = r.videoRate
+	}
+
+	ts, jump := rebaser.rebase(p, r.now(), rate, r.timestampJumpThreshold)
+
+	if jump != 0 {
+		rebaser.jumps = append(rebaser.jumps, types.TimestampJump{
+			Time:         r.now().UnixMilli(),
+			SeqNum:       p.SequenceNumber,
+			RTPTimestamp: p.Timestamp,
+			JumpMs:       jump.Milliseconds(),
+		})
+
+		if n := len(rebaser.jumps); n > maxTimestampJumps {
+			rebaser.jumps = rebaser.jumps[n-maxTimestampJumps:]
+		}
+
+		r.logger.WithField("kind", kind).
+			WithField("seq", p.SequenceNumber).
+			WithField("jump", jump).
+			Warn("RTP timestamp discontinuity, re-basing the timeline")
+	}
+
+	if ts == p.Timestamp {
+		return p
+	}
+
+	rebased := *p
+	rebased.Timestamp = ts
+
+	return &rebased
+}
@@ -0,0 +1,68 @@
+package recorder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimestampRebaser(t *testing.T) {
+	var rebaser timestampRebaser
+	now := time.Unix(1000, 0)
+	packet := func(seq uint16, ts uint32) *rtp.Packet {
+		return &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: ts}}
+	}
+
+	ts, jump := rebaser.rebase(packet(10, 90000), now, 90000, time.Second)
+	assert.Equal(t, uint32(90000), ts)
+	assert.Zero(t, jump)
+
+	// Timestamps keeping up with time, even across a long gap
+	now = now.Add(5 * time.Second)
+	ts, jump = rebaser.rebase(packet(11, 90000*6), now, 90000, time.Second)
+	assert.Equal(t, uint32(90000*6), ts)
+	assert.Zero(t, jump)
+
+	// Reset: lands the elapsed time after the previous packet
+	now = now.Add(100 * time.Millisecond)
+	ts, jump = rebaser.rebase(packet(12, 1000), now, 90000, time.Second)
+	assert.Equal(t, uint32(90000*6+9000), ts)
+	assert.Equal(t, time.Duration(int32(1000-90000*6))*time.Second/90000-100*time.Millisecond, jump)
+
+	// Later packets follow the new base, reordered ones too
+	now = now.Add(100 * time.Millisecond)
+	ts, jump = rebaser.rebase(packet(13, 10000), now, 90000, time.Second)
+	assert.Equal(t, uint32(90000*6+18000), ts)
+	assert.Zero(t, jump)
+
+	ts, _ = rebaser.rebase(packet(12, 1000), now, 90000, time.Second)
+	assert.Equal(t, uint32(90000*6+9000), ts)
+}
+
+func TestWebmRecorder_TimestampRebasing(t *testing.T) {
+	s := newAVSyncSource(t)
+	s.r.EnableTimestampRebasing(time.Second)
+
+	s.run(time.Second, true, true)
+
+	// The publisher restarts: video goes back, audio forward
+	s.videoTs -= 90000 * 60
+	resetTs := s.videoTs
+	s.audioTs += 48000 * 600
+
+	s.run(time.Second, true, true)
+	s.r.Close()
+
+	assert.InDelta(t, 2*time.Second, s.r.VideoTimestamp(), float64(100*time.Millisecond))
+	assert.InDelta(t, 2*time.Second, s.r.AudioTimestamp(), float64(100*time.Millisecond))
+
+	stats := s.r.GetStats()
+	require.Len(t, stats.Video.TimestampJumps, 1)
+	assert.Equal(t, resetTs, stats.Video.TimestampJumps[0].RTPTimestamp)
+	assert.InDelta(t, -60000, stats.Video.TimestampJumps[0].JumpMs, 100)
+	require.Len(t, stats.Audio.TimestampJumps, 1)
+	assert.InDelta(t, 600000, stats.Audio.TimestampJumps[0].JumpMs, 100)
+}
@@ -0,0 +1,177 @@
+package recorder
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How the silences publishers send as Opus DTX (discontinuous transmission)
+// are written (see config.Recorder.DTX)
+const (
+	// DTXPreserve leaves them as gaps between blocks, at their media time.
+	// WAV files, which can't have gaps, get digital silence.
+	DTXPreserve = "preserve"
+	// DTXFill fills them with the last DTX frame, repeated: the comfort
+	// noise the publisher encoded
+	DTXFill = "fill"
+)
+
+// maxDTXFill bounds the silence filled for a single gap; past that, the
+// publisher more likely stopped sending than went silent, and the remainder
+// is left as a gap
+const maxDTXFill = time.Minute
+
+// isOpusDTX returns whether an Opus packet is a DTX frame (see
+// opusDTXMaxSize)
+func isOpusDTX(packet []byte) bool {
+	return len(packet) > 0 && len(packet) <= opusDTXMaxSize
+}
+
+// EnableDTX sets how DTX silences are written, DTXPreserve if mode is
+// empty. Must be called before any media is pushed.
+func (r *WebmRecorder) EnableDTX(mode string) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	switch mode {
+	case "", DTXPreserve:
+		r.fillDTXGaps = false
+	case DTXFill:
+		r.fillDTXGaps = true
+	default:
+		return fmt.Errorf("invalid dtx mode %q", mode)
+	}
+
+	return nil
+}
+
+// noteDTXFrame keeps the last audio packet written if it's a DTX frame,
+// the silence that follows it being continued with it
+// Locked
+func (r *WebmRecorder) noteDTXFrame(packet []byte) {
+	if !isOpusDTX(packet) {
+		r.dtxFrame = nil
+		return
+	}
+
+	r.stats.Audio.DTXFrames++
+
+	// Samples may share buffers that are reused once written, and fillers
+	// already queued keep referencing the previous one
+	r.dtxFrame = bytes.Clone(packet)
+}
+
+// fillDTX returns the samples to write for those concealAudio returned: the
+// same, preceded by copies of the previous DTX frame covering the silence
+// that followed it, if filling DTX silences. Their last sample's duration
+// spans the silence, so it's shared with the copies. Gaps of losses
+// (concealed) and pauses are left alone. The result is only valid until
+// the next call.
+// Locked
+func (r *WebmRecorder) fillDTX(samples []pendingAudioSample) []pendingAudioSample {
+	dtx := r.dtxFrame
+	last := samples[len(samples)-1]
+	r.noteDTXFrame(last.data)
+
+	if !r.fillDTXGaps || dtx == nil || len(samples) > 1 || r.audioGapPending {
+		return samples
+	}
+
+	// Opus TOCs count 48 kHz samples whatever the RTP clock rate
+	frameSamples := opusPacketSamples(dtx)
+
+	if frameSamples == 0 {
+		return samples
+	}
+
+	frame := time.Duration(frameSamples) * time.Second / opusSampleRate
+	count := min(int(last.duration/frame)-1, int(maxDTXFill/frame))
+
+	if count <= 0 {
+		return samples
+	}
+
+	step := uint32(uint64(frameSamples) * uint64(r.audioRate) / opusSampleRate)
+	filled := r.dtxScratch[:0]
+
+	for i := count; i > 0; i-- {
+		filled = append(filled, pendingAudioSample{
+			data:         dtx,
+			duration:     frame,
+			rtpTimestamp: last.rtpTimestamp - uint32(i)*step,
+		})
+	}
+
+	r.stats.Audio.DTXFilledFrames += count
+
+	if log.IsLevelEnabled(log.TraceLevel) {
+		r.logger.WithField("frames", count).
+			WithField("rtp_timestamp", last.rtpTimestamp).
+			Trace("Filling DTX silence")
+	}
+
+	filled = append(filled, pendingAudioSample{
+		data:         last.data,
+		duration:     last.duration - time.Duration(count)*frame,
+		rtpTimestamp: last.rtpTimestamp,
+	})
+	r.dtxScratch = filled
+
+	return filled
+}
+
+// fillWAVDTX writes the silence that followed the previous packet, if it
+// was a DTX frame, up to the one at timestamp: digital silence, or the DTX
+// frame decoded over and over if filling DTX silences. Packets carry no gap
+// of their own in a WAV file, so the silence would be lost otherwise.
+// Locked
+func (r *WebmRecorder) fillWAVDTX(timestamp uint32) {
+	if r.dtxFrame == nil || r.audioRate == 0 {
+		return
+	}
+
+	elapsed := time.Duration(timestamp-r.wavLastTimestamp) * time.Second / time.Duration(r.audioRate)
+
+	// Past that, more likely a timestamp jump than a silence
+	if elapsed > maxDTXFill {
+		return
+	}
+
+	silence := min(elapsed-r.wavDuration(uint64(r.wavLastFrames)), maxWAVSilence)
+
+	if silence <= 0 {
+		return
+	}
+
+	if !r.fillDTXGaps {
+		r.writeWAVSilence(silence)
+		return
+	}
+
+	for written := time.Duration(0); written < silence; {
+		frames, err := r.wavDecoder.Decode(r.dtxFrame, r.wavPCM)
+
+		if err != nil || frames == 0 {
+			r.writeWAVSilence(silence - written)
+			return
+		}
+
+		frames = min(frames, int((silence-written).Seconds()*float64(r.wavSampleRate)))
+
+		if frames <= 0 {
+			return
+		}
+
+		if err := r.wavWriter.WritePCM(r.wavPCM[:frames*r.wavChannels]); err != nil {
+			r.logger.WithError(err).
+				Error("Error writing DTX comfort noise")
+			return
+		}
+
+		r.stats.Audio.DTXFilledFrames++
+		written += r.wavDuration(uint64(frames))
+	}
+}
@@ -0,0 +1,109 @@
+package recorder
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// SILK 20ms, mono, no payload: what publishers send while silent
+var dtxFrame = []byte{0x08}
+
+func TestEnableDTX(t *testing.T) {
+	r := NewWebmRecorder("", 0, 256, 64, false, false, false)
+
+	require.NoError(t, r.EnableDTX(DTXFill))
+	assert.True(t, r.fillDTXGaps)
+	require.NoError(t, r.EnableDTX(""))
+	assert.False(t, r.fillDTXGaps)
+	assert.Error(t, r.EnableDTX("drop"))
+}
+
+func TestWebmRecorder_FillDTX(t *testing.T) {
+	r := NewWebmRecorder("", 0, 256, 64, false, false, false)
+	r.SetHasAudio(true)
+	r.initAudioStats()
+
+	voice := []byte{0xFC, 0xAA, 0xBB}
+
+	// Preserved: the gap is left to the next sample's duration
+	samples := r.fillDTX([]pendingAudioSample{{data: dtxFrame, duration: 20 * time.Millisecond, rtpTimestamp: 0}})
+	require.Len(t, samples, 1)
+	samples = r.fillDTX([]pendingAudioSample{{data: voice, duration: 100 * time.Millisecond, rtpTimestamp: 4800}})
+	require.Len(t, samples, 1)
+	assert.Equal(t, 1, r.stats.Audio.DTXFrames)
+	assert.Zero(t, r.stats.Audio.DTXFilledFrames)
+
+	require.NoError(t, r.EnableDTX(DTXFill))
+
+	r.fillDTX([]pendingAudioSample{{data: dtxFrame, duration: 20 * time.Millisecond, rtpTimestamp: 5760}})
+	samples = r.fillDTX([]pendingAudioSample{{data: voice, duration: 100 * time.Millisecond, rtpTimestamp: 10560}})
+
+	// 4 copies of the DTX frame at their own timestamps, then the sample
+	require.Len(t, samples, 5)
+
+	for i, s := range samples[:4] {
+		assert.Equal(t, dtxFrame, s.data)
+		assert.Equal(t, 20*time.Millisecond, s.duration)
+		assert.Equal(t, uint32(6720+i*960), s.rtpTimestamp)
+	}
+
+	assert.Equal(t, voice, samples[4].data)
+	assert.Equal(t, 20*time.Millisecond, samples[4].duration)
+	assert.Equal(t, uint32(10560), samples[4].rtpTimestamp)
+	assert.Equal(t, 4, r.stats.Audio.DTXFilledFrames)
+
+	// Not following a DTX frame
+	samples = r.fillDTX([]pendingAudioSample{{data: voice, duration: 100 * time.Millisecond, rtpTimestamp: 15360}})
+	assert.Len(t, samples, 1)
+}
+
+func TestWebmRecorder_WAVDTX(t *testing.T) {
+	tests := []struct {
+		mode     string
+		expected int16 // Sample value across the silence
+	}{
+		{DTXPreserve, 0},
+		{DTXFill, 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			useFakeOpusDecoder(t)
+
+			r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, true)
+			require.NoError(t, r.EnableWAVOutput(config.WAV{SampleRate: 16000, Channels: 1}))
+			require.NoError(t, r.EnableDTX(tt.mode))
+			r.SetHasAudio(true)
+
+			push := func(seq uint16, timestamp uint32, payload []byte) {
+				r.PushAudio(&rtp.Packet{
+					Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: timestamp},
+					Payload: payload,
+				})
+			}
+
+			push(0, 0, []byte{0xFC, 0xAA, 0xBB})
+			push(1, 960, dtxFrame)
+			// 60ms of silence after the DTX frame, no packet lost
+			push(2, 4800, []byte{0xFC, 0xAA, 0xBB})
+			r.Close()
+
+			_, _, samples := readWAV(t, r.GetFilePath())
+
+			// 3 decoded packets plus the 60ms they didn't carry, 320 samples each
+			require.Len(t, samples, 6*320)
+
+			for i, value := range []int16{1000, 1000, tt.expected, tt.expected, tt.expected, 1000} {
+				assert.Equal(t, value, samples[i*320], "packet %d", i)
+			}
+
+			assert.Equal(t, 1, r.GetStats().Audio.DTXFrames)
+		})
+	}
+}
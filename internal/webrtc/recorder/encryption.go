@@ -0,0 +1,53 @@
+package recorder
+
+import (
+	"errors"
+	"io"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/encryption"
+)
+
+// ValidateEncryption checks the encryption configuration, and its key, along
+// with what it's enabled with: finalizing files after the fact takes them
+// in plaintext
+func ValidateEncryption(cfg config.Recorder) error {
+	if !cfg.Encryption.Enable {
+		return nil
+	}
+
+	if _, err := encryption.Load(cfg.Encryption); err != nil {
+		return err
+	}
+
+	if cfg.Recovery.Enable {
+		return errors.New("encrypted recordings can't be recovered, disable recovery")
+	}
+
+	if cfg.MKV.AttachSidecar {
+		return errors.New("sidecars can't be attached to encrypted recordings, disable mkv.attachSidecar")
+	}
+
+	return nil
+}
+
+// EnableEncryption encrypts the files the recording is written to with key,
+// none if nil. Must be called before any media is pushed.
+func (r *WebmRecorder) EnableEncryption(key *encryption.Key) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.encryptionKey = key
+}
+
+// encryptFile encrypts what's written to w, a file of the recording, if
+// enabled. The muxers see a writer they can't seek: files are streamed as
+// to sinks, nothing written back on close (e.g. the WebM duration).
+// Locked
+func (r *WebmRecorder) encryptFile(w io.WriteCloser) io.WriteCloser {
+	if r.encryptionKey == nil {
+		return w
+	}
+
+	return encryption.NewWriter(w, r.encryptionKey)
+}
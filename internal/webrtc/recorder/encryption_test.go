@@ -0,0 +1,63 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/encryption"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testEncryption = config.Encryption{
+	Enable: true,
+	Key:    hex.EncodeToString(bytes.Repeat([]byte{0x42}, 32)),
+	KeyID:  "test",
+}
+
+func TestWebmRecorder_Encryption(t *testing.T) {
+	key, err := encryption.Load(testEncryption)
+	require.NoError(t, err)
+
+	s := newAVSyncSource(t)
+	s.r.EnableEncryption(key)
+	s.run(time.Second, true, true)
+	s.r.Close()
+
+	data, err := os.ReadFile(s.r.GetFilePath())
+	require.NoError(t, err)
+	assert.True(t, encryption.IsEncrypted(data))
+
+	var plain bytes.Buffer
+	require.NoError(t, encryption.Decrypt(&plain, bytes.NewReader(data), key))
+	assert.Equal(t, []byte{0x1A, 0x45, 0xDF, 0xA3}, plain.Bytes()[:4], "An EBML file")
+	assert.Greater(t, plain.Len(), 1000)
+
+	_, err = RecoverWebM(s.r.GetFilePath())
+	assert.ErrorIs(t, err, ErrRecoveryUnsupported)
+}
+
+func TestValidateEncryption(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.Recorder
+		wantErr bool
+	}{
+		{"disabled", config.Recorder{Encryption: config.Encryption{Key: "invalid"}}, false},
+		{"enabled", config.Recorder{Encryption: testEncryption}, false},
+		{"no key", config.Recorder{Encryption: config.Encryption{Enable: true}}, true},
+		{"with recovery", config.Recorder{Encryption: testEncryption, Recovery: config.Recovery{Enable: true}}, true},
+		{"with attached sidecars", config.Recorder{Encryption: testEncryption, MKV: config.MKV{AttachSidecar: true}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateEncryption(tt.cfg)
+			assert.Equal(t, tt.wantErr, err != nil, err)
+		})
+	}
+}
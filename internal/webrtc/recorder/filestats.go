@@ -0,0 +1,151 @@
+package recorder
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+)
+
+// writeRateWindow is how far back the write rate is computed over
+const writeRateWindow = 5 * time.Second
+
+// FileStats returns how many bytes the recording's files hold so far, all
+// segments included, and how fast they grew lately
+func (r *WebmRecorder) FileStats() types.FileStats {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.written.stats(r.now())
+}
+
+type writeSample struct {
+	at    time.Time
+	total uint64
+}
+
+// writeCounter accounts for the bytes written to the files of a recording.
+// Containers write from their own goroutines, so they only add to the
+// total; the recorder samples it, once a second at most, as it writes
+// media and reports stats.
+type writeCounter struct {
+	total atomic.Uint64
+
+	mu sync.Mutex
+	// Oldest first, covering writeRateWindow
+	samples []writeSample
+}
+
+// reset starts over, for a recording restarting its files
+func (c *writeCounter) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.total.Store(0)
+	c.samples = nil
+}
+
+func (c *writeCounter) add(n int) {
+	if n > 0 {
+		c.total.Add(uint64(n))
+	}
+}
+
+// sample records the total at now, unless it was sampled less than a
+// second ago
+func (c *writeCounter) sample(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sampleLocked(now)
+}
+
+// Locked
+func (c *writeCounter) sampleLocked(now time.Time) {
+	if n := len(c.samples); n > 0 && now.Sub(c.samples[n-1].at) < time.Second {
+		return
+	}
+
+	expired := 0
+
+	for expired < len(c.samples) && now.Sub(c.samples[expired].at) > writeRateWindow {
+		expired++
+	}
+
+	c.samples = append(c.samples[expired:], writeSample{at: now, total: c.total.Load()})
+}
+
+// stats returns the total and the rate it grew at since the oldest sample
+// of the window
+func (c *writeCounter) stats(now time.Time) types.FileStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sampleLocked(now)
+	total := c.total.Load()
+	stats := types.FileStats{BytesWritten: total}
+	oldest := c.samples[0]
+
+	if elapsed := now.Sub(oldest.at); elapsed > 0 {
+		stats.WriteRate = uint64(float64(total-oldest.total) / elapsed.Seconds())
+	}
+
+	return stats
+}
+
+// wrap counts what's written to w, seekable or not
+func (c *writeCounter) wrap(w io.WriteCloser) io.WriteCloser {
+	if ws, ok := w.(io.WriteSeeker); ok {
+		return &countingWriteSeeker{countingWriter: countingWriter{w: w, c: c}, seeker: ws}
+	}
+
+	return &countingWriter{w: w, c: c}
+}
+
+type countingWriter struct {
+	w io.WriteCloser
+	c *writeCounter
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.c.add(n)
+
+	return n, err
+}
+
+func (w *countingWriter) Close() error {
+	return w.w.Close()
+}
+
+// countingWriteSeeker only counts what's written past the end of the file,
+// not what's overwritten (e.g. the size fields of a WAV header)
+type countingWriteSeeker struct {
+	countingWriter
+	seeker   io.WriteSeeker
+	pos, end int64
+}
+
+func (w *countingWriteSeeker) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.pos += int64(n)
+
+	if w.pos > w.end {
+		w.c.add(int(w.pos - w.end))
+		w.end = w.pos
+	}
+
+	return n, err
+}
+
+func (w *countingWriteSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := w.seeker.Seek(offset, whence)
+
+	if err == nil {
+		w.pos = pos
+	}
+
+	return pos, err
+}
@@ -0,0 +1,108 @@
+package recorder
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteCounter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := &writeCounter{}
+	assert.Zero(t, c.stats(now))
+
+	c.add(1000)
+	now = now.Add(500 * time.Millisecond)
+	c.add(1000)
+	stats := c.stats(now)
+	assert.Equal(t, uint64(2000), stats.BytesWritten)
+	assert.Equal(t, uint64(4000), stats.WriteRate, "Over what was written so far")
+
+	for range 10 {
+		now = now.Add(time.Second)
+		c.add(1000)
+		c.sample(now)
+	}
+
+	stats = c.stats(now)
+	assert.Equal(t, uint64(12000), stats.BytesWritten)
+	assert.Equal(t, uint64(1000), stats.WriteRate, "Over the last seconds")
+
+	// Stopped growing
+	now = now.Add(writeRateWindow + time.Second)
+	assert.Zero(t, c.stats(now).WriteRate)
+	assert.Equal(t, uint64(12000), c.stats(now).BytesWritten)
+
+	c.reset()
+	assert.Zero(t, c.stats(now))
+}
+
+func TestWriteCounter_Seeker(t *testing.T) {
+	c := &writeCounter{}
+	f, err := os.Create(filepath.Join(t.TempDir(), "rec.wav"))
+	require.NoError(t, err)
+
+	w := c.wrap(f)
+	ws, ok := w.(io.WriteSeeker)
+	require.True(t, ok, "Seekable files stay seekable")
+
+	_, err = ws.Write(make([]byte, 44))
+	require.NoError(t, err)
+	_, err = ws.Seek(4, io.SeekStart)
+	require.NoError(t, err)
+	_, err = ws.Write(make([]byte, 4))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(44), c.stats(time.Now()).BytesWritten, "Overwriting doesn't grow the file")
+
+	_, err = ws.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+	_, err = ws.Write(make([]byte, 10))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.Equal(t, uint64(54), c.stats(time.Now()).BytesWritten)
+
+	_, ok = c.wrap(&streamSink{}).(io.Seeker)
+	assert.False(t, ok)
+}
+
+func TestWebmRecorder_FileStats(t *testing.T) {
+	s := newAVSyncSource(t)
+	assert.Nil(t, s.r.GetStats().File)
+
+	s.run(2*time.Second, true, true)
+	s.r.Close()
+
+	stats := s.r.GetStats().File
+	require.NotNil(t, stats)
+	info, err := os.Stat(s.r.file)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(info.Size()), stats.BytesWritten)
+	assert.Equal(t, stats.BytesWritten, s.r.FileStats().BytesWritten)
+	assert.InEpsilon(t, stats.BytesWritten/2, stats.WriteRate, 0.3)
+}
+
+func TestWebmRecorder_FileStatsSegments(t *testing.T) {
+	s := newAVSyncSource(t)
+	require.NoError(t, s.r.EnableSegments(config.Segments{Enable: true, Duration: time.Second}))
+
+	s.run(2500*time.Millisecond, true, true)
+	s.r.Close()
+
+	files := s.r.SegmentFiles()
+	require.Len(t, files, 3)
+	var size uint64
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		require.NoError(t, err)
+		size += uint64(info.Size())
+	}
+
+	assert.Equal(t, size, s.r.GetStats().File.BytesWritten, "All segments")
+}
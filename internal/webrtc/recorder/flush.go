@@ -0,0 +1,93 @@
+package recorder
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Closing a recording writes out what the muxer holds, then its index
+// (cues) and the header's final duration, which can take a while for
+// large files on slow storage. With a flush deadline, whatever is still to
+// be written once it's past is dropped instead: the file is left as far as
+// it got, as if the recorder had crashed (see recovery.go), and the
+// recorder stats tell. A write already stuck in the kernel can't be cut
+// short.
+
+// EnableFlushDeadline bounds how long Close waits for the recording to be
+// finalized, 0 for no bound. Must be called before any media is pushed.
+func (r *WebmRecorder) EnableFlushDeadline(deadline time.Duration) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.flushDeadline = deadline
+}
+
+// flushGuard drops the writes to a recording's file once tripped
+type flushGuard struct {
+	tripped atomic.Bool
+}
+
+// wrap returns w, guarded; seeking is passed through so headers can still
+// be rewritten, which are dropped as well once tripped
+func (g *flushGuard) wrap(w io.WriteCloser) io.WriteCloser {
+	if ws, ok := w.(io.WriteSeeker); ok {
+		return &guardedWriteSeeker{guardedWriter: guardedWriter{w: w, g: g}, seeker: ws}
+	}
+
+	return &guardedWriter{w: w, g: g}
+}
+
+type guardedWriter struct {
+	w io.WriteCloser
+	g *flushGuard
+}
+
+func (w *guardedWriter) Write(b []byte) (int, error) {
+	if w.g.tripped.Load() {
+		return len(b), nil
+	}
+
+	return w.w.Write(b)
+}
+
+func (w *guardedWriter) Close() error {
+	return w.w.Close()
+}
+
+type guardedWriteSeeker struct {
+	guardedWriter
+	seeker io.WriteSeeker
+}
+
+func (w *guardedWriteSeeker) Seek(offset int64, whence int) (int64, error) {
+	return w.seeker.Seek(offset, whence)
+}
+
+// startFlushDeadline arms the flush deadline, if any, returning the func
+// to call once the recording is finalized
+// Locked
+func (r *WebmRecorder) startFlushDeadline() func() {
+	if r.flushDeadline <= 0 || !r.started {
+		return func() {}
+	}
+
+	start := r.now()
+	timer := r.clock.AfterFunc(r.flushDeadline, func() {
+		r.flushGuard.tripped.Store(true)
+	})
+
+	return func() {
+		timer.Stop()
+
+		// Canceled recordings aren't finalized on purpose (see Cancel)
+		if !r.flushGuard.tripped.Load() || r.stats.Canceled {
+			return
+		}
+
+		r.stats.FlushTimedOut = true
+		r.logger.WithField("file", r.file).
+			WithField("elapsed", r.now().Sub(start)).
+			Warnf("Recording not finalized within the flush deadline of %s, left unfinished", r.flushDeadline)
+	}
+}
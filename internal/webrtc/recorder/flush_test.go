@@ -0,0 +1,121 @@
+package recorder
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stalledSink is a sink whose writes take a while once stalled, as slow
+// storage would
+type stalledSink struct {
+	streamSink
+	stalled atomic.Bool
+	writes  int
+}
+
+func (s *stalledSink) Write(b []byte) (int, error) {
+	if s.stalled.Load() {
+		s.writes++
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return s.streamSink.Write(b)
+}
+
+func TestWebmRecorder_FlushDeadline(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		timedOut bool
+	}{
+		{"within deadline", time.Minute, false},
+		{"past deadline", 50 * time.Millisecond, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &stalledSink{}
+			r, err := NewRecorderWithWriter(context.Background(), config.Recorder{
+				VideoPacketQueueSize: 256,
+				AudioPacketQueueSize: 64,
+				FlushDeadline:        tt.deadline,
+			}, sink)
+			require.NoError(t, err)
+			r.SetHasAudio(true)
+
+			for i := 0; i < 100; i++ {
+				r.PushAudio(&rtp.Packet{
+					Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * 960)},
+					Payload: []byte{0xFC, 0xAA, 0xBB},
+				})
+			}
+
+			if tt.timedOut {
+				sink.stalled.Store(true)
+			}
+
+			start := time.Now()
+			r.Close()
+
+			assert.True(t, sink.closed)
+			assert.Equal(t, tt.timedOut, r.GetStats().FlushTimedOut)
+
+			if tt.timedOut {
+				// Only the write in progress at the deadline is waited for
+				assert.Less(t, time.Since(start), time.Second)
+				assert.LessOrEqual(t, sink.writes, 2)
+			}
+
+			// Closing again keeps the result
+			r.Close()
+			assert.Equal(t, tt.timedOut, r.GetStats().FlushTimedOut)
+		})
+	}
+}
+
+func TestWebmRecorder_FlushDeadlineClock(t *testing.T) {
+	sink := &stalledSink{}
+	clk := clock.NewMock(time.Now())
+	r, err := NewRecorderWithWriter(context.Background(), config.Recorder{
+		AudioPacketQueueSize: 64,
+		FlushDeadline:        time.Minute,
+	}, sink)
+	require.NoError(t, err)
+	r.(*WebmRecorder).WithClock(clk)
+	r.SetHasAudio(true)
+
+	for i := 0; i < 100; i++ {
+		r.PushAudio(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * 960)},
+			Payload: []byte{0xFC, 0xAA, 0xBB},
+		})
+	}
+
+	sink.stalled.Store(true)
+	closed := make(chan struct{})
+
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+
+	require.Eventually(t, func() bool { return clk.Timers() == 1 }, time.Second, time.Millisecond)
+	// The deadline is on the recorder's clock
+	clk.Add(time.Minute)
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close waited past the deadline")
+	}
+
+	assert.True(t, r.GetStats().FlushTimedOut)
+}
@@ -0,0 +1,58 @@
+package recorder
+
+import (
+	"fmt"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+)
+
+// EnableFMP4Output makes the recorder write fragmented MP4 (.mp4) files
+// instead of WebM/Matroska, so recordings can be served or packaged
+// (HLS/DASH) while they're being written. Audio-only Ogg/WAV output still
+// takes precedence when enabled. It must be called before any media is
+// pushed.
+func (r *WebmRecorder) EnableFMP4Output(cfg config.FMP4) error {
+	if cfg.FragmentDuration <= 0 {
+		return fmt.Errorf("invalid fMP4 fragment duration %v", cfg.FragmentDuration)
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.started {
+		return fmt.Errorf("cannot enable fMP4 output after recording started")
+	}
+
+	r.fmp4 = true
+	r.fmp4FragmentDuration = cfg.FragmentDuration
+	r.updateContainer()
+
+	return nil
+}
+
+// Locked
+func (r *WebmRecorder) isFMP4Output() bool {
+	audioOnly := r.hasAudio && !r.hasVideo
+
+	return r.fmp4 && !r.isWAVOutput() && !(r.audioOnlyOgg && audioOnly)
+}
+
+// Locked
+func (r *WebmRecorder) fmp4Tracks(width, height int) []FMP4Track {
+	var tracks []FMP4Track
+
+	if r.hasVideo {
+		tracks = append(tracks, FMP4Track{
+			Codec:        r.videoCodec,
+			Width:        width,
+			Height:       height,
+			CodecPrivate: r.videoCodecPrivate(),
+		})
+	}
+
+	if r.hasAudio {
+		tracks = append(tracks, FMP4Track{Codec: CodecOpus, Opus: r.audioFormat})
+	}
+
+	return tracks
+}
@@ -0,0 +1,551 @@
+package recorder
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/at-wat/ebml-go/webm"
+)
+
+const (
+	fmp4VideoTimescale = 90000
+	fmp4AudioTimescale = opusSampleRate
+
+	// Fragments are cut at the first keyframe past the fragment duration,
+	// or at this multiple of it if no keyframe shows up
+	fmp4MaxFragmentFactor = 2
+	// How long before a fragment boundary a keyframe is asked for
+	fmp4KeyframeLead = 500 * time.Millisecond
+
+	// ISO/IEC 14496-12 8.8.3.1 sample flags
+	fmp4SyncSampleFlags    = 0x02000000 // sample_depends_on = 2
+	fmp4NonSyncSampleFlags = 0x01010000 // sample_depends_on = 1, non sync
+
+	// tfhd/trun flags (ISO/IEC 14496-12 8.8.7, 8.8.8)
+	fmp4TfhdDefaultBaseIsMoof = 0x020000
+	fmp4TrunDataOffset        = 0x000001
+	fmp4TrunSampleDuration    = 0x000100
+	fmp4TrunSampleSize        = 0x000200
+	fmp4TrunSampleFlags       = 0x000400
+)
+
+var (
+	errFMP4WriterClosed  = errors.New("fmp4 writer closed")
+	errFMP4NoTracks      = errors.New("fmp4: no tracks")
+	errFMP4MissingConfig = errors.New("fmp4: H.264/AV1 track without decoder configuration")
+)
+
+// FMP4Track describes a track of a fragmented MP4 file
+type FMP4Track struct {
+	// Codec is one of the video Codec* mime types, or CodecOpus
+	Codec string
+	// Width and height of video tracks
+	Width, Height int
+	// CodecPrivate is the avcC of H.264 tracks
+	CodecPrivate []byte
+	// Opus is the channel layout of audio tracks, stereo if unset
+	Opus OpusFormat
+}
+
+type fmp4Sample struct {
+	data      []byte
+	keyframe  bool
+	timestamp int64 // In track timescale units
+	duration  int64
+}
+
+type fmp4TrackWriter struct {
+	muxer     *FMP4Writer
+	id        uint32
+	track     FMP4Track
+	timescale int64
+	video     bool
+	closed    bool
+
+	// The last sample is held back until the next one gives its duration
+	last         *fmp4Sample
+	lastDuration int64
+	samples      []fmp4Sample
+	decodeTime   int64
+	started      bool
+}
+
+// FMP4Writer writes a fragmented MP4 (ISO/IEC 14496-12) file: an init
+// segment (ftyp + moov) followed by moof + mdat fragments, so the file can
+// be played or packaged (HLS/DASH) while it's being written. It never seeks.
+// Fragments start at video keyframes once fragmentDuration has passed;
+// requestKeyframe is called shortly before each boundary so one arrives in
+// time.
+type FMP4Writer struct {
+	w                io.WriteCloser
+	mu               sync.Mutex
+	tracks           []*fmp4TrackWriter
+	fragmentDuration time.Duration
+	requestKeyframe  func()
+	userData         []byte // udta box of the moov, if any
+	closed           bool
+	err              error
+
+	sequence          uint32
+	fragmentStart     int64 // ms
+	fragmentStarted   bool
+	keyframeRequested bool
+}
+
+// NewFMP4Writer writes the init segment for tracks to w and returns a
+// writer for each track, in the same order. Timestamps are in milliseconds,
+// as with the WebM block writers.
+func NewFMP4Writer(w io.WriteCloser, tracks []FMP4Track, fragmentDuration time.Duration, requestKeyframe func()) ([]webm.BlockWriteCloser, error) {
+	return newFMP4Writer(w, tracks, fragmentDuration, requestKeyframe, nil)
+}
+
+// newFMP4Writer is NewFMP4Writer, with a udta box added to the init segment
+// if userData is set
+func newFMP4Writer(
+	w io.WriteCloser,
+	tracks []FMP4Track,
+	fragmentDuration time.Duration,
+	requestKeyframe func(),
+	userData []byte,
+) ([]webm.BlockWriteCloser, error) {
+	if len(tracks) == 0 {
+		return nil, errFMP4NoTracks
+	}
+
+	if requestKeyframe == nil {
+		requestKeyframe = func() {}
+	}
+
+	muxer := &FMP4Writer{
+		w:                w,
+		fragmentDuration: fragmentDuration,
+		requestKeyframe:  requestKeyframe,
+		userData:         userData,
+	}
+	writers := make([]webm.BlockWriteCloser, 0, len(tracks))
+
+	for i, track := range tracks {
+		tw := &fmp4TrackWriter{
+			muxer:     muxer,
+			id:        uint32(i + 1),
+			track:     track,
+			timescale: fmp4AudioTimescale,
+			video:     track.Codec != CodecOpus,
+		}
+
+		if tw.video {
+			tw.timescale = fmp4VideoTimescale
+		}
+
+		if (track.Codec == CodecH264 || track.Codec == CodecAV1) && len(track.CodecPrivate) == 0 {
+			return nil, errFMP4MissingConfig
+		}
+
+		muxer.tracks = append(muxer.tracks, tw)
+		writers = append(writers, tw)
+	}
+
+	if _, err := w.Write(muxer.initSegment()); err != nil {
+		return nil, err
+	}
+
+	return writers, nil
+}
+
+// leader is the track fragments are cut on: video if there is any
+func (m *FMP4Writer) leader() *fmp4TrackWriter {
+	for _, t := range m.tracks {
+		if t.video {
+			return t
+		}
+	}
+
+	return m.tracks[0]
+}
+
+func (t *fmp4TrackWriter) Write(keyframe bool, timestamp int64, b []byte) (int, error) {
+	m := t.muxer
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed || t.closed {
+		return 0, errFMP4WriterClosed
+	}
+
+	if m.err != nil {
+		return 0, m.err
+	}
+
+	ts := max(timestamp, 0) * t.timescale / 1000
+
+	if t.last != nil {
+		t.last.duration = max(ts-t.last.timestamp, 0)
+		t.lastDuration = t.last.duration
+		t.samples = append(t.samples, *t.last)
+	} else if !t.started {
+		t.started = true
+		t.decodeTime = ts
+	}
+
+	if t == m.leader() {
+		if !m.fragmentStarted {
+			m.fragmentStarted = true
+			m.fragmentStart = timestamp
+		}
+
+		elapsed := time.Duration(timestamp-m.fragmentStart) * time.Millisecond
+		cut := elapsed >= m.fragmentDuration*fmp4MaxFragmentFactor ||
+			elapsed >= m.fragmentDuration && (keyframe || !t.video)
+
+		if cut {
+			if err := m.writeFragment(); err != nil {
+				return 0, err
+			}
+
+			m.fragmentStart = timestamp
+			m.keyframeRequested = false
+			elapsed = 0
+		}
+
+		if t.video && !m.keyframeRequested && elapsed >= m.fragmentDuration-min(fmp4KeyframeLead, m.fragmentDuration/4) {
+			m.keyframeRequested = true
+			m.requestKeyframe()
+		}
+	}
+
+	data := make([]byte, len(b))
+	copy(data, b)
+	t.last = &fmp4Sample{data: data, keyframe: keyframe || !t.video, timestamp: ts}
+
+	return len(b), nil
+}
+
+// Close closes a track; the last fragment is written and the file closed
+// once all tracks are.
+func (t *fmp4TrackWriter) Close() error {
+	m := t.muxer
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t.closed {
+		return nil
+	}
+
+	t.closed = true
+
+	for _, track := range m.tracks {
+		if !track.closed {
+			return nil
+		}
+	}
+
+	m.closed = true
+
+	for _, track := range m.tracks {
+		track.flushLast()
+	}
+
+	err := m.writeFragment()
+
+	if closeErr := m.w.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// flushLast queues the held back sample, guessing its duration from the
+// previous ones
+func (t *fmp4TrackWriter) flushLast() {
+	if t.last == nil {
+		return
+	}
+
+	t.last.duration = t.lastDuration
+
+	if t.last.duration == 0 {
+		t.last.duration = t.defaultDuration()
+	}
+
+	t.samples = append(t.samples, *t.last)
+	t.last = nil
+}
+
+func (t *fmp4TrackWriter) defaultDuration() int64 {
+	if t.video {
+		return t.timescale / 30
+	}
+
+	return t.timescale / 50 // 20ms, the usual Opus packet
+}
+
+// writeFragment writes the queued samples of all tracks as a moof + mdat
+func (m *FMP4Writer) writeFragment() error {
+	var tracks []*fmp4TrackWriter
+	mdatSize := 8
+
+	for _, t := range m.tracks {
+		if len(t.samples) == 0 {
+			continue
+		}
+
+		tracks = append(tracks, t)
+
+		for _, s := range t.samples {
+			mdatSize += len(s.data)
+		}
+	}
+
+	if len(tracks) == 0 {
+		return nil
+	}
+
+	m.sequence++
+
+	// The data offsets don't change the moof size, so it's built once to
+	// measure it and again with the right offsets
+	moof := m.moof(tracks, 0)
+	moof = m.moof(tracks, len(moof)+8)
+
+	buf := make([]byte, 0, len(moof)+mdatSize)
+	buf = append(buf, moof...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(mdatSize))
+	buf = append(buf, "mdat"...)
+
+	for _, t := range tracks {
+		for _, s := range t.samples {
+			buf = append(buf, s.data...)
+			t.decodeTime += s.duration
+		}
+
+		t.samples = t.samples[:0]
+	}
+
+	if _, err := m.w.Write(buf); err != nil {
+		m.err = err
+		return err
+	}
+
+	return nil
+}
+
+func (m *FMP4Writer) moof(tracks []*fmp4TrackWriter, dataOffset int) []byte {
+	mfhd := fmp4FullBox("mfhd", 0, 0, binary.BigEndian.AppendUint32(nil, m.sequence))
+	boxes := [][]byte{mfhd}
+
+	for _, t := range tracks {
+		tfhd := fmp4FullBox("tfhd", 0, fmp4TfhdDefaultBaseIsMoof, binary.BigEndian.AppendUint32(nil, t.id))
+		tfdt := fmp4FullBox("tfdt", 1, 0, binary.BigEndian.AppendUint64(nil, uint64(t.decodeTime)))
+
+		trun := binary.BigEndian.AppendUint32(nil, uint32(len(t.samples)))
+		trun = binary.BigEndian.AppendUint32(trun, uint32(dataOffset))
+
+		for _, s := range t.samples {
+			flags := uint32(fmp4NonSyncSampleFlags)
+
+			if s.keyframe {
+				flags = fmp4SyncSampleFlags
+			}
+
+			trun = binary.BigEndian.AppendUint32(trun, uint32(s.duration))
+			trun = binary.BigEndian.AppendUint32(trun, uint32(len(s.data)))
+			trun = binary.BigEndian.AppendUint32(trun, flags)
+			dataOffset += len(s.data)
+		}
+
+		trunFlags := uint32(fmp4TrunDataOffset | fmp4TrunSampleDuration | fmp4TrunSampleSize | fmp4TrunSampleFlags)
+		boxes = append(boxes, fmp4Box("traf", tfhd, tfdt, fmp4FullBox("trun", 0, trunFlags, trun)))
+	}
+
+	return fmp4Box("moof", boxes...)
+}
+
+func (m *FMP4Writer) initSegment() []byte {
+	ftyp := fmp4Box("ftyp", []byte("iso5"), binary.BigEndian.AppendUint32(nil, 512),
+		[]byte("iso5iso6mp41"))
+
+	mvhd := make([]byte, 0, 96)
+	mvhd = binary.BigEndian.AppendUint32(mvhd, 0)    // creation_time
+	mvhd = binary.BigEndian.AppendUint32(mvhd, 0)    // modification_time
+	mvhd = binary.BigEndian.AppendUint32(mvhd, 1000) // timescale
+	mvhd = binary.BigEndian.AppendUint32(mvhd, 0)    // duration, unknown
+	mvhd = binary.BigEndian.AppendUint32(mvhd, 0x00010000)
+	mvhd = binary.BigEndian.AppendUint16(mvhd, 0x0100)
+	mvhd = append(mvhd, make([]byte, 10)...)
+	mvhd = append(mvhd, fmp4Matrix()...)
+	mvhd = append(mvhd, make([]byte, 24)...)
+	mvhd = binary.BigEndian.AppendUint32(mvhd, uint32(len(m.tracks)+1)) // next_track_ID
+
+	boxes := [][]byte{fmp4FullBox("mvhd", 0, 0, mvhd)}
+	var trexes [][]byte
+
+	for _, t := range m.tracks {
+		boxes = append(boxes, t.trak())
+
+		trex := binary.BigEndian.AppendUint32(nil, t.id)
+		trex = binary.BigEndian.AppendUint32(trex, 1) // default_sample_description_index
+		trex = append(trex, make([]byte, 12)...)
+		trexes = append(trexes, fmp4FullBox("trex", 0, 0, trex))
+	}
+
+	boxes = append(boxes, fmp4Box("mvex", trexes...))
+
+	if len(m.userData) > 0 {
+		boxes = append(boxes, m.userData)
+	}
+
+	return append(ftyp, fmp4Box("moov", boxes...)...)
+}
+
+func (t *fmp4TrackWriter) trak() []byte {
+	tkhd := make([]byte, 0, 80)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, 0) // creation_time
+	tkhd = binary.BigEndian.AppendUint32(tkhd, 0) // modification_time
+	tkhd = binary.BigEndian.AppendUint32(tkhd, t.id)
+	tkhd = append(tkhd, make([]byte, 4)...)       // reserved
+	tkhd = binary.BigEndian.AppendUint32(tkhd, 0) // duration
+	tkhd = append(tkhd, make([]byte, 8+2+2)...)   // reserved, layer, alternate_group
+
+	handler, name := "vide", "VideoHandler"
+	var mediaHeader []byte
+
+	if t.video {
+		tkhd = binary.BigEndian.AppendUint16(tkhd, 0) // volume
+		mediaHeader = fmp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	} else {
+		handler, name = "soun", "SoundHandler"
+		tkhd = binary.BigEndian.AppendUint16(tkhd, 0x0100)
+		mediaHeader = fmp4FullBox("smhd", 0, 0, make([]byte, 4))
+	}
+
+	tkhd = append(tkhd, 0, 0) // reserved
+	tkhd = append(tkhd, fmp4Matrix()...)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, uint32(t.track.Width)<<16)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, uint32(t.track.Height)<<16)
+
+	mdhd := make([]byte, 0, 20)
+	mdhd = binary.BigEndian.AppendUint32(mdhd, 0)
+	mdhd = binary.BigEndian.AppendUint32(mdhd, 0)
+	mdhd = binary.BigEndian.AppendUint32(mdhd, uint32(t.timescale))
+	mdhd = binary.BigEndian.AppendUint32(mdhd, 0)
+	mdhd = binary.BigEndian.AppendUint16(mdhd, 0x55C4) // "und"
+	mdhd = binary.BigEndian.AppendUint16(mdhd, 0)
+
+	hdlr := make([]byte, 4, 25+len(name))
+	hdlr = append(hdlr, handler...)
+	hdlr = append(hdlr, make([]byte, 12)...)
+	hdlr = append(hdlr, name...)
+	hdlr = append(hdlr, 0)
+
+	dref := fmp4FullBox("dref", 0, 0, binary.BigEndian.AppendUint32(nil, 1), fmp4FullBox("url ", 0, 1, nil))
+	stbl := fmp4Box("stbl",
+		fmp4FullBox("stsd", 0, 0, binary.BigEndian.AppendUint32(nil, 1), t.sampleEntry()),
+		fmp4FullBox("stts", 0, 0, make([]byte, 4)),
+		fmp4FullBox("stsc", 0, 0, make([]byte, 4)),
+		fmp4FullBox("stsz", 0, 0, make([]byte, 8)),
+		fmp4FullBox("stco", 0, 0, make([]byte, 4)),
+	)
+
+	return fmp4Box("trak",
+		fmp4FullBox("tkhd", 0, 3, tkhd), // enabled, in movie
+		fmp4Box("mdia",
+			fmp4FullBox("mdhd", 0, 0, mdhd),
+			fmp4FullBox("hdlr", 0, 0, hdlr),
+			fmp4Box("minf", mediaHeader, fmp4Box("dinf", dref), stbl),
+		),
+	)
+}
+
+func (t *fmp4TrackWriter) sampleEntry() []byte {
+	if !t.video {
+		// Opus sample entry and dOps (Encapsulation of Opus in ISOBMFF 4.3)
+		format := t.track.Opus
+
+		if format.Channels == 0 {
+			format = defaultOpusFormat
+		}
+
+		entry := make([]byte, 6, 28)
+		entry = binary.BigEndian.AppendUint16(entry, 1) // data_reference_index
+		entry = append(entry, make([]byte, 8)...)
+		entry = binary.BigEndian.AppendUint16(entry, uint16(format.Channels))
+		entry = binary.BigEndian.AppendUint16(entry, 16) // samplesize
+		entry = append(entry, make([]byte, 4)...)
+		entry = binary.BigEndian.AppendUint32(entry, opusSampleRate<<16)
+
+		return fmp4Box("Opus", entry, fmp4Box("dOps", format.dOps()))
+	}
+
+	entry := make([]byte, 6, 78)
+	entry = binary.BigEndian.AppendUint16(entry, 1) // data_reference_index
+	entry = append(entry, make([]byte, 16)...)
+	entry = binary.BigEndian.AppendUint16(entry, uint16(t.track.Width))
+	entry = binary.BigEndian.AppendUint16(entry, uint16(t.track.Height))
+	entry = binary.BigEndian.AppendUint32(entry, 0x00480000) // 72 dpi
+	entry = binary.BigEndian.AppendUint32(entry, 0x00480000)
+	entry = append(entry, make([]byte, 4)...)
+	entry = binary.BigEndian.AppendUint16(entry, 1) // frame_count
+	entry = append(entry, make([]byte, 32)...)      // compressorname
+	entry = binary.BigEndian.AppendUint16(entry, 0x0018)
+	entry = binary.BigEndian.AppendUint16(entry, 0xFFFF)
+
+	switch t.track.Codec {
+	case CodecH264:
+		return fmp4Box("avc1", entry, fmp4Box("avcC", t.track.CodecPrivate))
+	case CodecVP9:
+		return fmp4Box("vp09", entry, fmp4VPCodecConfig())
+	case CodecAV1:
+		return fmp4Box("av01", entry, fmp4Box("av1C", t.track.CodecPrivate))
+	default:
+		return fmp4Box("vp08", entry, fmp4VPCodecConfig())
+	}
+}
+
+// fmp4VPCodecConfig is a vpcC (VP Codec ISO Media File Format Binding 2.2)
+// for 8-bit 4:2:0 BT.709 profile 0, which is what WebRTC endpoints send
+func fmp4VPCodecConfig() []byte {
+	return fmp4FullBox("vpcC", 1, 0, []byte{
+		0,           // profile
+		10,          // level
+		8<<4 | 1<<1, // bitDepth, chromaSubsampling (4:2:0 colocated), full range off
+		1, 1, 1,     // colourPrimaries, transferCharacteristics, matrixCoefficients
+		0, 0, // codecInitializationDataSize
+	})
+}
+
+func fmp4Matrix() []byte {
+	matrix := make([]byte, 0, 36)
+
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		matrix = binary.BigEndian.AppendUint32(matrix, v)
+	}
+
+	return matrix
+}
+
+func fmp4Box(typ string, payloads ...[]byte) []byte {
+	size := 8
+
+	for _, p := range payloads {
+		size += len(p)
+	}
+
+	buf := make([]byte, 0, size)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(size))
+	buf = append(buf, typ...)
+
+	for _, p := range payloads {
+		buf = append(buf, p...)
+	}
+
+	return buf
+}
+
+func fmp4FullBox(typ string, version uint8, flags uint32, payloads ...[]byte) []byte {
+	header := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags&0xFFFFFF)
+
+	return fmp4Box(typ, append([][]byte{header}, payloads...)...)
+}
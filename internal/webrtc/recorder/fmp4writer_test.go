@@ -0,0 +1,267 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mp4Box struct {
+	typ     string
+	payload []byte
+	offset  int
+}
+
+func readMP4Boxes(t *testing.T, data []byte) []mp4Box {
+	var boxes []mp4Box
+	offset := 0
+
+	for offset < len(data) {
+		require.GreaterOrEqual(t, len(data)-offset, 8)
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		require.GreaterOrEqual(t, size, 8)
+		require.LessOrEqual(t, offset+size, len(data))
+
+		boxes = append(boxes, mp4Box{
+			typ:     string(data[offset+4 : offset+8]),
+			payload: data[offset+8 : offset+size],
+			offset:  offset,
+		})
+		offset += size
+	}
+
+	return boxes
+}
+
+func findMP4Box(t *testing.T, data []byte, path ...string) mp4Box {
+	var box mp4Box
+
+	for i, typ := range path {
+		found := false
+
+		for _, b := range readMP4Boxes(t, data) {
+			if b.typ == typ {
+				box, found = b, true
+				break
+			}
+		}
+
+		require.True(t, found, "Missing %s", typ)
+
+		if i < len(path)-1 {
+			data = box.payload
+		}
+	}
+
+	return box
+}
+
+type mp4TrunSample struct {
+	duration, size, flags uint32
+}
+
+type mp4Traf struct {
+	trackID    uint32
+	decodeTime uint64
+	dataOffset int
+	samples    []mp4TrunSample
+}
+
+func readMP4Trafs(t *testing.T, moof []byte) []mp4Traf {
+	var trafs []mp4Traf
+
+	for _, b := range readMP4Boxes(t, moof) {
+		if b.typ != "traf" {
+			continue
+		}
+
+		tfhd := findMP4Box(t, b.payload, "tfhd").payload
+		tfdt := findMP4Box(t, b.payload, "tfdt").payload
+		trun := findMP4Box(t, b.payload, "trun").payload
+		traf := mp4Traf{
+			trackID:    binary.BigEndian.Uint32(tfhd[4:]),
+			decodeTime: binary.BigEndian.Uint64(tfdt[4:]),
+			dataOffset: int(binary.BigEndian.Uint32(trun[8:])),
+		}
+
+		for i := 0; i < int(binary.BigEndian.Uint32(trun[4:])); i++ {
+			s := trun[12+i*12:]
+			traf.samples = append(traf.samples, mp4TrunSample{
+				binary.BigEndian.Uint32(s),
+				binary.BigEndian.Uint32(s[4:]),
+				binary.BigEndian.Uint32(s[8:]),
+			})
+		}
+
+		trafs = append(trafs, traf)
+	}
+
+	return trafs
+}
+
+func TestFMP4Writer(t *testing.T) {
+	sink := &streamSink{}
+	requests := 0
+	writers, err := NewFMP4Writer(sink, []FMP4Track{
+		{Codec: CodecVP8, Width: 1280, Height: 720},
+		{Codec: CodecOpus, Opus: OpusFormat{Channels: 2}},
+	}, 2*time.Second, func() { requests++ })
+	require.NoError(t, err)
+
+	video, audio := writers[0], writers[1]
+
+	// 5s of 25fps video with a keyframe each second, and 20ms audio
+	for ms := int64(0); ms < 5000; ms += 20 {
+		if ms%40 == 0 {
+			frame := []byte{byte(ms / 40), 0xAA, 0xBB}
+			_, err := video.Write(ms%1000 == 0, ms, frame)
+			require.NoError(t, err)
+		}
+
+		_, err := audio.Write(true, ms, []byte{0xFC, byte(ms / 20)})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, video.Close())
+	assert.False(t, sink.closed, "The file stays open until all tracks are closed")
+	require.NoError(t, audio.Close())
+	assert.True(t, sink.closed)
+
+	_, err = video.Write(true, 5000, []byte{1})
+	assert.ErrorIs(t, err, errFMP4WriterClosed)
+
+	data := sink.Bytes()
+	boxes := readMP4Boxes(t, data)
+	require.Len(t, boxes, 2+3*2, "ftyp, moov and 3 fragments")
+	assert.Equal(t, "ftyp", boxes[0].typ)
+	assert.Equal(t, "iso5", string(boxes[0].payload[:4]))
+	assert.Equal(t, "moov", boxes[1].typ)
+
+	moov := boxes[1].payload
+	findMP4Box(t, moov, "mvex", "trex")
+	vp08 := findMP4Box(t, moov, "trak", "mdia", "minf", "stbl", "stsd")
+	assert.Contains(t, string(vp08.payload), "vp08")
+	assert.Contains(t, string(vp08.payload), "vpcC")
+	assert.Contains(t, string(moov), "dOps")
+	assert.Equal(t, 2, bytes.Count(moov, []byte("trak")))
+
+	// Fragments start at the keyframes at 0, 2s and 4s
+	videoDecodeTimes := []uint64{0, 2 * fmp4VideoTimescale, 4 * fmp4VideoTimescale}
+
+	for i := 0; i < 3; i++ {
+		moof, mdat := boxes[2+2*i], boxes[3+2*i]
+		require.Equal(t, "moof", moof.typ)
+		require.Equal(t, "mdat", mdat.typ)
+		assert.Equal(t, uint32(i+1), binary.BigEndian.Uint32(findMP4Box(t, moof.payload, "mfhd").payload[4:]))
+
+		trafs := readMP4Trafs(t, moof.payload)
+		require.Len(t, trafs, 2)
+
+		v := trafs[0]
+		assert.Equal(t, uint32(1), v.trackID)
+		assert.Equal(t, videoDecodeTimes[i], v.decodeTime)
+		assert.Equal(t, uint32(fmp4SyncSampleFlags), v.samples[0].flags)
+		assert.Equal(t, uint32(fmp4NonSyncSampleFlags), v.samples[1].flags)
+		assert.Equal(t, uint32(40*fmp4VideoTimescale/1000), v.samples[0].duration)
+
+		// Offsets are relative to the moof and point at the sample data
+		first := data[moof.offset+v.dataOffset:]
+		assert.Equal(t, []byte{byte(videoDecodeTimes[i] / fmp4VideoTimescale * 25), 0xAA, 0xBB}, first[:3])
+
+		a := trafs[1]
+		assert.Equal(t, uint32(2), a.trackID)
+		assert.Equal(t, uint32(20*fmp4AudioTimescale/1000), a.samples[0].duration)
+		assert.Equal(t, byte(0xFC), data[moof.offset+a.dataOffset])
+	}
+
+	assert.Equal(t, 2, requests, "A keyframe is requested ahead of each boundary")
+}
+
+func TestFMP4Writer_NoKeyframes(t *testing.T) {
+	sink := &streamSink{}
+	writers, err := NewFMP4Writer(sink, []FMP4Track{{Codec: CodecVP9, Width: 640, Height: 360}}, time.Second, nil)
+	require.NoError(t, err)
+
+	for ms := int64(0); ms < 4500; ms += 100 {
+		_, err := writers[0].Write(ms == 0, ms, []byte{1})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, writers[0].Close())
+
+	var decodeTimes []uint64
+
+	for _, b := range readMP4Boxes(t, sink.Bytes()) {
+		if b.typ == "moof" {
+			decodeTimes = append(decodeTimes, readMP4Trafs(t, b.payload)[0].decodeTime)
+		}
+	}
+
+	assert.Equal(t, []uint64{0, 2 * fmp4VideoTimescale, 4 * fmp4VideoTimescale}, decodeTimes,
+		"Fragments are cut at twice the duration without keyframes")
+	assert.Contains(t, sink.String(), "vp09")
+}
+
+func TestFMP4Writer_H264(t *testing.T) {
+	_, err := NewFMP4Writer(&streamSink{}, []FMP4Track{{Codec: CodecH264}}, time.Second, nil)
+	assert.ErrorIs(t, err, errFMP4MissingConfig)
+
+	sink := &streamSink{}
+	avcC := buildAVCDecoderConfig([]byte{0x67, 0x42, 0xC0, 0x1F}, []byte{0x68, 0xCE})
+	writers, err := NewFMP4Writer(sink, []FMP4Track{{Codec: CodecH264, Width: 320, Height: 240, CodecPrivate: avcC}}, time.Second, nil)
+	require.NoError(t, err)
+	require.NoError(t, writers[0].Close())
+
+	avc1 := findMP4Box(t, sink.Bytes(), "moov", "trak", "mdia", "minf", "stbl", "stsd")
+	assert.Contains(t, string(avc1.payload), "avc1")
+	assert.True(t, bytes.Contains(avc1.payload, avcC))
+}
+
+func TestFMP4Writer_AV1(t *testing.T) {
+	_, err := NewFMP4Writer(&streamSink{}, []FMP4Track{{Codec: CodecAV1}}, time.Second, nil)
+	assert.ErrorIs(t, err, errFMP4MissingConfig)
+
+	seq, err := parseAV1SequenceHeader(mustHex(t, testAV1SequenceHeader))
+	require.NoError(t, err)
+	seq.obu = append([]byte{0x0A, 0x0B}, mustHex(t, testAV1SequenceHeader)...)
+	av1C := buildAV1CodecConfig(seq)
+
+	sink := &streamSink{}
+	writers, err := NewFMP4Writer(sink, []FMP4Track{{Codec: CodecAV1, Width: 640, Height: 480, CodecPrivate: av1C}}, time.Second, nil)
+	require.NoError(t, err)
+	require.NoError(t, writers[0].Close())
+
+	stsd := findMP4Box(t, sink.Bytes(), "moov", "trak", "mdia", "minf", "stbl", "stsd")
+	assert.Contains(t, string(stsd.payload), "av01")
+	assert.True(t, bytes.Contains(stsd.payload, av1C))
+}
+
+func TestWebmRecorder_FMP4(t *testing.T) {
+	s := newAVSyncSource(t)
+	assert.Error(t, s.r.EnableFMP4Output(config.FMP4{Enable: true}), "Fragment duration is required")
+	require.NoError(t, s.r.EnableFMP4Output(config.FMP4{Enable: true, FragmentDuration: time.Second}))
+	assert.Equal(t, ".mp4", s.r.containerExt())
+
+	s.run(3*time.Second, true, true)
+	s.r.Close()
+
+	assert.Greater(t, s.r.GetStats().Video.WrittenSamples, 80)
+	assert.Greater(t, s.r.GetStats().Audio.WrittenSamples, 140)
+
+	data, err := os.ReadFile(s.r.GetFilePath())
+	require.NoError(t, err)
+
+	boxes := readMP4Boxes(t, data)
+	require.GreaterOrEqual(t, len(boxes), 4)
+	assert.Equal(t, "ftyp", boxes[0].typ)
+	assert.Equal(t, "moov", boxes[1].typ)
+	assert.Equal(t, "moof", boxes[2].typ)
+	assert.Contains(t, string(boxes[1].payload), "vp08")
+	assert.Contains(t, string(boxes[1].payload), "Opus")
+}
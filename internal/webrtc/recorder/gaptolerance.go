@@ -0,0 +1,114 @@
+package recorder
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+)
+
+// maxToleratedGap bounds the gaps whose packets may be waited for
+const maxToleratedGap = 64
+
+// gapTolerance holds back the packets of small sequence gaps from being
+// counted lost: publishers reordering packets send them late rather than
+// never. Packets missing for longer than window are counted lost then, and
+// so are those of gaps over maxGap, at once. Only the loss accounting
+// waits; packets are passed on as they come.
+type gapTolerance struct {
+	maxGap int
+	window time.Duration
+	// Sequence numbers waited for, and since when
+	missing map[uint16]time.Time
+}
+
+// ValidateReorderTolerance checks the reorder tolerance configuration
+func ValidateReorderTolerance(cfg config.ReorderTolerance) error {
+	if cfg.MaxGap == 0 {
+		return nil
+	}
+
+	if cfg.MaxGap < 0 || cfg.MaxGap > maxToleratedGap {
+		return fmt.Errorf("reorder tolerance max gap %d out of range [0, %d]", cfg.MaxGap, maxToleratedGap)
+	}
+
+	if cfg.Window <= 0 {
+		return fmt.Errorf("invalid reorder tolerance window %s", cfg.Window)
+	}
+
+	return nil
+}
+
+// EnableReorderTolerance waits for the packets of sequence gaps of up to
+// cfg.MaxGap for cfg.Window before counting them lost, as validated by
+// ValidateReorderTolerance. Must be called before any media is pushed.
+func (r *WebmRecorder) EnableReorderTolerance(cfg config.ReorderTolerance) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	for _, tracker := range []*SequenceTracker{r.videoSeqTracker, r.audioSeqTracker} {
+		tracker.tolerance = nil
+
+		if cfg.MaxGap > 0 {
+			tracker.tolerance = &gapTolerance{
+				maxGap:  cfg.MaxGap,
+				window:  cfg.Window,
+				missing: make(map[uint16]time.Time),
+			}
+		}
+	}
+}
+
+// sequenceGap returns the packets to count lost as seq arrives on a track:
+// the gap before it, or with a tolerance, the packets given up on. Also
+// accounts late packets it waited for to stats.
+// Locked
+func (r *WebmRecorder) sequenceGap(tracker *SequenceTracker, stats *types.BaseTrackStats, seq uint16) (uint16, bool) {
+	expected := tracker.expectedNextSeq
+	t := tracker.tolerance
+
+	if t == nil {
+		if expected > 0 && seq != expected {
+			return calculateSequenceGap(seq, expected), true
+		}
+
+		return 0, false
+	}
+
+	// Not started, or restarted after a pause
+	if expected == 0 {
+		clear(t.missing)
+		return 0, false
+	}
+
+	var lost uint16
+	now := r.now()
+
+	for missing, since := range t.missing {
+		if now.Sub(since) > t.window {
+			delete(t.missing, missing)
+			lost++
+		}
+	}
+
+	switch diff := seq - expected; {
+	case diff >= 1<<15:
+		// Late: was it waited for?
+		if _, ok := t.missing[seq]; ok {
+			delete(t.missing, seq)
+
+			if stats != nil {
+				stats.ReorderedPackets++
+			}
+		}
+	case int(diff) > t.maxGap:
+		lost += diff
+	default:
+		for missing := expected; missing != seq; missing++ {
+			t.missing[missing] = now
+		}
+	}
+
+	return lost, lost > 0
+}
@@ -0,0 +1,79 @@
+package recorder
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebmRecorder_ReorderTolerance(t *testing.T) {
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, false)
+	r.SetHasVideo(true)
+	r.EnableReorderTolerance(config.ReorderTolerance{MaxGap: 2, Window: 100 * time.Millisecond})
+
+	clock := time.Unix(1000, 0)
+	r.now = func() time.Time { return clock }
+
+	push := func(seqs ...uint16) {
+		for _, seq := range seqs {
+			r.PushVideo(&rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 3000, Marker: true},
+				Payload: []byte{0x10, 0x00, 0x00, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01},
+			})
+			clock = clock.Add(10 * time.Millisecond)
+		}
+	}
+
+	// Reordered within the window
+	push(1, 2, 4, 3, 5)
+	stats := r.GetStats().Video
+	assert.Zero(t, stats.LostPackets)
+	assert.Equal(t, uint64(1), stats.ReorderedPackets)
+	assert.Zero(t, stats.RTPDiscontInfo.Count)
+
+	// Given up on once the window passed
+	push(7)
+	assert.Zero(t, r.GetStats().Video.LostPackets, "Waited for")
+	clock = clock.Add(200 * time.Millisecond)
+	push(8)
+	assert.Equal(t, uint64(1), r.GetStats().Video.LostPackets)
+
+	// Over the max gap, at once
+	push(12)
+	assert.Equal(t, uint64(4), r.GetStats().Video.LostPackets)
+
+	// Still lost when arriving too late, and the next one is in sequence
+	push(6, 13)
+	stats = r.GetStats().Video
+	assert.Equal(t, uint64(4), stats.LostPackets)
+	assert.Equal(t, uint64(1), stats.ReorderedPackets)
+	assert.Equal(t, 2, stats.RTPDiscontInfo.Count)
+}
+
+func TestWebmRecorder_ReorderToleranceDisabled(t *testing.T) {
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, false)
+	r.SetHasVideo(true)
+
+	for _, seq := range []uint16{1, 2, 4, 3, 5} {
+		r.PushVideo(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 3000, Marker: true},
+			Payload: []byte{0x10, 0x00, 0x00, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01},
+		})
+	}
+
+	stats := r.GetStats().Video
+	assert.NotZero(t, stats.LostPackets, "Any gap is counted lost")
+	assert.Zero(t, stats.ReorderedPackets)
+}
+
+func TestValidateReorderTolerance(t *testing.T) {
+	assert.NoError(t, ValidateReorderTolerance(config.ReorderTolerance{}))
+	assert.NoError(t, ValidateReorderTolerance(config.ReorderTolerance{MaxGap: 2, Window: 100 * time.Millisecond}))
+	assert.Error(t, ValidateReorderTolerance(config.ReorderTolerance{MaxGap: 2}))
+	assert.Error(t, ValidateReorderTolerance(config.ReorderTolerance{MaxGap: -1, Window: time.Second}))
+	assert.Error(t, ValidateReorderTolerance(config.ReorderTolerance{MaxGap: maxToleratedGap + 1, Window: time.Second}))
+}
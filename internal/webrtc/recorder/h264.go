@@ -0,0 +1,396 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/pion/rtp"
+	log "github.com/sirupsen/logrus"
+)
+
+// H.264 NAL unit types we care about (ITU-T H.264 Table 7-1)
+const (
+	h264NALTypeIDR = 5
+	h264NALTypeSPS = 7
+	h264NALTypePPS = 8
+)
+
+var errH264ShortSPS = errors.New("h264: SPS too short")
+
+func (r *WebmRecorder) pushH264(packet *rtp.Packet) {
+	if !r.hasVideo {
+		return
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if len(packet.Payload) == 0 || r.closed {
+		return
+	}
+
+	r.initVideoStats()
+
+	if gap, ok := r.sequenceGap(r.videoSeqTracker, &r.stats.Video.BaseTrackStats, packet.SequenceNumber); ok {
+		r.trackRTPDiscontinuity(&r.stats.Video.BaseTrackStats, gap)
+
+		r.logger.WithField("expected_seq", r.videoSeqTracker.expectedNextSeq).
+			WithField("got_seq", packet.SequenceNumber).
+			WithField("gap", gap).
+			Debug("Video sequence discontinuity detected")
+	}
+
+	// The sample builder retains the packet: it gets a copy of its own
+	packet = copyPacket(packet)
+	defer r.videoRecycler.recycle()
+
+	r.setExpectedNextSeq(packet.SequenceNumber, "video")
+	r.videoBuilder.Push(packet)
+
+	for {
+		// Samples are complete access units: the depacketizer already
+		// reassembled STAP-A/FU-A payloads into length-prefixed NAL units
+		sample, ts := r.videoBuilder.PopWithTimestamp()
+
+		if sample == nil {
+			return
+		}
+
+		isKf := false
+
+		r.h264NALUs = splitAVCNALUs(r.h264NALUs[:0], sample.Data)
+
+		for _, nalu := range r.h264NALUs {
+			switch nalu[0] & 0x1F {
+			case h264NALTypeIDR:
+				isKf = true
+			case h264NALTypeSPS:
+				r.updateH264ParamSet(&r.h264SPS, nalu, "SPS")
+			case h264NALTypePPS:
+				r.updateH264ParamSet(&r.h264PPS, nalu, "PPS")
+			}
+		}
+
+		if r.resumeKeyframePending {
+			if !isKf {
+				r.RequestKeyframe()
+				continue
+			}
+
+			r.resumeKeyframePending = false
+		}
+
+		duration := sample.Duration
+		r.trackFrameStats(r.stats.Video, len(sample.Data), isKf, duration)
+
+		if r.needsWebmWriter() {
+			// Matroska needs the parameter sets in the track's CodecPrivate,
+			// so nothing can be written until an IDR with SPS/PPS shows up.
+			if !isKf || r.h264SPS == nil || r.h264PPS == nil {
+				if r.videoWriter == nil {
+					if log.IsLevelEnabled(log.TraceLevel) {
+						r.logger.Tracef("Waiting for H.264 IDR with SPS/PPS, dropping frame: ts=%d, KF=%v", ts, isKf)
+					}
+
+					r.RequestKeyframe()
+					continue
+				}
+			} else {
+				width, height, err := parseH264SPSDimensions(r.h264SPS)
+
+				if err != nil {
+					r.logger.Warnf("Could not parse H.264 SPS dimensions: %v", err)
+				}
+
+				if log.IsLevelEnabled(log.TraceLevel) {
+					r.logger.Tracef("Frame dimensions: %dx%d", width, height)
+				}
+
+				r.initWriter(width, height)
+			}
+		}
+
+		if r.videoWriter != nil {
+			if gap, ok := r.consumePauseGap(&r.videoGapPending); ok {
+				duration = gap
+			}
+
+			r.startTimeline(&r.videoTimestamp, &r.videoTimelineStarted)
+			r.videoTimestamp += duration
+			r.anchorSkew(true, ts)
+
+			if log.IsLevelEnabled(log.TraceLevel) {
+				r.logger.Tracef("Writing H.264 frame: ts=%d, size=%d, KF=%v", ts, len(sample.Data), isKf)
+			}
+
+			if _, err := r.videoWriter.Write(isKf, int64(r.videoTimestamp/time.Millisecond), sample.Data); err != nil {
+				r.logger.Errorf("Error writing video frame: %v", err)
+				r.hasKeyFrame = false
+				r.RequestKeyframe()
+			} else {
+				r.onVideoFrameWritten(len(sample.Data), isKf)
+
+				if log.IsLevelEnabled(log.TraceLevel) {
+					r.logger.Tracef("H.264 frame written: ts=%d, size=%d, KF=%v", ts, len(sample.Data), isKf)
+				}
+			}
+		}
+	}
+}
+
+// SPS/PPS may be re-sent (or changed) mid-stream. They are kept in-band in the
+// written access units, so decoders pick up changes; we only keep the latest
+// copy around for (re)initializing the writer.
+func (r *WebmRecorder) updateH264ParamSet(dst *[]byte, nalu []byte, kind string) {
+	if bytes.Equal(*dst, nalu) {
+		return
+	}
+
+	if *dst != nil {
+		r.logger.Infof("H.264 %s changed mid-stream (size=%d)", kind, len(nalu))
+	}
+
+	*dst = append([]byte(nil), nalu...)
+}
+
+// splitAVCNALUs splits an AVC (4-byte length-prefixed) buffer into NAL
+// units, appended to nalus
+func splitAVCNALUs(nalus [][]byte, data []byte) [][]byte {
+	for len(data) >= 4 {
+		size := int(binary.BigEndian.Uint32(data[:4]))
+		data = data[4:]
+
+		if size == 0 || size > len(data) {
+			break
+		}
+
+		nalus = append(nalus, data[:size])
+		data = data[size:]
+	}
+
+	return nalus
+}
+
+// buildAVCDecoderConfig builds an AVCDecoderConfigurationRecord (ISO/IEC
+// 14496-15 5.2.4.1) to be used as the Matroska CodecPrivate
+func buildAVCDecoderConfig(sps, pps []byte) []byte {
+	if len(sps) < 4 || len(pps) == 0 {
+		return nil
+	}
+
+	buf := make([]byte, 0, 11+len(sps)+len(pps))
+	buf = append(buf,
+		1,      // configurationVersion
+		sps[1], // AVCProfileIndication
+		sps[2], // profile_compatibility
+		sps[3], // AVCLevelIndication
+		0xFF,   // 6 bits reserved + lengthSizeMinusOne = 3
+		0xE1,   // 3 bits reserved + numOfSequenceParameterSets = 1
+	)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(sps)))
+	buf = append(buf, sps...)
+	buf = append(buf, 1) // numOfPictureParameterSets
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(pps)))
+	buf = append(buf, pps...)
+
+	return buf
+}
+
+// parseH264SPSDimensions extracts the cropped picture size from a SPS NAL
+// unit (ITU-T H.264 7.3.2.1.1)
+func parseH264SPSDimensions(sps []byte) (int, int, error) {
+	if len(sps) < 4 {
+		return 0, 0, errH264ShortSPS
+	}
+
+	br := &expGolombReader{data: unescapeRBSP(sps[1:])}
+	profileIdc := br.readBits(8)
+	br.readBits(16) // constraint flags + level_idc
+	br.readUE()     // seq_parameter_set_id
+
+	chromaFormatIdc := uint(1)
+	separateColourPlane := uint(0)
+
+	switch profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormatIdc = br.readUE()
+
+		if chromaFormatIdc == 3 {
+			separateColourPlane = br.readBits(1)
+		}
+
+		br.readUE()    // bit_depth_luma_minus8
+		br.readUE()    // bit_depth_chroma_minus8
+		br.readBits(1) // qpprime_y_zero_transform_bypass_flag
+
+		if br.readBits(1) == 1 { // seq_scaling_matrix_present_flag
+			lists := 8
+
+			if chromaFormatIdc == 3 {
+				lists = 12
+			}
+
+			for i := 0; i < lists; i++ {
+				if br.readBits(1) == 1 {
+					size := 16
+
+					if i >= 6 {
+						size = 64
+					}
+
+					br.skipScalingList(size)
+				}
+			}
+		}
+	}
+
+	br.readUE() // log2_max_frame_num_minus4
+
+	switch br.readUE() { // pic_order_cnt_type
+	case 0:
+		br.readUE() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		br.readBits(1) // delta_pic_order_always_zero_flag
+		br.readSE()    // offset_for_non_ref_pic
+		br.readSE()    // offset_for_top_to_bottom_field
+
+		for i := br.readUE(); i > 0 && br.err == nil; i-- {
+			br.readSE() // offset_for_ref_frame
+		}
+	}
+
+	br.readUE()    // max_num_ref_frames
+	br.readBits(1) // gaps_in_frame_num_value_allowed_flag
+	widthInMbs := br.readUE() + 1
+	heightInMapUnits := br.readUE() + 1
+	frameMbsOnly := br.readBits(1)
+
+	if frameMbsOnly == 0 {
+		br.readBits(1) // mb_adaptive_frame_field_flag
+	}
+
+	br.readBits(1) // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom uint
+
+	if br.readBits(1) == 1 { // frame_cropping_flag
+		cropLeft = br.readUE()
+		cropRight = br.readUE()
+		cropTop = br.readUE()
+		cropBottom = br.readUE()
+	}
+
+	if br.err != nil {
+		return 0, 0, br.err
+	}
+
+	cropUnitX, cropUnitY := uint(1), 2-frameMbsOnly
+
+	if chromaFormatIdc != 0 && separateColourPlane == 0 {
+		subWidthC, subHeightC := uint(2), uint(1)
+
+		switch chromaFormatIdc {
+		case 1:
+			subHeightC = 2
+		case 3:
+			subWidthC = 1
+		}
+
+		cropUnitX = subWidthC
+		cropUnitY = subHeightC * (2 - frameMbsOnly)
+	}
+
+	width := int(widthInMbs*16) - int(cropUnitX*(cropLeft+cropRight))
+	height := int((2-frameMbsOnly)*heightInMapUnits*16) - int(cropUnitY*(cropTop+cropBottom))
+
+	return width, height, nil
+}
+
+// unescapeRBSP removes emulation prevention bytes (0x000003)
+func unescapeRBSP(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+
+	for _, b := range data {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+
+		out = append(out, b)
+	}
+
+	return out
+}
+
+// expGolombReader is a minimal MSB-first bit reader for parameter sets. The
+// first read past the end of data sets err; subsequent reads return 0.
+type expGolombReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (b *expGolombReader) readBits(n int) uint {
+	var v uint
+
+	for i := 0; i < n; i++ {
+		if b.pos >= len(b.data)*8 {
+			b.err = errH264ShortSPS
+			return 0
+		}
+
+		bit := (b.data[b.pos/8] >> (7 - uint(b.pos%8))) & 0x01
+		v = (v << 1) | uint(bit)
+		b.pos++
+	}
+
+	return v
+}
+
+func (b *expGolombReader) readUE() uint {
+	zeros := 0
+
+	for b.readBits(1) == 0 {
+		if b.err != nil || zeros > 31 {
+			b.err = errH264ShortSPS
+			return 0
+		}
+
+		zeros++
+	}
+
+	return (1 << uint(zeros)) - 1 + b.readBits(zeros)
+}
+
+func (b *expGolombReader) readSE() int {
+	v := b.readUE()
+
+	if v%2 == 0 {
+		return -int(v / 2)
+	}
+
+	return int((v + 1) / 2)
+}
+
+func (b *expGolombReader) skipScalingList(size int) {
+	last, next := 8, 8
+
+	for j := 0; j < size && b.err == nil; j++ {
+		if next != 0 {
+			next = (last + b.readSE() + 256) % 256
+		}
+
+		if next != 0 {
+			last = next
+		}
+	}
+}
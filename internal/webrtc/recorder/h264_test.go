@@ -0,0 +1,135 @@
+package recorder
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testSPS640x480  = "6742c01f8c8d40501e900f08846a"
+	testSPS1280x720 = "674d401fe8802802dd80b501010140000003004000000ca3c60c4480"
+	testPPS         = "68ce3c80"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+
+	return b
+}
+
+func TestParseH264SPSDimensions(t *testing.T) {
+	tests := []struct {
+		name   string
+		sps    string
+		width  int
+		height int
+	}{
+		{"constrained baseline 640x480", testSPS640x480, 640, 480},
+		{"main 1280x720 with cropping", testSPS1280x720, 1280, 720},
+		{"high 1280x720", "6764001facd9405005bb011000000300100000030320f1831960", 1280, 720},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, height, err := parseH264SPSDimensions(mustHex(t, tt.sps))
+			require.NoError(t, err)
+			assert.Equal(t, tt.width, width)
+			assert.Equal(t, tt.height, height)
+		})
+	}
+
+	_, _, err := parseH264SPSDimensions([]byte{0x67, 0x42})
+	assert.Error(t, err, "Truncated SPS should fail")
+}
+
+func TestBuildAVCDecoderConfig(t *testing.T) {
+	sps := mustHex(t, testSPS640x480)
+	pps := mustHex(t, testPPS)
+	avcC := buildAVCDecoderConfig(sps, pps)
+
+	require.Len(t, avcC, 11+len(sps)+len(pps))
+	assert.Equal(t, []byte{1, sps[1], sps[2], sps[3], 0xFF, 0xE1}, avcC[:6])
+	assert.Equal(t, sps, avcC[8:8+len(sps)])
+	assert.Equal(t, pps, avcC[len(avcC)-len(pps):])
+	assert.Nil(t, buildAVCDecoderConfig(nil, pps))
+}
+
+func TestSplitAVCNALUs(t *testing.T) {
+	data := []byte{0, 0, 0, 2, 0x67, 0x01, 0, 0, 0, 1, 0x68, 0, 0, 0, 9}
+	nalus := splitAVCNALUs(nil, data)
+
+	require.Len(t, nalus, 2, "Trailing truncated NALU should be ignored")
+	assert.Equal(t, []byte{0x67, 0x01}, nalus[0])
+	assert.Equal(t, []byte{0x68}, nalus[1])
+}
+
+func TestWebmRecorder_H264(t *testing.T) {
+	dir := t.TempDir()
+	r := NewWebmRecorder(filepath.Join(dir, "rec.webm"), 0600, 256, 64, false, false, false)
+	r.SetHasVideo(true)
+
+	require.NoError(t, r.SetVideoCodec("video/H264"))
+	assert.Equal(t, filepath.Join(dir, "rec.mkv"), r.GetFilePath())
+	assert.Error(t, r.SetVideoCodec("video/h265"))
+
+	sps := mustHex(t, testSPS640x480)
+	pps := mustHex(t, testPPS)
+	idr := append([]byte{0x65}, make([]byte, 64)...)
+	nonIdr := append([]byte{0x41}, make([]byte, 32)...)
+
+	// STAP-A with SPS and PPS
+	stapA := []byte{0x78}
+	stapA = append(stapA, byte(len(sps)>>8), byte(len(sps)))
+	stapA = append(stapA, sps...)
+	stapA = append(stapA, byte(len(pps)>>8), byte(len(pps)))
+	stapA = append(stapA, pps...)
+
+	// IDR split into FU-A fragments
+	fuStart := append([]byte{0x7C, 0x85}, idr[1:33]...)
+	fuEnd := append([]byte{0x7C, 0x45}, idr[33:]...)
+
+	seq := uint16(100)
+	push := func(ts uint32, marker bool, payload []byte) {
+		r.PushVideo(&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				SequenceNumber: seq,
+				Timestamp:      ts,
+				Marker:         marker,
+			},
+			Payload: payload,
+		})
+		seq++
+	}
+
+	// A P-frame before any IDR must be dropped
+	push(1000, true, nonIdr)
+
+	for i := uint32(0); i < 5; i++ {
+		ts := 4000 + i*3000
+		push(ts, false, stapA)
+		push(ts, false, fuStart)
+		push(ts, true, fuEnd)
+		push(ts+1500, true, nonIdr)
+	}
+
+	r.Close()
+
+	stats := r.GetStats()
+	require.NotNil(t, stats.Video)
+	assert.Equal(t, CodecH264, stats.Video.Codec)
+	assert.Greater(t, stats.Video.KeyframeCount, 0)
+	assert.Greater(t, stats.Video.WrittenSamples, 0)
+
+	data, err := os.ReadFile(r.GetFilePath())
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "matroska")
+	assert.Contains(t, string(data), "V_MPEG4/ISO/AVC")
+}
@@ -0,0 +1,392 @@
+package recorder
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	"github.com/pion/rtp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Mixes are encoded as 20ms Opus frames at 48kHz
+	mixSampleRate   = 48000
+	mixFrameSamples = mixSampleRate / 50
+	// A track whose RTP timeline drifted further than this from the wall
+	// clock (e.g. it stopped and resumed) is realigned to it
+	maxMixDrift = time.Second
+	// Payload type and SSRC of the mix's packets, internal to the recorder
+	mixPayloadType = 111
+	mixSSRC        = 1
+)
+
+type opusEncoder interface {
+	// Encode encodes a frame of interleaved pcm into data, returning the
+	// length of the packet
+	Encode(pcm []int16, data []byte) (int, error)
+	Close()
+}
+
+var newOpusEncoder = newLibopusEncoder
+
+// AudioMixer is implemented by recorders that can mix several audio tracks
+// into the recording's single audio track
+type AudioMixer interface {
+	// MixesAudio returns whether audio must be pushed with PushAudioTrack
+	MixesAudio() bool
+	// PushAudioTrack pushes an Opus packet of one of the mixed tracks.
+	// Packets of a track are expected in order.
+	PushAudioTrack(trackID string, p *rtp.Packet)
+}
+
+var _ AudioMixer = (*WebmRecorder)(nil)
+
+type mixInput struct {
+	dec  opusDecoder
+	gain float64
+	// Sample position on the mix timeline of the RTP timestamp anchorTs
+	anchorPos int64
+	anchorTs  int64
+	// Unwrapped RTP timestamp of the last packet
+	lastTs int64
+	stats  *types.MixInputStats
+}
+
+// audioMixer decodes the audio tracks pushed to it, mixes them and encodes
+// the mix as a single Opus stream. Tracks are placed on the mix timeline by
+// arrival time when they start (or resume after drifting), then by RTP
+// timestamp; the mix is held for latency before being encoded so late
+// tracks still make it in. Frames nobody spoke in are encoded as silence.
+type audioMixer struct {
+	mu sync.Mutex
+
+	ctx     context.Context
+	cfg     config.AudioMix
+	gains   map[string]float64
+	now     func() time.Time
+	encoder opusEncoder
+	// What the encoder encodes with
+	encoding types.OpusEncoding
+	// write receives the mix's packets
+	write func(p *rtp.Packet)
+
+	inputs  map[string]*mixInput
+	started bool
+	startAt time.Time
+	// Frames not encoded yet, the first one being nextFrame
+	pending   [][]int32
+	nextFrame int64
+	seq       uint16
+
+	pcm     []int16 // Decoded packet
+	frame   []int16 // Frame to encode
+	encoded []byte
+}
+
+func newAudioMixer(
+	ctx context.Context,
+	cfg config.AudioMix,
+	opus config.OpusEncoder,
+	gains map[string]float64,
+	now func() time.Time,
+	write func(p *rtp.Packet),
+) (*audioMixer, error) {
+	if cfg.Channels != 1 && cfg.Channels != 2 {
+		return nil, fmt.Errorf("unsupported audio mix channel count %d (must be 1 or 2)", cfg.Channels)
+	}
+
+	for trackID, gain := range gains {
+		if gain < 0 || math.IsNaN(gain) || math.IsInf(gain, 0) {
+			return nil, fmt.Errorf("invalid audio mix gain %v for track %s", gain, trackID)
+		}
+	}
+
+	// Packets are decoded whole before being mixed, so the mix can't be
+	// held for less than the longest one
+	if cfg.Latency < opusMaxPacketDuration {
+		cfg.Latency = opusMaxPacketDuration
+	}
+
+	encoding := opusEncoding(opus, cfg.Bitrate)
+	enc, err := newOpusEncoder(mixSampleRate, cfg.Channels, encoding)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &audioMixer{
+		ctx:      ctx,
+		cfg:      cfg,
+		gains:    gains,
+		now:      now,
+		encoder:  enc,
+		encoding: encoding,
+		write:    write,
+		inputs:   make(map[string]*mixInput),
+		pcm:      make([]int16, int(opusMaxPacketDuration.Seconds()*mixSampleRate)*cfg.Channels),
+		frame:    make([]int16, mixFrameSamples*cfg.Channels),
+		encoded:  make([]byte, 4000), // Recommended max packet size
+	}, nil
+}
+
+// wallPos is the mix timeline position, in samples, of the present
+func (m *audioMixer) wallPos(now time.Time) int64 {
+	return int64(now.Sub(m.startAt)) * mixSampleRate / int64(time.Second)
+}
+
+func (m *audioMixer) input(trackID string) (*mixInput, error) {
+	if in, ok := m.inputs[trackID]; ok {
+		return in, nil
+	}
+
+	dec, err := newOpusDecoder(mixSampleRate, m.cfg.Channels)
+
+	if err != nil {
+		return nil, err
+	}
+
+	gain, ok := m.gains[trackID]
+
+	if !ok {
+		gain = 1
+	}
+
+	in := &mixInput{dec: dec, gain: gain, stats: &types.MixInputStats{Gain: gain}}
+	m.inputs[trackID] = in
+
+	return in, nil
+}
+
+func (m *audioMixer) push(trackID string, p *rtp.Packet) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.encoder == nil || len(p.Payload) == 0 {
+		return
+	}
+
+	now := m.now()
+
+	if !m.started {
+		m.started = true
+		m.startAt = now
+	}
+
+	in, err := m.input(trackID)
+
+	if err != nil {
+		log.WithField("session", m.ctx.Value("session")).
+			WithField("trackID", trackID).
+			WithError(err).
+			Error("Failed to create audio mix decoder")
+		return
+	}
+
+	in.stats.Packets++
+	wall := m.wallPos(now)
+
+	if in.stats.Packets == 1 {
+		in.lastTs = int64(p.Timestamp)
+		in.anchorTs = in.lastTs
+		in.anchorPos = wall
+	} else {
+		in.lastTs += int64(int32(p.Timestamp - uint32(in.lastTs)))
+	}
+
+	pos := in.anchorPos + in.lastTs - in.anchorTs
+
+	if drift := time.Duration(pos-wall) * time.Second / mixSampleRate; drift > maxMixDrift || drift < -maxMixDrift {
+		in.anchorTs = in.lastTs
+		in.anchorPos = wall
+		pos = wall
+		in.stats.Realignments++
+	}
+
+	frames, err := in.dec.Decode(p.Payload, m.pcm)
+
+	if err != nil {
+		in.stats.DecodeErrors++
+		return
+	}
+
+	end := pos + int64(frames)
+	m.emitUntil(end - int64(m.cfg.Latency)*mixSampleRate/int64(time.Second))
+
+	if pos < m.nextFrame*mixFrameSamples {
+		in.stats.LatePackets++
+	}
+
+	m.mix(in, pos, m.pcm[:frames*m.cfg.Channels])
+
+	if in.stats.Packets == 1 {
+		in.stats.StartMs = pos * 1000 / mixSampleRate
+	}
+
+	in.stats.EndMs = end * 1000 / mixSampleRate
+}
+
+// mix adds the pcm of a packet starting at pos to the pending frames, minus
+// the part that was already encoded
+func (m *audioMixer) mix(in *mixInput, pos int64, pcm []int16) {
+	channels := int64(m.cfg.Channels)
+	first := m.nextFrame * mixFrameSamples
+
+	for i := int64(0); i < int64(len(pcm))/channels; i++ {
+		sample := pos + i
+
+		if sample < first {
+			continue
+		}
+
+		index := (sample - first) / mixFrameSamples
+
+		for int64(len(m.pending)) <= index {
+			m.pending = append(m.pending, make([]int32, mixFrameSamples*channels))
+		}
+
+		offset := (sample - first) % mixFrameSamples * channels
+
+		for c := int64(0); c < channels; c++ {
+			m.pending[index][offset+c] += int32(float64(pcm[i*channels+c]) * in.gain)
+		}
+	}
+}
+
+// emitUntil encodes the frames that end before pos, silent ones included
+func (m *audioMixer) emitUntil(pos int64) {
+	for (m.nextFrame+1)*mixFrameSamples <= pos {
+		var frame []int32
+
+		if len(m.pending) > 0 {
+			frame = m.pending[0]
+			m.pending[0] = nil
+			m.pending = m.pending[1:]
+		}
+
+		m.encodeFrame(frame)
+	}
+}
+
+// encodeFrame encodes and writes the next frame, silence if nil
+func (m *audioMixer) encodeFrame(frame []int32) {
+	for i := range m.frame {
+		if frame == nil {
+			m.frame[i] = 0
+			continue
+		}
+
+		m.frame[i] = int16(max(math.MinInt16, min(math.MaxInt16, frame[i])))
+	}
+
+	ts := uint32(m.nextFrame * mixFrameSamples)
+	m.nextFrame++
+	n, err := m.encoder.Encode(m.frame, m.encoded)
+
+	if err != nil {
+		log.WithField("session", m.ctx.Value("session")).
+			WithError(err).
+			Warn("Failed to encode audio mix frame")
+		return
+	}
+
+	m.write(&rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    mixPayloadType,
+			SequenceNumber: m.seq,
+			Timestamp:      ts,
+			SSRC:           mixSSRC,
+		},
+		Payload: m.encoded[:n],
+	})
+	m.seq++
+}
+
+// flush encodes what's left of the mix and releases the codecs
+func (m *audioMixer) flush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.encoder == nil {
+		return
+	}
+
+	for len(m.pending) > 0 {
+		m.emitUntil((m.nextFrame + 1) * mixFrameSamples)
+	}
+
+	m.encoder.Close()
+	m.encoder = nil
+
+	for _, in := range m.inputs {
+		in.dec.Close()
+	}
+}
+
+// inputStats returns a copy of the stats of the mixed tracks
+func (m *audioMixer) inputStats() map[string]*types.MixInputStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := make(map[string]*types.MixInputStats, len(m.inputs))
+
+	for trackID, in := range m.inputs {
+		s := *in.stats
+		stats[trackID] = &s
+	}
+
+	return stats
+}
+
+// EnableAudioMix makes the recorder mix the audio tracks pushed with
+// PushAudioTrack into a single Opus track, as set by cfg and encoded as set
+// by SetOpusEncoder. gains are linear, by track ID; unset ones are 1. It
+// must be called before any audio is pushed.
+func (r *WebmRecorder) EnableAudioMix(cfg config.AudioMix, gains map[string]float64) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.started {
+		return fmt.Errorf("cannot enable audio mixing after recording started")
+	}
+
+	mixer, err := newAudioMixer(r.ctx, cfg, r.opusEncoderCfg, gains, func() time.Time { return r.now() }, r.pushAudio)
+
+	if err != nil {
+		return err
+	}
+
+	r.mixer = mixer
+	r.audioFormat = OpusFormat{Channels: uint8(cfg.Channels)}
+	r.applyClockRates()
+
+	return nil
+}
+
+func (r *WebmRecorder) MixesAudio() bool {
+	return r.mixer != nil
+}
+
+func (r *WebmRecorder) PushAudioTrack(trackID string, p *rtp.Packet) {
+	if r.mixer == nil {
+		r.PushAudio(p)
+		return
+	}
+
+	if !r.hasAudio || p == nil {
+		return
+	}
+
+	r.audioPackets.Add(1)
+
+	if r.isPaused() {
+		return
+	}
+
+	r.mixer.push(trackID, p)
+}
@@ -0,0 +1,232 @@
+package recorder
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOpusEncoder "encodes" a frame as its first sample
+type fakeOpusEncoder struct {
+	encoding types.OpusEncoding
+	closed   bool
+}
+
+func (e *fakeOpusEncoder) Encode(pcm []int16, data []byte) (int, error) {
+	binary.LittleEndian.PutUint16(data, uint16(pcm[0]))
+	return 2, nil
+}
+
+func (e *fakeOpusEncoder) Close() {
+	e.closed = true
+}
+
+func useFakeOpusEncoder(t *testing.T) *fakeOpusEncoder {
+	enc := &fakeOpusEncoder{}
+	orig := newOpusEncoder
+	newOpusEncoder = func(sampleRate, channels int, encoding types.OpusEncoding) (opusEncoder, error) {
+		enc.encoding = encoding
+		return enc, nil
+	}
+	t.Cleanup(func() { newOpusEncoder = orig })
+
+	return enc
+}
+
+// mixSource drives an audioMixer with a fake clock, collecting the mix
+type mixSource struct {
+	m      *audioMixer
+	clock  time.Time
+	frames []*rtp.Packet
+}
+
+func newMixSource(t *testing.T, gains map[string]float64) *mixSource {
+	useFakeOpusDecoder(t)
+	s := &mixSource{clock: time.Unix(1000, 0)}
+	cfg := config.AudioMix{Channels: 1, Bitrate: 32000, Latency: 200 * time.Millisecond}
+	m, err := newAudioMixer(context.Background(), cfg, config.OpusEncoder{}, gains, func() time.Time { return s.clock }, func(p *rtp.Packet) {
+		c := *p
+		c.Payload = append([]byte(nil), p.Payload...)
+		s.frames = append(s.frames, &c)
+	})
+	require.NoError(t, err)
+	s.m = m
+
+	return s
+}
+
+func (s *mixSource) push(trackID string, ts uint32) {
+	s.m.push(trackID, &rtp.Packet{Header: rtp.Header{Version: 2, Timestamp: ts}, Payload: []byte{0xFC}})
+}
+
+// values returns the first sample of each mixed frame
+func (s *mixSource) values() []int16 {
+	values := make([]int16, len(s.frames))
+
+	for i, p := range s.frames {
+		values[i] = int16(binary.LittleEndian.Uint16(p.Payload))
+	}
+
+	return values
+}
+
+func TestAudioMixer_Mix(t *testing.T) {
+	enc := useFakeOpusEncoder(t)
+	s := newMixSource(t, map[string]float64{"b": 0.5})
+
+	// b joins 40ms after a, with unrelated RTP timestamps
+	for i := uint32(0); i < 20; i++ {
+		s.push("a", 1000+i*960)
+
+		if i >= 2 {
+			s.push("b", 5000+(i-2)*960)
+		}
+
+		s.clock = s.clock.Add(20 * time.Millisecond)
+	}
+
+	assert.Len(t, s.frames, 20-10, "Held for the latency")
+
+	s.m.flush()
+	assert.True(t, enc.closed)
+
+	expected := make([]int16, 20)
+
+	for i := range expected {
+		expected[i] = 1500
+	}
+
+	expected[0], expected[1] = 1000, 1000
+	assert.Equal(t, expected, s.values())
+
+	for i, p := range s.frames {
+		assert.Equal(t, uint16(i), p.SequenceNumber)
+		assert.Equal(t, uint32(i*mixFrameSamples), p.Timestamp)
+		assert.Equal(t, uint8(mixPayloadType), p.PayloadType)
+	}
+
+	stats := s.m.inputStats()
+	require.Len(t, stats, 2)
+	assert.Equal(t, 1.0, stats["a"].Gain)
+	assert.Equal(t, uint64(20), stats["a"].Packets)
+	assert.Equal(t, int64(0), stats["a"].StartMs)
+	assert.Equal(t, int64(400), stats["a"].EndMs)
+	assert.Equal(t, 0.5, stats["b"].Gain)
+	assert.Equal(t, uint64(18), stats["b"].Packets)
+	assert.Equal(t, int64(40), stats["b"].StartMs)
+	assert.Equal(t, int64(400), stats["b"].EndMs)
+
+	// Nothing is mixed once flushed
+	s.push("a", 1000+20*960)
+	assert.Len(t, s.frames, 20)
+}
+
+func TestAudioMixer_SilenceAndClipping(t *testing.T) {
+	useFakeOpusEncoder(t)
+	s := newMixSource(t, map[string]float64{"a": 40})
+
+	// DTX: 80ms without packets
+	s.push("a", 0)
+	s.clock = s.clock.Add(100 * time.Millisecond)
+	s.push("a", 5*960)
+	s.m.flush()
+
+	assert.Equal(t, []int16{math.MaxInt16, 0, 0, 0, 0, math.MaxInt16}, s.values())
+}
+
+func TestAudioMixer_LateAndRealigned(t *testing.T) {
+	useFakeOpusEncoder(t)
+	s := newMixSource(t, nil)
+
+	for i := uint32(0); i < 20; i++ {
+		s.push("a", i*960)
+		s.clock = s.clock.Add(20 * time.Millisecond)
+	}
+
+	// A retransmission of a frame already encoded
+	s.push("a", 0)
+	assert.Equal(t, uint64(1), s.m.inputStats()["a"].LatePackets)
+
+	// The track resumed with a timestamp jump
+	s.push("a", 100*48000)
+	stats := s.m.inputStats()["a"]
+	assert.Equal(t, 1, stats.Realignments)
+	assert.Equal(t, int64(420), stats.EndMs, "Placed at the wall clock")
+
+	s.m.flush()
+	assert.Len(t, s.frames, 21)
+}
+
+func TestNewAudioMixer_Invalid(t *testing.T) {
+	useFakeOpusEncoder(t)
+	now := func() time.Time { return time.Now() }
+	write := func(p *rtp.Packet) {}
+	ctx := context.Background()
+
+	_, err := newAudioMixer(ctx, config.AudioMix{Channels: 3}, config.OpusEncoder{}, nil, now, write)
+	assert.Error(t, err)
+
+	_, err = newAudioMixer(ctx, config.AudioMix{Channels: 1}, config.OpusEncoder{}, map[string]float64{"a": -1}, now, write)
+	assert.Error(t, err)
+
+	_, err = newAudioMixer(ctx, config.AudioMix{Channels: 1}, config.OpusEncoder{}, map[string]float64{"a": math.NaN()}, now, write)
+	assert.Error(t, err)
+
+	m, err := newAudioMixer(ctx, config.AudioMix{Channels: 2}, config.OpusEncoder{}, map[string]float64{"a": 0}, now, write)
+	require.NoError(t, err)
+	assert.Equal(t, opusMaxPacketDuration, m.cfg.Latency, "Latency raised to the longest packet")
+}
+
+func TestWebmRecorder_AudioMix(t *testing.T) {
+	enc := useFakeOpusEncoder(t)
+	useFakeOpusDecoder(t)
+
+	dir := t.TempDir()
+	r := NewWebmRecorder(filepath.Join(dir, "rec.webm"), 0600, 256, 64, false, false, true)
+	r.SetHasAudio(true)
+	r.SetOpusEncoder(config.OpusEncoder{Complexity: 8, FEC: true, Application: OpusApplicationVoIP})
+	require.NoError(t, r.EnableAudioMix(config.AudioMix{Channels: 2, Bitrate: 32000, Latency: 200 * time.Millisecond}, nil))
+	assert.True(t, r.MixesAudio())
+
+	encoding := types.OpusEncoding{Bitrate: 32000, Complexity: 8, FEC: true, Application: OpusApplicationVoIP}
+	assert.Equal(t, encoding, enc.encoding)
+
+	clock := time.Unix(1000, 0)
+	r.now = func() time.Time { return clock }
+
+	for i := uint32(0); i < 50; i++ {
+		for _, trackID := range []string{"a", "b"} {
+			r.PushAudioTrack(trackID, &rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: i * 960},
+				Payload: []byte{0xFC, 0xAA},
+			})
+		}
+
+		clock = clock.Add(20 * time.Millisecond)
+	}
+
+	assert.Error(t, r.EnableAudioMix(config.AudioMix{Channels: 1}, nil), "Already started")
+	assert.Equal(t, uint64(100), r.ReceivedPackets())
+
+	r.Close()
+
+	stats := r.GetStats()
+	require.Len(t, stats.AudioInputs, 2)
+	assert.Equal(t, uint64(50), stats.AudioInputs["a"].Packets)
+	assert.Equal(t, uint64(50), stats.AudioInputs["b"].Packets)
+	assert.Equal(t, &encoding, stats.AudioEncoding)
+
+	info, err := os.Stat(r.GetFilePath())
+	require.NoError(t, err)
+	assert.Greater(t, info.Size(), int64(0))
+}
@@ -0,0 +1,219 @@
+package recorder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"time"
+
+	"github.com/at-wat/ebml-go"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+)
+
+// WebM is a subset of Matroska: MKV output writes the same tracks and tags
+// as WebM does, to a Matroska file, with what WebM leaves out on top:
+// chapters, marked while recording, and attachments, appended once the
+// recording is closed (e.g. its sidecar). The Segment is written with an
+// unknown size, so both can follow its last Cluster without rewriting it.
+
+// Chapters are "und" (undetermined) language: titles are whatever the
+// client sent
+const chapterLanguage = "und"
+
+var errRecorderClosed = errors.New("recorder closed")
+
+type chapter struct {
+	title string
+	start time.Duration
+}
+
+// EnableMKVOutput makes the recorder write Matroska (.mkv) files instead of
+// WebM, whatever the codecs. fMP4 and audio-only Ogg/WAV output still take
+// precedence when enabled. It must be called before any media is pushed.
+func (r *WebmRecorder) EnableMKVOutput(cfg config.MKV) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.started {
+		return fmt.Errorf("cannot enable MKV output after recording started")
+	}
+
+	r.mkv = cfg.Enable
+	r.updateContainer()
+
+	return nil
+}
+
+// Locked
+func (r *WebmRecorder) isMKVOutput() bool {
+	audioOnly := r.hasAudio && !r.hasVideo
+
+	return r.mkv && !r.isFMP4Output() && !r.isWAVOutput() && !(r.audioOnlyOgg && audioOnly)
+}
+
+// AddChapter starts a chapter titled title at the current media time, that
+// ends where the next one starts or with the recording. Chapters are
+// written once the recording is closed, to MKV files that aren't segmented
+// only.
+func (r *WebmRecorder) AddChapter(title string) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.closed {
+		return errRecorderClosed
+	}
+
+	if !r.isMKVOutput() || r.isSegmented() {
+		return fmt.Errorf("chapters are only written to unsegmented MKV recordings")
+	}
+
+	start := max(r.videoTimestamp, r.audioTimestamp)
+
+	if !r.started {
+		start = 0
+	}
+
+	// Chapters starting at the same time replace each other
+	if n := len(r.chapters); n > 0 && r.chapters[n-1].start >= start {
+		r.chapters = r.chapters[:n-1]
+	}
+
+	r.chapters = append(r.chapters, chapter{title: title, start: start})
+
+	return nil
+}
+
+type matroskaChapterDisplay struct {
+	ChapString   string `ebml:"ChapString"`
+	ChapLanguage string `ebml:"ChapLanguage"`
+}
+
+type matroskaChapterAtom struct {
+	ChapterUID       uint64                 `ebml:"ChapterUID"`
+	ChapterTimeStart uint64                 `ebml:"ChapterTimeStart"`
+	ChapterTimeEnd   uint64                 `ebml:"ChapterTimeEnd"`
+	ChapterDisplay   matroskaChapterDisplay `ebml:"ChapterDisplay"`
+}
+
+type matroskaChaptersElement struct {
+	Chapters struct {
+		EditionEntry struct {
+			EditionFlagDefault uint64                `ebml:"EditionFlagDefault"`
+			ChapterAtom        []matroskaChapterAtom `ebml:"ChapterAtom"`
+		} `ebml:"EditionEntry"`
+	} `ebml:"Chapters"`
+}
+
+// matroskaChapters returns the Chapters element holding chapters, the last
+// ending at end. Times are in ns, whatever the segment's timecode scale.
+func matroskaChapters(chapters []chapter, end time.Duration) ([]byte, error) {
+	var element matroskaChaptersElement
+	element.Chapters.EditionEntry.EditionFlagDefault = 1
+
+	for i, c := range chapters {
+		chapterEnd := end
+
+		if i+1 < len(chapters) {
+			chapterEnd = chapters[i+1].start
+		}
+
+		element.Chapters.EditionEntry.ChapterAtom = append(element.Chapters.EditionEntry.ChapterAtom, matroskaChapterAtom{
+			ChapterUID:       uint64(i + 1),
+			ChapterTimeStart: uint64(c.start),
+			ChapterTimeEnd:   uint64(max(chapterEnd, c.start)),
+			ChapterDisplay:   matroskaChapterDisplay{ChapString: c.title, ChapLanguage: chapterLanguage},
+		})
+	}
+
+	var buf bytes.Buffer
+
+	if err := ebml.Marshal(&element, &buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// chaptersTrailer returns the Chapters element to end the recording with,
+// nil if it has no chapters
+// Locked
+func (r *WebmRecorder) chaptersTrailer() []byte {
+	if len(r.chapters) == 0 {
+		return nil
+	}
+
+	element, err := matroskaChapters(r.chapters, max(r.videoTimestamp, r.audioTimestamp))
+
+	if err != nil {
+		r.logger.Warnf("Error writing recording chapters: %v", err)
+		return nil
+	}
+
+	return element
+}
+
+// trailerWriter writes what trailer returns to w before closing it, after
+// the muxer's last write
+type trailerWriter struct {
+	io.WriteCloser
+	trailer func() []byte
+}
+
+func (w *trailerWriter) Close() error {
+	if trailer := w.trailer(); len(trailer) > 0 {
+		if _, err := w.WriteCloser.Write(trailer); err != nil {
+			_ = w.WriteCloser.Close()
+			return err
+		}
+	}
+
+	return w.WriteCloser.Close()
+}
+
+type matroskaAttachmentsElement struct {
+	Attachments struct {
+		AttachedFile struct {
+			FileName     string `ebml:"FileName"`
+			FileMimeType string `ebml:"FileMimeType"`
+			FileData     []byte `ebml:"FileData"`
+			FileUID      uint64 `ebml:"FileUID"`
+		} `ebml:"AttachedFile"`
+	} `ebml:"Attachments"`
+}
+
+// AppendMatroskaAttachment attaches a file named name to the closed MKV
+// recording at path, e.g. its sidecar, appending it to its Segment
+func AppendMatroskaAttachment(path, name, mimeType string, data []byte) error {
+	var element matroskaAttachmentsElement
+	file := &element.Attachments.AttachedFile
+	file.FileName = name
+	file.FileMimeType = mimeType
+	file.FileData = data
+
+	// Only has to be unique within the file, and not 0
+	uid := fnv.New64a()
+	uid.Write([]byte(name))
+	file.FileUID = uid.Sum64() | 1
+
+	var buf bytes.Buffer
+
+	if err := ebml.Marshal(&element, &buf); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,99 @@
+package recorder
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/at-wat/ebml-go"
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mkvFile struct {
+	Header  webm.EBMLHeader `ebml:"EBML"`
+	Segment struct {
+		Tracks   webm.Tracks    `ebml:"Tracks"`
+		Cluster  []webm.Cluster `ebml:"Cluster"`
+		Chapters struct {
+			EditionEntry struct {
+				ChapterAtom []matroskaChapterAtom `ebml:"ChapterAtom"`
+			} `ebml:"EditionEntry"`
+		} `ebml:"Chapters"`
+		Attachments struct {
+			AttachedFile []struct {
+				FileName     string `ebml:"FileName"`
+				FileMimeType string `ebml:"FileMimeType"`
+				FileData     []byte `ebml:"FileData"`
+			} `ebml:"AttachedFile"`
+		} `ebml:"Attachments"`
+	} `ebml:"Segment"`
+}
+
+func TestWebmRecorder_MKVOutput(t *testing.T) {
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, false)
+	require.NoError(t, r.EnableMKVOutput(config.MKV{Enable: true}))
+	r.SetHasAudio(true)
+	assert.Equal(t, ".mkv", filepath.Ext(r.GetFilePath()))
+
+	require.NoError(t, r.AddChapter("Main room"))
+
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			require.NoError(t, r.AddChapter("Breakout rooms"))
+		}
+
+		r.PushAudio(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * 960)},
+			Payload: []byte{0xFC, 0xAA, 0xBB},
+		})
+	}
+
+	r.Close()
+	assert.ErrorIs(t, r.AddChapter("Too late"), errRecorderClosed)
+
+	sidecar := []byte(`{"sessionId":"s-1"}`)
+	require.NoError(t, AppendMatroskaAttachment(r.GetFilePath(), "rec-sidecar.json", "application/json", sidecar))
+
+	data, err := os.ReadFile(r.GetFilePath())
+	require.NoError(t, err)
+
+	var file mkvFile
+	require.NoError(t, ebml.Unmarshal(bytes.NewReader(data), &file))
+	assert.Equal(t, "matroska", file.Header.DocType)
+	assert.NotEmpty(t, file.Segment.Cluster, "Media still readable")
+
+	chapters := file.Segment.Chapters.EditionEntry.ChapterAtom
+	require.Len(t, chapters, 2)
+	assert.Equal(t, "Main room", chapters[0].ChapterDisplay.ChapString)
+	assert.Zero(t, chapters[0].ChapterTimeStart)
+	assert.Equal(t, "Breakout rooms", chapters[1].ChapterDisplay.ChapString)
+	assert.InDelta(t, float64(time.Second), float64(chapters[1].ChapterTimeStart), float64(40*time.Millisecond))
+	assert.Equal(t, chapters[1].ChapterTimeStart, chapters[0].ChapterTimeEnd)
+	assert.Greater(t, chapters[1].ChapterTimeEnd, chapters[1].ChapterTimeStart)
+
+	require.Len(t, file.Segment.Attachments.AttachedFile, 1)
+	attached := file.Segment.Attachments.AttachedFile[0]
+	assert.Equal(t, "rec-sidecar.json", attached.FileName)
+	assert.Equal(t, "application/json", attached.FileMimeType)
+	assert.Equal(t, sidecar, attached.FileData)
+}
+
+func TestWebmRecorder_MKVChaptersUnsupported(t *testing.T) {
+	// WebM can't hold chapters
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, false)
+	r.SetHasAudio(true)
+	assert.Error(t, r.AddChapter("Main room"))
+
+	// Audio-only Ogg output takes precedence
+	r = NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, true)
+	require.NoError(t, r.EnableMKVOutput(config.MKV{Enable: true}))
+	r.SetHasAudio(true)
+	assert.Equal(t, ".ogg", filepath.Ext(r.GetFilePath()))
+	assert.Error(t, r.AddChapter("Main room"))
+}
@@ -0,0 +1,166 @@
+package recorder
+
+import (
+	"sync/atomic"
+
+	"github.com/at-wat/ebml-go/mkvcore"
+	"github.com/at-wat/ebml-go/webm"
+)
+
+// Many players reject files whose block timestamps go backward. Those of a
+// track are derived from RTP, so they can still step back, e.g. on frames
+// reordered or re-based around a timestamp jump; and the block sorter
+// writes blocks arriving too late to be sorted in as they come. Both are
+// clamped to the last timestamp written: per track by monotonicWriter, then
+// across the file by monotonicInterceptor.
+
+// timestampCorrections counts the blocks whose timestamp was clamped, by
+// track kind. Updated from the muxer's goroutine too, so it's atomic.
+type timestampCorrections struct {
+	video atomic.Int64
+	audio atomic.Int64
+}
+
+func (c *timestampCorrections) of(kind string) *atomic.Int64 {
+	switch kind {
+	case "video":
+		return &c.video
+	case "audio":
+		return &c.audio
+	default:
+		return nil
+	}
+}
+
+// onTimestampCorrection accounts for a block of kind written at last
+// instead of timestamp, which went backward. It doesn't take the lock: it's
+// called from the muxer's goroutine too.
+func (r *WebmRecorder) onTimestampCorrection(kind string, timestamp, last int64) {
+	count := int64(0)
+
+	if counter := r.timestampCorrections.of(kind); counter != nil {
+		count = counter.Add(1)
+	}
+
+	// Once per track at warning level, it's noisy when a source misbehaves
+	if count == 1 {
+		r.logger.Warnf("%s block timestamp went backward by %dms, clamped", kind, last-timestamp)
+	} else {
+		r.logger.Debugf("%s block timestamp went backward by %dms, clamped", kind, last-timestamp)
+	}
+}
+
+// trackKinds returns the kind of each writer, in order: video, audio, then
+// loss markers
+//
+// Locked
+func (r *WebmRecorder) trackKinds(n int) []string {
+	kinds := make([]string, 0, n)
+
+	if r.hasVideo {
+		kinds = append(kinds, "video")
+	}
+
+	if r.hasAudio {
+		kinds = append(kinds, "audio")
+	}
+
+	for len(kinds) < n {
+		kinds = append(kinds, "marker")
+	}
+
+	return kinds[:n]
+}
+
+// monotonicWriters keeps the block timestamps of each track from going
+// backward
+//
+// Locked
+func (r *WebmRecorder) monotonicWriters(writers []webm.BlockWriteCloser) []webm.BlockWriteCloser {
+	kinds := r.trackKinds(len(writers))
+
+	for i, w := range writers {
+		writers[i] = &monotonicWriter{r: r, w: w, kind: kinds[i]}
+	}
+
+	return writers
+}
+
+// monotonicWriter clamps the timestamps of a track's blocks to the last one
+// written, so they never go backward
+type monotonicWriter struct {
+	r    *WebmRecorder
+	w    webm.BlockWriteCloser
+	kind string
+
+	started bool
+	last    int64
+}
+
+func (w *monotonicWriter) Write(keyframe bool, timestamp int64, b []byte) (int, error) {
+	if w.started && timestamp < w.last {
+		w.r.onTimestampCorrection(w.kind, timestamp, w.last)
+		timestamp = w.last
+	}
+
+	w.started = true
+	w.last = timestamp
+
+	return w.w.Write(keyframe, timestamp, b)
+}
+
+func (w *monotonicWriter) Close() error {
+	return w.w.Close()
+}
+
+// monotonicInterceptor clamps the timestamps of the blocks its interceptor
+// (the block sorter) writes to the last one written to the file, whatever
+// their track
+type monotonicInterceptor struct {
+	mkvcore.BlockInterceptor
+	r     *WebmRecorder
+	kinds []string // By track number
+}
+
+func (i *monotonicInterceptor) Intercept(r []mkvcore.BlockReader, w []mkvcore.BlockWriter) {
+	// The interceptor writes from a single goroutine
+	order := &muxOrder{}
+	writers := make([]mkvcore.BlockWriter, len(w))
+
+	for n := range w {
+		kind := "marker"
+
+		if n < len(i.kinds) {
+			kind = i.kinds[n]
+		}
+
+		writers[n] = &muxOrderWriter{r: i.r, w: w[n], kind: kind, order: order}
+	}
+
+	i.BlockInterceptor.Intercept(r, writers)
+}
+
+// muxOrder is the last block timestamp written to a file
+type muxOrder struct {
+	started bool
+	last    int64
+}
+
+type muxOrderWriter struct {
+	r     *WebmRecorder
+	w     mkvcore.BlockWriter
+	kind  string
+	order *muxOrder
+}
+
+func (w *muxOrderWriter) Write(keyframe bool, timestamp int64, b []byte) (int, error) {
+	if w.order.started && timestamp < w.order.last {
+		w.r.onTimestampCorrection(w.kind, timestamp, w.order.last)
+		timestamp = w.order.last
+	}
+
+	w.order.started = true
+	w.order.last = timestamp
+
+	return w.w.Write(keyframe, timestamp, b)
+}
@@ -0,0 +1,81 @@
+package recorder
+
+import (
+	"testing"
+
+	"github.com/at-wat/ebml-go/mkvcore"
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMonotonicWriters(t *testing.T) {
+	r := NewWebmRecorder("", 0, 256, 64, false, false, false)
+	r.SetHasVideo(true)
+	r.SetHasAudio(true)
+
+	video, audio := &blockRecorder{}, &blockRecorder{}
+	writers := r.monotonicWriters([]webm.BlockWriteCloser{video, audio})
+	require.Len(t, writers, 2)
+
+	for _, timestamp := range []int64{100, 200, 150, 210} {
+		_, err := writers[0].Write(false, timestamp, []byte{0xAA})
+		require.NoError(t, err)
+	}
+
+	// Tracks are independent
+	_, err := writers[1].Write(true, 120, []byte{0xBB})
+	require.NoError(t, err)
+
+	assert.Equal(t, []writtenBlock{{false, 100}, {false, 200}, {false, 200}, {false, 210}}, video.blocks)
+	assert.Equal(t, []writtenBlock{{true, 120}}, audio.blocks)
+	assert.Equal(t, int64(1), r.timestampCorrections.video.Load())
+	assert.Equal(t, int64(0), r.timestampCorrections.audio.Load())
+
+	require.NoError(t, writers[0].Close())
+	assert.True(t, video.closed)
+}
+
+type scriptedBlock struct {
+	track     int
+	timestamp int64
+}
+
+// scriptedInterceptor writes the given blocks, as a block sorter would
+type scriptedInterceptor struct {
+	blocks []scriptedBlock
+}
+
+func (i *scriptedInterceptor) Intercept(_ []mkvcore.BlockReader, w []mkvcore.BlockWriter) {
+	for _, b := range i.blocks {
+		_, _ = w[b.track].Write(true, b.timestamp, []byte{0xAA})
+	}
+}
+
+func TestMonotonicInterceptor(t *testing.T) {
+	r := NewWebmRecorder("", 0, 256, 64, false, false, false)
+	r.SetHasVideo(true)
+	r.SetHasAudio(true)
+
+	inner := &scriptedInterceptor{blocks: []scriptedBlock{{0, 100}, {1, 110}, {1, 90}, {0, 105}, {0, 130}}}
+
+	video, audio := &blockRecorder{}, &blockRecorder{}
+	interceptor := &monotonicInterceptor{BlockInterceptor: inner, r: r, kinds: r.trackKinds(2)}
+	interceptor.Intercept(nil, []mkvcore.BlockWriter{video, audio})
+
+	// An outdated block is written at the last timestamp of the file
+	assert.Equal(t, []writtenBlock{{true, 100}, {true, 110}, {true, 130}}, video.blocks)
+	assert.Equal(t, []writtenBlock{{true, 110}, {true, 110}}, audio.blocks)
+	assert.Equal(t, int64(1), r.timestampCorrections.video.Load())
+	assert.Equal(t, int64(1), r.timestampCorrections.audio.Load())
+}
+
+func TestTrackKinds(t *testing.T) {
+	r := NewWebmRecorder("", 0, 256, 64, false, false, false)
+	r.SetHasAudio(true)
+	assert.Equal(t, []string{"audio", "marker"}, r.trackKinds(2))
+
+	r.SetHasVideo(true)
+	assert.Equal(t, []string{"video", "audio"}, r.trackKinds(2))
+	assert.Equal(t, []string{"video"}, r.trackKinds(1))
+}
@@ -0,0 +1,96 @@
+package recorder
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// How muted video is represented (see config.Recorder.MutedVideo)
+const (
+	// MutedVideoHold leaves the last frame before the mute showing, as
+	// players do until the next frame's timestamp
+	MutedVideoHold = "hold"
+	// MutedVideoMarker also writes a marker spanning the mute to the
+	// metadata track loss markers go to
+	MutedVideoMarker = "marker"
+)
+
+// muteMarker is the payload of a mute marker block, placed at the first
+// video frame written after the video was unmuted
+type muteMarker struct {
+	Muted  bool  `json:"muted"`
+	FromMs int64 `json:"fromMs"`
+	ToMs   int64 `json:"toMs"`
+}
+
+// EnableMutedVideo sets how periods the video was muted at the source are
+// represented, MutedVideoHold if mode is empty. Must be called before any
+// media is pushed.
+func (r *WebmRecorder) EnableMutedVideo(mode string) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	switch mode {
+	case "", MutedVideoHold:
+		r.muteMarkers = false
+	case MutedVideoMarker:
+		r.muteMarkers = true
+	default:
+		return fmt.Errorf("invalid muted video mode %q", mode)
+	}
+
+	return nil
+}
+
+// SetVideoMuted tells the recorder the video was muted, or unmuted, at the
+// source: no media is sent meanwhile
+func (r *WebmRecorder) SetVideoMuted(muted bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.videoMuted == muted {
+		return
+	}
+
+	r.videoMuted = muted
+
+	if muted {
+		r.videoMutePending = true
+	}
+
+	r.logger.WithField("muted", muted).
+		Debug("Video mute state changed")
+}
+
+// markVideoMute writes a marker spanning the mute that ended since the
+// previous frame written, if any. Must run before markVideoLoss, which moves
+// the previous frame's timestamp on.
+// Locked
+func (r *WebmRecorder) markVideoMute() {
+	// Frames still in flight when the mute started
+	if r.videoMuted || !r.videoMutePending {
+		return
+	}
+
+	r.videoMutePending = false
+
+	if r.lossMarkerWriter == nil || !r.muteMarkers {
+		return
+	}
+
+	marker := muteMarker{
+		Muted:  true,
+		FromMs: r.lastVideoFrameTimestamp.Milliseconds(),
+		ToMs:   r.videoTimestamp.Milliseconds(),
+	}
+
+	payload, err := json.Marshal(marker)
+
+	if err != nil {
+		return
+	}
+
+	if _, err := r.lossMarkerWriter.Write(true, marker.ToMs, payload); err != nil {
+		r.logger.Warnf("Error writing mute marker: %v", err)
+	}
+}
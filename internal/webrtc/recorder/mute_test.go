@@ -0,0 +1,58 @@
+package recorder
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebmRecorder_MutedVideo(t *testing.T) {
+	for _, mode := range []string{MutedVideoHold, MutedVideoMarker} {
+		s := newAVSyncSource(t)
+		require.NoError(t, s.r.EnableMutedVideo(mode))
+
+		s.run(time.Second, true, true)
+
+		// The publisher sends nothing while muted, its RTP clock keeps going
+		s.r.SetVideoMuted(true)
+		s.run(2*time.Second, true, false)
+		s.videoTs += 2 * 90000
+		s.r.SetVideoMuted(false)
+
+		s.run(2*time.Second, true, true)
+		s.r.Close()
+
+		data, err := os.ReadFile(s.r.GetFilePath())
+		require.NoError(t, err)
+		assert.InDelta(t, s.r.VideoTimestamp(), s.r.AudioTimestamp(), float64(100*time.Millisecond), mode)
+
+		if mode == MutedVideoHold {
+			assert.NotContains(t, string(data), lossMarkerCodecID)
+			continue
+		}
+
+		match := regexp.MustCompile(`\{"muted":true[^}]*\}`).Find(data)
+		require.NotNil(t, match, "Mute marker written")
+		var marker muteMarker
+		require.NoError(t, json.Unmarshal(match, &marker))
+		assert.InDelta(t, 1000, marker.FromMs, 100)
+		assert.InDelta(t, 3000, marker.ToMs, 100)
+		assert.NotContains(t, string(data), `"lostPackets"`, "Loss concealment is off")
+		assert.Zero(t, s.r.GetStats().Video.ConcealedFrames)
+	}
+}
+
+func TestEnableMutedVideo(t *testing.T) {
+	s := newAVSyncSource(t)
+
+	assert.NoError(t, s.r.EnableMutedVideo(""))
+	assert.False(t, s.r.writesLossMarkers())
+	assert.NoError(t, s.r.EnableMutedVideo(MutedVideoMarker))
+	assert.True(t, s.r.writesLossMarkers())
+	assert.Error(t, s.r.EnableMutedVideo("blank"))
+}
@@ -0,0 +1,263 @@
+package recorder
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+)
+
+const (
+	oggPageHeaderSize = 27
+
+	oggHeaderTypeContinuation = 0x00
+	oggHeaderTypeBOS          = 0x02
+	oggHeaderTypeEOS          = 0x04
+
+	// libopus encoder lookahead at 48 kHz, which is what WebRTC endpoints
+	// use. The real value is unknown to us as we don't encode anything.
+	oggOpusPreSkip = 312
+)
+
+var (
+	errOggWriterClosed = errors.New("ogg writer closed")
+	oggCRCTable        = makeOggCRCTable()
+)
+
+// OggOpusWriter writes Opus packets to an Ogg container (RFC 7845), one
+// packet per page. It never seeks, so it works with any io.WriteCloser:
+// the last page is held back so it can be flagged as end-of-stream on Close.
+type OggOpusWriter struct {
+	w         io.WriteCloser
+	mu        sync.Mutex
+	serial    uint32
+	pageIndex uint32
+	closed    bool
+
+	// Granule positions are derived from RTP timestamps (48 kHz clock),
+	// extended to 64 bits so they don't wrap
+	started       bool
+	lastTimestamp uint32
+	elapsed       uint64
+	granule       uint64
+
+	pending        []byte
+	pendingGranule uint64
+}
+
+func NewOggOpusWriter(w io.WriteCloser, format OpusFormat) (*OggOpusWriter, error) {
+	writer := &OggOpusWriter{
+		w:      w,
+		serial: rand.Uint32(),
+	}
+
+	if err := writer.writeHeaders(format); err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+func (writer *OggOpusWriter) writeHeaders(format OpusFormat) error {
+	// ID header (RFC 7845 5.1)
+	idHeader := format.opusHead()
+
+	if err := writer.writePage(idHeader, oggHeaderTypeBOS, 0); err != nil {
+		return err
+	}
+
+	// Comment header (RFC 7845 5.2)
+	vendor := "bbb-webrtc-recorder"
+	commentHeader := make([]byte, 0, 16+len(vendor))
+	commentHeader = append(commentHeader, "OpusTags"...)
+	commentHeader = binary.LittleEndian.AppendUint32(commentHeader, uint32(len(vendor)))
+	commentHeader = append(commentHeader, vendor...)
+	commentHeader = binary.LittleEndian.AppendUint32(commentHeader, 0) // User comment list length
+
+	return writer.writePage(commentHeader, oggHeaderTypeContinuation, 0)
+}
+
+// WritePacket writes a single Opus packet with the RTP timestamp it was
+// carried with. It returns the granule position (end sample) of the page.
+func (writer *OggOpusWriter) WritePacket(payload []byte, timestamp uint32) (uint64, error) {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	if writer.closed {
+		return 0, errOggWriterClosed
+	}
+
+	// Backwards jumps (which should not survive the samplebuilder anyway)
+	// are ignored rather than treated as a ~24h forward wrap
+	if delta := timestamp - writer.lastTimestamp; writer.started && delta < 1<<31 {
+		writer.elapsed += uint64(delta)
+	}
+
+	writer.started = true
+	writer.lastTimestamp = timestamp
+
+	// The granule position of a page is the PCM position of the last
+	// sample of the last packet completed in it (RFC 7845 4)
+	granule := oggOpusPreSkip + writer.elapsed + uint64(opusPacketSamples(payload))
+
+	// Keep it monotonic even if the source timestamps are not
+	if granule < writer.granule {
+		granule = writer.granule
+	}
+
+	writer.granule = granule
+
+	if err := writer.flushPending(oggHeaderTypeContinuation); err != nil {
+		return 0, err
+	}
+
+	writer.pending = append([]byte(nil), payload...)
+	writer.pendingGranule = granule
+
+	return granule, nil
+}
+
+// Skip makes the next packet start samples after the end of the last written
+// one, whatever its RTP timestamp. Used when the RTP timeline is interrupted.
+func (writer *OggOpusWriter) Skip(samples uint64) {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	if writer.granule >= oggOpusPreSkip {
+		writer.elapsed = writer.granule - oggOpusPreSkip
+	}
+
+	writer.elapsed += samples
+	writer.started = false
+}
+
+func (writer *OggOpusWriter) Granule() uint64 {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	return writer.granule
+}
+
+func (writer *OggOpusWriter) Close() error {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	if writer.closed {
+		return nil
+	}
+
+	writer.closed = true
+	err := writer.flushPending(oggHeaderTypeEOS)
+
+	if closeErr := writer.w.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (writer *OggOpusWriter) flushPending(headerType uint8) error {
+	if writer.pending == nil {
+		return nil
+	}
+
+	err := writer.writePage(writer.pending, headerType, writer.pendingGranule)
+	writer.pending = nil
+
+	return err
+}
+
+func (writer *OggOpusWriter) writePage(payload []byte, headerType uint8, granule uint64) error {
+	// Lacing values: n full 255-byte segments plus a terminating one < 255
+	segments := len(payload)/255 + 1
+
+	if segments > 255 {
+		return errors.New("ogg packet too large for a single page")
+	}
+
+	page := make([]byte, oggPageHeaderSize+segments+len(payload))
+	copy(page[0:], "OggS")
+	page[4] = 0 // Version
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	binary.LittleEndian.PutUint32(page[14:], writer.serial)
+	binary.LittleEndian.PutUint32(page[18:], writer.pageIndex)
+	page[26] = uint8(segments)
+
+	for i := 0; i < segments-1; i++ {
+		page[oggPageHeaderSize+i] = 255
+	}
+
+	page[oggPageHeaderSize+segments-1] = uint8(len(payload) % 255)
+	copy(page[oggPageHeaderSize+segments:], payload)
+
+	var crc uint32
+
+	for _, b := range page {
+		crc = (crc << 8) ^ oggCRCTable[byte(crc>>24)^b]
+	}
+
+	binary.LittleEndian.PutUint32(page[22:], crc)
+	writer.pageIndex++
+
+	_, err := writer.w.Write(page)
+
+	return err
+}
+
+func makeOggCRCTable() *[256]uint32 {
+	var table [256]uint32
+
+	for i := range table {
+		r := uint32(i) << 24
+
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = (r << 1) ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+
+		table[i] = r
+	}
+
+	return &table
+}
+
+// opusPacketSamples returns the number of 48 kHz samples in an Opus packet
+// as described by its TOC byte (RFC 6716 3.1)
+func opusPacketSamples(packet []byte) int {
+	if len(packet) == 0 {
+		return 0
+	}
+
+	toc := packet[0]
+	config := toc >> 3
+	var frameSamples int
+
+	switch {
+	case config < 12: // SILK-only: 10, 20, 40, 60 ms
+		frameSamples = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16: // Hybrid: 10, 20 ms
+		frameSamples = []int{480, 960}[config%2]
+	default: // CELT-only: 2.5, 5, 10, 20 ms
+		frameSamples = []int{120, 240, 480, 960}[config%4]
+	}
+
+	frames := 1
+
+	switch toc & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+
+		frames = int(packet[1] & 0x3F)
+	}
+
+	return frameSamples * frames
+}
@@ -0,0 +1,158 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type oggPage struct {
+	headerType uint8
+	granule    uint64
+	payload    []byte
+}
+
+func readOggPages(t *testing.T, data []byte) []oggPage {
+	var pages []oggPage
+
+	for len(data) > 0 {
+		require.GreaterOrEqual(t, len(data), oggPageHeaderSize)
+		require.Equal(t, "OggS", string(data[:4]))
+
+		segments := int(data[26])
+		size := 0
+
+		for _, l := range data[oggPageHeaderSize : oggPageHeaderSize+segments] {
+			size += int(l)
+		}
+
+		start := oggPageHeaderSize + segments
+		pages = append(pages, oggPage{
+			headerType: data[5],
+			granule:    binary.LittleEndian.Uint64(data[6:14]),
+			payload:    data[start : start+size],
+		})
+		data = data[start+size:]
+	}
+
+	return pages
+}
+
+func TestOpusPacketSamples(t *testing.T) {
+	assert.Equal(t, 960, opusPacketSamples([]byte{0xFC}), "CELT 20ms, 1 frame")
+	assert.Equal(t, 960, opusPacketSamples([]byte{0x78}), "Hybrid 20ms, 1 frame")
+	assert.Equal(t, 1920, opusPacketSamples([]byte{0x09}), "SILK 20ms, 2 frames")
+	assert.Equal(t, 2880, opusPacketSamples([]byte{0x0B, 0x03}), "SILK 20ms, code 3 with 3 frames")
+	assert.Equal(t, 0, opusPacketSamples(nil))
+}
+
+func TestOggOpusWriter_GranuleFromRTPTimestamps(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewOggOpusWriter(nopWriteCloser{buf}, OpusFormat{Channels: 2})
+	require.NoError(t, err)
+
+	// 20ms packets, with a 3-packet gap (e.g. DTX) before the last one
+	timestamps := []uint32{4294966336, 0, 960, 4800}
+
+	for _, ts := range timestamps {
+		_, err := w.WritePacket([]byte{0xFC, 0x01, 0x02}, ts)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, w.Close())
+	require.NoError(t, w.Close(), "Double close should be a no-op")
+
+	pages := readOggPages(t, buf.Bytes())
+	require.Len(t, pages, 2+len(timestamps))
+
+	assert.Equal(t, uint8(oggHeaderTypeBOS), pages[0].headerType)
+	assert.Equal(t, "OpusHead", string(pages[0].payload[:8]))
+	assert.Equal(t, "OpusTags", string(pages[1].payload[:8]))
+
+	expected := []uint64{
+		oggOpusPreSkip + 960,
+		oggOpusPreSkip + 960*2,
+		oggOpusPreSkip + 960*3,
+		oggOpusPreSkip + 960*7,
+	}
+
+	for i, page := range pages[2:] {
+		assert.Equal(t, expected[i], page.granule, "page %d", i)
+	}
+
+	assert.Equal(t, uint8(oggHeaderTypeEOS), pages[len(pages)-1].headerType)
+}
+
+func TestWebmRecorder_AudioOnlyOgg(t *testing.T) {
+	dir := t.TempDir()
+	r := NewWebmRecorder(filepath.Join(dir, "rec.webm"), 0600, 256, 64, false, false, true)
+	r.SetHasAudio(true)
+
+	assert.Equal(t, filepath.Join(dir, "rec.ogg"), r.GetFilePath())
+
+	for i := 0; i < 10; i++ {
+		r.PushAudio(&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				SequenceNumber: uint16(i),
+				Timestamp:      uint32(i * 960),
+			},
+			Payload: []byte{0xFC, 0xAA, 0xBB},
+		})
+	}
+
+	r.Close()
+
+	data, err := os.ReadFile(r.GetFilePath())
+	require.NoError(t, err)
+
+	pages := readOggPages(t, data)
+	require.Greater(t, len(pages), 2)
+
+	last := pages[len(pages)-1]
+	assert.Equal(t, uint8(oggHeaderTypeEOS), last.headerType)
+	// The last written packet starts at AudioTimestamp and lasts 20ms
+	assert.Equal(t, uint64(oggOpusPreSkip)+uint64(r.AudioTimestamp().Milliseconds()*48)+960, last.granule)
+	assert.Equal(t, CodecOpus, r.GetStats().Audio.Codec)
+}
+
+func TestWebmRecorder_AudioOnlyOggSwitchesBackWithVideo(t *testing.T) {
+	dir := t.TempDir()
+	r := NewWebmRecorder(filepath.Join(dir, "rec.webm"), 0600, 256, 64, false, false, true)
+	r.SetHasAudio(true)
+	assert.Equal(t, filepath.Join(dir, "rec.ogg"), r.GetFilePath())
+
+	r.SetHasVideo(true)
+	assert.Equal(t, filepath.Join(dir, "rec.webm"), r.GetFilePath())
+}
+
+func TestOggOpusWriter_Skip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewOggOpusWriter(nopWriteCloser{buf}, OpusFormat{Channels: 2})
+	require.NoError(t, err)
+
+	_, err = w.WritePacket([]byte{0xFC}, 1000)
+	require.NoError(t, err)
+
+	// The next timestamp is unrelated to the previous one
+	w.Skip(480)
+	granule, err := w.WritePacket([]byte{0xFC}, 7)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(oggOpusPreSkip+960+480+960), granule)
+
+	granule, err = w.WritePacket([]byte{0xFC}, 7+960)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(oggOpusPreSkip+960+480+960*2), granule)
+}
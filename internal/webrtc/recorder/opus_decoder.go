@@ -0,0 +1,69 @@
+//go:build opus && cgo
+
+package recorder
+
+/*
+#cgo LDFLAGS: -lopus
+#include <opus/opus.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// libopusDecoder decodes Opus with libopus. Building it requires the
+// "opus" build tag and the libopus development files (libopus-dev).
+type libopusDecoder struct {
+	dec      *C.OpusDecoder
+	channels int
+}
+
+func newLibopusDecoder(sampleRate int, channels int) (opusDecoder, error) {
+	var cerr C.int
+
+	dec := C.opus_decoder_create(C.opus_int32(sampleRate), C.int(channels), &cerr)
+
+	if cerr != C.OPUS_OK {
+		return nil, fmt.Errorf("failed to create opus decoder: %s", C.GoString(C.opus_strerror(cerr)))
+	}
+
+	return &libopusDecoder{dec: dec, channels: channels}, nil
+}
+
+func (d *libopusDecoder) Decode(packet []byte, pcm []int16) (int, error) {
+	if d.dec == nil {
+		return 0, errors.New("opus decoder closed")
+	}
+
+	if len(packet) == 0 || len(pcm) < d.channels {
+		return 0, errors.New("invalid opus decode buffers")
+	}
+
+	n := C.opus_decode(
+		d.dec,
+		(*C.uchar)(unsafe.Pointer(&packet[0])),
+		C.opus_int32(len(packet)),
+		(*C.opus_int16)(unsafe.Pointer(&pcm[0])),
+		C.int(len(pcm)/d.channels),
+		0,
+	)
+
+	if n < 0 {
+		return 0, fmt.Errorf("failed to decode opus packet: %s", C.GoString(C.opus_strerror(n)))
+	}
+
+	return int(n), nil
+}
+
+func (d *libopusDecoder) Close() {
+	if d.dec != nil {
+		C.opus_decoder_destroy(d.dec)
+		d.dec = nil
+	}
+}
+
+// WAV output and audio mixing decode and encode Opus with libopus
+const opusCodingAvailable = true
@@ -0,0 +1,11 @@
+//go:build !opus || !cgo
+
+package recorder
+
+import "errors"
+
+func newLibopusDecoder(sampleRate int, channels int) (opusDecoder, error) {
+	return nil, errors.New("opus decoding is not available: build with the 'opus' tag and libopus")
+}
+
+const opusCodingAvailable = false
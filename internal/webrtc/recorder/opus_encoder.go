@@ -0,0 +1,116 @@
+//go:build opus && cgo
+
+package recorder
+
+/*
+#cgo LDFLAGS: -lopus
+#include <opus/opus.h>
+
+// opus_encoder_ctl is variadic, which cgo can't call
+static int set_bitrate(OpusEncoder *enc, opus_int32 bitrate) {
+	return opus_encoder_ctl(enc, OPUS_SET_BITRATE(bitrate));
+}
+
+static int set_complexity(OpusEncoder *enc, opus_int32 complexity) {
+	return opus_encoder_ctl(enc, OPUS_SET_COMPLEXITY(complexity));
+}
+
+static int set_inband_fec(OpusEncoder *enc, opus_int32 fec, opus_int32 loss) {
+	int err = opus_encoder_ctl(enc, OPUS_SET_INBAND_FEC(fec));
+
+	if (err != OPUS_OK) {
+		return err;
+	}
+
+	return opus_encoder_ctl(enc, OPUS_SET_PACKET_LOSS_PERC(loss));
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+)
+
+// libopusEncoder encodes Opus with libopus, with the same build
+// requirements as libopusDecoder
+type libopusEncoder struct {
+	enc      *C.OpusEncoder
+	channels int
+}
+
+// newLibopusEncoder returns an encoder encoding as e. Bitrate 0 leaves
+// libopus' default.
+func newLibopusEncoder(sampleRate int, channels int, e types.OpusEncoding) (opusEncoder, error) {
+	var cerr C.int
+
+	application := C.int(C.OPUS_APPLICATION_AUDIO)
+
+	switch e.Application {
+	case OpusApplicationVoIP:
+		application = C.OPUS_APPLICATION_VOIP
+	case OpusApplicationLowDelay:
+		application = C.OPUS_APPLICATION_RESTRICTED_LOWDELAY
+	}
+
+	enc := C.opus_encoder_create(C.opus_int32(sampleRate), C.int(channels), application, &cerr)
+
+	if cerr != C.OPUS_OK {
+		return nil, fmt.Errorf("failed to create opus encoder: %s", C.GoString(C.opus_strerror(cerr)))
+	}
+
+	if e.Bitrate > 0 {
+		if cerr = C.set_bitrate(enc, C.opus_int32(e.Bitrate)); cerr != C.OPUS_OK {
+			C.opus_encoder_destroy(enc)
+			return nil, fmt.Errorf("failed to set opus bitrate %d: %s", e.Bitrate, C.GoString(C.opus_strerror(cerr)))
+		}
+	}
+
+	if cerr = C.set_complexity(enc, C.opus_int32(e.Complexity)); cerr != C.OPUS_OK {
+		C.opus_encoder_destroy(enc)
+		return nil, fmt.Errorf("failed to set opus complexity %d: %s", e.Complexity, C.GoString(C.opus_strerror(cerr)))
+	}
+
+	if e.FEC {
+		if cerr = C.set_inband_fec(enc, 1, opusFECPacketLoss); cerr != C.OPUS_OK {
+			C.opus_encoder_destroy(enc)
+			return nil, fmt.Errorf("failed to enable opus FEC: %s", C.GoString(C.opus_strerror(cerr)))
+		}
+	}
+
+	return &libopusEncoder{enc: enc, channels: channels}, nil
+}
+
+func (e *libopusEncoder) Encode(pcm []int16, data []byte) (int, error) {
+	if e.enc == nil {
+		return 0, errors.New("opus encoder closed")
+	}
+
+	if len(pcm) < e.channels || len(data) == 0 {
+		return 0, errors.New("invalid opus encode buffers")
+	}
+
+	n := C.opus_encode(
+		e.enc,
+		(*C.opus_int16)(unsafe.Pointer(&pcm[0])),
+		C.int(len(pcm)/e.channels),
+		(*C.uchar)(unsafe.Pointer(&data[0])),
+		C.opus_int32(len(data)),
+	)
+
+	if n < 0 {
+		return 0, fmt.Errorf("failed to encode opus frame: %s", C.GoString(C.opus_strerror(n)))
+	}
+
+	return int(n), nil
+}
+
+func (e *libopusEncoder) Close() {
+	if e.enc != nil {
+		C.opus_encoder_destroy(e.enc)
+		e.enc = nil
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !opus || !cgo
+
+package recorder
+
+import (
+	"errors"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+)
+
+func newLibopusEncoder(sampleRate int, channels int, e types.OpusEncoding) (opusEncoder, error) {
+	return nil, errors.New("opus encoding is not available: build with the 'opus' tag and libopus")
+}
@@ -0,0 +1,78 @@
+package recorder
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+)
+
+// Opus encoder applications, as in config.OpusEncoder
+const (
+	OpusApplicationAudio    = "audio"
+	OpusApplicationVoIP     = "voip"
+	OpusApplicationLowDelay = "lowdelay"
+)
+
+var opusApplications = []string{OpusApplicationAudio, OpusApplicationVoIP, OpusApplicationLowDelay}
+
+// Packet loss the encoder expects with FEC on: libopus only adds FEC for
+// the loss it's told to expect
+const opusFECPacketLoss = 10
+
+// ValidateOpusEncoder checks the Opus encoder configuration
+func ValidateOpusEncoder(cfg config.OpusEncoder) error {
+	if cfg.Complexity < 0 || cfg.Complexity > 10 {
+		return fmt.Errorf("invalid opus encoder complexity %d (must be 0 to 10)", cfg.Complexity)
+	}
+
+	if cfg.Application != "" && !slices.Contains(opusApplications, cfg.Application) {
+		return fmt.Errorf("invalid opus encoder application %q (must be one of %v)", cfg.Application, opusApplications)
+	}
+
+	return nil
+}
+
+// opusEncoding is what Opus is encoded with at bitrate, as configured by cfg
+func opusEncoding(cfg config.OpusEncoder, bitrate int) types.OpusEncoding {
+	application := cfg.Application
+
+	if application == "" {
+		application = OpusApplicationAudio
+	}
+
+	return types.OpusEncoding{
+		Bitrate:     bitrate,
+		Complexity:  cfg.Complexity,
+		FEC:         cfg.FEC,
+		Application: application,
+	}
+}
+
+// opusFFmpegArgs are the ffmpeg options of libopus encoding as e
+func opusFFmpegArgs(e types.OpusEncoding) []string {
+	args := []string{
+		"-c:a", "libopus",
+		"-b:a", strconv.Itoa(e.Bitrate),
+		"-compression_level", strconv.Itoa(e.Complexity),
+		"-application", e.Application,
+	}
+
+	if e.FEC {
+		args = append(args, "-fec", "1", "-packet_loss", strconv.Itoa(opusFECPacketLoss))
+	}
+
+	return args
+}
+
+// SetOpusEncoder sets what audio re-encoded to Opus (the audio mix, the
+// proxy) is encoded with. Must be called before EnableAudioMix and before
+// any media is pushed.
+func (r *WebmRecorder) SetOpusEncoder(cfg config.OpusEncoder) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.opusEncoderCfg = cfg
+}
@@ -0,0 +1,30 @@
+package recorder
+
+import (
+	"testing"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateOpusEncoder(t *testing.T) {
+	assert.NoError(t, ValidateOpusEncoder(config.OpusEncoder{Complexity: 10, Application: OpusApplicationAudio}))
+	assert.NoError(t, ValidateOpusEncoder(config.OpusEncoder{}), "Defaulting to audio")
+	assert.Error(t, ValidateOpusEncoder(config.OpusEncoder{Complexity: 11}))
+	assert.Error(t, ValidateOpusEncoder(config.OpusEncoder{Complexity: -1}))
+	assert.Error(t, ValidateOpusEncoder(config.OpusEncoder{Application: "music"}))
+}
+
+func TestOpusFFmpegArgs(t *testing.T) {
+	encoding := opusEncoding(config.OpusEncoder{Complexity: 10}, 64000)
+	assert.Equal(t, types.OpusEncoding{Bitrate: 64000, Complexity: 10, Application: OpusApplicationAudio}, encoding)
+	assert.Equal(t, []string{"-c:a", "libopus", "-b:a", "64000", "-compression_level", "10", "-application", "audio"},
+		opusFFmpegArgs(encoding))
+
+	encoding = opusEncoding(config.OpusEncoder{Complexity: 5, FEC: true, Application: OpusApplicationVoIP}, 32000)
+	assert.Equal(t, []string{
+		"-c:a", "libopus", "-b:a", "32000", "-compression_level", "5", "-application", "voip",
+		"-fec", "1", "-packet_loss", "10",
+	}, opusFFmpegArgs(encoding))
+}
@@ -0,0 +1,195 @@
+package recorder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Channel mapping family 1 (RFC 7845 5.1.1.2) covers up to 8 channels
+const opusMaxChannels = 8
+
+// ErrAudioFormatChanged is returned when a publisher switches channel
+// layout after the recording's header was written
+var ErrAudioFormatChanged = errors.New("audio format changed mid-recording")
+
+// OpusFormat is the channel layout of an Opus track, written to the
+// container headers (OpusHead, dOps)
+type OpusFormat struct {
+	Channels uint8
+	// Multistream layout, for more than 2 channels (channel mapping family 1)
+	Streams        uint8
+	CoupledStreams uint8
+	Mapping        []uint8
+}
+
+// What recordings are written as if the adapter doesn't tell
+var defaultOpusFormat = OpusFormat{Channels: 2}
+
+// ParseOpusFormat reads the channel layout from a negotiated codec:
+//   - audio/opus: stereo if the fmtp has stereo=1 or sprop-stereo=1 (RFC
+//     7587 7.1), mono if it sets them to 0. Without either, channels is
+//     used if it's 1 or 2, else mono. SDP always announces opus/48000/2, so
+//     adapters reading it from there should pass 0.
+//   - audio/multiopus: channels, with the num_streams, coupled_streams and
+//     channel_mapping fmtp parameters
+func ParseOpusFormat(mimeType string, channels uint16, fmtp string) (OpusFormat, error) {
+	params := parseFmtp(fmtp)
+
+	switch NormalizeMimeType(mimeType) {
+	case CodecOpus:
+		stereo, hasStereo := params["stereo"]
+		spropStereo, hasSpropStereo := params["sprop-stereo"]
+
+		switch {
+		case stereo == "1" || spropStereo == "1":
+			return OpusFormat{Channels: 2}, nil
+		case hasStereo || hasSpropStereo:
+			return OpusFormat{Channels: 1}, nil
+		case channels == 1 || channels == 2:
+			return OpusFormat{Channels: uint8(channels)}, nil
+		default:
+			return OpusFormat{Channels: 1}, nil
+		}
+	case CodecMultiOpus:
+		format := OpusFormat{}
+
+		if channels > opusMaxChannels {
+			return format, fmt.Errorf("unsupported opus channel count %d", channels)
+		}
+
+		format.Channels = uint8(channels)
+		streams, err := strconv.ParseUint(params["num_streams"], 10, 8)
+
+		if err != nil {
+			return format, fmt.Errorf("invalid multiopus num_streams %q", params["num_streams"])
+		}
+
+		coupled, err := strconv.ParseUint(params["coupled_streams"], 10, 8)
+
+		if err != nil {
+			return format, fmt.Errorf("invalid multiopus coupled_streams %q", params["coupled_streams"])
+		}
+
+		format.Streams = uint8(streams)
+		format.CoupledStreams = uint8(coupled)
+
+		for _, index := range strings.Split(params["channel_mapping"], ",") {
+			mapping, err := strconv.ParseUint(strings.TrimSpace(index), 10, 8)
+
+			if err != nil {
+				return format, fmt.Errorf("invalid multiopus channel_mapping %q", params["channel_mapping"])
+			}
+
+			format.Mapping = append(format.Mapping, uint8(mapping))
+		}
+
+		return format, format.Validate()
+	default:
+		return OpusFormat{}, fmt.Errorf("unsupported audio codec %s", mimeType)
+	}
+}
+
+func parseFmtp(fmtp string) map[string]string {
+	params := make(map[string]string)
+
+	for _, param := range strings.Split(fmtp, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+
+		if key != "" {
+			params[strings.ToLower(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	return params
+}
+
+func (f OpusFormat) Validate() error {
+	if f.Channels == 0 || f.Channels > opusMaxChannels {
+		return fmt.Errorf("unsupported opus channel count %d", f.Channels)
+	}
+
+	if f.mappingFamily() == 0 {
+		return nil
+	}
+
+	if f.Streams == 0 || f.CoupledStreams > f.Streams || int(f.Streams)+int(f.CoupledStreams) > 255 {
+		return fmt.Errorf("invalid opus stream layout: %d streams, %d coupled", f.Streams, f.CoupledStreams)
+	}
+
+	if len(f.Mapping) != int(f.Channels) {
+		return fmt.Errorf("opus channel mapping has %d entries for %d channels", len(f.Mapping), f.Channels)
+	}
+
+	for _, index := range f.Mapping {
+		// 255 is a silent channel
+		if index != 255 && index >= f.Streams+f.CoupledStreams {
+			return fmt.Errorf("opus channel mapping index %d out of range", index)
+		}
+	}
+
+	return nil
+}
+
+func (f OpusFormat) Equal(o OpusFormat) bool {
+	return f.Channels == o.Channels &&
+		f.Streams == o.Streams &&
+		f.CoupledStreams == o.CoupledStreams &&
+		slices.Equal(f.Mapping, o.Mapping)
+}
+
+func (f OpusFormat) String() string {
+	if f.mappingFamily() == 0 {
+		return fmt.Sprintf("%d channel(s)", f.Channels)
+	}
+
+	return fmt.Sprintf("%d channels (%d streams, %d coupled)", f.Channels, f.Streams, f.CoupledStreams)
+}
+
+// Mono and stereo need no mapping table (family 0)
+func (f OpusFormat) mappingFamily() uint8 {
+	if f.Channels <= 2 && f.Streams == 0 {
+		return 0
+	}
+
+	return 1
+}
+
+// opusHead returns the ID header (RFC 7845 5.1), used by Ogg and as the
+// Matroska CodecPrivate
+func (f OpusFormat) opusHead() []byte {
+	head := make([]byte, 19, 21+len(f.Mapping))
+	copy(head[0:], "OpusHead")
+	head[8] = 1 // Version
+	head[9] = f.Channels
+	binary.LittleEndian.PutUint16(head[10:], oggOpusPreSkip)
+	binary.LittleEndian.PutUint32(head[12:], opusSampleRate)
+	binary.LittleEndian.PutUint16(head[16:], 0) // Output gain
+	head[18] = f.mappingFamily()
+
+	if head[18] != 0 {
+		head = append(head, f.Streams, f.CoupledStreams)
+		head = append(head, f.Mapping...)
+	}
+
+	return head
+}
+
+// dOps returns the Opus specific box payload (Encapsulation of Opus in
+// ISOBMFF 4.3.2): the ID header fields, big endian
+func (f OpusFormat) dOps() []byte {
+	dops := []byte{0, f.Channels}
+	dops = binary.BigEndian.AppendUint16(dops, oggOpusPreSkip)
+	dops = binary.BigEndian.AppendUint32(dops, opusSampleRate)
+	dops = append(dops, 0, 0, f.mappingFamily()) // OutputGain, ChannelMappingFamily
+
+	if f.mappingFamily() != 0 {
+		dops = append(dops, f.Streams, f.CoupledStreams)
+		dops = append(dops, f.Mapping...)
+	}
+
+	return dops
+}
@@ -0,0 +1,145 @@
+package recorder
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 5.1 as Chrome negotiates it
+var surround51 = OpusFormat{Channels: 6, Streams: 4, CoupledStreams: 2, Mapping: []uint8{0, 4, 1, 2, 3, 5}}
+
+func TestParseOpusFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		channels uint16
+		fmtp     string
+		want     OpusFormat
+		wantErr  bool
+	}{
+		{"mono by default", "audio/opus", 0, "minptime=10;useinbandfec=1", OpusFormat{Channels: 1}, false},
+		{"stereo", "audio/opus", 0, "minptime=10;stereo=1;useinbandfec=1", OpusFormat{Channels: 2}, false},
+		{"sprop-stereo", "audio/OPUS", 0, "sprop-stereo=1", OpusFormat{Channels: 2}, false},
+		{"stereo off", "audio/opus", 2, "stereo=0", OpusFormat{Channels: 1}, false},
+		{"channel count", "audio/opus", 2, "", OpusFormat{Channels: 2}, false},
+		{
+			"multiopus 5.1", "audio/multiopus", 6,
+			"channel_mapping=0,4,1,2,3,5;coupled_streams=2;minptime=10;num_streams=4;useinbandfec=1",
+			surround51, false,
+		},
+		{"multiopus without layout", "audio/multiopus", 6, "minptime=10", OpusFormat{}, true},
+		{"multiopus short mapping", "audio/multiopus", 6, "channel_mapping=0,4,1;coupled_streams=2;num_streams=4", OpusFormat{}, true},
+		{"multiopus out of range", "audio/multiopus", 2, "channel_mapping=0,9;coupled_streams=0;num_streams=2", OpusFormat{}, true},
+		{"too many channels", "audio/multiopus", 9, "channel_mapping=0;coupled_streams=0;num_streams=1", OpusFormat{}, true},
+		{"not opus", "audio/pcmu", 1, "", OpusFormat{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := ParseOpusFormat(tt.mimeType, tt.channels, tt.fmtp)
+
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.True(t, tt.want.Equal(format), "got %s", format)
+		})
+	}
+}
+
+func TestOpusFormat_Headers(t *testing.T) {
+	head := OpusFormat{Channels: 1}.opusHead()
+	require.Len(t, head, 19)
+	assert.Equal(t, "OpusHead", string(head[:8]))
+	assert.Equal(t, byte(1), head[9], "Channel count")
+	assert.Equal(t, byte(0), head[18], "Mapping family")
+
+	head = surround51.opusHead()
+	require.Len(t, head, 19+2+6)
+	assert.Equal(t, byte(6), head[9])
+	assert.Equal(t, byte(1), head[18])
+	assert.Equal(t, []byte{4, 2, 0, 4, 1, 2, 3, 5}, head[19:])
+
+	dops := surround51.dOps()
+	require.Len(t, dops, 11+2+6)
+	assert.Equal(t, byte(6), dops[1])
+	assert.Equal(t, byte(1), dops[10])
+	assert.Equal(t, []byte{4, 2, 0, 4, 1, 2, 3, 5}, dops[11:])
+}
+
+func pushOpusPackets(r Recorder, first, count int) {
+	for i := first; i < first+count; i++ {
+		r.PushAudio(&rtp.Packet{
+			Header: rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * 960)},
+			// CELT 20ms, stereo
+			Payload: []byte{0xFC, 0xAA, 0xBB},
+		})
+	}
+}
+
+func TestWebmRecorder_AudioFormat(t *testing.T) {
+	dir := t.TempDir()
+	r := NewWebmRecorder(filepath.Join(dir, "rec.webm"), 0600, 256, 64, false, false, true)
+	r.SetHasAudio(true)
+	require.NoError(t, r.SetAudioFormat(OpusFormat{Channels: 1}))
+	require.NoError(t, r.SetAudioFormat(OpusFormat{Channels: 2}), "Can change until the header is written")
+	assert.Error(t, r.SetAudioFormat(OpusFormat{Channels: 3}), "More than 2 channels need a mapping")
+
+	pushOpusPackets(r, 0, 10)
+
+	written := r.GetStats().Audio.WrittenSamples
+	require.Positive(t, written)
+	// Timestamps follow the 48 kHz RTP clock whatever the channel count:
+	// each 20ms stereo frame is 960 samples. The last written one starts at
+	// AudioTimestamp.
+	assert.Equal(t, int64(written-1)*20, r.AudioTimestamp().Milliseconds())
+
+	assert.NoError(t, r.SetAudioFormat(OpusFormat{Channels: 2}), "Unchanged")
+
+	err := r.SetAudioFormat(OpusFormat{Channels: 1})
+	assert.ErrorIs(t, err, ErrAudioFormatChanged)
+
+	// Dropped rather than written with a stereo header
+	pushOpusPackets(r, 10, 10)
+	assert.Equal(t, written, r.GetStats().Audio.WrittenSamples)
+
+	r.Close()
+
+	data, err := os.ReadFile(r.GetFilePath())
+	require.NoError(t, err)
+
+	pages := readOggPages(t, data)
+	require.Greater(t, len(pages), 2)
+	assert.Equal(t, byte(2), pages[0].payload[9], "OpusHead channel count")
+	assert.Equal(t, uint8(oggHeaderTypeEOS), pages[len(pages)-1].headerType, "Finalized")
+}
+
+func TestWebmRecorder_AudioFormatMultichannel(t *testing.T) {
+	sink := &streamSink{}
+	r, err := NewRecorderWithWriter(context.Background(), config.Recorder{
+		VideoPacketQueueSize: 256,
+		AudioPacketQueueSize: 64,
+	}, sink)
+	require.NoError(t, err)
+	r.SetHasAudio(true)
+	require.NoError(t, r.(*WebmRecorder).SetAudioFormat(surround51))
+
+	pushOpusPackets(r, 0, 10)
+	r.Close()
+
+	assert.True(t, bytes.Contains(sink.Bytes(), surround51.opusHead()), "OpusHead in the CodecPrivate")
+
+	wav := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, false)
+	wav.audioOnlyWAV = true
+	assert.Error(t, wav.SetAudioFormat(surround51), "Multistream Opus can't be decoded to WAV")
+}
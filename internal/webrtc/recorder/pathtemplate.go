@@ -0,0 +1,159 @@
+package recorder
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Substituted for variables with no value, e.g. {room} on mediasoup
+// recordings
+const pathTemplateEmptyValue = "unknown"
+
+// PathVars are the values a PathTemplate is expanded with
+type PathVars struct {
+	Session string
+	Room    string
+	// Track IDs being recorded, joined with "_" in the path
+	Tracks []string
+	// File name requested in startRecording
+	FileName string
+	Time     time.Time
+}
+
+// PathTemplate builds recording paths (relative to the recorder directory)
+// from variables in braces:
+//   - {session}: recording session ID
+//   - {room}: LiveKit room
+//   - {track}: recorded track IDs
+//   - {fileName}: file name requested in startRecording
+//   - {date}, {time}: start date (2006-01-02) and time (150405), in UTC
+//   - {timestamp}: start time in Unix seconds
+//
+// e.g. "{room}/{date}/{session}.webm"
+type PathTemplate struct {
+	raw   string
+	parts []pathTemplatePart
+}
+
+type pathTemplatePart struct {
+	literal  string
+	variable string
+}
+
+var pathTemplateVariables = map[string]bool{
+	"session":   true,
+	"room":      true,
+	"track":     true,
+	"fileName":  true,
+	"date":      true,
+	"time":      true,
+	"timestamp": true,
+}
+
+// ParsePathTemplate validates a template. It must be relative, stay within
+// the recorder directory and end with the recording's extension (.webm) or
+// {fileName}.
+func ParsePathTemplate(tmpl string) (*PathTemplate, error) {
+	if tmpl == "" {
+		return nil, fmt.Errorf("empty path template")
+	}
+
+	if path.IsAbs(tmpl) {
+		return nil, fmt.Errorf("path template %s must be relative to the recorder directory", tmpl)
+	}
+
+	for _, segment := range strings.Split(tmpl, "/") {
+		if segment == ".." {
+			return nil, fmt.Errorf("path template %s must not leave the recorder directory", tmpl)
+		}
+	}
+
+	if !strings.HasSuffix(tmpl, ".webm") && !strings.HasSuffix(tmpl, "{fileName}") {
+		return nil, fmt.Errorf("path template %s must end with .webm or {fileName}", tmpl)
+	}
+
+	t := &PathTemplate{raw: tmpl}
+	rest := tmpl
+
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+
+		if open < 0 {
+			t.parts = append(t.parts, pathTemplatePart{literal: rest})
+			break
+		}
+
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("path template %s has an unmatched }", tmpl)
+		}
+
+		if open > 0 {
+			t.parts = append(t.parts, pathTemplatePart{literal: rest[:open]})
+		}
+
+		end := strings.IndexAny(rest[open+1:], "{}")
+
+		if end < 0 || rest[open+1+end] != '}' {
+			return nil, fmt.Errorf("path template %s has an unclosed {", tmpl)
+		}
+
+		variable := rest[open+1 : open+1+end]
+
+		if !pathTemplateVariables[variable] {
+			return nil, fmt.Errorf("path template %s has an unknown variable {%s}", tmpl, variable)
+		}
+
+		t.parts = append(t.parts, pathTemplatePart{variable: variable})
+		rest = rest[open+1+end+1:]
+	}
+
+	return t, nil
+}
+
+func (t *PathTemplate) String() string {
+	return t.raw
+}
+
+// Expand returns the path for a recording. Values can't add directories:
+// path separators in them are replaced, except in {fileName}, taken as is
+// like file names without a template.
+func (t *PathTemplate) Expand(vars PathVars) string {
+	var b strings.Builder
+	ts := vars.Time.UTC()
+
+	for _, part := range t.parts {
+		switch part.variable {
+		case "":
+			b.WriteString(part.literal)
+		case "session":
+			b.WriteString(pathTemplateValue(vars.Session))
+		case "room":
+			b.WriteString(pathTemplateValue(vars.Room))
+		case "track":
+			b.WriteString(pathTemplateValue(strings.Join(vars.Tracks, "_")))
+		case "fileName":
+			b.WriteString(vars.FileName)
+		case "date":
+			b.WriteString(ts.Format("2006-01-02"))
+		case "time":
+			b.WriteString(ts.Format("150405"))
+		case "timestamp":
+			b.WriteString(strconv.FormatInt(ts.Unix(), 10))
+		}
+	}
+
+	return b.String()
+}
+
+func pathTemplateValue(value string) string {
+	value = strings.NewReplacer("/", "_", "\\", "_").Replace(value)
+
+	if value == "" || value == "." || value == ".." {
+		return pathTemplateEmptyValue
+	}
+
+	return value
+}
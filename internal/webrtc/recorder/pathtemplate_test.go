@@ -0,0 +1,57 @@
+package recorder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePathTemplate_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		tmpl string
+	}{
+		{"empty", ""},
+		{"absolute", "/recordings/{session}.webm"},
+		{"parent directory", "../{session}.webm"},
+		{"no extension", "{room}/{session}"},
+		{"unknown variable", "{meeting}/{session}.webm"},
+		{"unclosed brace", "{room/{session}.webm"},
+		{"unmatched brace", "room}/{session}.webm"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePathTemplate(tt.tmpl)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestPathTemplate_Expand(t *testing.T) {
+	start := time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	tmpl, err := ParsePathTemplate("{room}/{date}/{session}-{time}.webm")
+	require.NoError(t, err)
+	assert.Equal(t, "room1/2026-03-04/sess-050607.webm", tmpl.Expand(PathVars{
+		Session: "sess",
+		Room:    "room1",
+		Time:    start,
+	}))
+
+	tmpl, err = ParsePathTemplate("{track}/{timestamp}_{fileName}")
+	require.NoError(t, err)
+	assert.Equal(t, "TR_a_TR_b/1772600767_sub/rec.webm", tmpl.Expand(PathVars{
+		Tracks:   []string{"TR_a", "TR_b"},
+		FileName: "sub/rec.webm",
+		Time:     start,
+	}), "fileName is taken as is")
+
+	// Values can't add or leave directories
+	tmpl, err = ParsePathTemplate("{room}/{session}.webm")
+	require.NoError(t, err)
+	assert.Equal(t, "unknown/a_b.webm", tmpl.Expand(PathVars{Session: "a/b"}))
+	assert.Equal(t, "unknown/unknown.webm", tmpl.Expand(PathVars{Room: "..", Session: "."}))
+}
@@ -0,0 +1,49 @@
+package recorder
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// packetPool recycles the copies of the packets held by the sample builders,
+// so steady-state recording doesn't allocate one per packet
+var packetPool = sync.Pool{
+	New: func() any { return &rtp.Packet{} },
+}
+
+// copyPacket returns a pooled copy of p, payload included, so the caller
+// can reuse p as soon as it's pushed. The header's CSRC and extension
+// slices are shared.
+func copyPacket(p *rtp.Packet) *rtp.Packet {
+	c := packetPool.Get().(*rtp.Packet)
+	c.Header = p.Header
+	c.Payload = append(c.Payload[:0], p.Payload...)
+
+	return c
+}
+
+// packetRecycler collects the packets a sample builder releases. They only
+// go back to the pool once the sample they're part of is built: the builder
+// still reads a packet's payload right after releasing it, and the pool is
+// shared between recorders.
+type packetRecycler struct {
+	released []*rtp.Packet
+}
+
+// release is the sample builder's packet release handler
+func (c *packetRecycler) release(p *rtp.Packet) {
+	c.released = append(c.released, p)
+}
+
+// recycle hands the released packets back to the pool
+func (c *packetRecycler) recycle() {
+	for i, p := range c.released {
+		p.Header = rtp.Header{}
+		p.Payload = p.Payload[:0]
+		packetPool.Put(p)
+		c.released[i] = nil
+	}
+
+	c.released = c.released[:0]
+}
@@ -0,0 +1,80 @@
+package recorder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyPacket(t *testing.T) {
+	p := &rtp.Packet{Header: rtp.Header{SequenceNumber: 7, Timestamp: 960}, Payload: []byte{1, 2, 3}}
+	c := copyPacket(p)
+	p.Payload[0] = 9
+
+	assert.Equal(t, uint16(7), c.SequenceNumber)
+	assert.Equal(t, []byte{1, 2, 3}, c.Payload, "The caller can reuse its packet")
+}
+
+func TestPacketRecycler(t *testing.T) {
+	var recycler packetRecycler
+	c := copyPacket(&rtp.Packet{Header: rtp.Header{SequenceNumber: 7}, Payload: []byte{1, 2, 3}})
+
+	recycler.release(c)
+	assert.Equal(t, []byte{1, 2, 3}, c.Payload, "Still readable until recycled")
+
+	recycler.recycle()
+	assert.Empty(t, c.Payload)
+	assert.Equal(t, rtp.Header{}, c.Header)
+	assert.Empty(t, recycler.released)
+}
+
+func TestWebmRecorder_PushAudioRecycles(t *testing.T) {
+	sink := &streamSink{}
+	rec, err := NewRecorderWithWriter(context.Background(), config.Recorder{AudioPacketQueueSize: 64}, sink)
+	require.NoError(t, err)
+	r := rec.(*WebmRecorder)
+	r.SetHasAudio(true)
+
+	p := &rtp.Packet{Header: rtp.Header{Version: 2}, Payload: []byte{0xFC, 0xAA, 0xBB}}
+
+	// The same packet over and over, as a pooling caller would
+	for i := 0; i < 100; i++ {
+		p.SequenceNumber = uint16(i)
+		p.Timestamp = uint32(i * 960)
+		r.PushAudio(p)
+		assert.Empty(t, r.audioRecycler.released, "Released packets go back once pushed")
+	}
+
+	r.Close()
+
+	assert.Greater(t, r.GetStats().Audio.WrittenSamples, 90)
+	assert.Equal(t, uint64(100), r.ReceivedPackets())
+}
+
+func TestWebmRecorder_PushVideoRecycles(t *testing.T) {
+	rec, err := NewRecorderWithWriter(context.Background(), config.Recorder{VideoPacketQueueSize: 64}, &streamSink{})
+	require.NoError(t, err)
+	r := rec.(*WebmRecorder)
+	r.SetHasVideo(true)
+
+	p := &rtp.Packet{
+		Header:  rtp.Header{Version: 2, Marker: true},
+		Payload: []byte{0x10, 0x00, 0x00, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01},
+	}
+
+	// The same packet over and over, as a pooling caller would
+	for i := 0; i < 100; i++ {
+		p.SequenceNumber = uint16(i)
+		p.Timestamp = uint32(i * 3000)
+		r.PushVideo(p)
+		assert.Empty(t, r.videoRecycler.released, "Released packets go back once pushed")
+	}
+
+	r.Close()
+
+	assert.Greater(t, r.GetStats().Video.KeyframeCount, 90)
+}
@@ -0,0 +1,73 @@
+package recorder
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+)
+
+var errPreallocateUnsupported = errors.New("preallocation not supported")
+
+// EnablePreallocation reserves disk space for each file the recording is
+// written to when it's created: cfg.Bitrate for cfg.Duration, or a
+// segment's duration if shorter. Must be called before any media is pushed.
+func (r *WebmRecorder) EnablePreallocation(cfg config.Preallocate) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.preallocateBitrate = cfg.Bitrate
+	r.preallocateDuration = cfg.Duration
+}
+
+// preallocateSize returns the bytes to reserve for a file lasting at most
+// duration, 0 if unbounded
+// Locked
+func (r *WebmRecorder) preallocateSize(duration time.Duration) int64 {
+	if duration <= 0 || duration > r.preallocateDuration {
+		duration = r.preallocateDuration
+	}
+
+	return int64(float64(r.preallocateBitrate) / 8 * duration.Seconds())
+}
+
+// preallocateFile reserves space for w, lasting at most duration, if it's a
+// file. Its size stays the same: the space past it is only allocated, and
+// released once it's closed. w is returned as is if it can't be.
+// Locked
+func (r *WebmRecorder) preallocateFile(w io.WriteCloser, duration time.Duration) io.WriteCloser {
+	f, ok := w.(*os.File)
+	size := r.preallocateSize(duration)
+
+	if !ok || size <= 0 {
+		return w
+	}
+
+	if err := fallocate(f, size); err != nil {
+		r.logger.WithField("file", f.Name()).
+			Debugf("Not preallocating recording file: %v", err)
+
+		return w
+	}
+
+	r.logger.WithField("file", f.Name()).
+		Debugf("Preallocated %d bytes for recording file", size)
+
+	return &preallocatedFile{File: f}
+}
+
+// preallocatedFile releases the space preallocated past its end on Close
+type preallocatedFile struct {
+	*os.File
+}
+
+func (f *preallocatedFile) Close() error {
+	// Truncating to the current size frees the blocks past it
+	if info, err := f.Stat(); err == nil {
+		_ = f.Truncate(info.Size())
+	}
+
+	return f.File.Close()
+}
@@ -0,0 +1,21 @@
+package recorder
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// FALLOC_FL_KEEP_SIZE: allocate without changing the file's size
+const fallocKeepSize = 0x1
+
+// fallocate allocates size bytes for f, past its end
+func fallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return errPreallocateUnsupported
+	}
+
+	return err
+}
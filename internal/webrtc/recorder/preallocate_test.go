@@ -0,0 +1,59 @@
+package recorder
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// allocated returns the disk space taken by path, past its size too
+func allocated(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestWebmRecorder_Preallocate(t *testing.T) {
+	s := newAVSyncSource(t)
+	// 8 MiB
+	s.r.EnablePreallocation(config.Preallocate{Bitrate: 8 << 20, Duration: 8 * time.Second})
+
+	path := s.r.GetFilePath()
+	probe, err := os.Create(path + ".probe")
+	require.NoError(t, err)
+	defer probe.Close()
+
+	if err := fallocate(probe, 1); err != nil {
+		t.Skipf("filesystem doesn't support preallocation: %v", err)
+	}
+
+	s.run(time.Second, true, true)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, allocated(t, path), int64(8<<20))
+	assert.Less(t, info.Size(), int64(1<<20), "The size is what was written")
+
+	s.r.Close()
+
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Positive(t, info.Size())
+	assert.Less(t, allocated(t, path), int64(1<<20), "What wasn't used is released")
+}
+
+func TestPreallocateSize(t *testing.T) {
+	r := NewWebmRecorder(os.DevNull, 0600, 256, 64, false, false, false)
+	assert.Zero(t, r.preallocateSize(0))
+
+	r.EnablePreallocation(config.Preallocate{Bitrate: 8_000_000, Duration: time.Hour})
+	assert.Equal(t, int64(3_600_000_000), r.preallocateSize(0))
+	assert.Equal(t, int64(10_000_000), r.preallocateSize(10*time.Second), "Segments are shorter")
+	assert.Equal(t, int64(3_600_000_000), r.preallocateSize(2*time.Hour))
+}
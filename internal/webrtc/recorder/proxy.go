@@ -0,0 +1,304 @@
+package recorder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Chunks of the recording held for the transcoder before it's given up on,
+// as the recording isn't held back for it
+const proxyQueueSize = 4096
+
+// How long the transcoder gets to finish once the recording is closed
+const proxyCloseTimeout = 10 * time.Second
+
+// ValidateProxy checks the proxy configuration of the recorder, the
+// transcoder included
+func ValidateProxy(cfg config.Proxy) error {
+	if !cfg.Enable {
+		return nil
+	}
+
+	if cfg.Height <= 0 || cfg.VideoBitrate <= 0 || cfg.AudioBitrate <= 0 {
+		return fmt.Errorf("invalid proxy height %d, video bitrate %d or audio bitrate %d",
+			cfg.Height, cfg.VideoBitrate, cfg.AudioBitrate)
+	}
+
+	if _, err := exec.LookPath(cfg.FFmpeg); err != nil {
+		return fmt.Errorf("proxy transcoder not found: %w", err)
+	}
+
+	return nil
+}
+
+// proxyPath is where the proxy of a recording goes, e.g. recording-proxy.webm
+// for recording.webm
+func proxyPath(recordingPath string) string {
+	return strings.TrimSuffix(recordingPath, filepath.Ext(recordingPath)) + "-proxy.webm"
+}
+
+// proxyArgs are the ffmpeg arguments re-encoding the recording, read from
+// stdin, to path. Timestamps are kept and keyframes forced where the
+// source's are, so both share a timeline.
+func proxyArgs(cfg config.Proxy, audio types.OpusEncoding, path string) []string {
+	args := []string{
+		"-hide_banner", "-loglevel", "error", "-nostdin",
+		"-f", "matroska", "-i", "pipe:0",
+		"-copyts",
+		"-c:v", "libvpx", "-deadline", "realtime", "-cpu-used", "8",
+		"-vf", fmt.Sprintf("scale=-2:'min(%d,ih)'", cfg.Height),
+		"-b:v", strconv.Itoa(cfg.VideoBitrate),
+		"-force_key_frames", "source",
+	}
+	args = append(args, opusFFmpegArgs(audio)...)
+
+	return append(args, "-f", "webm", "-y", path)
+}
+
+// proxyTranscoder feeds what's written to a recording to ffmpeg, which
+// writes a low bitrate proxy of it (see config.Proxy). Writes never block:
+// if the transcoder can't keep up, it's given up on and the proxy ends
+// there.
+type proxyTranscoder struct {
+	ctx      context.Context
+	path     string
+	fileMode os.FileMode
+	audio    types.OpusEncoding
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	stderr   bytes.Buffer
+	queue    chan []byte
+	fed      chan struct{}
+
+	mu      sync.Mutex
+	bytes   uint64
+	overrun bool
+	closed  bool
+	err     error
+}
+
+func startProxy(
+	ctx context.Context,
+	cfg config.Proxy,
+	audio types.OpusEncoding,
+	recordingPath string,
+	fileMode os.FileMode,
+) (*proxyTranscoder, error) {
+	p := &proxyTranscoder{
+		ctx:      ctx,
+		path:     proxyPath(recordingPath),
+		fileMode: fileMode,
+		audio:    audio,
+		queue:    make(chan []byte, proxyQueueSize),
+		fed:      make(chan struct{}),
+	}
+
+	p.cmd = exec.Command(cfg.FFmpeg, proxyArgs(cfg, audio, p.path)...)
+	p.cmd.Stderr = &p.stderr
+	stdin, err := p.cmd.StdinPipe()
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.stdin = stdin
+
+	if err := p.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start proxy transcoder: %w", err)
+	}
+
+	go p.feed()
+
+	return p, nil
+}
+
+func (p *proxyTranscoder) feed() {
+	defer close(p.fed)
+
+	for chunk := range p.queue {
+		if _, err := p.stdin.Write(chunk); err != nil {
+			p.fail(fmt.Errorf("proxy transcoder stopped reading: %w", err))
+
+			// Drained so writes don't fill the queue up
+			for range p.queue {
+			}
+
+			break
+		}
+	}
+
+	p.stdin.Close()
+}
+
+// write queues a copy of what was written to the recording
+func (p *proxyTranscoder) write(b []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || p.err != nil || len(b) == 0 {
+		return
+	}
+
+	select {
+	case p.queue <- bytes.Clone(b):
+		p.bytes += uint64(len(b))
+	default:
+		p.overrun = true
+		p.closed = true
+		close(p.queue)
+
+		log.WithField("session", p.ctx.Value("session")).
+			Warnf("Proxy transcoder can't keep up, ending the proxy %s here", p.path)
+	}
+}
+
+func (p *proxyTranscoder) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// close waits for the transcoder to finish with what it was fed, killing
+// it after proxyCloseTimeout
+func (p *proxyTranscoder) close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+
+	<-p.fed
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- p.cmd.Wait()
+	}()
+
+	var err error
+
+	select {
+	case err = <-done:
+	case <-time.After(proxyCloseTimeout):
+		p.cmd.Process.Kill()
+		err = fmt.Errorf("proxy transcoder timed out: %w", <-done)
+	}
+
+	if err != nil {
+		if msg := strings.TrimSpace(p.stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+
+		// Says more than the transcoder having stopped reading
+		p.mu.Lock()
+		p.err = err
+		p.mu.Unlock()
+
+		log.WithField("session", p.ctx.Value("session")).
+			WithError(err).
+			Error("Proxy transcoding failed")
+
+		return
+	}
+
+	if err := os.Chmod(p.path, p.fileMode); err != nil {
+		log.WithField("session", p.ctx.Value("session")).
+			WithError(err).
+			Warn("Failed to set proxy file mode")
+	}
+
+	log.WithField("session", p.ctx.Value("session")).
+		Infof("Proxy written: %s", p.path)
+}
+
+func (p *proxyTranscoder) stats() types.ProxyStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := types.ProxyStats{
+		File:    p.path,
+		Bytes:   p.bytes,
+		Overrun: p.overrun,
+		Audio:   &p.audio,
+	}
+
+	if p.err != nil {
+		stats.Error = p.err.Error()
+	}
+
+	return stats
+}
+
+// proxyFile tees what's written to a recording's file to its transcoder
+type proxyFile struct {
+	w io.WriteCloser
+	p *proxyTranscoder
+}
+
+func (f *proxyFile) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	f.p.write(b[:n])
+
+	return n, err
+}
+
+func (f *proxyFile) Close() error {
+	return f.w.Close()
+}
+
+// EnableProxy writes a low bitrate proxy of the recording alongside it.
+// Must be called before any media is pushed.
+func (r *WebmRecorder) EnableProxy(cfg config.Proxy) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.proxyCfg = cfg
+}
+
+// proxyWriter starts the transcoder of the recording's file, if enabled.
+// Restarted files restart it. Locked
+func (r *WebmRecorder) proxyWriter(w io.WriteCloser) io.WriteCloser {
+	if !r.proxyCfg.Enable || r.sink != nil || r.isSegmented() {
+		return w
+	}
+
+	if ext := r.containerExt(); ext != ".webm" && ext != ".mkv" {
+		return w
+	}
+
+	if r.proxy != nil {
+		r.proxy.close()
+	}
+
+	audio := opusEncoding(r.opusEncoderCfg, r.proxyCfg.AudioBitrate)
+	p, err := startProxy(r.ctx, r.proxyCfg, audio, r.file, r.fileMode)
+
+	if err != nil {
+		r.logger.WithError(err).
+			Error("Proxy disabled")
+		r.proxy = nil
+
+		return w
+	}
+
+	r.proxy = p
+
+	return &proxyFile{w: w, p: p}
+}
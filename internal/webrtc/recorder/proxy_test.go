@@ -0,0 +1,90 @@
+package recorder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeFFmpeg writes a transcoder copying its input to its output as is
+func fakeFFmpeg(t *testing.T, script string) string {
+	path := filepath.Join(t.TempDir(), "ffmpeg")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0700))
+
+	return path
+}
+
+func TestProxyPath(t *testing.T) {
+	assert.Equal(t, "/rec/abc-proxy.webm", proxyPath("/rec/abc.webm"))
+	assert.Equal(t, "/rec/abc-proxy.webm", proxyPath("/rec/abc.mkv"))
+}
+
+func TestValidateProxy(t *testing.T) {
+	cfg := config.Proxy{Enable: true, FFmpeg: fakeFFmpeg(t, ""), Height: 360, VideoBitrate: 500000, AudioBitrate: 64000}
+	assert.NoError(t, ValidateProxy(cfg))
+
+	cfg.Height = 0
+	assert.Error(t, ValidateProxy(cfg))
+
+	cfg.Height = 360
+	cfg.FFmpeg = filepath.Join(t.TempDir(), "missing")
+	assert.Error(t, ValidateProxy(cfg))
+
+	assert.NoError(t, ValidateProxy(config.Proxy{}), "Disabled")
+}
+
+func TestWebmRecorder_Proxy(t *testing.T) {
+	s := newAVSyncSource(t)
+	s.r.EnableProxy(config.Proxy{
+		Enable:       true,
+		FFmpeg:       fakeFFmpeg(t, `for last; do :; done; cat > "$last"`),
+		Height:       360,
+		VideoBitrate: 500000,
+		AudioBitrate: 64000,
+	})
+
+	s.run(time.Second, true, true)
+	s.r.Close()
+
+	recording, err := os.ReadFile(s.r.GetFilePath())
+	require.NoError(t, err)
+	proxy, err := os.ReadFile(proxyPath(s.r.GetFilePath()))
+	require.NoError(t, err)
+	assert.Equal(t, recording, proxy, "The transcoder is fed the whole recording")
+
+	info, err := os.Stat(proxyPath(s.r.GetFilePath()))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	stats := s.r.GetStats().Proxy
+	require.NotNil(t, stats)
+	assert.Equal(t, proxyPath(s.r.GetFilePath()), stats.File)
+	assert.Equal(t, uint64(len(recording)), stats.Bytes)
+	assert.False(t, stats.Overrun)
+	assert.Empty(t, stats.Error)
+	assert.Equal(t, &types.OpusEncoding{Bitrate: 64000, Application: OpusApplicationAudio}, stats.Audio)
+}
+
+func TestWebmRecorder_ProxyFailed(t *testing.T) {
+	s := newAVSyncSource(t)
+	s.r.EnableProxy(config.Proxy{
+		Enable: true,
+		FFmpeg: fakeFFmpeg(t, "echo 'Unknown encoder libvpx' >&2; exit 1"),
+	})
+
+	s.run(time.Second, true, true)
+	s.r.Close()
+
+	_, err := os.Stat(s.r.GetFilePath())
+	require.NoError(t, err, "The recording isn't affected")
+
+	stats := s.r.GetStats().Proxy
+	require.NotNil(t, stats)
+	assert.Contains(t, stats.Error, "Unknown encoder libvpx")
+}
@@ -0,0 +1,686 @@
+package recorder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Raw output (see config.RawOutput) decodes the blocks written to the video
+// and audio tracks of a file, past trimming but before video is fit to a
+// constant frame rate (the repeated frames would throw the decoder off),
+// and writes them out in the background, a goroutine per stream. Streams
+// are kept across file restarts, their timeline going on where it was.
+
+const (
+	// Blocks held for a stream's reader before they're dropped
+	rawOutputQueueSize = 256
+	// How often a named pipe nobody reads yet is opened again
+	rawOutputOpenRetry = 200 * time.Millisecond
+	// How long a stream's reader gets to take what's left once the
+	// recording is closed
+	rawOutputCloseTimeout = 5 * time.Second
+	// maxRawGap bounds the frames repeated (or the silence written) for a
+	// single gap, as maxWAVSilence does for WAV files
+	maxRawGap = 10 * time.Second
+)
+
+var errRawDecode = errors.New("failed to decode")
+
+// ValidateRawOutput checks the raw output configuration of the recorder,
+// including that this build can decode what it's set to write
+func ValidateRawOutput(cfg config.RawOutput) error {
+	if !cfg.Enable {
+		return nil
+	}
+
+	if err := validateRawOutputFormat(cfg); err != nil {
+		return err
+	}
+
+	if cfg.VideoPath != "" && !videoDecodingAvailable {
+		return errors.New("raw video output is not available: build with the 'vpx' tag and libvpx")
+	}
+
+	if cfg.AudioPath != "" {
+		if err := ValidateWAVConfig(config.WAV{SampleRate: cfg.SampleRate, Channels: cfg.Channels}); err != nil {
+			return fmt.Errorf("raw audio output: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func validateRawOutputFormat(cfg config.RawOutput) error {
+	if cfg.VideoPath == "" && cfg.AudioPath == "" {
+		return errors.New("raw output enabled without a video or audio path")
+	}
+
+	if cfg.VideoPath != "" && cfg.FrameRate <= 0 {
+		return fmt.Errorf("invalid raw output frame rate %d", cfg.FrameRate)
+	}
+
+	if cfg.AudioPath != "" {
+		if err := validateWAVFormat(config.WAV{SampleRate: cfg.SampleRate, Channels: cfg.Channels}); err != nil {
+			return fmt.Errorf("raw audio output: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// EnableRawOutput writes the recording's media, decoded, to the files or
+// named pipes of cfg. It must be called before any media is pushed.
+func (r *WebmRecorder) EnableRawOutput(cfg config.RawOutput) error {
+	if !cfg.Enable {
+		return nil
+	}
+
+	if err := validateRawOutputFormat(cfg); err != nil {
+		return err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.started {
+		return fmt.Errorf("cannot enable raw output after recording started")
+	}
+
+	r.rawOutputCfg = cfg
+
+	return nil
+}
+
+// rawOutputPath expands the {session} of a stream's path
+// Locked
+func (r *WebmRecorder) rawOutputPath(path string) string {
+	if session, ok := r.ctx.Value("session").(string); ok {
+		path = strings.ReplaceAll(path, "{session}", session)
+	}
+
+	return path
+}
+
+// rawWriters hands what's written to a file's video and audio tracks to
+// their raw streams
+// Locked
+func (r *WebmRecorder) rawWriters(writers []webm.BlockWriteCloser) []webm.BlockWriteCloser {
+	if !r.rawOutputCfg.Enable {
+		return writers
+	}
+
+	for i, kind := range r.trackKinds(len(writers)) {
+		var s *rawStream
+
+		switch kind {
+		case "video":
+			s = r.rawVideoStream()
+		case "audio":
+			s = r.rawAudioStream()
+		}
+
+		if s != nil {
+			writers[i] = &rawWriter{w: writers[i], s: s, restart: true}
+		}
+	}
+
+	return writers
+}
+
+// rawVideoStream returns the raw video stream, started on first use
+// Locked
+func (r *WebmRecorder) rawVideoStream() *rawStream {
+	if r.rawVideo != nil || r.rawOutputCfg.VideoPath == "" {
+		return r.rawVideo
+	}
+
+	decoder, err := newVideoDecoder(r.videoCodec)
+
+	if err != nil {
+		r.logger.Warnf("Raw video output disabled: %v", err)
+		r.rawOutputCfg.VideoPath = ""
+
+		return nil
+	}
+
+	r.rawVideo = newRawStream(r.ctx, r.rawOutputPath(r.rawOutputCfg.VideoPath), r.fileMode, &rawVideoEncoder{
+		decoder: decoder,
+		fps:     int64(r.rawOutputCfg.FrameRate),
+	})
+
+	return r.rawVideo
+}
+
+// rawAudioStream returns the raw audio stream, started on first use
+// Locked
+func (r *WebmRecorder) rawAudioStream() *rawStream {
+	if r.rawAudio != nil || r.rawOutputCfg.AudioPath == "" {
+		return r.rawAudio
+	}
+
+	cfg := r.rawOutputCfg
+	decoder, err := newOpusDecoder(cfg.SampleRate, cfg.Channels)
+
+	if err == nil && r.audioFormat.mappingFamily() != 0 {
+		decoder.Close()
+		err = fmt.Errorf("cannot decode %s Opus", r.audioFormat)
+	}
+
+	if err != nil {
+		r.logger.Warnf("Raw audio output disabled: %v", err)
+		r.rawOutputCfg.AudioPath = ""
+
+		return nil
+	}
+
+	r.rawAudio = newRawStream(r.ctx, r.rawOutputPath(cfg.AudioPath), r.fileMode, &rawAudioEncoder{
+		decoder:    decoder,
+		sampleRate: cfg.SampleRate,
+		channels:   cfg.Channels,
+		pcm:        make([]int16, int(opusMaxPacketDuration.Seconds()*float64(cfg.SampleRate))*cfg.Channels),
+	})
+
+	return r.rawAudio
+}
+
+// Locked
+func (r *WebmRecorder) closeRawOutput() {
+	for _, s := range []*rawStream{r.rawVideo, r.rawAudio} {
+		if s != nil {
+			s.close()
+		}
+	}
+}
+
+// rawOutputFiles returns the regular files raw streams were written to.
+// Named pipes belong to their reader and are left out.
+// Locked
+func (r *WebmRecorder) rawOutputFiles() []string {
+	var files []string
+
+	for _, s := range []*rawStream{r.rawVideo, r.rawAudio} {
+		if s == nil {
+			continue
+		}
+
+		if info, err := os.Lstat(s.path); err == nil && info.Mode().IsRegular() {
+			files = append(files, s.path)
+		}
+	}
+
+	return files
+}
+
+// Locked
+func (r *WebmRecorder) rawOutputStats() *types.RawOutputStats {
+	if r.rawVideo == nil && r.rawAudio == nil {
+		return nil
+	}
+
+	stats := &types.RawOutputStats{}
+
+	if r.rawVideo != nil {
+		stats.Video = r.rawVideo.stats()
+	}
+
+	if r.rawAudio != nil {
+		stats.Audio = r.rawAudio.stats()
+	}
+
+	return stats
+}
+
+// rawWriter queues the blocks written to a track for its raw stream
+type rawWriter struct {
+	w       webm.BlockWriteCloser
+	s       *rawStream
+	restart bool // Next block is the first of the file
+}
+
+func (w *rawWriter) Write(keyframe bool, timestamp int64, b []byte) (int, error) {
+	n, err := w.w.Write(keyframe, timestamp, b)
+
+	if err != nil {
+		return n, err
+	}
+
+	w.s.push(rawBlock{keyframe: keyframe, timestamp: timestamp, data: b, restart: w.restart})
+	w.restart = false
+
+	return n, nil
+}
+
+func (w *rawWriter) Close() error {
+	return w.w.Close()
+}
+
+type rawBlock struct {
+	keyframe  bool
+	timestamp int64 // ms
+	data      []byte
+	// The timeline restarts with this block (a new file), or blocks before
+	// it were dropped
+	restart, lost bool
+}
+
+// rawEncoder writes the frames decoded from a track's blocks to a file
+type rawEncoder interface {
+	// start writes the stream's header, if any, to f
+	start(f *os.File) error
+	// write writes what b decodes to, returning the frames written and
+	// dropped. Failing to decode b is an errRawDecode, which the stream goes
+	// on after.
+	write(b rawBlock) (written, dropped int, err error)
+	// close closes the file, if started, and the decoder
+	close() error
+}
+
+// rawStream writes a track, decoded, to a file or named pipe. Pushing never
+// blocks: blocks are dropped while the reader isn't keeping up, or isn't
+// there yet.
+type rawStream struct {
+	ctx      context.Context
+	path     string
+	fileMode os.FileMode
+	encoder  rawEncoder
+	queue    chan rawBlock
+	stop     chan struct{}
+	done     chan struct{}
+
+	// Guarded by the recorder's lock
+	closed  bool
+	lost    bool // Blocks were dropped since the last one queued
+	restart bool // The restart of the timeline is yet to be queued
+
+	opened                   atomic.Bool
+	written, dropped, failed atomic.Int64
+
+	mu   sync.Mutex
+	file *os.File
+	err  error
+}
+
+func newRawStream(ctx context.Context, path string, fileMode os.FileMode, encoder rawEncoder) *rawStream {
+	s := &rawStream{
+		ctx:      ctx,
+		path:     path,
+		fileMode: fileMode,
+		encoder:  encoder,
+		queue:    make(chan rawBlock, rawOutputQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s
+}
+
+// push queues a block written to the track. The block is copied: samples
+// may share buffers that are reused once written.
+func (s *rawStream) push(b rawBlock) {
+	if s.closed {
+		return
+	}
+
+	s.restart = s.restart || b.restart
+	b.restart = s.restart
+	b.lost = s.lost
+	b.data = append([]byte(nil), b.data...)
+
+	select {
+	case s.queue <- b:
+		s.lost = false
+		s.restart = false
+	default:
+		s.lost = true
+		s.dropped.Add(1)
+	}
+}
+
+func (s *rawStream) run() {
+	defer close(s.done)
+
+	f, err := s.open()
+
+	if err == nil && f != nil {
+		s.mu.Lock()
+		s.file = f
+		s.mu.Unlock()
+		s.opened.Store(true)
+
+		log.WithField("session", s.ctx.Value("session")).
+			Infof("Raw output opened: %s", s.path)
+
+		err = s.encoder.start(f)
+	}
+
+	if err != nil {
+		s.fail(err)
+	}
+
+	if err == nil && f != nil {
+		for b := range s.queue {
+			written, dropped, err := s.encoder.write(b)
+			s.written.Add(int64(written))
+			s.dropped.Add(int64(dropped))
+
+			if errors.Is(err, errRawDecode) {
+				s.failed.Add(1)
+				log.WithField("session", s.ctx.Value("session")).
+					Debugf("Raw output frame at %dms skipped: %v", b.timestamp, err)
+
+				continue
+			}
+
+			if err != nil {
+				s.fail(err)
+				break
+			}
+		}
+	}
+
+	// Drained so pushes don't fill the queue up
+	for range s.queue {
+	}
+
+	if err := s.encoder.close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		s.fail(err)
+	}
+}
+
+// open opens the stream's file, waiting for the reader of a named pipe.
+// Returns nil if the stream is closed first.
+func (s *rawStream) open() (*os.File, error) {
+	for {
+		// Without a reader, opening a named pipe fails rather than blocking
+		f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NONBLOCK, s.fileMode)
+
+		if err == nil || !errors.Is(err, syscall.ENXIO) {
+			return f, err
+		}
+
+		select {
+		case <-s.stop:
+			return nil, nil
+		case <-time.After(rawOutputOpenRetry):
+		}
+	}
+}
+
+func (s *rawStream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return
+	}
+
+	s.err = err
+	log.WithField("session", s.ctx.Value("session")).
+		Warnf("Raw output %s stopped: %v", s.path, err)
+}
+
+// close waits for the reader to take what's queued, giving up on it after
+// rawOutputCloseTimeout
+func (s *rawStream) close() {
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	close(s.stop)
+	close(s.queue)
+
+	select {
+	case <-s.done:
+		return
+	case <-time.After(rawOutputCloseTimeout):
+	}
+
+	s.fail(fmt.Errorf("reader fell behind, given up on after %s", rawOutputCloseTimeout))
+
+	// Unblocks the write in progress
+	s.mu.Lock()
+	if s.file != nil {
+		_ = s.file.Close()
+	}
+	s.mu.Unlock()
+
+	<-s.done
+}
+
+func (s *rawStream) stats() *types.RawStreamStats {
+	stats := &types.RawStreamStats{
+		Path:    s.path,
+		Opened:  s.opened.Load(),
+		Frames:  s.written.Load(),
+		Dropped: s.dropped.Load(),
+		Failed:  s.failed.Load(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		stats.Error = s.err.Error()
+	}
+
+	return stats
+}
+
+// rawVideoEncoder writes video as YUV4MPEG2, at fps: each frame lands in the
+// slot of that cadence closest to its timestamp, the previous frame being
+// repeated into the slots nothing came for. Frames whose slot is taken are
+// dropped, once decoded. The size of the first frame is kept, frames of
+// other sizes are dropped.
+type rawVideoEncoder struct {
+	decoder videoDecoder
+	fps     int64
+	f       *os.File
+
+	width, height int
+	started       bool
+	origin        int64 // Timestamp of slot 0 (ms)
+	next          int64 // Slot the next frame is due at
+	keyframeWait  bool  // Decoding resumes at the next keyframe
+	// The frame last written, header included
+	frame []byte
+}
+
+func (e *rawVideoEncoder) start(f *os.File) error {
+	e.f = f
+	return nil
+}
+
+func (e *rawVideoEncoder) write(b rawBlock) (int, int, error) {
+	if b.restart {
+		e.started = false
+	}
+
+	if b.lost {
+		e.keyframeWait = true
+	}
+
+	if e.keyframeWait && !b.keyframe {
+		return 0, 1, nil
+	}
+
+	img, err := e.decoder.Decode(b.data)
+
+	if err != nil {
+		e.keyframeWait = true
+		return 0, 0, fmt.Errorf("%w: %v", errRawDecode, err)
+	}
+
+	e.keyframeWait = false
+	yuv, ok := img.(*image.YCbCr)
+
+	if !ok || yuv.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+		return 0, 0, fmt.Errorf("%w: not an I420 frame", errRawDecode)
+	}
+
+	size := yuv.Rect.Size()
+
+	if e.frame == nil {
+		e.width, e.height = size.X, size.Y
+		header := fmt.Sprintf("YUV4MPEG2 W%d H%d F%d:1 Ip A1:1 C420jpeg\n", e.width, e.height, e.fps)
+
+		if _, err := e.f.WriteString(header); err != nil {
+			return 0, 0, err
+		}
+	} else if size.X != e.width || size.Y != e.height {
+		return 0, 1, nil
+	}
+
+	// A new file's timestamps go on from the last slot written
+	if !e.started {
+		e.started = true
+		e.origin = b.timestamp - e.next*1000/e.fps
+	}
+
+	slot := ((b.timestamp-e.origin)*e.fps*2 + 1000) / 2000
+
+	if slot < e.next {
+		return 0, 1, nil
+	}
+
+	written := 0
+
+	if e.frame != nil {
+		repeats := min(slot-e.next, int64(maxRawGap.Seconds())*e.fps)
+
+		for i := int64(0); i < repeats; i++ {
+			if _, err := e.f.Write(e.frame); err != nil {
+				return written, 0, err
+			}
+
+			written++
+		}
+	}
+
+	e.frame = appendI420Frame(e.frame[:0], yuv)
+
+	if _, err := e.f.Write(e.frame); err != nil {
+		return written, 0, err
+	}
+
+	e.next = slot + 1
+
+	return written + 1, 0, nil
+}
+
+// appendI420Frame appends img as a YUV4MPEG2 frame
+func appendI420Frame(buf []byte, img *image.YCbCr) []byte {
+	buf = append(buf, "FRAME\n"...)
+	r := img.Rect
+	cw, ch := (r.Dx()+1)/2, (r.Dy()+1)/2
+
+	for y := 0; y < r.Dy(); y++ {
+		i := img.YOffset(r.Min.X, r.Min.Y+y)
+		buf = append(buf, img.Y[i:i+r.Dx()]...)
+	}
+
+	for _, plane := range [][]byte{img.Cb, img.Cr} {
+		for y := 0; y < ch; y++ {
+			i := img.COffset(r.Min.X, r.Min.Y+2*y)
+			buf = append(buf, plane[i:i+cw]...)
+		}
+	}
+
+	return buf
+}
+
+func (e *rawVideoEncoder) close() error {
+	e.decoder.Close()
+
+	if e.f == nil {
+		return nil
+	}
+
+	return e.f.Close()
+}
+
+// rawAudioEncoder writes audio as a WAV stream, its sizes left unknown if
+// it's a pipe. Gaps in the timestamps are filled with silence.
+type rawAudioEncoder struct {
+	decoder    opusDecoder
+	sampleRate int
+	channels   int
+	wav        *WAVWriter
+	pcm        []int16
+
+	started bool
+	next    int64 // Timestamp the next block is expected at (ms)
+}
+
+func (e *rawAudioEncoder) start(f *os.File) error {
+	wav, err := NewWAVWriter(f, e.sampleRate, e.channels)
+
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	e.wav = wav
+
+	return nil
+}
+
+func (e *rawAudioEncoder) write(b rawBlock) (int, int, error) {
+	if b.restart {
+		e.started = false
+	}
+
+	frames, err := e.decoder.Decode(b.data, e.pcm)
+
+	// The silence for it is written with the next block
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: %v", errRawDecode, err)
+	}
+
+	duration := time.Duration(frames) * time.Second / time.Duration(e.sampleRate)
+
+	if e.started {
+		// Blocks are timed to the ms: less than a frame off is rounding
+		if gap := time.Duration(b.timestamp-e.next) * time.Millisecond; gap >= duration {
+			silence := int(min(gap, maxRawGap).Seconds() * float64(e.sampleRate))
+
+			if err := e.wav.WriteSilence(silence); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	if err := e.wav.WritePCM(e.pcm[:frames*e.channels]); err != nil {
+		return 0, 0, err
+	}
+
+	e.started = true
+	e.next = b.timestamp + duration.Milliseconds()
+
+	return 1, 0, nil
+}
+
+func (e *rawAudioEncoder) close() error {
+	e.decoder.Close()
+
+	if e.wav == nil {
+		return nil
+	}
+
+	return e.wav.Close()
+}
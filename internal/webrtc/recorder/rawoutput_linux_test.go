@@ -0,0 +1,64 @@
+package recorder
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRawStream_NamedPipe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.y4m")
+	require.NoError(t, syscall.Mkfifo(path, 0600))
+
+	s := newRawStream(context.Background(), path, 0600, &rawVideoEncoder{decoder: &fakeVideoDecoder{}, fps: 30})
+
+	// Queued until the reader comes
+	s.push(rawBlock{keyframe: true, timestamp: 0, data: []byte{0xAA}})
+	time.Sleep(2 * rawOutputOpenRetry)
+	assert.False(t, s.opened.Load())
+
+	reader, err := os.Open(path)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	read := make(chan []byte)
+
+	go func() {
+		data, _ := io.ReadAll(bufio.NewReader(reader))
+		read <- data
+	}()
+
+	s.push(rawBlock{timestamp: 33, data: []byte{0xAA}})
+	s.close()
+
+	data := <-read
+	assert.Equal(t, "YUV4MPEG2 W32 H24 F30:1 Ip A1:1 C420jpeg\n", string(data[:41]))
+	stats := s.stats()
+	assert.True(t, stats.Opened)
+	assert.Equal(t, int64(2), stats.Frames)
+	assert.Empty(t, stats.Error)
+}
+
+func TestRawStream_NoReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audio.wav")
+	require.NoError(t, syscall.Mkfifo(path, 0600))
+
+	s := newRawStream(context.Background(), path, 0600, &rawAudioEncoder{decoder: &fakeOpusDecoder{48000, 2}, sampleRate: 48000, channels: 2})
+	s.push(rawBlock{timestamp: 0, data: []byte{0xAA}})
+
+	start := time.Now()
+	s.close()
+	assert.Less(t, time.Since(start), time.Second, "Not waiting for a reader once closed")
+
+	stats := s.stats()
+	assert.False(t, stats.Opened)
+	assert.Empty(t, stats.Error)
+}
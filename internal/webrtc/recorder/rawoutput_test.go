@@ -0,0 +1,166 @@
+package recorder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebmRecorder_RawOutput(t *testing.T) {
+	withVideoDecoder(t, &fakeVideoDecoder{}, nil)
+	useFakeOpusDecoder(t)
+
+	dir := t.TempDir()
+	r := NewWebmRecorder(filepath.Join(dir, "rec.webm"), 0600, 256, 64, false, false, false)
+	r.WithContext(context.WithValue(context.Background(), "session", "s1"))
+	r.SetHasVideo(true)
+	r.SetHasAudio(true)
+	require.NoError(t, r.EnableRawOutput(config.RawOutput{
+		Enable:     true,
+		VideoPath:  filepath.Join(dir, "{session}.y4m"),
+		AudioPath:  filepath.Join(dir, "{session}.wav"),
+		FrameRate:  30,
+		SampleRate: 48000,
+		Channels:   2,
+	}))
+
+	writers := r.rawWriters([]webm.BlockWriteCloser{&blockRecorder{}, &blockRecorder{}})
+	video, audio := writers[0], writers[1]
+
+	write := func(w webm.BlockWriteCloser, keyframe bool, timestamp int64, b ...byte) {
+		_, err := w.Write(keyframe, timestamp, b)
+		require.NoError(t, err)
+	}
+
+	// Slots 0 and 1, 3 after repeating the previous frame into 2, then 3
+	// again, taken
+	write(video, true, 0, 0xAA)
+	write(video, false, 33, 0xAA)
+	write(video, false, 100, 0xAA)
+	write(video, false, 110, 0xAA)
+
+	// A gap of a frame, then a frame failing to decode
+	write(audio, true, 0, 0xAA)
+	write(audio, true, 20, 0xAA)
+	write(audio, true, 60, 0xAA)
+	write(audio, true, 80, 0xFF)
+	write(audio, true, 100, 0xAA)
+
+	// The next file's timeline goes on from there
+	writers = r.rawWriters([]webm.BlockWriteCloser{&blockRecorder{}, &blockRecorder{}})
+	write(writers[0], true, 0, 0xAA)
+	write(writers[1], true, 0, 0xAA)
+
+	r.closeRawOutput()
+	stats := r.rawOutputStats()
+
+	require.NotNil(t, stats.Video)
+	assert.Equal(t, filepath.Join(dir, "s1.y4m"), stats.Video.Path)
+	assert.True(t, stats.Video.Opened)
+	assert.Equal(t, int64(5), stats.Video.Frames)
+	assert.Equal(t, int64(1), stats.Video.Dropped)
+	assert.Empty(t, stats.Video.Error)
+
+	require.NotNil(t, stats.Audio)
+	assert.Equal(t, int64(5), stats.Audio.Frames)
+	assert.Equal(t, int64(1), stats.Audio.Failed)
+
+	data, err := os.ReadFile(stats.Video.Path)
+	require.NoError(t, err)
+	header := "YUV4MPEG2 W32 H24 F30:1 Ip A1:1 C420jpeg\n"
+	frameSize := len("FRAME\n") + 32*24 + 2*16*12
+	require.Len(t, data, len(header)+5*frameSize)
+	assert.Equal(t, header, string(data[:len(header)]))
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, "FRAME\n", string(data[len(header)+i*frameSize:][:6]), fmt.Sprintf("frame %d", i))
+	}
+
+	channels, sampleRate, samples := readWAV(t, stats.Audio.Path)
+	assert.Equal(t, 2, channels)
+	assert.Equal(t, 48000, sampleRate)
+	// 5 packets and 2 of silence
+	require.Len(t, samples, 7*960*2)
+	assert.Equal(t, int16(1000), samples[2*960*2-1])
+	assert.Equal(t, make([]int16, 960*2), samples[2*960*2:3*960*2])
+	assert.Equal(t, make([]int16, 960*2), samples[4*960*2:5*960*2])
+	assert.Equal(t, int16(1000), samples[len(samples)-1])
+}
+
+func TestRawVideoEncoder_LostBlocks(t *testing.T) {
+	decoder := &fakeVideoDecoder{}
+	f, err := os.Create(filepath.Join(t.TempDir(), "out.y4m"))
+	require.NoError(t, err)
+
+	e := &rawVideoEncoder{decoder: decoder, fps: 10}
+	require.NoError(t, e.start(f))
+	defer e.close()
+
+	written, dropped, err := e.write(rawBlock{keyframe: true, timestamp: 0, data: []byte{1}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, written)
+	assert.Zero(t, dropped)
+
+	// Not decoded until the next keyframe
+	written, dropped, err = e.write(rawBlock{timestamp: 100, data: []byte{2}, lost: true})
+	require.NoError(t, err)
+	assert.Zero(t, written)
+	assert.Equal(t, 1, dropped)
+
+	written, _, err = e.write(rawBlock{keyframe: true, timestamp: 300, data: []byte{3}})
+	require.NoError(t, err)
+	assert.Equal(t, 3, written, "The gap is filled with the last frame")
+	assert.Equal(t, [][]byte{{1}, {3}}, decoder.frames)
+}
+
+func TestValidateRawOutput(t *testing.T) {
+	useFakeOpusDecoder(t)
+
+	assert.NoError(t, ValidateRawOutput(config.RawOutput{}))
+	assert.NoError(t, ValidateRawOutput(config.RawOutput{Enable: true, AudioPath: "/tmp/a.wav", SampleRate: 48000, Channels: 2}))
+	assert.Error(t, ValidateRawOutput(config.RawOutput{Enable: true}))
+	assert.Error(t, ValidateRawOutput(config.RawOutput{Enable: true, AudioPath: "/tmp/a.wav", SampleRate: 44100, Channels: 2}))
+	assert.Error(t, ValidateRawOutput(config.RawOutput{Enable: true, VideoPath: "/tmp/v.y4m"}))
+}
+
+func TestWebmRecorder_CancelRawOutput(t *testing.T) {
+	withVideoDecoder(t, &fakeVideoDecoder{}, nil)
+	useFakeOpusDecoder(t)
+
+	dir := t.TempDir()
+	pipe := filepath.Join(dir, "audio.wav")
+	require.NoError(t, syscall.Mkfifo(pipe, 0600))
+
+	r := NewWebmRecorder(filepath.Join(dir, "rec.webm"), 0600, 256, 64, false, false, false)
+	r.SetHasVideo(true)
+	r.SetHasAudio(true)
+	require.NoError(t, r.EnableRawOutput(config.RawOutput{
+		Enable:     true,
+		VideoPath:  filepath.Join(dir, "video.y4m"),
+		AudioPath:  pipe,
+		FrameRate:  30,
+		SampleRate: 48000,
+		Channels:   2,
+	}))
+
+	// Nobody reads the audio pipe
+	writers := r.rawWriters([]webm.BlockWriteCloser{&blockRecorder{}, &blockRecorder{}})
+
+	for _, w := range writers {
+		_, err := w.Write(true, 0, []byte{0xAA})
+		require.NoError(t, err)
+	}
+
+	r.Cancel()
+
+	assert.NoFileExists(t, filepath.Join(dir, "video.y4m"))
+	assert.FileExists(t, pipe, "Named pipes are their reader's")
+}
@@ -3,13 +3,16 @@ package recorder
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/encryption"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/interfaces"
 	"github.com/pion/rtp"
@@ -19,6 +22,12 @@ import (
 // KeyframeRequester defines the interface for requesting keyframes
 type KeyframeRequester = interfaces.KeyframeRequester
 
+// What a video shows (see WebmRecorder.SetVideoSource)
+const (
+	VideoSourceCamera      = "camera"
+	VideoSourceScreenShare = "screen_share"
+)
+
 type Recorder interface {
 	GetFilePath() string
 	GetStats() *types.RecorderStats
@@ -28,9 +37,15 @@ type Recorder interface {
 	WithContext(ctx context.Context)
 	VideoTimestamp() time.Duration
 	AudioTimestamp() time.Duration
+	ReceivedPackets() uint64
+	FileStats() types.FileStats
 	SetHasAudio(hasAudio bool)
 	SetHasVideo(hasVideo bool)
+	SetVideoCodec(mimeType string) error
+	SetVideoLayer(layer string, width, height uint32)
 	SetKeyframeRequester(requester KeyframeRequester)
+	Pause()
+	Resume()
 	GetHasAudio() bool
 	GetHasVideo() bool
 	Close() time.Duration
@@ -97,8 +112,10 @@ func ValidateAndPrepareFile(ctx context.Context, cfg config.Recorder, file strin
 			}
 		}
 
-		if _, err := os.Stat(file); !os.IsNotExist(err) {
-			return "", 0, fmt.Errorf("file already exists %s", file)
+		var err error
+
+		if file, err = claimFile(file, cfg.FileCollision, time.Now()); err != nil {
+			return "", 0, err
 		}
 	} else {
 		file = os.DevNull
@@ -115,15 +132,23 @@ func ValidateAndPrepareFile(ctx context.Context, cfg config.Recorder, file strin
 	return file, fileMode, nil
 }
 
-func NewRecorder(ctx context.Context, cfg config.Recorder, file string) (Recorder, error) {
+func NewRecorder(ctx context.Context, cfg config.Recorder, file string) (r Recorder, err error) {
 	ext := filepath.Ext(file)
+	requested := path.Clean(path.Clean(cfg.Directory) + string(os.PathSeparator) + file)
+	claimTime := time.Now()
 	file, fileMode, err := ValidateAndPrepareFile(ctx, cfg, file)
 
 	if err != nil {
 		return nil, err
 	}
 
-	var r Recorder
+	// The file is taken until the recorder closes
+	defer func() {
+		if err != nil {
+			releaseFile(file)
+		}
+	}()
+
 	switch ext {
 	case ".webm":
 		r = NewWebmRecorder(
@@ -133,14 +158,183 @@ func NewRecorder(ctx context.Context, cfg config.Recorder, file string) (Recorde
 			cfg.AudioPacketQueueSize,
 			cfg.UseCustomSampler,
 			cfg.WriteIVFCopy,
+			cfg.AudioOnlyOgg,
 		)
 		r.WithContext(ctx)
+		if !cfg.WriteToDevNull {
+			wr := r.(*WebmRecorder)
+			wr.claimedFile = file
+			wr.requestedFile = requested
+			wr.fileCollision = cfg.FileCollision
+			wr.claimTime = claimTime
+		}
+
+		if err := configure(r.(*WebmRecorder), cfg); err != nil {
+			return nil, err
+		}
+
+		if cfg.Segments.Enable {
+			if err := r.(*WebmRecorder).EnableSegments(cfg.Segments); err != nil {
+				return nil, err
+			}
+		}
+
+		r.(*WebmRecorder).EnablePreallocation(cfg.Preallocate)
+		r.(*WebmRecorder).EnableCues(cfg.Cues)
+		r.(*WebmRecorder).EnableProxy(cfg.Proxy)
+
+		if cfg.Encryption.Enable {
+			key, err := encryption.Load(cfg.Encryption)
+
+			if err != nil {
+				return nil, err
+			}
+
+			r.(*WebmRecorder).EnableEncryption(key)
+		}
+
+		if cfg.Snapshots.Enable {
+			dirMode, err := parseFileMode(cfg.DirFileMode)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if err := r.(*WebmRecorder).EnableSnapshots(cfg.Snapshots, dirMode); err != nil {
+				return nil, err
+			}
+		}
 	default:
 		return nil, fmt.Errorf("unsupported file extension %s", ext)
 	}
 	return r, nil
 }
 
+// NewRecorderWithWriter creates a recorder writing to sink instead of a file
+// in the recorder directory. The container is picked the same way as for
+// files, from the tracks and codecs being recorded. A sink is a single
+// stream, with no directory: options writing more files next to the
+// recording (segments, snapshots, the proxy) or changing what's written
+// (encryption) are rejected, those about how files are written (cues,
+// preallocation, the IVF copy) are ignored.
+func NewRecorderWithWriter(ctx context.Context, cfg config.Recorder, sink io.WriteCloser) (Recorder, error) {
+	if sink == nil {
+		return nil, fmt.Errorf("recorder sink is nil")
+	}
+
+	if err := validateSinkConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	r := NewWebmRecorder(
+		"",
+		0,
+		cfg.VideoPacketQueueSize,
+		cfg.AudioPacketQueueSize,
+		cfg.UseCustomSampler,
+		false,
+		cfg.AudioOnlyOgg,
+	)
+	r.WithContext(ctx)
+	r.WithWriter(sink)
+
+	if ignored := sinkIgnoredOptions(cfg); len(ignored) > 0 {
+		log.WithField("session", ctx.Value("session")).
+			Warnf("Ignoring %s: not applicable to a recording written to a sink", strings.Join(ignored, ", "))
+	}
+
+	if err := configure(r, cfg); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// configure applies what's in cfg to r, whatever it's written to
+func configure(r *WebmRecorder, cfg config.Recorder) error {
+	if cfg.AudioOnlyWAV {
+		if err := r.EnableWAVOutput(cfg.WAV); err != nil {
+			return err
+		}
+	}
+
+	if cfg.FMP4.Enable {
+		if err := r.EnableFMP4Output(cfg.FMP4); err != nil {
+			return err
+		}
+	}
+
+	if cfg.MKV.Enable {
+		if err := r.EnableMKVOutput(cfg.MKV); err != nil {
+			return err
+		}
+	}
+
+	if len(cfg.ClockRates) > 0 {
+		r.SetClockRates(cfg.ClockRates)
+	}
+
+	r.EnableLossConcealment(cfg.LossConcealment)
+	r.EnableSilenceFill(cfg.SilenceFill)
+	r.EnableTrim(cfg.Trim)
+	r.EnableConstantFrameRate(cfg.ConstantFrameRate)
+	r.EnableTimestampRebasing(cfg.TimestampJumpThreshold)
+	r.EnableVP8TemporalLayers(cfg.VP8TemporalLayers)
+	r.EnableReorderTolerance(cfg.ReorderTolerance)
+	r.EnableAVSync(cfg.AVSync)
+
+	if err := r.EnableMutedVideo(cfg.MutedVideo); err != nil {
+		return err
+	}
+
+	if err := r.EnableDTX(cfg.DTX); err != nil {
+		return err
+	}
+
+	r.AddTags(cfg.Tags)
+	r.EnableFlushDeadline(cfg.FlushDeadline)
+	r.SetOpusEncoder(cfg.OpusEncoder)
+
+	return r.EnableRawOutput(cfg.RawOutput)
+}
+
+// validateSinkConfig checks cfg has none of the options a recording written
+// to a sink can't have
+func validateSinkConfig(cfg config.Recorder) error {
+	switch {
+	case cfg.Segments.Enable:
+		return fmt.Errorf("cannot split a recording written to a sink into segments")
+	case cfg.Snapshots.Enable:
+		return fmt.Errorf("cannot write snapshots of a recording written to a sink")
+	case cfg.Proxy.Enable:
+		return fmt.Errorf("cannot write a proxy of a recording written to a sink")
+	case cfg.Encryption.Enable:
+		return fmt.Errorf("cannot encrypt a recording written to a sink")
+	}
+
+	return nil
+}
+
+// sinkIgnoredOptions returns the options set in cfg that don't apply to a
+// recording written to a sink
+func sinkIgnoredOptions(cfg config.Recorder) []string {
+	var ignored []string
+
+	if cfg.Cues.FlushInterval > 0 {
+		ignored = append(ignored, "cues")
+	}
+
+	if cfg.Preallocate.Bitrate > 0 && cfg.Preallocate.Duration > 0 {
+		ignored = append(ignored, "preallocation")
+	}
+
+	if cfg.WriteIVFCopy {
+		ignored = append(ignored, "the IVF copy")
+	}
+
+	return ignored
+}
+
 func parseFileMode(mode string) (os.FileMode, error) {
 	if parsedFileMode, err := strconv.ParseUint(mode, 0, 32); err != nil {
 		return 0, fmt.Errorf("invalid file mode %s", mode)
@@ -0,0 +1,742 @@
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/at-wat/ebml-go"
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/encryption"
+)
+
+// ErrRecoveryUnsupported is returned when recovering a recording of a
+// container that isn't WebM/MKV
+var ErrRecoveryUnsupported = errors.New("recovery not supported for this container")
+
+// Matroska element IDs the recovery reads or writes
+const (
+	idEBML          = 0x1A45DFA3
+	idSegment       = 0x18538067
+	idSeekHead      = 0x114D9B74
+	idSeek          = 0x4DBB
+	idSeekID        = 0x53AB
+	idSeekPosition  = 0x53AC
+	idInfo          = 0x1549A966
+	idTimecodeScale = 0x2AD7B1
+	idDuration      = 0x4489
+	idTracks        = 0x1654AE6B
+	idTrackEntry    = 0xAE
+	idTrackNumber   = 0xD7
+	idTrackType     = 0x83
+	idTags          = 0x1254C367
+	idCluster       = 0x1F43B675
+	idTimecode      = 0xE7
+	idPrevSize      = 0xAB
+	idSimpleBlock   = 0xA3
+	idBlockGroup    = 0xA0
+	idBlock         = 0xA1
+	idCues          = 0x1C53BB6B
+	idVoid          = 0xEC
+	idChapters      = 0x1043A770
+	idAttachments   = 0x1941A469
+)
+
+// maxElementSize bounds the elements read, so a corrupt size doesn't
+// allocate the whole file
+const maxElementSize = 256 << 20
+
+// RecoveryResult describes a recording recovered by RecoverWebM
+type RecoveryResult struct {
+	Clusters int
+	Blocks   int
+	Duration time.Duration
+	// DroppedBytes were past the last complete block, e.g. a block the
+	// process crashed while writing
+	DroppedBytes int64
+}
+
+// RecoverWebM finalizes a WebM/MKV recording that wasn't closed, e.g. as
+// the recorder crashed: what follows the last complete block is dropped,
+// and the file is rewritten with its duration, a seek head and cues, so
+// players can seek it. The file is only replaced once rewritten.
+func RecoverWebM(path string) (*RecoveryResult, error) {
+	if ext := filepath.Ext(path); ext != ".webm" && ext != ".mkv" {
+		return nil, fmt.Errorf("%w: %s", ErrRecoveryUnsupported, ext)
+	}
+
+	in, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer in.Close()
+
+	info, err := in.Stat()
+
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(in)
+
+	if magic, _ := reader.Peek(encryption.MagicSize); encryption.IsEncrypted(magic) {
+		return nil, fmt.Errorf("%w: encrypted", ErrRecoveryUnsupported)
+	}
+
+	tmp := path + ".recovering"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := recoverWebM(reader, out, info.Size())
+
+	if err == nil {
+		err = out.Sync()
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ebmlElementHeader is an element's ID and size, -1 if unknown, as read
+type ebmlElementHeader struct {
+	id   uint32
+	size int64
+	raw  []byte
+}
+
+// ebmlReader reads EBML elements, keeping track of the offset
+type ebmlReader struct {
+	r   *bufio.Reader
+	pos int64
+}
+
+func (e *ebmlReader) readHeader() (ebmlElementHeader, error) {
+	id, err := e.readVint()
+
+	if err != nil {
+		return ebmlElementHeader{}, err
+	}
+
+	if len(id) > 4 {
+		return ebmlElementHeader{}, fmt.Errorf("invalid element ID at %d", e.pos)
+	}
+
+	size, err := e.readVint()
+
+	if err != nil {
+		return ebmlElementHeader{}, err
+	}
+
+	return ebmlElementHeader{
+		id:   uint32(beUint(id)),
+		size: vintValue(size),
+		raw:  append(id, size...),
+	}, nil
+}
+
+// readVint reads the bytes of an EBML variable-size integer
+func (e *ebmlReader) readVint() ([]byte, error) {
+	first, err := e.r.ReadByte()
+
+	if err != nil {
+		return nil, err
+	}
+
+	n := 1
+
+	for n <= 8 && first&(0x80>>(n-1)) == 0 {
+		n++
+	}
+
+	if n > 8 {
+		return nil, fmt.Errorf("invalid EBML integer at %d", e.pos)
+	}
+
+	b := make([]byte, n)
+	b[0] = first
+
+	if _, err := io.ReadFull(e.r, b[1:]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	e.pos += int64(n)
+
+	return b, nil
+}
+
+func (e *ebmlReader) readData(size int64) ([]byte, error) {
+	if size < 0 || size > maxElementSize {
+		return nil, fmt.Errorf("invalid element size %d at %d", size, e.pos)
+	}
+
+	b := make([]byte, size)
+
+	if _, err := io.ReadFull(e.r, b); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	e.pos += size
+
+	return b, nil
+}
+
+// vintValue returns the value of an EBML variable-size integer, -1 if it's
+// the reserved unknown size
+func vintValue(b []byte) int64 {
+	mask := byte(0xFF >> len(b))
+	v := uint64(b[0] & mask)
+	unknown := b[0]&mask == mask
+
+	for _, c := range b[1:] {
+		v = v<<8 | uint64(c)
+		unknown = unknown && c == 0xFF
+	}
+
+	if unknown {
+		return -1
+	}
+
+	return int64(v)
+}
+
+func beUint(b []byte) uint64 {
+	var v uint64
+
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+
+	return v
+}
+
+// ebmlChild is an element read from the data of a master element
+type ebmlChild struct {
+	id   uint32
+	data []byte
+	raw  []byte
+}
+
+// ebmlChildren splits the data of a master element into its children
+func ebmlChildren(data []byte) ([]ebmlChild, error) {
+	var children []ebmlChild
+	e := &ebmlReader{r: bufio.NewReader(bytes.NewReader(data))}
+
+	for e.pos < int64(len(data)) {
+		header, err := e.readHeader()
+
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := e.readData(header.size)
+
+		if err != nil {
+			return nil, err
+		}
+
+		children = append(children, ebmlChild{id: header.id, data: body, raw: append(header.raw, body...)})
+	}
+
+	return children, nil
+}
+
+// ebmlElement encodes an element, with an 8 byte size so it can be patched
+func ebmlElement(id uint32, data ...[]byte) []byte {
+	var b []byte
+
+	for shift := 24; shift >= 0; shift -= 8 {
+		if c := byte(id >> shift); c != 0 || len(b) > 0 {
+			b = append(b, c)
+		}
+	}
+
+	size := 0
+
+	for _, d := range data {
+		size += len(d)
+	}
+
+	b = append(b, ebmlSize(uint64(size))...)
+
+	for _, d := range data {
+		b = append(b, d...)
+	}
+
+	return b
+}
+
+// ebmlSize encodes an EBML size as 8 bytes
+func ebmlSize(size uint64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, size)
+	b[0] = 0x01
+
+	return b
+}
+
+// cueTrack returns the track cues point to: the video track, or the first
+// track of audio-only recordings. Returns whether it's video.
+func cueTrack(tracks []byte) (uint64, bool, error) {
+	entries, err := ebmlChildren(tracks)
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	var first uint64
+
+	for _, entry := range entries {
+		if entry.id != idTrackEntry {
+			continue
+		}
+
+		fields, err := ebmlChildren(entry.data)
+
+		if err != nil {
+			return 0, false, err
+		}
+
+		var number, kind uint64
+
+		for _, field := range fields {
+			switch field.id {
+			case idTrackNumber:
+				number = beUint(field.data)
+			case idTrackType:
+				kind = beUint(field.data)
+			}
+		}
+
+		if kind == 1 {
+			return number, true, nil
+		}
+
+		if first == 0 {
+			first = number
+		}
+	}
+
+	return first, false, nil
+}
+
+// parseBlock returns a block's track, its timecode relative to the
+// cluster's and whether it's a keyframe
+func parseBlock(id uint32, data []byte) (track uint64, timecode int16, keyframe bool, ok bool) {
+	block := data
+
+	if id == idBlockGroup {
+		children, err := ebmlChildren(data)
+
+		if err != nil {
+			return 0, 0, false, false
+		}
+
+		block = nil
+
+		for _, child := range children {
+			if child.id == idBlock {
+				block = child.data
+			}
+		}
+	}
+
+	if len(block) == 0 {
+		return 0, 0, false, false
+	}
+
+	e := &ebmlReader{r: bufio.NewReader(bytes.NewReader(block))}
+	trackBytes, err := e.readVint()
+
+	if err != nil || len(block) < len(trackBytes)+3 {
+		return 0, 0, false, false
+	}
+
+	rest := block[len(trackBytes):]
+	track = uint64(vintValue(trackBytes))
+	timecode = int16(binary.BigEndian.Uint16(rest))
+	keyframe = id == idSimpleBlock && rest[2]&0x80 != 0
+
+	return track, timecode, keyframe, true
+}
+
+// webmRecovery rewrites a recording as it's read
+type webmRecovery struct {
+	in  *ebmlReader
+	out io.WriteSeeker
+	// Written so far, and where the segment's data starts
+	pos, segmentStart int64
+	// Patched once everything is written
+	segmentSizeAt, durationAt, cuesPositionAt int64
+
+	info, tracks, tags []byte
+	timecodeScale      uint64
+	cueTrack           uint64
+	cueOnKeyframes     bool
+	cues               webm.Cues
+	lastTimecode       int64
+	result             RecoveryResult
+	// End of the last complete element read
+	goodEnd int64
+}
+
+func (w *webmRecovery) write(b []byte) error {
+	n, err := w.out.Write(b)
+	w.pos += int64(n)
+
+	return err
+}
+
+// recoverWebM writes what's recoverable of the recording read from in, of
+// size bytes, to out
+func recoverWebM(in *bufio.Reader, out io.WriteSeeker, size int64) (*RecoveryResult, error) {
+	w := &webmRecovery{in: &ebmlReader{r: in}, out: out, timecodeScale: 1000000}
+	header, err := w.in.readHeader()
+
+	if err != nil || header.id != idEBML {
+		return nil, errors.New("not a Matroska file")
+	}
+
+	ebmlHeader, err := w.in.readData(header.size)
+
+	if err != nil {
+		return nil, fmt.Errorf("reading EBML header: %w", err)
+	}
+
+	segment, err := w.in.readHeader()
+
+	if err != nil || segment.id != idSegment {
+		return nil, errors.New("no segment found")
+	}
+
+	end := size
+
+	if segment.size >= 0 {
+		end = min(size, w.in.pos+segment.size)
+	}
+
+	if err := w.write(append(header.raw, ebmlHeader...)); err != nil {
+		return nil, err
+	}
+
+	segmentHeader := ebmlElement(idSegment)
+	w.segmentSizeAt = w.pos + int64(len(segmentHeader)) - 8
+
+	if err := w.write(segmentHeader); err != nil {
+		return nil, err
+	}
+
+	w.segmentStart = w.pos
+	w.goodEnd = w.in.pos
+	started := false
+	var next *ebmlElementHeader
+
+	for next != nil || w.in.pos < end {
+		element := next
+		next = nil
+
+		if element == nil {
+			header, err := w.in.readHeader()
+
+			if err != nil {
+				break
+			}
+
+			element = &header
+		}
+
+		if element.id != idCluster {
+			if element.size < 0 {
+				break
+			}
+
+			data, err := w.in.readData(element.size)
+
+			if err != nil {
+				break
+			}
+
+			w.goodEnd = w.in.pos
+
+			// Those past the first cluster, and the seek head and cues,
+			// aren't kept
+			switch {
+			case started:
+			case element.id == idInfo:
+				w.info = data
+			case element.id == idTracks:
+				w.tracks = data
+			case element.id == idTags:
+				w.tags = data
+			}
+
+			continue
+		}
+
+		if !started {
+			started = true
+
+			if err := w.writeHeader(); err != nil {
+				return nil, err
+			}
+		}
+
+		var complete bool
+
+		if next, complete, err = w.recoverCluster(element, end); err != nil {
+			return nil, err
+		}
+
+		if !complete {
+			break
+		}
+	}
+
+	if w.result.Blocks == 0 {
+		return nil, errors.New("no media to recover")
+	}
+
+	if err := w.finish(); err != nil {
+		return nil, err
+	}
+
+	w.result.Duration = time.Duration(w.lastTimecode) * time.Duration(w.timecodeScale)
+	w.result.DroppedBytes = size - w.goodEnd
+
+	return &w.result, nil
+}
+
+// writeHeader writes the seek head, segment info and tracks (and tags)
+// ahead of the first cluster
+func (w *webmRecovery) writeHeader() error {
+	if w.info == nil || w.tracks == nil {
+		return errors.New("no segment info or tracks before the first cluster")
+	}
+
+	var err error
+
+	if w.cueTrack, w.cueOnKeyframes, err = cueTrack(w.tracks); err != nil {
+		return fmt.Errorf("reading tracks: %w", err)
+	}
+
+	fields, err := ebmlChildren(w.info)
+
+	if err != nil {
+		return fmt.Errorf("reading segment info: %w", err)
+	}
+
+	var info [][]byte
+
+	for _, field := range fields {
+		switch field.id {
+		case idDuration:
+			continue
+		case idTimecodeScale:
+			w.timecodeScale = beUint(field.data)
+		}
+
+		info = append(info, field.raw)
+	}
+
+	// Last, so it's patched at the end of the info
+	info = append(info, ebmlElement(idDuration, make([]byte, 8)))
+	elements := [][]byte{ebmlElement(idInfo, info...), ebmlElement(idTracks, w.tracks)}
+	ids := []uint32{idInfo, idTracks}
+
+	if w.tags != nil {
+		elements = append(elements, ebmlElement(idTags, w.tags))
+		ids = append(ids, idTags)
+	}
+
+	ids = append(ids, idCues)
+
+	// Positions are fixed width, so its size is known before they are
+	seek := func(id uint32, position int64) []byte {
+		return ebmlElement(idSeek,
+			ebmlElement(idSeekID, binary.BigEndian.AppendUint32(nil, id)),
+			ebmlElement(idSeekPosition, binary.BigEndian.AppendUint64(nil, uint64(position))),
+		)
+	}
+
+	position := int64(len(ebmlElement(idSeekHead))) + int64(len(ids)*len(seek(0, 0)))
+	var seeks [][]byte
+
+	for i, id := range ids {
+		seeks = append(seeks, seek(id, position))
+
+		if i < len(elements) {
+			position += int64(len(elements[i]))
+		}
+	}
+
+	seekHead := ebmlElement(idSeekHead, seeks...)
+	w.cuesPositionAt = w.pos + int64(len(seekHead)) - 8
+	w.durationAt = w.pos + int64(len(seekHead)) + int64(len(elements[0])) - 8
+
+	for _, element := range append([][]byte{seekHead}, elements...) {
+		if err := w.write(element); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recoverCluster writes what's complete of a cluster, returning the element
+// that ends it (if of unknown size) and whether it's complete
+func (w *webmRecovery) recoverCluster(cluster *ebmlElementHeader, end int64) (*ebmlElementHeader, bool, error) {
+	if cluster.size >= 0 {
+		end = min(end, w.in.pos+cluster.size)
+	}
+
+	position := w.pos - w.segmentStart
+	var children [][]byte
+	var timecode int64
+	var cuePoint *webm.CuePoint
+	var next *ebmlElementHeader
+	blocks := 0
+	complete := true
+
+	for w.in.pos < end {
+		child, err := w.in.readHeader()
+
+		if err != nil {
+			complete = false
+			break
+		}
+
+		// Clusters of unknown size end at the next top-level element
+		if cluster.size < 0 {
+			switch child.id {
+			case idCluster, idCues, idTags, idInfo, idTracks, idSeekHead, idChapters, idAttachments:
+				next = &child
+			}
+
+			if next != nil {
+				break
+			}
+		}
+
+		data, err := w.in.readData(child.size)
+
+		if err != nil {
+			complete = false
+			break
+		}
+
+		w.goodEnd = w.in.pos
+
+		switch child.id {
+		case idTimecode:
+			timecode = int64(beUint(data))
+		case idPrevSize, idVoid:
+			// Wrong once rewritten
+			continue
+		case idSimpleBlock, idBlockGroup:
+			track, relative, keyframe, ok := parseBlock(child.id, data)
+
+			if !ok {
+				continue
+			}
+
+			blocks++
+			w.lastTimecode = max(w.lastTimecode, timecode+int64(relative))
+
+			if track == w.cueTrack && (keyframe || !w.cueOnKeyframes) && cuePoint == nil {
+				cuePoint = &webm.CuePoint{
+					CueTime: uint64(max(timecode+int64(relative), 0)),
+					CueTrackPositions: []webm.CueTrackPosition{
+						{CueTrack: track, CueClusterPosition: uint64(position)},
+					},
+				}
+			}
+		}
+
+		children = append(children, append(child.raw, data...))
+	}
+
+	if blocks == 0 {
+		return next, complete, nil
+	}
+
+	// Players need one at least
+	if cuePoint == nil && len(w.cues.CuePoint) == 0 {
+		cuePoint = &webm.CuePoint{
+			CueTime:           uint64(max(timecode, 0)),
+			CueTrackPositions: []webm.CueTrackPosition{{CueTrack: w.cueTrack, CueClusterPosition: uint64(position)}},
+		}
+	}
+
+	if cuePoint != nil {
+		w.cues.CuePoint = append(w.cues.CuePoint, *cuePoint)
+	}
+
+	if err := w.write(ebmlElement(idCluster, children...)); err != nil {
+		return nil, false, err
+	}
+
+	w.result.Clusters++
+	w.result.Blocks += blocks
+
+	return next, complete, nil
+}
+
+// finish writes the cues, then patches the sizes and positions left open
+func (w *webmRecovery) finish() error {
+	cuesPosition := w.pos - w.segmentStart
+
+	if err := ebml.Marshal(&struct {
+		Cues webm.Cues `ebml:"Cues"`
+	}{w.cues}, w.out); err != nil {
+		return err
+	}
+
+	segmentEnd, err := w.out.Seek(0, io.SeekCurrent)
+
+	if err != nil {
+		return err
+	}
+
+	patches := []struct {
+		at   int64
+		data []byte
+	}{
+		{w.segmentSizeAt, ebmlSize(uint64(segmentEnd - w.segmentStart))},
+		{w.durationAt, binary.BigEndian.AppendUint64(nil, math.Float64bits(float64(w.lastTimecode)))},
+		{w.cuesPositionAt, binary.BigEndian.AppendUint64(nil, uint64(cuesPosition))},
+	}
+
+	for _, patch := range patches {
+		if _, err := w.out.Seek(patch.at, io.SeekStart); err != nil {
+			return err
+		}
+
+		if _, err := w.out.Write(patch.data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
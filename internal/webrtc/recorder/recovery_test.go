@@ -0,0 +1,109 @@
+package recorder
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/at-wat/ebml-go"
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// crashedRecording returns the path of a recording as left by a crash
+// after d of media, torn in the middle of its last block
+func crashedRecording(t *testing.T, d time.Duration) string {
+	s := newAVSyncSource(t)
+	s.gop = 30
+	s.run(d, true, true)
+
+	// What's on disk as the process dies
+	data, err := os.ReadFile(s.r.GetFilePath())
+	require.NoError(t, err)
+	s.r.Close()
+
+	path := filepath.Join(t.TempDir(), "crashed.webm")
+	require.NoError(t, os.WriteFile(path, data[:len(data)-3], 0600))
+
+	return path
+}
+
+type recoveredWebm struct {
+	Header  webm.EBMLHeader `ebml:"EBML"`
+	Segment webm.Segment    `ebml:"Segment"`
+}
+
+func TestRecoverWebM(t *testing.T) {
+	path := crashedRecording(t, 70*time.Second)
+
+	result, err := RecoverWebM(path)
+	require.NoError(t, err)
+	assert.Greater(t, result.Clusters, 1)
+	assert.Positive(t, result.DroppedBytes, "The torn block is dropped")
+	assert.InDelta(t, 70*time.Second, result.Duration, float64(time.Second))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var file recoveredWebm
+	require.NoError(t, ebml.Unmarshal(bytes.NewReader(data), &file))
+
+	segment := file.Segment
+	assert.InDelta(t, result.Duration.Milliseconds(), segment.Info.Duration, 1)
+	assert.Len(t, segment.Tracks.TrackEntry, 2)
+	assert.Len(t, segment.Cluster, result.Clusters)
+
+	blocks := 0
+
+	for _, cluster := range segment.Cluster {
+		blocks += len(cluster.SimpleBlock)
+	}
+
+	assert.Equal(t, result.Blocks, blocks)
+
+	// Positions are relative to the segment's data
+	segmentStart := bytes.Index(data, []byte{0x18, 0x53, 0x80, 0x67}) + 12
+	at := func(position uint64) []byte {
+		return data[segmentStart+int(position):][:4]
+	}
+
+	require.NotNil(t, segment.Cues)
+	require.Len(t, segment.Cues.CuePoint, result.Clusters, "A cue per cluster starting with a keyframe")
+
+	for _, cue := range segment.Cues.CuePoint {
+		assert.Equal(t, uint64(1), cue.CueTrackPositions[0].CueTrack, "Cues point to video")
+		assert.Equal(t, []byte{0x1F, 0x43, 0xB6, 0x75}, at(cue.CueTrackPositions[0].CueClusterPosition))
+	}
+
+	require.NotNil(t, segment.SeekHead)
+	require.Len(t, segment.SeekHead.Seek, 3)
+
+	for _, seek := range segment.SeekHead.Seek {
+		assert.Equal(t, seek.SeekID, at(seek.SeekPosition)[:len(seek.SeekID)])
+	}
+
+	// Recovering a recovered file changes nothing but its cues positions
+	again, err := RecoverWebM(path)
+	require.NoError(t, err)
+	assert.Equal(t, result.Blocks, again.Blocks)
+	assert.Zero(t, again.DroppedBytes)
+}
+
+func TestRecoverWebM_Invalid(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := RecoverWebM(filepath.Join(dir, "rec.ogg"))
+	assert.ErrorIs(t, err, ErrRecoveryUnsupported)
+
+	path := filepath.Join(dir, "rec.webm")
+	require.NoError(t, os.WriteFile(path, []byte("not a recording"), 0600))
+	_, err = RecoverWebM(path)
+	assert.Error(t, err)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "not a recording", string(data), "Left as is")
+	assert.NoFileExists(t, path+".recovering")
+}
@@ -0,0 +1,417 @@
+package recorder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How long before a segment boundary keyframes start being asked for
+	segmentKeyframeLead = time.Second
+	// Segments are cut on the first track: video if there is any
+	segmentLeader = 0
+)
+
+var errSegmentClosed = errors.New("segment writer closed")
+
+// SegmentManifest lists the segments of a recording split with
+// EnableSegments. It's written next to them, as GetFilePath.
+type SegmentManifest struct {
+	Segments []SegmentInfo `json:"segments"`
+}
+
+type SegmentInfo struct {
+	// File is relative to the manifest's directory
+	File  string `json:"file"`
+	Index int    `json:"index"`
+	// Wall clock time the segment started (Unix ms)
+	StartTime int64 `json:"startTime"`
+	// Position of the segment in the recording and its length (ms). The
+	// duration is only set once the segment is complete.
+	Start    int64 `json:"start"`
+	Duration int64 `json:"duration"`
+}
+
+type segment struct {
+	writers []webm.BlockWriteCloser
+	start   int64 // ms
+	last    int64
+	open    []bool // Tracks still writing to the segment
+	index   int    // In the manifest
+}
+
+// segmenter splits a recording into independently playable files, each
+// with its own container header and timestamps starting at 0. Segments are
+// cut on the leading track (video if there is any) at the first keyframe
+// past the segment duration. The other tracks move over once they reach the
+// boundary, so samples lagging behind still land in the segment they belong
+// to.
+type segmenter struct {
+	ctx             context.Context
+	file            string // Recording file name, segments are numbered after it
+	fileMode        os.FileMode
+	duration        time.Duration
+	newWriters      func(w io.WriteCloser) ([]webm.BlockWriteCloser, error)
+	requestKeyframe func()
+	onSegment       func(segment SegmentInfo)
+	now             func() time.Time
+	video           bool
+	closed          []bool
+
+	manifest          SegmentManifest
+	current, previous *segment
+}
+
+// Locked
+// isSegmented returns whether the recording is split into segment files.
+// Audio-only Ogg/WAV output and recordings without a file aren't.
+func (r *WebmRecorder) isSegmented() bool {
+	ext := r.containerExt()
+
+	return r.segmentDuration > 0 && r.sink == nil && r.file != os.DevNull && ext != ".ogg" && ext != ".wav"
+}
+
+// EnableSegments makes the recorder split recordings into segment files of
+// about cfg.Duration, cut at keyframes. GetFilePath returns the path of
+// their manifest (a SegmentManifest) then. It must be called before any
+// media is pushed, and can't be used along with WithWriter.
+func (r *WebmRecorder) EnableSegments(cfg config.Segments) error {
+	if cfg.Duration <= 0 {
+		return fmt.Errorf("invalid segment duration %v", cfg.Duration)
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.started {
+		return fmt.Errorf("cannot enable segments after recording started")
+	}
+
+	if r.sink != nil {
+		return fmt.Errorf("cannot split a recording written to a sink into segments")
+	}
+
+	r.segmentDuration = cfg.Duration
+
+	return nil
+}
+
+// SetSegmentCallback sets a callback for when a segment starts, including
+// the first one. It's called from its own goroutine.
+func (r *WebmRecorder) SetSegmentCallback(callback func(segment SegmentInfo)) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.segmentCallback = callback
+}
+
+// SegmentFiles returns the paths of the segments written so far, oldest
+// first, or nil if the recording isn't segmented
+func (r *WebmRecorder) SegmentFiles() []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.segmenter == nil {
+		return nil
+	}
+
+	return r.segmenter.files()
+}
+
+// Locked
+func (r *WebmRecorder) manifestPath() string {
+	return replaceExt(r.file, ".json")
+}
+
+// Locked
+// newSegmentWriters starts a new segmented recording, discarding whatever
+// segments were written if it's restarted
+func (r *WebmRecorder) newSegmentWriters(width, height int) ([]webm.BlockWriteCloser, error) {
+	if r.segmenter != nil {
+		r.segmenter.discard()
+	}
+
+	tracks := 0
+
+	if r.hasVideo {
+		tracks++
+	}
+
+	if r.hasAudio {
+		tracks++
+	}
+
+	s := &segmenter{
+		ctx:      r.ctx,
+		file:     r.file,
+		fileMode: r.fileMode,
+		duration: r.segmentDuration,
+		newWriters: func(w io.WriteCloser) ([]webm.BlockWriteCloser, error) {
+			return r.newWriters(r.indexFile(r.written.wrap(r.flushGuard.wrap(r.encryptFile(r.preallocateFile(w, r.segmentDuration))))), width, height)
+		},
+		requestKeyframe: r.RequestKeyframe,
+		// Locked, as the segmenter is only used with the recorder's lock
+		onSegment: func(segment SegmentInfo) {
+			if callback := r.segmentCallback; callback != nil {
+				go callback(segment)
+			}
+		},
+		now:    r.now,
+		video:  r.hasVideo,
+		closed: make([]bool, tracks),
+	}
+
+	if err := s.rotate(0); err != nil {
+		return nil, err
+	}
+
+	r.segmenter = s
+	writers := make([]webm.BlockWriteCloser, tracks)
+
+	for i := range writers {
+		writers[i] = &segmentTrackWriter{s: s, track: i}
+	}
+
+	return writers, nil
+}
+
+type segmentTrackWriter struct {
+	s     *segmenter
+	track int
+}
+
+func (t *segmentTrackWriter) Write(keyframe bool, timestamp int64, b []byte) (int, error) {
+	return t.s.write(t.track, keyframe, timestamp, b)
+}
+
+func (t *segmentTrackWriter) Close() error {
+	return t.s.closeTrack(t.track)
+}
+
+func (s *segmenter) write(track int, keyframe bool, timestamp int64, b []byte) (int, error) {
+	if s.closed[track] || s.current == nil {
+		return 0, errSegmentClosed
+	}
+
+	if track == segmentLeader {
+		elapsed := time.Duration(timestamp-s.current.start) * time.Millisecond
+
+		if elapsed >= s.duration && (keyframe || !s.video) {
+			if err := s.rotate(timestamp); err != nil {
+				return 0, err
+			}
+		} else if s.video && elapsed >= s.duration-min(segmentKeyframeLead, s.duration/4) {
+			// Throttled by the recorder, so it's asked again until one shows up
+			s.requestKeyframe()
+		}
+	}
+
+	seg := s.current
+
+	if s.previous != nil && s.previous.open[track] {
+		if timestamp < s.current.start {
+			seg = s.previous
+		} else if err := s.closeSegmentTrack(s.previous, track); err != nil {
+			return 0, err
+		}
+	}
+
+	seg.last = max(seg.last, timestamp)
+
+	return seg.writers[track].Write(keyframe, max(timestamp-seg.start, 0), b)
+}
+
+// rotate starts a new segment at start (ms). A previous segment still
+// waiting for lagging tracks is closed first.
+func (s *segmenter) rotate(start int64) error {
+	if s.previous != nil {
+		if err := s.closeSegment(s.previous); err != nil {
+			return err
+		}
+	}
+
+	index := len(s.manifest.Segments) + 1
+	ext := filepath.Ext(s.file)
+	file := fmt.Sprintf("%s-%04d%s", strings.TrimSuffix(s.file, ext), index, ext)
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, s.fileMode)
+
+	if err != nil {
+		return err
+	}
+
+	writers, err := s.newWriters(f)
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.manifest.Segments = append(s.manifest.Segments, SegmentInfo{
+		File:      filepath.Base(file),
+		Index:     index,
+		StartTime: s.now().UnixMilli(),
+		Start:     start,
+	})
+
+	seg := &segment{
+		writers: writers,
+		start:   start,
+		last:    start,
+		open:    make([]bool, len(writers)),
+		index:   len(s.manifest.Segments) - 1,
+	}
+
+	for i := range seg.open {
+		seg.open[i] = true
+	}
+
+	s.previous, s.current = s.current, seg
+
+	// Tracks that ended still need their writer closed for the container
+	// to be finalized
+	for i, closed := range s.closed {
+		if closed {
+			if err := s.closeSegmentTrack(seg, i); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.WithField("session", s.ctx.Value("session")).
+		Infof("Recording segment %d started at %dms: %s", index, start, file)
+
+	if s.onSegment != nil {
+		s.onSegment(s.manifest.Segments[seg.index])
+	}
+
+	if s.previous != nil {
+		if err := s.closeSegmentTrack(s.previous, segmentLeader); err != nil {
+			return err
+		}
+	}
+
+	return s.writeManifest()
+}
+
+func (s *segmenter) closeSegment(seg *segment) error {
+	for track, open := range seg.open {
+		if open {
+			if err := s.closeSegmentTrack(seg, track); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// closeSegmentTrack closes a track of a segment, finalizing the segment once
+// none is left
+func (s *segmenter) closeSegmentTrack(seg *segment, track int) error {
+	if !seg.open[track] {
+		return nil
+	}
+
+	seg.open[track] = false
+	err := seg.writers[track].Close()
+
+	for _, open := range seg.open {
+		if open {
+			return err
+		}
+	}
+
+	info := &s.manifest.Segments[seg.index]
+
+	if seg == s.previous {
+		s.previous = nil
+		info.Duration = s.current.start - seg.start
+	} else {
+		info.Duration = seg.last - seg.start
+	}
+
+	if manifestErr := s.writeManifest(); err == nil {
+		err = manifestErr
+	}
+
+	log.WithField("session", s.ctx.Value("session")).
+		Debugf("Recording segment %d completed", info.Index)
+
+	return err
+}
+
+// closeTrack closes a track writer: the recording is over once all are
+func (s *segmenter) closeTrack(track int) error {
+	if s.closed[track] {
+		return nil
+	}
+
+	s.closed[track] = true
+	var err error
+
+	if s.previous != nil {
+		err = s.closeSegmentTrack(s.previous, track)
+	}
+
+	if s.current != nil {
+		if closeErr := s.closeSegmentTrack(s.current, track); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// writeManifest replaces the manifest, so readers never see a partial one
+func (s *segmenter) writeManifest() error {
+	data, err := json.MarshalIndent(s.manifest, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	path := replaceExt(s.file, ".json")
+	tmp := path + ".tmp"
+
+	if err := os.WriteFile(tmp, data, s.fileMode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (s *segmenter) files() []string {
+	dir := filepath.Dir(s.file)
+	files := make([]string, 0, len(s.manifest.Segments))
+
+	for _, seg := range s.manifest.Segments {
+		files = append(files, filepath.Join(dir, seg.File))
+	}
+
+	return files
+}
+
+// discard closes and removes everything written
+func (s *segmenter) discard() {
+	for i := range s.closed {
+		_ = s.closeTrack(i)
+	}
+
+	for _, file := range append(s.files(), replaceExt(s.file, ".json")) {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.WithField("session", s.ctx.Value("session")).
+				Warnf("Error removing segment: %v", err)
+		}
+	}
+}
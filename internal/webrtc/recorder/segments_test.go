@@ -0,0 +1,169 @@
+package recorder
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeBlockWriter struct {
+	timestamps []int64
+	closed     bool
+	file       io.Closer
+	closers    *int
+}
+
+func (w *fakeBlockWriter) Write(keyframe bool, timestamp int64, b []byte) (int, error) {
+	w.timestamps = append(w.timestamps, timestamp)
+	return len(b), nil
+}
+
+func (w *fakeBlockWriter) Close() error {
+	w.closed = true
+	*w.closers--
+
+	if *w.closers == 0 {
+		return w.file.Close()
+	}
+
+	return nil
+}
+
+func readSegmentManifest(t *testing.T, path string) SegmentManifest {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var manifest SegmentManifest
+	require.NoError(t, json.Unmarshal(data, &manifest))
+
+	return manifest
+}
+
+func TestSegmenter(t *testing.T) {
+	dir := t.TempDir()
+	var segments [][]*fakeBlockWriter
+	requests := 0
+
+	s := &segmenter{
+		ctx:      context.Background(),
+		file:     filepath.Join(dir, "rec.webm"),
+		fileMode: 0600,
+		duration: time.Second,
+		newWriters: func(w io.WriteCloser) ([]webm.BlockWriteCloser, error) {
+			closers := 2
+			video := &fakeBlockWriter{file: w, closers: &closers}
+			audio := &fakeBlockWriter{file: w, closers: &closers}
+			segments = append(segments, []*fakeBlockWriter{video, audio})
+
+			return []webm.BlockWriteCloser{video, audio}, nil
+		},
+		requestKeyframe: func() { requests++ },
+		now:             time.Now,
+		video:           true,
+		closed:          make([]bool, 2),
+	}
+	require.NoError(t, s.rotate(0))
+	video, audio := &segmentTrackWriter{s: s, track: 0}, &segmentTrackWriter{s: s, track: 1}
+
+	// Keyframes every 1.5s, audio lagging 30ms behind video
+	for ms := int64(0); ms <= 3200; ms += 20 {
+		_, err := video.Write(ms%1500 == 0, ms, []byte{1})
+		require.NoError(t, err)
+
+		if ms >= 30 {
+			_, err = audio.Write(true, ms-30, []byte{2})
+			require.NoError(t, err)
+		}
+	}
+
+	require.NoError(t, video.Close())
+	require.NoError(t, audio.Close())
+
+	require.Len(t, segments, 3, "Segments only start at keyframes")
+	assert.Positive(t, requests, "Keyframes are requested ahead of the boundary")
+
+	for i, seg := range segments {
+		assert.Equal(t, int64(0), seg[0].timestamps[0], "Segment %d starts at 0", i)
+		assert.True(t, seg[0].closed)
+		assert.True(t, seg[1].closed)
+	}
+
+	// Lagging audio stays in the segment it belongs to
+	assert.Equal(t, int64(1490), segments[0][1].timestamps[len(segments[0][1].timestamps)-1])
+	assert.Equal(t, int64(10), segments[1][1].timestamps[0])
+
+	manifest := readSegmentManifest(t, filepath.Join(dir, "rec.json"))
+	require.Len(t, manifest.Segments, 3)
+	assert.Equal(t, "rec-0001.webm", manifest.Segments[0].File)
+	assert.Equal(t, "rec-0003.webm", manifest.Segments[2].File)
+	assert.Equal(t, []int64{0, 1500, 3000}, []int64{manifest.Segments[0].Start, manifest.Segments[1].Start, manifest.Segments[2].Start})
+	assert.Equal(t, int64(1500), manifest.Segments[0].Duration)
+	assert.Equal(t, int64(200), manifest.Segments[2].Duration)
+
+	for _, file := range s.files() {
+		assert.FileExists(t, file)
+	}
+
+	_, err := video.Write(true, 4000, []byte{1})
+	assert.ErrorIs(t, err, errSegmentClosed)
+}
+
+func TestWebmRecorder_Segments(t *testing.T) {
+	s := newAVSyncSource(t)
+	require.NoError(t, s.r.EnableSegments(config.Segments{Enable: true, Duration: time.Second}))
+
+	started := make(chan SegmentInfo, 4)
+	s.r.SetSegmentCallback(func(segment SegmentInfo) {
+		started <- segment
+	})
+
+	dir := filepath.Dir(s.r.file)
+	assert.Equal(t, filepath.Join(dir, "rec.json"), s.r.GetFilePath())
+
+	s.run(2500*time.Millisecond, true, true)
+	s.r.Close()
+
+	files := s.r.SegmentFiles()
+	require.Len(t, files, 3)
+
+	manifest := readSegmentManifest(t, s.r.GetFilePath())
+	require.Len(t, manifest.Segments, 3)
+
+	for i, file := range files {
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0x1A, 0x45, 0xDF, 0xA3}, data[:4], "Each segment is a complete WebM")
+		assert.Equal(t, filepath.Base(file), manifest.Segments[i].File)
+	}
+
+	assert.InDelta(t, 1000, manifest.Segments[0].Duration, 50)
+	assert.NoFileExists(t, filepath.Join(dir, "rec.webm"))
+
+	// Callbacks run in their own goroutines, so they may be out of order
+	indexes := map[int]bool{}
+
+	for range 3 {
+		select {
+		case segment := <-started:
+			indexes[segment.Index] = true
+		case <-time.After(time.Second):
+			t.Fatal("Segment callback not called")
+		}
+	}
+
+	assert.Equal(t, map[int]bool{1: true, 2: true, 3: true}, indexes)
+
+	sink := &streamSink{}
+	r := NewWebmRecorder("", 0, 256, 64, false, false, false)
+	r.WithWriter(sink)
+	assert.Error(t, r.EnableSegments(config.Segments{Enable: true, Duration: time.Second}), "Sinks can't be segmented")
+}
@@ -0,0 +1,102 @@
+package recorder
+
+import (
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+)
+
+const (
+	// maxSilenceFill bounds the silence generated for a single gap; past
+	// that, more likely a timestamp jump than a drop, and the remainder is
+	// left as a gap
+	maxSilenceFill = 10 * time.Minute
+	// Silent frames are 20ms
+	silenceFrameSamples = opusSampleRate / 50
+)
+
+// opusSilence returns a 20ms Opus frame decoding to silence (CELT, full
+// band), mono or stereo
+func opusSilence(stereo bool) []byte {
+	if stereo {
+		return []byte{0xFC, 0xFF, 0xFE}
+	}
+
+	return []byte{0xF8, 0xFF, 0xFE}
+}
+
+// EnableSilenceFill fills the audio gaps longer than cfg.Threshold with
+// silence, if enabled. Must be called before any media is pushed.
+func (r *WebmRecorder) EnableSilenceFill(cfg config.SilenceFill) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.silenceThreshold = 0
+
+	if cfg.Enable {
+		// Anything past the packet's own duration is a gap
+		r.silenceThreshold = max(cfg.Threshold, time.Nanosecond)
+	}
+}
+
+// fillSilence returns the samples to write for those fillDTX returned: the
+// same, preceded by silent frames covering what's left of the gap the last
+// one's duration spans, if longer than the threshold. Frames filled in
+// earlier (PLC, DTX) sit at the end of the gap, so the silence goes first.
+// Pause gaps are left alone. The result is only valid until the next call.
+// Locked
+func (r *WebmRecorder) fillSilence(samples []pendingAudioSample) []pendingAudioSample {
+	if r.silenceThreshold == 0 || r.audioGapPending {
+		return samples
+	}
+
+	last := samples[len(samples)-1]
+	frameSamples := opusPacketSamples(last.data)
+
+	if frameSamples == 0 {
+		return samples
+	}
+
+	gap := last.duration - time.Duration(frameSamples)*time.Second/opusSampleRate
+
+	if gap <= r.silenceThreshold {
+		return samples
+	}
+
+	frame := time.Duration(silenceFrameSamples) * time.Second / opusSampleRate
+	count := int(min(gap, maxSilenceFill) / frame)
+
+	if count <= 0 {
+		return samples
+	}
+
+	silence := opusSilence(last.data[0]&0x04 != 0)
+	step := uint32(uint64(silenceFrameSamples) * uint64(r.audioRate) / opusSampleRate)
+	filled := r.silenceScratch[:0]
+
+	for i := count; i > 0; i-- {
+		filled = append(filled, pendingAudioSample{
+			data:         silence,
+			duration:     frame,
+			rtpTimestamp: samples[0].rtpTimestamp - uint32(i)*step,
+		})
+	}
+
+	filled = append(filled, samples[:len(samples)-1]...)
+
+	filledDuration := time.Duration(count) * frame
+	r.stats.Audio.SilenceFilledMs += filledDuration.Milliseconds()
+
+	r.logger.WithField("silence", filledDuration).
+		WithField("rtp_timestamp", last.rtpTimestamp).
+		Debug("Filling audio gap with silence")
+
+	filled = append(filled, pendingAudioSample{
+		data:         last.data,
+		duration:     last.duration - filledDuration,
+		rtpTimestamp: last.rtpTimestamp,
+	})
+	r.silenceScratch = filled
+
+	return filled
+}
@@ -0,0 +1,70 @@
+package recorder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebmRecorder_FillSilence(t *testing.T) {
+	r := NewWebmRecorder("", 0, 256, 64, false, false, false)
+	r.SetHasAudio(true)
+	r.initAudioStats()
+
+	voice := []byte{0xFC, 0xAA, 0xBB} // CELT 20ms, stereo
+	gap := pendingAudioSample{data: voice, duration: 120 * time.Millisecond, rtpTimestamp: 4800}
+
+	// Disabled
+	assert.Len(t, r.fillSilence([]pendingAudioSample{gap}), 1)
+
+	r.EnableSilenceFill(config.SilenceFill{Enable: true, Threshold: 100 * time.Millisecond})
+
+	// Not past the threshold
+	assert.Len(t, r.fillSilence([]pendingAudioSample{gap}), 1)
+
+	gap.duration = 200 * time.Millisecond
+	samples := r.fillSilence([]pendingAudioSample{gap})
+
+	// 9 silent frames after the previous sample, then the sample
+	require.Len(t, samples, 10)
+
+	for i, s := range samples[:9] {
+		assert.Equal(t, opusSilence(true), s.data)
+		assert.Equal(t, 20*time.Millisecond, s.duration)
+		assert.Equal(t, uint32(4800-(9-i)*960), s.rtpTimestamp)
+	}
+
+	assert.Equal(t, voice, samples[9].data)
+	assert.Equal(t, 20*time.Millisecond, samples[9].duration)
+	assert.Equal(t, int64(180), r.stats.Audio.SilenceFilledMs)
+
+	// Concealed first: the PLC frames stay at the end of the gap
+	plc := []byte{0xFC}
+	samples = r.fillSilence([]pendingAudioSample{
+		{data: plc, duration: 20 * time.Millisecond, rtpTimestamp: 9600 - 960},
+		{data: voice, duration: 200 * time.Millisecond, rtpTimestamp: 9600},
+	})
+
+	require.Len(t, samples, 11)
+	assert.Equal(t, uint32(0), samples[0].rtpTimestamp)
+	assert.Equal(t, uint32(9600-2*960), samples[8].rtpTimestamp)
+	assert.Equal(t, plc, samples[9].data)
+	assert.Equal(t, voice, samples[10].data)
+	assert.Equal(t, 20*time.Millisecond, samples[10].duration)
+	assert.Equal(t, int64(360), r.stats.Audio.SilenceFilledMs)
+
+	var total time.Duration
+
+	for _, s := range samples {
+		total += s.duration
+	}
+
+	assert.Equal(t, 220*time.Millisecond, total, "The media time is kept")
+
+	// Pauses are left alone
+	r.audioGapPending = true
+	assert.Len(t, r.fillSilence([]pendingAudioSample{gap}), 1)
+}
@@ -0,0 +1,314 @@
+package recorder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// snapshotKeyframeWait is how long past due a snapshot waits for a keyframe
+// before one is requested
+const snapshotKeyframeWait = time.Second
+
+// videoDecoder decodes compressed video frames
+type videoDecoder interface {
+	// Decode returns the image of frame, a keyframe for the first call
+	Decode(frame []byte) (image.Image, error)
+	Close()
+}
+
+var newVideoDecoder = newLibvpxDecoder
+
+// ValidateSnapshots checks the snapshots configuration of the recorder,
+// including that this build can decode video
+func ValidateSnapshots(cfg config.Snapshots) error {
+	if !cfg.Enable {
+		return nil
+	}
+
+	if err := validateSnapshotFormat(cfg); err != nil {
+		return err
+	}
+
+	if !videoDecodingAvailable {
+		return errors.New("snapshots are not available: build with the 'vpx' tag and libvpx")
+	}
+
+	return nil
+}
+
+func validateSnapshotFormat(cfg config.Snapshots) error {
+	if cfg.Interval <= 0 {
+		return fmt.Errorf("invalid snapshot interval %v", cfg.Interval)
+	}
+
+	if cfg.Quality < 1 || cfg.Quality > 100 {
+		return fmt.Errorf("invalid snapshot quality %d", cfg.Quality)
+	}
+
+	return nil
+}
+
+// EnableSnapshots writes a JPEG still of the video every cfg.Interval of
+// media time, next to the recording (see config.Snapshots). The directory
+// is created with dirMode. Must be called before any media is pushed.
+func (r *WebmRecorder) EnableSnapshots(cfg config.Snapshots, dirMode os.FileMode) error {
+	if err := validateSnapshotFormat(cfg); err != nil {
+		return err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.started {
+		return fmt.Errorf("cannot enable snapshots after recording started")
+	}
+
+	r.snapshotInterval = cfg.Interval
+	r.snapshotQuality = cfg.Quality
+	r.snapshotDirMode = dirMode
+
+	return nil
+}
+
+// SnapshotDir returns the directory snapshots are written to, or "" if
+// they're not enabled
+func (r *WebmRecorder) SnapshotDir() string {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.snapshotDir()
+}
+
+// Locked
+func (r *WebmRecorder) snapshotDir() string {
+	if r.snapshotInterval == 0 || r.file == "" || r.file == os.DevNull {
+		return ""
+	}
+
+	return replaceExt(r.file, "-snapshots")
+}
+
+// snapshotWriters takes the snapshots of a file's video track from what's
+// written to it
+// Locked
+func (r *WebmRecorder) snapshotWriters(writers []webm.BlockWriteCloser) []webm.BlockWriteCloser {
+	dir := r.snapshotDir()
+
+	if dir == "" || !r.hasVideo || len(writers) == 0 {
+		return writers
+	}
+
+	// Kept across file restarts
+	if r.snapshotter == nil {
+		s, err := newSnapshotter(r.ctx, r.videoCodec, dir, r.snapshotDirMode, r.fileMode, r.snapshotQuality)
+
+		if err != nil {
+			r.logger.Warnf("Snapshots disabled: %v", err)
+			r.snapshotInterval = 0
+
+			return writers
+		}
+
+		r.snapshotter = s
+	}
+
+	// Video comes first
+	writers[0] = &snapshotWriter{
+		r:        r,
+		w:        writers[0],
+		s:        r.snapshotter,
+		interval: r.snapshotInterval.Milliseconds(),
+	}
+
+	return writers
+}
+
+// snapshotWriter hands the first keyframe written once a snapshot is due
+// to the snapshotter, asking for one if it's late
+type snapshotWriter struct {
+	r        *WebmRecorder
+	w        webm.BlockWriteCloser
+	s        *snapshotter
+	interval int64 // ms
+
+	next      int64 // Timestamp the next snapshot is due at (ms)
+	requested bool  // A keyframe was asked for the snapshot due
+}
+
+func (w *snapshotWriter) Write(keyframe bool, timestamp int64, b []byte) (int, error) {
+	n, err := w.w.Write(keyframe, timestamp, b)
+
+	if err != nil {
+		return n, err
+	}
+
+	// Keyframes slightly ahead will do: publishers' keyframe intervals
+	// often are the snapshot interval, give or take rounding
+	if keyframe && timestamp >= w.next-w.interval/10 {
+		w.s.push(timestamp, b)
+		w.next = timestamp + w.interval
+		w.requested = false
+	} else if !keyframe && !w.requested && timestamp >= w.next+snapshotKeyframeWait.Milliseconds() {
+		w.requested = true
+		w.r.RequestKeyframe()
+	}
+
+	return n, nil
+}
+
+func (w *snapshotWriter) Close() error {
+	return w.w.Close()
+}
+
+type snapshotFrame struct {
+	timestamp int64 // ms
+	data      []byte
+}
+
+// snapshotter decodes and writes snapshots in the background, one at a
+// time: keyframes handed over while one is in progress are skipped
+type snapshotter struct {
+	ctx      context.Context
+	dir      string
+	fileMode os.FileMode
+	quality  int
+	decoder  videoDecoder
+	frames   chan snapshotFrame
+	done     chan struct{}
+	closed   bool
+
+	written, failed, skipped atomic.Int64
+}
+
+func newSnapshotter(
+	ctx context.Context,
+	codec string,
+	dir string,
+	dirMode os.FileMode,
+	fileMode os.FileMode,
+	quality int,
+) (*snapshotter, error) {
+	decoder, err := newVideoDecoder(codec)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		decoder.Close()
+		return nil, fmt.Errorf("snapshot directory could not be created %s: %w", dir, err)
+	}
+
+	s := &snapshotter{
+		ctx:      ctx,
+		dir:      dir,
+		fileMode: fileMode,
+		quality:  quality,
+		decoder:  decoder,
+		frames:   make(chan snapshotFrame, 1),
+		done:     make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+// push queues a keyframe taken at timestamp to be written as a snapshot.
+// The frame is copied: samples may share buffers that are reused once
+// written.
+func (s *snapshotter) push(timestamp int64, frame []byte) {
+	select {
+	case s.frames <- snapshotFrame{timestamp: timestamp, data: append([]byte(nil), frame...)}:
+	default:
+		s.skipped.Add(1)
+	}
+}
+
+func (s *snapshotter) run() {
+	defer close(s.done)
+
+	for frame := range s.frames {
+		file, err := s.write(frame)
+
+		if err != nil {
+			s.failed.Add(1)
+			log.WithField("session", s.ctx.Value("session")).
+				Warnf("Failed to write snapshot at %dms: %v", frame.timestamp, err)
+
+			continue
+		}
+
+		s.written.Add(1)
+		log.WithField("session", s.ctx.Value("session")).
+			Debugf("Snapshot written: %s", file)
+	}
+}
+
+// write decodes frame into a JPEG file named after its timestamp. It's
+// written under a temporary name first so readers never see part of it.
+func (s *snapshotter) write(frame snapshotFrame) (string, error) {
+	img, err := s.decoder.Decode(frame.data)
+
+	if err != nil {
+		return "", err
+	}
+
+	file := filepath.Join(s.dir, fmt.Sprintf("%09d.jpg", frame.timestamp))
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, s.fileMode)
+
+	if err != nil {
+		return "", err
+	}
+
+	err = jpeg.Encode(f, img, &jpeg.Options{Quality: s.quality})
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+
+	return file, nil
+}
+
+// close waits for the snapshot in progress, if any
+func (s *snapshotter) close() {
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	close(s.frames)
+	<-s.done
+	s.decoder.Close()
+}
+
+func (s *snapshotter) stats() types.SnapshotStats {
+	return types.SnapshotStats{
+		Directory: s.dir,
+		Written:   s.written.Load(),
+		Failed:    s.failed.Load(),
+		Skipped:   s.skipped.Load(),
+	}
+}
@@ -0,0 +1,173 @@
+package recorder
+
+import (
+	"errors"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeVideoDecoder decodes every frame into a blank image
+type fakeVideoDecoder struct {
+	m      sync.Mutex
+	frames [][]byte
+	closed bool
+}
+
+func (d *fakeVideoDecoder) Decode(frame []byte) (image.Image, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.frames = append(d.frames, frame)
+
+	return image.NewYCbCr(image.Rect(0, 0, 32, 24), image.YCbCrSubsampleRatio420), nil
+}
+
+func (d *fakeVideoDecoder) Close() {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.closed = true
+}
+
+func withVideoDecoder(t *testing.T, decoder videoDecoder, err error) {
+	orig := newVideoDecoder
+	newVideoDecoder = func(codec string) (videoDecoder, error) {
+		return decoder, err
+	}
+	t.Cleanup(func() { newVideoDecoder = orig })
+}
+
+var snapshotConfig = config.Snapshots{Enable: true, Interval: time.Second, Quality: 80}
+
+func TestSnapshotWriter(t *testing.T) {
+	decoder := &fakeVideoDecoder{}
+	withVideoDecoder(t, decoder, nil)
+
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, false)
+	r.SetHasVideo(true)
+	require.NoError(t, r.EnableSnapshots(snapshotConfig, 0700))
+	requester := &countingKeyframeRequester{}
+	r.SetKeyframeRequester(requester)
+
+	video := &blockRecorder{}
+	writers := r.snapshotWriters([]webm.BlockWriteCloser{video})
+	require.Len(t, writers, 1)
+	stats := func() int64 { return r.snapshotter.stats().Written }
+
+	write := func(keyframe bool, timestamp int64) {
+		_, err := writers[0].Write(keyframe, timestamp, []byte{0xAA, byte(timestamp)})
+		require.NoError(t, err)
+	}
+
+	write(true, 0)
+	require.Eventually(t, func() bool { return stats() == 1 }, time.Second, time.Millisecond)
+
+	// Not due yet
+	write(false, 500)
+	write(true, 600)
+	write(false, 700)
+
+	// Due, but no keyframe within a second
+	write(false, 1500)
+	assert.Zero(t, requester.requests)
+	write(false, 2000)
+	assert.Equal(t, 1, requester.requests)
+	write(false, 2100)
+	assert.Equal(t, 1, requester.requests, "Asked once")
+
+	write(true, 2200)
+	require.Eventually(t, func() bool { return stats() == 2 }, time.Second, time.Millisecond)
+
+	// A keyframe a little early is taken
+	write(true, 3150)
+	require.Eventually(t, func() bool { return stats() == 3 }, time.Second, time.Millisecond)
+	assert.Len(t, video.blocks, 9, "Everything is written")
+
+	require.NoError(t, writers[0].Close())
+	r.snapshotter.close()
+	assert.True(t, decoder.closed)
+	assert.Equal(t, [][]byte{{0xAA, 0}, {0xAA, byte(2200 % 256)}, {0xAA, byte(3150 % 256)}}, decoder.frames)
+
+	dir := r.SnapshotDir()
+	assert.Equal(t, filepath.Join(filepath.Dir(r.file), "rec-snapshots"), dir)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, "000000000.jpg", entries[0].Name())
+	assert.Equal(t, "000002200.jpg", entries[1].Name())
+	assert.Equal(t, "000003150.jpg", entries[2].Name())
+
+	f, err := os.Open(filepath.Join(dir, entries[1].Name()))
+	require.NoError(t, err)
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 32, 24), img.Bounds())
+}
+
+func TestWebmRecorder_Snapshots(t *testing.T) {
+	withVideoDecoder(t, &fakeVideoDecoder{}, nil)
+
+	s := newAVSyncSource(t)
+	s.gop = 30
+	require.NoError(t, s.r.EnableSnapshots(snapshotConfig, 0700))
+
+	s.run(3500*time.Millisecond, true, true)
+	s.r.Close()
+
+	stats := s.r.GetStats().Snapshots
+	require.NotNil(t, stats)
+	assert.Equal(t, s.r.SnapshotDir(), stats.Directory)
+	assert.Equal(t, int64(4), stats.Written+stats.Skipped, "One a second")
+	assert.Positive(t, stats.Written)
+	assert.Zero(t, stats.Failed)
+
+	entries, err := os.ReadDir(stats.Directory)
+	require.NoError(t, err)
+	assert.Len(t, entries, int(stats.Written))
+}
+
+func TestWebmRecorder_SnapshotsUnavailable(t *testing.T) {
+	withVideoDecoder(t, nil, errors.New("no decoder"))
+
+	s := newAVSyncSource(t)
+	require.NoError(t, s.r.EnableSnapshots(snapshotConfig, 0700))
+
+	s.run(time.Second, true, true)
+	s.r.Close()
+
+	assert.Nil(t, s.r.GetStats().Snapshots)
+	assert.Empty(t, s.r.SnapshotDir(), "Disabled")
+	assert.Positive(t, s.r.GetStats().Video.TotalSamples, "Still recorded")
+}
+
+func TestEnableSnapshots_Invalid(t *testing.T) {
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, false)
+
+	assert.Error(t, r.EnableSnapshots(config.Snapshots{Enable: true, Quality: 80}, 0700))
+	assert.Error(t, r.EnableSnapshots(config.Snapshots{Enable: true, Interval: time.Second, Quality: 101}, 0700))
+	assert.Empty(t, r.SnapshotDir())
+}
+
+func TestValidateSnapshots(t *testing.T) {
+	assert.NoError(t, ValidateSnapshots(config.Snapshots{}))
+	assert.Error(t, ValidateSnapshots(config.Snapshots{Enable: true, Quality: 80}))
+
+	err := ValidateSnapshots(snapshotConfig)
+
+	if videoDecodingAvailable {
+		assert.NoError(t, err)
+	} else {
+		assert.Error(t, err, "This build can't decode video")
+	}
+}
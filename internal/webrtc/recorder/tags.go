@@ -0,0 +1,176 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"maps"
+	"slices"
+
+	"github.com/at-wat/ebml-go"
+)
+
+// Tags the server embeds in every recording (see AddTags)
+const (
+	TagSessionID = "SESSION_ID"
+	TagRoomID    = "ROOM_ID"
+	// TagTitle is also written as the MP4 title (©nam)
+	TagTitle = "TITLE"
+)
+
+// mp4FreeformMean is the namespace MP4 freeform (----) tags are written in
+const mp4FreeformMean = "com.apple.iTunes"
+
+type recordingTag struct {
+	name  string
+	value string
+}
+
+// AddTags adds tags to embed in the recording's container: the Matroska
+// Tags element of WebM/MKV files, the udta box of MP4 ones. A tag already
+// set is replaced. Must be called before any media is pushed.
+func (r *WebmRecorder) AddTags(tags map[string]string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if len(tags) == 0 {
+		return
+	}
+
+	if r.tags == nil {
+		r.tags = make(map[string]string, len(tags))
+	}
+
+	maps.Copy(r.tags, tags)
+}
+
+// sortedTags returns the tags by name, so files are written the same way
+// every time. Empty names can't be written and are left out.
+// Locked
+func (r *WebmRecorder) sortedTags() []recordingTag {
+	tags := make([]recordingTag, 0, len(r.tags))
+
+	for _, name := range slices.Sorted(maps.Keys(r.tags)) {
+		if name != "" {
+			tags = append(tags, recordingTag{name: name, value: r.tags[name]})
+		}
+	}
+
+	return tags
+}
+
+type matroskaSimpleTag struct {
+	TagName   string `ebml:"TagName"`
+	TagString string `ebml:"TagString"`
+}
+
+type matroskaTargets struct {
+	// 50 is the whole recording (an episode, a movie)
+	TargetTypeValue uint64 `ebml:"TargetTypeValue"`
+}
+
+type matroskaTag struct {
+	Targets   matroskaTargets     `ebml:"Targets"`
+	SimpleTag []matroskaSimpleTag `ebml:"SimpleTag"`
+}
+
+type matroskaTagsElement struct {
+	Tags struct {
+		Tag []matroskaTag `ebml:"Tag"`
+	} `ebml:"Tags"`
+}
+
+// matroskaTags returns the Tags element holding tags
+func matroskaTags(tags []recordingTag) ([]byte, error) {
+	tag := matroskaTag{Targets: matroskaTargets{TargetTypeValue: 50}}
+
+	for _, t := range tags {
+		tag.SimpleTag = append(tag.SimpleTag, matroskaSimpleTag{TagName: t.name, TagString: t.value})
+	}
+
+	var element matroskaTagsElement
+	element.Tags.Tag = []matroskaTag{tag}
+	var buf bytes.Buffer
+
+	if err := ebml.Marshal(&element, &buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// mp4UserData returns the udta box holding tags as iTunes-style metadata,
+// which players and ffprobe read: TagTitle as the title, all of them as
+// freeform items
+func mp4UserData(tags []recordingTag) []byte {
+	var items [][]byte
+
+	for _, t := range tags {
+		if t.name == TagTitle {
+			items = append(items, fmp4Box("\xa9nam", mp4TagData(t.value)))
+		}
+
+		items = append(items, fmp4Box("----",
+			fmp4FullBox("mean", 0, 0, []byte(mp4FreeformMean)),
+			fmp4FullBox("name", 0, 0, []byte(t.name)),
+			mp4TagData(t.value),
+		))
+	}
+
+	hdlr := make([]byte, 0, 21)
+	hdlr = binary.BigEndian.AppendUint32(hdlr, 0) // pre_defined
+	hdlr = append(hdlr, "mdir"...)
+	hdlr = append(hdlr, "appl"...)
+	hdlr = append(hdlr, make([]byte, 8)...)
+	hdlr = append(hdlr, 0) // name
+
+	return fmp4Box("udta", fmp4FullBox("meta", 0, 0, fmp4FullBox("hdlr", 0, 0, hdlr), fmp4Box("ilst", items...)))
+}
+
+// mp4TagData is the data box of a UTF-8 tag value
+func mp4TagData(value string) []byte {
+	data := binary.BigEndian.AppendUint32(nil, 1) // UTF-8
+	data = binary.BigEndian.AppendUint32(data, 0) // locale
+
+	return fmp4Box("data", data, []byte(value))
+}
+
+// headerWriter holds what's written to w until flush, so more can be added
+// after the container header without seeking back, e.g. when streaming
+type headerWriter struct {
+	w       io.WriteCloser
+	header  bytes.Buffer
+	flushed bool
+}
+
+func (h *headerWriter) Write(b []byte) (int, error) {
+	if h.flushed {
+		return h.w.Write(b)
+	}
+
+	return h.header.Write(b)
+}
+
+// flush writes the header held, followed by trailer, in a single write.
+// What's written afterwards goes straight to w.
+func (h *headerWriter) flush(trailer []byte) error {
+	if h.flushed {
+		return nil
+	}
+
+	h.flushed = true
+	h.header.Write(trailer)
+	_, err := h.w.Write(h.header.Bytes())
+	h.header = bytes.Buffer{}
+
+	return err
+}
+
+func (h *headerWriter) Close() error {
+	if err := h.flush(nil); err != nil {
+		_ = h.w.Close()
+		return err
+	}
+
+	return h.w.Close()
+}
@@ -0,0 +1,101 @@
+package recorder
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/at-wat/ebml-go"
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type taggedWebm struct {
+	Header  webm.EBMLHeader `ebml:"EBML"`
+	Segment struct {
+		Tracks webm.Tracks `ebml:"Tracks"`
+		Tags   struct {
+			Tag []matroskaTag `ebml:"Tag"`
+		} `ebml:"Tags"`
+		Cluster []webm.Cluster `ebml:"Cluster"`
+	} `ebml:"Segment"`
+}
+
+func TestWebmRecorder_Tags(t *testing.T) {
+	// Streamed: the Tags can't be written by seeking back
+	sink := &streamSink{}
+	r, err := NewRecorderWithWriter(context.Background(), config.Recorder{
+		AudioPacketQueueSize: 64,
+		Tags:                 map[string]string{"ENCODER_SITE": "dc1", TagTitle: "Configured"},
+	}, sink)
+	require.NoError(t, err)
+	r.SetHasAudio(true)
+	r.(*WebmRecorder).AddTags(map[string]string{TagTitle: "Class 1", "MEETING_ID": "m-1", "": "dropped"})
+
+	for i := 0; i < 10; i++ {
+		r.PushAudio(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * 960)},
+			Payload: []byte{0xFC, 0xAA, 0xBB},
+		})
+	}
+
+	r.Close()
+
+	data := sink.Bytes()
+	tagsAt := bytes.Index(data, []byte{0x12, 0x54, 0xC3, 0x67})
+	clusterAt := bytes.Index(data, []byte{0x1F, 0x43, 0xB6, 0x75})
+	require.Positive(t, tagsAt)
+	assert.Less(t, tagsAt, clusterAt, "Tags come before the media")
+
+	var file taggedWebm
+	require.NoError(t, ebml.Unmarshal(bytes.NewReader(data), &file))
+	require.Len(t, file.Segment.Tags.Tag, 1)
+	tag := file.Segment.Tags.Tag[0]
+	assert.Equal(t, uint64(50), tag.Targets.TargetTypeValue)
+	assert.Equal(t, []matroskaSimpleTag{
+		{TagName: "ENCODER_SITE", TagString: "dc1"},
+		{TagName: "MEETING_ID", TagString: "m-1"},
+		{TagName: TagTitle, TagString: "Class 1"},
+	}, tag.SimpleTag)
+	assert.Len(t, file.Segment.Tracks.TrackEntry, 1)
+	assert.NotEmpty(t, file.Segment.Cluster, "Media still readable")
+}
+
+func TestWebmRecorder_NoTags(t *testing.T) {
+	sink := &streamSink{}
+	r, err := NewRecorderWithWriter(context.Background(), config.Recorder{AudioPacketQueueSize: 64}, sink)
+	require.NoError(t, err)
+	r.SetHasAudio(true)
+	r.PushAudio(&rtp.Packet{Header: rtp.Header{Version: 2}, Payload: []byte{0xFC, 0xAA, 0xBB}})
+	r.Close()
+
+	assert.NotContains(t, sink.String(), "\x12\x54\xC3\x67")
+}
+
+func TestFMP4Writer_UserData(t *testing.T) {
+	sink := &streamSink{}
+	tags := []recordingTag{{name: "MEETING_ID", value: "m-1"}, {name: TagTitle, value: "Class 1"}}
+	_, err := newFMP4Writer(sink, []FMP4Track{{Codec: CodecOpus}}, time.Second, nil, mp4UserData(tags))
+	require.NoError(t, err)
+
+	init := sink.Bytes()
+	ftypSize := binary.BigEndian.Uint32(init)
+	moov := init[ftypSize:]
+	require.Equal(t, "moov", string(moov[4:8]))
+	assert.Equal(t, uint32(len(moov)), binary.BigEndian.Uint32(moov), "Sizes account for the udta")
+
+	udtaAt := bytes.Index(moov, []byte("udta"))
+	require.Positive(t, udtaAt)
+	udta := moov[udtaAt-4:]
+	assert.Equal(t, uint32(len(udta)), binary.BigEndian.Uint32(udta), "Last in the moov")
+	assert.Contains(t, string(udta), "mdir")
+	assert.Contains(t, string(udta), "\xa9nam")
+	assert.Contains(t, string(udta), mp4FreeformMean)
+	assert.Contains(t, string(udta), "MEETING_ID")
+	assert.Contains(t, string(udta), "Class 1")
+}
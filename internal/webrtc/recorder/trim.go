@@ -0,0 +1,206 @@
+package recorder
+
+import (
+	"time"
+
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+)
+
+// maxTrimHold bounds how much is held waiting for the next keyframe. Past
+// it, the held blocks are written and the recording's tail isn't trimmed
+// until the next keyframe.
+const maxTrimHold = 10 * time.Second
+
+// EnableTrim trims recordings with video to keyframe boundaries: Leading
+// starts the file at the first keyframe, dropping the audio received
+// before it, Trailing drops what was written after the last keyframe. Must
+// be called before any media is pushed.
+func (r *WebmRecorder) EnableTrim(cfg config.Trim) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.trimLeading = cfg.Leading
+	r.trimTrailing = cfg.Trailing
+}
+
+// trimStats returns the recording's trim stats, creating them
+// Locked
+func (r *WebmRecorder) trimStats() *types.TrimStats {
+	if r.stats.Trim == nil {
+		r.stats.Trim = &types.TrimStats{}
+	}
+
+	return r.stats.Trim
+}
+
+// noteFirstMedia records when the first packet of any track arrived
+// Locked
+func (r *WebmRecorder) noteFirstMedia() {
+	if r.firstMediaAt.IsZero() {
+		r.firstMediaAt = r.now()
+	}
+}
+
+// trimPendingAudio drops the audio received before the first keyframe
+// opened the file, with leading trim on
+// Locked
+func (r *WebmRecorder) trimPendingAudio() {
+	if !r.trimLeading || !r.hasVideo {
+		return
+	}
+
+	stats := r.trimStats()
+	stats.LeadingMs = max(r.now().Sub(r.firstMediaAt), 0).Milliseconds()
+	stats.DroppedAudioFrames += len(r.pendingAudio)
+
+	if len(r.pendingAudio) > 0 {
+		r.logger.Debugf("Trimming %v of audio received before the first keyframe", r.pendingAudioDuration)
+	}
+
+	r.pendingAudio = nil
+	r.pendingAudioDuration = 0
+}
+
+// trimWriters holds the blocks of a file's tracks from the latest video
+// keyframe on, so they can be dropped if the recording ends before the
+// next one
+// Locked
+func (r *WebmRecorder) trimWriters(writers []webm.BlockWriteCloser) []webm.BlockWriteCloser {
+	if !r.trimTrailing || !r.hasVideo {
+		return writers
+	}
+
+	r.trimmer = &blockTrimmer{r: r}
+	trimmed := make([]webm.BlockWriteCloser, len(writers))
+
+	for i, w := range writers {
+		// Video comes first, then audio and loss markers
+		kind := ""
+
+		if i == 0 {
+			kind = "video"
+		} else if i == 1 && r.hasAudio {
+			kind = "audio"
+		}
+
+		trimmed[i] = &trimWriter{t: r.trimmer, w: w, kind: kind}
+	}
+
+	return trimmed
+}
+
+type heldBlock struct {
+	w         webm.BlockWriteCloser
+	kind      string
+	keyframe  bool
+	timestamp int64
+	data      []byte
+}
+
+// blockTrimmer holds the blocks written to the tracks of a file since the
+// latest video keyframe, in the order they were written. The next keyframe
+// releases them; closing the file drops them.
+type blockTrimmer struct {
+	r       *WebmRecorder
+	held    []heldBlock
+	holding bool
+	from    int64 // Timestamp of the held keyframe (ms)
+	closed  bool
+}
+
+func (t *blockTrimmer) write(w webm.BlockWriteCloser, kind string, keyframe bool, timestamp int64, b []byte) (int, error) {
+	if t.closed {
+		return w.Write(keyframe, timestamp, b)
+	}
+
+	if kind == "video" && keyframe {
+		t.release()
+		t.holding = true
+		t.from = timestamp
+	} else if t.holding && time.Duration(timestamp-t.from)*time.Millisecond > maxTrimHold {
+		t.release()
+	}
+
+	if !t.holding {
+		return w.Write(keyframe, timestamp, b)
+	}
+
+	// Samples may share buffers that are reused once written
+	t.held = append(t.held, heldBlock{
+		w:         w,
+		kind:      kind,
+		keyframe:  keyframe,
+		timestamp: timestamp,
+		data:      append([]byte(nil), b...),
+	})
+
+	return len(b), nil
+}
+
+// release writes the held blocks and stops holding until the next keyframe
+func (t *blockTrimmer) release() {
+	for _, block := range t.held {
+		if _, err := block.w.Write(block.keyframe, block.timestamp, block.data); err != nil {
+			t.r.logger.WithField("timestamp", block.timestamp).
+				Errorf("Error writing held block: %v", err)
+		}
+	}
+
+	clear(t.held)
+	t.held = t.held[:0]
+	t.holding = false
+}
+
+// trim drops the held blocks, the recording ending before the next keyframe
+func (t *blockTrimmer) trim() {
+	if t.closed {
+		return
+	}
+
+	t.closed = true
+
+	if len(t.held) == 0 {
+		return
+	}
+
+	stats := t.r.trimStats()
+	last := t.from
+
+	for _, block := range t.held {
+		last = max(last, block.timestamp)
+
+		switch block.kind {
+		case "video":
+			stats.DroppedVideoFrames++
+		case "audio":
+			stats.DroppedAudioFrames++
+		}
+	}
+
+	stats.TrailingMs = last - t.from
+	t.held = nil
+	// The file now ends at the keyframe
+	t.r.videoTimestamp = time.Duration(t.from) * time.Millisecond
+
+	t.r.logger.Debugf("Trimmed %dms written after the last keyframe", stats.TrailingMs)
+}
+
+// trimWriter is a track writer of a file whose tail is trimmed
+type trimWriter struct {
+	t    *blockTrimmer
+	w    webm.BlockWriteCloser
+	kind string // "video", "audio" or empty for loss markers
+}
+
+func (w *trimWriter) Write(keyframe bool, timestamp int64, b []byte) (int, error) {
+	return w.t.write(w.w, w.kind, keyframe, timestamp, b)
+}
+
+// Close trims the file's tail the first time one of its tracks is closed
+func (w *trimWriter) Close() error {
+	w.t.trim()
+
+	return w.w.Close()
+}
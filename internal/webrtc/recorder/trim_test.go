@@ -0,0 +1,133 @@
+package recorder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type writtenBlock struct {
+	keyframe  bool
+	timestamp int64
+}
+
+// blockRecorder is a track writer remembering what was written to it
+type blockRecorder struct {
+	blocks []writtenBlock
+	closed bool
+}
+
+func (w *blockRecorder) Write(keyframe bool, timestamp int64, b []byte) (int, error) {
+	w.blocks = append(w.blocks, writtenBlock{keyframe: keyframe, timestamp: timestamp})
+	return len(b), nil
+}
+
+func (w *blockRecorder) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestWebmRecorder_TrimLeading(t *testing.T) {
+	s := newAVSyncSource(t)
+	s.r.EnableTrim(config.Trim{Leading: true})
+
+	s.run(3*time.Second, true, false)
+	s.run(time.Second, true, true)
+	s.r.Close()
+
+	stats := s.r.GetStats()
+	require.NotNil(t, stats.Trim)
+	assert.InDelta(t, 3000, stats.Trim.LeadingMs, 50)
+	assert.InDelta(t, 150, stats.Trim.DroppedAudioFrames, 2)
+	assert.Zero(t, stats.Trim.TrailingMs)
+	assert.Less(t, stats.Audio.WrittenSamples, 60, "Audio from before the keyframe is dropped")
+
+	assert.InDelta(t, time.Second, s.r.AudioTimestamp(), float64(100*time.Millisecond))
+	assert.InDelta(t, s.r.AudioTimestamp(), s.r.VideoTimestamp(), float64(100*time.Millisecond))
+}
+
+func TestWebmRecorder_TrimTrailing(t *testing.T) {
+	s := newAVSyncSource(t)
+	s.gop = 30
+	s.r.EnableTrim(config.Trim{Trailing: true})
+
+	s.run(2500*time.Millisecond, true, true)
+	s.r.Close()
+
+	stats := s.r.GetStats()
+	require.NotNil(t, stats.Trim)
+	assert.Zero(t, stats.Trim.LeadingMs)
+	assert.InDelta(t, 466, stats.Trim.TrailingMs, 40)
+	assert.Equal(t, 15, stats.Trim.DroppedVideoFrames, "The last keyframe and what followed")
+	assert.InDelta(t, 25, stats.Trim.DroppedAudioFrames, 2)
+	assert.InDelta(t, 2*time.Second, s.r.VideoTimestamp(), float64(50*time.Millisecond), "Ends at the last keyframe")
+}
+
+func TestWebmRecorder_NoTrim(t *testing.T) {
+	s := newAVSyncSource(t)
+	s.gop = 30
+
+	s.run(time.Second, true, false)
+	s.run(1500*time.Millisecond, true, true)
+	s.r.Close()
+
+	assert.Nil(t, s.r.GetStats().Trim)
+	assert.InDelta(t, 2500*time.Millisecond, s.r.VideoTimestamp(), float64(100*time.Millisecond))
+}
+
+func TestBlockTrimmer(t *testing.T) {
+	r := NewWebmRecorder("", 0, 256, 64, false, false, false)
+	r.SetHasVideo(true)
+	r.SetHasAudio(true)
+	r.EnableTrim(config.Trim{Trailing: true})
+
+	video, audio := &blockRecorder{}, &blockRecorder{}
+	writers := r.trimWriters([]webm.BlockWriteCloser{video, audio})
+	require.Len(t, writers, 2)
+
+	write := func(track int, keyframe bool, timestamp int64) {
+		n, err := writers[track].Write(keyframe, timestamp, []byte{0xAA})
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+	}
+
+	// Nothing before the first keyframe is held
+	write(1, true, 0)
+	assert.Len(t, audio.blocks, 1)
+
+	write(0, true, 10)
+	write(1, true, 20)
+	write(0, false, 40)
+	assert.Empty(t, video.blocks, "Held until the next keyframe")
+	assert.Len(t, audio.blocks, 1)
+
+	write(0, true, 60)
+	assert.Equal(t, []writtenBlock{{true, 10}, {false, 40}}, video.blocks)
+	assert.Len(t, audio.blocks, 2)
+
+	// Held for at most maxTrimHold
+	write(0, false, 60+maxTrimHold.Milliseconds()+1)
+	assert.Len(t, video.blocks, 4)
+
+	write(0, true, 20000)
+	write(1, true, 20010)
+	write(0, false, 20040)
+
+	require.NoError(t, writers[1].Close())
+	require.NoError(t, writers[0].Close())
+	assert.True(t, video.closed)
+	assert.True(t, audio.closed)
+	assert.Len(t, video.blocks, 4)
+	assert.Len(t, audio.blocks, 2)
+
+	stats := r.GetStats().Trim
+	require.NotNil(t, stats)
+	assert.Equal(t, int64(40), stats.TrailingMs)
+	assert.Equal(t, 2, stats.DroppedVideoFrames)
+	assert.Equal(t, 1, stats.DroppedAudioFrames)
+	assert.Equal(t, 20*time.Second, r.VideoTimestamp())
+}
@@ -0,0 +1,209 @@
+package recorder
+
+import (
+	"math"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	"github.com/pion/rtp"
+)
+
+const (
+	// Audio levels are in -dBov (RFC 6464): 0 is the loudest, 127 silence.
+	// Anything louder than vadSpeechLevel counts as speech.
+	vadSpeechLevel = 50
+	vadSilentLevel = 127
+	// vadHangover is how long audio must stay quiet to end a speech
+	// interval, so pauses between words don't split it
+	vadHangover = 500 * time.Millisecond
+	// Opus DTX sends tiny packets when the input is silent
+	opusDTXMaxSize = 2
+	// Bounds levels held for packets the samplebuilder never outputs
+	maxPendingVADLevels = 1024
+	// Payload levels are measured on narrowband audio, which is cheaper to
+	// decode and plenty for telling silence apart
+	vadSampleRate = 8000
+)
+
+// vadTracker turns per-sample speech decisions into alternating
+// speaking/silent intervals on the recording's audio timeline
+type vadTracker struct {
+	started       bool
+	speaking      bool
+	intervalStart time.Duration
+	lastSpeech    time.Duration
+	intervals     []types.VoiceActivityInterval
+}
+
+func (v *vadTracker) update(at time.Duration, speech bool) {
+	if !v.started {
+		v.started = true
+		v.speaking = speech
+		v.intervalStart = at
+		v.lastSpeech = at
+
+		return
+	}
+
+	switch {
+	case speech && !v.speaking:
+		v.closeInterval(at)
+		v.speaking = true
+	case !speech && v.speaking && at-v.lastSpeech >= vadHangover:
+		v.closeInterval(v.lastSpeech)
+		v.speaking = false
+	}
+
+	if speech {
+		v.lastSpeech = at
+	}
+}
+
+func (v *vadTracker) closeInterval(end time.Duration) {
+	if end > v.intervalStart {
+		v.intervals = append(v.intervals, types.VoiceActivityInterval{
+			StartMs:  v.intervalStart.Milliseconds(),
+			EndMs:    end.Milliseconds(),
+			Speaking: v.speaking,
+		})
+	}
+
+	v.intervalStart = end
+}
+
+// snapshot returns the intervals so far, the open one ending at end
+func (v *vadTracker) snapshot(end time.Duration) []types.VoiceActivityInterval {
+	if !v.started {
+		return nil
+	}
+
+	intervals := make([]types.VoiceActivityInterval, len(v.intervals), len(v.intervals)+1)
+	copy(intervals, v.intervals)
+
+	if end > v.intervalStart {
+		intervals = append(intervals, types.VoiceActivityInterval{
+			StartMs:  v.intervalStart.Milliseconds(),
+			EndMs:    end.Milliseconds(),
+			Speaking: v.speaking,
+		})
+	}
+
+	return intervals
+}
+
+// SetAudioLevelExtensionID sets the negotiated ID of the RFC 6464 audio
+// level header extension. Without it, speech is detected from the Opus
+// payload instead.
+func (r *WebmRecorder) SetAudioLevelExtensionID(id uint8) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.audioLevelExtID = id
+}
+
+// Locked
+func (r *WebmRecorder) headerAudioLevel(p *rtp.Packet) (uint8, bool) {
+	if r.audioLevelExtID == 0 {
+		return 0, false
+	}
+
+	ext := p.GetExtension(r.audioLevelExtID)
+
+	if ext == nil {
+		return 0, false
+	}
+
+	var level rtp.AudioLevelExtension
+
+	if err := level.Unmarshal(ext); err != nil {
+		return 0, false
+	}
+
+	return level.Level, true
+}
+
+// payloadAudioLevel estimates the level of an Opus payload by decoding it.
+// If this build can't decode Opus, DTX packets are the only silence we can
+// tell apart.
+// Locked
+func (r *WebmRecorder) payloadAudioLevel(payload []byte) uint8 {
+	if len(payload) <= opusDTXMaxSize {
+		return vadSilentLevel
+	}
+
+	if r.vadDecoder == nil && !r.vadDecoderFailed {
+		dec, err := newOpusDecoder(vadSampleRate, 1)
+
+		if err != nil {
+			r.logger.Debugf("No audio level header extension and can't decode Opus, only DTX counts as silence: %v", err)
+			r.vadDecoderFailed = true
+		} else {
+			r.vadDecoder = dec
+			r.vadPCM = make([]int16, int(opusMaxPacketDuration.Seconds()*vadSampleRate))
+		}
+	}
+
+	if r.vadDecoder == nil {
+		return 0
+	}
+
+	frames, err := r.vadDecoder.Decode(payload, r.vadPCM)
+
+	if err != nil {
+		return vadSilentLevel
+	}
+
+	return pcmAudioLevel(r.vadPCM[:frames])
+}
+
+// pcmAudioLevel returns the RMS level of pcm in -dBov
+func pcmAudioLevel(pcm []int16) uint8 {
+	if len(pcm) == 0 {
+		return vadSilentLevel
+	}
+
+	var sum float64
+
+	for _, sample := range pcm {
+		sum += float64(sample) * float64(sample)
+	}
+
+	rms := math.Sqrt(sum/float64(len(pcm))) / math.MaxInt16
+
+	if rms <= 0 {
+		return vadSilentLevel
+	}
+
+	return uint8(min(max(math.Round(-20*math.Log10(rms)), 0), vadSilentLevel))
+}
+
+// measureVoiceActivity classifies an incoming packet. The decision is used
+// once the packet's sample is written, so it lands on the file's timeline.
+// Locked
+func (r *WebmRecorder) measureVoiceActivity(p *rtp.Packet) {
+	level, ok := r.headerAudioLevel(p)
+
+	if !ok {
+		level = r.payloadAudioLevel(p.Payload)
+	}
+
+	if len(r.vadLevels) >= maxPendingVADLevels {
+		clear(r.vadLevels)
+	}
+
+	r.vadLevels[p.Timestamp] = level
+}
+
+// recordVoiceActivity adds a written sample, starting at start on the audio
+// timeline, to the voice activity intervals
+// Locked
+func (r *WebmRecorder) recordVoiceActivity(rtpTimestamp uint32, start time.Duration) {
+	level, ok := r.vadLevels[rtpTimestamp]
+
+	if !ok {
+		return
+	}
+
+	delete(r.vadLevels, rtpTimestamp)
+	r.vad.update(start, level < vadSpeechLevel)
+}
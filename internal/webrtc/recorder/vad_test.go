@@ -0,0 +1,115 @@
+package recorder
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVADTracker(t *testing.T) {
+	v := &vadTracker{}
+	assert.Nil(t, v.snapshot(time.Second))
+
+	at := time.Duration(0)
+	feed := func(d time.Duration, speech bool) {
+		for end := at + d; at < end; at += 20 * time.Millisecond {
+			v.update(at, speech)
+		}
+	}
+
+	feed(time.Second, true)
+	// Shorter than the hangover: same interval
+	feed(300*time.Millisecond, false)
+	feed(time.Second, true)
+	feed(2*time.Second, false)
+
+	assert.Equal(t, []types.VoiceActivityInterval{
+		{StartMs: 0, EndMs: 2280, Speaking: true},
+		{StartMs: 2280, EndMs: 4300, Speaking: false},
+	}, v.snapshot(at))
+}
+
+func TestPCMAudioLevel(t *testing.T) {
+	assert.Equal(t, uint8(vadSilentLevel), pcmAudioLevel(nil))
+	assert.Equal(t, uint8(vadSilentLevel), pcmAudioLevel(make([]int16, 160)))
+	assert.Equal(t, uint8(0), pcmAudioLevel([]int16{32767, -32767}))
+	assert.Equal(t, uint8(30), pcmAudioLevel([]int16{1000, -1000}))
+}
+
+func pushOpusWithLevel(r *WebmRecorder, seq uint16, level uint8, extID uint8, payload []byte) {
+	p := &rtp.Packet{
+		Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 960},
+		Payload: payload,
+	}
+
+	if extID != 0 {
+		ext, _ := rtp.AudioLevelExtension{Level: level}.Marshal()
+		_ = p.Header.SetExtension(extID, ext)
+	}
+
+	r.PushAudio(p)
+}
+
+func TestWebmRecorder_VoiceActivityFromHeader(t *testing.T) {
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, false)
+	r.SetHasAudio(true)
+	r.SetAudioLevelExtensionID(3)
+
+	seq := uint16(0)
+
+	for ; seq < 50; seq++ {
+		pushOpusWithLevel(r, seq, 30, 3, []byte{0xFC, 0xAA, 0xBB})
+	}
+
+	for ; seq < 150; seq++ {
+		pushOpusWithLevel(r, seq, 100, 3, []byte{0xFC, 0xAA, 0xBB})
+	}
+
+	for ; seq < 200; seq++ {
+		pushOpusWithLevel(r, seq, 30, 3, []byte{0xFC, 0xAA, 0xBB})
+	}
+
+	stats := r.GetStats()
+	r.Close()
+
+	require.NotNil(t, stats.Audio)
+	activity := stats.Audio.VoiceActivity
+	require.Len(t, activity, 3)
+	assert.Equal(t, []bool{true, false, true}, []bool{activity[0].Speaking, activity[1].Speaking, activity[2].Speaking})
+	assert.InDelta(t, 1000, activity[0].EndMs, 40)
+	assert.InDelta(t, 3000, activity[1].EndMs, 40)
+	assert.Equal(t, activity[0].EndMs, activity[1].StartMs)
+}
+
+func TestWebmRecorder_VoiceActivityFromPayload(t *testing.T) {
+	useFakeOpusDecoder(t)
+
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, false)
+	r.SetHasAudio(true)
+
+	seq := uint16(0)
+
+	// No extension: the fake decoder's output is loud, DTX packets silent
+	for ; seq < 50; seq++ {
+		pushOpusWithLevel(r, seq, 0, 0, []byte{0xFC, 0xAA, 0xBB})
+	}
+
+	for ; seq < 100; seq++ {
+		pushOpusWithLevel(r, seq, 0, 0, []byte{0xF8})
+	}
+
+	stats := r.GetStats()
+	r.Close()
+
+	require.NotNil(t, stats.Audio)
+	activity := stats.Audio.VoiceActivity
+	require.Len(t, activity, 2)
+	assert.True(t, activity[0].Speaking)
+	assert.False(t, activity[1].Speaking)
+	assert.Nil(t, r.vadDecoder, "Decoder is released on close")
+}
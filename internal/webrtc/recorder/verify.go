@@ -0,0 +1,217 @@
+package recorder
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/at-wat/ebml-go"
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+)
+
+// Matroska track types, as in TrackEntry.TrackType
+const (
+	trackTypeVideo = 1
+	trackTypeAudio = 2
+)
+
+// VerifiableConfig returns cfg with what VerifyWebM can't check left out:
+// recordings go to a single plaintext WebM/MKV file (no fMP4, segments,
+// encryption or /dev/null), with none of the files written alongside it
+// (IVF copy, stats, sidecar, snapshots, proxy, raw output)
+func VerifiableConfig(cfg config.Recorder) config.Recorder {
+	cfg.WriteToDevNull = false
+	cfg.WriteIVFCopy = false
+	cfg.WriteStatsFile = false
+	cfg.WriteSidecarFile = false
+	cfg.MKV.AttachSidecar = false
+	cfg.FMP4.Enable = false
+	cfg.Segments.Enable = false
+	cfg.Encryption.Enable = false
+	cfg.Snapshots.Enable = false
+	cfg.Proxy.Enable = false
+	cfg.RawOutput.Enable = false
+
+	return cfg
+}
+
+// Verification describes a recording checked by VerifyWebM
+type Verification struct {
+	DocType string `json:"docType"`
+	// As declared in the file if it is (recordings are streamed, so it
+	// isn't unless recovered), otherwise as spanned by its blocks
+	Duration time.Duration       `json:"duration"`
+	Clusters int                 `json:"clusters"`
+	Tracks   []VerificationTrack `json:"tracks"`
+}
+
+// VerificationTrack is a track of a verified recording
+type VerificationTrack struct {
+	Number    uint64 `json:"number"`
+	Kind      string `json:"kind"`
+	CodecID   string `json:"codecId"`
+	Width     uint64 `json:"width,omitempty"`
+	Height    uint64 `json:"height,omitempty"`
+	Blocks    int    `json:"blocks"`
+	Keyframes int    `json:"keyframes"`
+	// Timestamps of the first and last blocks
+	First time.Duration `json:"first"`
+	Last  time.Duration `json:"last"`
+}
+
+// Track returns the track of kind, nil if none
+func (v *Verification) Track(kind string) *VerificationTrack {
+	for i := range v.Tracks {
+		if v.Tracks[i].Kind == kind {
+			return &v.Tracks[i]
+		}
+	}
+
+	return nil
+}
+
+// VerifyWebM checks that a WebM/MKV recording, in plaintext and closed,
+// is one players can read: tracks with a codec, blocks for each media
+// track, video starting on a keyframe and timestamps that don't
+// go backward within a track. The whole file is read into memory.
+func VerifyWebM(path string) (*Verification, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var file struct {
+		Header  webm.EBMLHeader `ebml:"EBML"`
+		Segment webm.Segment    `ebml:"Segment"`
+	}
+
+	if err := ebml.Unmarshal(bufio.NewReader(f), &file); err != nil {
+		return nil, fmt.Errorf("invalid WebM/MKV file: %w", err)
+	}
+
+	if file.Header.DocType != "webm" && file.Header.DocType != "matroska" {
+		return nil, fmt.Errorf("unexpected doc type %q", file.Header.DocType)
+	}
+
+	segment := file.Segment
+	scale := time.Duration(segment.Info.TimecodeScale)
+
+	if scale == 0 {
+		return nil, errors.New("no timecode scale")
+	}
+
+	v := &Verification{
+		DocType:  file.Header.DocType,
+		Duration: time.Duration(segment.Info.Duration * float64(scale)),
+		Clusters: len(segment.Cluster),
+	}
+
+	if len(segment.Tracks.TrackEntry) == 0 {
+		return nil, errors.New("no tracks")
+	}
+
+	tracks := make(map[uint64]*VerificationTrack, len(segment.Tracks.TrackEntry))
+	v.Tracks = make([]VerificationTrack, len(segment.Tracks.TrackEntry))
+
+	for i, entry := range segment.Tracks.TrackEntry {
+		t := &v.Tracks[i]
+		t.Number = entry.TrackNumber
+		t.CodecID = entry.CodecID
+
+		switch entry.TrackType {
+		case trackTypeVideo:
+			t.Kind = "video"
+
+			if entry.Video != nil {
+				t.Width, t.Height = entry.Video.PixelWidth, entry.Video.PixelHeight
+			}
+		case trackTypeAudio:
+			t.Kind = "audio"
+		case lossMarkerTrackType:
+			t.Kind = "metadata"
+		default:
+			return nil, fmt.Errorf("track %d: unexpected type %d", entry.TrackNumber, entry.TrackType)
+		}
+
+		if t.CodecID == "" {
+			return nil, fmt.Errorf("track %d: no codec", t.Number)
+		}
+
+		if _, ok := tracks[t.Number]; ok {
+			return nil, fmt.Errorf("track %d: duplicate track number", t.Number)
+		}
+
+		tracks[t.Number] = t
+	}
+
+	addBlock := func(cluster uint64, block ebml.Block, keyframe bool) error {
+		t, ok := tracks[block.TrackNumber]
+
+		if !ok {
+			return fmt.Errorf("block of unknown track %d", block.TrackNumber)
+		}
+
+		at := time.Duration(int64(cluster)+int64(block.Timecode)) * scale
+
+		if t.Blocks == 0 {
+			if t.Kind == "video" && !keyframe {
+				return fmt.Errorf("track %d: video doesn't start on a keyframe", t.Number)
+			}
+
+			t.First = at
+		} else if at < t.Last {
+			return fmt.Errorf("track %d: timestamp went backward from %s to %s", t.Number, t.Last, at)
+		}
+
+		t.Blocks++
+		t.Last = at
+
+		if keyframe {
+			t.Keyframes++
+		}
+
+		return nil
+	}
+
+	for _, cluster := range segment.Cluster {
+		for _, block := range cluster.SimpleBlock {
+			if err := addBlock(cluster.Timecode, block, block.Keyframe); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, group := range cluster.BlockGroup {
+			// Blocks referencing none are keyframes
+			if err := addBlock(cluster.Timecode, group.Block, group.ReferenceBlock == 0); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var first, last time.Duration
+
+	for i, t := range v.Tracks {
+		// Loss markers are sparse, none if nothing was lost
+		if t.Blocks == 0 && t.Kind != "metadata" {
+			return nil, fmt.Errorf("track %d: no blocks", t.Number)
+		}
+
+		if i == 0 || t.First < first {
+			first = t.First
+		}
+
+		last = max(last, t.Last)
+	}
+
+	if v.Duration <= 0 {
+		v.Duration = last - first
+	}
+
+	return v, nil
+}
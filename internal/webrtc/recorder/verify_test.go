@@ -0,0 +1,57 @@
+package recorder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyWebM(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.SetDefaults()
+	recCfg := VerifiableConfig(cfg.Recorder)
+	recCfg.Directory = t.TempDir()
+
+	r, err := NewRecorder(context.Background(), recCfg, "audio.webm")
+	require.NoError(t, err)
+	r.SetHasAudio(true)
+
+	for i := 0; i < 50; i++ {
+		r.PushAudio(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * 960)},
+			Payload: opusSilence(false),
+		})
+	}
+
+	r.Close()
+
+	v, err := VerifyWebM(r.GetFilePath())
+	require.NoError(t, err)
+	assert.Equal(t, "webm", v.DocType)
+	require.Len(t, v.Tracks, 1)
+	assert.Nil(t, v.Track("video"))
+
+	audio := v.Track("audio")
+	require.NotNil(t, audio)
+	assert.Equal(t, "A_OPUS", audio.CodecID)
+	assert.Positive(t, audio.Blocks)
+	assert.InDelta(t, 980, v.Duration.Milliseconds(), 40, "Spanned by the blocks")
+}
+
+func TestVerifyWebM_Invalid(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := VerifyWebM(filepath.Join(dir, "missing.webm"))
+	assert.Error(t, err)
+
+	garbage := filepath.Join(dir, "garbage.webm")
+	require.NoError(t, os.WriteFile(garbage, []byte("not a recording"), 0600))
+	_, err = VerifyWebM(garbage)
+	assert.Error(t, err)
+}
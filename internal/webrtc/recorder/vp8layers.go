@@ -0,0 +1,193 @@
+package recorder
+
+import (
+	"github.com/pion/rtp"
+)
+
+// VP8 temporal scalability (RFC 7741) sends a frame's layer as the TID of
+// its payload descriptor, every packet of the frame carrying it. Frames of
+// a layer only reference those of the same or lower layers, so the layers
+// above the one chosen can be left out and what's left still decodes: the
+// filter drops their frames whole, as they come in. The packets kept are
+// renumbered, and their PictureIDs too, to leave no gaps where frames were
+// dropped, as an SFU forwarding fewer layers would: the rest of the VP8
+// path still tells real losses from those.
+
+// TIDs are 2 bits in the payload descriptor
+const vp8MaxTemporalLayers = 4
+
+// vp8Descriptor is what the filter needs of a VP8 payload descriptor
+type vp8Descriptor struct {
+	hasTID bool
+	tid    uint8
+	// Offset of the PictureID in the payload, -1 if absent
+	pictureIDOffset int
+	pictureIDLong   bool // 15 bits, 7 otherwise
+}
+
+func parseVP8Descriptor(payload []byte) (vp8Descriptor, bool) {
+	d := vp8Descriptor{pictureIDOffset: -1}
+	invalid := d
+
+	if len(payload) < 1 {
+		return invalid, false
+	}
+
+	// No extension: no PictureID nor TID
+	if payload[0]&0x80 == 0 {
+		return d, true
+	}
+
+	if len(payload) < 2 {
+		return invalid, false
+	}
+
+	ext := payload[1]
+	idx := 2
+
+	if ext&0x80 != 0 {
+		if len(payload) <= idx {
+			return invalid, false
+		}
+
+		d.pictureIDOffset = idx
+		d.pictureIDLong = payload[idx]&0x80 != 0
+		idx++
+
+		if d.pictureIDLong {
+			if len(payload) <= idx {
+				return invalid, false
+			}
+
+			idx++
+		}
+	}
+
+	// TL0PICIDX
+	if ext&0x40 != 0 {
+		idx++
+	}
+
+	if ext&0x20 != 0 {
+		if len(payload) <= idx {
+			return invalid, false
+		}
+
+		d.hasTID = true
+		d.tid = payload[idx] >> 6
+	}
+
+	return d, true
+}
+
+// vp8TemporalFilter keeps the frames of the temporal layers up to maxTID
+type vp8TemporalFilter struct {
+	maxTID uint8
+
+	started bool
+	// The latest frame, and whether it's dropped
+	frameTs   uint32
+	dropFrame bool
+	// Packets and frames with a PictureID dropped so far, subtracted from
+	// those kept
+	seqOffset       uint16
+	pictureIDOffset uint16
+
+	droppedFrames int
+}
+
+// filter returns packet as it's written, nil if it's dropped
+func (f *vp8TemporalFilter) filter(packet *rtp.Packet) *rtp.Packet {
+	d, ok := parseVP8Descriptor(packet.Payload)
+
+	// Left to the VP8 path to reject
+	if !ok {
+		return f.rewrite(packet, d)
+	}
+
+	drop := d.hasTID && d.tid > f.maxTID
+
+	// Packets of an older frame are judged on their own TID, which is that of
+	// the whole frame, but don't count as a new frame
+	if !f.started || int32(packet.Timestamp-f.frameTs) > 0 {
+		f.started = true
+		f.frameTs = packet.Timestamp
+		f.dropFrame = drop
+
+		if drop {
+			f.droppedFrames++
+
+			if d.pictureIDOffset >= 0 {
+				f.pictureIDOffset++
+			}
+		}
+	} else if packet.Timestamp == f.frameTs {
+		// Never half a frame, whatever its packets say
+		drop = f.dropFrame
+	}
+
+	if drop {
+		f.seqOffset++
+		return nil
+	}
+
+	return f.rewrite(packet, d)
+}
+
+func (f *vp8TemporalFilter) rewrite(packet *rtp.Packet, d vp8Descriptor) *rtp.Packet {
+	if f.seqOffset == 0 && f.pictureIDOffset == 0 {
+		return packet
+	}
+
+	// The packet may still be used by the caller
+	packet = packet.Clone()
+	packet.SequenceNumber -= f.seqOffset
+
+	if i := d.pictureIDOffset; i >= 0 && f.pictureIDOffset > 0 {
+		if d.pictureIDLong {
+			pictureID := (uint16(packet.Payload[i]&0x7F)<<8 | uint16(packet.Payload[i+1])) - f.pictureIDOffset
+			packet.Payload[i] = 0x80 | byte(pictureID>>8)&0x7F
+			packet.Payload[i+1] = byte(pictureID)
+		} else {
+			packet.Payload[i] = (packet.Payload[i] - byte(f.pictureIDOffset)) & 0x7F
+		}
+	}
+
+	return packet
+}
+
+// EnableVP8TemporalLayers records VP8 video up to that many temporal layers,
+// 1 being the base layer alone, dropping frames of the layers above. 0 (or
+// more layers than VP8 has) records them all. It must be called before any
+// media is pushed.
+func (r *WebmRecorder) EnableVP8TemporalLayers(layers int) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if layers <= 0 || layers >= vp8MaxTemporalLayers {
+		r.vp8Layers = nil
+		return
+	}
+
+	r.vp8Layers = &vp8TemporalFilter{maxTID: uint8(layers - 1)}
+}
+
+// filterVP8TemporalLayer returns p as it's written, nil if its temporal
+// layer isn't recorded
+func (r *WebmRecorder) filterVP8TemporalLayer(p *rtp.Packet) *rtp.Packet {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.vp8Layers == nil || r.videoCodec != CodecVP8 {
+		return p
+	}
+
+	filtered := r.vp8Layers.filter(p)
+
+	if filtered == nil {
+		r.logger.Tracef("Dropping VP8 packet above temporal layer %d: seq=%d, ts=%d",
+			r.vp8Layers.maxTID, p.SequenceNumber, p.Timestamp)
+	}
+
+	return filtered
+}
@@ -0,0 +1,103 @@
+package recorder
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// vp8LayerPacket is a single packet VP8 frame with a 15-bit PictureID and a
+// TID, a keyframe if tid is 0 and keyframe is set
+func vp8LayerPacket(seq uint16, ts uint32, pictureID uint16, tid uint8, keyframe bool) *rtp.Packet {
+	payload := []byte{0x90, 0xA0, 0x80 | byte(pictureID>>8), byte(pictureID), tid << 6}
+
+	if keyframe {
+		payload = append(payload, 0x00, 0x00, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01)
+	} else {
+		payload = append(payload, 0x01, 0x00, 0x00, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA)
+	}
+
+	return &rtp.Packet{
+		Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: ts, Marker: true},
+		Payload: payload,
+	}
+}
+
+func TestVP8TemporalFilter(t *testing.T) {
+	f := &vp8TemporalFilter{maxTID: 1}
+	// L1T3: 0, 2, 1, 2, ...
+	tids := []uint8{0, 2, 1, 2, 0, 2, 1, 2}
+	var kept []*rtp.Packet
+
+	for i, tid := range tids {
+		// Two packets per frame, PictureIDs wrapping around
+		for j := 0; j < 2; j++ {
+			p := vp8LayerPacket(uint16(65530+2*i+j), uint32(i*3000), uint16(0x7FFD+i)&0x7FFF, tid, false)
+			original := p.Clone()
+
+			if out := f.filter(p); out != nil {
+				kept = append(kept, out)
+			}
+
+			assert.Equal(t, original, p, "Packets are rewritten as copies")
+		}
+	}
+
+	require.Len(t, kept, 8)
+	assert.Equal(t, 4, f.droppedFrames)
+
+	for i, p := range kept {
+		var vp8 codecs.VP8Packet
+		_, err := vp8.Unmarshal(p.Payload)
+		require.NoError(t, err)
+
+		assert.Equal(t, uint16(65530+i), p.SequenceNumber, "Sequence numbers are left without gaps")
+		assert.Equal(t, (uint16(0x7FFD)+uint16(i/2))&0x7FFF, vp8.PictureID, "PictureIDs are left without gaps")
+		assert.LessOrEqual(t, vp8.TID, uint8(1))
+	}
+
+	// A straggler of a dropped frame is dropped too, without counting again
+	assert.Nil(t, f.filter(vp8LayerPacket(0, 3*3000, 0x7FFD+3, 2, false)))
+	assert.Equal(t, 4, f.droppedFrames)
+
+	// Packets without TIDs are the base layer
+	p := &rtp.Packet{Header: rtp.Header{SequenceNumber: 100, Timestamp: 100 * 3000}, Payload: []byte{0x10, 0x01, 0x00, 0x00, 0xAA}}
+	assert.NotNil(t, f.filter(p))
+}
+
+func TestWebmRecorder_VP8TemporalLayers(t *testing.T) {
+	for _, custom := range []bool{false, true} {
+		r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, custom, false, false)
+		r.EnableVP8TemporalLayers(2)
+		r.SetHasVideo(true)
+
+		tids := []uint8{0, 2, 1, 2}
+
+		for i := 0; i < 120; i++ {
+			r.PushVideo(vp8LayerPacket(uint16(i), uint32(i*3000), uint16(i), tids[i%4], i == 0))
+		}
+
+		r.Close()
+		stats := r.GetStats().Video
+
+		require.NotNil(t, stats.MaxTemporalLayer)
+		assert.Equal(t, 1, *stats.MaxTemporalLayer)
+		assert.Equal(t, 60, stats.DroppedLayerFrames)
+		assert.Zero(t, stats.RTPDiscontInfo.Count, "Dropped layers aren't losses")
+		assert.Zero(t, stats.VP8PicIDDiscontInfo.Count)
+		assert.Zero(t, stats.CorruptedFrames)
+		assert.InDelta(t, 60, stats.WrittenSamples, 2)
+	}
+
+	// Not filtering
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, false)
+	r.EnableVP8TemporalLayers(0)
+	r.SetHasVideo(true)
+	r.PushVideo(vp8LayerPacket(0, 0, 0, 0, true))
+	r.Close()
+	assert.Nil(t, r.GetStats().Video.MaxTemporalLayer)
+}
@@ -0,0 +1,591 @@
+package recorder
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	vp9SampleRate = 90000
+	// Layer IDs are 3 bits in the payload descriptor
+	vp9MaxLayerID = 7
+	// A superframe holds at most 8 frames (VP9 bitstream spec Annex B)
+	vp9MaxSuperframeFrames = 8
+	// P_DIFF is 7 bits, so references never go back further than this
+	vp9MaxRefDistance = 128
+	vp9FrameSyncCode  = 0x498342
+)
+
+var errVP9InvalidHeader = errors.New("vp9: invalid keyframe header")
+
+// vp9FrameInfo is the payload descriptor (RFC 9628) of the first packet of
+// a layer frame
+type vp9FrameInfo struct {
+	started       bool // Whether the first packet of the frame was seen
+	pictureID     int  // -1 if absent
+	pictureIDMask int
+	tid, sid      uint8
+	switchUp      bool
+	inter         bool // Inter-picture predicted
+	flexible      bool
+	hasTL0        bool
+	tl0PicIdx     uint8
+	pdiff         []uint8
+	// Scalability structure, only sent on some (key)frames
+	numSpatial    int
+	width, height []uint16
+}
+
+// vp9Depacketizer depacketizes like codecs.VP9Packet, keeping the payload
+// descriptor of the last layer frame it started. The samplebuilder
+// depacketizes a sample's packets right before returning it, so the info
+// matches the sample just popped.
+type vp9Depacketizer struct {
+	frame vp9FrameInfo
+	// Reused from one payload to the next
+	packet codecs.VP9Packet
+}
+
+func (d *vp9Depacketizer) Unmarshal(payload []byte) ([]byte, error) {
+	// codecs.VP9Packet appends to some fields on every call: they're
+	// emptied, their storage kept
+	p := &d.packet
+	*p = codecs.VP9Packet{
+		PDiff:   p.PDiff[:0],
+		Width:   p.Width[:0],
+		Height:  p.Height[:0],
+		PGTID:   p.PGTID[:0],
+		PGU:     p.PGU[:0],
+		PGPDiff: p.PGPDiff[:0],
+	}
+
+	data, err := p.Unmarshal(payload)
+
+	if err != nil || !p.B {
+		return data, err
+	}
+
+	d.frame = vp9FrameInfo{
+		started:   true,
+		pictureID: -1,
+		tid:       p.TID,
+		sid:       p.SID,
+		switchUp:  p.U,
+		inter:     p.P,
+		flexible:  p.F,
+		hasTL0:    p.L && !p.F,
+		tl0PicIdx: p.TL0PICIDX,
+		pdiff:     slices.Clone(p.PDiff),
+	}
+
+	if p.I {
+		d.frame.pictureID = int(p.PictureID)
+		d.frame.pictureIDMask = 0x7F
+
+		if payload[1]&0x80 != 0 {
+			d.frame.pictureIDMask = 0x7FFF
+		}
+	}
+
+	if p.V {
+		d.frame.numSpatial = int(p.NS) + 1
+		d.frame.width = slices.Clone(p.Width)
+		d.frame.height = slices.Clone(p.Height)
+	}
+
+	return data, nil
+}
+
+func (d *vp9Depacketizer) IsPartitionHead(payload []byte) bool {
+	return (&codecs.VP9Packet{}).IsPartitionHead(payload)
+}
+
+func (d *vp9Depacketizer) IsPartitionTail(marker bool, _ []byte) bool {
+	return marker
+}
+
+type vp9LayerFrame struct {
+	data []byte
+	info vp9FrameInfo
+}
+
+// vp9Picture is what gets written as a single block: the decodable spatial
+// layers of a picture
+type vp9Picture struct {
+	data          []byte
+	timestamp     uint32
+	keyframe      bool
+	width, height int
+	spatial       uint8
+	temporal      uint8
+	droppedFrames int
+}
+
+// vp9LayerFilter groups layer frames into pictures and keeps only those that
+// decode with what was written so far. Frames lost in an upper temporal or
+// spatial layer lower the written layer until the stream allows switching
+// back up; base layer losses need a keyframe.
+type vp9LayerFilter struct {
+	frames    []vp9LayerFrame
+	timestamp uint32
+
+	// From the last scalability structure
+	numSpatial    int
+	width, height []uint16
+	// Highest spatial layer ID seen
+	maxSID int
+
+	needKeyframe  bool
+	spatial       int   // Highest spatial layer of the last written picture
+	maxTemporal   uint8 // Highest temporal layer that can be written
+	lastPictureID int
+	tl0Valid      bool
+	lastTL0PicIdx uint8
+	// Flexible mode: picture IDs written, by pictureID % vp9MaxRefDistance
+	written [vp9MaxRefDistance]int
+}
+
+func newVP9LayerFilter() *vp9LayerFilter {
+	return &vp9LayerFilter{
+		numSpatial:    1,
+		needKeyframe:  true,
+		lastPictureID: -1,
+	}
+}
+
+// push adds a layer frame and returns the pictures it completed, and whether
+// a keyframe is needed to recover from a loss.
+func (f *vp9LayerFilter) push(data []byte, timestamp uint32, info vp9FrameInfo) ([]*vp9Picture, bool) {
+	var pictures []*vp9Picture
+	var keyframeNeeded bool
+
+	finish := func() {
+		picture, needed := f.finish()
+		keyframeNeeded = keyframeNeeded || needed
+
+		if picture != nil {
+			pictures = append(pictures, picture)
+		}
+	}
+
+	// Upper layers may not be forwarded, so a picture is only known to be
+	// over once the next one starts
+	if len(f.frames) > 0 && timestamp != f.timestamp {
+		finish()
+	}
+
+	f.timestamp = timestamp
+	f.frames = append(f.frames, vp9LayerFrame{data: data, info: info})
+	f.maxSID = max(f.maxSID, int(info.sid))
+
+	if info.numSpatial > 0 {
+		f.numSpatial = info.numSpatial
+	}
+
+	if int(info.sid)+1 >= max(f.numSpatial, f.maxSID+1) || len(f.frames) >= vp9MaxSuperframeFrames {
+		finish()
+	}
+
+	return pictures, keyframeNeeded
+}
+
+func (f *vp9LayerFilter) finish() (*vp9Picture, bool) {
+	frames := f.frames
+	f.frames = nil
+	base := frames[0].info
+	keyframe := !base.inter && base.sid == 0
+
+	if base.sid != 0 {
+		// The base spatial layer of this picture was lost
+		f.needKeyframe = true
+
+		return &vp9Picture{droppedFrames: len(frames)}, true
+	}
+
+	keyframeNeeded := false
+
+	if keyframe {
+		f.reset(base)
+	} else if f.needKeyframe {
+		return &vp9Picture{droppedFrames: len(frames)}, true
+	} else {
+		ok, needed := f.checkTemporal(base)
+
+		if !ok {
+			return &vp9Picture{droppedFrames: len(frames)}, needed
+		}
+
+		keyframeNeeded = needed
+	}
+
+	layers := make([][]byte, 0, len(frames))
+
+	for i, frame := range frames {
+		// A missing lower layer breaks everything above it. Upper layers
+		// can't be resumed from an inter predicted frame either, as their
+		// previous frames weren't written.
+		if int(frame.info.sid) != i || (!keyframe && i > f.spatial && frame.info.inter) {
+			break
+		}
+
+		layers = append(layers, frame.data)
+	}
+
+	f.spatial = len(layers) - 1
+	f.markWritten(base)
+
+	if base.switchUp {
+		// Higher temporal layers no longer depend on anything before this
+		f.maxTemporal = vp9MaxLayerID
+	}
+
+	picture := &vp9Picture{
+		data:          buildVP9Superframe(layers),
+		timestamp:     f.timestamp,
+		keyframe:      keyframe,
+		spatial:       uint8(f.spatial),
+		temporal:      base.tid,
+		droppedFrames: len(frames) - len(layers),
+	}
+
+	if keyframe {
+		picture.width, picture.height = f.dimensions(layers[0])
+	}
+
+	// Layers were received but can't be decoded until the next keyframe
+	return picture, keyframeNeeded || picture.droppedFrames > 0
+}
+
+func (f *vp9LayerFilter) reset(info vp9FrameInfo) {
+	if info.numSpatial > 0 {
+		f.width, f.height = info.width, info.height
+	}
+
+	f.needKeyframe = false
+	f.maxTemporal = vp9MaxLayerID
+	f.lastPictureID = info.pictureID
+	f.tl0Valid = info.hasTL0
+	f.lastTL0PicIdx = info.tl0PicIdx
+	clear(f.written[:])
+}
+
+// checkTemporal returns whether a non-key picture's references were written,
+// and whether a keyframe is needed.
+func (f *vp9LayerFilter) checkTemporal(info vp9FrameInfo) (bool, bool) {
+	lost := false
+
+	if info.pictureID >= 0 && f.lastPictureID >= 0 {
+		lost = (info.pictureID-f.lastPictureID-1)&info.pictureIDMask != 0
+	}
+
+	if info.pictureID >= 0 {
+		f.lastPictureID = info.pictureID
+	}
+
+	switch {
+	case info.flexible:
+		// References are explicit
+		for _, diff := range info.pdiff {
+			if !f.isWritten((info.pictureID - int(diff)) & info.pictureIDMask) {
+				f.needKeyframe = info.tid == 0
+
+				return false, f.needKeyframe
+			}
+		}
+
+		return true, false
+
+	case info.hasTL0:
+		// TL0PICIDX counts base temporal layer pictures; upper layer
+		// pictures carry the one they depend on
+		expected := f.lastTL0PicIdx
+
+		if info.tid == 0 {
+			expected++
+		}
+
+		if f.tl0Valid && info.tl0PicIdx != expected {
+			f.needKeyframe = true
+
+			return false, true
+		}
+
+		f.tl0Valid = true
+		f.lastTL0PicIdx = info.tl0PicIdx
+
+		if lost {
+			// Only upper temporal layer pictures were lost
+			f.maxTemporal = 0
+		}
+
+		return info.tid <= f.maxTemporal, lost
+
+	default:
+		// No temporal layers: every picture references the previous one
+		if lost {
+			f.needKeyframe = true
+
+			return false, true
+		}
+
+		return true, false
+	}
+}
+
+func (f *vp9LayerFilter) markWritten(info vp9FrameInfo) {
+	if info.pictureID >= 0 {
+		f.written[info.pictureID%vp9MaxRefDistance] = info.pictureID + 1
+	}
+}
+
+func (f *vp9LayerFilter) isWritten(pictureID int) bool {
+	return f.written[pictureID%vp9MaxRefDistance] == pictureID+1
+}
+
+// dimensions returns the size of the top written spatial layer, from the
+// scalability structure or else from the base layer keyframe header.
+func (f *vp9LayerFilter) dimensions(baseFrame []byte) (int, int) {
+	if f.spatial < len(f.width) && f.spatial < len(f.height) {
+		return int(f.width[f.spatial]), int(f.height[f.spatial])
+	}
+
+	width, height, err := parseVP9KeyframeDimensions(baseFrame)
+
+	if err != nil {
+		return 0, 0
+	}
+
+	return width, height
+}
+
+func (r *WebmRecorder) pushVP9(packet *rtp.Packet) {
+	if !r.hasVideo {
+		return
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if len(packet.Payload) == 0 || r.closed {
+		return
+	}
+
+	r.initVideoStats()
+
+	if gap, ok := r.sequenceGap(r.videoSeqTracker, &r.stats.Video.BaseTrackStats, packet.SequenceNumber); ok {
+		r.trackRTPDiscontinuity(&r.stats.Video.BaseTrackStats, gap)
+
+		r.logger.WithField("expected_seq", r.videoSeqTracker.expectedNextSeq).
+			WithField("got_seq", packet.SequenceNumber).
+			WithField("gap", gap).
+			Debug("Video sequence discontinuity detected")
+	}
+
+	// The sample builder retains the packet: it gets a copy of its own
+	packet = copyPacket(packet)
+	defer r.videoRecycler.recycle()
+
+	r.setExpectedNextSeq(packet.SequenceNumber, "video")
+	r.videoBuilder.Push(packet)
+
+	for {
+		// Samples are single layer frames; a picture may span several
+		sample, ts := r.videoBuilder.PopWithTimestamp()
+
+		if sample == nil {
+			return
+		}
+
+		info := r.vp9Depacketizer.frame
+		r.vp9Depacketizer.frame = vp9FrameInfo{}
+
+		if !info.started {
+			// The frame's first packet was lost; the filter notices the
+			// missing frame from the ones that follow
+			r.stats.Video.DroppedLayerFrames++
+			continue
+		}
+
+		pictures, keyframeNeeded := r.vp9Filter.push(sample.Data, ts, info)
+
+		if keyframeNeeded {
+			r.logger.Debugf("VP9 layer frames lost, requesting keyframe: ts=%d", ts)
+			r.RequestKeyframe()
+		}
+
+		for _, picture := range pictures {
+			r.writeVP9Picture(picture)
+		}
+	}
+}
+
+// Locked
+func (r *WebmRecorder) writeVP9Picture(picture *vp9Picture) {
+	r.stats.Video.DroppedLayerFrames += picture.droppedFrames
+
+	if picture.data == nil {
+		return
+	}
+
+	if r.resumeKeyframePending {
+		if !picture.keyframe {
+			r.RequestKeyframe()
+			return
+		}
+
+		r.resumeKeyframePending = false
+	}
+
+	// Durations come from the RTP timestamps of whole pictures
+	var duration time.Duration
+
+	if r.vp9LastTimestampValid {
+		duration = time.Duration(float64(picture.timestamp-r.vp9LastTimestamp) / float64(r.videoRate) * float64(time.Second))
+	}
+
+	r.vp9LastTimestamp = picture.timestamp
+	r.vp9LastTimestampValid = true
+	r.trackFrameStats(r.stats.Video, len(picture.data), picture.keyframe, duration)
+
+	if r.needsWebmWriter() {
+		if !picture.keyframe {
+			if r.videoWriter == nil {
+				if log.IsLevelEnabled(log.TraceLevel) {
+					r.logger.Tracef("Waiting for VP9 keyframe, dropping picture: ts=%d", picture.timestamp)
+				}
+
+				r.RequestKeyframe()
+
+				return
+			}
+		} else {
+			if log.IsLevelEnabled(log.TraceLevel) {
+				r.logger.Tracef("Frame dimensions: %dx%d", picture.width, picture.height)
+			}
+
+			r.initWriter(picture.width, picture.height)
+		}
+	}
+
+	if r.videoWriter == nil {
+		return
+	}
+
+	if gap, ok := r.consumePauseGap(&r.videoGapPending); ok {
+		duration = gap
+	}
+
+	r.startTimeline(&r.videoTimestamp, &r.videoTimelineStarted)
+	r.videoTimestamp += duration
+	r.anchorSkew(true, picture.timestamp)
+
+	if log.IsLevelEnabled(log.TraceLevel) {
+		r.logger.Tracef("Writing VP9 picture: ts=%d, size=%d, KF=%v, S=%d, T=%d",
+			picture.timestamp, len(picture.data), picture.keyframe, picture.spatial, picture.temporal)
+	}
+
+	if _, err := r.videoWriter.Write(picture.keyframe, int64(r.videoTimestamp/time.Millisecond), picture.data); err != nil {
+		r.logger.Errorf("Error writing video frame: %v", err)
+		r.hasKeyFrame = false
+		r.RequestKeyframe()
+	} else {
+		r.onVideoFrameWritten(len(picture.data), picture.keyframe)
+	}
+}
+
+// buildVP9Superframe packs a picture's layer frames into a superframe (VP9
+// bitstream spec Annex B), so they are written as one block
+func buildVP9Superframe(frames [][]byte) []byte {
+	if len(frames) == 1 {
+		return frames[0]
+	}
+
+	size, maxSize := 0, 0
+
+	for _, frame := range frames {
+		size += len(frame)
+		maxSize = max(maxSize, len(frame))
+	}
+
+	mag := 1
+
+	for mag < 4 && maxSize >= 1<<(8*mag) {
+		mag++
+	}
+
+	marker := byte(0xC0) | byte(mag-1)<<3 | byte(len(frames)-1)
+	buf := make([]byte, 0, size+2+mag*len(frames))
+
+	for _, frame := range frames {
+		buf = append(buf, frame...)
+	}
+
+	buf = append(buf, marker)
+
+	for _, frame := range frames {
+		for i := 0; i < mag; i++ {
+			buf = append(buf, byte(len(frame)>>(8*i)))
+		}
+	}
+
+	return append(buf, marker)
+}
+
+// parseVP9KeyframeDimensions reads the frame size from a keyframe's
+// uncompressed header (VP9 bitstream spec 6.2)
+func parseVP9KeyframeDimensions(frame []byte) (int, int, error) {
+	br := &expGolombReader{data: frame}
+
+	if br.readBits(2) != 2 { // frame_marker
+		return 0, 0, errVP9InvalidHeader
+	}
+
+	profile := br.readBits(1) | br.readBits(1)<<1
+
+	if profile == 3 {
+		br.readBits(1) // reserved_zero
+	}
+
+	if br.readBits(1) == 1 { // show_existing_frame
+		return 0, 0, errVP9InvalidHeader
+	}
+
+	if br.readBits(1) != 0 { // frame_type, 0 is KEY_FRAME
+		return 0, 0, errVP9InvalidHeader
+	}
+
+	br.readBits(2) // show_frame, error_resilient_mode
+
+	if br.readBits(24) != vp9FrameSyncCode {
+		return 0, 0, errVP9InvalidHeader
+	}
+
+	// color_config
+	if profile >= 2 {
+		br.readBits(1) // ten_or_twelve_bit
+	}
+
+	if br.readBits(3) != 7 { // color_space != CS_RGB
+		br.readBits(1) // color_range
+
+		if profile == 1 || profile == 3 {
+			br.readBits(3) // subsampling_x, subsampling_y, reserved_zero
+		}
+	} else if profile == 1 || profile == 3 {
+		br.readBits(1) // reserved_zero
+	}
+
+	width := int(br.readBits(16)) + 1
+	height := int(br.readBits(16)) + 1
+
+	if br.err != nil {
+		return 0, 0, errVP9InvalidHeader
+	}
+
+	return width, height, nil
+}
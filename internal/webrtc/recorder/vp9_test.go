@@ -0,0 +1,284 @@
+package recorder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Profile 0 keyframe, BT.601, 1280x720
+var testVP9Keyframe = []byte{0x82, 0x49, 0x83, 0x42, 0x40, 0x4F, 0xF0, 0x2C, 0xF0}
+
+type vp9TestDescriptor struct {
+	pictureID  uint16
+	tid, sid   uint8
+	switchUp   bool
+	inter      bool
+	tl0PicIdx  uint8
+	start, end bool
+	// Scalability structure sizes, one per spatial layer
+	sizes [][2]uint16
+}
+
+// payload builds a non-flexible mode descriptor with a 15-bit picture ID
+func (d vp9TestDescriptor) payload(data []byte) []byte {
+	b := byte(0xA0) // I, L
+
+	if d.inter {
+		b |= 0x40
+	}
+
+	if d.start {
+		b |= 0x08
+	}
+
+	if d.end {
+		b |= 0x04
+	}
+
+	if d.sizes != nil {
+		b |= 0x02
+	}
+
+	layer := d.tid<<5 | d.sid<<1
+
+	if d.switchUp {
+		layer |= 0x10
+	}
+
+	buf := []byte{b, 0x80 | byte(d.pictureID>>8), byte(d.pictureID), layer, d.tl0PicIdx}
+
+	if d.sizes != nil {
+		buf = append(buf, byte(len(d.sizes)-1)<<5|0x10)
+
+		for _, size := range d.sizes {
+			buf = append(buf, byte(size[0]>>8), byte(size[0]), byte(size[1]>>8), byte(size[1]))
+		}
+	}
+
+	return append(buf, data...)
+}
+
+func (d vp9TestDescriptor) info() vp9FrameInfo {
+	var depacketizer vp9Depacketizer
+
+	d.start = true
+	_, _ = depacketizer.Unmarshal(d.payload(nil))
+
+	return depacketizer.frame
+}
+
+func TestVP9Depacketizer_Reused(t *testing.T) {
+	var depacketizer vp9Depacketizer
+
+	_, err := depacketizer.Unmarshal(vp9TestDescriptor{start: true, sizes: [][2]uint16{{640, 360}, {1280, 720}}}.payload(nil))
+	require.NoError(t, err)
+	first := depacketizer.frame
+
+	_, err = depacketizer.Unmarshal(vp9TestDescriptor{start: true, sizes: [][2]uint16{{320, 180}}}.payload(nil))
+	require.NoError(t, err)
+
+	assert.Equal(t, []uint16{640, 1280}, first.width, "Frames don't share the depacketizer's storage")
+	assert.Equal(t, []uint16{320}, depacketizer.frame.width, "Fields are emptied between payloads")
+	assert.Equal(t, 1, depacketizer.frame.numSpatial)
+}
+
+func TestParseVP9KeyframeDimensions(t *testing.T) {
+	width, height, err := parseVP9KeyframeDimensions(testVP9Keyframe)
+	require.NoError(t, err)
+	assert.Equal(t, 1280, width)
+	assert.Equal(t, 720, height)
+
+	_, _, err = parseVP9KeyframeDimensions(testVP9Keyframe[:6])
+	assert.Error(t, err, "Truncated header should fail")
+
+	interFrame := append([]byte{0x86}, testVP9Keyframe[1:]...)
+	_, _, err = parseVP9KeyframeDimensions(interFrame)
+	assert.Error(t, err, "Inter frames have no size")
+}
+
+func TestBuildVP9Superframe(t *testing.T) {
+	single := []byte{1, 2, 3}
+	assert.Equal(t, single, buildVP9Superframe([][]byte{single}))
+
+	large := make([]byte, 300)
+	sf := buildVP9Superframe([][]byte{single, large})
+
+	// 2 frames, 2 bytes per size
+	marker := byte(0xC0 | 1<<3 | 1)
+	require.Len(t, sf, 3+300+2+2*2)
+	assert.Equal(t, marker, sf[303])
+	assert.Equal(t, []byte{3, 0, 0x2C, 0x01}, sf[304:308])
+	assert.Equal(t, marker, sf[len(sf)-1])
+}
+
+func TestVP9LayerFilter_Spatial(t *testing.T) {
+	f := newVP9LayerFilter()
+	sizes := [][2]uint16{{640, 360}, {1280, 720}}
+
+	// Keyframe with both layers
+	pictures, needed := f.push(testVP9Keyframe, 3000, vp9TestDescriptor{pictureID: 2, sizes: sizes}.info())
+	require.Len(t, pictures, 0, "Waiting for the second layer")
+	pictures, needed = f.push([]byte{3}, 3000, vp9TestDescriptor{pictureID: 2, sid: 1}.info())
+	require.Len(t, pictures, 1)
+	assert.False(t, needed)
+	assert.True(t, pictures[0].keyframe)
+	assert.Equal(t, uint8(1), pictures[0].spatial)
+	assert.Equal(t, 1280, pictures[0].width)
+	assert.Equal(t, 720, pictures[0].height)
+	assert.Equal(t, buildVP9Superframe([][]byte{testVP9Keyframe, {3}}), pictures[0].data)
+
+	// The upper layer of picture 3 is lost: picture 4 can only use the base
+	f.push([]byte{4}, 6000, vp9TestDescriptor{pictureID: 3, inter: true, tl0PicIdx: 1}.info())
+	pictures, needed = f.push([]byte{5}, 9000, vp9TestDescriptor{pictureID: 4, inter: true, tl0PicIdx: 2}.info())
+	require.Len(t, pictures, 1, "Picture 3 ends when picture 4 starts")
+	assert.Equal(t, []byte{4}, pictures[0].data)
+	assert.False(t, needed)
+
+	pictures, needed = f.push([]byte{6}, 9000, vp9TestDescriptor{pictureID: 4, sid: 1, inter: true, tl0PicIdx: 2}.info())
+	require.Len(t, pictures, 1)
+	assert.Equal(t, []byte{5}, pictures[0].data, "Upper layer must be left out")
+	assert.Equal(t, 1, pictures[0].droppedFrames)
+	assert.True(t, needed)
+
+	// The base layer of picture 5 is lost
+	pictures, needed = f.push([]byte{7}, 12000, vp9TestDescriptor{pictureID: 5, sid: 1, inter: true, tl0PicIdx: 3}.info())
+	require.Len(t, pictures, 1)
+	assert.Nil(t, pictures[0].data)
+	assert.True(t, needed)
+
+	pictures, _ = f.push([]byte{8}, 15000, vp9TestDescriptor{pictureID: 6, inter: true, tl0PicIdx: 4}.info())
+	require.Len(t, pictures, 0)
+	pictures, needed = f.push([]byte{9}, 15000, vp9TestDescriptor{pictureID: 6, sid: 1, inter: true, tl0PicIdx: 4}.info())
+	require.Len(t, pictures, 1)
+	assert.Nil(t, pictures[0].data, "Nothing is written until the next keyframe")
+	assert.True(t, needed)
+}
+
+func TestVP9LayerFilter_Temporal(t *testing.T) {
+	f := newVP9LayerFilter()
+	push := func(pictureID uint16, tid uint8, tl0PicIdx uint8, switchUp bool) (*vp9Picture, bool) {
+		d := vp9TestDescriptor{pictureID: pictureID, tid: tid, tl0PicIdx: tl0PicIdx, switchUp: switchUp, inter: pictureID > 0}
+		pictures, needed := f.push([]byte{byte(pictureID)}, uint32(pictureID)*3000, d.info())
+		require.Len(t, pictures, 1)
+
+		return pictures[0], needed
+	}
+
+	// Inter pictures before any keyframe are dropped
+	d := vp9TestDescriptor{pictureID: 100, inter: true}
+	pictures, needed := f.push([]byte{1}, 0, d.info())
+	require.Len(t, pictures, 1)
+	assert.Nil(t, pictures[0].data)
+	assert.True(t, needed)
+
+	// L1T3: T0 T2 T1 T2 T0 ...
+	picture, _ := push(0, 0, 0, false)
+	assert.True(t, picture.keyframe)
+	picture, _ = push(1, 2, 0, false)
+	assert.NotNil(t, picture.data)
+	picture, _ = push(2, 1, 0, false)
+	assert.NotNil(t, picture.data)
+
+	// Picture 3 (T2) is lost: only the base temporal layer decodes
+	picture, needed = push(4, 0, 1, false)
+	assert.NotNil(t, picture.data)
+	assert.True(t, needed)
+	picture, _ = push(5, 2, 1, false)
+	assert.Nil(t, picture.data)
+	picture, _ = push(6, 1, 1, false)
+	assert.Nil(t, picture.data)
+	picture, _ = push(7, 2, 1, false)
+	assert.Nil(t, picture.data)
+
+	// Switching up point on the base layer
+	picture, _ = push(8, 0, 2, true)
+	assert.NotNil(t, picture.data)
+	picture, needed = push(9, 2, 2, false)
+	assert.NotNil(t, picture.data)
+	assert.False(t, needed)
+
+	// Picture 12 (T0) is lost: upper layers that depend on it show up
+	// with a TL0PICIDX that wasn't seen
+	push(10, 1, 2, false)
+	push(11, 2, 2, false)
+	picture, needed = push(13, 2, 3, false)
+	assert.Nil(t, picture.data)
+	assert.True(t, needed)
+	picture, _ = push(14, 0, 4, false)
+	assert.Nil(t, picture.data, "Nothing is written until the next keyframe")
+}
+
+func TestWebmRecorder_VP9(t *testing.T) {
+	dir := t.TempDir()
+	// A short queue so the incomplete frame is given up on quickly
+	r := NewWebmRecorder(filepath.Join(dir, "rec.webm"), 0600, 4, 64, false, false, false)
+	r.SetHasVideo(true)
+
+	require.NoError(t, r.SetVideoCodec("video/VP9"))
+	assert.Equal(t, filepath.Join(dir, "rec.webm"), r.GetFilePath(), "VP9 fits in WebM")
+
+	kfr := &countingKeyframeRequester{}
+	r.SetKeyframeRequester(kfr)
+
+	seq := uint16(100)
+	push := func(ts uint32, marker bool, d vp9TestDescriptor, data []byte) {
+		r.PushVideo(&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				SequenceNumber: seq,
+				Timestamp:      ts,
+				Marker:         marker,
+			},
+			Payload: d.payload(data),
+		})
+		seq++
+	}
+	sizes := [][2]uint16{{640, 360}, {1280, 720}}
+
+	for i := uint16(0); i < 10; i++ {
+		ts := uint32(i) * 3000
+		base := vp9TestDescriptor{pictureID: i, inter: i > 0, tl0PicIdx: uint8(i), start: true, end: true}
+		upper := base
+		upper.sid = 1
+
+		if i == 0 {
+			base.sizes = sizes
+			push(ts, false, base, testVP9Keyframe)
+		} else {
+			push(ts, false, base, make([]byte, 16))
+		}
+
+		// The upper layer is split over two packets
+		upper.end = false
+		push(ts, false, upper, make([]byte, 16))
+
+		if i == 5 {
+			// Second half lost
+			seq++
+			continue
+		}
+
+		upper.start, upper.end = false, true
+		push(ts, true, upper, make([]byte, 16))
+	}
+
+	// Completes the last picture
+	push(30000, true, vp9TestDescriptor{pictureID: 10, inter: true, tl0PicIdx: 10, start: true, end: true}, make([]byte, 16))
+	r.Close()
+
+	stats := r.GetStats()
+	require.NotNil(t, stats.Video)
+	assert.Equal(t, 10, stats.Video.WrittenSamples, "Pictures are written even when their upper layer is lost")
+	assert.Equal(t, 1, stats.Video.KeyframeCount)
+	assert.Positive(t, stats.Video.DroppedLayerFrames)
+	assert.Positive(t, kfr.requests, "Losing a layer should request a keyframe")
+
+	info, err := os.Stat(r.GetFilePath())
+	require.NoError(t, err)
+	assert.Positive(t, info.Size())
+}
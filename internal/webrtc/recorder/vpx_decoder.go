@@ -0,0 +1,116 @@
+//go:build vpx && cgo
+
+package recorder
+
+/*
+#cgo LDFLAGS: -lvpx
+#include <vpx/vpx_decoder.h>
+#include <vpx/vp8dx.h>
+
+// vpx_codec_dec_init is a macro, which cgo can't call
+static vpx_codec_err_t init_decoder(vpx_codec_ctx_t *ctx, int vp9) {
+	vpx_codec_iface_t *iface = vp9 ? vpx_codec_vp9_dx() : vpx_codec_vp8_dx();
+	return vpx_codec_dec_init(ctx, iface, NULL, 0);
+}
+
+static vpx_image_t *next_frame(vpx_codec_ctx_t *ctx) {
+	vpx_codec_iter_t iter = NULL;
+	vpx_image_t *img = NULL;
+	vpx_image_t *last = NULL;
+
+	// The last of a superframe's frames is the one shown
+	while ((img = vpx_codec_get_frame(ctx, &iter)) != NULL) {
+		last = img;
+	}
+
+	return last;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"unsafe"
+)
+
+// libvpxDecoder decodes VP8 and VP9 with libvpx. Building it requires the
+// "vpx" build tag and the libvpx development files (libvpx-dev).
+type libvpxDecoder struct {
+	ctx    C.vpx_codec_ctx_t
+	closed bool
+}
+
+func newLibvpxDecoder(codec string) (videoDecoder, error) {
+	var vp9 C.int
+
+	switch codec {
+	case CodecVP8:
+	case CodecVP9:
+		vp9 = 1
+	default:
+		return nil, fmt.Errorf("no %s decoder for snapshots", codec)
+	}
+
+	d := &libvpxDecoder{}
+
+	if err := C.init_decoder(&d.ctx, vp9); err != C.VPX_CODEC_OK {
+		return nil, fmt.Errorf("failed to create %s decoder: %s", codec, C.GoString(C.vpx_codec_err_to_string(err)))
+	}
+
+	return d, nil
+}
+
+func (d *libvpxDecoder) Decode(frame []byte) (image.Image, error) {
+	if d.closed {
+		return nil, errors.New("vpx decoder closed")
+	}
+
+	if len(frame) == 0 {
+		return nil, errors.New("empty frame")
+	}
+
+	err := C.vpx_codec_decode(&d.ctx, (*C.uint8_t)(unsafe.Pointer(&frame[0])), C.uint(len(frame)), nil, 0)
+
+	if err != C.VPX_CODEC_OK {
+		return nil, fmt.Errorf("failed to decode frame: %s", C.GoString(C.vpx_codec_error(&d.ctx)))
+	}
+
+	img := C.next_frame(&d.ctx)
+
+	if img == nil {
+		return nil, errors.New("no frame decoded")
+	}
+
+	if img.fmt != C.VPX_IMG_FMT_I420 {
+		return nil, fmt.Errorf("unsupported pixel format %d", img.fmt)
+	}
+
+	width, height := int(img.d_w), int(img.d_h)
+	out := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+	copyPlane(out.Y, out.YStride, img.planes[0], int(img.stride[0]), width, height)
+	copyPlane(out.Cb, out.CStride, img.planes[1], int(img.stride[1]), (width+1)/2, (height+1)/2)
+	copyPlane(out.Cr, out.CStride, img.planes[2], int(img.stride[2]), (width+1)/2, (height+1)/2)
+
+	return out, nil
+}
+
+// copyPlane copies a plane of the decoder's image, whose rows may be padded
+func copyPlane(dst []byte, dstStride int, src *C.uchar, srcStride int, width, height int) {
+	plane := unsafe.Slice((*byte)(unsafe.Pointer(src)), srcStride*(height-1)+width)
+
+	for y := 0; y < height; y++ {
+		copy(dst[y*dstStride:y*dstStride+width], plane[y*srcStride:])
+	}
+}
+
+func (d *libvpxDecoder) Close() {
+	if !d.closed {
+		C.vpx_codec_destroy(&d.ctx)
+		d.closed = true
+	}
+}
+
+// Snapshots decode video with libvpx
+const videoDecodingAvailable = true
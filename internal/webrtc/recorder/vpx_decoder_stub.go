@@ -0,0 +1,11 @@
+//go:build !vpx || !cgo
+
+package recorder
+
+import "errors"
+
+func newLibvpxDecoder(codec string) (videoDecoder, error) {
+	return nil, errors.New("video decoding is not available: build with the 'vpx' tag and libvpx")
+}
+
+const videoDecodingAvailable = false
@@ -0,0 +1,228 @@
+package recorder
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/rtp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Opus packets last at most 120ms
+	opusMaxPacketDuration = 120 * time.Millisecond
+	// maxWAVSilence bounds the silence inserted for a single gap, so a
+	// sequence number jump (e.g. a publisher restart) can't blow up the file
+	maxWAVSilence = 10 * time.Second
+)
+
+type opusDecoder interface {
+	// Decode decodes packet into interleaved pcm, returning the number of
+	// samples per channel
+	Decode(packet []byte, pcm []int16) (int, error)
+	Close()
+}
+
+var newOpusDecoder = newLibopusDecoder
+
+// ValidateWAVConfig checks that WAV output can be used with cfg, including
+// that this build can decode Opus.
+func ValidateWAVConfig(cfg config.WAV) error {
+	if err := validateWAVFormat(cfg); err != nil {
+		return err
+	}
+
+	dec, err := newOpusDecoder(cfg.SampleRate, cfg.Channels)
+
+	if err != nil {
+		return err
+	}
+
+	dec.Close()
+
+	return nil
+}
+
+// Opus can only be decoded at a few rates
+func validateWAVFormat(cfg config.WAV) error {
+	switch cfg.SampleRate {
+	case 8000, 12000, 16000, 24000, 48000:
+	default:
+		return fmt.Errorf("unsupported WAV sample rate %d (must be 8000, 12000, 16000, 24000 or 48000)", cfg.SampleRate)
+	}
+
+	if cfg.Channels != 1 && cfg.Channels != 2 {
+		return fmt.Errorf("unsupported WAV channel count %d (must be 1 or 2)", cfg.Channels)
+	}
+
+	return nil
+}
+
+// EnableWAVOutput makes audio-only recordings decode Opus and write 16-bit
+// PCM WAV (.wav) files instead of WebM/Ogg. It must be called before any
+// audio is pushed.
+func (r *WebmRecorder) EnableWAVOutput(cfg config.WAV) error {
+	if err := validateWAVFormat(cfg); err != nil {
+		return err
+	}
+
+	dec, err := newOpusDecoder(cfg.SampleRate, cfg.Channels)
+
+	if err != nil {
+		return err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.started {
+		dec.Close()
+		return fmt.Errorf("cannot enable WAV output after recording started")
+	}
+
+	r.audioOnlyWAV = true
+	r.wavSampleRate = cfg.SampleRate
+	r.wavChannels = cfg.Channels
+	r.wavDecoder = dec
+	r.wavPCM = make([]int16, int(opusMaxPacketDuration.Seconds()*float64(cfg.SampleRate))*cfg.Channels)
+	r.updateContainer()
+
+	return nil
+}
+
+// Locked
+func (r *WebmRecorder) isWAVOutput() bool {
+	return r.audioOnlyWAV && r.hasAudio && !r.hasVideo
+}
+
+// Locked
+func (r *WebmRecorder) wavDuration(frames uint64) time.Duration {
+	return time.Duration(frames) * time.Second / time.Duration(r.wavSampleRate)
+}
+
+// Locked
+func (r *WebmRecorder) writeWAVSilence(duration time.Duration) {
+	if duration > maxWAVSilence {
+		r.logger.Warnf("Clamping WAV silence from %v to %v", duration, maxWAVSilence)
+		duration = maxWAVSilence
+	}
+
+	frames := int(duration.Seconds() * float64(r.wavSampleRate))
+
+	if frames <= 0 {
+		return
+	}
+
+	if err := r.wavWriter.WriteSilence(frames); err != nil {
+		r.logger.WithError(err).
+			Error("Error writing WAV silence")
+		return
+	}
+
+	r.logger.Debugf("Inserted %v of WAV silence", duration)
+}
+
+// pushWAV decodes Opus packets straight into the WAV file. Packets are
+// expected in order (the adapters' jitter buffers take care of it), so the
+// samplebuilder is bypassed. Gaps reported through NotifySkippedPacket are
+// filled with silence for the duration of the missing packets to keep the
+// file aligned with the rest of the session, and so are DTX silences (see
+// dtx.go).
+func (r *WebmRecorder) pushWAV(p *rtp.Packet) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if len(p.Payload) == 0 || r.closed || r.audioFormatChanged || !r.isWAVOutput() {
+		return
+	}
+
+	r.initAudioStats()
+
+	if r.wavWriter == nil {
+		r.initWriter(0, 0)
+	}
+
+	if r.wavWriter == nil {
+		return
+	}
+
+	if gap, ok := r.consumePauseGap(&r.audioGapPending); ok {
+		r.writeWAVSilence(gap)
+		r.wavStarted = false
+	}
+
+	if r.wavStarted {
+		diff := p.SequenceNumber - r.wavLastSeq
+
+		// Duplicate or late packet
+		if diff == 0 || diff >= 1<<15 {
+			return
+		}
+
+		if diff > 1 {
+			r.trackRTPDiscontinuity(&r.stats.Audio.BaseTrackStats, diff-1)
+
+			if r.wavSkipPending {
+				r.writeWAVSilence(time.Duration(diff-1) * r.wavDuration(uint64(r.wavLastFrames)))
+			}
+		} else {
+			r.fillWAVDTX(p.Timestamp)
+		}
+	}
+
+	r.wavSkipPending = false
+	r.wavStarted = true
+	r.wavLastSeq = p.SequenceNumber
+	r.wavLastTimestamp = p.Timestamp
+	r.noteDTXFrame(p.Payload)
+	r.setExpectedNextSeq(p.SequenceNumber, "audio")
+
+	frames, err := r.wavDecoder.Decode(p.Payload, r.wavPCM)
+
+	if err != nil {
+		r.logger.WithError(err).
+			WithField("seq", p.SequenceNumber).
+			Warn("Error decoding audio packet, writing silence")
+
+		// Keep the timeline going with the last known packet duration
+		r.writeWAVSilence(r.wavDuration(uint64(r.wavLastFrames)))
+		r.hasValidAudio = false
+
+		return
+	}
+
+	r.wavLastFrames = frames
+	r.audioTimestamp = r.wavDuration(r.wavWriter.Frames())
+
+	level, ok := r.headerAudioLevel(p)
+
+	if !ok {
+		level = pcmAudioLevel(r.wavPCM[:frames*r.wavChannels])
+	}
+
+	r.vad.update(r.audioTimestamp, level < vadSpeechLevel)
+	duration := r.wavDuration(uint64(frames))
+	r.trackSampleStats(&r.stats.Audio.BaseTrackStats, duration)
+
+	if err := r.wavWriter.WritePCM(r.wavPCM[:frames*r.wavChannels]); err != nil {
+		r.logger.WithError(err).
+			WithField("timestamp", r.audioTimestamp).
+			Error("Error writing audio frame")
+		r.onWriteError(err)
+		r.hasValidAudio = false
+
+		return
+	}
+
+	r.stats.Audio.WrittenSamples++
+	r.stats.Audio.BytesWritten += uint64(frames * r.wavChannels * wavBitsPerSample / 8)
+	r.hasValidAudio = true
+
+	if log.IsLevelEnabled(log.TraceLevel) {
+		r.logger.WithField("duration", duration).
+			WithField("timestamp", r.audioTimestamp).
+			WithField("frames", frames).
+			Trace("Audio frame written")
+	}
+}
@@ -0,0 +1,185 @@
+package recorder
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sync"
+)
+
+const (
+	wavHeaderSize     = 44
+	wavBitsPerSample  = 16
+	wavFormatPCM      = 1
+	wavUnknownSize    = math.MaxUint32
+	wavRIFFSizeOffset = 4
+	wavDataSizeOffset = 40
+)
+
+var errWAVWriterClosed = errors.New("wav writer closed")
+
+// WAVWriter writes 16-bit PCM to a RIFF/WAVE file. Chunk sizes are written
+// as unknown (0xFFFFFFFF, which most tools read as "until EOF") and fixed up
+// on Close if w can seek, so files stay readable if the recorder dies
+// mid-way and streaming to non-seekable writers works.
+type WAVWriter struct {
+	w          io.WriteCloser
+	seeker     io.WriteSeeker // w if it can seek, found once created
+	mu         sync.Mutex
+	sampleRate int
+	channels   int
+	frames     uint64
+	dataSize   uint64
+	buf        []byte
+	closed     bool
+}
+
+func NewWAVWriter(w io.WriteCloser, sampleRate int, channels int) (*WAVWriter, error) {
+	writer := &WAVWriter{
+		w:          w,
+		sampleRate: sampleRate,
+		channels:   channels,
+	}
+
+	if seeker, ok := w.(io.WriteSeeker); ok {
+		if _, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			writer.seeker = seeker
+		}
+	}
+
+	if err := writer.writeHeader(wavUnknownSize, wavUnknownSize); err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+func (writer *WAVWriter) writeHeader(riffSize, dataSize uint32) error {
+	blockAlign := writer.channels * wavBitsPerSample / 8
+	header := make([]byte, wavHeaderSize)
+
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], riffSize)
+	copy(header[8:], "WAVE")
+	copy(header[12:], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], wavFormatPCM)
+	binary.LittleEndian.PutUint16(header[22:], uint16(writer.channels))
+	binary.LittleEndian.PutUint32(header[24:], uint32(writer.sampleRate))
+	binary.LittleEndian.PutUint32(header[28:], uint32(writer.sampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(header[32:], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(header[34:], wavBitsPerSample)
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], dataSize)
+
+	_, err := writer.w.Write(header)
+
+	return err
+}
+
+// WritePCM writes interleaved samples
+func (writer *WAVWriter) WritePCM(samples []int16) error {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	if writer.closed {
+		return errWAVWriterClosed
+	}
+
+	if cap(writer.buf) < len(samples)*2 {
+		writer.buf = make([]byte, len(samples)*2)
+	}
+
+	buf := writer.buf[:len(samples)*2]
+
+	for i, sample := range samples {
+		binary.LittleEndian.PutUint16(buf[i*2:], uint16(sample))
+	}
+
+	return writer.write(buf)
+}
+
+// WriteSilence writes the given number of silent frames (one sample per
+// channel each)
+func (writer *WAVWriter) WriteSilence(frames int) error {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	if writer.closed {
+		return errWAVWriterClosed
+	}
+
+	frameSize := writer.channels * wavBitsPerSample / 8
+	chunk := make([]byte, 4096*frameSize)
+
+	for frames > 0 {
+		n := min(frames, 4096)
+
+		if err := writer.write(chunk[:n*frameSize]); err != nil {
+			return err
+		}
+
+		frames -= n
+	}
+
+	return nil
+}
+
+// Locked
+func (writer *WAVWriter) write(data []byte) error {
+	n, err := writer.w.Write(data)
+	writer.dataSize += uint64(n)
+	writer.frames = writer.dataSize / uint64(writer.channels*wavBitsPerSample/8)
+
+	return err
+}
+
+// Frames returns the number of frames written so far
+func (writer *WAVWriter) Frames() uint64 {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	return writer.frames
+}
+
+func (writer *WAVWriter) Close() error {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	if writer.closed {
+		return nil
+	}
+
+	writer.closed = true
+
+	// Sizes don't fit past 4GB: leave them as unknown
+	if writer.seeker != nil && writer.dataSize+wavHeaderSize-8 <= math.MaxUint32 {
+		if err := writeSizeAt(writer.seeker, wavRIFFSizeOffset, uint32(writer.dataSize+wavHeaderSize-8)); err != nil {
+			_ = writer.w.Close()
+			return err
+		}
+
+		if err := writeSizeAt(writer.seeker, wavDataSizeOffset, uint32(writer.dataSize)); err != nil {
+			_ = writer.w.Close()
+			return err
+		}
+	}
+
+	return writer.w.Close()
+}
+
+// writeSizeAt overwrites a chunk size
+func writeSizeAt(w io.WriteSeeker, offset int64, size uint32) error {
+	var buf [4]byte
+
+	binary.LittleEndian.PutUint32(buf[:], size)
+
+	if _, err := w.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err := w.Write(buf[:])
+
+	return err
+}
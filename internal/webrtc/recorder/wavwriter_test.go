@@ -0,0 +1,216 @@
+package recorder
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOpusDecoder "decodes" every packet to 20ms of a constant sample
+// value, 0 for packets starting with 0xFF which fail to decode
+type fakeOpusDecoder struct {
+	sampleRate int
+	channels   int
+}
+
+func (d *fakeOpusDecoder) Decode(packet []byte, pcm []int16) (int, error) {
+	if packet[0] == 0xFF {
+		return 0, errors.New("corrupted packet")
+	}
+
+	frames := d.sampleRate / 50
+
+	for i := 0; i < frames*d.channels; i++ {
+		pcm[i] = 1000
+	}
+
+	return frames, nil
+}
+
+func (d *fakeOpusDecoder) Close() {}
+
+func useFakeOpusDecoder(t *testing.T) {
+	orig := newOpusDecoder
+	newOpusDecoder = func(sampleRate, channels int) (opusDecoder, error) {
+		return &fakeOpusDecoder{sampleRate: sampleRate, channels: channels}, nil
+	}
+	t.Cleanup(func() { newOpusDecoder = orig })
+}
+
+func readWAV(t *testing.T, path string) (channels, sampleRate int, samples []int16) {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(data), wavHeaderSize)
+
+	assert.Equal(t, "RIFF", string(data[0:4]))
+	assert.Equal(t, uint32(len(data)-8), binary.LittleEndian.Uint32(data[4:]))
+	assert.Equal(t, "WAVE", string(data[8:12]))
+	assert.Equal(t, uint16(wavFormatPCM), binary.LittleEndian.Uint16(data[20:]))
+	assert.Equal(t, uint16(wavBitsPerSample), binary.LittleEndian.Uint16(data[34:]))
+	assert.Equal(t, "data", string(data[36:40]))
+	assert.Equal(t, uint32(len(data)-wavHeaderSize), binary.LittleEndian.Uint32(data[40:]))
+
+	channels = int(binary.LittleEndian.Uint16(data[22:]))
+	sampleRate = int(binary.LittleEndian.Uint32(data[24:]))
+
+	for i := wavHeaderSize; i+1 < len(data); i += 2 {
+		samples = append(samples, int16(binary.LittleEndian.Uint16(data[i:])))
+	}
+
+	return channels, sampleRate, samples
+}
+
+func TestWAVWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.wav")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+
+	w, err := NewWAVWriter(f, 16000, 2)
+	require.NoError(t, err)
+
+	require.NoError(t, w.WritePCM([]int16{1, -1, 2, -2}))
+	require.NoError(t, w.WriteSilence(5000))
+	assert.Equal(t, uint64(5002), w.Frames())
+
+	require.NoError(t, w.Close())
+	require.NoError(t, w.Close(), "Double close should be a no-op")
+	assert.Error(t, w.WritePCM([]int16{1}))
+
+	channels, sampleRate, samples := readWAV(t, path)
+	assert.Equal(t, 2, channels)
+	assert.Equal(t, 16000, sampleRate)
+	require.Len(t, samples, 5002*2)
+	assert.Equal(t, []int16{1, -1, 2, -2, 0, 0}, samples[:6])
+}
+
+func TestValidateWAVConfig(t *testing.T) {
+	useFakeOpusDecoder(t)
+
+	assert.NoError(t, ValidateWAVConfig(config.WAV{SampleRate: 16000, Channels: 1}))
+	assert.Error(t, ValidateWAVConfig(config.WAV{SampleRate: 44100, Channels: 1}))
+	assert.Error(t, ValidateWAVConfig(config.WAV{SampleRate: 16000, Channels: 6}))
+}
+
+func TestWebmRecorder_AudioOnlyWAV(t *testing.T) {
+	useFakeOpusDecoder(t)
+
+	dir := t.TempDir()
+	r := NewWebmRecorder(filepath.Join(dir, "rec.webm"), 0600, 256, 64, false, false, true)
+	require.NoError(t, r.EnableWAVOutput(config.WAV{SampleRate: 16000, Channels: 1}))
+	r.SetHasAudio(true)
+
+	assert.Equal(t, filepath.Join(dir, "rec.wav"), r.GetFilePath(), "WAV takes precedence over Ogg")
+
+	push := func(seq uint16, payload byte) {
+		r.PushAudio(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 960},
+			Payload: []byte{payload, 0xAA},
+		})
+	}
+
+	// Sequence number wraparound
+	push(65534, 0xFC)
+	push(65535, 0xFC)
+	push(65535, 0xFC) // Duplicate, dropped
+	// 0 and 1 are skipped and reported: 40ms of silence
+	r.NotifySkippedPacket(0)
+	push(2, 0xFC)
+	// 3 is lost but not reported: no silence
+	push(4, 0xFC)
+	// Undecodable packet: 20ms of silence
+	push(5, 0xFF)
+	push(6, 0xFC)
+
+	r.Close()
+
+	channels, sampleRate, samples := readWAV(t, r.GetFilePath())
+	assert.Equal(t, 1, channels)
+	assert.Equal(t, 16000, sampleRate)
+
+	// 5 decoded packets plus 3 packets of silence, 320 samples each
+	require.Len(t, samples, 8*320)
+
+	expected := []int16{1000, 1000, 0, 0, 1000, 1000, 0, 1000}
+
+	for i, value := range expected {
+		assert.Equal(t, value, samples[i*320], "packet %d", i)
+		assert.Equal(t, value, samples[i*320+319], "packet %d", i)
+	}
+
+	stats := r.GetStats()
+	assert.Equal(t, 5, stats.Audio.WrittenSamples)
+}
+
+func TestWebmRecorder_AudioOnlyWAVSwitchesBackWithVideo(t *testing.T) {
+	useFakeOpusDecoder(t)
+
+	dir := t.TempDir()
+	r := NewWebmRecorder(filepath.Join(dir, "rec.webm"), 0600, 256, 64, false, false, false)
+	require.NoError(t, r.EnableWAVOutput(config.WAV{SampleRate: 16000, Channels: 1}))
+	r.SetHasAudio(true)
+	assert.Equal(t, filepath.Join(dir, "rec.wav"), r.GetFilePath())
+
+	r.SetHasVideo(true)
+	assert.Equal(t, filepath.Join(dir, "rec.webm"), r.GetFilePath())
+}
+
+func TestWAVWriter_NonSeekable(t *testing.T) {
+	sink := &streamSink{}
+	w, err := NewWAVWriter(sink, 16000, 1)
+	require.NoError(t, err)
+
+	require.NoError(t, w.WritePCM([]int16{1, 2, 3}))
+	require.NoError(t, w.Close())
+
+	assert.True(t, sink.closed)
+	require.Equal(t, wavHeaderSize+6, sink.Len())
+	assert.Equal(t, uint32(wavUnknownSize), binary.LittleEndian.Uint32(sink.Bytes()[40:]), "Size left as unknown")
+}
+
+// seekFailSink can seek until it fails to
+type seekFailSink struct {
+	streamSink
+	fail bool
+}
+
+func (s *seekFailSink) Seek(offset int64, whence int) (int64, error) {
+	if s.fail {
+		return 0, errors.New("seek failed")
+	}
+
+	return int64(s.Len()), nil
+}
+
+func TestWAVWriter_SeekFailure(t *testing.T) {
+	sink := &seekFailSink{}
+	w, err := NewWAVWriter(sink, 16000, 1)
+	require.NoError(t, err)
+
+	require.NoError(t, w.WritePCM([]int16{1, 2, 3}))
+	sink.fail = true
+	assert.ErrorContains(t, w.Close(), "seek failed")
+	assert.True(t, sink.closed)
+}
+
+func TestWAVWriter_Pipe(t *testing.T) {
+	r, pw, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+
+	// A file, but one that can't seek
+	w, err := NewWAVWriter(pw, 16000, 1)
+	require.NoError(t, err)
+
+	go func() { _, _ = io.Copy(io.Discard, r) }()
+
+	require.NoError(t, w.WritePCM([]int16{1, 2, 3}))
+	assert.NoError(t, w.Close(), "Sizes left as unknown")
+}
@@ -3,15 +3,24 @@ package recorder
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"runtime/debug"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/at-wat/ebml-go/mkv"
 	"github.com/at-wat/ebml-go/mkvcore"
 	"github.com/at-wat/ebml-go/webm"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/encryption"
 	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/interfaces"
 	"github.com/jech/samplebuilder"
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
@@ -24,6 +33,9 @@ const (
 	opusSampleRate      = 48000
 	vp8SampleRate       = 90000
 	secondToNanoseconds = 1000000000
+	// maxPauseGap is the most media time a pause adds to the recording, so
+	// playback doesn't freeze on the last frame for the whole pause
+	maxPauseGap = time.Second
 )
 
 type VP8PartitionTracker struct {
@@ -47,6 +59,8 @@ type VP8FrameInfo struct {
 type SequenceTracker struct {
 	expectedNextSeq uint16
 	kind            string
+	// nil unless gaps are tolerated (see gaptolerance.go)
+	tolerance *gapTolerance
 }
 
 type WebmRecorder struct {
@@ -58,6 +72,15 @@ type WebmRecorder struct {
 	audioPacketQueueSize  uint16
 	useCustomSampler      bool
 	writeIVFCopy          bool
+	audioOnlyOgg          bool
+	videoCodec            string
+	audioFormat           OpusFormat
+	// Set once the audio format changed after the header was written: audio
+	// is dropped from then on, until the recording is stopped
+	audioFormatChanged bool
+	// sink replaces the file when set, sinkExt is its container
+	sink    io.WriteCloser
+	sinkExt string
 
 	// State tracking
 	hasAudio      bool
@@ -70,19 +93,26 @@ type WebmRecorder struct {
 	// Synchronization
 	m   sync.Mutex
 	ctx context.Context
+	// Tagged with the session of ctx, built once rather than per packet
+	logger *log.Entry
 
 	// Writers and builders
 	audioWriter, videoWriter       webm.BlockWriteCloser
 	audioBuilder, videoBuilder     *samplebuilder.SampleBuilder
+	audioRecycler, videoRecycler   packetRecycler
+	oggWriter                      *OggOpusWriter
 	audioTimestamp, videoTimestamp time.Duration
 
 	// Keyframe tracking
 	seenKeyFrame            bool // Seen at least one keyframe
 	hasKeyFrame             bool // Has a valid keyframe to keep recording
-	currKeyFrame            *rtp.Packet
+	currKeyFrameTs          uint32
+	hasCurrKeyFrame         bool
 	lastKeyFrameTime        time.Time
 	keyframeRequester       KeyframeRequester
 	lastKeyframeRequestTime time.Time
+	firstKeyframeCallback   func(timestamp time.Duration)
+	firstKeyframeWritten    bool
 
 	// Frame processing
 	currentFrame     []byte
@@ -110,6 +140,193 @@ type WebmRecorder struct {
 	vp8Tracker          VP8PartitionTracker
 	ivfWriter           *IVFWriter
 
+	// H.264 parameter sets (latest seen), used to build the CodecPrivate
+	h264SPS []byte
+	h264PPS []byte
+	// NAL units of the sample being written, reused from one to the next
+	h264NALUs [][]byte
+
+	// VP9 layer state
+	vp9Depacketizer       *vp9Depacketizer
+	vp9Filter             *vp9LayerFilter
+	vp9LastTimestamp      uint32
+	vp9LastTimestampValid bool
+
+	// AV1 sequence header (latest seen), used to build the CodecPrivate
+	av1SeqHeader       *av1SequenceHeader
+	av1Depacketizer    *av1Depacketizer
+	av1SequenceStarted bool
+
+	// Simulcast layer selected by the adapter, for stats
+	videoLayer       string
+	videoLayerWidth  uint32
+	videoLayerHeight uint32
+	// What the video shows, for stats (see SetVideoSource)
+	videoSource string
+	// Released once closed (see claimFile). Files switched to as the
+	// container changes are claimed as the first one was, from the one
+	// requested.
+	claimedFile   string
+	requestedFile string
+	fileCollision string
+	claimTime     time.Time
+
+	// RTP timestamp re-basing, if enabled (see discontinuity.go)
+	timestampJumpThreshold time.Duration
+	videoRebaser           timestampRebaser
+	audioRebaser           timestampRebaser
+
+	// VP8 temporal layers filtered out, if enabled (see vp8layers.go)
+	vp8Layers *vp8TemporalFilter
+
+	// Low bitrate proxy, if enabled (see proxy.go)
+	proxyCfg config.Proxy
+	// What the mix and the proxy encode Opus with (see opusencoding.go)
+	opusEncoderCfg config.OpusEncoder
+	proxy          *proxyTranscoder
+	// Decoded media for other pipelines, if enabled (see rawoutput.go)
+	rawOutputCfg config.RawOutput
+	rawVideo     *rawStream
+	rawAudio     *rawStream
+
+	// WAV output: decoded Opus, for audio-only recordings
+	audioOnlyWAV     bool
+	wavSampleRate    int
+	wavChannels      int
+	wavWriter        *WAVWriter
+	wavDecoder       opusDecoder
+	wavPCM           []int16
+	wavStarted       bool
+	wavLastSeq       uint16
+	wavLastTimestamp uint32
+	wavLastFrames    int
+	wavSkipPending   bool
+
+	// Fragmented MP4 output (see fmp4.go)
+	fmp4                 bool
+	fmp4FragmentDuration time.Duration
+
+	// Segmented output (see segments.go)
+	segmentDuration time.Duration
+	segmenter       *segmenter
+	segmentCallback func(segment SegmentInfo)
+
+	// Audio tracks mixed into this recording's (see mixer.go). Set before
+	// any audio is pushed.
+	mixer *audioMixer
+
+	// Keyframe trimming (see trim.go)
+	trimLeading  bool
+	trimTrailing bool
+	trimmer      *blockTrimmer
+	firstMediaAt time.Time
+
+	// Video frames per second written, 0 as they come (see cfr.go)
+	constantFrameRate int
+
+	// Bytes written to the recording's files (see filestats.go)
+	written *writeCounter
+
+	// Stills of the video every snapshotInterval, if set (see snapshots.go)
+	snapshotInterval time.Duration
+	snapshotQuality  int
+	snapshotDirMode  os.FileMode
+	snapshotter      *snapshotter
+
+	// Blocks written at a later timestamp than theirs (see monotonic.go)
+	timestampCorrections timestampCorrections
+
+	// Packets pushed, paused or not (see ReceivedPackets)
+	videoPackets atomic.Uint64
+	audioPackets atomic.Uint64
+
+	// Pause tracking
+	paused                bool
+	pausedAt              time.Time
+	resumedAt             time.Time
+	resumeGap             time.Duration
+	videoGapPending       bool
+	audioGapPending       bool
+	resumeKeyframePending bool
+
+	// A/V sync (see avsync.go)
+	now                  func() time.Time
+	clock                clock.Clock // What timers go by, as now
+	mediaStart           time.Time
+	videoTimelineStarted bool
+	audioTimelineStarted bool
+	pendingAudio         []pendingAudioSample
+	pendingAudioStart    time.Time
+	pendingAudioDuration time.Duration
+	skew                 *skewCorrection
+
+	// RTP clock rates and their overrides (see clockrate.go)
+	clockRates       map[string]uint32
+	videoRate        uint32
+	audioRate        uint32
+	videoPayloadType int
+	audioPayloadType int
+
+	// Loss concealment (see concealment.go)
+	concealAudioLoss        bool
+	concealVideoLoss        bool
+	audioLosses             map[uint32]struct{}  // RTP timestamps following losses, until written
+	concealScratch          []pendingAudioSample // Reused by concealAudio
+	lossMarkerWriter        webm.BlockWriteCloser
+	videoLostPackets        int
+	lastVideoFrameTimestamp time.Duration
+
+	// Opus DTX (see dtx.go)
+	fillDTXGaps bool
+	dtxFrame    []byte               // Last audio packet written, if a DTX frame
+	dtxScratch  []pendingAudioSample // Reused by fillDTX
+
+	// Filling audio gaps with silence (see silence.go)
+	silenceThreshold time.Duration        // 0 if disabled
+	silenceScratch   []pendingAudioSample // Reused by fillSilence
+
+	// Matroska output and its chapters (see mkv.go)
+	mkv      bool
+	chapters []chapter
+
+	// Bounds finalization on close (see flush.go)
+	flushDeadline time.Duration
+	flushGuard    flushGuard
+
+	// Media between the cues WebM/MKV files are indexed with as they're
+	// written, 0 if not (see cues.go)
+	cueFlushInterval time.Duration
+
+	// Embedded in the container (see tags.go)
+	tags map[string]string
+
+	// Disk space reserved for each file (see preallocate.go)
+	preallocateBitrate  uint64
+	preallocateDuration time.Duration
+
+	// Encrypts the files written, if set (see encryption.go)
+	encryptionKey *encryption.Key
+
+	// The first failure to write the recording (see WriteError), whether
+	// it's one to set up its writers, after which nothing is written, and
+	// who's told about those
+	writeErr             error
+	writerFailed         bool
+	writeFailureCallback func(err error)
+
+	// Muted video (see mute.go)
+	muteMarkers      bool
+	videoMuted       bool
+	videoMutePending bool // Muted since the last frame written
+
+	// Voice activity (see vad.go)
+	audioLevelExtID  uint8
+	vad              vadTracker
+	vadLevels        map[uint32]uint8 // RTP timestamp -> level, until written
+	vadDecoder       opusDecoder
+	vadDecoderFailed bool
+	vadPCM           []int16
+
 	// Stats tracking
 	stats        types.RecorderStats
 	lastAudioPTS int64
@@ -123,9 +340,11 @@ func NewWebmRecorder(
 	audioPacketQueueSize uint16,
 	useCustomSampler bool,
 	writeIVFCopy bool,
+	audioOnlyOgg bool,
 ) *WebmRecorder {
 	r := &WebmRecorder{
 		ctx:                   context.Background(),
+		logger:                log.WithField("session", nil),
 		file:                  file,
 		fileMode:              fileMode,
 		videoPacketQueueSize:  videoPacketQueueSize,
@@ -133,11 +352,19 @@ func NewWebmRecorder(
 		audioPacketQueueSize:  audioPacketQueueSize,
 		useCustomSampler:      useCustomSampler,
 		writeIVFCopy:          writeIVFCopy,
-		audioBuilder:          samplebuilder.New(audioPacketQueueSize, &codecs.OpusPacket{}, opusSampleRate),
-		videoBuilder:          samplebuilder.New(videoPacketQueueSize, &codecs.VP8Packet{}, vp8SampleRate),
+		audioOnlyOgg:          audioOnlyOgg,
+		videoCodec:            CodecVP8,
+		audioFormat:           defaultOpusFormat,
+		videoRate:             vp8SampleRate,
+		audioRate:             opusSampleRate,
+		videoPayloadType:      -1,
+		audioPayloadType:      -1,
 		videoSeqTracker:       &SequenceTracker{expectedNextSeq: 0, kind: "video"},
 		audioSeqTracker:       &SequenceTracker{expectedNextSeq: 0, kind: "audio"},
 		lastKeyFrameTime:      time.Now(),
+		now:                   time.Now,
+		clock:                 clock.Real,
+		vadLevels:             make(map[uint32]uint8),
 		// TODO Make this configurable or remove the timeout altogether - prlanzarin
 		frameTimeout: time.Millisecond * 2000,
 		// maxFrameSize = 5MB (basically disabled for now)
@@ -149,19 +376,71 @@ func NewWebmRecorder(
 		hasValidVideo: false,
 	}
 
+	r.videoBuilder = r.newVideoBuilder()
+	r.audioBuilder = r.newAudioBuilder()
+	r.written = &writeCounter{}
+
 	return r
 }
 
 func (r *WebmRecorder) GetFilePath() string {
+	if r.isSegmented() {
+		return r.manifestPath()
+	}
+
 	return r.file
 }
 
 func (r *WebmRecorder) WithContext(ctx context.Context) {
 	r.ctx = ctx
+	r.logger = log.WithField("session", ctx.Value("session"))
+}
+
+// WithClock makes the recorder time itself with c rather than the system
+// clock, e.g. for tests to control it. Must be called before any media is
+// pushed.
+func (r *WebmRecorder) WithClock(c clock.Clock) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.now = c.Now
+	r.clock = c
+	r.lastKeyFrameTime = c.Now()
+}
+
+// WithWriter makes the recorder write to sink instead of a file, e.g. to
+// stream into an uploader or transcoder. GetFilePath returns an empty string
+// then. Containers are written sequentially, so sink doesn't need to be
+// seekable; it's closed along with the recorder. Must be called before any
+// media is pushed.
+func (r *WebmRecorder) WithWriter(sink io.WriteCloser) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.sink = sink
+	r.file = ""
+	r.sinkExt = ".webm"
+	// The IVF copy is a sibling file of the recording
+	r.writeIVFCopy = false
+	r.updateContainer()
+}
+
+// Locked
+// containerExt returns the extension of the container being written
+func (r *WebmRecorder) containerExt() string {
+	if r.sink != nil {
+		return r.sinkExt
+	}
+
+	return filepath.Ext(r.file)
 }
 
 func (r *WebmRecorder) SetHasAudio(hasAudio bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
 	r.hasAudio = hasAudio
+	r.updateContainer()
 }
 
 func (r *WebmRecorder) GetHasAudio() bool {
@@ -169,13 +448,216 @@ func (r *WebmRecorder) GetHasAudio() bool {
 }
 
 func (r *WebmRecorder) SetHasVideo(hasVideo bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	// What was written to a sink can't be taken back
+	if hasVideo && r.sink != nil && (r.oggWriter != nil || r.wavWriter != nil) {
+		r.logger.Warn("Video track added after an audio-only stream was started, ignoring it")
+		return
+	}
+
 	r.hasVideo = hasVideo
+
+	// A video track showed up after an audio-only Ogg/WAV file was started:
+	// drop it so the recording is restarted as a WebM with both tracks
+	if hasVideo && (r.oggWriter != nil || r.wavWriter != nil) {
+		r.logger.Infof("Video track added, discarding audio-only file: %s", r.file)
+
+		if r.oggWriter != nil {
+			if err := r.oggWriter.Close(); err != nil {
+				r.logger.Warnf("Error closing Ogg writer: %v", err)
+			}
+		}
+
+		if r.wavWriter != nil {
+			if err := r.wavWriter.Close(); err != nil {
+				r.logger.Warnf("Error closing WAV writer: %v", err)
+			}
+		}
+
+		if err := os.Remove(r.file); err != nil && !os.IsNotExist(err) {
+			r.logger.Warnf("Error removing audio-only file: %v", err)
+		}
+
+		r.oggWriter = nil
+		r.wavWriter = nil
+		r.started = false
+	}
+
+	r.updateContainer()
+}
+
+// Locked
+// updateContainer picks the output container (and file extension) from the
+// current track setup. It's a no-op once writing has started.
+func (r *WebmRecorder) updateContainer() {
+	if err := r.switchContainer(); err != nil {
+		r.logger.Warnf("Not switching output container: %v", err)
+	}
+}
+
+// switchContainer is updateContainer, returning an error if the file of the
+// container picked can't be taken, leaving the output as it was.
+// Locked
+func (r *WebmRecorder) switchContainer() error {
+	if r.started {
+		return nil
+	}
+
+	ext := ".webm"
+
+	switch {
+	case r.isFMP4Output():
+		ext = ".mp4"
+	case requiresMatroska(r.videoCodec), r.isMKVOutput():
+		ext = ".mkv"
+	case r.isWAVOutput():
+		ext = ".wav"
+	case r.audioOnlyOgg && r.hasAudio && !r.hasVideo:
+		ext = ".ogg"
+	}
+
+	if r.sink != nil {
+		r.sinkExt = ext
+		return nil
+	}
+
+	if file := replaceExt(r.file, ext); file != r.file {
+		return r.switchFile(file)
+	}
+
+	return nil
 }
 
 func (r *WebmRecorder) GetHasVideo() bool {
 	return r.hasVideo
 }
 
+// SetVideoCodec selects the video codec to be recorded. It must be called
+// before any video packet is pushed. H.264 is not part of the WebM subset,
+// so the output file is switched to Matroska (.mkv) in that case, unless
+// fMP4 output is enabled.
+func (r *WebmRecorder) SetVideoCodec(mimeType string) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	codec := NormalizeMimeType(mimeType)
+
+	if codec == r.videoCodec {
+		return nil
+	}
+
+	if !IsSupportedVideoCodec(codec) {
+		return fmt.Errorf("%w: video %s", interfaces.ErrCodecUnsupported, mimeType)
+	}
+
+	if r.started {
+		return fmt.Errorf("cannot change video codec to %s after recording started", mimeType)
+	}
+
+	previous := r.videoCodec
+	r.videoCodec = codec
+
+	if err := r.switchContainer(); err != nil {
+		r.videoCodec = previous
+		return err
+	}
+
+	r.logger.Infof("Recording video codec set to %s: %s", codec, r.file)
+
+	// Rebuilt for the new codec's depacketizer even if the rate is the same
+	r.videoRate = 0
+	r.applyClockRates()
+
+	if codec == CodecVP9 {
+		r.vp9Filter = newVP9LayerFilter()
+	}
+
+	return nil
+}
+
+// SetAudioFormat sets the channel layout of the audio track, as negotiated.
+// Recordings are stereo if it's never called. The layout is in the container
+// header, so it can't change once the recording started: that's an
+// ErrAudioFormatChanged, and audio is dropped from then on rather than
+// written with a mismatched header. The recording should be stopped.
+func (r *WebmRecorder) SetAudioFormat(format OpusFormat) error {
+	if err := format.Validate(); err != nil {
+		return err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	// Mixes are encoded in their own format, whatever the tracks' is
+	if r.mixer != nil || format.Equal(r.audioFormat) {
+		return nil
+	}
+
+	if r.started {
+		r.audioFormatChanged = true
+
+		return fmt.Errorf("%w: from %s to %s", ErrAudioFormatChanged, r.audioFormat, format)
+	}
+
+	if r.audioOnlyWAV && format.mappingFamily() != 0 {
+		return fmt.Errorf("cannot decode %s Opus to WAV", format)
+	}
+
+	// Audio held for the file to start was encoded for the previous layout
+	r.pendingAudio = nil
+	r.pendingAudioDuration = 0
+	r.audioFormat = format
+	// Overrides may differ between audio/opus and audio/multiopus
+	r.applyClockRates()
+
+	r.logger.Infof("Recording audio format set to %s: %s", format, r.file)
+
+	return nil
+}
+
+func (r *WebmRecorder) GetVideoCodec() string {
+	return r.videoCodec
+}
+
+// SetVideoLayer records which simulcast layer is being recorded
+func (r *WebmRecorder) SetVideoLayer(layer string, width, height uint32) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.videoLayer = layer
+	r.videoLayerWidth = width
+	r.videoLayerHeight = height
+
+	if r.stats.Video != nil {
+		r.stats.Video.Layer = layer
+		r.stats.Video.LayerWidth = width
+		r.stats.Video.LayerHeight = height
+	}
+}
+
+// SetVideoSource records what the video shows, one of the VideoSource
+// values. Screen shares are written as their frames come, even at a constant
+// frame rate: their content barely changes, at a low rate. Must be called
+// before any media is pushed.
+func (r *WebmRecorder) SetVideoSource(source string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.videoSource = source
+
+	if r.stats.Video != nil {
+		r.stats.Video.Source = source
+	}
+
+	if source == VideoSourceScreenShare && r.constantFrameRate > 0 {
+		r.logger.Debug("Not writing screen share at a constant frame rate")
+
+		r.constantFrameRate = 0
+	}
+}
+
 func (r *WebmRecorder) SetKeyframeRequester(requester KeyframeRequester) {
 	r.m.Lock()
 	defer r.m.Unlock()
@@ -183,6 +665,81 @@ func (r *WebmRecorder) SetKeyframeRequester(requester KeyframeRequester) {
 	r.lastKeyframeRequestTime = time.Time{}
 }
 
+// SetFirstKeyframeCallback sets a callback for when the first keyframe is
+// written, with its timestamp in the recording. It's called from its own
+// goroutine.
+func (r *WebmRecorder) SetFirstKeyframeCallback(callback func(timestamp time.Duration)) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.firstKeyframeCallback = callback
+}
+
+// onVideoFrameWritten is called once a video frame made it to the file
+// Locked
+func (r *WebmRecorder) onVideoFrameWritten(size int, keyframe bool) {
+	r.stats.Video.WrittenSamples++
+	r.stats.Video.BytesWritten += uint64(size)
+	r.hasValidVideo = true
+	r.markVideoMute()
+	r.markVideoLoss()
+
+	if !keyframe || r.firstKeyframeWritten {
+		return
+	}
+
+	r.firstKeyframeWritten = true
+
+	if callback := r.firstKeyframeCallback; callback != nil {
+		go callback(r.videoTimestamp)
+	}
+}
+
+// onWriteError keeps the first failure to write the recording
+// Locked
+func (r *WebmRecorder) onWriteError(err error) {
+	if r.writeErr == nil {
+		r.writeErr = interfaces.WriteError(err)
+	}
+}
+
+// SetWriteFailureCallback sets a callback for when the recording can't be
+// written at all, its writers failing to be set up, with its WriteError.
+// It's called from its own goroutine.
+func (r *WebmRecorder) SetWriteFailureCallback(callback func(err error)) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.writeFailureCallback = callback
+}
+
+// failWriter gives up on writing the recording, its writers failing to be
+// set up on w (nil if not opened)
+// Locked
+func (r *WebmRecorder) failWriter(w io.Closer, err error) {
+	r.logger.Errorf("Cannot write recording %s: %v", r.file, err)
+
+	r.onWriteError(err)
+	r.writerFailed = true
+
+	if w != nil {
+		if err := w.Close(); err != nil {
+			r.logger.Warnf("Error closing recording after failing to write it: %v", err)
+		}
+	}
+
+	if callback := r.writeFailureCallback; callback != nil {
+		go callback(r.writeErr)
+	}
+}
+
+// WriteError returns the first failure to write the recording, either
+// interfaces.ErrDiskFull or interfaces.ErrWriteFailed, nil if none
+func (r *WebmRecorder) WriteError() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.writeErr
+}
+
 func (r *WebmRecorder) VideoTimestamp() time.Duration {
 	return r.videoTimestamp
 }
@@ -191,15 +748,81 @@ func (r *WebmRecorder) AudioTimestamp() time.Duration {
 	return r.audioTimestamp
 }
 
+// ReceivedPackets returns how many packets were pushed, whether they made
+// it into the recording or not. Unlike the media timestamps, it keeps
+// increasing while waiting for a keyframe or paused.
+func (r *WebmRecorder) ReceivedPackets() uint64 {
+	return r.videoPackets.Load() + r.audioPackets.Load()
+}
+
 func (r *WebmRecorder) GetStats() *types.RecorderStats {
+	// The mixer writes to the recorder while holding its own lock
+	var inputs map[string]*types.MixInputStats
+
+	if r.mixer != nil {
+		inputs = r.mixer.inputStats()
+	}
+
 	r.m.Lock()
 	defer r.m.Unlock()
 
 	stats := r.stats
+	stats.AudioInputs = inputs
+
+	if r.mixer != nil {
+		encoding := r.mixer.encoding
+		stats.AudioEncoding = &encoding
+	}
+
+	// Copies, the recorder keeps updating its own
+	if stats.Audio != nil {
+		audio := *stats.Audio
+		stats.Audio = &audio
+	}
+
+	if stats.Video != nil {
+		video := *stats.Video
+		stats.Video = &video
+	}
+
+	if stats.Trim != nil {
+		trim := *stats.Trim
+		stats.Trim = &trim
+	}
+
+	if stats.ConstantFrameRate != nil {
+		cfr := *stats.ConstantFrameRate
+		stats.ConstantFrameRate = &cfr
+	}
+
+	if r.started {
+		file := r.written.stats(r.now())
+		stats.File = &file
+	}
+
+	if r.snapshotter != nil {
+		snapshots := r.snapshotter.stats()
+		stats.Snapshots = &snapshots
+	}
+
+	if r.proxy != nil {
+		proxy := r.proxy.stats()
+		stats.Proxy = &proxy
+	}
+
+	stats.RawOutput = r.rawOutputStats()
+
+	if r.skew != nil {
+		avSync := r.skew.stats
+		stats.AVSync = &avSync
+	}
 
 	if stats.Audio != nil {
-		stats.Audio.EndTime = time.Now().Unix()
+		stats.Audio.EndTime = r.now().Unix()
 		stats.Audio.EndPTS = r.lastAudioPTS
+		stats.Audio.VoiceActivity = r.vad.snapshot(r.audioTimestamp)
+		stats.Audio.TimestampJumps = slices.Clone(r.audioRebaser.jumps)
+		stats.Audio.TimestampCorrections = int(r.timestampCorrections.audio.Load())
 
 		if stats.Audio.TotalSamples > 0 {
 			stats.Audio.AvgSampleDurationMs = stats.Audio.SampleDurationAcc /
@@ -214,8 +837,16 @@ func (r *WebmRecorder) GetStats() *types.RecorderStats {
 	}
 
 	if stats.Video != nil {
-		stats.Video.EndTime = time.Now().Unix()
+		stats.Video.EndTime = r.now().Unix()
 		stats.Video.EndPTS = r.pts
+		stats.Video.TimestampJumps = slices.Clone(r.videoRebaser.jumps)
+		stats.Video.TimestampCorrections = int(r.timestampCorrections.video.Load())
+
+		if r.vp8Layers != nil && r.videoCodec == CodecVP8 {
+			layer := int(r.vp8Layers.maxTID)
+			stats.Video.MaxTemporalLayer = &layer
+			stats.Video.DroppedLayerFrames += r.vp8Layers.droppedFrames
+		}
 
 		if stats.Video.TotalSamples > 0 {
 			stats.Video.AvgFrameSizeBytes = stats.Video.AvgFrameSizeBytes / stats.Video.TotalSamples
@@ -247,9 +878,30 @@ func (r *WebmRecorder) PushVideo(p *rtp.Packet) {
 		return
 	}
 
-	if !r.useCustomSampler {
+	r.videoPackets.Add(1)
+
+	if r.isPaused() {
+		return
+	}
+
+	r.notePayloadType(&r.videoPayloadType, p.PayloadType)
+
+	if p = r.filterVP8TemporalLayer(p); p == nil {
+		return
+	}
+
+	p = r.rebaseTimestamp(p, &r.videoRebaser, "video")
+
+	switch {
+	case r.videoCodec == CodecH264:
+		r.pushH264(p)
+	case r.videoCodec == CodecVP9:
+		r.pushVP9(p)
+	case r.videoCodec == CodecAV1:
+		r.pushAV1(p)
+	case !r.useCustomSampler:
 		r.pushVP8Builtin(p)
-	} else {
+	default:
 		r.pushVP8Custom(p)
 	}
 }
@@ -259,15 +911,118 @@ func (r *WebmRecorder) PushAudio(p *rtp.Packet) {
 		return
 	}
 
+	r.audioPackets.Add(1)
+
+	if r.isPaused() {
+		return
+	}
+
+	r.pushAudio(r.rebaseTimestamp(p, &r.audioRebaser, "audio"))
+}
+
+func (r *WebmRecorder) pushAudio(p *rtp.Packet) {
+	r.notePayloadType(&r.audioPayloadType, p.PayloadType)
+
+	if r.audioOnlyWAV && !r.hasVideo {
+		r.pushWAV(p)
+		return
+	}
+
 	r.pushOpus(p)
 }
 
+// Pause makes the recorder discard incoming media until Resume is called.
+// Writers and keyframe state are kept, so no new file is started.
+func (r *WebmRecorder) Pause() {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.paused || r.closed {
+		return
+	}
+
+	r.paused = true
+	r.pausedAt = r.now()
+	r.currentFrame = nil
+	r.currentFrameInfo = nil
+
+	r.logger.Infof("Recording paused: %s", r.file)
+}
+
+// Resume restarts writing after a Pause. The paused interval is added to the
+// media timestamps, clamped to maxPauseGap. Video is only written again once
+// a fresh keyframe, requested here, arrives.
+func (r *WebmRecorder) Resume() {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if !r.paused || r.closed {
+		return
+	}
+
+	r.paused = false
+	r.resumedAt = r.now()
+	r.resumeGap = r.resumedAt.Sub(r.pausedAt)
+
+	if r.resumeGap > maxPauseGap {
+		r.resumeGap = maxPauseGap
+	}
+
+	r.videoGapPending = r.videoWriter != nil
+	r.audioGapPending = r.audioWriter != nil || r.oggWriter != nil || r.wavWriter != nil
+
+	// Start from clean builders: the packets lost while paused would
+	// otherwise stall them, and the first sample's duration would span the
+	// whole pause
+	r.videoBuilder = r.newVideoBuilder()
+	r.audioBuilder = r.newAudioBuilder()
+	r.videoSeqTracker.expectedNextSeq = 0
+	r.audioSeqTracker.expectedNextSeq = 0
+
+	r.logger.Infof("Recording resumed after %v: %s", r.resumedAt.Sub(r.pausedAt), r.file)
+
+	if r.hasVideo {
+		r.hasKeyFrame = false
+		r.resumeKeyframePending = true
+		// Bypass the request throttling, the last request may be recent
+		r.lastKeyframeRequestTime = time.Time{}
+		r.RequestKeyframe()
+	}
+}
+
+func (r *WebmRecorder) isPaused() bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.paused
+}
+
+// Locked
+// consumePauseGap returns the media time to account for on the first sample
+// of a track written after a Resume: the clamped pause plus the time it took
+// for media to flow again.
+func (r *WebmRecorder) consumePauseGap(pending *bool) (time.Duration, bool) {
+	if !*pending {
+		return 0, false
+	}
+
+	*pending = false
+
+	return r.resumeGap + r.now().Sub(r.resumedAt), true
+}
+
 func (r *WebmRecorder) NotifySkippedPacket(seq uint16) {
 	r.m.Lock()
 	defer r.m.Unlock()
 
+	// Numbered as written, if VP8 temporal layers are filtered out
+	if r.vp8Layers != nil && r.videoCodec == CodecVP8 {
+		seq -= r.vp8Layers.seqOffset
+	}
+
 	r.lastSkippedSeq = seq
 	r.skipSignaled = true
+	r.wavSkipPending = true
 
 	// Frame in progress and skipped packet might belong to it, discard current
 	// frame to avoid stream corruption ( not that great but better than
@@ -286,8 +1041,7 @@ func (r *WebmRecorder) NotifySkippedPacket(seq uint16) {
 			)
 		}
 
-		log.WithField("session", r.ctx.Value("session")).
-			Warnf("Discarding frame due to skipped packet: seq=%d, frame=%v", seq, logMsgPkts)
+		r.logger.Warnf("Discarding frame due to skipped packet: seq=%d, frame=%v", seq, logMsgPkts)
 
 		r.currentFrame = nil
 		r.currentFrameInfo = nil
@@ -303,31 +1057,70 @@ func (r *WebmRecorder) close() time.Duration {
 	}
 	r.closed = true
 
+	if r.claimedFile != "" {
+		releaseFile(r.claimedFile)
+	}
+
+	finalized := r.startFlushDeadline()
+
 	if r.audioWriter != nil {
 		if err := r.audioWriter.Close(); err != nil {
 			panic(err)
 		}
 	}
+	if r.oggWriter != nil {
+		if err := r.oggWriter.Close(); err != nil {
+			r.logger.Warnf("Error closing Ogg writer: %v", err)
+		}
+	}
+	if r.wavWriter != nil {
+		if err := r.wavWriter.Close(); err != nil {
+			r.logger.Warnf("Error closing WAV writer: %v", err)
+		}
+	}
+	if r.wavDecoder != nil {
+		r.wavDecoder.Close()
+		r.wavDecoder = nil
+	}
+	if r.vadDecoder != nil {
+		r.vadDecoder.Close()
+		r.vadDecoder = nil
+	}
+	if r.lossMarkerWriter != nil {
+		if err := r.lossMarkerWriter.Close(); err != nil {
+			r.logger.Warnf("Error closing loss marker writer: %v", err)
+		}
+	}
 	if r.videoWriter != nil {
 		if err := r.videoWriter.Close(); err != nil {
 			panic(err)
 		}
 	}
+	finalized()
+	if r.snapshotter != nil {
+		r.snapshotter.close()
+	}
+	if r.proxy != nil {
+		r.proxy.close()
+	}
+	r.closeRawOutput()
+	// Closed already if its writers failed to be set up
+	if r.sink != nil && !r.started && !r.writerFailed {
+		if err := r.sink.Close(); err != nil {
+			r.logger.Warnf("Error closing recording sink: %v", err)
+		}
+	}
 	if r.started {
-		log.WithField("session", r.ctx.Value("session")).
-			Infof("webm writer closed: %s", r.file)
+		r.logger.Infof("webm writer closed: %s", r.file)
 	} else {
-		log.WithField("session", r.ctx.Value("session")).
-			Info("webm writer closed without starting")
+		r.logger.Info("webm writer closed without starting")
 	}
 
 	if r.ivfWriter != nil {
 		if err := r.ivfWriter.Close(); err != nil {
-			log.WithField("session", r.ctx.Value("session")).
-				Warnf("Error closing IVF writer: %v", err)
+			r.logger.Warnf("Error closing IVF writer: %v", err)
 		} else {
-			log.WithField("session", r.ctx.Value("session")).
-				Debugf("IVF writer closed")
+			r.logger.Debugf("IVF writer closed")
 		}
 
 		r.ivfWriter = nil
@@ -337,6 +1130,11 @@ func (r *WebmRecorder) close() time.Duration {
 }
 
 func (r *WebmRecorder) Close() time.Duration {
+	// The mix's tail goes through the usual audio path, which takes the lock
+	if r.mixer != nil {
+		r.mixer.flush()
+	}
+
 	r.m.Lock()
 	ts := r.close()
 	r.m.Unlock()
@@ -346,9 +1144,15 @@ func (r *WebmRecorder) Close() time.Duration {
 
 func (r *WebmRecorder) initVideoStats() {
 	if r.stats.Video == nil {
+		r.noteFirstMedia()
 		r.stats.Video = &types.RecorderTrackStats{
+			Codec:       r.videoCodec,
+			Layer:       r.videoLayer,
+			LayerWidth:  r.videoLayerWidth,
+			LayerHeight: r.videoLayerHeight,
+			Source:      r.videoSource,
 			BaseTrackStats: types.BaseTrackStats{
-				StartTime: time.Now().Unix(),
+				StartTime: r.now().Unix(),
 				StartPTS:  r.lastVideoPTS,
 				RTPDiscontInfo: types.DiscontinuityInfo{
 					Count:    0,
@@ -369,9 +1173,11 @@ func (r *WebmRecorder) initVideoStats() {
 
 func (r *WebmRecorder) initAudioStats() {
 	if r.stats.Audio == nil {
+		r.noteFirstMedia()
 		r.stats.Audio = &types.RecorderTrackStats{
+			Codec: CodecOpus,
 			BaseTrackStats: types.BaseTrackStats{
-				StartTime: time.Now().Unix(),
+				StartTime: r.now().Unix(),
 				StartPTS:  r.lastAudioPTS,
 				RTPDiscontInfo: types.DiscontinuityInfo{
 					Count:    0,
@@ -396,20 +1202,24 @@ func (r *WebmRecorder) pushVP8Builtin(packet *rtp.Packet) {
 		return
 	}
 
+	// The sample builder retains the packet: it gets a copy of its own
+	packet = copyPacket(packet)
+	defer r.videoRecycler.recycle()
+
 	r.initVideoStats()
 	isKeyFrame := IsVP8KeyFrame(packet)
 
 	if isKeyFrame {
-		r.currKeyFrame = packet
-		r.lastKeyFrameTime = time.Now()
+		r.currKeyFrameTs = packet.Timestamp
+		r.hasCurrKeyFrame = true
+		r.lastKeyFrameTime = r.now()
 	}
 
-	if r.videoSeqTracker.expectedNextSeq > 0 && packet.SequenceNumber != r.videoSeqTracker.expectedNextSeq {
-		gap := calculateSequenceGap(packet.SequenceNumber, r.videoSeqTracker.expectedNextSeq)
+	if gap, ok := r.sequenceGap(r.videoSeqTracker, &r.stats.Video.BaseTrackStats, packet.SequenceNumber); ok {
 		r.trackRTPDiscontinuity(&r.stats.Video.BaseTrackStats, gap)
+		r.noteVideoLoss(gap)
 
-		log.WithField("session", r.ctx.Value("session")).
-			WithField("expected_seq", r.videoSeqTracker.expectedNextSeq).
+		r.logger.WithField("expected_seq", r.videoSeqTracker.expectedNextSeq).
 			WithField("got_seq", packet.SequenceNumber).
 			WithField("gap", gap).
 			Debug("Video sequence discontinuity detected")
@@ -417,10 +1227,12 @@ func (r *WebmRecorder) pushVP8Builtin(packet *rtp.Packet) {
 
 	r.setExpectedNextSeq(packet.SequenceNumber, "video")
 	r.videoBuilder.Push(packet)
-	log.WithField("session", r.ctx.Value("session")).
-		Tracef("BUILTIN: VP8 RTP-DEPAY: seq=%d, ts=%d, marker=%v, S=%v, PictureID=%d, KeyFrame=%v, size=%d, PartID=%d",
+
+	if log.IsLevelEnabled(log.TraceLevel) {
+		r.logger.Tracef("BUILTIN: VP8 RTP-DEPAY: seq=%d, ts=%d, marker=%v, S=%v, PictureID=%d, KeyFrame=%v, size=%d, PartID=%d",
 			packet.SequenceNumber, packet.Timestamp, packet.Marker, isKeyFrame,
 			0, isKeyFrame, len(packet.Payload), 0)
+	}
 
 	for {
 		sample, ts := r.videoBuilder.PopWithTimestamp()
@@ -431,16 +1243,26 @@ func (r *WebmRecorder) pushVP8Builtin(packet *rtp.Packet) {
 
 		isKf := false
 
-		if r.currKeyFrame != nil {
-			isKf = ts == r.currKeyFrame.Timestamp
+		if r.hasCurrKeyFrame {
+			isKf = ts == r.currKeyFrameTs
 		}
 
-		if isKf && ((r.videoWriter == nil && r.hasVideo) ||
-			(r.audioWriter == nil && r.hasAudio) ||
-			(r.hasVideo && r.hasAudio && (!r.hasValidVideo || !r.hasValidAudio))) {
+		if r.resumeKeyframePending {
+			if !isKf {
+				r.RequestKeyframe()
+				continue
+			}
+
+			r.resumeKeyframePending = false
+		}
+
+		if isKf && r.needsWebmWriter() {
 			width, height := GetVP8KFDimension(packet)
-			log.WithField("session", r.ctx.Value("session")).
-				Tracef("Frame dimensions: %dx%d", width, height)
+
+			if log.IsLevelEnabled(log.TraceLevel) {
+				r.logger.Tracef("Frame dimensions: %dx%d", width, height)
+			}
+
 			r.initWriter(width, height)
 		}
 
@@ -449,19 +1271,29 @@ func (r *WebmRecorder) pushVP8Builtin(packet *rtp.Packet) {
 		r.trackFrameStats(r.stats.Video, len(sample.Data), isKf, duration)
 
 		if r.videoWriter != nil {
+			if gap, ok := r.consumePauseGap(&r.videoGapPending); ok {
+				duration = gap
+			}
+
+			r.startTimeline(&r.videoTimestamp, &r.videoTimelineStarted)
 			r.videoTimestamp += duration
-			log.WithField("session", r.ctx.Value("session")).
-				Tracef("Writing VP8 frame: ts=%d, size=%d, KF=%v", ts, len(sample.Data), isKf)
+			r.anchorSkew(true, ts)
+
+			if log.IsLevelEnabled(log.TraceLevel) {
+				r.logger.Tracef("Writing VP8 frame: ts=%d, size=%d, KF=%v", ts, len(sample.Data), isKf)
+			}
 
 			if _, err := r.videoWriter.Write(isKf, int64(r.videoTimestamp/time.Millisecond), sample.Data); err != nil {
-				log.WithField("session", r.ctx.Value("session")).
-					Errorf("Error writing video frame: %v", err)
+				r.logger.Errorf("Error writing video frame: %v", err)
+				r.onWriteError(err)
 				r.hasKeyFrame = false
 				r.RequestKeyframe()
 			} else {
-				r.stats.Video.WrittenSamples++
-				log.WithField("session", r.ctx.Value("session")).
-					Tracef("VP8 frame written: ts=%d, size=%d, KF=%v", ts, len(sample.Data), isKf)
+				r.onVideoFrameWritten(len(sample.Data), isKf)
+
+				if log.IsLevelEnabled(log.TraceLevel) {
+					r.logger.Tracef("VP8 frame written: ts=%d, size=%d, KF=%v", ts, len(sample.Data), isKf)
+				}
 			}
 		}
 
@@ -472,18 +1304,26 @@ func (r *WebmRecorder) pushVP8Builtin(packet *rtp.Packet) {
 }
 
 func (r *WebmRecorder) setExpectedNextSeq(currentSeq uint16, kind string) {
+	tracker := r.audioSeqTracker
+
 	if kind == r.videoSeqTracker.kind {
-		r.videoSeqTracker.expectedNextSeq = currentSeq + 1
-	} else if kind == r.audioSeqTracker.kind {
-		r.audioSeqTracker.expectedNextSeq = currentSeq + 1
+		tracker = r.videoSeqTracker
+	} else if kind != r.audioSeqTracker.kind {
+		return
 	}
+
+	// Late packets don't move a tolerant tracker back
+	if tracker.tolerance != nil && tracker.expectedNextSeq != 0 && currentSeq-tracker.expectedNextSeq >= 1<<15 {
+		return
+	}
+
+	tracker.expectedNextSeq = currentSeq + 1
 }
 
 func (r *WebmRecorder) pushOpus(op *rtp.Packet) {
 	defer func() {
 		if err := recover(); err != nil {
-			log.WithField("session", r.ctx.Value("session")).
-				WithField("error", err).
+			r.logger.WithField("error", err).
 				WithField("stack", string(debug.Stack())).
 				WithField("packet_seq", op.SequenceNumber).
 				WithField("packet_ts", op.Timestamp).
@@ -506,26 +1346,29 @@ func (r *WebmRecorder) pushOpus(op *rtp.Packet) {
 	r.m.Lock()
 	defer r.m.Unlock()
 
-	if len(op.Payload) == 0 || r.closed {
+	if len(op.Payload) == 0 || r.closed || r.audioFormatChanged {
 		return
 	}
 
 	// Create a deep copy of the packet before passing to the recorder
-	// since samplebuilder docs state that it retains the packet reference
-	p := &rtp.Packet{
-		Header:  op.Header,
-		Payload: make([]byte, len(op.Payload)),
-	}
-	copy(p.Payload, op.Payload)
+	// since samplebuilder docs state that it retains the packet reference.
+	// The copies it releases are recycled once done with this packet.
+	p := copyPacket(op)
+	defer r.audioRecycler.recycle()
 
 	r.initAudioStats()
+	r.measureVoiceActivity(p)
 
-	if r.audioSeqTracker.expectedNextSeq > 0 && p.SequenceNumber != r.audioSeqTracker.expectedNextSeq {
-		gap := calculateSequenceGap(p.SequenceNumber, r.audioSeqTracker.expectedNextSeq)
+	// Concealment doesn't wait for losses to be counted: samples late
+	// packets complete are left as they are (see concealAudio)
+	if expected := r.audioSeqTracker.expectedNextSeq; expected > 0 && p.SequenceNumber != expected {
+		r.noteAudioLoss(p.Timestamp)
+	}
+
+	if gap, ok := r.sequenceGap(r.audioSeqTracker, &r.stats.Audio.BaseTrackStats, p.SequenceNumber); ok {
 		r.trackRTPDiscontinuity(&r.stats.Audio.BaseTrackStats, gap)
 
-		log.WithField("session", r.ctx.Value("session")).
-			WithField("gap", gap).
+		r.logger.WithField("gap", gap).
 			WithField("expected_seq", r.audioSeqTracker.expectedNextSeq).
 			WithField("got_seq", p.SequenceNumber).
 			Debug("Audio sequence discontinuity detected")
@@ -535,7 +1378,7 @@ func (r *WebmRecorder) pushOpus(op *rtp.Packet) {
 	r.audioBuilder.Push(p)
 
 	for {
-		sample := r.audioBuilder.Pop()
+		sample, ts := r.audioBuilder.PopWithTimestamp()
 
 		if sample == nil {
 			return
@@ -543,46 +1386,99 @@ func (r *WebmRecorder) pushOpus(op *rtp.Packet) {
 
 		// Initialize writer here only if we have audio and no video
 		// Otherwise, we'll initialize it in pushVP8
-		if r.audioWriter == nil && r.hasAudio && !r.hasVideo {
+		if r.audioWriter == nil && r.oggWriter == nil && r.hasAudio && !r.hasVideo {
 			r.initWriter(0, 0)
 		}
 
-		if r.audioWriter != nil {
-			duration := sample.Duration
-			r.trackSampleStats(&r.stats.Audio.BaseTrackStats, duration)
-			r.audioTimestamp += duration
-
-			if _, err := r.audioWriter.Write(true, int64(r.audioTimestamp/time.Millisecond), sample.Data); err != nil {
-				log.WithField("session", r.ctx.Value("session")).
-					WithField("error", err).
-					WithField("duration", duration).
-					WithField("timestamp", r.audioTimestamp).
-					Error("Error writing audio frame")
-				r.hasValidAudio = false
-			} else {
-				r.stats.Audio.WrittenSamples++
-				r.hasValidAudio = true
-				log.WithField("session", r.ctx.Value("session")).
-					WithField("duration", duration).
-					WithField("timestamp", r.audioTimestamp).
-					WithField("size", len(sample.Data)).
-					Trace("Audio frame written")
+		for _, s := range r.fillSilence(r.fillDTX(r.concealAudio(sample.Data, sample.Duration, ts))) {
+			if r.oggWriter != nil {
+				r.writeOggAudio(s.data, s.duration, s.rtpTimestamp)
+			} else if r.audioWriter != nil {
+				r.writeWebmAudio(s.data, s.duration, s.rtpTimestamp)
+			} else if r.hasVideo {
+				// Held until the first video keyframe opens the file
+				r.queuePendingAudio(s.data, s.duration, s.rtpTimestamp)
 			}
 		}
 	}
 }
 
+// Locked
+func (r *WebmRecorder) writeOggAudio(data []byte, duration time.Duration, rtpTimestamp uint32) {
+	if gap, ok := r.consumePauseGap(&r.audioGapPending); ok {
+		duration = gap
+		r.oggWriter.Skip(uint64(gap.Seconds() * opusSampleRate))
+	}
+
+	r.trackSampleStats(&r.stats.Audio.BaseTrackStats, duration)
+	r.recordVoiceActivity(rtpTimestamp, r.audioTimestamp)
+	r.audioTimestamp += duration
+
+	if granule, err := r.oggWriter.WritePacket(data, rtpTimestamp); err != nil {
+		r.logger.WithField("error", err).
+			WithField("timestamp", r.audioTimestamp).
+			Error("Error writing audio frame")
+		r.onWriteError(err)
+		r.hasValidAudio = false
+	} else {
+		r.stats.Audio.WrittenSamples++
+		r.stats.Audio.BytesWritten += uint64(len(data))
+		r.hasValidAudio = true
+
+		if log.IsLevelEnabled(log.TraceLevel) {
+			r.logger.WithField("duration", duration).
+				WithField("timestamp", r.audioTimestamp).
+				WithField("granule", granule).
+				WithField("size", len(data)).
+				Trace("Audio frame written")
+		}
+	}
+}
+
+// Locked
+func (r *WebmRecorder) writeWebmAudio(data []byte, duration time.Duration, rtpTimestamp uint32) {
+	if gap, ok := r.consumePauseGap(&r.audioGapPending); ok {
+		duration = gap
+	}
+
+	r.startTimeline(&r.audioTimestamp, &r.audioTimelineStarted)
+	r.trackSampleStats(&r.stats.Audio.BaseTrackStats, duration)
+	r.recordVoiceActivity(rtpTimestamp, r.audioTimestamp)
+	r.audioTimestamp += duration
+	r.anchorSkew(false, rtpTimestamp)
+
+	if _, err := r.audioWriter.Write(true, int64(r.audioTimestamp/time.Millisecond), data); err != nil {
+		r.logger.WithField("error", err).
+			WithField("duration", duration).
+			WithField("timestamp", r.audioTimestamp).
+			Error("Error writing audio frame")
+		r.onWriteError(err)
+		r.hasValidAudio = false
+	} else {
+		r.stats.Audio.WrittenSamples++
+		r.stats.Audio.BytesWritten += uint64(len(data))
+		r.hasValidAudio = true
+
+		if log.IsLevelEnabled(log.TraceLevel) {
+			r.logger.WithField("duration", duration).
+				WithField("timestamp", r.audioTimestamp).
+				WithField("size", len(data)).
+				Trace("Audio frame written")
+		}
+	}
+}
+
 func (r *WebmRecorder) RequestKeyframe() {
 	if r.keyframeRequester == nil {
 		return
 	}
 
 	shouldRequest := r.lastKeyframeRequestTime.IsZero() ||
-		time.Since(r.lastKeyframeRequestTime) > time.Second
+		r.now().Sub(r.lastKeyframeRequestTime) > time.Second
 
 	if shouldRequest {
-		r.lastKeyframeRequestTime = time.Now()
-		log.WithField("session", r.ctx.Value("session")).Debug("Recorder is requesting keyframe")
+		r.lastKeyframeRequestTime = r.now()
+		r.logger.Debug("Recorder is requesting keyframe")
 		r.keyframeRequester.RequestKeyframe()
 	}
 }
@@ -684,22 +1580,22 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 
 	r.initVideoStats()
 
-	if r.videoSeqTracker.expectedNextSeq > 0 && p.SequenceNumber != r.videoSeqTracker.expectedNextSeq {
-		gap := calculateSequenceGap(p.SequenceNumber, r.videoSeqTracker.expectedNextSeq)
+	if gap, ok := r.sequenceGap(r.videoSeqTracker, &r.stats.Video.BaseTrackStats, p.SequenceNumber); ok {
 		r.trackRTPDiscontinuity(&r.stats.Video.BaseTrackStats, gap)
+		r.noteVideoLoss(gap)
 
 		if !r.skipSignaled {
-			log.WithField("session", r.ctx.Value("session")).
-				WithField("expected_seq", r.videoSeqTracker.expectedNextSeq).
+			r.logger.WithField("expected_seq", r.videoSeqTracker.expectedNextSeq).
 				WithField("got_seq", p.SequenceNumber).
 				WithField("gap", gap).
 				Debug("Video sequence discontinuity detected")
 		}
+	}
 
+	if r.videoSeqTracker.expectedNextSeq > 0 && p.SequenceNumber != r.videoSeqTracker.expectedNextSeq {
 		if r.skipSignaled && r.lastSkippedSeq+1 == p.SequenceNumber {
-			log.WithField("session", r.ctx.Value("session")).
-				Debugf("Processing first packet after skip: seq=%d, last_skipped=%d",
-					p.SequenceNumber, r.lastSkippedSeq)
+			r.logger.Debugf("Processing first packet after skip: seq=%d, last_skipped=%d",
+				p.SequenceNumber, r.lastSkippedSeq)
 
 			// Force treating this as a new frame start for safety
 			if r.currentFrame != nil {
@@ -709,8 +1605,7 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 					logMsgPkts = len(r.currentFrameInfo.packets)
 				}
 
-				log.WithField("session", r.ctx.Value("session")).
-					Warnf("Discarding partial frame after skip boundary: pkts=%v", logMsgPkts)
+				r.logger.Warnf("Discarding partial frame after skip boundary: pkts=%v", logMsgPkts)
 				r.currentFrame = nil
 				r.currentFrameInfo = nil
 			}
@@ -725,8 +1620,7 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 	vp8Packet := codecs.VP8Packet{}
 
 	if _, err := vp8Packet.Unmarshal(p.Payload); err != nil {
-		log.WithField("session", r.ctx.Value("session")).
-			Debugf("Failed to unmarshal VP8 packet: seq=%d, err=%v", p.SequenceNumber, err)
+		r.logger.Debugf("Failed to unmarshal VP8 packet: seq=%d, err=%v", p.SequenceNumber, err)
 		r.hasKeyFrame = false
 		r.RequestKeyframe()
 		return
@@ -736,17 +1630,17 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 	isKeyFrame := vp8Packet.S != 0 && (vp8Packet.Payload[0]&0x1 == 0) && vp8Packet.PID == 0
 	pictureID := vp8Packet.PictureID
 
-	log.WithField("session", r.ctx.Value("session")).
-		Tracef("VP8 RTP-DEPAY: seq=%d, ts=%d, marker=%v, S=%v, PictureID=%d, KeyFrame=%v, size=%d, PartID=%d",
+	if log.IsLevelEnabled(log.TraceLevel) {
+		r.logger.Tracef("VP8 RTP-DEPAY: seq=%d, ts=%d, marker=%v, S=%v, PictureID=%d, KeyFrame=%v, size=%d, PartID=%d",
 			p.SequenceNumber, p.Timestamp, p.Marker, vp8Packet.S == 1,
 			pictureID, isKeyFrame, len(vp8Packet.Payload), vp8Packet.PID)
+	}
 
 	// I don't fully get this: when testing with some extreme network scenarios,
 	// I got packets with S=1 and PID > 0. I have not had the time to investigate
 	// further, so try and make it work but log it - prlanzarin
 	if vp8Packet.S == 1 && vp8Packet.PID > 0 {
-		log.WithField("session", r.ctx.Value("session")).
-			Warnf("Mid-frame partition detected: seq=%d, PID=%d", p.SequenceNumber, vp8Packet.PID)
+		r.logger.Warnf("Mid-frame partition detected: seq=%d, PID=%d", p.SequenceNumber, vp8Packet.PID)
 		if r.currentFrameInfo != nil {
 			r.currentFrameInfo.packets = append(r.currentFrameInfo.packets, p.SequenceNumber)
 			r.currentFrame = append(r.currentFrame, vp8Packet.Payload[0:]...)
@@ -767,11 +1661,10 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 					len(r.currentFrameInfo.packets))
 			}
 
-			log.WithField("session", r.ctx.Value("session")).
-				Warnf("Discarding incomplete VP8 frame: packets=%v, size=%d, elapsed=%v, new_seq=%d",
-					logMsgPkts,
-					len(r.currentFrame),
-					time.Since(r.frameStartTime), p.SequenceNumber)
+			r.logger.Warnf("Discarding incomplete VP8 frame: packets=%v, size=%d, elapsed=%v, new_seq=%d",
+				logMsgPkts,
+				len(r.currentFrame),
+				r.now().Sub(r.frameStartTime), p.SequenceNumber)
 
 			r.currentFrame = nil
 			r.currentFrameInfo = nil
@@ -781,7 +1674,7 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 
 		r.vp8Tracker.partitionsStarted++
 		r.vp8Tracker.currentPartitionSize = 0
-		r.frameStartTime = time.Now()
+		r.frameStartTime = r.now()
 
 		r.currentFrameInfo = &VP8FrameInfo{
 			startSequence: p.SequenceNumber,
@@ -799,9 +1692,8 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 			pidDiff := (pictureID - r.lastPictureID) & 0x7FFF
 			if pidDiff > 1 && pidDiff < 0x7000 {
 				r.trackPicIDDiscontinuity(r.stats.Video, pidDiff-1)
-				log.WithField("session", r.ctx.Value("session")).
-					Debugf("VP8 Picture ID gap detected: expected=%d, got=%d (missing %d frames), seq=%d",
-						expectedID, pictureID, pidDiff-1, p.SequenceNumber)
+				r.logger.Debugf("VP8 Picture ID gap detected: expected=%d, got=%d (missing %d frames), seq=%d",
+					expectedID, pictureID, pidDiff-1, p.SequenceNumber)
 
 				if r.currentFrame != nil {
 					logPID := uint16(0)
@@ -810,9 +1702,8 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 						logPID = r.currentFrameInfo.pictureID
 					}
 
-					log.WithField("session", r.ctx.Value("session")).
-						Warnf("Discarding partial frame due to PictureID discontinuity (%d -> %d)",
-							logPID, pictureID)
+					r.logger.Warnf("Discarding partial frame due to PictureID discontinuity (%d -> %d)",
+						logPID, pictureID)
 
 					r.currentFrame = nil
 					r.currentFrameInfo = nil
@@ -820,17 +1711,16 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 
 				if isKeyFrame && vp8Packet.S == 1 {
 					// This is a new keyframe after discontinuity - ACCEPT IT
-					log.WithField("session", r.ctx.Value("session")).
-						Debugf("Accepting keyframe despite PictureID discontinuity: new picID=%d, seq=%d",
-							pictureID, p.SequenceNumber)
+					r.logger.Debugf("Accepting keyframe despite PictureID discontinuity: new picID=%d, seq=%d",
+						pictureID, p.SequenceNumber)
 
 					// Continue processing this keyframe
 					r.hasKeyFrame = true
-					r.lastKeyFrameTime = time.Now()
+					r.lastKeyFrameTime = r.now()
 
 					// Still update request state to avoid unnecessary PLIs
 					if r.lastKeyframeRequestTime.IsZero() {
-						r.lastKeyframeRequestTime = time.Now()
+						r.lastKeyframeRequestTime = r.now()
 					}
 				} else {
 					// For non-keyframes with discontinuity, reject and request keyframe
@@ -846,16 +1736,15 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 
 		// Check for timestamp discontinuity within a frame
 		if r.currentFrameInfo.timestamp != p.Timestamp {
-			log.WithField("session", r.ctx.Value("session")).
-				Warnf("Timestamp discontinuity in frame: expected=%d, got=%d, seq=%d",
-					r.currentFrameInfo.timestamp, p.Timestamp, p.SequenceNumber)
+			r.logger.Warnf("Timestamp discontinuity in frame: expected=%d, got=%d, seq=%d",
+				r.currentFrameInfo.timestamp, p.Timestamp, p.SequenceNumber)
 		}
 	}
 
 	r.vp8Tracker.currentPartitionSize += len(vp8Packet.Payload)
 
 	// Frame assembly timeout - TODO review later - prlanzarin
-	if r.currentFrame != nil && time.Since(r.frameStartTime) > r.frameTimeout {
+	if r.currentFrame != nil && r.now().Sub(r.frameStartTime) > r.frameTimeout {
 		var logMsgPkts = "unknown"
 
 		if r.currentFrameInfo != nil {
@@ -865,12 +1754,11 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 				len(r.currentFrameInfo.packets))
 		}
 
-		log.WithField("session", r.ctx.Value("session")).
-			Warnf("Frame assembly timed out after %v: packets=%v, size=%d",
-				r.frameTimeout,
-				logMsgPkts,
-				len(r.currentFrame),
-			)
+		r.logger.Warnf("Frame assembly timed out after %v: packets=%v, size=%d",
+			r.frameTimeout,
+			logMsgPkts,
+			len(r.currentFrame),
+		)
 
 		r.currentFrame = nil
 		r.currentFrameInfo = nil
@@ -882,9 +1770,12 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 
 	switch {
 	case !r.hasKeyFrame && !isKeyFrame:
-		log.WithField("session", r.ctx.Value("session")).
-			Tracef("Waiting for keyframe, dropping non-keyframe: seq=%d", p.SequenceNumber)
-		if !r.seenKeyFrame {
+
+		if log.IsLevelEnabled(log.TraceLevel) {
+			r.logger.Tracef("Waiting for keyframe, dropping non-keyframe: seq=%d", p.SequenceNumber)
+		}
+
+		if !r.seenKeyFrame || r.resumeKeyframePending {
 			r.RequestKeyframe()
 		}
 
@@ -892,8 +1783,7 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 		r.currentFrameInfo = nil
 		return
 	case r.currentFrame == nil && vp8Packet.S != 1:
-		log.WithField("session", r.ctx.Value("session")).
-			Debugf("Dropping continuation packet without start bit: seq=%d", p.SequenceNumber)
+		r.logger.Debugf("Dropping continuation packet without start bit: seq=%d", p.SequenceNumber)
 		r.currentFrameInfo = nil
 		r.hasKeyFrame = false
 		r.RequestKeyframe()
@@ -902,17 +1792,16 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 
 	if !r.hasKeyFrame {
 		if !r.seenKeyFrame {
-			log.WithField("session", r.ctx.Value("session")).
-				Infof("First keyframe received: seq=%d, timestamp=%d, picID=%d",
-					p.SequenceNumber, p.Timestamp, pictureID)
+			r.logger.Infof("First keyframe received: seq=%d, timestamp=%d, picID=%d",
+				p.SequenceNumber, p.Timestamp, pictureID)
 			r.seenKeyFrame = true
 			r.packetTimestamp = p.Timestamp
 		}
 
-		r.lastKeyFrameTime = time.Now()
-		log.WithField("session", r.ctx.Value("session")).
-			Debugf("Unblocking keyframe received: seq=%d, timestamp=%d, picID=%d",
-				p.SequenceNumber, p.Timestamp, pictureID)
+		r.lastKeyFrameTime = r.now()
+		r.resumeKeyframePending = false
+		r.logger.Debugf("Unblocking keyframe received: seq=%d, timestamp=%d, picID=%d",
+			p.SequenceNumber, p.Timestamp, pictureID)
 	}
 
 	if r.currentFrame != nil && len(r.currentFrame)+len(vp8Packet.Payload) > r.maxFrameSize {
@@ -925,11 +1814,10 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 				len(r.currentFrameInfo.packets))
 		}
 
-		log.WithField("session", r.ctx.Value("session")).
-			Warnf("Frame exceeds max size (%d bytes), discarding: packets=%v",
-				r.maxFrameSize,
-				logMsgPkts,
-			)
+		r.logger.Warnf("Frame exceeds max size (%d bytes), discarding: packets=%v",
+			r.maxFrameSize,
+			logMsgPkts,
+		)
 
 		r.currentFrame = nil
 		r.currentFrameInfo = nil
@@ -955,20 +1843,22 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 			r.currentFrameInfo.size = len(r.currentFrame)
 			r.lastPictureID = r.currentFrameInfo.pictureID
 
-			log.WithField("session", r.ctx.Value("session")).
-				Tracef("VP8 frame complete: seq=[%d-%d], ts=%d, packets=%d, size=%d, elapsed=%v, keyframe=%v",
+			if log.IsLevelEnabled(log.TraceLevel) {
+				r.logger.Tracef("VP8 frame complete: seq=[%d-%d], ts=%d, packets=%d, size=%d, elapsed=%v, keyframe=%v",
 					r.currentFrameInfo.startSequence, p.SequenceNumber,
 					p.Timestamp, len(r.currentFrameInfo.packets), len(r.currentFrame),
-					time.Since(r.currentFrameInfo.startTime), r.currentFrameInfo.isKeyFrame)
+					r.now().Sub(r.currentFrameInfo.startTime), r.currentFrameInfo.isKeyFrame)
+			}
 		}
 
-		log.WithField("session", r.ctx.Value("session")).
-			Tracef("VP8 partition stats: started=%d, complete=%d, lastSize=%d",
+		if log.IsLevelEnabled(log.TraceLevel) {
+			r.logger.Tracef("VP8 partition stats: started=%d, complete=%d, lastSize=%d",
 				r.vp8Tracker.partitionsStarted, r.vp8Tracker.partitionsComplete,
 				r.vp8Tracker.currentPartitionSize)
+		}
 
 		// Track frame stats when frame is complete, regardless of whether it's written
-		r.trackFrameStats(r.stats.Video, len(r.currentFrame), isKeyFrame, time.Since(r.frameStartTime))
+		r.trackFrameStats(r.stats.Video, len(r.currentFrame), isKeyFrame, r.now().Sub(r.frameStartTime))
 	}
 
 	if valid, reason := validateVP8Frame(r.currentFrame, r.currentFrameInfo); !valid {
@@ -982,8 +1872,7 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 			)
 		}
 
-		log.WithField("session", r.ctx.Value("session")).
-			Warnf("Discarding invalid VP8 frame: %s, packets=%v", reason, logMsgPkts)
+		r.logger.Warnf("Discarding invalid VP8 frame: %s, packets=%v", reason, logMsgPkts)
 
 		r.corruptedFrameCount++
 		r.currentFrame = nil
@@ -999,9 +1888,8 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 		if r.lastPictureID > 0 &&
 			pictureID != ((r.lastPictureID+1)&0x7FFF) &&
 			r.currentFrameInfo.pictureID != pictureID {
-			log.WithField("session", r.ctx.Value("session")).
-				Warnf("Picture ID mismatch in frame: start=%d, end=%d",
-					r.currentFrameInfo.pictureID, pictureID)
+			r.logger.Warnf("Picture ID mismatch in frame: start=%d, end=%d",
+				r.currentFrameInfo.pictureID, pictureID)
 		}
 	}
 
@@ -1009,64 +1897,78 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 	r.corruptedFrameCount = 0 // Reset corruption counter on valid frame
 
 	frameSize := len(r.currentFrame)
-	log.WithField("session", r.ctx.Value("session")).
-		Tracef("Assembled complete VP8 frame: keyframe=%v, size=%d",
+
+	if log.IsLevelEnabled(log.TraceLevel) {
+		r.logger.Tracef("Assembled complete VP8 frame: keyframe=%v, size=%d",
 			isKeyFrame, frameSize)
+	}
+
+	duration := time.Duration((float64(p.Timestamp-r.packetTimestamp)/float64(r.videoRate))*secondToNanoseconds) * time.Nanosecond
+
+	if r.videoWriter != nil {
+		if gap, ok := r.consumePauseGap(&r.videoGapPending); ok {
+			duration = gap
+		}
+	}
 
-	duration := time.Duration((float64(p.Timestamp-r.packetTimestamp)/float64(vp8SampleRate))*secondToNanoseconds) * time.Nanosecond
 	newVideoTs := r.videoTimestamp + duration
 	newPts := int64(newVideoTs / time.Millisecond)
 
-	log.WithField("session", r.ctx.Value("session")).
-		Tracef("Frame duration: %v, pts=%v, new timestamp: %v, prevPacketTS: %v, newPacketTS: %v",
+	if log.IsLevelEnabled(log.TraceLevel) {
+		r.logger.Tracef("Frame duration: %v, pts=%v, new timestamp: %v, prevPacketTS: %v, newPacketTS: %v",
 			duration, newPts, r.videoTimestamp+duration, r.packetTimestamp, p.Timestamp)
+	}
 
 	// Initialize writer if either:
 	// 1. We don't have a video writer yet and we have video
 	// 2. We don't have an audio writer yet and we have audio
-	// 3. We have both tracks but haven't received valid samples from both yet
-	if (r.videoWriter == nil && r.hasVideo) ||
-		(r.audioWriter == nil && r.hasAudio) ||
-		(r.hasVideo && r.hasAudio && (!r.hasValidVideo || !r.hasValidAudio)) {
+	if r.needsWebmWriter() {
 
 		raw := uint(r.currentFrame[6]) | uint(r.currentFrame[7])<<8 | uint(r.currentFrame[8])<<16 | uint(r.currentFrame[9])<<24
 		width := int(raw & 0x3FFF)
 		height := int((raw >> 16) & 0x3FFF)
 
-		log.WithField("session", r.ctx.Value("session")).
-			Tracef("Frame dimensions: %dx%d", width, height)
+		if log.IsLevelEnabled(log.TraceLevel) {
+			r.logger.Tracef("Frame dimensions: %dx%d", width, height)
+		}
 
 		r.initWriter(width, height)
 	}
 
 	if r.videoWriter != nil {
+		if r.startTimeline(&r.videoTimestamp, &r.videoTimelineStarted) {
+			newVideoTs = r.videoTimestamp + duration
+			newPts = int64(newVideoTs / time.Millisecond)
+		}
+
 		if r.pts > 0 && r.pts == newPts {
-			log.WithField("session", r.ctx.Value("session")).
-				Warnf("Duplicate frame detected: pts=%d, seq=[%d-%d], duration=%v, prevPacketTS=%d, newPacketTS=%d",
-					newPts, r.currentFrameInfo.startSequence, p.SequenceNumber, duration, r.packetTimestamp, p.Timestamp)
+			r.logger.Warnf("Duplicate frame detected: pts=%d, seq=[%d-%d], duration=%v, prevPacketTS=%d, newPacketTS=%d",
+				newPts, r.currentFrameInfo.startSequence, p.SequenceNumber, duration, r.packetTimestamp, p.Timestamp)
 		}
 
 		r.videoTimestamp = newVideoTs
 		r.packetTimestamp = p.Timestamp
 		r.pts = newPts
+		r.anchorSkew(true, p.Timestamp)
 
 		if isKeyFrame {
-			r.lastKeyFrameTime = time.Now()
+			r.lastKeyFrameTime = r.now()
 		}
 
-		log.WithField("session", r.ctx.Value("session")).
-			Tracef("Writing frame to WebM: pts=%d, isKey=%v, size=%d",
+		if log.IsLevelEnabled(log.TraceLevel) {
+			r.logger.Tracef("Writing frame to WebM: pts=%d, isKey=%v, size=%d",
 				newPts, isKeyFrame, frameSize)
+		}
 
 		if _, err := r.videoWriter.Write(isKeyFrame, newPts, r.currentFrame); err != nil {
-			log.WithField("session", r.ctx.Value("session")).
-				Errorf("Error writing video frame: %v", err)
+			r.logger.Errorf("Error writing video frame: %v", err)
+			r.onWriteError(err)
 			r.hasKeyFrame = false
 			r.RequestKeyframe()
 		} else {
 			var sSeq, eSeq, pktCount, stime, pictureID, timestamp int = 0, 0, 0, 0, 0, 0
 
-			r.stats.Video.WrittenSamples++
+			r.onVideoFrameWritten(len(r.currentFrame), isKeyFrame)
 
 			if r.currentFrameInfo != nil {
 				sSeq = int(r.currentFrameInfo.startSequence)
@@ -1077,12 +1979,13 @@ func (r *WebmRecorder) pushVP8Custom(p *rtp.Packet) {
 				pktCount = len(r.currentFrameInfo.packets)
 			}
 
-			log.WithField("session", r.ctx.Value("session")).
-				Tracef("Written VP8 frame to WebM: size=%d, pts=%d, seq=[%d-%d], ts=%d, picID=%d, keyframe=%v, pkts=%d, stime=%d",
+			if log.IsLevelEnabled(log.TraceLevel) {
+				r.logger.Tracef("Written VP8 frame to WebM: size=%d, pts=%d, seq=[%d-%d], ts=%d, picID=%d, keyframe=%v, pkts=%d, stime=%d",
 					len(r.currentFrame),
 					newPts,
 					sSeq, eSeq, timestamp, pictureID, isKeyFrame, pktCount, stime,
 				)
+			}
 		}
 
 		if r.writeIVFCopy {
@@ -1106,8 +2009,7 @@ func (r *WebmRecorder) startIVFWriter() error {
 
 		r.ivfWriter = ivf
 
-		log.WithField("session", r.ctx.Value("session")).
-			Infof("IVF copy enabled: %s", ivf.filePath)
+		r.logger.Infof("IVF copy enabled: %s", ivf.filePath)
 	}
 
 	return nil
@@ -1134,25 +2036,151 @@ func (r *WebmRecorder) pushToIVFWriter(frame []byte, p *rtp.Packet) {
 		err := r.ivfWriter.WriteFrame(frame, p.Timestamp, isKeyFrame)
 
 		if err != nil {
-			log.WithField("session", r.ctx.Value("session")).
-				Warnf("Failed to write frame to IVF copy: %v", err)
+			r.logger.Warnf("Failed to write frame to IVF copy: %v", err)
 		}
 	}
 }
 
 func (r *WebmRecorder) initWriter(width, height int) {
 	if !r.hasAudio && !r.hasVideo {
-		log.WithField("session", r.ctx.Value("session")).
-			Error("Cannot initialize writer: neither audio nor video tracks are present")
+		r.logger.Error("Cannot initialize writer: neither audio nor video tracks are present")
+		return
+	}
+
+	// Files are restarted (truncated) until both tracks are valid; a sink
+	// can't be rewound, so keep what was started
+	if (r.sink != nil && r.started) || r.writerFailed {
+		return
+	}
+
+	var w io.WriteCloser = r.sink
+
+	if w == nil && !r.isSegmented() {
+		log.WithField("file", r.file).WithField("fileMode", r.fileMode).Debug("Opening file for writing")
+		f, err := os.OpenFile(r.file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, r.fileMode)
+		if err != nil {
+			r.failWriter(nil, err)
+			return
+		}
+
+		w = r.encryptFile(r.preallocateFile(f, 0))
+	}
+
+	// Restarted files start over
+	r.written.reset()
+
+	if w != nil {
+		w = r.proxyWriter(r.indexFile(r.written.wrap(r.flushGuard.wrap(w))))
+	}
+
+	if r.containerExt() == ".wav" && !r.hasVideo {
+		wav, err := NewWAVWriter(w, r.wavSampleRate, r.wavChannels)
+
+		if err != nil {
+			r.failWriter(w, err)
+			return
+		}
+
+		r.wavWriter = wav
+		r.started = true
+		r.logger.Infof("wav writer started: %s", r.file)
+
 		return
 	}
 
-	log.WithField("file", r.file).WithField("fileMode", r.fileMode).Debug("Opening file for writing")
-	w, err := os.OpenFile(r.file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, r.fileMode)
+	if r.containerExt() == ".ogg" && !r.hasVideo {
+		ogg, err := NewOggOpusWriter(w, r.audioFormat)
+
+		if err != nil {
+			r.failWriter(w, err)
+			return
+		}
+
+		r.oggWriter = ogg
+		r.started = true
+		r.logger.Infof("ogg writer started: %s", r.file)
+
+		return
+	}
+
+	r.resetTimelines()
+
+	if r.hasVideo && (width == 0 || height == 0) {
+		// TODO: the webm writer should NOT have uneeded tracks if they are not necessary.
+		// Review this - prlanzarin
+		width = 640
+		height = 480
+		r.logger.Debug("Using default video dimensions for audio-only initialization")
+	}
+
+	var writers []webm.BlockWriteCloser
+	var err error
+	muxer := "webm"
+
+	if r.containerExt() == ".mp4" {
+		muxer = "fmp4"
+	}
+
+	if r.isSegmented() {
+		muxer = "segmented " + muxer
+		writers, err = r.newSegmentWriters(width, height)
+	} else {
+		writers, err = r.newWriters(w, width, height)
+	}
+
 	if err != nil {
-		panic(err)
+		r.failWriter(w, err)
+		return
+	}
+
+	writers = r.trimWriters(r.rawWriters(r.cfrWriters(r.snapshotWriters(r.monotonicWriters(writers)))))
+
+	r.logger.Infof("%s writers started with video=%t, audio=%t : %s", muxer, r.hasVideo, r.hasAudio, r.file)
+
+	writerIndex := 0
+
+	if r.hasVideo {
+		r.videoWriter = writers[writerIndex]
+		writerIndex++
+	}
+
+	if r.hasAudio && writerIndex < len(writers) {
+		r.audioWriter = writers[writerIndex]
+		writerIndex++
+	}
+
+	if r.writesLossMarkers() && writerIndex < len(writers) {
+		r.lossMarkerWriter = writers[writerIndex]
+	}
+
+	r.started = true
+	r.trimPendingAudio()
+	r.flushPendingAudio()
+
+	if r.writeIVFCopy && r.hasVideo && r.videoCodec == CodecVP8 {
+		if err := r.startIVFWriter(); err != nil {
+			r.logger.Warnf("Error starting RTP ivf: %v", err)
+		}
+	}
+}
+
+// Locked
+func (r *WebmRecorder) newWriters(w io.WriteCloser, width, height int) ([]webm.BlockWriteCloser, error) {
+	if r.containerExt() == ".mp4" {
+		var userData []byte
+
+		if tags := r.sortedTags(); len(tags) > 0 {
+			userData = mp4UserData(tags)
+		}
+
+		return newFMP4Writer(w, r.fmp4Tracks(width, height), r.fmp4FragmentDuration, r.RequestKeyframe, userData)
 	}
 
+	return r.newWebmWriters(w, width, height)
+}
+
+// Locked
+func (r *WebmRecorder) newWebmWriters(w io.WriteCloser, width, height int) ([]webm.BlockWriteCloser, error) {
 	info := &webm.Info{
 		TimecodeScale: 1000000, // 1ms
 		MuxingApp:     internal.AppName,
@@ -1162,21 +2190,14 @@ func (r *WebmRecorder) initWriter(width, height int) {
 	var tracks []webm.TrackEntry
 
 	if r.hasVideo {
-		// TODO: the webm writer should NOT have uneeded tracks if they are not necessary.
-		// Review this - prlanzarin
-		if width == 0 || height == 0 {
-			width = 640
-			height = 480
-			log.WithField("session", r.ctx.Value("session")).
-				Debug("Using default video dimensions for audio-only initialization")
-		}
-
 		tracks = append(tracks, webm.TrackEntry{
-			Name:        "Video",
-			TrackNumber: 1,
-			TrackUID:    12345,
-			CodecID:     "V_VP8",
-			TrackType:   1,
+			Name:            "Video",
+			TrackNumber:     1,
+			TrackUID:        12345,
+			CodecID:         videoCodecID(r.videoCodec),
+			CodecPrivate:    r.videoCodecPrivate(),
+			TrackType:       1,
+			DefaultDuration: r.frameDuration(),
 			Video: &webm.Video{
 				PixelWidth:  uint64(width),
 				PixelHeight: uint64(height),
@@ -1187,61 +2208,96 @@ func (r *WebmRecorder) initWriter(width, height int) {
 	// Audio track is optional
 	if r.hasAudio {
 		tracks = append(tracks, webm.TrackEntry{
-			Name:        "Audio",
-			TrackNumber: uint64(len(tracks) + 1),
-			TrackUID:    54321,
-			CodecID:     "A_OPUS",
-			TrackType:   2,
+			Name:         "Audio",
+			TrackNumber:  uint64(len(tracks) + 1),
+			TrackUID:     54321,
+			CodecID:      "A_OPUS",
+			CodecPrivate: r.audioFormat.opusHead(),
+			TrackType:    2,
 			Audio: &webm.Audio{
 				SamplingFrequency: 48000.0,
-				Channels:          2,
+				Channels:          uint64(r.audioFormat.Channels),
 			},
 		})
 	}
 
-	interceptor, err := mkvcore.NewMultiTrackBlockSorter(
+	sorterOpts := []mkvcore.MultiTrackBlockSorterOption{
 		mkvcore.WithMaxDelayedPackets(r.sorterPacketQueueSize),
 		mkvcore.WithSortRule(mkvcore.BlockSorterWriteOutdated),
-	)
+	}
+
+	if r.writesLossMarkers() {
+		tracks = append(tracks, lossMarkerTrack(uint64(len(tracks)+1)))
+		// Otherwise blocks would wait for the marker track until the queue
+		// is full
+		sorterOpts = append(sorterOpts, mkvcore.WithMaxTimescaleDelay(lossMarkerMaxDelay))
+	}
+
+	interceptor, err := mkvcore.NewMultiTrackBlockSorter(sorterOpts...)
 
 	if err != nil {
-		// TODO review - panic is not the best choice here.
-		panic(err)
+		return nil, err
 	}
 
-	writers, err := webm.NewSimpleBlockWriter(
-		w,
-		tracks,
+	opts := []mkvcore.BlockWriterOption{
 		mkvcore.WithSegmentInfo(info),
-		mkvcore.WithBlockInterceptor(interceptor),
-	)
+		mkvcore.WithBlockInterceptor(&monotonicInterceptor{
+			BlockInterceptor: interceptor,
+			r:                r,
+			kinds:            r.trackKinds(len(tracks)),
+		}),
+	}
 
-	if err != nil {
-		// TODO review - panic is not the best choice here.
-		panic(err)
+	if r.containerExt() == ".mkv" {
+		opts = append(opts, mkvcore.WithEBMLHeader(mkv.DefaultEBMLHeader))
 	}
 
-	log.WithField("session", r.ctx.Value("session")).
-		Infof("webm writers started with video=%t, audio=%t : %s", r.hasVideo, r.hasAudio, r.file)
+	if r.cueFlushInterval > 0 && r.hasVideo {
+		// Clusters start at the first keyframe past the interval, so there's
+		// a cue point about as often
+		opts = append(opts, mkvcore.WithMaxKeyframeInterval(1, maxClusterDuration-r.cueFlushInterval.Milliseconds()))
+	}
 
-	writerIndex := 0
+	if r.isMKVOutput() && !r.isSegmented() {
+		w = &trailerWriter{WriteCloser: w, trailer: r.chaptersTrailer}
+	}
 
-	if r.hasVideo {
-		r.videoWriter = writers[writerIndex]
-		writerIndex++
+	tags := r.sortedTags()
+
+	if len(tags) == 0 {
+		return webm.NewSimpleBlockWriter(w, tracks, opts...)
 	}
 
-	if r.hasAudio && writerIndex < len(writers) {
-		r.audioWriter = writers[writerIndex]
+	element, err := matroskaTags(tags)
+
+	if err != nil {
+		return nil, err
 	}
 
-	r.started = true
+	// The Segment is written with an unknown size, so the Tags can follow
+	// its Tracks, held until then, before the first Cluster
+	hw := &headerWriter{w: w}
+	writers, err := webm.NewSimpleBlockWriter(hw, tracks, opts...)
 
-	if r.writeIVFCopy && r.hasVideo {
-		if err := r.startIVFWriter(); err != nil {
-			log.WithField("session", r.ctx.Value("session")).
-				Warnf("Error starting RTP ivf: %v", err)
-		}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := hw.flush(element); err != nil {
+		return nil, err
+	}
+
+	return writers, nil
+}
+
+func (r *WebmRecorder) videoCodecPrivate() []byte {
+	switch r.videoCodec {
+	case CodecH264:
+		return buildAVCDecoderConfig(r.h264SPS, r.h264PPS)
+	case CodecAV1:
+		return buildAV1CodecConfig(r.av1SeqHeader)
+	default:
+		return nil
 	}
 }
 
@@ -1255,6 +2311,11 @@ func (r *WebmRecorder) trackRTPDiscontinuity(stats *types.BaseTrackStats, gap ui
 	stats.RTPDiscontInfo.Count++
 	stats.RTPDiscontInfo.TotalGap += gap
 
+	// Not a backwards jump
+	if gap < 1<<15 {
+		stats.LostPackets += uint64(gap)
+	}
+
 	if gap < stats.RTPDiscontInfo.MinGap || stats.RTPDiscontInfo.MinGap == 0 {
 		stats.RTPDiscontInfo.MinGap = gap
 	}
@@ -1306,6 +2367,7 @@ func (r *WebmRecorder) trackSampleStats(stats *types.BaseTrackStats, duration ti
 		return
 	}
 
+	r.written.sample(r.now())
 	stats.TotalSamples++
 	stats.SampleDurationAcc += durationMs
 
@@ -0,0 +1,561 @@
+package recorder
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/clock"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/interfaces"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingKeyframeRequester struct {
+	requests int
+}
+
+func (k *countingKeyframeRequester) RequestKeyframe()                   { k.requests++ }
+func (k *countingKeyframeRequester) RequestKeyframeForSSRC(ssrc uint32) { k.requests++ }
+
+func TestWebmRecorder_PauseResume(t *testing.T) {
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, true)
+	r.SetHasAudio(true)
+
+	seq := uint16(0)
+	push := func(ts uint32) {
+		r.PushAudio(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: ts},
+			Payload: []byte{0xFC, 0xAA, 0xBB},
+		})
+		seq++
+	}
+
+	for i := uint32(0); i < 10; i++ {
+		push(i * 960)
+	}
+
+	before := r.AudioTimestamp()
+	written := r.GetStats().Audio.WrittenSamples
+
+	r.Pause()
+
+	// Discarded while paused
+	for i := uint32(10); i < 20; i++ {
+		push(i * 960)
+	}
+
+	assert.Equal(t, written, r.GetStats().Audio.WrittenSamples)
+
+	r.Resume()
+
+	// The source kept going for ~10 minutes meanwhile
+	for i := uint32(30000); i < 30010; i++ {
+		push(i * 960)
+	}
+
+	r.Close()
+
+	// 9 samples of 20ms after the first one, plus a pause gap of at most maxPauseGap
+	gap := r.AudioTimestamp() - before - 9*20*time.Millisecond
+	assert.GreaterOrEqual(t, gap, time.Duration(0))
+	assert.LessOrEqual(t, gap, maxPauseGap+100*time.Millisecond)
+	assert.Greater(t, r.GetStats().Audio.WrittenSamples, written)
+}
+
+func TestWebmRecorder_PauseGap(t *testing.T) {
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, false)
+	r.SetHasAudio(true)
+	clk := clock.NewMock(time.Unix(1000, 0))
+	r.WithClock(clk)
+
+	seq := uint16(0)
+	push := func(ts uint32) {
+		r.PushAudio(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: ts},
+			Payload: []byte{0xFC, 0xAA, 0xBB},
+		})
+		seq++
+		clk.Add(20 * time.Millisecond)
+	}
+
+	for i := uint32(0); i < 10; i++ {
+		push(i * 960)
+	}
+
+	before := r.AudioTimestamp()
+	r.Pause()
+	clk.Add(500 * time.Millisecond)
+	r.Resume()
+
+	for i := uint32(100); i < 103; i++ {
+		push(i * 960)
+	}
+
+	// The first sample after resuming spans the pause and the 20ms it took
+	// for the next one to arrive
+	assert.Equal(t, before+500*time.Millisecond+20*time.Millisecond+20*time.Millisecond, r.AudioTimestamp())
+
+	r.Pause()
+	clk.Add(time.Minute)
+	r.Resume()
+	before = r.AudioTimestamp()
+	push(200 * 960)
+	push(201 * 960)
+	assert.Equal(t, before+maxPauseGap+20*time.Millisecond, r.AudioTimestamp(), "Clamped to maxPauseGap")
+
+	r.Close()
+}
+
+func TestWebmRecorder_ResumeRequestsKeyframe(t *testing.T) {
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, true, false, false)
+	r.SetHasVideo(true)
+
+	requester := &countingKeyframeRequester{}
+	r.SetKeyframeRequester(requester)
+
+	r.Resume()
+	assert.Equal(t, 0, requester.requests, "Resume without Pause is a no-op")
+
+	r.RequestKeyframe()
+	r.Pause()
+	r.Resume()
+	assert.Equal(t, 2, requester.requests, "Resume bypasses keyframe request throttling")
+	assert.True(t, r.resumeKeyframePending)
+
+	r.Pause()
+	r.Close()
+	r.Resume()
+	assert.Equal(t, 2, requester.requests, "Resume after Close is a no-op")
+}
+
+// streamSink is a non-seekable sink
+type streamSink struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (s *streamSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestWebmRecorder_WithWriter(t *testing.T) {
+	sink := &streamSink{}
+	r, err := NewRecorderWithWriter(context.Background(), config.Recorder{
+		VideoPacketQueueSize: 256,
+		AudioPacketQueueSize: 64,
+	}, sink)
+	require.NoError(t, err)
+	r.SetHasAudio(true)
+
+	assert.Equal(t, "", r.GetFilePath())
+
+	for i := 0; i < 10; i++ {
+		r.PushAudio(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * 960)},
+			Payload: []byte{0xFC, 0xAA, 0xBB},
+		})
+	}
+
+	r.Close()
+
+	assert.True(t, sink.closed)
+	assert.Equal(t, []byte{0x1A, 0x45, 0xDF, 0xA3}, sink.Bytes()[:4], "EBML header")
+	assert.Contains(t, sink.String(), "webm")
+	assert.Contains(t, sink.String(), "A_OPUS")
+	assert.Greater(t, r.GetStats().Audio.WrittenSamples, 0)
+}
+
+func TestWebmRecorder_WithWriterClosedWithoutMedia(t *testing.T) {
+	sink := &streamSink{}
+	r, err := NewRecorderWithWriter(context.Background(), config.Recorder{}, sink)
+	require.NoError(t, err)
+
+	r.Close()
+	assert.True(t, sink.closed)
+	assert.Zero(t, sink.Len())
+
+	_, err = NewRecorderWithWriter(context.Background(), config.Recorder{}, nil)
+	assert.Error(t, err)
+}
+
+func TestWebmRecorder_WithWriterOptions(t *testing.T) {
+	for name, cfg := range map[string]config.Recorder{
+		"segments":   {Segments: config.Segments{Enable: true, Duration: time.Minute}},
+		"snapshots":  {Snapshots: config.Snapshots{Enable: true}},
+		"proxy":      {Proxy: config.Proxy{Enable: true}},
+		"encryption": {Encryption: config.Encryption{Enable: true}},
+	} {
+		_, err := NewRecorderWithWriter(context.Background(), cfg, &streamSink{})
+		assert.Error(t, err, "%s is rejected", name)
+	}
+
+	rec, err := NewRecorderWithWriter(context.Background(), config.Recorder{
+		Cues:      config.Cues{FlushInterval: time.Second},
+		RawOutput: config.RawOutput{Enable: true, AudioPath: "/tmp/audio.raw", SampleRate: 48000, Channels: 2},
+		Tags:      map[string]string{"TITLE": "Talk"},
+	}, &streamSink{})
+	require.NoError(t, err)
+	r := rec.(*WebmRecorder)
+
+	assert.Zero(t, r.cueFlushInterval, "Cues are ignored")
+	assert.True(t, r.rawOutputCfg.Enable, "As files are, but for those options")
+	assert.NotEmpty(t, r.tags)
+}
+
+func TestWebmRecorder_WithWriterOgg(t *testing.T) {
+	sink := &streamSink{}
+	r, err := NewRecorderWithWriter(context.Background(), config.Recorder{
+		AudioPacketQueueSize: 64,
+		AudioOnlyOgg:         true,
+	}, sink)
+	require.NoError(t, err)
+	r.SetHasAudio(true)
+
+	for i := 0; i < 5; i++ {
+		r.PushAudio(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * 960)},
+			Payload: []byte{0xFC, 0xAA, 0xBB},
+		})
+	}
+
+	// Can't restart a stream as WebM
+	r.SetHasVideo(true)
+	assert.False(t, r.GetHasVideo())
+
+	r.Close()
+
+	pages := readOggPages(t, sink.Bytes())
+	require.Greater(t, len(pages), 2)
+	assert.Equal(t, uint8(oggHeaderTypeEOS), pages[len(pages)-1].headerType)
+}
+
+// fullSink is a sink on a full disk
+type fullSink struct {
+	writes, closes int
+}
+
+func (s *fullSink) Write(p []byte) (int, error) {
+	s.writes++
+	return 0, syscall.ENOSPC
+}
+
+func (s *fullSink) Close() error {
+	s.closes++
+	return nil
+}
+
+func TestWebmRecorder_WriterFailure(t *testing.T) {
+	sink := &fullSink{}
+	rec, err := NewRecorderWithWriter(context.Background(), config.Recorder{
+		AudioPacketQueueSize: 64,
+		AudioOnlyOgg:         true,
+	}, sink)
+	require.NoError(t, err)
+	r := rec.(*WebmRecorder)
+	failed := make(chan error, 1)
+	r.SetWriteFailureCallback(func(err error) { failed <- err })
+	r.SetHasAudio(true)
+
+	for i := 0; i < 10; i++ {
+		r.PushAudio(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * 960)},
+			Payload: opusSilence(false),
+		})
+	}
+
+	select {
+	case err := <-failed:
+		assert.ErrorIs(t, err, interfaces.ErrDiskFull)
+	case <-time.After(time.Second):
+		t.Fatal("Failure not reported")
+	}
+
+	assert.Equal(t, 1, sink.writes, "Nothing more is written")
+	r.Close()
+	assert.Equal(t, 1, sink.closes)
+	assert.ErrorIs(t, r.WriteError(), interfaces.ErrDiskFull)
+}
+
+// avSyncSource feeds 50fps Opus and 30fps VP8 (all keyframes) at the pace
+// of a fake clock
+type avSyncSource struct {
+	r        *WebmRecorder
+	clock    time.Time
+	audioSeq uint16
+	audioTs  uint32
+	videoSeq uint16
+	videoTs  uint32
+	// Video frames per keyframe, 0 for keyframes only
+	gop int
+}
+
+func newAVSyncSource(t *testing.T) *avSyncSource {
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 256, 64, false, false, false)
+	r.SetHasVideo(true)
+	r.SetHasAudio(true)
+
+	s := &avSyncSource{r: r, clock: time.Unix(1000, 0)}
+	r.now = func() time.Time { return s.clock }
+
+	return s
+}
+
+// run advances the clock by d, pushing the enabled tracks meanwhile
+func (s *avSyncSource) run(d time.Duration, audio, video bool) {
+	const step = time.Millisecond
+	nextAudio, nextVideo := time.Duration(0), time.Duration(0)
+
+	for elapsed := time.Duration(0); elapsed < d; elapsed += step {
+		if audio && elapsed >= nextAudio {
+			s.r.PushAudio(&rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: s.audioSeq, Timestamp: s.audioTs},
+				Payload: []byte{0xFC, 0xAA, 0xBB},
+			})
+			s.audioSeq++
+			s.audioTs += 960
+			nextAudio += 20 * time.Millisecond
+		}
+
+		if video && elapsed >= nextVideo {
+			payload := []byte{0x10, 0x00, 0x00, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01}
+
+			if s.gop > 0 && int(s.videoSeq)%s.gop != 0 {
+				payload = []byte{0x10, 0x01, 0x00, 0x00, 0xAA}
+			}
+
+			s.r.PushVideo(&rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: s.videoSeq, Timestamp: s.videoTs, Marker: true},
+				Payload: payload,
+			})
+			s.videoSeq++
+			s.videoTs += 3000
+			nextVideo += time.Second / 30
+		}
+
+		s.clock = s.clock.Add(step)
+	}
+}
+
+func TestWebmRecorder_AVSyncLateVideo(t *testing.T) {
+	s := newAVSyncSource(t)
+
+	s.run(3*time.Second, true, false)
+	assert.Zero(t, s.r.GetStats().Audio.WrittenSamples, "Audio waits for the first video keyframe")
+
+	s.run(time.Second, true, true)
+	s.r.Close()
+
+	assert.InDelta(t, 4*time.Second, s.r.AudioTimestamp(), float64(100*time.Millisecond))
+	assert.InDelta(t, s.r.AudioTimestamp(), s.r.VideoTimestamp(), float64(100*time.Millisecond))
+	assert.Greater(t, s.r.GetStats().Audio.WrittenSamples, 190, "Audio from before video must be kept")
+}
+
+func TestWebmRecorder_AVSyncLateAudio(t *testing.T) {
+	s := newAVSyncSource(t)
+
+	s.run(3*time.Second, false, true)
+	s.run(time.Second, true, true)
+	s.r.Close()
+
+	assert.InDelta(t, 4*time.Second, s.r.VideoTimestamp(), float64(100*time.Millisecond))
+	assert.InDelta(t, s.r.VideoTimestamp(), s.r.AudioTimestamp(), float64(100*time.Millisecond))
+	assert.Greater(t, s.r.GetStats().Video.WrittenSamples, 110, "Video from before audio must be kept")
+}
+
+func TestWebmRecorder_PendingAudioBounded(t *testing.T) {
+	s := newAVSyncSource(t)
+
+	s.run(maxPendingAudio+2*time.Second, true, false)
+	assert.LessOrEqual(t, s.r.pendingAudioDuration, maxPendingAudio)
+	assert.WithinDuration(t, s.clock.Add(-maxPendingAudio), s.r.pendingAudioStart, 100*time.Millisecond,
+		"Dropped samples move the start of the pending audio")
+}
+
+func TestWebmRecorder_FirstKeyframeCallback(t *testing.T) {
+	r := NewWebmRecorder(filepath.Join(t.TempDir(), "rec.webm"), 0600, 4, 64, false, false, false)
+	r.SetHasVideo(true)
+	require.NoError(t, r.SetVideoCodec("video/VP9"))
+
+	keyframes := make(chan time.Duration, 4)
+	r.SetFirstKeyframeCallback(func(timestamp time.Duration) {
+		keyframes <- timestamp
+	})
+
+	for i := uint16(0); i < 6; i++ {
+		d := vp9TestDescriptor{pictureID: i, inter: i%3 != 0, tl0PicIdx: uint8(i), start: true, end: true}
+		data := make([]byte, 16)
+
+		// Two keyframes
+		if !d.inter {
+			data = testVP9Keyframe
+		}
+
+		r.PushVideo(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: 100 + i, Timestamp: uint32(i) * 3000, Marker: true},
+			Payload: d.payload(data),
+		})
+	}
+
+	r.Close()
+
+	select {
+	case ts := <-keyframes:
+		assert.Less(t, ts, 100*time.Millisecond, "The first keyframe starts the recording")
+	case <-time.After(time.Second):
+		t.Fatal("First keyframe callback not called")
+	}
+
+	assert.Equal(t, 2, r.GetStats().Video.KeyframeCount)
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, keyframes, "Only the first keyframe is reported")
+}
+
+// discardSink is a non-seekable sink that keeps nothing
+type discardSink struct{}
+
+func (discardSink) Write(p []byte) (int, error) { return len(p), nil }
+func (discardSink) Close() error                { return nil }
+
+// The recorder itself allocates nothing per packet once writing: what's
+// reported is the sample builders' and the muxer's
+func BenchmarkWebmRecorder_PushVideo(b *testing.B) {
+	packets := make([]*rtp.Packet, 65535)
+
+	for i := range packets {
+		packets[i] = &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i) * 3000, Marker: true},
+			Payload: []byte{0x10, 0x00, 0x00, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01},
+		}
+	}
+
+	b.ReportAllocs()
+	before := readMemStats()
+
+	for b.Loop() {
+		r, err := NewRecorderWithWriter(context.Background(), config.Recorder{VideoPacketQueueSize: 256}, discardSink{})
+		require.NoError(b, err)
+		r.SetHasVideo(true)
+
+		for _, p := range packets {
+			r.PushVideo(p)
+		}
+
+		r.Close()
+	}
+
+	reportAllocsPerPacket(b, before, len(packets))
+}
+
+func BenchmarkWebmRecorder_PushAudio(b *testing.B) {
+	p := &rtp.Packet{Header: rtp.Header{Version: 2}, Payload: []byte{0xFC, 0xAA, 0xBB}}
+
+	b.ReportAllocs()
+	before := readMemStats()
+
+	for b.Loop() {
+		r, err := NewRecorderWithWriter(context.Background(), config.Recorder{AudioPacketQueueSize: 64}, discardSink{})
+		require.NoError(b, err)
+		r.SetHasAudio(true)
+
+		for i := 0; i < 65535; i++ {
+			p.SequenceNumber = uint16(i)
+			p.Timestamp = uint32(i * 960)
+			r.PushAudio(p)
+		}
+
+		r.Close()
+	}
+
+	reportAllocsPerPacket(b, before, 65535)
+}
+
+func readMemStats() *runtime.MemStats {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	return &stats
+}
+
+// reportAllocsPerPacket reports what was allocated since before, over the
+// packets pushed on each iteration, so a regression on any of them shows
+func reportAllocsPerPacket(b *testing.B, before *runtime.MemStats, packets int) {
+	after := readMemStats()
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/float64(b.N*packets), "allocs/packet")
+}
+
+func TestWebmRecorder_AVSyncSenderClock(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxCorrection time.Duration
+		videoSent     time.Duration // After audio, at the same RTP timestamp
+		correction    time.Duration
+		track         string
+		clamped       bool
+	}{
+		{"Video sent later", time.Second, 200 * time.Millisecond, 200 * time.Millisecond, "video", false},
+		{"Audio sent later", time.Second, -300 * time.Millisecond, 300 * time.Millisecond, "audio", false},
+		{"Clamped", 100 * time.Millisecond, 200 * time.Millisecond, 100 * time.Millisecond, "video", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newAVSyncSource(t)
+			s.r.EnableAVSync(config.AVSync{Enable: true, MaxCorrection: tt.maxCorrection})
+
+			s.run(time.Second, true, true)
+			assert.Equal(t, skewSourceArrival, s.r.GetStats().AVSync.Source)
+
+			s.r.SetSenderClock(false, 0, s.clock)
+			s.r.SetSenderClock(true, 0, s.clock.Add(tt.videoSent))
+			s.run(time.Second, true, true)
+			stats := s.r.GetStats().AVSync
+			s.r.Close()
+
+			assert.Equal(t, skewSourceRTCP, stats.Source)
+			assert.InDelta(t, -tt.videoSent.Milliseconds(), stats.SkewMs, 40)
+			assert.InDelta(t, tt.correction.Milliseconds(), stats.CorrectionMs, 40)
+			assert.Equal(t, tt.track, stats.Track)
+			assert.Equal(t, tt.clamped, stats.Clamped)
+
+			ahead := s.r.VideoTimestamp() - s.r.AudioTimestamp()
+
+			if tt.track == "audio" {
+				ahead = -ahead
+			}
+
+			assert.InDelta(t, tt.correction, ahead, float64(40*time.Millisecond))
+		})
+	}
+}
+
+func TestWebmRecorder_AVSyncArrival(t *testing.T) {
+	s := newAVSyncSource(t)
+	s.r.EnableAVSync(config.AVSync{Enable: true, MaxCorrection: time.Second})
+
+	s.run(maxSkewDelay+time.Second, true, true)
+
+	// Too late into the recording
+	s.r.SetSenderClock(false, 0, s.clock)
+	s.r.SetSenderClock(true, 0, s.clock.Add(200*time.Millisecond))
+	s.run(time.Second, true, true)
+	stats := s.r.GetStats().AVSync
+	s.r.Close()
+
+	assert.Equal(t, skewSourceArrival, stats.Source)
+	assert.Zero(t, stats.CorrectionMs)
+	assert.InDelta(t, s.r.VideoTimestamp(), s.r.AudioTimestamp(), float64(40*time.Millisecond))
+}
+
+func TestValidateAVSync(t *testing.T) {
+	assert.NoError(t, ValidateAVSync(config.AVSync{}))
+	assert.NoError(t, ValidateAVSync(config.AVSync{Enable: true, MaxCorrection: time.Second}))
+	assert.Error(t, ValidateAVSync(config.AVSync{Enable: true}))
+}
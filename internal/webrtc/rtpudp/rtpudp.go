@@ -0,0 +1,812 @@
+// Package rtpudp records plain RTP received on a UDP socket, for sources
+// that don't go through LiveKit or mediasoup (e.g. an SFU forwarding RTP, or
+// GStreamer/FFmpeg). It follows the same flow as the LiveKit adapter: packets
+// are depacketized into samples, accounted for in the track stats and pushed
+// to the recorder.
+package rtpudp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/appstats"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/interfaces"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/utils"
+	"github.com/livekit/server-sdk-go/v2/pkg/jitter"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	notFlowingTicker = time.Millisecond * 100
+	flowingTicker    = time.Millisecond * 1000
+	// Largest UDP payload; RTP packets are usually kept under the MTU
+	maxPacketSize = 65535
+	// Source label of the tracks in metrics and stats
+	trackSource = "rtp"
+)
+
+var errEncryptionUnsupported = errors.New("end-to-end encryption is not supported by the rtp adapter")
+
+type track struct {
+	cfg       events.RTPTrackConfig
+	kind      string
+	mimeType  string
+	clockRate uint32
+	// The configured SSRC, or the first one seen with the payload type
+	ssrc      uint32
+	buffer    *jitter.Buffer
+	stats     *appstats.AdapterTrackStats
+	firstSeen bool
+	// Checks packets against the configured payload type, or the first one
+	// seen if none was
+	codecCheck *utils.CodecChecker
+	// Switched to another codec, its packets are ignored
+	codecMismatch bool
+	duplicates    *utils.DuplicateFilter
+	// Last PLI sent, zero if none yet
+	lastPLI time.Time
+}
+
+// RTPCapture implements interfaces.LiveKitWebRTCInterface so sessions drive
+// it as they do LiveKit captures
+type RTPCapture struct {
+	m        sync.Mutex
+	ctx      context.Context
+	cfg      config.RTP
+	opts     events.RTPConfig
+	rec      recorder.Recorder
+	conn     net.PacketConn
+	rtcpAddr net.Addr
+	tracks   map[string]*track
+	startTs  time.Time
+
+	connStateCallback func(state utils.ConnectionState)
+	flowCallback      func(isFlowing bool, timestamp time.Duration, closed bool)
+	firstPacketCb     func(event interfaces.MediaEvent)
+	firstKeyframeCb   func(event interfaces.MediaEvent)
+	firstKeyframeSeen bool
+
+	// Packets received (all tracks) and when the last one was, for flow checks
+	received   uint64
+	lastRecvTs time.Time
+	isFlowing  bool
+	// Packets not matching any track
+	unmatchedPackets uint64
+
+	readWg   sync.WaitGroup
+	flowDone chan struct{}
+
+	closeOnce   sync.Once
+	closeResult *interfaces.CloseResult
+	endReason   string
+	endErr      error
+}
+
+func NewRTPCapture(
+	ctx context.Context,
+	cfg config.RTP,
+	rec recorder.Recorder,
+	opts events.RTPConfig,
+) *RTPCapture {
+	return &RTPCapture{
+		ctx:      ctx,
+		cfg:      cfg,
+		opts:     opts,
+		rec:      rec,
+		tracks:   make(map[string]*track),
+		startTs:  time.Now(),
+		flowDone: make(chan struct{}),
+	}
+}
+
+func (w *RTPCapture) SetConnectionStateCallback(callback func(state utils.ConnectionState)) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	w.connStateCallback = callback
+}
+
+func (w *RTPCapture) SetFlowCallback(callback func(isFlowing bool, timestamp time.Duration, closed bool)) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	w.flowCallback = callback
+}
+
+// SetStopCallback is kept for the interface: RTP captures only end when
+// stopped or on socket errors
+func (w *RTPCapture) SetStopCallback(callback func(reason string)) {}
+
+func (w *RTPCapture) SetFirstPacketCallback(callback func(event interfaces.MediaEvent)) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	w.firstPacketCb = callback
+}
+
+func (w *RTPCapture) SetFirstKeyframeCallback(callback func(event interfaces.MediaEvent)) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	w.firstKeyframeCb = callback
+}
+
+func (w *RTPCapture) Init() error {
+	if err := w.initTracks(); err != nil {
+		w.setEndReason(interfaces.CloseReasonInitFailed, err)
+		return err
+	}
+
+	if w.opts.RTCPAddress != "" {
+		addr, err := net.ResolveUDPAddr("udp", w.opts.RTCPAddress)
+
+		if err != nil {
+			err = fmt.Errorf("invalid rtcp address: %w", err)
+			w.setEndReason(interfaces.CloseReasonInitFailed, err)
+			return err
+		}
+
+		w.rtcpAddr = addr
+	}
+
+	conn, err := net.ListenPacket("udp", w.opts.ListenAddress)
+
+	if err != nil {
+		w.setEndReason(interfaces.CloseReasonInitFailed, err)
+		return err
+	}
+
+	w.conn = conn
+
+	log.WithField("session", w.ctx.Value("session")).
+		Infof("Receiving RTP on %s for %d tracks, rtcp=%s", conn.LocalAddr(), len(w.tracks), w.opts.RTCPAddress)
+
+	w.rec.SetKeyframeRequester(w)
+
+	if fkc, ok := w.rec.(interface {
+		SetFirstKeyframeCallback(func(timestamp time.Duration))
+	}); ok {
+		fkc.SetFirstKeyframeCallback(w.notifyFirstKeyframe)
+	}
+
+	for _, t := range w.tracks {
+		appstats.OnTrackRecordingStarted(t.kind, t.mimeType, trackSource)
+	}
+
+	w.readWg.Add(2)
+	go w.readPackets()
+	go w.checkFlow()
+
+	return nil
+}
+
+// initTracks sets up a sample buffer per track and tells the recorder what
+// it's going to record
+func (w *RTPCapture) initTracks() error {
+	var hasVideo, hasAudio bool
+
+	// To name the codec of packets a track gets another track's payload
+	// type in
+	payloadTypes := make(map[uint8]string)
+
+	for _, cfg := range w.opts.Tracks {
+		if cfg.PayloadType != 0 {
+			payloadTypes[cfg.PayloadType] = recorder.NormalizeMimeType(cfg.MimeType)
+		}
+	}
+
+	for _, cfg := range w.opts.Tracks {
+		t := &track{
+			cfg:        cfg,
+			mimeType:   recorder.NormalizeMimeType(cfg.MimeType),
+			ssrc:       cfg.SSRC,
+			stats:      &appstats.AdapterTrackStats{StartTime: time.Now().Unix()},
+			duplicates: utils.NewDuplicateFilter(),
+		}
+
+		var depacketizer rtp.Depacketizer
+
+		switch t.mimeType {
+		case recorder.CodecVP8:
+			depacketizer = &codecs.VP8Packet{}
+		case recorder.CodecH264:
+			depacketizer = &codecs.H264Packet{}
+		case recorder.CodecVP9:
+			depacketizer = &codecs.VP9Packet{}
+		case recorder.CodecAV1:
+			depacketizer = &codecs.AV1Depacketizer{}
+		case recorder.CodecOpus, recorder.CodecMultiOpus:
+			depacketizer = &codecs.OpusPacket{}
+		default:
+			return fmt.Errorf("track %s: unsupported codec %s", cfg.ID, cfg.MimeType)
+		}
+
+		if t.mimeType == recorder.CodecOpus || t.mimeType == recorder.CodecMultiOpus {
+			t.kind = "audio"
+			t.clockRate = 48000
+
+			if hasAudio {
+				return fmt.Errorf("track %s: only one audio track can be recorded", cfg.ID)
+			}
+
+			hasAudio = true
+		} else {
+			t.kind = "video"
+			t.clockRate = 90000
+
+			if hasVideo {
+				return fmt.Errorf("track %s: only one video track can be recorded", cfg.ID)
+			}
+
+			hasVideo = true
+		}
+
+		if cfg.ClockRate != 0 {
+			t.clockRate = cfg.ClockRate
+		}
+
+		t.buffer = jitter.NewBuffer(
+			depacketizer,
+			t.clockRate,
+			w.cfg.Latency,
+			jitter.WithPacketDroppedHandler(func() {
+				if t.kind == "video" {
+					w.requestKeyframe(t)
+				}
+			}),
+		)
+
+		if cfg.PayloadType != 0 {
+			t.codecCheck = utils.NewCodecChecker(t.mimeType, cfg.PayloadType, payloadTypes)
+		}
+
+		w.tracks[cfg.ID] = t
+	}
+
+	if hasVideo {
+		w.rec.SetHasVideo(true)
+
+		for _, t := range w.tracks {
+			if t.kind == "video" {
+				if err := w.rec.SetVideoCodec(t.mimeType); err != nil {
+					return fmt.Errorf("track %s: %w", t.cfg.ID, err)
+				}
+			}
+		}
+	}
+
+	if hasAudio {
+		w.rec.SetHasAudio(true)
+
+		for _, t := range w.tracks {
+			if t.kind == "audio" {
+				if err := w.setAudioFormat(t); err != nil {
+					return fmt.Errorf("track %s: %w", t.cfg.ID, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// setAudioFormat passes the configured Opus channel layout to the recorder
+func (w *RTPCapture) setAudioFormat(t *track) error {
+	format, err := recorder.ParseOpusFormat(t.mimeType, t.cfg.Channels, t.cfg.Fmtp)
+
+	if err != nil {
+		return err
+	}
+
+	if afs, ok := w.rec.(interface {
+		SetAudioFormat(format recorder.OpusFormat) error
+	}); ok {
+		return afs.SetAudioFormat(format)
+	}
+
+	return nil
+}
+
+func (w *RTPCapture) readPackets() {
+	defer w.readWg.Done()
+	defer func() {
+		// If a panic occurs, notify the connection state callback as failed so clients can retry/handle it
+		if err := recover(); err != nil {
+			log.WithField("session", w.ctx.Value("session")).
+				WithField("error", err).
+				WithField("stack", string(debug.Stack())).
+				Error("Panic detected in RTP packet processing, emit failed state")
+
+			w.fail(fmt.Errorf("panic processing rtp: %v", err))
+		}
+	}()
+
+	buf := make([]byte, maxPacketSize)
+
+	for {
+		n, _, err := w.conn.ReadFrom(buf)
+
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.WithField("session", w.ctx.Value("session")).
+					Errorf("Failed to read RTP: %v", err)
+				w.fail(err)
+			}
+
+			return
+		}
+
+		// RTCP multiplexed on the same port (RFC 5761) is not needed
+		if n >= 2 && buf[1] >= 192 && buf[1] <= 223 {
+			continue
+		}
+
+		// Samples hold on to packets (and their payloads) until popped
+		packet := &rtp.Packet{}
+
+		if err := packet.Unmarshal(append([]byte(nil), buf[:n]...)); err != nil {
+			log.WithField("session", w.ctx.Value("session")).
+				Tracef("Ignoring invalid RTP packet: %v", err)
+			continue
+		}
+
+		t := w.matchTrack(packet)
+
+		if t == nil {
+			continue
+		}
+
+		w.onPacket(t, packet, n)
+	}
+}
+
+// matchTrack finds the track of a packet by SSRC, then by payload type.
+// Tracks mapped by payload type are bound to the first SSRC seen.
+func (w *RTPCapture) matchTrack(packet *rtp.Packet) *track {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	var byPayloadType *track
+
+	for _, t := range w.tracks {
+		if t.ssrc != 0 && t.ssrc == packet.SSRC {
+			return t
+		}
+
+		if t.ssrc == 0 && t.cfg.PayloadType == packet.PayloadType {
+			byPayloadType = t
+		}
+	}
+
+	if byPayloadType != nil {
+		byPayloadType.ssrc = packet.SSRC
+
+		log.WithField("session", w.ctx.Value("session")).
+			WithField("trackID", byPayloadType.cfg.ID).
+			Infof("Bound payload type %d to SSRC %d", packet.PayloadType, packet.SSRC)
+
+		return byPayloadType
+	}
+
+	w.unmatchedPackets++
+
+	if w.unmatchedPackets == 1 {
+		log.WithField("session", w.ctx.Value("session")).
+			Warnf("Ignoring RTP packets not matching any track: ssrc=%d pt=%d", packet.SSRC, packet.PayloadType)
+	}
+
+	return nil
+}
+
+func (w *RTPCapture) onPacket(t *track, packet *rtp.Packet, size int) {
+	now := time.Now()
+
+	w.m.Lock()
+	w.received++
+	w.lastRecvTs = now
+
+	if t.duplicates.Duplicate(packet.SSRC, packet.SequenceNumber) {
+		t.stats.DuplicatePackets++
+		w.m.Unlock()
+
+		return
+	}
+
+	t.stats.PacketsReceived++
+	t.stats.BytesReceived += uint64(size)
+	first := !t.firstSeen
+	t.firstSeen = true
+
+	if t.codecMismatch {
+		w.m.Unlock()
+		return
+	}
+
+	if t.codecCheck == nil {
+		t.codecCheck = utils.NewCodecChecker(t.mimeType, packet.PayloadType, nil)
+	}
+
+	// Packets of another codec would be written as garbage
+	ok, err := t.codecCheck.Check(packet.PayloadType)
+	t.codecMismatch = err != nil
+	mismatches := t.codecCheck.Mismatches()
+	w.m.Unlock()
+
+	if err != nil {
+		log.WithField("session", w.ctx.Value("session")).
+			WithField("trackID", t.cfg.ID).
+			Errorf("Stopping track recording: %v", err)
+		w.fail(fmt.Errorf("track %s: %w", t.cfg.ID, err))
+
+		return
+	}
+
+	if !ok {
+		if mismatches == 1 {
+			log.WithField("session", w.ctx.Value("session")).
+				WithField("trackID", t.cfg.ID).
+				Warnf("Dropping packet seq=%d of payload type %d", packet.SequenceNumber, packet.PayloadType)
+		}
+
+		return
+	}
+
+	if first {
+		w.notifyFirstPacket(t, packet)
+	}
+
+	t.buffer.Push(packet)
+
+	// A push can complete more than one sample (e.g. when a lost packet is
+	// given up on)
+	for packets := t.buffer.Pop(false); len(packets) > 0; packets = t.buffer.Pop(false) {
+		for _, p := range packets {
+			if t.kind == "video" {
+				w.rec.PushVideo(p)
+			} else {
+				w.rec.PushAudio(p)
+			}
+		}
+
+		w.processPacketStats(t, packets)
+	}
+}
+
+func (w *RTPCapture) processPacketStats(t *track, packets []*rtp.Packet) {
+	w.m.Lock()
+	hadSeqNum, prevSeqNum, wrapArounds := t.stats.HasSeqNum, t.stats.LastSeqNum, t.stats.SeqNumWrapArounds
+	t.stats.OnPacketBatch(packets[0].SequenceNumber, packets[len(packets)-1].SequenceNumber, len(packets))
+	snapshot := *t.stats
+	w.m.Unlock()
+
+	if !hadSeqNum {
+		log.WithField("session", w.ctx.Value("session")).
+			WithField("trackID", t.cfg.ID).
+			WithField("firstSeqNum", snapshot.FirstSeqNum).
+			Debug("Sequence number tracking started")
+	}
+
+	if snapshot.SeqNumWrapArounds != wrapArounds {
+		log.WithField("session", w.ctx.Value("session")).
+			WithField("trackID", t.cfg.ID).
+			WithField("prevSeqNum", prevSeqNum).
+			WithField("batchFirstSeqNum", packets[0].SequenceNumber).
+			WithField("batchLastSeqNum", packets[len(packets)-1].SequenceNumber).
+			WithField("wrapArounds", snapshot.SeqNumWrapArounds).
+			WithField("lossFraction", snapshot.LossFraction).
+			Debug("Sequence number wraparound detected")
+	}
+
+	appstats.UpdateSessionTrackMetrics(w.ctx.Value("session").(string), t.cfg.ID, &snapshot)
+}
+
+// checkFlow reports the capture as flowing while packets keep coming, on
+// any of its tracks
+func (w *RTPCapture) checkFlow() {
+	defer w.readWg.Done()
+
+	ticker := time.NewTicker(notFlowingTicker)
+	defer ticker.Stop()
+
+	var lastReceived uint64
+
+	for {
+		select {
+		case <-w.flowDone:
+			return
+		case <-ticker.C:
+			w.m.Lock()
+			isFlowing := w.received != lastReceived
+			changed := isFlowing != w.isFlowing
+			lastReceived = w.received
+			w.isFlowing = isFlowing
+			timestamp := w.lastRecvTs.Sub(w.startTs)
+			callback := w.flowCallback
+			w.m.Unlock()
+
+			if changed && callback != nil {
+				callback(isFlowing, timestamp, false)
+			}
+
+			if isFlowing {
+				ticker.Reset(flowingTicker)
+			} else {
+				ticker.Reset(notFlowingTicker)
+			}
+		}
+	}
+}
+
+func (w *RTPCapture) notifyFirstPacket(t *track, packet *rtp.Packet) {
+	w.m.Lock()
+	callback := w.firstPacketCb
+	w.m.Unlock()
+
+	event := interfaces.MediaEvent{
+		TrackID:      t.cfg.ID,
+		Kind:         t.kind,
+		Timestamp:    time.Since(w.startTs),
+		RTPTimestamp: packet.Timestamp,
+	}
+
+	log.WithField("session", w.ctx.Value("session")).
+		WithField("trackID", t.cfg.ID).
+		Infof("First %s packet received: ts=%v rtpTs=%d ssrc=%d", t.kind, event.Timestamp, packet.Timestamp, packet.SSRC)
+
+	if callback != nil {
+		callback(event)
+	}
+}
+
+func (w *RTPCapture) notifyFirstKeyframe(mediaTimestamp time.Duration) {
+	w.m.Lock()
+
+	if w.firstKeyframeSeen {
+		w.m.Unlock()
+		return
+	}
+
+	w.firstKeyframeSeen = true
+	callback := w.firstKeyframeCb
+	var trackID string
+
+	for _, t := range w.tracks {
+		if t.kind == "video" {
+			trackID = t.cfg.ID
+		}
+	}
+	w.m.Unlock()
+
+	event := interfaces.MediaEvent{
+		TrackID:        trackID,
+		Kind:           "video",
+		Timestamp:      time.Since(w.startTs),
+		MediaTimestamp: mediaTimestamp,
+	}
+
+	if callback != nil {
+		callback(event)
+	}
+}
+
+// RequestKeyframe sends a PLI for every video track whose SSRC is known.
+// Without an RTCP address configured, this is a no-op.
+func (w *RTPCapture) RequestKeyframe() {
+	w.m.Lock()
+	videoTracks := make([]*track, 0, 1)
+
+	for _, t := range w.tracks {
+		if t.kind == "video" {
+			videoTracks = append(videoTracks, t)
+		}
+	}
+	w.m.Unlock()
+
+	for _, t := range videoTracks {
+		w.requestKeyframe(t)
+	}
+}
+
+func (w *RTPCapture) RequestKeyframeForSSRC(ssrc uint32) {
+	w.m.Lock()
+	var target *track
+
+	for _, t := range w.tracks {
+		if t.kind == "video" && t.ssrc == ssrc {
+			target = t
+		}
+	}
+	w.m.Unlock()
+
+	if target != nil {
+		w.requestKeyframe(target)
+	}
+}
+
+// requestKeyframe sends a PLI to the RTCP address, at most once per
+// cfg.KeyframeRequestInterval. Requests within the interval are dropped.
+func (w *RTPCapture) requestKeyframe(t *track) {
+	if w.rtcpAddr == nil || w.conn == nil {
+		return
+	}
+
+	now := time.Now()
+
+	w.m.Lock()
+	ssrc := t.ssrc
+
+	if ssrc == 0 || (w.cfg.KeyframeRequestInterval > 0 && !t.lastPLI.IsZero() &&
+		now.Sub(t.lastPLI) < w.cfg.KeyframeRequestInterval) {
+		w.m.Unlock()
+		return
+	}
+
+	t.lastPLI = now
+	t.stats.PLIRequests++
+	w.m.Unlock()
+
+	b, err := rtcp.Marshal([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}})
+
+	if err == nil {
+		_, err = w.conn.WriteTo(b, w.rtcpAddr)
+	}
+
+	if err != nil {
+		log.WithField("session", w.ctx.Value("session")).
+			WithField("trackID", t.cfg.ID).
+			Warnf("Failed to send PLI for SSRC %d: %v", ssrc, err)
+		return
+	}
+
+	log.WithField("session", w.ctx.Value("session")).
+		Tracef("Requested keyframe for SSRC %d", ssrc)
+}
+
+func (w *RTPCapture) HasTrack(trackID string) bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	_, ok := w.tracks[trackID]
+
+	return ok
+}
+
+func (w *RTPCapture) SetEncryptionKey(key string, index uint8) error {
+	return errEncryptionUnsupported
+}
+
+func (w *RTPCapture) GetStats() *appstats.CaptureStats {
+	stats := &appstats.CaptureStats{
+		RecorderSessionUUID: w.ctx.Value("session").(string),
+		FileName:            w.rec.GetFilePath(),
+		Tracks:              make(map[string]*appstats.TrackStats, len(w.tracks)),
+	}
+	buffers := make(map[string]*jitter.Buffer, len(w.tracks))
+
+	w.m.Lock()
+	for trackID, t := range w.tracks {
+		adapterStats := *t.stats
+		buffers[trackID] = t.buffer
+
+		stats.Tracks[trackID] = &appstats.TrackStats{
+			Source:    trackSource,
+			Adapter:   &adapterStats,
+			TrackKind: t.kind,
+			MimeType:  t.mimeType,
+		}
+	}
+	w.m.Unlock()
+
+	// Sample buffers call back into the capture (on drops) with their lock
+	// held, and the recorder may hold its lock while requesting keyframes:
+	// neither can be queried with w.m held
+	for trackID, buffer := range buffers {
+		bufferStats := buffer.Stats()
+		stats.Tracks[trackID].Buffer = &appstats.BufferStatsWrapper{
+			PacketsPushed:  bufferStats.PacketsPushed,
+			PacketsPopped:  bufferStats.PacketsPopped,
+			PacketsDropped: bufferStats.PacketsDropped,
+			PaddingPushed:  bufferStats.PaddingPushed,
+			SamplesPopped:  bufferStats.SamplesPopped,
+		}
+	}
+
+	recStats := w.rec.GetStats()
+
+	if recStats == nil {
+		return stats
+	}
+
+	for _, track := range stats.Tracks {
+		if track.TrackKind == "video" {
+			track.RecorderTrackStats = recStats.Video
+		} else {
+			track.RecorderTrackStats = recStats.Audio
+		}
+	}
+
+	return stats
+}
+
+// fail ends the capture on an unrecoverable error
+func (w *RTPCapture) fail(err error) {
+	w.setEndReason(interfaces.CloseReasonError, err)
+
+	w.m.Lock()
+	callback := w.connStateCallback
+	w.m.Unlock()
+
+	if callback != nil {
+		callback(utils.ConnectionStateFailed)
+	}
+}
+
+// setEndReason records why the capture is ending. Only the first reason
+// sticks: later ones are usually fallout from the first.
+func (w *RTPCapture) setEndReason(reason string, err error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.endReason == "" {
+		w.endReason = reason
+		w.endErr = err
+	}
+}
+
+func (w *RTPCapture) Close() time.Duration {
+	return w.CloseWithResult().Duration
+}
+
+// CloseWithResult releases the socket and closes the recorder. Only the
+// first call does any work; later calls return the same result.
+func (w *RTPCapture) CloseWithResult() *interfaces.CloseResult {
+	w.closeOnce.Do(func() {
+		w.closeResult = w.close()
+	})
+
+	return w.closeResult
+}
+
+func (w *RTPCapture) close() *interfaces.CloseResult {
+	if w.conn != nil {
+		_ = w.conn.Close()
+		close(w.flowDone)
+		w.readWg.Wait()
+
+		for _, t := range w.tracks {
+			appstats.OnTrackRecordingStopped(t.kind, t.mimeType, trackSource)
+		}
+	}
+
+	sessionID := w.ctx.Value("session").(string)
+
+	for trackID := range w.tracks {
+		appstats.DeleteSessionTrackMetrics(sessionID, trackID)
+	}
+
+	w.setEndReason(interfaces.CloseReasonNormal, nil)
+	w.m.Lock()
+	result := &interfaces.CloseResult{
+		Reason: w.endReason,
+		Err:    w.endErr,
+	}
+	w.m.Unlock()
+
+	if w.rec != nil {
+		result.Duration = w.rec.Close()
+		result.Stats = w.rec.GetStats()
+	}
+
+	return result
+}
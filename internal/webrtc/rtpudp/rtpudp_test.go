@@ -0,0 +1,351 @@
+package rtpudp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/config"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/pubsub/events"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/types"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/interfaces"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/recorder"
+	"github.com/bigbluebutton/bbb-webrtc-recorder/internal/webrtc/utils"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockRecorder implements the recorder.Recorder interface for testing
+type mockRecorder struct {
+	m          sync.Mutex
+	video      []*rtp.Packet
+	audio      []*rtp.Packet
+	hasAudio   bool
+	hasVideo   bool
+	videoCodec string
+	format     recorder.OpusFormat
+}
+
+func (m *mockRecorder) SetAudioFormat(format recorder.OpusFormat) error {
+	m.format = format
+	return nil
+}
+
+func (m *mockRecorder) GetFilePath() string { return "test.webm" }
+
+func (m *mockRecorder) GetStats() *types.RecorderStats {
+	return &types.RecorderStats{Video: &types.RecorderTrackStats{}, Audio: &types.RecorderTrackStats{}}
+}
+
+func (m *mockRecorder) PushVideo(packet *rtp.Packet) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.video = append(m.video, packet)
+}
+
+func (m *mockRecorder) PushAudio(packet *rtp.Packet) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.audio = append(m.audio, packet)
+}
+
+func (m *mockRecorder) pushed() (video, audio int) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return len(m.video), len(m.audio)
+}
+
+func (m *mockRecorder) NotifySkippedPacket(seq uint16)                              {}
+func (m *mockRecorder) WithContext(ctx context.Context)                             {}
+func (m *mockRecorder) VideoTimestamp() time.Duration                               { return 0 }
+func (m *mockRecorder) AudioTimestamp() time.Duration                               { return 0 }
+func (m *mockRecorder) ReceivedPackets() uint64                                     { return 0 }
+func (m *mockRecorder) FileStats() types.FileStats                                  { return types.FileStats{} }
+func (m *mockRecorder) SetHasAudio(hasAudio bool)                                   { m.hasAudio = hasAudio }
+func (m *mockRecorder) SetHasVideo(hasVideo bool)                                   { m.hasVideo = hasVideo }
+func (m *mockRecorder) SetKeyframeRequester(requester interfaces.KeyframeRequester) {}
+func (m *mockRecorder) GetHasAudio() bool                                           { return m.hasAudio }
+func (m *mockRecorder) GetHasVideo() bool                                           { return m.hasVideo }
+func (m *mockRecorder) SetVideoCodec(mimeType string) error                         { m.videoCodec = mimeType; return nil }
+func (m *mockRecorder) SetVideoLayer(layer string, width, height uint32)            {}
+func (m *mockRecorder) Pause()                                                      {}
+func (m *mockRecorder) Resume()                                                     {}
+func (m *mockRecorder) Close() time.Duration                                        { return time.Second }
+
+func setupCapture(t *testing.T, opts events.RTPConfig) (*RTPCapture, *mockRecorder, net.Conn) {
+	ctx := context.WithValue(context.Background(), "session", "test-session")
+	rec := &mockRecorder{}
+	cfg := config.RTP{Latency: 200 * time.Millisecond, KeyframeRequestInterval: time.Second}
+	capture := NewRTPCapture(ctx, cfg, rec, opts)
+	require.NoError(t, capture.Init())
+	t.Cleanup(func() { capture.Close() })
+
+	sender, err := net.Dial("udp", capture.conn.LocalAddr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { sender.Close() })
+
+	return capture, rec, sender
+}
+
+func sendRTP(t *testing.T, conn net.Conn, ssrc uint32, pt uint8, seq uint16, payload []byte) {
+	b, err := (&rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         true,
+			PayloadType:    pt,
+			SequenceNumber: seq,
+			Timestamp:      uint32(seq) * 3000,
+			SSRC:           ssrc,
+		},
+		Payload: payload,
+	}).Marshal()
+	require.NoError(t, err)
+
+	_, err = conn.Write(b)
+	require.NoError(t, err)
+}
+
+// Single packet VP8 frames: S bit set, partition 0
+var vp8Frame = []byte{0x10, 0x00, 0x9d, 0x01, 0x2a}
+
+func TestRTPCapture_Record(t *testing.T) {
+	capture, rec, sender := setupCapture(t, events.RTPConfig{
+		ListenAddress: "127.0.0.1:0",
+		Tracks: []events.RTPTrackConfig{
+			{ID: "video", SSRC: 1111, MimeType: "video/VP8"},
+			{ID: "audio", PayloadType: 111, MimeType: "audio/opus"},
+		},
+	})
+
+	assert.True(t, rec.hasVideo)
+	assert.True(t, rec.hasAudio)
+	assert.Equal(t, "video/vp8", rec.videoCodec)
+
+	firstPackets := make(chan interfaces.MediaEvent, 2)
+	capture.SetFirstPacketCallback(func(event interfaces.MediaEvent) {
+		firstPackets <- event
+	})
+
+	flowing := make(chan bool, 2)
+	capture.SetFlowCallback(func(isFlowing bool, timestamp time.Duration, closed bool) {
+		flowing <- isFlowing
+	})
+
+	// Wraps around, as the sequence numbers of any long recording do
+	for i := range 6 {
+		seq := uint16(65533 + i)
+		sendRTP(t, sender, 1111, 96, seq, vp8Frame)
+		sendRTP(t, sender, 2222, 111, seq, []byte{0x78, 0x01})
+	}
+
+	// Not mapped to any track
+	sendRTP(t, sender, 3333, 100, 1, vp8Frame)
+
+	require.Eventually(t, func() bool {
+		video, audio := rec.pushed()
+		return video == 6 && audio == 6
+	}, 2*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, "video", (<-firstPackets).TrackID)
+	assert.Equal(t, "audio", (<-firstPackets).TrackID)
+	assert.True(t, <-flowing)
+
+	stats := capture.GetStats()
+	require.Len(t, stats.Tracks, 2)
+
+	video := stats.Tracks["video"]
+	assert.Equal(t, "video", video.TrackKind)
+	assert.Equal(t, uint16(65533), video.Adapter.FirstSeqNum)
+	assert.Equal(t, uint16(2), video.Adapter.LastSeqNum)
+	assert.Equal(t, 1, video.Adapter.SeqNumWrapArounds)
+	assert.Equal(t, uint64(6), video.Adapter.SeqNumPackets)
+	assert.Equal(t, float64(0), video.Adapter.LossFraction)
+	assert.Equal(t, uint64(6), video.Buffer.PacketsPopped)
+
+	assert.Equal(t, uint32(2222), capture.tracks["audio"].ssrc, "Payload type mapping binds the SSRC")
+	assert.Equal(t, uint64(1), capture.unmatchedPackets)
+
+	result := capture.CloseWithResult()
+	assert.Equal(t, interfaces.CloseReasonNormal, result.Reason)
+	assert.Equal(t, time.Second, result.Duration)
+}
+
+func TestRTPCapture_DuplicatePackets(t *testing.T) {
+	capture, rec, sender := setupCapture(t, events.RTPConfig{
+		ListenAddress: "127.0.0.1:0",
+		Tracks:        []events.RTPTrackConfig{{ID: "video", SSRC: 1111, MimeType: "video/VP8"}},
+	})
+
+	// Each packet twice, across a wraparound
+	for i := range 4 {
+		seq := uint16(65534 + i)
+		sendRTP(t, sender, 1111, 96, seq, vp8Frame)
+		sendRTP(t, sender, 1111, 96, seq, vp8Frame)
+	}
+
+	require.Eventually(t, func() bool {
+		capture.m.Lock()
+		defer capture.m.Unlock()
+
+		return capture.tracks["video"].stats.DuplicatePackets == 4
+	}, 2*time.Second, 10*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		video, _ := rec.pushed()
+		return video == 4
+	}, 2*time.Second, 10*time.Millisecond)
+
+	video := capture.GetStats().Tracks["video"]
+	assert.Equal(t, uint64(4), video.Adapter.PacketsReceived)
+	assert.Equal(t, uint64(4), video.Adapter.SeqNumPackets)
+	assert.Equal(t, 1, video.Adapter.SeqNumWrapArounds)
+}
+
+func TestRTPCapture_RequestKeyframe(t *testing.T) {
+	rtcpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer rtcpConn.Close()
+
+	capture, rec, sender := setupCapture(t, events.RTPConfig{
+		ListenAddress: "127.0.0.1:0",
+		RTCPAddress:   rtcpConn.LocalAddr().String(),
+		Tracks:        []events.RTPTrackConfig{{ID: "video", PayloadType: 96, MimeType: "video/vp8"}},
+	})
+
+	// The SSRC isn't known until the first packet
+	capture.RequestKeyframe()
+
+	sendRTP(t, sender, 1111, 96, 1, vp8Frame)
+	require.Eventually(t, func() bool {
+		video, _ := rec.pushed()
+		return video == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	capture.RequestKeyframe()
+	// Throttled
+	capture.RequestKeyframeForSSRC(1111)
+
+	buf := make([]byte, 1500)
+	require.NoError(t, rtcpConn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, _, err := rtcpConn.ReadFrom(buf)
+	require.NoError(t, err)
+
+	packets, err := rtcp.Unmarshal(buf[:n])
+	require.NoError(t, err)
+	require.Len(t, packets, 1)
+	pli, ok := packets[0].(*rtcp.PictureLossIndication)
+	require.True(t, ok)
+	assert.Equal(t, uint32(1111), pli.MediaSSRC)
+
+	assert.Equal(t, 1, capture.GetStats().Tracks["video"].Adapter.PLIRequests)
+}
+
+func TestRTPCapture_InitErrors(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "session", "test-session")
+
+	capture := NewRTPCapture(ctx, config.RTP{}, &mockRecorder{}, events.RTPConfig{
+		ListenAddress: "127.0.0.1:0",
+		Tracks:        []events.RTPTrackConfig{{ID: "video", SSRC: 1, MimeType: "video/h265"}},
+	})
+	assert.Error(t, capture.Init(), "Unsupported codec")
+	assert.Equal(t, interfaces.CloseReasonInitFailed, capture.CloseWithResult().Reason)
+
+	capture = NewRTPCapture(ctx, config.RTP{}, &mockRecorder{}, events.RTPConfig{
+		ListenAddress: "127.0.0.1:0",
+		Tracks: []events.RTPTrackConfig{
+			{ID: "video1", SSRC: 1, MimeType: "video/vp8"},
+			{ID: "video2", SSRC: 2, MimeType: "video/vp8"},
+		},
+	})
+	assert.Error(t, capture.Init(), "More than one video track")
+
+	assert.ErrorIs(t, capture.SetEncryptionKey("key", 0), errEncryptionUnsupported)
+}
+
+func TestRTPCapture_AudioFormat(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "session", "test-session")
+
+	rec := &mockRecorder{}
+	capture := NewRTPCapture(ctx, config.RTP{}, rec, events.RTPConfig{
+		ListenAddress: "127.0.0.1:0",
+		Tracks:        []events.RTPTrackConfig{{ID: "audio", SSRC: 1, MimeType: "audio/opus", Fmtp: "stereo=1"}},
+	})
+	require.NoError(t, capture.Init())
+	capture.Close()
+	assert.Equal(t, uint8(2), rec.format.Channels)
+
+	rec = &mockRecorder{}
+	capture = NewRTPCapture(ctx, config.RTP{}, rec, events.RTPConfig{
+		ListenAddress: "127.0.0.1:0",
+		Tracks: []events.RTPTrackConfig{{
+			ID: "audio", SSRC: 1, MimeType: "audio/multiopus", Channels: 6,
+			Fmtp: "channel_mapping=0,4,1,2,3,5;coupled_streams=2;num_streams=4",
+		}},
+	})
+	require.NoError(t, capture.Init())
+	capture.Close()
+	assert.Equal(t, uint8(6), rec.format.Channels)
+	assert.Equal(t, uint8(4), rec.format.Streams)
+	assert.True(t, rec.hasAudio)
+
+	capture = NewRTPCapture(ctx, config.RTP{}, &mockRecorder{}, events.RTPConfig{
+		ListenAddress: "127.0.0.1:0",
+		Tracks:        []events.RTPTrackConfig{{ID: "audio", SSRC: 1, MimeType: "audio/multiopus", Channels: 6}},
+	})
+	assert.Error(t, capture.Init(), "Multiopus needs a stream layout")
+}
+
+func TestRTPCapture_CodecMismatch(t *testing.T) {
+	capture, rec, sender := setupCapture(t, events.RTPConfig{
+		ListenAddress: "127.0.0.1:0",
+		Tracks: []events.RTPTrackConfig{
+			{ID: "video", SSRC: 1111, MimeType: "video/vp8"},
+			{ID: "audio", PayloadType: 111, MimeType: "audio/opus"},
+		},
+	})
+
+	states := make(chan utils.ConnectionState, 1)
+	capture.SetConnectionStateCallback(func(state utils.ConnectionState) {
+		states <- state
+	})
+
+	// A stray packet is left out
+	sendRTP(t, sender, 1111, 96, 1, vp8Frame)
+	sendRTP(t, sender, 1111, 111, 2, []byte{0x78, 0x01})
+
+	// Given up on as lost once past the buffer's latency
+	for seq := uint16(3); seq < 12; seq++ {
+		sendRTP(t, sender, 1111, 96, seq, vp8Frame)
+	}
+
+	require.Eventually(t, func() bool {
+		video, audio := rec.pushed()
+		return video >= 2 && audio == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Empty(t, states)
+	pushed, _ := rec.pushed()
+
+	for i := range 25 {
+		sendRTP(t, sender, 1111, 102, uint16(12+i), []byte{0x7c, 0x85, 0x00})
+	}
+
+	select {
+	case state := <-states:
+		assert.Equal(t, utils.ConnectionStateFailed, state)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Capture didn't fail")
+	}
+
+	result := capture.CloseWithResult()
+	assert.Equal(t, interfaces.CloseReasonError, result.Reason)
+	assert.ErrorIs(t, result.Err, utils.ErrCodecMismatch)
+	assert.EqualError(t, result.Err,
+		"track video: codec mismatch: got unknown codec (payload type 102), expected video/vp8 (payload type 96)")
+
+	video, _ := rec.pushed()
+	assert.Equal(t, pushed, video, "Nothing of the other codec is recorded")
+}
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// codecMismatchPackets is how many packets in a row have to carry another
+// payload type for a track to be taken as switched to another codec
+const codecMismatchPackets = 25
+
+var ErrCodecMismatch = errors.New("codec mismatch")
+
+// CodecChecker validates the payload type of a track's packets against the
+// codec it's recorded as. Packets of another payload type aren't to be
+// recorded; once enough of them arrive in a row, e.g. after the publisher
+// renegotiated, Check fails.
+type CodecChecker struct {
+	mimeType    string
+	payloadType uint8
+	// Negotiated codecs by payload type, to name the one detected
+	codecs     map[uint8]string
+	mismatches int
+}
+
+func NewCodecChecker(mimeType string, payloadType uint8, codecs map[uint8]string) *CodecChecker {
+	return &CodecChecker{
+		mimeType:    mimeType,
+		payloadType: payloadType,
+		codecs:      codecs,
+	}
+}
+
+// Check returns whether a packet of payloadType is of the track's codec,
+// and an ErrCodecMismatch naming the detected and expected codecs once the
+// mismatch persists
+func (c *CodecChecker) Check(payloadType uint8) (bool, error) {
+	if payloadType == c.payloadType {
+		c.mismatches = 0
+		return true, nil
+	}
+
+	detected, ok := c.codecs[payloadType]
+
+	if !ok {
+		detected = "unknown codec"
+	}
+
+	return false, c.mismatch(fmt.Sprintf("%s (payload type %d)", detected, payloadType))
+}
+
+// CheckUnnegotiated accounts for a packet of a payload type that wasn't
+// negotiated, which pion fails to read rather than returning it
+func (c *CodecChecker) CheckUnnegotiated() error {
+	return c.mismatch("a payload type that wasn't negotiated")
+}
+
+func (c *CodecChecker) mismatch(detected string) error {
+	c.mismatches++
+
+	if c.mismatches < codecMismatchPackets {
+		return nil
+	}
+
+	return fmt.Errorf("%w: got %s, expected %s (payload type %d)",
+		ErrCodecMismatch, detected, c.mimeType, c.payloadType)
+}
+
+// Mismatches returns how many packets in a row didn't match
+func (c *CodecChecker) Mismatches() int {
+	return c.mismatches
+}
+
+// CodecNames returns the MIME types of the negotiated codecs, by payload type
+func CodecNames(params webrtc.RTPParameters) map[uint8]string {
+	names := make(map[uint8]string, len(params.Codecs))
+
+	for _, codec := range params.Codecs {
+		names[uint8(codec.PayloadType)] = codec.MimeType
+	}
+
+	return names
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestCodecChecker(t *testing.T) {
+	codecs := CodecNames(webrtc.RTPParameters{Codecs: []webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, PayloadType: 96},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, PayloadType: 102},
+	}})
+	checker := NewCodecChecker("video/vp8", 96, codecs)
+
+	if ok, err := checker.Check(96); !ok || err != nil {
+		t.Fatalf("Expected match, got ok=%t err=%v", ok, err)
+	}
+
+	// Stray packets are left out without failing
+	for i := 0; i < codecMismatchPackets-1; i++ {
+		if ok, err := checker.Check(102); ok || err != nil {
+			t.Fatalf("Expected stray packet %d to be left out, got ok=%t err=%v", i, ok, err)
+		}
+	}
+
+	if ok, _ := checker.Check(96); !ok || checker.Mismatches() != 0 {
+		t.Fatalf("Expected a match to reset mismatches, got %d", checker.Mismatches())
+	}
+
+	var err error
+
+	for i := 0; i < codecMismatchPackets && err == nil; i++ {
+		_, err = checker.Check(102)
+	}
+
+	if !errors.Is(err, ErrCodecMismatch) {
+		t.Fatalf("Expected codec mismatch, got %v", err)
+	}
+
+	expected := "codec mismatch: got video/H264 (payload type 102), expected video/vp8 (payload type 96)"
+
+	if err.Error() != expected {
+		t.Errorf("Unexpected error. Expected: %q, Got: %q", expected, err.Error())
+	}
+
+	checker = NewCodecChecker("audio/opus", 111, nil)
+
+	for i := 0; i < codecMismatchPackets-1; i++ {
+		if err := checker.CheckUnnegotiated(); err != nil {
+			t.Fatalf("Expected stray packet %d to be left out, got %v", i, err)
+		}
+	}
+
+	if err := checker.CheckUnnegotiated(); err == nil {
+		t.Fatal("Expected unnegotiated payload types to count as mismatches")
+	}
+
+	checker.Check(111)
+
+	for i := 0; i < codecMismatchPackets; i++ {
+		_, err = checker.Check(63)
+	}
+
+	expected = "codec mismatch: got unknown codec (payload type 63), expected audio/opus (payload type 111)"
+
+	if err == nil || err.Error() != expected {
+		t.Errorf("Unexpected error. Expected: %q, Got: %v", expected, err)
+	}
+}
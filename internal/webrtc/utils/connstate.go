@@ -62,6 +62,17 @@ func NormalizeLiveKitDisconnectReason(reason lksdk.DisconnectionReason) Connecti
 	}
 }
 
+// IsLiveKitDisconnectRecoverable returns true if rejoining the room after a
+// disconnect with the given reason may succeed
+func IsLiveKitDisconnectRecoverable(reason lksdk.DisconnectionReason) bool {
+	switch reason {
+	case lksdk.Failed, lksdk.OtherReason:
+		return true
+	default:
+		return false
+	}
+}
+
 func (s ConnectionState) String() string {
 	switch s {
 	case ConnectionStateNew:
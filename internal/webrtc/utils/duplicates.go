@@ -0,0 +1,53 @@
+package utils
+
+// How far back (in packets) duplicates are recognized
+const duplicateWindow = 1024
+
+// DuplicateFilter recognizes packets of a stream received more than once,
+// e.g. over lossy or bonded links, by their sequence number. Sequence
+// numbers are unwrapped, so one coming back around after a wraparound isn't
+// taken for a duplicate; packets older than the window aren't either.
+type DuplicateFilter struct {
+	su      *SequenceUnwrapper
+	ssrc    uint32
+	started bool
+	maxSeq  int64
+	// Unwrapped sequence numbers + 1 of recent packets, by seq % duplicateWindow
+	seen [duplicateWindow]int64
+}
+
+func NewDuplicateFilter() *DuplicateFilter {
+	return &DuplicateFilter{
+		su: NewSequenceUnwrapper(16),
+	}
+}
+
+// Duplicate returns whether seq of ssrc was already received, recording it
+// otherwise
+func (f *DuplicateFilter) Duplicate(ssrc uint32, seq uint16) bool {
+	// A new SSRC (e.g. after a reconnect) restarts sequence numbers
+	if f.started && ssrc != f.ssrc {
+		f.su = NewSequenceUnwrapper(16)
+		f.started = false
+		clear(f.seen[:])
+	}
+
+	unwrapped := f.su.Unwrap(uint64(seq))
+
+	if !f.started {
+		f.started = true
+		f.ssrc = ssrc
+		f.maxSeq = unwrapped
+	} else if unwrapped <= f.maxSeq-duplicateWindow || unwrapped < 0 {
+		// Too old to tell, late rather than duplicated
+		return false
+	} else if f.seen[unwrapped%duplicateWindow] == unwrapped+1 {
+		return true
+	} else if unwrapped > f.maxSeq {
+		f.maxSeq = unwrapped
+	}
+
+	f.seen[unwrapped%duplicateWindow] = unwrapped + 1
+
+	return false
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDuplicateFilter(t *testing.T) {
+	f := NewDuplicateFilter()
+
+	assert.False(t, f.Duplicate(1, 100))
+	assert.False(t, f.Duplicate(1, 101))
+	assert.True(t, f.Duplicate(1, 100))
+	assert.True(t, f.Duplicate(1, 101))
+
+	// Reordered, not duplicated
+	assert.False(t, f.Duplicate(1, 103))
+	assert.False(t, f.Duplicate(1, 102))
+	assert.True(t, f.Duplicate(1, 102))
+
+	// Too far back to tell
+	for seq := uint16(104); seq < 104+duplicateWindow; seq++ {
+		assert.False(t, f.Duplicate(1, seq))
+	}
+
+	assert.False(t, f.Duplicate(1, 100))
+
+	// A new SSRC restarts sequence numbers
+	assert.False(t, f.Duplicate(2, 101))
+	assert.True(t, f.Duplicate(2, 101))
+}
+
+func TestDuplicateFilter_Wraparound(t *testing.T) {
+	f := NewDuplicateFilter()
+
+	// Across several wraparounds, sequence numbers coming back around
+	// aren't duplicates
+	seq := uint16(65530)
+
+	for range 3 * 65536 {
+		if !assert.False(t, f.Duplicate(1, seq), "seq %d", seq) {
+			return
+		}
+
+		seq++
+	}
+
+	assert.True(t, f.Duplicate(1, seq-1))
+
+	// Duplicated right across a wraparound
+	f = NewDuplicateFilter()
+	assert.False(t, f.Duplicate(1, 65535))
+	assert.False(t, f.Duplicate(1, 0))
+	assert.True(t, f.Duplicate(1, 65535))
+	assert.True(t, f.Duplicate(1, 0))
+	assert.False(t, f.Duplicate(1, 1))
+}
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// supportedHeaderExtensions are the URIs of the header extensions the
+// recorder can do something with
+var supportedHeaderExtensions = map[string]bool{
+	sdp.AudioLevelURI:  true,
+	sdp.TransportCCURI: true,
+}
+
+// HeaderExtensions is the set of RTP header extensions to parse, by URI.
+// IDs are always the ones negotiated, never assumed.
+type HeaderExtensions map[string]bool
+
+func NewHeaderExtensions(uris []string) HeaderExtensions {
+	e := make(HeaderExtensions, len(uris))
+
+	for _, uri := range uris {
+		e[uri] = true
+	}
+
+	return e
+}
+
+// ValidateHeaderExtensions checks that the recorder can parse the header
+// extensions of uris
+func ValidateHeaderExtensions(uris []string) error {
+	for _, uri := range uris {
+		if !supportedHeaderExtensions[uri] {
+			return fmt.Errorf("unsupported header extension %q", uri)
+		}
+	}
+
+	return nil
+}
+
+// AudioLevelID returns the negotiated ID of the RFC 6464 audio level header
+// extension, 0 if it wasn't negotiated or isn't parsed
+func (e HeaderExtensions) AudioLevelID(params webrtc.RTPParameters) uint8 {
+	return e.id(params, sdp.AudioLevelURI)
+}
+
+// TransportCCID returns the negotiated ID of the transport-wide congestion
+// control header extension, 0 if it wasn't negotiated or isn't parsed
+func (e HeaderExtensions) TransportCCID(params webrtc.RTPParameters) uint8 {
+	return e.id(params, sdp.TransportCCURI)
+}
+
+func (e HeaderExtensions) id(params webrtc.RTPParameters, uri string) uint8 {
+	if !e[uri] {
+		return 0
+	}
+
+	for _, ext := range params.HeaderExtensions {
+		if ext.URI == uri {
+			return uint8(ext.ID)
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderExtensions(t *testing.T) {
+	params := webrtc.RTPParameters{HeaderExtensions: []webrtc.RTPHeaderExtensionParameter{
+		{URI: sdp.TransportCCURI, ID: 5},
+		{URI: sdp.AudioLevelURI, ID: 9},
+	}}
+
+	all := NewHeaderExtensions([]string{sdp.AudioLevelURI, sdp.TransportCCURI})
+	assert.Equal(t, uint8(9), all.AudioLevelID(params), "The negotiated ID")
+	assert.Equal(t, uint8(5), all.TransportCCID(params))
+	assert.Zero(t, all.AudioLevelID(webrtc.RTPParameters{}), "Not negotiated")
+
+	audioLevel := NewHeaderExtensions([]string{sdp.AudioLevelURI})
+	assert.Equal(t, uint8(9), audioLevel.AudioLevelID(params))
+	assert.Zero(t, audioLevel.TransportCCID(params), "Not parsed")
+
+	assert.Zero(t, NewHeaderExtensions(nil).AudioLevelID(params))
+}
+
+func TestValidateHeaderExtensions(t *testing.T) {
+	assert.NoError(t, ValidateHeaderExtensions([]string{sdp.AudioLevelURI, sdp.TransportCCURI}))
+	assert.NoError(t, ValidateHeaderExtensions(nil))
+	assert.Error(t, ValidateHeaderExtensions([]string{sdp.ABSSendTimeURI}))
+}
@@ -38,6 +38,7 @@ type WebRTC struct {
 	videoTrackSSRCs     []uint32
 	pliStats            map[uint32]PLITracker
 	sdpOffer            webrtc.SessionDescription
+	headerExtensions    utils.HeaderExtensions
 	m                   sync.Mutex
 }
 
@@ -51,6 +52,7 @@ func NewWebRTC(ctx context.Context, cfg config.WebRTC, rec recorder.Recorder) *W
 		flowCallback:        nil,
 		videoTrackSSRCs:     make([]uint32, 0),
 		pliStats:            make(map[uint32]PLITracker),
+		headerExtensions:    utils.NewHeaderExtensions(cfg.HeaderExtensions),
 	}
 }
 
@@ -123,6 +125,12 @@ func (w *WebRTC) Init() (webrtc.SessionDescription, error) {
 	}, webrtc.RTPCodecTypeAudio); err != nil {
 		panic(err)
 	}
+	// Audio levels are used for voice activity stats
+	if w.headerExtensions[sdp.AudioLevelURI] {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+			panic(err)
+		}
+	}
 
 	se := &webrtc.SettingEngine{}
 	se.SetSRTPReplayProtectionWindow(1024)
@@ -171,6 +179,28 @@ func (w *WebRTC) Init() (webrtc.SessionDescription, error) {
 
 		if isAudio {
 			w.rec.SetHasAudio(true)
+
+			if afs, ok := w.rec.(interface {
+				SetAudioFormat(format recorder.OpusFormat) error
+			}); ok {
+				codec := track.Codec()
+				format, err := recorder.ParseOpusFormat(codec.MimeType, 0, codec.SDPFmtpLine)
+
+				if err == nil {
+					err = afs.SetAudioFormat(format)
+				}
+
+				if err != nil {
+					log.WithField("session", w.ctx.Value("session")).
+						Errorf("Failed to set audio format: %v", err)
+				}
+			}
+
+			if id := w.headerExtensions.AudioLevelID(receiver.GetParameters()); id != 0 {
+				if alr, ok := w.rec.(interface{ SetAudioLevelExtensionID(id uint8) }); ok {
+					alr.SetAudioLevelExtensionID(id)
+				}
+			}
 		} else if isVideo {
 			w.rec.SetHasVideo(true)
 		}
@@ -519,7 +549,7 @@ func (w *WebRTC) RequestKeyframe() {
 	}
 }
 
-func (w WebRTC) RequestKeyframeForSSRC(ssrc uint32) {
+func (w *WebRTC) RequestKeyframeForSSRC(ssrc uint32) {
 	err := w.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}})
 
 	if err != nil {